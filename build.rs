@@ -1,8 +1,100 @@
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
+use std::process::Command;
 use std::{env, fs};
 
+/// Crates whose versions are passed to the library, with the variable they are passed in.
+const VERSIONED_CRATES: [(&str, &str); 5] = [
+    ("iroh", "IROH_FFI_IROH_VERSION"),
+    ("iroh-blobs", "IROH_FFI_IROH_BLOBS_VERSION"),
+    ("iroh-docs", "IROH_FFI_IROH_DOCS_VERSION"),
+    ("iroh-gossip", "IROH_FFI_IROH_GOSSIP_VERSION"),
+    ("uniffi", "IROH_FFI_UNIFFI_VERSION"),
+];
+
 fn main() {
+    // declaring any file disables the default of rerunning on every change in the package
+    for path in ["build.rs", "Cargo.toml", "iroh.pc.in"] {
+        println!("cargo:rerun-if-changed={path}");
+    }
+    for var in ["PREFIX", "LIBDIR", "INCLUDEDIR"] {
+        println!("cargo:rerun-if-env-changed={var}");
+    }
     build_pc();
+    build_versions();
+}
+
+/// Pass the locked versions of the iroh crates and the git commit to the library, see
+/// `version_info`.
+///
+/// The lock file is not checked in and missing when the library is built as a dependency, the
+/// requirements of the manifest are passed instead.
+fn build_versions() {
+    let manifest_dir = PathBuf::from(env::var("CARGO_MANIFEST_DIR").unwrap());
+    let lock_path = manifest_dir.join("Cargo.lock");
+    let lock = match fs::read_to_string(&lock_path) {
+        Ok(lock) => {
+            rerun_if_exists(&lock_path);
+            Some(lock)
+        }
+        Err(_) => {
+            println!("cargo:warning=Cargo.lock not found, reporting the required crate versions");
+            None
+        }
+    };
+    let manifest = fs::read_to_string(manifest_dir.join("Cargo.toml")).unwrap_or_default();
+    for (name, var) in VERSIONED_CRATES {
+        let version = lock
+            .as_deref()
+            .and_then(|lock| locked_version(lock, name))
+            .or_else(|| required_version(&manifest, name))
+            .unwrap_or_else(|| "unknown".to_string());
+        println!("cargo:rustc-env={var}={version}");
+    }
+
+    // the commit changes with HEAD, or with the branch HEAD points to
+    let git_dir = manifest_dir.join(".git");
+    rerun_if_exists(&git_dir.join("HEAD"));
+    if let Ok(head) = fs::read_to_string(git_dir.join("HEAD")) {
+        if let Some(branch) = head.trim().strip_prefix("ref: ") {
+            rerun_if_exists(&git_dir.join(branch));
+            rerun_if_exists(&git_dir.join("packed-refs"));
+        }
+    }
+    let commit = Command::new("git")
+        .args(["rev-parse", "HEAD"])
+        .current_dir(&manifest_dir)
+        .output()
+        .ok()
+        .filter(|output| output.status.success())
+        .map(|output| String::from_utf8_lossy(&output.stdout).trim().to_string())
+        .unwrap_or_default();
+    println!("cargo:rustc-env=IROH_FFI_GIT_COMMIT={commit}");
+}
+
+/// The version of the package `name` in the lock file `lock`.
+fn locked_version(lock: &str, name: &str) -> Option<String> {
+    let name_line = format!("name = \"{name}\"");
+    let mut lines = lock.lines();
+    lines.find(|line| *line == name_line)?;
+    let version = lines.next()?.strip_prefix("version = \"")?;
+    Some(version.trim_end_matches('"').to_string())
+}
+
+/// The version requirement of the dependency `name` in the manifest `manifest`.
+fn required_version(manifest: &str, name: &str) -> Option<String> {
+    let line = manifest
+        .lines()
+        .find(|line| line.starts_with(&format!("{name} = ")))?;
+    let version = line.split_once("version = \"")?.1;
+    Some(version.split('"').next()?.to_string())
+}
+
+/// Rerun the build script when `path` changes. Cargo reruns it on every build for a path that
+/// does not exist, so those are skipped.
+fn rerun_if_exists(path: &Path) {
+    if path.exists() {
+        println!("cargo:rerun-if-changed={}", path.display());
+    }
 }
 
 fn build_pc() {
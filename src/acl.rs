@@ -0,0 +1,320 @@
+use std::{
+    path::PathBuf,
+    str::FromStr,
+    sync::{Arc, RwLock},
+};
+
+use iroh_gossip::net::Gossip;
+use serde::{Deserialize, Serialize};
+
+use crate::{IrohError, Node, PublicKey};
+
+/// Name of the file the rules of a persistent node are stored in, in its data directory.
+pub(crate) const ACL_FILE: &str = "acl.json";
+/// Error code used to close connections refused by the access control list.
+const ACL_DENIED_CLOSE_CODE: u32 = 0xac1;
+
+/// What a peer wants to do, see [`AclRule`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+#[serde(rename_all = "snake_case")]
+pub enum AclAction {
+    /// Connect to this node for any protocol the list covers. Rules for this action match all
+    /// actions.
+    Connect,
+    /// Gossip and document invitations with this node.
+    ///
+    /// This can not keep a peer from syncing documents: the docs engine only accepts
+    /// connections before their peer is known, so the document sync protocol itself is not
+    /// covered by the list. A peer denied this action does not receive live updates through
+    /// gossip, but can still reconcile any document it knows the id of and this node syncs.
+    Sync,
+    /// Fetch blobs from this node.
+    Fetch,
+}
+
+/// Whether a matching [`AclRule`] allows or denies the action.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+#[serde(rename_all = "snake_case")]
+pub enum AclEffect {
+    Allow,
+    Deny,
+}
+
+/// A rule of the access control list of a node, see `Node.acl_set`.
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct AclRule {
+    /// The peer the rule applies to, or every peer if not set.
+    #[uniffi(default = None)]
+    pub node_id: Option<Arc<PublicKey>>,
+    pub action: AclAction,
+    pub effect: AclEffect,
+}
+
+#[uniffi::export]
+impl Node {
+    /// Replace the access control list of this node.
+    ///
+    /// The first rule matching a peer and action decides, peers matching no rule are allowed.
+    /// To only allow some peers, end the list with a rule denying every peer. The rules of a
+    /// persistent node are stored in its data directory and apply again after a restart.
+    ///
+    /// Rules are checked when a peer connects, connections that are already established are
+    /// not affected. Document sync connections and custom protocols are not covered, as they
+    /// are handed to their handlers before the peer is known, so neither a `Sync` nor a
+    /// `Connect` rule keeps a peer from syncing documents, see [`AclAction::Sync`].
+    pub fn acl_set(&self, rules: Vec<AclRule>) -> Result<(), IrohError> {
+        let rules = rules.iter().map(Rule::from).collect();
+        self.acl.set(rules)?;
+        Ok(())
+    }
+
+    /// The access control list of this node, see [`Self::acl_set`].
+    pub fn acl_rules(&self) -> Vec<AclRule> {
+        let rules = self.acl.rules.read().expect("poisoned");
+        rules.iter().map(AclRule::from).collect()
+    }
+
+    /// Whether the access control list allows `node_id` to do `action`.
+    pub fn acl_allows(&self, node_id: &PublicKey, action: AclAction) -> bool {
+        self.acl.allows(&node_id.into(), action)
+    }
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Rule {
+    node_id: Option<iroh::NodeId>,
+    action: AclAction,
+    effect: AclEffect,
+}
+
+impl From<&AclRule> for Rule {
+    fn from(rule: &AclRule) -> Self {
+        Rule {
+            node_id: rule.node_id.as_deref().map(iroh::NodeId::from),
+            action: rule.action,
+            effect: rule.effect,
+        }
+    }
+}
+
+impl From<&Rule> for AclRule {
+    fn from(rule: &Rule) -> Self {
+        AclRule {
+            node_id: rule.node_id.map(|id| Arc::new(id.into())),
+            action: rule.action,
+            effect: rule.effect,
+        }
+    }
+}
+
+/// The stored form of the rules.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct AclFile {
+    rules: Vec<StoredRule>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct StoredRule {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    node_id: Option<String>,
+    action: AclAction,
+    effect: AclEffect,
+}
+
+/// The access control list of a node, see `Node.acl_set`.
+#[derive(Debug, Default)]
+pub(crate) struct Acl {
+    rules: RwLock<Vec<Rule>>,
+    /// Where the rules are stored, for persistent nodes.
+    path: Option<PathBuf>,
+}
+
+impl Acl {
+    /// Load the rules stored at `path`, if there are any.
+    pub(crate) fn load(path: PathBuf) -> anyhow::Result<Self> {
+        let rules = match std::fs::read(&path) {
+            Ok(bytes) => {
+                let file: AclFile = serde_json::from_slice(&bytes)?;
+                file.rules
+                    .into_iter()
+                    .map(|rule| {
+                        let node_id = rule
+                            .node_id
+                            .map(|id| iroh::NodeId::from_str(&id))
+                            .transpose()?;
+                        anyhow::Ok(Rule {
+                            node_id,
+                            action: rule.action,
+                            effect: rule.effect,
+                        })
+                    })
+                    .collect::<anyhow::Result<_>>()?
+            }
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => Vec::new(),
+            Err(err) => return Err(err.into()),
+        };
+        Ok(Acl {
+            rules: RwLock::new(rules),
+            path: Some(path),
+        })
+    }
+
+    fn set(&self, rules: Vec<Rule>) -> anyhow::Result<()> {
+        let mut current = self.rules.write().expect("poisoned");
+        if let Some(path) = &self.path {
+            let file = AclFile {
+                rules: rules
+                    .iter()
+                    .map(|rule| StoredRule {
+                        node_id: rule.node_id.map(|id| id.to_string()),
+                        action: rule.action,
+                        effect: rule.effect,
+                    })
+                    .collect(),
+            };
+            // write a temporary file first, so that a crash never leaves a partial list
+            let tmp = path.with_extension("json.tmp");
+            std::fs::write(&tmp, serde_json::to_vec_pretty(&file)?)?;
+            std::fs::rename(&tmp, path)?;
+        }
+        *current = rules;
+        Ok(())
+    }
+
+    pub(crate) fn allows(&self, node_id: &iroh::NodeId, action: AclAction) -> bool {
+        let rules = self.rules.read().expect("poisoned");
+        rules
+            .iter()
+            .find(|rule| {
+                rule.node_id.map_or(true, |id| id == *node_id)
+                    && (rule.action == AclAction::Connect || rule.action == action)
+            })
+            .map_or(true, |rule| rule.effect == AclEffect::Allow)
+    }
+
+    /// Check whether the peer of `conn` may do `action`, closing the connection if not.
+    pub(crate) fn admit(
+        &self,
+        conn: &iroh::endpoint::Connection,
+        action: AclAction,
+    ) -> anyhow::Result<bool> {
+        let node_id = iroh::endpoint::get_remote_node_id(conn)?;
+        if self.allows(&node_id, action) {
+            return Ok(true);
+        }
+        conn.close(ACL_DENIED_CLOSE_CODE.into(), b"denied");
+        Ok(false)
+    }
+}
+
+/// Serves gossip to the peers the access control list allows to sync.
+#[derive(Debug, Clone)]
+pub(crate) struct AclGossip {
+    gossip: Gossip,
+    acl: Arc<Acl>,
+}
+
+impl AclGossip {
+    pub(crate) fn new(gossip: Gossip, acl: Arc<Acl>) -> Self {
+        AclGossip { gossip, acl }
+    }
+}
+
+impl iroh::protocol::ProtocolHandler for AclGossip {
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let this = self.clone();
+        Box::pin(async move {
+            let conn = conn.await?;
+            if !this.acl.admit(&conn, AclAction::Sync)? {
+                return Ok(());
+            }
+            this.gossip.handle_connection(conn).await
+        })
+    }
+
+    fn shutdown(&self) -> futures_lite::future::Boxed<()> {
+        iroh::protocol::ProtocolHandler::shutdown(&self.gossip)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::NoProgress;
+
+    fn random_node_id() -> iroh::NodeId {
+        iroh::SecretKey::from_bytes(&rand::random()).public()
+    }
+
+    #[test]
+    fn test_acl_rules() {
+        let acl = Acl::default();
+        let friend = random_node_id();
+        let stranger = random_node_id();
+        assert!(acl.allows(&stranger, AclAction::Fetch));
+
+        acl.set(vec![
+            Rule {
+                node_id: Some(friend),
+                action: AclAction::Connect,
+                effect: AclEffect::Allow,
+            },
+            Rule {
+                node_id: None,
+                action: AclAction::Fetch,
+                effect: AclEffect::Deny,
+            },
+        ])
+        .unwrap();
+        assert!(acl.allows(&friend, AclAction::Fetch));
+        assert!(!acl.allows(&stranger, AclAction::Fetch));
+        assert!(acl.allows(&stranger, AclAction::Sync));
+    }
+
+    #[tokio::test]
+    async fn test_acl_persisted() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().to_string_lossy().into_owned();
+        let node = crate::Iroh::persistent(path.clone()).await.unwrap();
+        let peer = crate::Iroh::memory().await.unwrap();
+        let peer_id = PublicKey::from_string(peer.net().node_id().await.unwrap()).unwrap();
+        let rules = vec![AclRule {
+            node_id: Some(Arc::new(peer_id.clone())),
+            action: AclAction::Fetch,
+            effect: AclEffect::Deny,
+        }];
+        node.node().acl_set(rules).unwrap();
+
+        // fetching from the node is refused
+        let outcome = node.blobs().add_bytes(b"private".to_vec()).await.unwrap();
+        let addr = node.net().node_addr().await.unwrap();
+        let res = peer
+            .blobs()
+            .download(
+                outcome.hash.clone(),
+                Arc::new(
+                    crate::BlobDownloadOptions::new(
+                        crate::BlobFormat::Raw,
+                        vec![Arc::new(addr)],
+                        Arc::new(crate::SetTagOption::auto()),
+                    )
+                    .unwrap(),
+                ),
+                Arc::new(NoProgress),
+            )
+            .await;
+        assert!(res.is_err());
+
+        node.node().shutdown().await.unwrap();
+        drop(node);
+        let node = crate::Iroh::persistent(path).await.unwrap();
+        let rules = node.node().acl_rules();
+        assert_eq!(rules.len(), 1);
+        assert!(rules[0].node_id.as_ref().unwrap().equal(&peer_id));
+        assert!(!node.node().acl_allows(&peer_id, AclAction::Fetch));
+        assert!(node.node().acl_allows(&peer_id, AclAction::Sync));
+    }
+}
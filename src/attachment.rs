@@ -0,0 +1,307 @@
+use std::{
+    path::{Path, PathBuf},
+    str::FromStr,
+    sync::Arc,
+};
+
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+use serde::{Deserialize, Serialize};
+
+use crate::{AuthorId, Doc, Entry, Hash, IrohError};
+
+/// Version of the attachment envelope, stored in the `iroh-attachment` field.
+const ENVELOPE_VERSION: u32 = 1;
+/// Prefix of the tags keeping attached files, followed by their hash.
+const ATTACHMENT_TAG_PREFIX: &str = "attachment/";
+
+/// A file attached to a document entry, see `Doc.attach_file`.
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct Attachment {
+    /// The hash of the file content.
+    pub hash: Arc<Hash>,
+    /// The size of the file in bytes.
+    pub size: u64,
+    /// The name of the file, without directories.
+    pub filename: String,
+    /// The media type of the file, e.g. `image/png`.
+    pub mime: String,
+}
+
+/// The value of an attachment entry, as JSON so that applications in any language can read it.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+struct Envelope {
+    #[serde(rename = "iroh-attachment")]
+    version: u32,
+    hash: String,
+    size: u64,
+    filename: String,
+    mime: String,
+}
+
+impl Envelope {
+    fn decode(value: &[u8]) -> anyhow::Result<Attachment> {
+        let envelope: Envelope = serde_json::from_slice(value)
+            .map_err(|err| anyhow::anyhow!("entry is not an attachment: {err}"))?;
+        anyhow::ensure!(
+            envelope.version == ENVELOPE_VERSION,
+            "unsupported attachment version {}",
+            envelope.version
+        );
+        Ok(Attachment {
+            hash: Arc::new(Hash(iroh_blobs::Hash::from_str(&envelope.hash)?)),
+            size: envelope.size,
+            filename: envelope.filename,
+            mime: envelope.mime,
+        })
+    }
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Attach a file to `key`: import the file as a blob and set `key` to a small JSON
+    /// envelope with its hash, size, file name and media type.
+    ///
+    /// The media type is guessed from the file extension if `mime` is not set. Only the
+    /// envelope is synced with the document, peers fetch the file with
+    /// [`Doc::export_attachment`]. The file is kept in the blob store under the tag
+    /// `attachment/<hash>` until that tag is deleted.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn attach_file(
+        &self,
+        author: Arc<AuthorId>,
+        key: Vec<u8>,
+        path: String,
+        mime: Option<String>,
+    ) -> Result<Attachment, IrohError> {
+        self.ensure_open()?;
+        let path = PathBuf::from(path);
+        let filename = path
+            .file_name()
+            .ok_or_else(|| anyhow::anyhow!("{} is not a file", path.display()))?
+            .to_string_lossy()
+            .into_owned();
+        let mime = mime.unwrap_or_else(|| guess_mime(&filename).to_string());
+
+        // the tag is named after the hash, which is only known once the file was read
+        let hash = hash_file(path.clone()).await?;
+        let outcome = self
+            .engine
+            .blobs
+            .add_from_path(
+                path,
+                false,
+                iroh_blobs::util::SetTagOption::Named(attachment_tag(&hash)),
+                iroh_blobs::rpc::client::blobs::WrapOption::NoWrap,
+            )
+            .await?
+            .finish()
+            .await?;
+        if outcome.hash != hash {
+            self.engine.blobs.tags().delete(outcome.tag).await?;
+            return Err(anyhow::anyhow!("file changed while it was attached").into());
+        }
+
+        let envelope = Envelope {
+            version: ENVELOPE_VERSION,
+            hash: hash.to_string(),
+            size: outcome.size,
+            filename,
+            mime,
+        };
+        let value = serde_json::to_vec(&envelope).map_err(anyhow::Error::from)?;
+        let lock = self.write_lock().await;
+        self.put_bytes(&lock, author.0, key, value).await?;
+        Ok(Attachment {
+            hash: Arc::new(Hash(hash)),
+            size: envelope.size,
+            filename: envelope.filename,
+            mime: envelope.mime,
+        })
+    }
+
+    /// Read the attachment of an entry written with [`Doc::attach_file`].
+    ///
+    /// Fails if the entry is not an attachment. The content of the entry has to be available
+    /// on this node, the attached file does not.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_attachment(&self, entry: Arc<Entry>) -> Result<Attachment, IrohError> {
+        self.ensure_open()?;
+        let value = self
+            .engine
+            .content_cache
+            .read(&self.engine.blobs, entry.0.content_hash())
+            .await?;
+        let attachment = Envelope::decode(&value)?;
+        Ok(attachment)
+    }
+
+    /// Export the file attached to an entry to `path`, see [`Doc::attach_file`].
+    ///
+    /// If the file is not on this node yet, it is downloaded from the sync peers of the
+    /// document and kept under the tag `attachment/<hash>`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_attachment(
+        &self,
+        entry: Arc<Entry>,
+        path: String,
+    ) -> Result<Attachment, IrohError> {
+        let attachment = self.read_attachment(entry).await?;
+        let hash = attachment.hash.0;
+        let blobs = &self.engine.blobs;
+        if !matches!(blobs.status(hash).await?, BlobStatus::Complete { .. }) {
+            let peers = self.inner.get_sync_peers().await?.unwrap_or_default();
+            let nodes = peers
+                .into_iter()
+                .map(|peer| iroh::NodeId::from_bytes(&peer).map(iroh::NodeAddr::new))
+                .collect::<Result<Vec<_>, _>>()
+                .map_err(anyhow::Error::from)?;
+            if nodes.is_empty() {
+                return Err(anyhow::anyhow!("attachment {hash} is not available").into());
+            }
+            let opts = iroh_blobs::rpc::client::blobs::DownloadOptions {
+                format: iroh_blobs::BlobFormat::Raw,
+                nodes,
+                tag: iroh_blobs::util::SetTagOption::Named(attachment_tag(&hash)),
+                mode: iroh_blobs::rpc::client::blobs::DownloadMode::Direct,
+            };
+            blobs.download_with_opts(hash, opts).await?.finish().await?;
+        }
+        blobs
+            .export(
+                hash,
+                PathBuf::from(path),
+                iroh_blobs::store::ExportFormat::Blob,
+                iroh_blobs::store::ExportMode::Copy,
+            )
+            .await?
+            .finish()
+            .await?;
+        Ok(attachment)
+    }
+}
+
+fn attachment_tag(hash: &iroh_blobs::Hash) -> iroh_blobs::Tag {
+    iroh_blobs::Tag(format!("{ATTACHMENT_TAG_PREFIX}{hash}").into())
+}
+
+/// The hash the blob store will assign to the content of the file at `path`.
+async fn hash_file(path: PathBuf) -> anyhow::Result<iroh_blobs::Hash> {
+    tokio::task::spawn_blocking(move || {
+        let mut file = std::fs::File::open(&path)?;
+        let mut hasher = blake3::Hasher::new();
+        std::io::copy(&mut file, &mut hasher)?;
+        Ok(iroh_blobs::Hash::from_bytes(*hasher.finalize().as_bytes()))
+    })
+    .await?
+}
+
+/// Guess the media type of a file from its extension.
+fn guess_mime(filename: &str) -> &'static str {
+    let extension = Path::new(filename)
+        .extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+    match extension.as_str() {
+        "txt" => "text/plain",
+        "md" => "text/markdown",
+        "html" | "htm" => "text/html",
+        "css" => "text/css",
+        "csv" => "text/csv",
+        "js" => "text/javascript",
+        "json" => "application/json",
+        "xml" => "application/xml",
+        "pdf" => "application/pdf",
+        "zip" => "application/zip",
+        "gz" => "application/gzip",
+        "tar" => "application/x-tar",
+        "png" => "image/png",
+        "jpg" | "jpeg" => "image/jpeg",
+        "gif" => "image/gif",
+        "webp" => "image/webp",
+        "svg" => "image/svg+xml",
+        "mp3" => "audio/mpeg",
+        "ogg" => "audio/ogg",
+        "wav" => "audio/wav",
+        "mp4" => "video/mp4",
+        "webm" => "video/webm",
+        _ => "application/octet-stream",
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[test]
+    fn test_envelope() {
+        let hash = iroh_blobs::Hash::new(b"content");
+        let value = format!(
+            r#"{{"iroh-attachment":1,"hash":"{hash}","size":7,"filename":"a.txt","mime":"text/plain"}}"#
+        );
+        let attachment = Envelope::decode(value.as_bytes()).unwrap();
+        assert_eq!(attachment.hash.0, hash);
+        assert_eq!(attachment.size, 7);
+        assert_eq!(attachment.filename, "a.txt");
+
+        assert!(Envelope::decode(b"plain value").is_err());
+        let value = value.replace(r#""iroh-attachment":1"#, r#""iroh-attachment":2"#);
+        assert!(Envelope::decode(value.as_bytes()).is_err());
+
+        assert_eq!(guess_mime("photo.JPG"), "image/jpeg");
+        assert_eq!(guess_mime("README"), "application/octet-stream");
+    }
+
+    #[tokio::test]
+    async fn test_attach_file() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("report.pdf");
+        std::fs::write(&path, b"%PDF-1.7 not really").unwrap();
+
+        let attachment = doc
+            .attach_file(
+                author.clone(),
+                b"files/report".to_vec(),
+                path.display().to_string(),
+                None,
+            )
+            .await
+            .unwrap();
+        assert_eq!(attachment.filename, "report.pdf");
+        assert_eq!(attachment.mime, "application/pdf");
+        assert_eq!(attachment.size, 19);
+        assert_eq!(
+            attachment.hash.0,
+            iroh_blobs::Hash::new(b"%PDF-1.7 not really")
+        );
+
+        let entry = doc
+            .get_exact(author.clone(), b"files/report".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let read = doc.read_attachment(entry.clone()).await.unwrap();
+        assert_eq!(read.hash.0, attachment.hash.0);
+        assert_eq!(read.mime, "application/pdf");
+
+        let out = dir.path().join("out.pdf");
+        doc.export_attachment(entry, out.display().to_string())
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(out).unwrap(), b"%PDF-1.7 not really");
+
+        // plain entries are not attachments
+        doc.set_bytes(&author, b"plain".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        let entry = doc
+            .get_exact(author, b"plain".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert!(doc.read_attachment(entry).await.is_err());
+    }
+}
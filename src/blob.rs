@@ -1,22 +1,48 @@
 use std::{
-    path::PathBuf,
+    collections::HashMap,
+    path::{Path, PathBuf},
     str::FromStr,
     sync::{Arc, RwLock},
-    time::Duration,
+    time::{Duration, Instant},
 };
 
 use futures::{StreamExt, TryStreamExt};
 use serde::{Deserialize, Serialize};
 
-use crate::{node::Iroh, BlobsClient, CallbackError, NetClient};
+use crate::{
+    acl::{Acl, AclAction},
+    content_cache::ContentCache,
+    instrument::CallTimer,
+    node::Iroh,
+    node_events::NodeEvents,
+    peer_diagnostics::PeerErrors,
+    presence::PresenceStore,
+    provide::ProvideEvents,
+    response_limit::{read_at_len, ResponseClass},
+    serve_policy::ServeFilter,
+    tag_index::{TagIndexes, METADATA_TAG_PREFIX},
+    BlobsClient, CallbackError, NetClient,
+};
+use crate::{error::VerificationFailed, IrohError, NodeAddr, PublicKey};
 use crate::{ticket::AddrInfoOptions, BlobTicket};
-use crate::{IrohError, NodeAddr};
 
 /// Iroh blobs client.
 #[derive(uniffi::Object)]
 pub struct Blobs {
-    client: BlobsClient,
+    pub(crate) client: BlobsClient,
     net_client: NetClient,
+    endpoint: iroh::Endpoint,
+    downloads: Arc<DownloadLimiter>,
+    incomplete: Arc<IncompleteBlobs>,
+    pub(crate) tag_indexes: Arc<TagIndexes>,
+    pub(crate) presence: PresenceStore,
+    verify_on_read: bool,
+    events: NodeEvents,
+    pub(crate) provides: Arc<ProvideEvents>,
+    peer_errors: Arc<PeerErrors>,
+    pub(crate) content_cache: Arc<ContentCache>,
+    pub(crate) docs_client: Option<crate::node::DocsClient>,
+    pub(crate) serve: Arc<ServeFilter>,
 }
 
 #[uniffi::export]
@@ -26,6 +52,18 @@ impl Iroh {
         Blobs {
             client: self.blobs_client.clone(),
             net_client: self.net_client.clone(),
+            endpoint: self.router.endpoint().clone(),
+            downloads: self.download_limiter.clone(),
+            incomplete: self.incomplete_blobs.clone(),
+            tag_indexes: self.tag_indexes.clone(),
+            presence: self.presence.clone(),
+            verify_on_read: self.verify_on_read,
+            events: self.events.clone(),
+            provides: self.provides.clone(),
+            peer_errors: self.peer_errors.clone(),
+            content_cache: self.content_cache.clone(),
+            docs_client: self.docs_client.clone(),
+            serve: self.serve.clone(),
         }
     }
 }
@@ -64,11 +102,38 @@ impl Blobs {
     /// before calling [`Self::blobs_read_to_bytes`].
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn read_to_bytes(&self, hash: Arc<Hash>) -> Result<Vec<u8>, IrohError> {
-        let res = self
-            .client
-            .read_to_bytes(hash.0)
+        self.read_to_bytes_with_options(hash, ReadOptions::default())
             .await
-            .map(|b| b.to_vec())?;
+    }
+
+    /// Read all bytes of single blob, see [`Self::read_to_bytes`].
+    ///
+    /// If verification is enabled and the content does not match the hash, an error of kind
+    /// `IrohErrorKind::VerificationFailed` is returned.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_to_bytes_with_options(
+        &self,
+        hash: Arc<Hash>,
+        options: ReadOptions,
+    ) -> Result<Vec<u8>, IrohError> {
+        let mut timer = CallTimer::start("blobs.read_to_bytes");
+        let verify = options.verify.unwrap_or(self.verify_on_read);
+        let res = async {
+            if ResponseClass::BlobRead.max().is_some() {
+                let size = self.client.read(hash.0).await?.size();
+                ResponseClass::BlobRead.check(size)?;
+            }
+            let bytes = self.content_cache.read(&self.client, hash.0).await?;
+            if verify {
+                verify_content(hash.0, &bytes)?;
+            }
+            anyhow::Ok(bytes.to_vec())
+        }
+        .await;
+        if let Ok(ref bytes) = res {
+            timer.payload(bytes.len());
+        }
+        let res = timer.finish(res)?;
         Ok(res)
     }
 
@@ -84,20 +149,71 @@ impl Blobs {
         offset: u64,
         len: &ReadAtLen,
     ) -> Result<Vec<u8>, IrohError> {
-        let res = self
-            .client
-            .read_at_to_bytes(hash.0, offset, (*len).into())
+        self.read_at_to_bytes_with_options(hash, offset, len, ReadOptions::default())
             .await
-            .map(|b| b.to_vec())?;
+    }
+
+    /// Read all bytes of single blob at `offset` for length `len`, see
+    /// [`Self::read_at_to_bytes`].
+    ///
+    /// Verification needs the full content, so a verified read loads the whole blob into
+    /// memory.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_at_to_bytes_with_options(
+        &self,
+        hash: Arc<Hash>,
+        offset: u64,
+        len: &ReadAtLen,
+        options: ReadOptions,
+    ) -> Result<Vec<u8>, IrohError> {
+        let mut timer = CallTimer::start("blobs.read_at_to_bytes");
+        let verify = options.verify.unwrap_or(self.verify_on_read);
+        let res = async {
+            if ResponseClass::BlobRead.max().is_some() {
+                let size = self.client.read(hash.0).await?.size();
+                ResponseClass::BlobRead.check(read_at_len(size, offset, *len))?;
+            }
+            if verify {
+                let bytes = self.client.read_to_bytes(hash.0).await?;
+                verify_content(hash.0, &bytes)?;
+                read_range(&bytes, offset, *len)
+            } else {
+                let bytes = self
+                    .client
+                    .read_at_to_bytes(hash.0, offset, (*len).into())
+                    .await?;
+                Ok(bytes.to_vec())
+            }
+        }
+        .await;
+        if let Ok(ref bytes) = res {
+            timer.payload(bytes.len());
+        }
+        let res = timer.finish(res)?;
         Ok(res)
     }
 
+    /// Detect the MIME type of a blob from its first bytes.
+    ///
+    /// Recognizes common image, audio, video, document and archive formats. Falls back to
+    /// `text/plain; charset=utf-8` for valid UTF-8 and `application/octet-stream` for
+    /// everything else.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn sniff_mime(&self, hash: Arc<Hash>) -> Result<String, IrohError> {
+        let len = iroh_blobs::rpc::client::blobs::ReadAtLen::AtMost(SNIFF_LEN);
+        let head = self.client.read_at_to_bytes(hash.0, 0, len).await?;
+        Ok(sniff_mime(&head).to_string())
+    }
+
     /// Import a blob from a filesystem path.
     ///
     /// `path` should be an absolute path valid for the file system on which
     /// the node runs.
     /// If `in_place` is true, Iroh will assume that the data will not change and will share it in
     /// place without copying to the Iroh data directory.
+    ///
+    /// Besides the events for each file, `AddProgressType::Summary` events report the progress
+    /// of the whole import, at most every 250ms and once more right before `AllDone`.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn add_from_path(
         &self,
@@ -107,18 +223,33 @@ impl Blobs {
         wrap: Arc<WrapOption>,
         cb: Arc<dyn AddCallback>,
     ) -> Result<(), IrohError> {
-        let mut stream = self
+        let path = PathBuf::from(path);
+        let mut totals = AddTotals::new(count_files(path.clone()).await);
+        let res = self
             .client
             .add_from_path(
-                path.into(),
+                path,
                 in_place,
                 (*tag).clone().into(),
                 (*wrap).clone().into(),
             )
-            .await?;
+            .await;
+        let mut stream = self.events.check_write("blobs.add_from_path", res)?;
+        self.serve.tags_changed();
         while let Some(progress) = stream.next().await {
-            let progress = progress?;
+            let progress = self.events.check_write("blobs.add_from_path", progress)?;
+            totals.update(&progress);
+            // the final summary comes before `AllDone`, which stays the last event
+            let all_done = matches!(progress, iroh_blobs::provider::AddProgress::AllDone { .. });
+            if all_done {
+                cb.progress(Arc::new(AddProgress::Summary(totals.summary())))
+                    .await?;
+            }
             cb.progress(Arc::new(progress.into())).await?;
+            if !all_done && totals.due() {
+                cb.progress(Arc::new(AddProgress::Summary(totals.summary())))
+                    .await?;
+            }
         }
         Ok(())
     }
@@ -143,10 +274,49 @@ impl Blobs {
         Ok(())
     }
 
+    /// Export the bytes of a blob at `offset` for length `len` to a file path.
+    ///
+    /// If `append` is true the bytes are appended to the file, otherwise the file is replaced.
+    /// Only the requested range has to be present locally.
+    ///
+    /// Returns the number of bytes written.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn write_range_to_path(
+        &self,
+        hash: Arc<Hash>,
+        offset: u64,
+        len: &ReadAtLen,
+        path: String,
+        append: bool,
+    ) -> Result<u64, IrohError> {
+        let mut reader = self.client.read_at(hash.0, offset, (*len).into()).await?;
+        let path: PathBuf = path.into();
+        if let Some(dir) = path.parent() {
+            tokio::fs::create_dir_all(dir)
+                .await
+                .map_err(anyhow::Error::from)?;
+        }
+        let mut file = tokio::fs::OpenOptions::new()
+            .create(true)
+            .write(true)
+            .append(append)
+            .truncate(!append)
+            .open(path)
+            .await
+            .map_err(anyhow::Error::from)?;
+        let written = tokio::io::copy(&mut reader, &mut file)
+            .await
+            .map_err(anyhow::Error::from)?;
+        Ok(written)
+    }
+
     /// Write a blob by passing bytes.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn add_bytes(&self, bytes: Vec<u8>) -> Result<BlobAddOutcome, IrohError> {
-        let res = self.client.add_bytes(bytes).await?;
+        let mut timer = CallTimer::start("blobs.add_bytes");
+        timer.payload(bytes.len());
+        let res = self.client.add_bytes(bytes).await;
+        let res = timer.finish(self.events.check_write("blobs.add_bytes", res))?;
         Ok(res.into())
     }
 
@@ -157,13 +327,117 @@ impl Blobs {
         bytes: Vec<u8>,
         name: String,
     ) -> Result<BlobAddOutcome, IrohError> {
+        let mut timer = CallTimer::start("blobs.add_bytes_named");
+        timer.payload(bytes.len());
         let res = self
             .client
             .add_bytes_named(bytes, iroh_blobs::Tag(name.into()))
-            .await?;
+            .await;
+        let res = timer.finish(self.events.check_write("blobs.add_bytes_named", res))?;
+        self.serve.tags_changed();
         Ok(res.into())
     }
 
+    /// Write a blob by passing bytes, attaching application `metadata` to it.
+    ///
+    /// See [`Blobs::set_metadata`] for how the metadata is stored.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn add_bytes_with_metadata(
+        &self,
+        bytes: Vec<u8>,
+        metadata: HashMap<String, String>,
+    ) -> Result<BlobAddOutcome, IrohError> {
+        let outcome = self.add_bytes(bytes).await?;
+        self.set_metadata(outcome.hash.clone(), metadata).await?;
+        Ok(outcome)
+    }
+
+    /// Add a blob whose content is read from `reader`, e.g. a socket or a pipe.
+    ///
+    /// Chunks of up to 64 KiB are read until the reader returns an empty chunk. They are
+    /// stored as they are read, like with [`Self::writer`], so the content never has to be
+    /// buffered in full. An error returned by the reader aborts the import, no blob is added.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn add_from_reader(
+        &self,
+        reader: Arc<dyn BlobReader>,
+        tag: Arc<SetTagOption>,
+    ) -> Result<BlobAddOutcome, IrohError> {
+        let writer = self.writer(tag).await;
+        loop {
+            let chunk = match reader.read(BLOB_READER_CHUNK_SIZE).await {
+                Ok(chunk) => chunk,
+                Err(err) => {
+                    writer.abort().await?;
+                    return Err(err.into());
+                }
+            };
+            if chunk.is_empty() {
+                break;
+            }
+            writer.write(chunk).await?;
+        }
+        writer.finish().await
+    }
+
+    /// Start writing a blob whose content is produced incrementally, e.g. while recording.
+    ///
+    /// The content is hashed and stored as chunks are written, so it never has to be buffered
+    /// in full. Call [`BlobWriter::finish`] to complete the blob.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn writer(&self, tag: Arc<SetTagOption>) -> BlobWriter {
+        let (sender, mut receiver) = tokio::sync::mpsc::channel(BLOB_WRITER_BUFFER);
+        let client = self.client.clone();
+        let serve = self.serve.clone();
+        let tag = (*tag).clone().into();
+        let task = tokio::task::spawn(async move {
+            let input = futures::stream::poll_fn(move |cx| receiver.poll_recv(cx));
+            let outcome = client.add_stream(input, tag).await;
+            serve.tags_changed();
+            outcome
+        });
+        BlobWriter {
+            sender: tokio::sync::Mutex::new(Some(sender)),
+            task: tokio::sync::Mutex::new(Some(task)),
+        }
+    }
+
+    /// Attach application metadata, such as a file name or MIME type, to a blob.
+    ///
+    /// The metadata is stored as a JSON blob of its own, referenced by a tag named
+    /// `iroh-ffi/meta/<hash>`, and replaces any metadata set before.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn set_metadata(
+        &self,
+        hash: Arc<Hash>,
+        metadata: HashMap<String, String>,
+    ) -> Result<(), IrohError> {
+        // sorted, so equal metadata ends up in the same blob
+        let metadata: std::collections::BTreeMap<_, _> = metadata.into_iter().collect();
+        let json = serde_json::to_vec(&metadata).map_err(anyhow::Error::from)?;
+        let name = metadata_tag(&hash);
+        let outcome = self.client.add_bytes_named(json, name.clone()).await?;
+        self.tag_indexes.metadata.set(name, outcome.hash).await;
+        self.serve.tags_changed();
+        Ok(())
+    }
+
+    /// Get the metadata attached to a blob with [`Blobs::set_metadata`], if any.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn metadata(
+        &self,
+        hash: Arc<Hash>,
+    ) -> Result<Option<HashMap<String, String>>, IrohError> {
+        let name = metadata_tag(&hash);
+        let index = &self.tag_indexes.metadata;
+        let Some(json_hash) = index.get(&self.client.tags(), &name).await? else {
+            return Ok(None);
+        };
+        let json = self.client.read_to_bytes(json_hash).await?;
+        let metadata = serde_json::from_slice(&json).map_err(anyhow::Error::from)?;
+        Ok(Some(metadata))
+    }
+
     /// Download a blob from another node and add it to the local database.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn download(
@@ -172,14 +446,29 @@ impl Blobs {
         opts: Arc<BlobDownloadOptions>,
         cb: Arc<dyn DownloadCallback>,
     ) -> Result<(), IrohError> {
-        let mut stream = self
-            .client
-            .download_with_opts(hash.0, opts.0.clone())
-            .await?;
-        while let Some(progress) = stream.next().await {
-            let progress = progress?;
-            cb.progress(Arc::new(progress.into())).await?;
+        let timer = CallTimer::start("blobs.download");
+        timer.run(self.download_with_retry(hash, opts, cb)).await
+    }
+
+    /// The current download limits of this node.
+    #[uniffi::method]
+    pub fn download_limits(&self) -> DownloadLimits {
+        self.downloads.limits()
+    }
+
+    /// Change how many downloads started with [`Blobs::download`] may run at the same time.
+    ///
+    /// Downloads exceeding the limit wait until a running download finishes. This only gates
+    /// calls to [`Blobs::download`]: the downloader of the node keeps the limits it was created
+    /// with, so content fetched by document sync is not affected, and raising the limit above
+    /// the `max_concurrent_downloads` the node was created with does not allow more parallel
+    /// transfers than that. `max_concurrent_requests_per_node` can not be changed at runtime.
+    #[uniffi::method]
+    pub fn set_max_concurrent_downloads(&self, max: u32) -> Result<(), IrohError> {
+        if max == 0 {
+            return Err(anyhow::anyhow!("max_concurrent_downloads must be larger than 0").into());
         }
+        self.downloads.set_max_concurrent_downloads(max);
         Ok(())
     }
 
@@ -200,21 +489,26 @@ impl Blobs {
         format: BlobExportFormat,
         mode: BlobExportMode,
     ) -> Result<(), IrohError> {
-        let destination: PathBuf = destination.into();
-        if let Some(dir) = destination.parent() {
-            tokio::fs::create_dir_all(dir)
-                .await
-                .map_err(anyhow::Error::from)?;
-        }
+        let timer = CallTimer::start("blobs.export");
+        timer
+            .run(async {
+                let destination: PathBuf = destination.into();
+                if let Some(dir) = destination.parent() {
+                    tokio::fs::create_dir_all(dir)
+                        .await
+                        .map_err(anyhow::Error::from)?;
+                }
 
-        let stream = self
-            .client
-            .export(hash.0, destination, format.into(), mode.into())
-            .await?;
+                let stream = self
+                    .client
+                    .export(hash.0, destination, format.into(), mode.into())
+                    .await?;
 
-        stream.finish().await?;
+                stream.finish().await?;
 
-        Ok(())
+                Ok::<_, IrohError>(())
+            })
+            .await
     }
 
     /// Create a ticket for sharing a blob from this node.
@@ -243,11 +537,86 @@ impl Blobs {
             .list_incomplete()
             .await?
             .map_ok(|res| res.into())
-            .try_collect::<Vec<_>>()
+            .try_collect::<Vec<IncompleteBlobInfo>>()
             .await?;
         Ok(blobs)
     }
 
+    /// Delete the data of downloads that started at least `older_than` ago and did not
+    /// complete.
+    ///
+    /// Only downloads started with [`Blobs::download`] are pruned. Until they complete, they are
+    /// recorded in a tag named `iroh-ffi/incomplete/<hash>/<started>`, which keeps their
+    /// partial data from being garbage collected and remembers when they first started across
+    /// restarts. Pruning removes that tag and deletes the partial data, unless another tag
+    /// still refers to it. Downloads that are currently running are never pruned.
+    ///
+    /// Returns the hashes of the pruned downloads.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn prune_incomplete(
+        &self,
+        older_than: Duration,
+    ) -> Result<Vec<Arc<Hash>>, IrohError> {
+        let mut tracked = Vec::new();
+        let mut references: HashMap<iroh_blobs::Hash, usize> = HashMap::new();
+        let mut tags = self.client.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            match IncompleteTag::parse(&tag) {
+                Some(incomplete) => tracked.push(incomplete),
+                None => *references.entry(tag.hash).or_default() += 1,
+            }
+        }
+
+        let now = std::time::SystemTime::now();
+        let mut pruned = Vec::new();
+        for incomplete in tracked {
+            let age = now.duration_since(incomplete.started).unwrap_or_default();
+            if age < older_than || self.incomplete.is_active(&incomplete.hash) {
+                continue;
+            }
+            let status = self.client.status(incomplete.hash).await?;
+            self.client.tags().delete(incomplete.name).await?;
+            if matches!(
+                status,
+                iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. }
+            ) {
+                continue;
+            }
+            if matches!(
+                status,
+                iroh_blobs::rpc::client::blobs::BlobStatus::Partial { .. }
+            ) && !references.contains_key(&incomplete.hash)
+            {
+                self.client.delete_blob(incomplete.hash).await?;
+            }
+            pruned.push(Arc::new(Hash(incomplete.hash)));
+        }
+        Ok(pruned)
+    }
+
+    /// Finish downloading an incomplete blob from `provider`.
+    ///
+    /// Data that is already present locally is verified and not transferred again. A download
+    /// started with [`Blobs::download`] is resumed in the format it was started with, any other
+    /// incomplete blob is downloaded as a raw blob.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn resume_incomplete(
+        &self,
+        hash: Arc<Hash>,
+        provider: Arc<NodeAddr>,
+        cb: Arc<dyn DownloadCallback>,
+    ) -> Result<(), IrohError> {
+        let format = self
+            .incomplete_tags(hash.0)
+            .await?
+            .first()
+            .map(|tag| tag.format)
+            .unwrap_or(iroh_blobs::BlobFormat::Raw);
+        let opts =
+            BlobDownloadOptions::new(format.into(), vec![provider], Arc::new(SetTagOption::Auto))?;
+        self.download(hash, Arc::new(opts), cb).await
+    }
+
     /// List all collections.
     ///
     /// Note: this allocates for each `BlobListCollectionsResponse`, if you have many `BlobListCollectionsResponse`s this may be a prohibitively large list.
@@ -263,6 +632,39 @@ impl Blobs {
         Ok(blobs)
     }
 
+    /// Compute how much storage content addressing saves.
+    ///
+    /// Every tag counts as one reference to its blob, and every hash sequence as one reference
+    /// to each of its children. The logical size is what storing each reference separately would
+    /// take, the physical size is what the complete blobs in the store actually take.
+    ///
+    /// `top` limits the number of most referenced blobs that are returned.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn dedup_stats(&self, top: u32) -> Result<DedupStats, IrohError> {
+        let sizes: HashMap<iroh_blobs::Hash, u64> = self
+            .client
+            .list()
+            .await?
+            .map_ok(|info| (info.hash, info.size))
+            .try_collect()
+            .await?;
+
+        let mut references: HashMap<iroh_blobs::Hash, u64> = HashMap::new();
+        let mut tags = self.client.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            *references.entry(tag.hash).or_default() += 1;
+            if tag.format.is_hash_seq() && sizes.contains_key(&tag.hash) {
+                let bytes = self.client.read_to_bytes(tag.hash).await?;
+                let children = iroh_blobs::hashseq::HashSeq::try_from(bytes)?;
+                for child in children.iter() {
+                    *references.entry(child).or_default() += 1;
+                }
+            }
+        }
+
+        Ok(DedupStats::new(&sizes, &references, top as usize))
+    }
+
     /// Read the content of a collection
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn get_collection(&self, hash: Arc<Hash>) -> Result<Arc<Collection>, IrohError> {
@@ -294,6 +696,7 @@ impl Blobs {
                     .collect(),
             )
             .await?;
+        self.serve.tags_changed();
 
         Ok(HashAndTag {
             hash: Arc::new(hash.into()),
@@ -301,25 +704,324 @@ impl Blobs {
         })
     }
 
+    /// Push a blob to another node.
+    ///
+    /// The receiving node must have set `NodeOptions.accept_push`. Its callback decides whether
+    /// to accept the blob, in which case the receiver downloads it from this node. Returns once
+    /// the receiver has stored the blob, or an error if it was rejected or the download failed.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn send_blob(
+        &self,
+        node_addr: &NodeAddr,
+        hash: &Hash,
+        format: BlobFormat,
+    ) -> Result<(), IrohError> {
+        let node_addr: iroh::NodeAddr = node_addr.clone().try_into()?;
+        let conn = self
+            .peer_errors
+            .connect(&self.endpoint, node_addr, BLOB_PUSH_ALPN, None)
+            .await?;
+        let (mut send, mut recv) = conn.open_bi().await.map_err(anyhow::Error::from)?;
+
+        let mut request = hash.0.as_bytes().to_vec();
+        request.push(match format {
+            BlobFormat::Raw => 0,
+            BlobFormat::HashSeq => 1,
+        });
+        send.write_all(&request)
+            .await
+            .map_err(anyhow::Error::from)?;
+        send.finish().map_err(anyhow::Error::from)?;
+
+        let response = recv
+            .read_to_end(BLOB_PUSH_MAX_RESPONSE)
+            .await
+            .map_err(anyhow::Error::from)?;
+        conn.close(0u32.into(), b"done");
+
+        match response.split_first() {
+            Some((&BLOB_PUSH_STORED, _)) => Ok(()),
+            Some((&BLOB_PUSH_REJECTED, _)) => {
+                Err(anyhow::anyhow!("blob push rejected by receiver").into())
+            }
+            Some((_, reason)) => Err(anyhow::anyhow!(
+                "receiver failed to store blob: {}",
+                String::from_utf8_lossy(reason)
+            )
+            .into()),
+            None => Err(anyhow::anyhow!("receiver closed the connection").into()),
+        }
+    }
+
     /// Delete a blob.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn delete_blob(&self, hash: Arc<Hash>) -> Result<(), IrohError> {
-        let mut tags = self.client.tags().list().await?;
+        let timer = CallTimer::start("blobs.delete_blob");
+        timer
+            .run(async {
+                let mut tags = self.client.tags().list().await?;
+
+                let mut name = None;
+                while let Some(tag) = tags.next().await {
+                    let tag = tag?;
+                    if tag.hash == hash.0 {
+                        name = Some(tag.name);
+                    }
+                }
 
-        let mut name = None;
-        while let Some(tag) = tags.next().await {
-            let tag = tag?;
-            if tag.hash == hash.0 {
-                name = Some(tag.name);
-            }
+                self.content_cache.remove(&hash.0);
+                if let Some(name) = name {
+                    self.client.tags().delete(name.clone()).await?;
+                    self.tag_indexes.forget(&name).await;
+                    self.serve.tags_changed();
+                    self.client.delete_blob((*hash).clone().0).await?;
+                }
+
+                Ok::<_, IrohError>(())
+            })
+            .await
+    }
+}
+
+/// Number of bytes read by [`Blobs::sniff_mime`].
+const SNIFF_LEN: u64 = 512;
+
+/// Magic numbers of well known formats, as offset, signature and MIME type.
+const MAGIC_NUMBERS: &[(usize, &[u8], &str)] = &[
+    (0, b"\x89PNG\r\n\x1a\n", "image/png"),
+    (0, b"\xff\xd8\xff", "image/jpeg"),
+    (0, b"GIF87a", "image/gif"),
+    (0, b"GIF89a", "image/gif"),
+    (8, b"WEBP", "image/webp"),
+    (0, b"%PDF-", "application/pdf"),
+    (0, b"PK\x03\x04", "application/zip"),
+    (0, b"\x1f\x8b", "application/gzip"),
+    (0, b"(\xb5/\xfd", "application/zstd"),
+    (0, b"7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"),
+    (257, b"ustar", "application/x-tar"),
+    (0, b"ID3", "audio/mpeg"),
+    (0, b"OggS", "audio/ogg"),
+    (0, b"fLaC", "audio/flac"),
+    (8, b"WAVE", "audio/wav"),
+    (4, b"ftyp", "video/mp4"),
+    (0, b"\x1aE\xdf\xa3", "video/webm"),
+    (0, b"\x00asm", "application/wasm"),
+];
+
+/// Detect the MIME type of data from its first bytes.
+fn sniff_mime(head: &[u8]) -> &'static str {
+    for (offset, magic, mime) in MAGIC_NUMBERS {
+        if head
+            .get(*offset..)
+            .is_some_and(|rest| rest.starts_with(magic))
+        {
+            return mime;
+        }
+    }
+    let text = match std::str::from_utf8(head) {
+        Ok(text) => text,
+        // the head may end in the middle of a multi byte character
+        Err(err) if err.error_len().is_none() => {
+            std::str::from_utf8(&head[..err.valid_up_to()]).expect("valid prefix")
+        }
+        Err(_) => return "application/octet-stream",
+    };
+    let text = text.trim_start();
+    let starts_with = |prefix: &str| {
+        text.get(..prefix.len())
+            .is_some_and(|start| start.eq_ignore_ascii_case(prefix))
+    };
+    if starts_with("<svg") || (starts_with("<?xml") && text.contains("<svg")) {
+        "image/svg+xml"
+    } else if starts_with("<?xml") {
+        "application/xml"
+    } else if starts_with("<!doctype html") || starts_with("<html") {
+        "text/html"
+    } else if starts_with("{") || starts_with("[") {
+        "application/json"
+    } else {
+        "text/plain; charset=utf-8"
+    }
+}
+
+/// Options for reading blobs.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct ReadOptions {
+    /// Check the content against its hash. Defaults to the `verify_on_read` node option.
+    #[uniffi(default = None)]
+    pub verify: Option<bool>,
+}
+
+/// Check that `bytes` is the content of the blob `hash`.
+fn verify_content(hash: iroh_blobs::Hash, bytes: &[u8]) -> Result<(), VerificationFailed> {
+    let actual = iroh_blobs::Hash::new(bytes);
+    if actual != hash {
+        return Err(VerificationFailed {
+            expected: hash,
+            actual,
+        });
+    }
+    Ok(())
+}
+
+/// The bytes of `content` at `offset` for length `len`, see [`Blobs::read_at_to_bytes`].
+fn read_range(content: &[u8], offset: u64, len: ReadAtLen) -> anyhow::Result<Vec<u8>> {
+    let size = content.len() as u64;
+    anyhow::ensure!(
+        offset <= size,
+        "offset {offset} is past the end of the blob"
+    );
+    let end = match len {
+        ReadAtLen::All => size,
+        ReadAtLen::Exact(len) => {
+            let end = offset.saturating_add(len);
+            anyhow::ensure!(end <= size, "cannot read {len} bytes at offset {offset}");
+            end
         }
+        ReadAtLen::AtMost(len) => offset.saturating_add(len).min(size),
+    };
+    Ok(content[offset as usize..end as usize].to_vec())
+}
+
+/// The tag referencing the metadata of the blob `hash`, see [`Blobs::set_metadata`].
+fn metadata_tag(hash: &Hash) -> iroh_blobs::Tag {
+    iroh_blobs::Tag(format!("{METADATA_TAG_PREFIX}{}", hash.0).into())
+}
+
+/// ALPN of the protocol used by [`Blobs::send_blob`].
+pub(crate) const BLOB_PUSH_ALPN: &[u8] = b"/iroh-ffi/blob-push/0";
+
+/// Size of a push request: the hash followed by the format.
+const BLOB_PUSH_REQUEST_LEN: usize = 33;
+/// Maximum size of a push response: a status byte, followed by an error message.
+const BLOB_PUSH_MAX_RESPONSE: usize = 1024;
 
-        if let Some(name) = name {
-            self.client.tags().delete(name).await?;
-            self.client.delete_blob((*hash).clone().0).await?;
+const BLOB_PUSH_STORED: u8 = 0;
+const BLOB_PUSH_REJECTED: u8 = 1;
+const BLOB_PUSH_FAILED: u8 = 2;
+
+/// The `accept` method is called for every blob another node pushes to this node using
+/// `Blobs.send_blob`. Return `true` to download and store the blob.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait AcceptPushCallback: Send + Sync + 'static {
+    async fn accept(
+        &self,
+        from: Arc<PublicKey>,
+        hash: Arc<Hash>,
+        format: BlobFormat,
+    ) -> Result<bool, CallbackError>;
+}
+
+/// Handles incoming blob pushes, see [`Blobs::send_blob`].
+#[derive(derive_more::Debug, Clone)]
+pub(crate) struct BlobPushProtocol {
+    #[debug("AcceptPushCallback")]
+    callback: Arc<dyn AcceptPushCallback>,
+    #[debug("BlobsClient")]
+    client: BlobsClient,
+    acl: Arc<Acl>,
+}
+
+impl BlobPushProtocol {
+    pub(crate) fn new(
+        callback: Arc<dyn AcceptPushCallback>,
+        client: BlobsClient,
+        acl: Arc<Acl>,
+    ) -> Self {
+        Self {
+            callback,
+            client,
+            acl,
         }
+    }
 
-        Ok(())
+    /// Decide on a push request and store the blob if accepted.
+    ///
+    /// Returns the status byte and optional error message to send back.
+    async fn handle(&self, from: iroh::NodeId, request: &[u8]) -> Vec<u8> {
+        let (hash, format) = match parse_push_request(request) {
+            Ok(req) => req,
+            Err(err) => return push_failure(err),
+        };
+        let accepted = self
+            .callback
+            .accept(
+                Arc::new(from.into()),
+                Arc::new(hash.into()),
+                format.clone().into(),
+            )
+            .await;
+        match accepted {
+            Ok(true) => {}
+            Ok(false) => return vec![BLOB_PUSH_REJECTED],
+            Err(err) => return push_failure(anyhow::Error::from(err)),
+        }
+
+        let opts = iroh_blobs::rpc::client::blobs::DownloadOptions {
+            format,
+            nodes: vec![iroh::NodeAddr::new(from)],
+            tag: iroh_blobs::util::SetTagOption::Auto,
+            mode: iroh_blobs::rpc::client::blobs::DownloadMode::Direct,
+        };
+        let res = async {
+            self.client
+                .download_with_opts(hash, opts)
+                .await?
+                .finish()
+                .await
+        }
+        .await;
+        match res {
+            Ok(_) => vec![BLOB_PUSH_STORED],
+            Err(err) => push_failure(err),
+        }
+    }
+}
+
+fn parse_push_request(
+    request: &[u8],
+) -> anyhow::Result<(iroh_blobs::Hash, iroh_blobs::BlobFormat)> {
+    if request.len() != BLOB_PUSH_REQUEST_LEN {
+        anyhow::bail!("invalid push request length {}", request.len());
+    }
+    let hash: [u8; 32] = request[..32].try_into().expect("checked length");
+    let format = match request[32] {
+        0 => iroh_blobs::BlobFormat::Raw,
+        1 => iroh_blobs::BlobFormat::HashSeq,
+        f => anyhow::bail!("invalid blob format {f}"),
+    };
+    Ok((iroh_blobs::Hash::from_bytes(hash), format))
+}
+
+fn push_failure(err: anyhow::Error) -> Vec<u8> {
+    let mut response = vec![BLOB_PUSH_FAILED];
+    let msg = err.to_string();
+    let len = msg.len().min(BLOB_PUSH_MAX_RESPONSE - 1);
+    response.extend_from_slice(&msg.as_bytes()[..len]);
+    response
+}
+
+impl iroh::protocol::ProtocolHandler for BlobPushProtocol {
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let this = self.clone();
+        Box::pin(async move {
+            let conn = conn.await?;
+            if !this.acl.admit(&conn, AclAction::Connect)? {
+                return Ok(());
+            }
+            let from = iroh::endpoint::get_remote_node_id(&conn)?;
+            let (mut send, mut recv) = conn.accept_bi().await?;
+            let request = recv.read_to_end(BLOB_PUSH_REQUEST_LEN).await?;
+            let response = this.handle(from, &request).await;
+            send.write_all(&response).await?;
+            send.finish()?;
+            conn.closed().await;
+            Ok(())
+        })
     }
 }
 
@@ -345,6 +1047,98 @@ pub struct BlobAddOutcome {
     pub tag: Vec<u8>,
 }
 
+/// Number of chunks a [`BlobWriter`] buffers before [`BlobWriter::write`] waits for the store.
+const BLOB_WRITER_BUFFER: usize = 16;
+/// Maximum size of the chunks [`Blobs::add_from_reader`] reads.
+const BLOB_READER_CHUNK_SIZE: u32 = 64 * 1024;
+
+/// The source of the content of [`Blobs::add_from_reader`], e.g. wrapping a Go `io.Reader`.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait BlobReader: Send + Sync + 'static {
+    /// Read up to `max_len` bytes. An empty result ends the content.
+    async fn read(&self, max_len: u32) -> Result<Vec<u8>, CallbackError>;
+}
+
+/// Writes a blob chunk by chunk, see [`Blobs::writer`].
+#[derive(uniffi::Object)]
+pub struct BlobWriter {
+    sender: tokio::sync::Mutex<Option<tokio::sync::mpsc::Sender<std::io::Result<bytes::Bytes>>>>,
+    task: tokio::sync::Mutex<
+        Option<tokio::task::JoinHandle<anyhow::Result<iroh_blobs::rpc::client::blobs::AddOutcome>>>,
+    >,
+}
+
+#[uniffi::export]
+impl BlobWriter {
+    /// Append `chunk` to the blob.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn write(&self, chunk: Vec<u8>) -> Result<(), IrohError> {
+        let mut timer = CallTimer::start("blob_writer.write");
+        timer.payload(chunk.len());
+        let sender = self.sender.lock().await;
+        let Some(sender) = sender.as_ref() else {
+            return timer.finish(Err(anyhow::anyhow!("blob writer is closed").into()));
+        };
+        if sender.send(Ok(chunk.into())).await.is_err() {
+            // the import stopped, its error is more useful than the closed channel
+            let err = match self.outcome().await {
+                Ok(_) => anyhow::anyhow!("blob writer is closed").into(),
+                Err(err) => err,
+            };
+            return timer.finish(Err(err));
+        }
+        timer.finish(Ok(()))
+    }
+
+    /// Complete the blob and get the outcome of adding it.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn finish(&self) -> Result<BlobAddOutcome, IrohError> {
+        self.sender.lock().await.take();
+        let outcome = self.outcome().await?;
+        Ok(outcome.into())
+    }
+
+    /// Discard the content written so far. No blob is added.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn abort(&self) -> Result<(), IrohError> {
+        if let Some(sender) = self.sender.lock().await.take() {
+            let err = std::io::Error::new(std::io::ErrorKind::Interrupted, "aborted");
+            sender.send(Err(err)).await.ok();
+        }
+        self.outcome().await.ok();
+        Ok(())
+    }
+}
+
+impl BlobWriter {
+    /// Wait for the import to end.
+    async fn outcome(&self) -> Result<iroh_blobs::rpc::client::blobs::AddOutcome, IrohError> {
+        let task = self
+            .task
+            .lock()
+            .await
+            .take()
+            .ok_or_else(|| anyhow::anyhow!("blob writer is closed"))?;
+        let outcome = task.await.map_err(anyhow::Error::from)??;
+        Ok(outcome)
+    }
+}
+
+/// Serialize a [`BlobAddOutcome`] to JSON.
+///
+/// The hash is encoded as its string representation.
+#[uniffi::export]
+pub fn blob_add_outcome_to_json(outcome: &BlobAddOutcome) -> Result<String, IrohError> {
+    crate::to_json(outcome)
+}
+
+/// Parse a [`BlobAddOutcome`] from JSON produced by [`blob_add_outcome_to_json`].
+#[uniffi::export]
+pub fn blob_add_outcome_from_json(json: String) -> Result<BlobAddOutcome, IrohError> {
+    crate::from_json(&json)
+}
+
 impl From<iroh_blobs::rpc::client::blobs::AddOutcome> for BlobAddOutcome {
     fn from(value: iroh_blobs::rpc::client::blobs::AddOutcome) -> Self {
         BlobAddOutcome {
@@ -418,6 +1212,22 @@ impl SetTagOption {
     pub fn named(tag: Vec<u8>) -> Self {
         SetTagOption::Named(tag)
     }
+
+    /// Indicate you want a new tag starting with `prefix`, followed by the current time and a
+    /// random part.
+    ///
+    /// Subsystems sharing a node can use their own prefix to find and delete their tags with
+    /// `Tags.list_by_prefix` and `Tags.delete_by_prefix`.
+    #[uniffi::constructor]
+    pub fn with_prefix(prefix: Vec<u8>) -> Self {
+        let millis = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_millis();
+        let mut tag = prefix;
+        tag.extend_from_slice(format!("{millis}-{:08x}", rand::random::<u32>()).as_bytes());
+        SetTagOption::Named(tag)
+    }
 }
 
 impl From<SetTagOption> for iroh_blobs::util::SetTagOption {
@@ -573,6 +1383,8 @@ pub enum BlobProvideEventType {
     TransferAborted,
 }
 
+crate::display_via_debug!(BlobProvideEventType);
+
 /// An BlobProvide event indicating a new tagged blob or collection was added
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
 pub struct TaggedBlobAdded {
@@ -692,6 +1504,7 @@ impl From<&iroh_blobs::provider::TransferStats> for TransferStats {
 
 /// Events emitted by the provider informing about the current status.
 #[derive(Debug, Clone, PartialEq, uniffi::Object)]
+#[uniffi::export(Display)]
 pub enum BlobProvideEvent {
     /// A new collection or tagged blob has been added
     TaggedBlobAdded(TaggedBlobAdded),
@@ -714,6 +1527,8 @@ pub enum BlobProvideEvent {
     TransferAborted(TransferAborted),
 }
 
+crate::display_via_debug!(BlobProvideEvent);
+
 impl From<iroh_blobs::provider::Event> for BlobProvideEvent {
     fn from(value: iroh_blobs::provider::Event) -> Self {
         match value {
@@ -893,8 +1708,12 @@ pub enum AddProgressType {
     ///
     /// This will be the last message in the stream.
     Abort,
+    /// The progress of the whole operation.
+    Summary,
 }
 
+crate::display_via_debug!(AddProgressType);
+
 /// An AddProgress event indicating an item was found with name `name`, that can be referred to by `id`
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
 pub struct AddProgressFound {
@@ -941,8 +1760,22 @@ pub struct AddProgressAbort {
     pub error: String,
 }
 
+/// An AddProgress event with the progress of the whole operation, for imports of directories
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct AddProgressSummary {
+    /// The number of files to import.
+    pub total_files: u64,
+    /// The size of all files to import, in bytes.
+    pub total_bytes: u64,
+    /// The number of files imported.
+    pub completed_files: u64,
+    /// The bytes imported so far, across all files.
+    pub completed_bytes: u64,
+}
+
 /// Progress updates for the add operation.
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+#[uniffi::export(Display)]
 pub enum AddProgress {
     /// An item was found with name `name`, from now on referred to via `id`
     Found(AddProgressFound),
@@ -956,8 +1789,12 @@ pub enum AddProgress {
     ///
     /// This will be the last message in the stream.
     Abort(AddProgressAbort),
+    /// The progress of the whole operation.
+    Summary(AddProgressSummary),
 }
 
+crate::display_via_debug!(AddProgress);
+
 impl From<iroh_blobs::provider::AddProgress> for AddProgress {
     fn from(value: iroh_blobs::provider::AddProgress) -> Self {
         match value {
@@ -997,8 +1834,19 @@ impl AddProgress {
             AddProgress::Done(_) => AddProgressType::Done,
             AddProgress::AllDone(_) => AddProgressType::AllDone,
             AddProgress::Abort(_) => AddProgressType::Abort,
+            AddProgress::Summary(_) => AddProgressType::Summary,
         }
     }
+    /// Returns true if this is the `AllDone` event, signaling a successful end of the stream.
+    pub fn is_all_done(&self) -> bool {
+        matches!(self, AddProgress::AllDone(_))
+    }
+
+    /// Returns true if this is the `Abort` event, signaling the operation failed.
+    pub fn is_abort(&self) -> bool {
+        matches!(self, AddProgress::Abort(_))
+    }
+
     /// Return the `AddProgressFound` event
     pub fn as_found(&self) -> AddProgressFound {
         match self {
@@ -1037,6 +1885,114 @@ impl AddProgress {
             _ => panic!("AddProgress type is not 'Abort'"),
         }
     }
+
+    /// Return the `AddProgressSummary`, if this is a `Summary` event
+    pub fn as_summary(&self) -> Option<AddProgressSummary> {
+        match self {
+            AddProgress::Summary(s) => Some(s.clone()),
+            _ => None,
+        }
+    }
+}
+
+/// Minimum time between two `AddProgress::Summary` events.
+const ADD_SUMMARY_INTERVAL: Duration = Duration::from_millis(250);
+
+/// The progress of a whole `Blobs.add_from_path` call.
+#[derive(Debug)]
+struct AddTotals {
+    /// Files and bytes found before the import started.
+    counted: (u64, u64),
+    /// Size, bytes imported and whether it is done, by id.
+    files: HashMap<u64, (u64, u64, bool)>,
+    last_summary: Option<Instant>,
+}
+
+impl AddTotals {
+    fn new(counted: (u64, u64)) -> Self {
+        AddTotals {
+            counted,
+            files: HashMap::new(),
+            last_summary: None,
+        }
+    }
+
+    fn update(&mut self, progress: &iroh_blobs::provider::AddProgress) {
+        use iroh_blobs::provider::AddProgress;
+
+        match progress {
+            AddProgress::Found { id, size, .. } => {
+                self.files.insert(*id, (*size, 0, false));
+            }
+            AddProgress::Progress { id, offset } => {
+                if let Some(file) = self.files.get_mut(id) {
+                    file.1 = *offset;
+                }
+            }
+            AddProgress::Done { id, .. } => {
+                if let Some(file) = self.files.get_mut(id) {
+                    file.1 = file.0;
+                    file.2 = true;
+                }
+            }
+            AddProgress::AllDone { .. } | AddProgress::Abort(_) => {}
+        }
+    }
+
+    /// Whether a summary is due, assuming it is sent if so.
+    fn due(&mut self) -> bool {
+        let due = self
+            .last_summary
+            .map_or(true, |last| last.elapsed() >= ADD_SUMMARY_INTERVAL);
+        if due {
+            self.last_summary = Some(Instant::now());
+        }
+        due
+    }
+
+    fn summary(&self) -> AddProgressSummary {
+        let found_bytes = self.files.values().map(|(size, _, _)| size).sum::<u64>();
+        AddProgressSummary {
+            // counting may have failed or missed files created since
+            total_files: self.counted.0.max(self.files.len() as u64),
+            total_bytes: self.counted.1.max(found_bytes),
+            completed_files: self.files.values().filter(|(_, _, done)| *done).count() as u64,
+            completed_bytes: self.files.values().map(|(_, offset, _)| offset).sum(),
+        }
+    }
+}
+
+/// Count the files `Blobs.add_from_path` imports from `path` and their size, `(0, 0)` if that
+/// fails.
+async fn count_files(path: PathBuf) -> (u64, u64) {
+    let res = tokio::task::spawn_blocking(move || count_files_blocking(&path)).await;
+    match res {
+        Ok(Ok(counted)) => counted,
+        _ => (0, 0),
+    }
+}
+
+/// Like the import, counts the regular files under `path` without following symlinks.
+fn count_files_blocking(path: &Path) -> std::io::Result<(u64, u64)> {
+    let meta = std::fs::metadata(path)?;
+    if meta.is_file() {
+        return Ok((1, meta.len()));
+    }
+    let mut counted = (0, 0);
+    let mut dirs = vec![path.to_path_buf()];
+    while let Some(dir) = dirs.pop() {
+        for entry in std::fs::read_dir(&dir)? {
+            let entry = entry?;
+            let file_type = entry.file_type()?;
+            if file_type.is_dir() {
+                dirs.push(entry.path());
+            } else if file_type.is_file() {
+                counted.0 += 1;
+                counted.1 += entry.metadata()?.len();
+            }
+        }
+    }
+    Ok(counted)
 }
 
 /// A format identifier
@@ -1048,6 +2004,8 @@ pub enum BlobFormat {
     HashSeq,
 }
 
+crate::display_via_debug!(BlobFormat);
+
 impl From<iroh_blobs::BlobFormat> for BlobFormat {
     fn from(value: iroh_blobs::BlobFormat) -> Self {
         match value {
@@ -1066,9 +2024,404 @@ impl From<BlobFormat> for iroh_blobs::BlobFormat {
     }
 }
 
+impl Blobs {
+    /// Download a blob, retrying failed attempts according to the retry policy of `opts`.
+    async fn download_with_retry(
+        &self,
+        hash: Arc<Hash>,
+        opts: Arc<BlobDownloadOptions>,
+        cb: Arc<dyn DownloadCallback>,
+    ) -> Result<(), IrohError> {
+        let _permit = self.downloads.acquire().await;
+        let _active = self.incomplete.start(hash.0);
+        self.track_incomplete(hash.0, opts.opts.format).await?;
+        let retry = opts.retry.clone().unwrap_or_default();
+        let max_attempts = retry.max_attempts.max(1);
+        let mut backoff = retry.initial_backoff;
+        let mut attempt = 1;
+        let mut peers = PeerTransfers::default();
+        let mut download_opts = opts.opts.clone();
+        download_opts.nodes = download_opts
+            .nodes
+            .into_iter()
+            .map(|node| self.peer_errors.dialable(node))
+            .collect();
+        loop {
+            let last = attempt >= max_attempts;
+            let download = self.download_attempt(&hash, &download_opts, &cb, last, &mut peers);
+            let res = match retry.attempt_timeout {
+                Some(timeout) => tokio::time::timeout(timeout, download)
+                    .await
+                    .unwrap_or_else(|_| Ok(Some(anyhow::anyhow!("download attempt timed out")))),
+                None => download.await,
+            };
+            match res? {
+                None => {
+                    for tag in self.incomplete_tags(hash.0).await? {
+                        self.client.tags().delete(tag.name).await?;
+                    }
+                    self.serve.tags_changed();
+                    return Ok(());
+                }
+                Some(err) if last => return Err(err.into()),
+                Some(err) => {
+                    let event = DownloadProgress::Retry(DownloadProgressRetry {
+                        attempt,
+                        error: err.to_string(),
+                        backoff,
+                    });
+                    cb.progress(Arc::new(event)).await?;
+                    tokio::time::sleep(backoff).await;
+                    backoff = backoff.saturating_mul(2).min(retry.max_backoff);
+                    attempt += 1;
+                }
+            }
+        }
+    }
+
+    /// Run a single download attempt, forwarding progress events to `cb`.
+    ///
+    /// Returns the transfer error if the attempt failed, callback errors are returned directly.
+    /// Unless this is the `last` attempt, abort events are not forwarded, since the download
+    /// will be retried.
+    ///
+    /// All nodes are passed to a single download, which asks them one at a time and reports
+    /// every new provider with a `Connected` event. The progress events do not say which node
+    /// it connected to, so the bytes are added to the node of `opts` the endpoint used most
+    /// recently.
+    async fn download_attempt(
+        &self,
+        hash: &Hash,
+        opts: &iroh_blobs::rpc::client::blobs::DownloadOptions,
+        cb: &Arc<dyn DownloadCallback>,
+        last: bool,
+        peers: &mut PeerTransfers,
+    ) -> Result<Option<anyhow::Error>, IrohError> {
+        // the download does not tell which node failed, so all of them are blamed
+        let failed = |err: anyhow::Error| {
+            let kind = crate::peer_diagnostics::classify(&err);
+            for node in &opts.nodes {
+                self.peer_errors
+                    .record(node.node_id, iroh_blobs::ALPN, kind, format!("{err:#}"));
+            }
+            err
+        };
+        let mut stream = match self.client.download_with_opts(hash.0, opts.clone()).await {
+            Ok(stream) => stream,
+            Err(err) => return Ok(Some(failed(err))),
+        };
+        let mut provider = match opts.nodes.as_slice() {
+            [node] => Some(node.node_id),
+            _ => None,
+        };
+        let mut offsets = HashMap::new();
+        while let Some(progress) = stream.next().await {
+            let progress = match progress {
+                Ok(progress) => progress,
+                Err(err) => return Ok(Some(failed(err))),
+            };
+            match &progress {
+                iroh_blobs::get::db::DownloadProgress::Abort(err) if !last => {
+                    return Ok(Some(failed(anyhow::anyhow!("{err}"))));
+                }
+                iroh_blobs::get::db::DownloadProgress::Abort(err) => {
+                    // forwarded to the callback, which sees the error
+                    failed(anyhow::anyhow!("{err}"));
+                }
+                iroh_blobs::get::db::DownloadProgress::Connected => {
+                    if opts.nodes.len() > 1 {
+                        provider = self.last_used(&opts.nodes);
+                    }
+                    if let Some(provider) = provider {
+                        self.peer_errors.connected(provider);
+                    }
+                }
+                _ => {}
+            }
+            let mut progress = DownloadProgress::from(progress);
+            match (&mut progress, provider) {
+                (DownloadProgress::Progress(progress), Some(provider)) => {
+                    let previous = offsets.insert(progress.id, progress.offset).unwrap_or(0);
+                    let received = progress.offset.saturating_sub(previous);
+                    progress.provider_bytes = peers.add(provider, received);
+                    progress.provider = Some(Arc::new(provider.into()));
+                }
+                (DownloadProgress::AllDone(all_done), _) => all_done.peers = peers.stats(),
+                _ => {}
+            }
+            cb.progress(Arc::new(progress)).await?;
+        }
+        Ok(None)
+    }
+
+    /// The node of `nodes` the endpoint sent to or received from most recently.
+    fn last_used(&self, nodes: &[iroh::NodeAddr]) -> Option<iroh::NodeId> {
+        nodes
+            .iter()
+            .filter_map(|node| {
+                let info = self.endpoint.remote_info(node.node_id)?;
+                Some((info.last_used?, node.node_id))
+            })
+            .min_by_key(|(last_used, _)| *last_used)
+            .map(|(_, node_id)| node_id)
+    }
+}
+
+/// The bytes received from each peer during a download, in the order the peers were used.
+#[derive(Debug, Default)]
+struct PeerTransfers(Vec<(iroh::NodeId, u64)>);
+
+impl PeerTransfers {
+    /// Add `bytes` received from `peer`, returning the total received from it.
+    fn add(&mut self, peer: iroh::NodeId, bytes: u64) -> u64 {
+        let total = match self.0.iter_mut().find(|(id, _)| *id == peer) {
+            Some((_, total)) => total,
+            None => {
+                self.0.push((peer, 0));
+                &mut self.0.last_mut().expect("just pushed").1
+            }
+        };
+        *total += bytes;
+        *total
+    }
+
+    fn stats(&self) -> Vec<DownloadPeerStats> {
+        self.0
+            .iter()
+            .map(|(id, bytes)| DownloadPeerStats {
+                node_id: Arc::new((*id).into()),
+                bytes: *bytes,
+            })
+            .collect()
+    }
+}
+
+/// Prefix of the tags that record downloads until they complete, see
+/// [`Blobs::prune_incomplete`].
+const INCOMPLETE_TAG_PREFIX: &str = "iroh-ffi/incomplete/";
+
+/// A download recorded in a tag named `iroh-ffi/incomplete/<hash>/<started>`, with the unix
+/// time in seconds when it first started. The tag refers to the blob in the format of the
+/// download.
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct IncompleteTag {
+    name: iroh_blobs::Tag,
+    hash: iroh_blobs::Hash,
+    format: iroh_blobs::BlobFormat,
+    started: std::time::SystemTime,
+}
+
+impl IncompleteTag {
+    fn name(hash: iroh_blobs::Hash, started: std::time::SystemTime) -> iroh_blobs::Tag {
+        let secs = started
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap_or_default()
+            .as_secs();
+        iroh_blobs::Tag(format!("{INCOMPLETE_TAG_PREFIX}{hash}/{secs}").into())
+    }
+
+    fn parse(tag: &iroh_blobs::rpc::client::tags::TagInfo) -> Option<Self> {
+        let name = std::str::from_utf8(&tag.name.0).ok()?;
+        let (hash, secs) = name.strip_prefix(INCOMPLETE_TAG_PREFIX)?.split_once('/')?;
+        let hash = iroh_blobs::Hash::from_str(hash).ok()?;
+        let secs = secs.parse().ok()?;
+        (hash == tag.hash).then(|| IncompleteTag {
+            name: tag.name.clone(),
+            hash,
+            format: tag.format,
+            started: std::time::UNIX_EPOCH + Duration::from_secs(secs),
+        })
+    }
+}
+
+impl Blobs {
+    /// The tags recording downloads of `hash`.
+    async fn incomplete_tags(&self, hash: iroh_blobs::Hash) -> anyhow::Result<Vec<IncompleteTag>> {
+        self.client
+            .tags()
+            .list()
+            .await?
+            .try_filter_map(|tag| async move {
+                Ok(IncompleteTag::parse(&tag).filter(|tag| tag.hash == hash))
+            })
+            .try_collect()
+            .await
+    }
+
+    /// Record a download of `hash` in `format` until it completes, unless the blob is already
+    /// complete or the download was recorded before.
+    async fn track_incomplete(
+        &self,
+        hash: iroh_blobs::Hash,
+        format: iroh_blobs::BlobFormat,
+    ) -> anyhow::Result<()> {
+        let status = self.client.status(hash).await?;
+        if matches!(
+            status,
+            iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. }
+        ) || !self.incomplete_tags(hash).await?.is_empty()
+        {
+            return Ok(());
+        }
+        let batch = self.client.batch().await?;
+        let temp_tag = batch
+            .temp_tag(iroh_blobs::HashAndFormat { hash, format })
+            .await?;
+        let name = IncompleteTag::name(hash, std::time::SystemTime::now());
+        batch.persist_to(temp_tag, name).await?;
+        Ok(())
+    }
+}
+
+/// The downloads running on a node, which [`Blobs::prune_incomplete`] leaves alone.
+#[derive(Debug, Default)]
+pub(crate) struct IncompleteBlobs(std::sync::Mutex<HashMap<iroh_blobs::Hash, usize>>);
+
+impl IncompleteBlobs {
+    /// Record that a download of `hash` started, until the returned guard is dropped.
+    fn start(self: &Arc<Self>, hash: iroh_blobs::Hash) -> ActiveDownload {
+        *self.0.lock().expect("poisoned").entry(hash).or_default() += 1;
+        ActiveDownload {
+            downloads: self.clone(),
+            hash,
+        }
+    }
+
+    fn is_active(&self, hash: &iroh_blobs::Hash) -> bool {
+        self.0.lock().expect("poisoned").contains_key(hash)
+    }
+}
+
+/// A running download, see [`IncompleteBlobs::start`].
+struct ActiveDownload {
+    downloads: Arc<IncompleteBlobs>,
+    hash: iroh_blobs::Hash,
+}
+
+impl Drop for ActiveDownload {
+    fn drop(&mut self) {
+        let mut active = self.downloads.0.lock().expect("poisoned");
+        if let Some(count) = active.get_mut(&self.hash) {
+            *count -= 1;
+            if *count == 0 {
+                active.remove(&self.hash);
+            }
+        }
+    }
+}
+
+/// Limits for concurrent blob downloads.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct DownloadLimits {
+    /// Maximum number of downloads running at the same time.
+    pub max_concurrent_downloads: u32,
+    /// Maximum number of requests sent to a single node at the same time. Fixed when the node
+    /// is created.
+    pub max_concurrent_requests_per_node: u32,
+}
+
+impl Default for DownloadLimits {
+    fn default() -> Self {
+        let limits = iroh_blobs::downloader::ConcurrencyLimits::default();
+        DownloadLimits {
+            max_concurrent_downloads: limits.max_concurrent_requests as u32,
+            max_concurrent_requests_per_node: limits.max_concurrent_requests_per_node as u32,
+        }
+    }
+}
+
+impl DownloadLimits {
+    /// The limits for the blobs downloader, keeping the defaults for everything else.
+    pub(crate) fn concurrency_limits(&self) -> iroh_blobs::downloader::ConcurrencyLimits {
+        iroh_blobs::downloader::ConcurrencyLimits {
+            max_concurrent_requests: self.max_concurrent_downloads.max(1) as usize,
+            max_concurrent_requests_per_node: self.max_concurrent_requests_per_node.max(1) as usize,
+            ..Default::default()
+        }
+    }
+}
+
+/// Limits the number of concurrent [`Blobs::download`] calls of a node.
+#[derive(Debug)]
+pub(crate) struct DownloadLimiter {
+    state: std::sync::Mutex<DownloadLimiterState>,
+    released: tokio::sync::Notify,
+}
+
+#[derive(Debug)]
+struct DownloadLimiterState {
+    limits: DownloadLimits,
+    active: u32,
+}
+
+impl DownloadLimiter {
+    pub(crate) fn new(limits: DownloadLimits) -> Self {
+        DownloadLimiter {
+            state: std::sync::Mutex::new(DownloadLimiterState { limits, active: 0 }),
+            released: tokio::sync::Notify::new(),
+        }
+    }
+
+    fn limits(&self) -> DownloadLimits {
+        self.state.lock().expect("poisoned").limits.clone()
+    }
+
+    fn set_max_concurrent_downloads(&self, max: u32) {
+        self.state
+            .lock()
+            .expect("poisoned")
+            .limits
+            .max_concurrent_downloads = max;
+        self.released.notify_waiters();
+    }
+
+    /// Wait until a download may start.
+    async fn acquire(self: &Arc<Self>) -> DownloadPermit {
+        loop {
+            // created before checking, so a release in between is not missed
+            let released = self.released.notified();
+            {
+                let mut state = self.state.lock().expect("poisoned");
+                if state.active < state.limits.max_concurrent_downloads {
+                    state.active += 1;
+                    return DownloadPermit(self.clone());
+                }
+            }
+            released.await;
+        }
+    }
+}
+
+/// A running download, releases its slot in the [`DownloadLimiter`] when dropped.
+struct DownloadPermit(Arc<DownloadLimiter>);
+
+impl Drop for DownloadPermit {
+    fn drop(&mut self) {
+        self.0.state.lock().expect("poisoned").active -= 1;
+        self.0.released.notify_waiters();
+    }
+}
+
+/// The fields of a [`BlobDownloadOptions`], see [`BlobDownloadOptions::from_params`].
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct BlobDownloadParams {
+    pub format: BlobFormat,
+    /// The nodes to download from.
+    pub nodes: Vec<Arc<NodeAddr>>,
+    /// The tag to keep the downloaded data under, an automatically generated one if not set.
+    #[uniffi(default = None)]
+    pub tag: Option<Arc<SetTagOption>>,
+    /// Retry failed downloads, see [`BlobDownloadOptions::with_retry`].
+    #[uniffi(default = None)]
+    pub retry: Option<RetryPolicy>,
+}
+
 /// Options to download  data specified by the hash.
 #[derive(Debug, uniffi::Object)]
-pub struct BlobDownloadOptions(iroh_blobs::rpc::client::blobs::DownloadOptions);
+pub struct BlobDownloadOptions {
+    opts: iroh_blobs::rpc::client::blobs::DownloadOptions,
+    retry: Option<RetryPolicy>,
+}
 
 #[uniffi::export]
 impl BlobDownloadOptions {
@@ -1079,28 +2432,85 @@ impl BlobDownloadOptions {
         nodes: Vec<Arc<NodeAddr>>,
         tag: Arc<SetTagOption>,
     ) -> Result<Self, IrohError> {
-        Ok(BlobDownloadOptions(
-            iroh_blobs::rpc::client::blobs::DownloadOptions {
-                format: format.into(),
-                nodes: nodes
-                    .into_iter()
-                    .map(|node| (*node).clone().try_into())
-                    .collect::<Result<_, _>>()?,
-                tag: (*tag).clone().into(),
-                mode: iroh_blobs::rpc::client::blobs::DownloadMode::Direct,
-            },
-        ))
+        let opts = iroh_blobs::rpc::client::blobs::DownloadOptions {
+            format: format.into(),
+            nodes: nodes
+                .into_iter()
+                .map(|node| (*node).clone().try_into())
+                .collect::<Result<_, _>>()?,
+            tag: (*tag).clone().into(),
+            mode: iroh_blobs::rpc::client::blobs::DownloadMode::Direct,
+        };
+        Ok(opts.into())
+    }
+
+    /// Create a BlobDownloadRequest that retries failed downloads according to `retry`.
+    #[uniffi::constructor]
+    pub fn with_retry(
+        format: BlobFormat,
+        nodes: Vec<Arc<NodeAddr>>,
+        tag: Arc<SetTagOption>,
+        retry: RetryPolicy,
+    ) -> Result<Self, IrohError> {
+        let mut opts = Self::new(format, nodes, tag)?;
+        opts.retry = Some(retry);
+        Ok(opts)
+    }
+
+    /// Create a BlobDownloadRequest from named fields.
+    #[uniffi::constructor]
+    pub fn from_params(params: BlobDownloadParams) -> Result<Self, IrohError> {
+        let tag = params.tag.unwrap_or_else(|| Arc::new(SetTagOption::Auto));
+        let mut opts = Self::new(params.format, params.nodes, tag)?;
+        opts.retry = params.retry;
+        Ok(opts)
+    }
+
+    /// The retry policy of this request, if any.
+    pub fn retry(&self) -> Option<RetryPolicy> {
+        self.retry.clone()
     }
 }
 
 impl From<iroh_blobs::rpc::client::blobs::DownloadOptions> for BlobDownloadOptions {
     fn from(value: iroh_blobs::rpc::client::blobs::DownloadOptions) -> Self {
-        BlobDownloadOptions(value)
+        BlobDownloadOptions {
+            opts: value,
+            retry: None,
+        }
+    }
+}
+
+/// How failed downloads are retried.
+///
+/// The delay between attempts starts at `initial_backoff` and doubles after every failed
+/// attempt, up to `max_backoff`. Each retry is announced with a `DownloadProgress::Retry` event.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct RetryPolicy {
+    /// Maximum number of attempts, including the first one.
+    pub max_attempts: u32,
+    /// Delay before the first retry.
+    pub initial_backoff: Duration,
+    /// Upper limit for the delay between attempts.
+    pub max_backoff: Duration,
+    /// Abort an attempt that takes longer than this and count it as failed.
+    #[uniffi(default = None)]
+    pub attempt_timeout: Option<Duration>,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        RetryPolicy {
+            max_attempts: 1,
+            initial_backoff: Duration::from_secs(1),
+            max_backoff: Duration::from_secs(30),
+            attempt_timeout: None,
+        }
     }
 }
 
 /// The expected format of a hash being exported.
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Enum)]
 pub enum BlobExportFormat {
     /// The hash refers to any blob and will be exported to a single file.
     Blob,
@@ -1116,6 +2526,8 @@ pub enum BlobExportFormat {
     Collection,
 }
 
+crate::display_via_debug!(BlobExportFormat);
+
 impl From<BlobExportFormat> for iroh_blobs::store::ExportFormat {
     fn from(value: BlobExportFormat) -> Self {
         match value {
@@ -1131,7 +2543,7 @@ impl From<BlobExportFormat> for iroh_blobs::store::ExportFormat {
 /// does not make any sense. E.g. an in memory implementation will always have
 /// to copy the file into memory. Also, a disk based implementation might choose
 /// to copy small files even if the mode is `Reference`.
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Enum)]
 pub enum BlobExportMode {
     /// This mode will copy the file to the target directory.
     ///
@@ -1147,13 +2559,26 @@ pub enum BlobExportMode {
     /// Stores are allowed to ignore this mode and always copy the file, e.g.
     /// if the file is very small or if the store does not support referencing files.
     TryReference,
+    /// This mode will clone the file of the blob in the store, so both share their data on
+    /// disk until one of them is modified. This makes exporting large blobs near instant.
+    ///
+    /// Like [`BlobExportMode::Copy`], the exported file is independent of the store. The blob
+    /// is copied instead if the filesystem does not support cloning files, as is the case for
+    /// most filesystems other than Btrfs, XFS and APFS, if the target is on a different
+    /// filesystem than the store, or if the blob is not kept in a file of its own, such as
+    /// small blobs or blobs of memory nodes.
+    Reflink,
 }
 
+crate::display_via_debug!(BlobExportMode);
+
 impl From<BlobExportMode> for iroh_blobs::store::ExportMode {
     fn from(value: BlobExportMode) -> Self {
         match value {
             BlobExportMode::Copy => iroh_blobs::store::ExportMode::Copy,
             BlobExportMode::TryReference => iroh_blobs::store::ExportMode::TryReference,
+            // the file store clones the data file of a blob when copying it out, if it can
+            BlobExportMode::Reflink => iroh_blobs::store::ExportMode::Copy,
         }
     }
 }
@@ -1179,8 +2604,11 @@ pub enum DownloadProgressType {
     Done,
     AllDone,
     Abort,
+    Retry,
 }
 
+crate::display_via_debug!(DownloadProgressType);
+
 /// A DownloadProgress event indicating an item was found with hash `hash`, that can be referred to by `id`
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
 pub struct DownloadProgressFound {
@@ -1223,6 +2651,22 @@ pub struct DownloadProgressProgress {
     pub id: u64,
     /// The offset of the progress, in bytes.
     pub offset: u64,
+    /// The node the data is downloaded from, if known.
+    pub provider: Option<Arc<PublicKey>>,
+    /// The number of bytes received from `provider` during this download so far.
+    ///
+    /// Counts from the start of each blob, so data that was already present is included when
+    /// a partial blob is resumed.
+    pub provider_bytes: u64,
+}
+
+/// The number of bytes a download received from a single peer.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DownloadPeerStats {
+    /// The peer that provided the data.
+    pub node_id: Arc<PublicKey>,
+    /// The number of bytes received from it.
+    pub bytes: u64,
 }
 
 /// A DownloadProgress event indicated we are done with `id`
@@ -1241,6 +2685,8 @@ pub struct DownloadProgressAllDone {
     pub bytes_read: u64,
     /// The time it took to transfer the data
     pub elapsed: Duration,
+    /// The bytes received from each peer, across all attempts of the download.
+    pub peers: Vec<DownloadPeerStats>,
 }
 
 /// A DownloadProgress event indicating we got an error and need to abort
@@ -1249,6 +2695,17 @@ pub struct DownloadProgressAbort {
     pub error: String,
 }
 
+/// A DownloadProgress event indicating an attempt failed and the download will be retried
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DownloadProgressRetry {
+    /// The number of the attempt that failed, starting at 1.
+    pub attempt: u32,
+    /// Why the attempt failed.
+    pub error: String,
+    /// How long we wait before the next attempt.
+    pub backoff: Duration,
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
 pub struct DownloadProgressInitialState {
     // TODO(b5) - numerous fields missing
@@ -1266,6 +2723,7 @@ pub struct DownloadProgressInitialState {
 
 /// Progress updates for the get operation.
 #[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+#[uniffi::export(Display)]
 pub enum DownloadProgress {
     /// Initial state if subscribing to a running or queued transfer.
     InitialState(DownloadProgressInitialState),
@@ -1287,8 +2745,14 @@ pub enum DownloadProgress {
     ///
     /// This will be the last message in the stream.
     Abort(DownloadProgressAbort),
+    /// An attempt failed, we will try again after a backoff.
+    ///
+    /// Only emitted for downloads with a retry policy.
+    Retry(DownloadProgressRetry),
 }
 
+crate::display_via_debug!(DownloadProgress);
+
 impl From<iroh_blobs::get::db::DownloadProgress> for DownloadProgress {
     fn from(value: iroh_blobs::get::db::DownloadProgress) -> Self {
         match value {
@@ -1328,7 +2792,12 @@ impl From<iroh_blobs::get::db::DownloadProgress> for DownloadProgress {
                 })
             }
             iroh_blobs::get::db::DownloadProgress::Progress { id, offset } => {
-                DownloadProgress::Progress(DownloadProgressProgress { id, offset })
+                DownloadProgress::Progress(DownloadProgressProgress {
+                    id,
+                    offset,
+                    provider: None,
+                    provider_bytes: 0,
+                })
             }
             iroh_blobs::get::db::DownloadProgress::Done { id } => {
                 DownloadProgress::Done(DownloadProgressDone { id })
@@ -1338,6 +2807,7 @@ impl From<iroh_blobs::get::db::DownloadProgress> for DownloadProgress {
                     bytes_written: stats.bytes_written,
                     bytes_read: stats.bytes_read,
                     elapsed: stats.elapsed,
+                    peers: Vec::new(),
                 })
             }
             iroh_blobs::get::db::DownloadProgress::Abort(err) => {
@@ -1364,9 +2834,20 @@ impl DownloadProgress {
             DownloadProgress::Done(_) => DownloadProgressType::Done,
             DownloadProgress::AllDone(_) => DownloadProgressType::AllDone,
             DownloadProgress::Abort(_) => DownloadProgressType::Abort,
+            DownloadProgress::Retry(_) => DownloadProgressType::Retry,
         }
     }
 
+    /// Returns true if this is the `AllDone` event, signaling a successful end of the stream.
+    pub fn is_all_done(&self) -> bool {
+        matches!(self, DownloadProgress::AllDone(_))
+    }
+
+    /// Returns true if this is the `Abort` event, signaling the operation failed.
+    pub fn is_abort(&self) -> bool {
+        matches!(self, DownloadProgress::Abort(_))
+    }
+
     /// Return the `DownloadProgressFound` event
     pub fn as_found(&self) -> DownloadProgressFound {
         match self {
@@ -1422,6 +2903,14 @@ impl DownloadProgress {
             _ => panic!("DownloadProgress type is not 'Abort'"),
         }
     }
+
+    /// Return the `DownloadProgressRetry` event, if this is a `Retry` event
+    pub fn as_retry(&self) -> Option<DownloadProgressRetry> {
+        match self {
+            DownloadProgress::Retry(r) => Some(r.clone()),
+            _ => None,
+        }
+    }
 }
 
 /// A chunk range specification as a sequence of chunk offsets
@@ -1489,6 +2978,69 @@ impl From<iroh_blobs::rpc::client::blobs::IncompleteBlobInfo> for IncompleteBlob
     }
 }
 
+/// Deduplication statistics of the blob store, see `Blobs.dedup_stats`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DedupStats {
+    /// Bytes referenced by all tags and hash sequences, counting shared blobs once per reference.
+    pub logical_bytes: u64,
+    /// Bytes of all complete blobs in the store.
+    pub physical_bytes: u64,
+    /// Number of complete blobs in the store.
+    pub blobs: u64,
+    /// The blobs referenced more than once, most saved bytes first.
+    pub duplicated: Vec<DuplicatedBlob>,
+}
+
+/// A blob that is referenced more than once.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DuplicatedBlob {
+    /// The hash of the blob
+    pub hash: Arc<Hash>,
+    /// The size of the blob
+    pub size: u64,
+    /// How often the blob is referenced
+    pub references: u64,
+}
+
+impl DedupStats {
+    fn new(
+        sizes: &HashMap<iroh_blobs::Hash, u64>,
+        references: &HashMap<iroh_blobs::Hash, u64>,
+        top: usize,
+    ) -> Self {
+        let mut logical_bytes = 0;
+        let mut duplicated = Vec::new();
+        for (hash, count) in references {
+            // references to blobs that are missing or incomplete take no space
+            let Some(size) = sizes.get(hash) else {
+                continue;
+            };
+            logical_bytes += size * count;
+            if *count > 1 {
+                duplicated.push(DuplicatedBlob {
+                    hash: Arc::new(Hash(*hash)),
+                    size: *size,
+                    references: *count,
+                });
+            }
+        }
+        duplicated.sort_by(|a, b| {
+            let saved = |d: &DuplicatedBlob| d.size * (d.references - 1);
+            saved(b)
+                .cmp(&saved(a))
+                .then_with(|| a.hash.0.cmp(&b.hash.0))
+        });
+        duplicated.truncate(top);
+
+        DedupStats {
+            logical_bytes,
+            physical_bytes: sizes.values().sum(),
+            blobs: sizes.len() as u64,
+            duplicated,
+        }
+    }
+}
+
 /// A response to a list collections request
 #[derive(Debug, Clone, Serialize, Deserialize, uniffi::Record)]
 pub struct CollectionInfo {
@@ -1614,7 +3166,7 @@ mod tests {
 
     use super::*;
     use crate::node::Iroh;
-    use crate::{setup_logging, CallbackError, NodeOptions};
+    use crate::{setup_logging, test_utils::Collect, CallbackError, NodeOptions};
 
     use rand::RngCore;
 
@@ -1645,6 +3197,588 @@ mod tests {
         assert!(hash_0.equal(&hash));
     }
 
+    #[test]
+    fn test_progress_display() {
+        assert_eq!(AddProgressType::AllDone.to_string(), "AllDone");
+        assert_eq!(
+            serde_json::to_string(&DownloadProgressType::FoundHashSeq).unwrap(),
+            "\"FoundHashSeq\""
+        );
+
+        let progress = AddProgress::Abort(AddProgressAbort {
+            error: "oops".into(),
+        });
+        assert!(progress.is_abort());
+        assert!(!progress.is_all_done());
+        assert!(progress.to_string().starts_with("Abort"));
+    }
+
+    #[test]
+    fn test_blob_add_outcome_json() {
+        let outcome = BlobAddOutcome {
+            hash: Arc::new(Hash::new(b"hello".to_vec())),
+            format: BlobFormat::Raw,
+            size: 5,
+            tag: b"tag".to_vec(),
+        };
+        let json = blob_add_outcome_to_json(&outcome).unwrap();
+        assert!(json.contains(&outcome.hash.to_string()));
+        let got = blob_add_outcome_from_json(json).unwrap();
+        assert_eq!(outcome, got);
+    }
+
+    #[test]
+    fn test_parse_push_request() {
+        let hash = iroh_blobs::Hash::new(b"hello");
+        let mut request = hash.as_bytes().to_vec();
+        request.push(1);
+        let (got_hash, format) = parse_push_request(&request).unwrap();
+        assert_eq!(got_hash, hash);
+        assert_eq!(format, iroh_blobs::BlobFormat::HashSeq);
+
+        request[32] = 7;
+        assert!(parse_push_request(&request).is_err());
+        assert!(parse_push_request(&request[..10]).is_err());
+
+        let response = push_failure(anyhow::anyhow!("x".repeat(2048)));
+        assert_eq!(response[0], BLOB_PUSH_FAILED);
+        assert_eq!(response.len(), BLOB_PUSH_MAX_RESPONSE);
+    }
+
+    #[tokio::test]
+    async fn test_dedup_stats() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let shared = blobs
+            .add_bytes_named(vec![1u8; 100], "a".into())
+            .await
+            .unwrap();
+        blobs
+            .add_bytes_named(vec![1u8; 100], "b".into())
+            .await
+            .unwrap();
+        blobs
+            .add_bytes_named(vec![2u8; 10], "c".into())
+            .await
+            .unwrap();
+
+        let stats = blobs.dedup_stats(10).await.unwrap();
+        assert_eq!(stats.blobs, 2);
+        assert_eq!(stats.physical_bytes, 110);
+        assert_eq!(stats.logical_bytes, 210);
+        assert_eq!(stats.duplicated.len(), 1);
+        assert_eq!(stats.duplicated[0].hash, shared.hash);
+        assert_eq!(stats.duplicated[0].references, 2);
+
+        let stats = blobs.dedup_stats(0).await.unwrap();
+        assert!(stats.duplicated.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_blob_writer() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+
+        let writer = blobs
+            .writer(Arc::new(SetTagOption::Named(b"recording".to_vec())))
+            .await;
+        let mut content = Vec::new();
+        for i in 0..100u8 {
+            let chunk = vec![i; 1024];
+            content.extend_from_slice(&chunk);
+            writer.write(chunk).await.unwrap();
+        }
+        let outcome = writer.finish().await.unwrap();
+        assert_eq!(outcome.size, content.len() as u64);
+        assert_eq!(outcome.hash.0, iroh_blobs::Hash::new(&content));
+        assert_eq!(outcome.tag, b"recording".to_vec());
+        assert_eq!(blobs.read_to_bytes(outcome.hash).await.unwrap(), content);
+        assert!(writer.write(vec![1]).await.is_err());
+
+        let writer = blobs.writer(Arc::new(SetTagOption::Auto)).await;
+        writer.write(b"discarded".to_vec()).await.unwrap();
+        writer.abort().await.unwrap();
+        assert!(writer.finish().await.is_err());
+        let hash = Arc::new(Hash(iroh_blobs::Hash::new(b"discarded")));
+        assert!(blobs.read_to_bytes(hash).await.is_err());
+    }
+
+    struct Chunks(std::sync::Mutex<std::collections::VecDeque<Result<Vec<u8>, CallbackError>>>);
+
+    #[async_trait::async_trait]
+    impl BlobReader for Chunks {
+        async fn read(&self, max_len: u32) -> Result<Vec<u8>, CallbackError> {
+            let chunk = self.0.lock().unwrap().pop_front().unwrap_or(Ok(Vec::new()));
+            if let Ok(chunk) = &chunk {
+                assert!(chunk.len() <= max_len as usize);
+            }
+            chunk
+        }
+    }
+
+    #[tokio::test]
+    async fn test_add_from_reader() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+
+        let chunks: Vec<_> = (0..10u8).map(|i| vec![i; 1000]).collect();
+        let content = chunks.concat();
+        let reader = Chunks(std::sync::Mutex::new(chunks.into_iter().map(Ok).collect()));
+        let outcome = blobs
+            .add_from_reader(Arc::new(reader), Arc::new(SetTagOption::Auto))
+            .await
+            .unwrap();
+        assert_eq!(outcome.size, content.len() as u64);
+        assert_eq!(blobs.read_to_bytes(outcome.hash).await.unwrap(), content);
+
+        let chunks = vec![Ok(b"partial".to_vec()), Err(CallbackError::Error)];
+        let reader = Chunks(std::sync::Mutex::new(chunks.into_iter().collect()));
+        let res = blobs
+            .add_from_reader(Arc::new(reader), Arc::new(SetTagOption::Auto))
+            .await;
+        assert!(res.is_err());
+        let hash = Arc::new(Hash(iroh_blobs::Hash::new(b"partial")));
+        assert!(blobs.read_to_bytes(hash).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_write_range_to_path() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let outcome = blobs.add_bytes(b"hello world".to_vec()).await.unwrap();
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("out").join("range");
+        let path_str = path.to_string_lossy().into_owned();
+        let written = blobs
+            .write_range_to_path(
+                outcome.hash.clone(),
+                6,
+                &ReadAtLen::All,
+                path_str.clone(),
+                false,
+            )
+            .await
+            .unwrap();
+        assert_eq!(written, 5);
+        blobs
+            .write_range_to_path(
+                outcome.hash.clone(),
+                0,
+                &ReadAtLen::Exact(5),
+                path_str.clone(),
+                true,
+            )
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(&path).unwrap(), b"worldhello");
+
+        blobs
+            .write_range_to_path(outcome.hash, 0, &ReadAtLen::AtMost(3), path_str, false)
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(&path).unwrap(), b"hel");
+    }
+
+    #[tokio::test]
+    async fn test_export_reflink() {
+        let dir = tempfile::tempdir().unwrap();
+
+        // memory nodes have no files to clone and copy instead
+        let node = Iroh::memory().await.unwrap();
+        let outcome = node.blobs().add_bytes(b"hello".to_vec()).await.unwrap();
+        let path = dir.path().join("memory");
+        node.blobs()
+            .export(
+                outcome.hash,
+                path.to_string_lossy().into_owned(),
+                BlobExportFormat::Blob,
+                BlobExportMode::Reflink,
+            )
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(&path).unwrap(), b"hello");
+        node.node().shutdown().await.unwrap();
+
+        let node = Iroh::persistent(dir.path().join("node").to_string_lossy().into_owned())
+            .await
+            .unwrap();
+        let data = vec![7u8; 1024 * 1024];
+        let outcome = node.blobs().add_bytes(data.clone()).await.unwrap();
+        let path = dir.path().join("persistent");
+        node.blobs()
+            .export(
+                outcome.hash.clone(),
+                path.to_string_lossy().into_owned(),
+                BlobExportFormat::Blob,
+                BlobExportMode::Reflink,
+            )
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read(&path).unwrap(), data);
+
+        // the export does not share its content with the store, whether it was cloned or not
+        std::fs::write(&path, b"changed").unwrap();
+        assert_eq!(
+            node.blobs()
+                .read_to_bytes(outcome.hash.clone())
+                .await
+                .unwrap(),
+            data
+        );
+        let status = node.blobs().client.status(outcome.hash.0).await.unwrap();
+        assert!(matches!(
+            status,
+            iroh_blobs::rpc::client::blobs::BlobStatus::Complete { size } if size == data.len() as u64
+        ));
+        node.node().shutdown().await.unwrap();
+    }
+
+    #[test]
+    fn test_verify_content() {
+        let hash = iroh_blobs::Hash::new(b"hello");
+        assert!(verify_content(hash, b"hello").is_ok());
+
+        let err = IrohError::from(anyhow::Error::from(
+            verify_content(hash, b"hellO").unwrap_err(),
+        ));
+        assert_eq!(err.kind(), crate::IrohErrorKind::VerificationFailed);
+        let other = IrohError::from(anyhow::anyhow!("other"));
+        assert_eq!(other.kind(), crate::IrohErrorKind::Other);
+    }
+
+    #[test]
+    fn test_read_range() {
+        let content = b"hello world";
+        assert_eq!(read_range(content, 6, ReadAtLen::All).unwrap(), b"world");
+        assert_eq!(
+            read_range(content, 0, ReadAtLen::Exact(5)).unwrap(),
+            b"hello"
+        );
+        assert!(read_range(content, 6, ReadAtLen::Exact(6)).is_err());
+        assert_eq!(
+            read_range(content, 6, ReadAtLen::AtMost(100)).unwrap(),
+            b"world"
+        );
+        assert!(read_range(content, 12, ReadAtLen::All).is_err());
+    }
+
+    #[test]
+    fn test_sniff_mime() {
+        assert_eq!(sniff_mime(b"\x89PNG\r\n\x1a\n\0\0"), "image/png");
+        assert_eq!(sniff_mime(b"RIFF\0\0\0\0WEBPVP8 "), "image/webp");
+        assert_eq!(sniff_mime(b"\0\0\0\x18ftypmp42"), "video/mp4");
+        assert_eq!(sniff_mime(b"%PDF-1.7"), "application/pdf");
+        assert_eq!(sniff_mime(b"  <!DOCTYPE html><html>"), "text/html");
+        assert_eq!(sniff_mime(b"<svg xmlns=\"\">"), "image/svg+xml");
+        assert_eq!(sniff_mime(b"{\"a\": 1}"), "application/json");
+        assert_eq!(sniff_mime(b"hello"), "text/plain; charset=utf-8");
+        // cut off in the middle of a multi byte character
+        assert_eq!(
+            sniff_mime(&"hä".as_bytes()[..2]),
+            "text/plain; charset=utf-8"
+        );
+        assert_eq!(sniff_mime(b"\0\xff\xfe"), "application/octet-stream");
+    }
+
+    #[tokio::test]
+    async fn test_blob_metadata() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let metadata = HashMap::from([
+            ("name".to_string(), "hello.txt".to_string()),
+            ("mime".to_string(), "text/plain".to_string()),
+        ]);
+        let outcome = blobs
+            .add_bytes_with_metadata(b"hello".to_vec(), metadata.clone())
+            .await
+            .unwrap();
+        let got = blobs.metadata(outcome.hash.clone()).await.unwrap();
+        assert_eq!(got, Some(metadata));
+
+        let updated = HashMap::from([("name".to_string(), "renamed.txt".to_string())]);
+        blobs
+            .set_metadata(outcome.hash.clone(), updated.clone())
+            .await
+            .unwrap();
+        assert_eq!(
+            blobs.metadata(outcome.hash.clone()).await.unwrap(),
+            Some(updated)
+        );
+
+        let other = blobs.add_bytes(b"other".to_vec()).await.unwrap();
+        assert_eq!(blobs.metadata(other.hash).await.unwrap(), None);
+
+        // deleting the tag removes the metadata
+        let name = metadata_tag(&outcome.hash).0.to_vec();
+        node.tags().delete(name).await.unwrap();
+        assert_eq!(blobs.metadata(outcome.hash).await.unwrap(), None);
+    }
+
+    #[tokio::test]
+    async fn test_prune_incomplete() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let missing = iroh_blobs::Hash::new(b"never downloaded");
+        blobs
+            .track_incomplete(missing, iroh_blobs::BlobFormat::HashSeq)
+            .await
+            .unwrap();
+        let tags = blobs.incomplete_tags(missing).await.unwrap();
+        assert_eq!(tags.len(), 1);
+        assert_eq!(tags[0].format, iroh_blobs::BlobFormat::HashSeq);
+        assert_eq!(tags[0].name, IncompleteTag::name(missing, tags[0].started));
+
+        // complete blobs are not tracked
+        let complete = blobs.add_bytes(b"complete".to_vec()).await.unwrap();
+        blobs
+            .track_incomplete(complete.hash.0, iroh_blobs::BlobFormat::Raw)
+            .await
+            .unwrap();
+        assert!(blobs
+            .incomplete_tags(complete.hash.0)
+            .await
+            .unwrap()
+            .is_empty());
+
+        let pruned = blobs
+            .prune_incomplete(Duration::from_secs(3600))
+            .await
+            .unwrap();
+        assert!(pruned.is_empty());
+        // running downloads are never pruned
+        let active = blobs.incomplete.start(missing);
+        assert!(blobs
+            .prune_incomplete(Duration::ZERO)
+            .await
+            .unwrap()
+            .is_empty());
+        drop(active);
+
+        let pruned = blobs.prune_incomplete(Duration::ZERO).await.unwrap();
+        assert_eq!(pruned, vec![Arc::new(Hash(missing))]);
+        assert!(blobs.incomplete_tags(missing).await.unwrap().is_empty());
+        assert_eq!(
+            blobs.read_to_bytes(complete.hash).await.unwrap(),
+            b"complete".to_vec()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_download_limiter() {
+        let limiter = Arc::new(DownloadLimiter::new(DownloadLimits {
+            max_concurrent_downloads: 1,
+            max_concurrent_requests_per_node: 1,
+        }));
+        let first = limiter.acquire().await;
+        let waiting = tokio::spawn({
+            let limiter = limiter.clone();
+            async move {
+                let _permit = limiter.acquire().await;
+            }
+        });
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(!waiting.is_finished());
+
+        // raising the limit lets the waiting download start
+        limiter.set_max_concurrent_downloads(2);
+        tokio::time::timeout(Duration::from_secs(1), waiting)
+            .await
+            .unwrap()
+            .unwrap();
+        drop(first);
+        assert_eq!(limiter.state.lock().unwrap().active, 0);
+    }
+
+    #[tokio::test]
+    async fn test_download_retry() {
+        let provider = Iroh::memory().await.unwrap();
+        let node = Iroh::memory().await.unwrap();
+        // the provider does not have this blob, so every attempt fails
+        let hash = Arc::new(Hash::new(b"missing".to_vec()));
+        let addr = Arc::new(provider.net().node_addr().await.unwrap());
+        let retry = RetryPolicy {
+            max_attempts: 3,
+            initial_backoff: Duration::from_millis(10),
+            max_backoff: Duration::from_millis(15),
+            attempt_timeout: Some(Duration::from_secs(10)),
+        };
+        let opts = BlobDownloadOptions::with_retry(
+            BlobFormat::Raw,
+            vec![addr],
+            Arc::new(SetTagOption::auto()),
+            retry,
+        )
+        .unwrap();
+        let cb = Arc::new(Collect::<Arc<DownloadProgress>>::default());
+        node.blobs()
+            .download(hash, Arc::new(opts), cb.clone())
+            .await
+            .ok();
+
+        let events = cb.0.lock().unwrap();
+        let retries: Vec<_> = events.iter().filter_map(|e| e.as_retry()).collect();
+        assert_eq!(retries.len(), 2);
+        assert_eq!(retries[0].attempt, 1);
+        assert_eq!(retries[0].backoff, Duration::from_millis(10));
+        assert_eq!(retries[1].backoff, Duration::from_millis(15));
+        assert_eq!(
+            events
+                .iter()
+                .filter(|e| e.r#type() == DownloadProgressType::Abort)
+                .count(),
+            1
+        );
+    }
+
+    #[test]
+    fn test_download_options_from_params() {
+        let node_id = PublicKey::from_string(
+            "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254".into(),
+        )
+        .unwrap();
+        let addr = Arc::new(NodeAddr::new(&node_id, None, vec!["127.0.0.1:3000".into()]));
+        let opts = BlobDownloadOptions::from_params(BlobDownloadParams {
+            format: BlobFormat::HashSeq,
+            nodes: vec![addr.clone()],
+            tag: None,
+            retry: None,
+        })
+        .unwrap();
+        assert_eq!(opts.opts.format, iroh_blobs::BlobFormat::HashSeq);
+        assert_eq!(opts.opts.nodes.len(), 1);
+        assert!(matches!(
+            opts.opts.tag,
+            iroh_blobs::util::SetTagOption::Auto
+        ));
+        assert!(opts.retry().is_none());
+
+        let retry = RetryPolicy {
+            max_attempts: 2,
+            initial_backoff: Duration::from_millis(10),
+            max_backoff: Duration::from_millis(10),
+            attempt_timeout: None,
+        };
+        let opts = BlobDownloadOptions::from_params(BlobDownloadParams {
+            format: BlobFormat::Raw,
+            nodes: vec![addr],
+            tag: Some(Arc::new(SetTagOption::named(b"download".to_vec()))),
+            retry: Some(retry.clone()),
+        })
+        .unwrap();
+        assert!(matches!(
+            &opts.opts.tag,
+            iroh_blobs::util::SetTagOption::Named(tag) if tag.0 == b"download".as_slice()
+        ));
+        assert_eq!(opts.retry(), Some(retry));
+    }
+
+    #[tokio::test]
+    async fn test_download_peer_stats() {
+        let empty = Iroh::memory().await.unwrap();
+        let provider = Iroh::memory().await.unwrap();
+        let node = Iroh::memory().await.unwrap();
+        let data = vec![1u8; 100 * 1024];
+        let outcome = provider.blobs().add_bytes(data.clone()).await.unwrap();
+        let provider_id = provider.net().node_id().await.unwrap();
+
+        // the first node does not have the blob, so it is downloaded from the second one
+        let nodes = vec![
+            Arc::new(empty.net().node_addr().await.unwrap()),
+            Arc::new(provider.net().node_addr().await.unwrap()),
+        ];
+        let opts = BlobDownloadOptions::new(BlobFormat::Raw, nodes, Arc::new(SetTagOption::auto()))
+            .unwrap();
+        let cb = Arc::new(Collect::<Arc<DownloadProgress>>::default());
+        node.blobs()
+            .download(outcome.hash, Arc::new(opts), cb.clone())
+            .await
+            .unwrap();
+
+        let events = cb.0.lock().unwrap();
+        let progress: Vec<_> = events
+            .iter()
+            .filter(|e| e.r#type() == DownloadProgressType::Progress)
+            .map(|e| e.as_progress())
+            .collect();
+        assert!(!progress.is_empty());
+        for p in &progress {
+            assert_eq!(p.provider.as_ref().unwrap().to_string(), provider_id);
+        }
+        let all_done = events.last().unwrap().as_all_done();
+        assert_eq!(all_done.peers.len(), 1);
+        assert_eq!(all_done.peers[0].node_id.to_string(), provider_id);
+        assert_eq!(all_done.peers[0].bytes, data.len() as u64);
+        assert_eq!(progress.last().unwrap().provider_bytes, data.len() as u64);
+    }
+
+    #[test]
+    fn test_peer_transfers() {
+        let a = iroh::SecretKey::from_bytes(&[1u8; 32]).public();
+        let b = iroh::SecretKey::from_bytes(&[2u8; 32]).public();
+        let mut peers = PeerTransfers::default();
+        assert_eq!(peers.add(b, 10), 10);
+        assert_eq!(peers.add(a, 5), 5);
+        assert_eq!(peers.add(b, 7), 17);
+        let stats = peers.stats();
+        assert_eq!(stats.len(), 2);
+        assert_eq!(*stats[0].node_id, PublicKey::from(b));
+        assert_eq!(stats[0].bytes, 17);
+        assert_eq!(stats[1].bytes, 5);
+    }
+
+    #[tokio::test]
+    async fn test_send_blob() {
+        struct Accept(bool);
+        #[async_trait::async_trait]
+        impl AcceptPushCallback for Accept {
+            async fn accept(
+                &self,
+                _from: Arc<PublicKey>,
+                _hash: Arc<Hash>,
+                _format: BlobFormat,
+            ) -> Result<bool, CallbackError> {
+                Ok(self.0)
+            }
+        }
+
+        let sender = Iroh::memory().await.unwrap();
+        let receiver = Iroh::memory_with_options(NodeOptions {
+            accept_push: Some(Arc::new(Accept(true))),
+            ..Default::default()
+        })
+        .await
+        .unwrap();
+        let rejecter = Iroh::memory_with_options(NodeOptions {
+            accept_push: Some(Arc::new(Accept(false))),
+            ..Default::default()
+        })
+        .await
+        .unwrap();
+
+        let outcome = sender.blobs().add_bytes(b"pushed".to_vec()).await.unwrap();
+
+        let addr = receiver.net().node_addr().await.unwrap();
+        sender
+            .blobs()
+            .send_blob(&addr, &outcome.hash, BlobFormat::Raw)
+            .await
+            .unwrap();
+        let got = receiver
+            .blobs()
+            .read_to_bytes(outcome.hash.clone())
+            .await
+            .unwrap();
+        assert_eq!(got, b"pushed".to_vec());
+
+        let addr = rejecter.net().node_addr().await.unwrap();
+        assert!(sender
+            .blobs()
+            .send_blob(&addr, &outcome.hash, BlobFormat::Raw)
+            .await
+            .is_err());
+    }
+
     #[tokio::test]
     async fn test_blobs_add_get_bytes() {
         let dir = tempfile::tempdir().unwrap();
@@ -1780,6 +3914,74 @@ mod tests {
         assert_eq!(bytes, got_bytes);
     }
 
+    #[tokio::test]
+    async fn test_add_from_path_summary() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir(dir.path().join("sub")).unwrap();
+        for (name, size) in [("a", 100), ("b", 2000), ("sub/c", 30_000)] {
+            std::fs::write(dir.path().join(name), vec![1u8; size]).unwrap();
+        }
+        let node = Iroh::memory().await.unwrap();
+        let cb = Arc::new(Collect::<Arc<AddProgress>>::default());
+        node.blobs()
+            .add_from_path(
+                dir.path().display().to_string(),
+                false,
+                Arc::new(SetTagOption::auto()),
+                Arc::new(WrapOption::no_wrap()),
+                cb.clone(),
+            )
+            .await
+            .unwrap();
+
+        let events = cb.0.lock().unwrap();
+        assert!(events.last().unwrap().is_all_done());
+        let summary = events[events.len() - 2].as_summary().unwrap();
+        assert_eq!(
+            summary,
+            AddProgressSummary {
+                total_files: 3,
+                total_bytes: 32_100,
+                completed_files: 3,
+                completed_bytes: 32_100,
+            }
+        );
+        let summaries: Vec<_> = events.iter().filter_map(|e| e.as_summary()).collect();
+        assert!(summaries.iter().all(|s| s.total_files == 3));
+        assert!(summaries
+            .windows(2)
+            .all(|w| w[0].completed_bytes <= w[1].completed_bytes));
+    }
+
+    #[test]
+    fn test_add_totals() {
+        use iroh_blobs::provider::AddProgress;
+
+        let mut totals = AddTotals::new((0, 0));
+        totals.update(&AddProgress::Found {
+            id: 1,
+            name: "a".to_string(),
+            size: 10,
+        });
+        totals.update(&AddProgress::Found {
+            id: 2,
+            name: "b".to_string(),
+            size: 20,
+        });
+        totals.update(&AddProgress::Progress { id: 2, offset: 5 });
+        totals.update(&AddProgress::Done {
+            id: 1,
+            hash: iroh_blobs::Hash::new(b"a"),
+        });
+        let summary = totals.summary();
+        assert_eq!(summary.total_files, 2);
+        assert_eq!(summary.total_bytes, 30);
+        assert_eq!(summary.completed_files, 1);
+        assert_eq!(summary.completed_bytes, 15);
+        assert!(totals.due());
+        assert!(!totals.due());
+    }
+
     #[tokio::test]
     async fn test_blobs_list_collections() {
         let dir = tempfile::tempdir().unwrap();
@@ -0,0 +1,186 @@
+use std::{
+    future::Future,
+    sync::Arc,
+    time::{Duration, Instant},
+};
+
+use tokio_util::sync::CancellationToken;
+
+use crate::{
+    error::Cancelled, AddCallback, BlobDownloadOptions, Blobs, Doc, DownloadCallback, Hash,
+    IrohError, NodeAddr, ReadOnlyDoc, SetTagOption, WrapOption,
+};
+
+/// Cancels the operations it is passed to, e.g. `Blobs.download_cancellable`.
+///
+/// Bindings without support for cancelling async calls can use it to stop an operation, e.g.
+/// when a Go context is done. One token can be passed to several operations, which are all
+/// cancelled together.
+#[derive(Debug, uniffi::Object)]
+pub struct CancelToken {
+    token: CancellationToken,
+    deadline: Option<Instant>,
+}
+
+#[uniffi::export]
+impl CancelToken {
+    /// A token that is only cancelled by calling [`CancelToken::cancel`].
+    #[uniffi::constructor]
+    pub fn new() -> Self {
+        CancelToken {
+            token: CancellationToken::new(),
+            deadline: None,
+        }
+    }
+
+    /// A token that is cancelled once `timeout` has passed, or by calling
+    /// [`CancelToken::cancel`] before that.
+    #[uniffi::constructor]
+    pub fn with_timeout(timeout: Duration) -> Self {
+        CancelToken {
+            token: CancellationToken::new(),
+            deadline: Some(Instant::now() + timeout),
+        }
+    }
+
+    /// Cancel the operations using this token.
+    ///
+    /// Operations started with a cancelled token fail right away.
+    pub fn cancel(&self) {
+        self.token.cancel();
+    }
+
+    /// Whether the token was cancelled or its timeout has passed.
+    pub fn is_cancelled(&self) -> bool {
+        self.token.is_cancelled() || self.timed_out()
+    }
+}
+
+impl Default for CancelToken {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl CancelToken {
+    fn timed_out(&self) -> bool {
+        self.deadline
+            .is_some_and(|deadline| deadline <= Instant::now())
+    }
+
+    /// Run `fut` until it completes or the token is cancelled, in which case it is dropped,
+    /// stopping it, and an error of kind `IrohErrorKind::Cancelled` is returned.
+    pub(crate) async fn run<T>(
+        &self,
+        fut: impl Future<Output = Result<T, IrohError>>,
+    ) -> Result<T, IrohError> {
+        let deadline = async {
+            match self.deadline {
+                Some(deadline) => tokio::time::sleep_until(deadline.into()).await,
+                None => std::future::pending().await,
+            }
+        };
+        tokio::select! {
+            biased;
+            _ = self.token.cancelled() => Err(Cancelled { timed_out: false }.into()),
+            _ = deadline => Err(Cancelled { timed_out: true }.into()),
+            res = fut => res,
+        }
+    }
+}
+
+#[uniffi::export]
+impl Blobs {
+    /// Import a file or directory, see [`Blobs::add_from_path`], until `cancel` is cancelled.
+    ///
+    /// Cancelling stops the import. Blobs imported before remain in the store without a tag
+    /// and are removed by the garbage collection.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn add_from_path_cancellable(
+        &self,
+        path: String,
+        in_place: bool,
+        tag: Arc<SetTagOption>,
+        wrap: Arc<WrapOption>,
+        cb: Arc<dyn AddCallback>,
+        cancel: Arc<CancelToken>,
+    ) -> Result<(), IrohError> {
+        cancel
+            .run(self.add_from_path(path, in_place, tag, wrap, cb))
+            .await
+    }
+
+    /// Download a blob, see [`Blobs::download`], until `cancel` is cancelled.
+    ///
+    /// Cancelling stops waiting for the download and its retries, like an attempt timing out.
+    /// The data received so far is kept as an incomplete blob, which a later download resumes.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn download_cancellable(
+        &self,
+        hash: Arc<Hash>,
+        opts: Arc<BlobDownloadOptions>,
+        cb: Arc<dyn DownloadCallback>,
+        cancel: Arc<CancelToken>,
+    ) -> Result<(), IrohError> {
+        cancel.run(self.download(hash, opts, cb)).await
+    }
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Start the live sync, see [`Doc::start_sync`], unless `cancel` is cancelled first.
+    ///
+    /// Only starting the sync can be cancelled, use [`Doc::leave`] to stop a running sync.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn start_sync_cancellable(
+        &self,
+        peers: Vec<Arc<NodeAddr>>,
+        cancel: Arc<CancelToken>,
+    ) -> Result<(), IrohError> {
+        cancel.run(self.start_sync(peers)).await
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// Start the live sync unless `cancel` is cancelled first, see
+    /// [`Doc::start_sync_cancellable`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn start_sync_cancellable(
+        &self,
+        peers: Vec<Arc<NodeAddr>>,
+        cancel: Arc<CancelToken>,
+    ) -> Result<(), IrohError> {
+        self.doc.start_sync_cancellable(peers, cancel).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::IrohErrorKind;
+
+    #[tokio::test]
+    async fn test_cancel_token() {
+        let pending = || std::future::pending::<Result<(), IrohError>>();
+
+        let cancel = CancelToken::new();
+        assert_eq!(cancel.run(async { Ok(1) }).await.unwrap(), 1);
+        let (res, _) = tokio::join!(cancel.run(pending()), async {
+            tokio::time::sleep(Duration::from_millis(50)).await;
+            cancel.cancel();
+        });
+        assert_eq!(res.unwrap_err().kind(), IrohErrorKind::Cancelled);
+        assert!(cancel.is_cancelled());
+        // already cancelled
+        let err = cancel.run(async { Ok(()) }).await.unwrap_err();
+        assert_eq!(err.kind(), IrohErrorKind::Cancelled);
+
+        let cancel = CancelToken::with_timeout(Duration::from_millis(50));
+        assert!(!cancel.is_cancelled());
+        let err = cancel.run(pending()).await.unwrap_err();
+        assert_eq!(err.kind(), IrohErrorKind::Cancelled);
+        assert!(err.message().contains("deadline"));
+        assert!(cancel.is_cancelled());
+    }
+}
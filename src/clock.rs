@@ -0,0 +1,255 @@
+use std::sync::Arc;
+
+use anyhow::Context;
+use futures::{future, Stream, TryStreamExt};
+use iroh_docs::rpc::client::docs::LiveEvent;
+
+use crate::{doc::WriteGuard, sidecar, CallbackError, Doc, SignedRecord};
+
+/// A clock for the timestamps of document entries, see `NodeOptions.clock`.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait ClockCallback: Send + Sync + 'static {
+    /// The current time in microseconds since the unix epoch.
+    async fn now(&self) -> Result<u64, CallbackError>;
+}
+
+/// The clock of `NodeOptions.clock`.
+#[derive(derive_more::Debug, Clone)]
+#[debug("EntryClock")]
+pub(crate) struct EntryClock(Arc<dyn ClockCallback>);
+
+impl EntryClock {
+    pub(crate) fn new(clock: Arc<dyn ClockCallback>) -> Self {
+        EntryClock(clock)
+    }
+
+    async fn now(&self) -> anyhow::Result<u64> {
+        let now = self.0.now().await.context("failed to read the clock")?;
+        Ok(now)
+    }
+}
+
+impl Doc {
+    /// Set `key` to `value`, timestamped by the node clock if there is one.
+    pub(crate) async fn put_bytes(
+        &self,
+        _lock: &WriteGuard<'_>,
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        value: Vec<u8>,
+    ) -> anyhow::Result<iroh_blobs::Hash> {
+        let Some(clock) = &self.engine.clock else {
+            let hash = self.inner.set_bytes(author, key.clone(), value).await?;
+            self.index_write(author, &key).await?;
+            return Ok(hash);
+        };
+        let len = value.len() as u64;
+        let outcome = self.engine.blobs.add_bytes(value).await?;
+        // the entry protects the content from garbage collection once it is inserted
+        let res = self
+            .insert_clocked(clock, author, key.clone(), outcome.hash, len)
+            .await;
+        self.engine.blobs.tags().delete(outcome.tag).await?;
+        res?;
+        self.index_write(author, &key).await?;
+        Ok(outcome.hash)
+    }
+
+    /// Set `key` to `hash`, timestamped by the node clock if there is one.
+    pub(crate) async fn put_hash(
+        &self,
+        _lock: &WriteGuard<'_>,
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        hash: iroh_blobs::Hash,
+        len: u64,
+    ) -> anyhow::Result<()> {
+        match &self.engine.clock {
+            Some(clock) => {
+                self.insert_clocked(clock, author, key.clone(), hash, len)
+                    .await?
+            }
+            None => self.inner.set_hash(author, key.clone(), hash, len).await?,
+        }
+        self.index_write(author, &key).await
+    }
+
+    /// Delete the entries of `author` below `prefix`, timestamped by the node clock if there
+    /// is one.
+    pub(crate) async fn del_prefix(
+        &self,
+        _lock: &WriteGuard<'_>,
+        author: iroh_docs::AuthorId,
+        prefix: Vec<u8>,
+    ) -> anyhow::Result<usize> {
+        let Some(clock) = &self.engine.clock else {
+            let removed = self.inner.del(author, prefix.clone()).await?;
+            self.index_write(author, &prefix).await?;
+            return Ok(removed);
+        };
+        // entries inserted from sync do not report what they removed, compare the entries
+        // before and after instead, the write lock keeps other local writes out
+        let before = self.entries_below(author, &prefix).await?;
+        let timestamp = clock.now().await?;
+        let hash = iroh_blobs::Hash::EMPTY;
+        self.insert_at(timestamp, author, prefix.clone(), hash, 0)
+            .await?;
+        let after = self.entries_below(author, &prefix).await?;
+        let removed = before
+            .iter()
+            .filter(|entry| {
+                !after
+                    .iter()
+                    .any(|kept| kept.key() == entry.key() && kept.timestamp() == entry.timestamp())
+            })
+            .count();
+        self.index_write(author, &prefix).await?;
+        Ok(removed)
+    }
+
+    /// Subscribe to the events of the document, reporting the entries written by this node
+    /// with the node clock as local inserts. Inserts of sidecar entries are left out.
+    ///
+    /// Those entries reach the docs engine as if received from this node, see
+    /// [`Doc::insert_record`], and are reported as remote inserts by the engine.
+    pub(crate) async fn live_events(
+        &self,
+    ) -> anyhow::Result<impl Stream<Item = anyhow::Result<LiveEvent>> + Send + Unpin + 'static>
+    {
+        let node_id = self.engine.node_id;
+        let events = self.inner.subscribe().await?;
+        Ok(events
+            .try_filter(|event| {
+                let sidecar = match event {
+                    LiveEvent::InsertLocal { entry } | LiveEvent::InsertRemote { entry, .. } => {
+                        sidecar::is_sidecar(entry.key())
+                    }
+                    _ => false,
+                };
+                future::ready(!sidecar)
+            })
+            .map_ok(move |event| match event {
+                LiveEvent::InsertRemote { from, entry, .. } if from == node_id => {
+                    LiveEvent::InsertLocal { entry }
+                }
+                event => event,
+            }))
+    }
+
+    async fn entries_below(
+        &self,
+        author: iroh_docs::AuthorId,
+        prefix: &[u8],
+    ) -> anyhow::Result<Vec<iroh_docs::rpc::client::docs::Entry>> {
+        let query = iroh_docs::store::Query::author(author)
+            .key_prefix(prefix)
+            .include_empty()
+            .build();
+        self.inner.get_many(query).await?.try_collect().await
+    }
+
+    async fn insert_clocked(
+        &self,
+        clock: &EntryClock,
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        hash: iroh_blobs::Hash,
+        len: u64,
+    ) -> anyhow::Result<()> {
+        let timestamp = clock.now().await?;
+        self.insert_at(timestamp, author, key, hash, len).await
+    }
+
+    /// Sign and insert an entry with the given timestamp.
+    async fn insert_at(
+        &self,
+        timestamp: u64,
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        hash: iroh_blobs::Hash,
+        len: u64,
+    ) -> anyhow::Result<()> {
+        let namespace = self.inner.id();
+        let author = self
+            .engine
+            .sync
+            .export_author(author)
+            .await?
+            .with_context(|| format!("author {author} not found"))?;
+        let record = SignedRecord::sign(&author, namespace, key, hash, len, timestamp);
+        self.insert_record(record).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::atomic::{AtomicU64, Ordering};
+
+    use super::*;
+
+    /// A clock that only moves when told to.
+    struct ManualClock(AtomicU64);
+
+    #[async_trait::async_trait]
+    impl ClockCallback for ManualClock {
+        async fn now(&self) -> Result<u64, CallbackError> {
+            Ok(self.0.load(Ordering::SeqCst))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_custom_clock() {
+        let start = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap()
+            .as_micros() as u64
+            - 3_600_000_000;
+        let clock = Arc::new(ManualClock(AtomicU64::new(start)));
+        let node = crate::Iroh::memory_with_options(crate::NodeOptions {
+            enable_docs: true,
+            clock: Some(clock.clone()),
+            ..Default::default()
+        })
+        .await
+        .unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let events = doc.subscribe_events(16).await.unwrap();
+
+        doc.set_bytes(&author, b"a".to_vec(), b"one".to_vec())
+            .await
+            .unwrap();
+        // reported like any other local write
+        let event = events.next().await.unwrap();
+        assert_eq!(event.r#type(), crate::LiveEventType::InsertLocal);
+        assert_eq!(event.as_insert_local().key(), b"a".to_vec());
+        let entry = doc
+            .get_exact(author.clone(), b"a".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.timestamp(), start);
+        let content = doc.read_content(entry).await.unwrap();
+        assert_eq!(content.data, b"one");
+
+        clock.0.fetch_add(1, Ordering::SeqCst);
+        doc.set_bytes(&author, b"a/b".to_vec(), b"two".to_vec())
+            .await
+            .unwrap();
+        clock.0.fetch_add(1, Ordering::SeqCst);
+        let removed = doc.delete(author.clone(), b"a".to_vec()).await.unwrap();
+        assert_eq!(removed, 2);
+        assert!(doc
+            .get_exact(author.clone(), b"a/b".to_vec(), false)
+            .await
+            .unwrap()
+            .is_none());
+        let tombstone = doc
+            .get_exact(author, b"a".to_vec(), true)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(tombstone.timestamp(), start + 2);
+    }
+}
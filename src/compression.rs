@@ -0,0 +1,353 @@
+use std::{io::Read, sync::Arc};
+
+use anyhow::Context;
+
+use crate::{entry_meta, sidecar, AuthorId, Doc, Entry, Hash, IrohError, ReadOnlyDoc};
+
+/// Kind of the sidecar marking content compressed by `Doc.set_bytes_with_options`, see
+/// [`sidecar::write`]. Its payload is the uncompressed length as a big endian u64.
+pub(crate) const COMPRESSED_SIDECAR: &str = "zstd";
+/// The zstd compression level, the zstd default.
+const COMPRESSION_LEVEL: i32 = 3;
+/// Larger content is stored uncompressed, and compressed content claiming to be larger is
+/// not decompressed.
+const MAX_DECOMPRESSED_LEN: u64 = 256 * 1024 * 1024;
+
+/// Options for `Doc.set_bytes_with_options`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct SetBytesOptions {
+    /// Compress the content with zstd before storing it.
+    ///
+    /// The content is stored and synced compressed, read it with `Doc.read_content` to get it
+    /// back uncompressed. Reading the content hash directly, e.g. with `Blobs.read_to_bytes`,
+    /// returns the compressed bytes. Content that does not get smaller or is larger than
+    /// 256 MiB is stored as is.
+    ///
+    /// That the content is compressed is recorded in a sidecar entry written by the same
+    /// author, at a key starting with `\xffiroh-ffi/zstd/` followed by the key of the entry.
+    /// Sidecars are not returned by queries and listings and are copied along with their entry.
+    /// Peers need the sidecar to decompress the content, so keep it included in download
+    /// policies.
+    #[uniffi(default = false)]
+    pub compress: bool,
+    /// Small metadata stored with the content, such as its media type or encoding, up to 256
+    /// bytes.
+    ///
+    /// Read it back with `Doc.entry_meta` or `Doc.read_content`. The metadata is stored in a
+    /// sidecar entry written by the same author, at a key starting with `\xffiroh-ffi/meta/`
+    /// followed by the key of the entry, so the content of the entry is stored as is. Like the
+    /// sidecar of compressed content, it is not returned by queries and listings and is
+    /// copied along with its entry.
+    ///
+    /// Setting the key again with this method replaces or removes the metadata and marks
+    /// the content as compressed or not. `Doc.set_bytes` leaves the sidecars alone, so content
+    /// set with it that is identical to the content before keeps its metadata.
+    #[uniffi(default = None)]
+    pub meta: Option<Vec<u8>>,
+}
+
+/// The content of an entry, see `Doc.read_content`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct EntryContent {
+    /// The uncompressed content.
+    pub data: Vec<u8>,
+    /// Whether the content is stored compressed.
+    pub compressed: bool,
+    /// Size of the content as stored and synced, the content length of the entry.
+    pub stored_len: u64,
+    /// The metadata stored with the content, see [`SetBytesOptions::meta`].
+    pub meta: Option<Vec<u8>>,
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Set the content of a key to a byte array, see [`SetBytesOptions`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn set_bytes_with_options(
+        &self,
+        author_id: &AuthorId,
+        key: Vec<u8>,
+        value: Vec<u8>,
+        options: SetBytesOptions,
+    ) -> Result<Arc<Hash>, IrohError> {
+        self.ensure_open()?;
+        let uncompressed_len = value.len() as u64;
+        let frame = if options.compress {
+            compress(&value)?
+        } else {
+            None
+        };
+        let compressed = frame.is_some();
+        let value = frame.unwrap_or(value);
+        let hash = iroh_blobs::Hash::new(&value);
+        // the entry and its sidecars are written under one lock, so readers see all or none
+        let lock = self.write_lock().await;
+        let meta = options.meta.as_deref();
+        entry_meta::write(self, &lock, author_id, &key, hash, meta).await?;
+        if compressed {
+            let payload = uncompressed_len.to_be_bytes();
+            sidecar::write(
+                self,
+                &lock,
+                author_id,
+                COMPRESSED_SIDECAR,
+                &key,
+                hash,
+                &payload,
+            )
+            .await?;
+        } else {
+            sidecar::clear(self, &lock, author_id, COMPRESSED_SIDECAR, &key).await?;
+        }
+        let res = self.put_bytes(&lock, author_id.0, key, value).await;
+        let hash = self
+            .engine
+            .events
+            .check_write("doc.set_bytes_with_options", res)?;
+        Ok(Arc::new(Hash(hash)))
+    }
+
+    /// Read the content of an entry, decompressing it if it was stored compressed with
+    /// `Doc.set_bytes_with_options`.
+    ///
+    /// The content has to be available on this node.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_content(&self, entry: Arc<Entry>) -> Result<EntryContent, IrohError> {
+        self.ensure_open()?;
+        let stored = self
+            .engine
+            .content_cache
+            .read(&self.engine.blobs, entry.0.content_hash())
+            .await?;
+        let content = decode_entry(self, &entry.0, &stored).await?;
+        Ok(content)
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// Read the content of an entry, decompressing it if it was stored compressed with
+    /// `Doc.set_bytes_with_options`.
+    ///
+    /// The content has to be available on this node.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_content(&self, entry: Arc<Entry>) -> Result<EntryContent, IrohError> {
+        self.doc.read_content(entry).await
+    }
+}
+
+/// Compress `value` into a zstd frame, unless that does not make it smaller.
+fn compress(value: &[u8]) -> anyhow::Result<Option<Vec<u8>>> {
+    if value.len() as u64 > MAX_DECOMPRESSED_LEN {
+        return Ok(None);
+    }
+    let frame = zstd::bulk::compress(value, COMPRESSION_LEVEL)?;
+    Ok(Some(frame).filter(|frame| frame.len() < value.len()))
+}
+
+/// Decompress the zstd `frame` of content that is `len` bytes uncompressed.
+///
+/// Never produces more than `len` bytes, so a frame that decompresses to much more than it
+/// claims can not exhaust memory.
+fn decompress(frame: &[u8], len: u64) -> anyhow::Result<Vec<u8>> {
+    anyhow::ensure!(
+        len <= MAX_DECOMPRESSED_LEN,
+        "compressed content claims to be {len} bytes, at most {MAX_DECOMPRESSED_LEN} are decompressed"
+    );
+    let mut data = Vec::new();
+    zstd::stream::read::Decoder::with_buffer(frame)?
+        .take(len + 1)
+        .read_to_end(&mut data)
+        .context("invalid compressed content")?;
+    anyhow::ensure!(
+        data.len() as u64 == len,
+        "compressed content is not {len} bytes long"
+    );
+    Ok(data)
+}
+
+/// Decode the content `stored` of `entry` of `doc`, see [`decode`].
+pub(crate) async fn decode_entry(
+    doc: &Doc,
+    entry: &iroh_docs::rpc::client::docs::Entry,
+    stored: &[u8],
+) -> anyhow::Result<EntryContent> {
+    let uncompressed_len = match sidecar::read(doc, entry, COMPRESSED_SIDECAR).await? {
+        Some(payload) => {
+            let payload = payload
+                .try_into()
+                .map_err(|_| anyhow::anyhow!("invalid compression sidecar"))?;
+            Some(u64::from_be_bytes(payload))
+        }
+        None => None,
+    };
+    let mut content = decode(stored, uncompressed_len)?;
+    content.meta = entry_meta::read(doc, entry).await?;
+    Ok(content)
+}
+
+/// Decompress `stored` if it is compressed, in which case `uncompressed_len` is its
+/// uncompressed length.
+fn decode(stored: &[u8], uncompressed_len: Option<u64>) -> anyhow::Result<EntryContent> {
+    let stored_len = stored.len() as u64;
+    match uncompressed_len {
+        Some(len) => Ok(EntryContent {
+            data: decompress(stored, len)?,
+            compressed: true,
+            stored_len,
+            meta: None,
+        }),
+        None => Ok(EntryContent {
+            data: stored.to_vec(),
+            compressed: false,
+            stored_len,
+            meta: None,
+        }),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{test_utils::local_node, DocCursor, Query, QueryOptions};
+
+    #[test]
+    fn test_compress_roundtrip() {
+        let text = "the quick brown fox jumps over the lazy dog. ".repeat(100);
+        let len = text.len() as u64;
+        let compressed = compress(text.as_bytes()).unwrap().unwrap();
+        assert!(compressed.len() < text.len() / 4);
+        let content = decode(&compressed, Some(len)).unwrap();
+        assert_eq!(content.data, text.as_bytes());
+        assert!(content.compressed);
+        assert_eq!(content.stored_len, compressed.len() as u64);
+
+        // content that decompresses to more or less than it claims is rejected
+        assert!(decode(&compressed, Some(len - 1)).is_err());
+        assert!(decode(&compressed, Some(len + 1)).is_err());
+        assert!(decode(&compressed, Some(MAX_DECOMPRESSED_LEN + 1)).is_err());
+
+        // too small to gain anything
+        assert!(compress(b"short").unwrap().is_none());
+        let content = decode(b"short", None).unwrap();
+        assert!(!content.compressed);
+        assert_eq!(content.data, b"short");
+    }
+
+    #[tokio::test]
+    async fn test_set_bytes_compressed() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let text = "lorem ipsum dolor sit amet ".repeat(200).into_bytes();
+
+        let options = SetBytesOptions {
+            compress: true,
+            meta: None,
+        };
+        doc.set_bytes_with_options(&author, b"text".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        doc.set_bytes(&author, b"plain".to_vec(), text.clone())
+            .await
+            .unwrap();
+
+        let entry = doc
+            .get_exact(author.clone(), b"text".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert!(entry.content_len() < text.len() as u64);
+        let content = doc.read_content(entry.clone()).await.unwrap();
+        assert!(content.compressed);
+        assert_eq!(content.data, text);
+        assert_eq!(content.stored_len, entry.content_len());
+
+        let entry = doc
+            .get_exact(author, b"plain".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = doc.read_only().read_content(entry).await.unwrap();
+        assert!(!content.compressed);
+        assert_eq!(content.data, text);
+
+        // plain content that happens to be a zstd frame is not decompressed
+        let frame = compress(&text).unwrap().unwrap();
+        doc.set_bytes_with_options(
+            &author,
+            b"text".to_vec(),
+            frame.clone(),
+            SetBytesOptions::default(),
+        )
+        .await
+        .unwrap();
+        let entry = doc
+            .get_exact(author, b"text".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = doc.read_content(entry).await.unwrap();
+        assert!(!content.compressed);
+        assert_eq!(content.data, frame);
+    }
+
+    #[tokio::test]
+    async fn test_compressed_sidecar() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let other = node.authors().create().await.unwrap();
+        let text = "lorem ipsum dolor sit amet ".repeat(200).into_bytes();
+        let options = SetBytesOptions {
+            compress: true,
+            meta: None,
+        };
+        doc.set_bytes_with_options(&author, b"dir/a".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        doc.set_bytes(&author, b"dir/b".to_vec(), b"b".to_vec())
+            .await
+            .unwrap();
+
+        // the sidecar is not visible
+        let opts = QueryOptions {
+            limit: 1,
+            offset: 1,
+            ..Default::default()
+        };
+        let entries = doc.get_many(Query::all(Some(opts)).into()).await.unwrap();
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].0.key(), b"dir/b");
+        let entries = doc.get_many(Query::all(None).into()).await.unwrap();
+        assert_eq!(entries.len(), 2);
+        let listing = doc.list_prefixes(b'/', Vec::new()).await.unwrap();
+        assert_eq!(listing.prefixes, vec![b"dir/".to_vec()]);
+        assert!(listing.entries.is_empty());
+        assert_eq!(doc.prefix_stats(Vec::new()).await.unwrap().entries, 2);
+        let snapshot = doc.snapshot().await.unwrap();
+        assert_eq!(snapshot.entries.len(), 2);
+        let changes = doc.changes_since(DocCursor::default()).await.unwrap();
+        assert_eq!(changes.entries.len(), 2);
+        assert_eq!(changes.cursor, snapshot.cursor);
+
+        // copies and moves by another author decompress
+        doc.copy_entry(&other, b"dir/a".to_vec(), b"copy".to_vec())
+            .await
+            .unwrap();
+        doc.move_entry(&author, b"dir/a".to_vec(), b"moved".to_vec())
+            .await
+            .unwrap();
+        for (writer, key) in [(&other, b"copy".to_vec()), (&author, b"moved".to_vec())] {
+            let entry = doc
+                .get_exact(writer.clone(), key, false)
+                .await
+                .unwrap()
+                .unwrap();
+            let content = doc.read_content(entry).await.unwrap();
+            assert!(content.compressed);
+            assert_eq!(content.data, text);
+        }
+        assert_eq!(doc.prefix_stats(Vec::new()).await.unwrap().entries, 3);
+    }
+}
@@ -0,0 +1,255 @@
+use std::{
+    collections::{HashMap, VecDeque},
+    sync::{Arc, Mutex},
+    time::{Duration, SystemTime},
+};
+
+use iroh::endpoint::ConnectionType as IrohConnectionType;
+use tokio_util::task::AbortOnDropHandle;
+
+use crate::{ConnectionType, Net, PublicKey};
+
+/// How often the connection types of the peers are checked. Changes that revert within this
+/// time are not recorded.
+const CONN_TYPE_POLL_INTERVAL: Duration = Duration::from_secs(1);
+/// Number of changes kept per peer.
+const CHANGES_PER_PEER: usize = 32;
+/// Number of peers changes are kept for, the peers with the oldest last change are forgotten
+/// first.
+const MAX_PEERS: usize = 256;
+
+/// Why the connection type of a peer changed, see [`ConnTypeChange`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum ConnChangeReason {
+    /// A path to a peer without one was found.
+    Connected,
+    /// A direct path was confirmed, the relay is no longer used.
+    DirectPathConfirmed,
+    /// A direct path is being tried, with the relay as backup.
+    DirectPathUnverified,
+    /// The direct path stopped working, packets go through the relay.
+    FellBackToRelay,
+    /// The peer is reached the same way as before, but on another address or relay.
+    AddressChanged,
+    /// No path to the peer is known anymore.
+    Disconnected,
+}
+
+/// A change of the connection type of a peer, see `Net.peer_conn_history`.
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct ConnTypeChange {
+    /// When the change was noticed.
+    pub at: SystemTime,
+    /// The connection type after the change.
+    pub conn_type: Arc<ConnectionType>,
+    pub reason: ConnChangeReason,
+}
+
+#[uniffi::export]
+impl Net {
+    /// The last changes of the connection type of a peer, oldest first.
+    ///
+    /// Changes are recorded from the start of the node, by checking the connection types once
+    /// a second, so a direct path that is lost and found again within a second does not show
+    /// up. Up to 32 changes are kept per peer.
+    pub fn peer_conn_history(&self, node_id: &PublicKey) -> Vec<ConnTypeChange> {
+        self.conn_history.get(&node_id.into())
+    }
+}
+
+/// The connection type of a peer and its changes.
+#[derive(Debug)]
+struct PeerConns {
+    current: IrohConnectionType,
+    /// Oldest first.
+    changes: VecDeque<ConnTypeChange>,
+}
+
+/// The recent connection type changes of every peer, see `Net.peer_conn_history`.
+#[derive(Debug, Default)]
+pub(crate) struct ConnHistory {
+    peers: Mutex<HashMap<iroh::NodeId, PeerConns>>,
+}
+
+impl ConnHistory {
+    /// Record the current connection types, peers missing from `current` have none.
+    fn observe(&self, current: HashMap<iroh::NodeId, IrohConnectionType>, at: SystemTime) {
+        let mut peers = self.peers.lock().expect("poisoned");
+        for (node_id, peer) in peers.iter_mut() {
+            if !current.contains_key(node_id) {
+                record(peer, IrohConnectionType::None, at);
+            }
+        }
+        for (node_id, conn_type) in current {
+            if let Some(peer) = peers.get_mut(&node_id) {
+                record(peer, conn_type, at);
+                continue;
+            }
+            if conn_type == IrohConnectionType::None {
+                continue;
+            }
+            if peers.len() >= MAX_PEERS {
+                let oldest = peers
+                    .iter()
+                    .min_by_key(|(_, peer)| peer.changes.back().map(|change| change.at))
+                    .map(|(id, _)| *id);
+                if let Some(oldest) = oldest {
+                    peers.remove(&oldest);
+                }
+            }
+            let mut peer = PeerConns {
+                current: IrohConnectionType::None,
+                changes: VecDeque::new(),
+            };
+            record(&mut peer, conn_type, at);
+            peers.insert(node_id, peer);
+        }
+    }
+
+    fn get(&self, node_id: &iroh::NodeId) -> Vec<ConnTypeChange> {
+        let peers = self.peers.lock().expect("poisoned");
+        peers
+            .get(node_id)
+            .map(|peer| peer.changes.iter().cloned().collect())
+            .unwrap_or_default()
+    }
+}
+
+fn record(peer: &mut PeerConns, conn_type: IrohConnectionType, at: SystemTime) {
+    let Some(reason) = change_reason(&peer.current, &conn_type) else {
+        return;
+    };
+    if peer.changes.len() == CHANGES_PER_PEER {
+        peer.changes.pop_front();
+    }
+    peer.changes.push_back(ConnTypeChange {
+        at,
+        conn_type: Arc::new(conn_type.clone().into()),
+        reason,
+    });
+    peer.current = conn_type;
+}
+
+/// Why the connection type changed from `old` to `new`, `None` if it did not.
+fn change_reason(old: &IrohConnectionType, new: &IrohConnectionType) -> Option<ConnChangeReason> {
+    use IrohConnectionType::{Direct, Mixed, Relay};
+
+    if old == new {
+        return None;
+    }
+    let reason = match (old, new) {
+        (_, IrohConnectionType::None) => ConnChangeReason::Disconnected,
+        (IrohConnectionType::None, _) => ConnChangeReason::Connected,
+        (Direct(_), Direct(_)) | (Relay(_), Relay(_)) | (Mixed(..), Mixed(..)) => {
+            ConnChangeReason::AddressChanged
+        }
+        (_, Direct(_)) => ConnChangeReason::DirectPathConfirmed,
+        (_, Mixed(..)) => ConnChangeReason::DirectPathUnverified,
+        (_, Relay(_)) => ConnChangeReason::FellBackToRelay,
+    };
+    Some(reason)
+}
+
+/// Check the connection types of the peers of `endpoint` periodically, recording changes in
+/// `history`.
+pub(crate) fn spawn_conn_history(
+    endpoint: iroh::Endpoint,
+    history: Arc<ConnHistory>,
+) -> AbortOnDropHandle<()> {
+    let task = tokio::task::spawn(async move {
+        let mut interval = tokio::time::interval(CONN_TYPE_POLL_INTERVAL);
+        interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        loop {
+            interval.tick().await;
+            let current = endpoint
+                .remote_info_iter()
+                .map(|info| (info.node_id, info.conn_type))
+                .collect();
+            history.observe(current, SystemTime::now());
+        }
+    });
+    AbortOnDropHandle::new(task)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn random_node_id() -> iroh::NodeId {
+        iroh::SecretKey::from_bytes(&rand::random()).public()
+    }
+
+    #[test]
+    fn test_change_reason() {
+        use IrohConnectionType::*;
+
+        let addr = |port| std::net::SocketAddr::from(([192, 168, 1, 2], port));
+        let relay: iroh::RelayUrl = "https://relay.example.com".parse().unwrap();
+        let reason = |old, new| change_reason(&old, &new);
+        assert_eq!(reason(None, None), Option::None);
+        assert_eq!(reason(Direct(addr(1)), Direct(addr(1))), Option::None);
+        assert_eq!(
+            reason(None, Relay(relay.clone())),
+            Some(ConnChangeReason::Connected)
+        );
+        assert_eq!(
+            reason(Relay(relay.clone()), Mixed(addr(1), relay.clone())),
+            Some(ConnChangeReason::DirectPathUnverified)
+        );
+        assert_eq!(
+            reason(Mixed(addr(1), relay.clone()), Direct(addr(1))),
+            Some(ConnChangeReason::DirectPathConfirmed)
+        );
+        assert_eq!(
+            reason(Direct(addr(1)), Direct(addr(2))),
+            Some(ConnChangeReason::AddressChanged)
+        );
+        assert_eq!(
+            reason(Direct(addr(1)), Relay(relay)),
+            Some(ConnChangeReason::FellBackToRelay)
+        );
+        assert_eq!(
+            reason(Direct(addr(1)), None),
+            Some(ConnChangeReason::Disconnected)
+        );
+    }
+
+    #[test]
+    fn test_observe() {
+        let history = ConnHistory::default();
+        let node_id = random_node_id();
+        let addr = std::net::SocketAddr::from(([192, 168, 1, 2], 1));
+        let direct = IrohConnectionType::Direct(addr);
+        let at = SystemTime::now();
+
+        // peers without a path are not recorded until they get one
+        history.observe(HashMap::from([(node_id, IrohConnectionType::None)]), at);
+        assert!(history.get(&node_id).is_empty());
+        history.observe(HashMap::from([(node_id, direct.clone())]), at);
+        history.observe(HashMap::from([(node_id, direct)]), at);
+        // a peer the endpoint forgot has no path
+        history.observe(HashMap::new(), at);
+        let reasons: Vec<_> = history.get(&node_id).iter().map(|c| c.reason).collect();
+        assert_eq!(
+            reasons,
+            vec![ConnChangeReason::Connected, ConnChangeReason::Disconnected]
+        );
+
+        let relay: iroh::RelayUrl = "https://relay.example.com".parse().unwrap();
+        for i in 0..CHANGES_PER_PEER {
+            let conn_type = match i % 2 {
+                0 => IrohConnectionType::Relay(relay.clone()),
+                _ => IrohConnectionType::Direct(addr),
+            };
+            history.observe(HashMap::from([(node_id, conn_type)]), at);
+        }
+        let changes = history.get(&node_id);
+        assert_eq!(changes.len(), CHANGES_PER_PEER);
+        // the oldest changes were dropped
+        assert_eq!(changes[0].reason, ConnChangeReason::Connected);
+        assert_eq!(
+            changes.last().unwrap().reason,
+            ConnChangeReason::DirectPathConfirmed
+        );
+    }
+}
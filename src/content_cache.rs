@@ -0,0 +1,257 @@
+use std::{
+    collections::{BTreeMap, HashMap},
+    sync::Mutex,
+};
+
+use bytes::Bytes;
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+
+use crate::{Blobs, BlobsClient};
+
+/// Options for the in-memory cache of small blob and document entry contents, see
+/// `NodeOptions.content_cache`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct ContentCacheOptions {
+    /// Total size of the cached contents in bytes. The least recently read contents are evicted
+    /// first.
+    pub capacity: u64,
+    /// Only contents of up to this many bytes are cached. Defaults to 64 KiB.
+    #[uniffi(default = None)]
+    pub max_content_len: Option<u64>,
+}
+
+/// Statistics of the content cache, see `Blobs.content_cache_stats`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct ContentCacheStats {
+    /// Reads served from the cache.
+    pub hits: u64,
+    /// Reads that went to the blob store.
+    pub misses: u64,
+    /// Number of cached contents.
+    pub entries: u64,
+    /// Total size of the cached contents in bytes.
+    pub bytes: u64,
+    /// The configured capacity in bytes.
+    pub capacity: u64,
+}
+
+#[uniffi::export]
+impl Blobs {
+    /// Statistics of the content cache, or `None` if `NodeOptions.content_cache` is not set.
+    pub fn content_cache_stats(&self) -> Option<ContentCacheStats> {
+        self.content_cache.stats()
+    }
+
+    /// Drop all cached contents and reset the statistics.
+    pub fn content_cache_clear(&self) {
+        self.content_cache.clear();
+    }
+}
+
+const DEFAULT_MAX_CONTENT_LEN: u64 = 64 * 1024;
+
+/// A least recently used cache of small contents, by hash.
+///
+/// Contents are immutable for a given hash, so cached contents never go stale. They can be
+/// removed from the store though, by deleting them, garbage collection or a tag being deleted,
+/// so a hit is only served while the store still has the blob.
+#[derive(Debug, Default)]
+pub(crate) struct ContentCache {
+    /// `None` if caching is disabled.
+    options: Option<ContentCacheOptions>,
+    state: Mutex<CacheState>,
+}
+
+#[derive(Debug, Default)]
+struct CacheState {
+    entries: HashMap<iroh_blobs::Hash, CachedContent>,
+    /// Cached hashes by the tick they were last read at, least recent first.
+    recency: BTreeMap<u64, iroh_blobs::Hash>,
+    tick: u64,
+    bytes: u64,
+    hits: u64,
+    misses: u64,
+}
+
+#[derive(Debug)]
+struct CachedContent {
+    data: Bytes,
+    tick: u64,
+}
+
+impl ContentCache {
+    pub(crate) fn new(options: Option<ContentCacheOptions>) -> Self {
+        ContentCache {
+            options: options.filter(|options| options.capacity > 0),
+            state: Default::default(),
+        }
+    }
+
+    /// Read the content of `hash`, from the cache if possible.
+    pub(crate) async fn read(
+        &self,
+        client: &BlobsClient,
+        hash: iroh_blobs::Hash,
+    ) -> anyhow::Result<Bytes> {
+        if self.options.is_none() {
+            return client.read_to_bytes(hash).await;
+        }
+        if let Some(data) = self.get(&hash) {
+            if matches!(client.status(hash).await?, BlobStatus::Complete { .. }) {
+                return Ok(data);
+            }
+            self.remove(&hash);
+        }
+        let data = client.read_to_bytes(hash).await?;
+        self.insert(hash, data.clone());
+        Ok(data)
+    }
+
+    /// Forget the content of `hash`, e.g. because it was deleted from the store.
+    pub(crate) fn remove(&self, hash: &iroh_blobs::Hash) {
+        let mut state = self.state.lock().expect("poisoned");
+        if let Some(cached) = state.entries.remove(hash) {
+            state.recency.remove(&cached.tick);
+            state.bytes -= cached.data.len() as u64;
+        }
+    }
+
+    fn get(&self, hash: &iroh_blobs::Hash) -> Option<Bytes> {
+        let mut state = self.state.lock().expect("poisoned");
+        state.tick += 1;
+        let tick = state.tick;
+        let Some(cached) = state.entries.get_mut(hash) else {
+            state.misses += 1;
+            return None;
+        };
+        let previous = std::mem::replace(&mut cached.tick, tick);
+        let data = cached.data.clone();
+        state.recency.remove(&previous);
+        state.recency.insert(tick, *hash);
+        state.hits += 1;
+        Some(data)
+    }
+
+    fn insert(&self, hash: iroh_blobs::Hash, data: Bytes) {
+        let Some(options) = &self.options else {
+            return;
+        };
+        let len = data.len() as u64;
+        let max_len = options.max_content_len.unwrap_or(DEFAULT_MAX_CONTENT_LEN);
+        if len > max_len || len > options.capacity {
+            return;
+        }
+        let mut state = self.state.lock().expect("poisoned");
+        if state.entries.contains_key(&hash) {
+            return;
+        }
+        while state.bytes + len > options.capacity {
+            let Some((_, oldest)) = state.recency.pop_first() else {
+                break;
+            };
+            let evicted = state.entries.remove(&oldest).expect("tracked");
+            state.bytes -= evicted.data.len() as u64;
+        }
+        state.tick += 1;
+        let tick = state.tick;
+        state.recency.insert(tick, hash);
+        state.entries.insert(hash, CachedContent { data, tick });
+        state.bytes += len;
+    }
+
+    fn stats(&self) -> Option<ContentCacheStats> {
+        let options = self.options.as_ref()?;
+        let state = self.state.lock().expect("poisoned");
+        Some(ContentCacheStats {
+            hits: state.hits,
+            misses: state.misses,
+            entries: state.entries.len() as u64,
+            bytes: state.bytes,
+            capacity: options.capacity,
+        })
+    }
+
+    fn clear(&self) {
+        *self.state.lock().expect("poisoned") = CacheState::default();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_eviction() {
+        let cache = ContentCache::new(Some(ContentCacheOptions {
+            capacity: 10,
+            max_content_len: Some(6),
+        }));
+        let hash = |i: u8| iroh_blobs::Hash::new([i]);
+        cache.insert(hash(0), Bytes::from_static(b"0000"));
+        cache.insert(hash(1), Bytes::from_static(b"1111"));
+        // too large to cache
+        cache.insert(hash(2), Bytes::from_static(b"2222222"));
+        assert!(cache.get(&hash(2)).is_none());
+
+        // reading 0 makes 1 the least recently used
+        assert!(cache.get(&hash(0)).is_some());
+        cache.insert(hash(3), Bytes::from_static(b"3333"));
+        assert!(cache.get(&hash(1)).is_none());
+        assert!(cache.get(&hash(0)).is_some());
+        assert!(cache.get(&hash(3)).is_some());
+
+        let stats = cache.stats().unwrap();
+        assert_eq!(stats.entries, 2);
+        assert_eq!(stats.bytes, 8);
+        assert_eq!(stats.hits, 3);
+        assert_eq!(stats.misses, 2);
+
+        cache.remove(&hash(0));
+        assert_eq!(cache.stats().unwrap().bytes, 4);
+        cache.clear();
+        assert_eq!(cache.stats().unwrap().entries, 0);
+
+        assert!(ContentCache::new(None).stats().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_cached_reads() {
+        let node = crate::Iroh::memory_with_options(crate::NodeOptions {
+            enable_docs: true,
+            content_cache: Some(ContentCacheOptions {
+                capacity: 1024 * 1024,
+                max_content_len: None,
+            }),
+            ..Default::default()
+        })
+        .await
+        .unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let hash = doc
+            .set_bytes(&author, b"hot".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+
+        let blobs = node.blobs();
+        for _ in 0..3 {
+            let data = blobs.read_to_bytes(hash.clone()).await.unwrap();
+            assert_eq!(data, b"value");
+        }
+        let entry = doc
+            .get_exact(author, b"hot".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        doc.read_content(entry).await.unwrap();
+        let stats = blobs.content_cache_stats().unwrap();
+        assert_eq!(stats.misses, 1);
+        assert_eq!(stats.hits, 3);
+        assert_eq!(stats.entries, 1);
+
+        // content removed from the store behind the cache's back, e.g. by garbage collection
+        node.blobs_client.delete_blob(hash.0).await.unwrap();
+        assert!(blobs.read_to_bytes(hash).await.is_err());
+        assert_eq!(blobs.content_cache_stats().unwrap().entries, 0);
+    }
+}
@@ -0,0 +1,198 @@
+use std::{collections::HashMap, sync::Arc, time::Duration};
+
+use tokio::{sync::mpsc, time::Instant};
+use tracing::warn;
+
+use crate::{CallbackError, Doc, IrohError, LiveEvent, ReadOnlyDoc, SubscribeCallback};
+
+/// Options for `Doc.subscribe_with_options`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct SubscribeOptions {
+    /// Deliver at most one insert event per key in this time, the latest one.
+    ///
+    /// The first insert of a key is delivered right away. Later inserts of the key within the
+    /// time are held back, and only the last of them is delivered once the time is up. Inserts
+    /// of other keys and all other events are not held back.
+    #[uniffi(default = None)]
+    pub debounce: Option<Duration>,
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Subscribe to events for this document, see [`Doc::subscribe`] and [`SubscribeOptions`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_with_options(
+        &self,
+        cb: Arc<dyn SubscribeCallback>,
+        options: SubscribeOptions,
+    ) -> Result<(), IrohError> {
+        let cb = match options.debounce {
+            Some(interval) if !interval.is_zero() => Debounced::spawn(cb, interval),
+            _ => cb,
+        };
+        self.subscribe(cb).await
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// Subscribe to events for this document, see [`Doc::subscribe_with_options`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_with_options(
+        &self,
+        cb: Arc<dyn SubscribeCallback>,
+        options: SubscribeOptions,
+    ) -> Result<(), IrohError> {
+        self.doc.subscribe_with_options(cb, options).await
+    }
+}
+
+/// Passes events on to a task that holds back inserts of the same key.
+struct Debounced {
+    events: mpsc::UnboundedSender<Arc<LiveEvent>>,
+}
+
+impl Debounced {
+    fn spawn(cb: Arc<dyn SubscribeCallback>, interval: Duration) -> Arc<dyn SubscribeCallback> {
+        let (events, receiver) = mpsc::unbounded_channel();
+        tokio::task::spawn(run_debounced(receiver, cb, interval));
+        Arc::new(Debounced { events })
+    }
+}
+
+#[async_trait::async_trait]
+impl SubscribeCallback for Debounced {
+    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+        self.events.send(event).map_err(|_| CallbackError::Error)
+    }
+}
+
+/// A key an insert was delivered for recently.
+struct Window {
+    until: Instant,
+    /// The latest insert of the key since, to deliver when the window ends.
+    pending: Option<Arc<LiveEvent>>,
+}
+
+async fn run_debounced(
+    mut events: mpsc::UnboundedReceiver<Arc<LiveEvent>>,
+    cb: Arc<dyn SubscribeCallback>,
+    interval: Duration,
+) {
+    let mut windows: HashMap<Vec<u8>, Window> = HashMap::new();
+    loop {
+        let next = windows.values().map(|window| window.until).min();
+        let event = tokio::select! {
+            event = events.recv() => event,
+            _ = tokio::time::sleep_until(next.unwrap_or_else(|| Instant::now() + interval)),
+                if next.is_some() =>
+            {
+                let now = Instant::now();
+                let ended: Vec<_> = windows
+                    .iter()
+                    .filter(|(_, window)| window.until <= now)
+                    .map(|(key, _)| key.clone())
+                    .collect();
+                for key in ended {
+                    let window = windows.get_mut(&key).expect("just listed");
+                    match window.pending.take() {
+                        Some(event) => {
+                            // delivering the held back insert starts a new window
+                            window.until = now + interval;
+                            deliver(&cb, event).await;
+                        }
+                        None => {
+                            windows.remove(&key);
+                        }
+                    }
+                }
+                continue;
+            }
+        };
+        let Some(event) = event else {
+            break;
+        };
+        let key = match &*event {
+            LiveEvent::InsertLocal { entry } | LiveEvent::InsertRemote { entry, .. } => {
+                entry.0.id().key().to_vec()
+            }
+            LiveEvent::Closed => {
+                // nothing held back is lost, the closed event stays the last one
+                for window in windows.into_values() {
+                    if let Some(pending) = window.pending {
+                        deliver(&cb, pending).await;
+                    }
+                }
+                deliver(&cb, event).await;
+                return;
+            }
+            _ => {
+                deliver(&cb, event).await;
+                continue;
+            }
+        };
+        match windows.get_mut(&key) {
+            Some(window) => window.pending = Some(event),
+            None => {
+                let window = Window {
+                    until: Instant::now() + interval,
+                    pending: None,
+                };
+                windows.insert(key, window);
+                deliver(&cb, event).await;
+            }
+        }
+    }
+}
+
+async fn deliver(cb: &Arc<dyn SubscribeCallback>, event: Arc<LiveEvent>) {
+    if let Err(err) = cb.event(event).await {
+        warn!("cb error: {:?}", err);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_node, Collect};
+
+    #[tokio::test]
+    async fn test_subscribe_debounced() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let cb = Arc::new(Collect::<Arc<LiveEvent>>::default());
+        let options = SubscribeOptions {
+            debounce: Some(Duration::from_millis(300)),
+        };
+        doc.subscribe_with_options(cb.clone(), options)
+            .await
+            .unwrap();
+
+        for i in 0..10u8 {
+            doc.set_bytes(&author, b"busy".to_vec(), vec![i])
+                .await
+                .unwrap();
+        }
+        doc.set_bytes(&author, b"quiet".to_vec(), b"once".to_vec())
+            .await
+            .unwrap();
+        tokio::time::sleep(Duration::from_millis(1000)).await;
+
+        let events = cb.0.lock().unwrap();
+        let values: Vec<_> = events
+            .iter()
+            .filter(|event| event.r#type() == crate::LiveEventType::InsertLocal)
+            .map(|event| {
+                let entry = event.as_insert_local();
+                (entry.key(), entry.content_hash())
+            })
+            .collect();
+        let busy: Vec<_> = values.iter().filter(|(key, _)| key == b"busy").collect();
+        // the first and the latest write
+        assert_eq!(busy.len(), 2);
+        assert!(busy[0].1.equal(&crate::Hash::new(vec![0])));
+        assert!(busy[1].1.equal(&crate::Hash::new(vec![9])));
+        assert_eq!(values.iter().filter(|(key, _)| key == b"quiet").count(), 1);
+    }
+}
@@ -1,17 +1,34 @@
-use std::{path::PathBuf, str::FromStr, sync::Arc, time::SystemTime};
+use std::{
+    collections::{BTreeMap, HashMap, VecDeque},
+    ops::Bound,
+    path::PathBuf,
+    str::FromStr,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, Mutex, Weak,
+    },
+    time::{Duration, SystemTime},
+};
 
 use bytes::Bytes;
 use futures::{StreamExt, TryStreamExt};
 use quic_rpc::transport::flume::FlumeConnector;
 use serde::{Deserialize, Serialize};
+use tokio::sync::broadcast;
+use tokio_util::sync::{CancellationToken, DropGuard};
 use tracing::warn;
 
-use crate::DocsClient;
 use crate::{
-    ticket::AddrInfoOptions, AuthorId, CallbackError, DocTicket, Hash, Iroh, IrohError, PublicKey,
+    clock::EntryClock, content_cache::ContentCache, doc_metrics::DocMetricsRegistry,
+    error::ObjectClosed, instrument::CallTimer, invite::DocInvites, node_events::NodeEvents,
+    peer_diagnostics::PeerErrors, response_limit::ResponseClass, sidecar, snapshot::DocSnapshots,
+    sync_parallelism::DocSyncLimits, ticket::AddrInfoOptions, AuthorId, BlobExportMode,
+    CallbackError, DocInvite, DocMetrics, DocTicket, Hash, Iroh, IrohError, PublicKey,
+    ShareOptions,
 };
+use crate::{BlobsClient, DocsClient};
 
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Enum)]
 pub enum CapabilityKind {
     /// A writable replica.
     Write = 1,
@@ -19,6 +36,8 @@ pub enum CapabilityKind {
     Read = 2,
 }
 
+crate::display_via_debug!(CapabilityKind);
+
 impl From<iroh_docs::CapabilityKind> for CapabilityKind {
     fn from(value: iroh_docs::CapabilityKind) -> Self {
         match value {
@@ -32,9 +51,79 @@ impl From<iroh_docs::CapabilityKind> for CapabilityKind {
 #[derive(uniffi::Object)]
 pub struct Docs {
     client: DocsClient,
+    pub(crate) engine: DocsEngine,
+    pub(crate) snapshots: Arc<DocSnapshots>,
+}
+
+/// Direct access to the docs engine, for operations the RPC client does not offer.
+#[derive(Debug, Clone)]
+pub(crate) struct DocsEngine {
+    pub(crate) sync: iroh_docs::actor::SyncHandle,
+    pub(crate) client: DocsClient,
+    pub(crate) node_id: iroh::NodeId,
+    /// The blob store holding the content of the entries.
+    pub(crate) blobs: BlobsClient,
+    pub(crate) endpoint: iroh::Endpoint,
+    /// The invitations issued with [`Doc::share_with_options`].
+    pub(crate) invites: Arc<DocInvites>,
+    /// The documents whose metrics are tracked, see [`Doc::metrics`].
+    pub(crate) metrics: Arc<DocMetricsRegistry>,
+    pub(crate) events: NodeEvents,
+    /// The clock for entry timestamps, see [`NodeOptions::clock`](crate::NodeOptions::clock).
+    pub(crate) clock: Option<EntryClock>,
+    /// The cache for small contents, see [`NodeOptions::content_cache`](crate::NodeOptions::content_cache).
+    pub(crate) content_cache: Arc<ContentCache>,
+    /// The documents with limits on their sync, see [`Doc::set_sync_parallelism`].
+    pub(crate) sync_limits: Arc<DocSyncLimits>,
+    /// Records failed sync rounds, see `Net.peer_diagnostics`.
+    pub(crate) peer_errors: Arc<PeerErrors>,
+    /// Announces the entries inserted by [`Doc::insert_record`] to the peers of a document.
+    pub(crate) gossip: iroh_gossip::net::Gossip,
+    /// The local state of the open documents.
+    pub(crate) namespaces: Arc<Namespaces>,
+}
+
+impl DocsEngine {
+    /// Verify signed entries of the open document `namespace` and insert them.
+    ///
+    /// Entries that are older than the local state are skipped, any other entry that can not be
+    /// inserted fails the call. Returns the number of entries that were inserted.
+    pub(crate) async fn insert_signed(
+        &self,
+        namespace: iroh_docs::NamespaceId,
+        entries: Vec<iroh_docs::SignedEntry>,
+    ) -> anyhow::Result<u64> {
+        let mut inserted = 0;
+        for entry in entries {
+            if entry.namespace() != namespace {
+                anyhow::bail!("entry belongs to a different document");
+            }
+            entry.verify(&())?;
+            let res = self
+                .sync
+                .insert_remote(
+                    namespace,
+                    entry,
+                    *self.node_id.as_bytes(),
+                    iroh_docs::ContentStatus::Missing,
+                )
+                .await;
+            match res {
+                Ok(()) => inserted += 1,
+                Err(err)
+                    if matches!(
+                        err.downcast_ref::<iroh_docs::InsertError>(),
+                        Some(iroh_docs::InsertError::NewerEntryExists)
+                    ) => {}
+                Err(err) => return Err(err.context("failed to insert signed entry")),
+            }
+        }
+        Ok(inserted)
+    }
 }
 
-type MemConnector = FlumeConnector<iroh_docs::rpc::proto::Response, iroh_docs::rpc::proto::Request>;
+pub(crate) type MemConnector =
+    FlumeConnector<iroh_docs::rpc::proto::Response, iroh_docs::rpc::proto::Request>;
 
 #[uniffi::export]
 impl Iroh {
@@ -42,6 +131,8 @@ impl Iroh {
     pub fn docs(&self) -> Docs {
         Docs {
             client: self.docs_client.clone().expect("missing docs"),
+            engine: self.docs_engine.clone().expect("missing docs"),
+            snapshots: self.snapshots.clone(),
         }
     }
 }
@@ -51,16 +142,28 @@ impl Docs {
     /// Create a new doc.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn create(&self) -> Result<Arc<Doc>, IrohError> {
-        let doc = self.client.create().await?;
+        let timer = CallTimer::start("docs.create");
+        let doc = timer.finish(self.client.create().await)?;
 
-        Ok(Arc::new(Doc { inner: doc }))
+        Ok(Arc::new(self.doc(doc)))
     }
 
     /// Join and sync with an already existing document.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn join(&self, ticket: &DocTicket) -> Result<Arc<Doc>, IrohError> {
-        let doc = self.client.import(ticket.clone().into()).await?;
-        Ok(Arc::new(Doc { inner: doc }))
+        let timer = CallTimer::start("docs.join");
+        let doc = timer.finish(self.import(ticket.clone().into()).await)?;
+        Ok(Arc::new(doc))
+    }
+
+    /// Join and sync with an already existing document, getting a handle that only allows
+    /// reading.
+    ///
+    /// Use this for read tickets, writing to such a document always fails.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn join_read_only(&self, ticket: &DocTicket) -> Result<Arc<ReadOnlyDoc>, IrohError> {
+        let doc = self.import(ticket.clone().into()).await?;
+        Ok(Arc::new(doc.read_only()))
     }
 
     /// Join and sync with an already existing document and subscribe to events on that document.
@@ -70,27 +173,31 @@ impl Docs {
         ticket: &DocTicket,
         cb: Arc<dyn SubscribeCallback>,
     ) -> Result<Arc<Doc>, IrohError> {
-        let (doc, mut stream) = self
-            .client
-            .import_and_subscribe(ticket.clone().into())
-            .await?;
-
-        tokio::spawn(async move {
-            while let Some(event) = stream.next().await {
-                match event {
-                    Ok(event) => {
-                        if let Err(err) = cb.event(Arc::new(event.into())).await {
-                            warn!("cb error: {:?}", err);
-                        }
-                    }
-                    Err(err) => {
-                        warn!("rpc error: {:?}", err);
-                    }
-                }
-            }
-        });
+        let ticket: iroh_docs::DocTicket = ticket.clone().into();
+        let doc = self.client.import_namespace(ticket.capability).await?;
+        let doc = self.doc(doc);
+        let stream = doc.live_events().await?;
+        let batches = doc.state.subscribe_batches();
+        tokio::spawn(forward_live_events(stream, batches, cb));
+
+        let peers = ticket
+            .nodes
+            .into_iter()
+            .map(|addr| Arc::new(addr.into()))
+            .collect();
+        doc.start_sync(peers).await?;
+        Ok(Arc::new(doc))
+    }
 
-        Ok(Arc::new(Doc { inner: doc }))
+    /// Join a document with an invitation created by `Doc.share_with_options`.
+    ///
+    /// The issuer of the invitation has to be reachable, it checks that the invitation is
+    /// still valid and hands out the ticket for the document.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn redeem_invite(&self, invite: &DocInvite) -> Result<Arc<Doc>, IrohError> {
+        let ticket = crate::invite::redeem(&self.engine.endpoint, invite).await?;
+        let doc = self.import(ticket).await?;
+        Ok(Arc::new(doc))
     }
 
     /// List all the docs we have access to on this node.
@@ -110,15 +217,62 @@ impl Docs {
         Ok(docs)
     }
 
+    /// List the documents that are open, with by how many handles and event subscriptions
+    /// they are held.
+    ///
+    /// Every [`Doc`] of this node holds its document open until it is closed or dropped, and
+    /// live sync holds it open as well. Counts that keep growing point to `Doc` objects or
+    /// subscriptions that are never released.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_open(&self) -> Result<Vec<OpenDoc>, IrohError> {
+        let namespaces: Vec<_> = self
+            .client
+            .list()
+            .await?
+            .map_ok(|(namespace, _)| namespace)
+            .try_collect()
+            .await?;
+        let mut open = Vec::new();
+        for namespace in namespaces {
+            // the state of a closed document is an error
+            let Ok(state) = self.engine.sync.get_state(namespace).await else {
+                continue;
+            };
+            if state.handles == 0 {
+                continue;
+            }
+            open.push(OpenDoc {
+                namespace: namespace.to_string(),
+                state: state.into(),
+            });
+        }
+        Ok(open)
+    }
+
     /// Get a [`Doc`].
     ///
+    /// Works for every document stored on this node, also after a restart, so the id is enough
+    /// to get a document back that was created or joined earlier.
+    ///
     /// Returns None if the document cannot be found.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn open(&self, id: String) -> Result<Option<Arc<Doc>>, IrohError> {
+        let namespace_id = iroh_docs::NamespaceId::from_str(&id)?;
+        let timer = CallTimer::start("docs.open");
+        let doc = timer.finish(self.client.open(namespace_id).await)?;
+
+        Ok(doc.map(|d| Arc::new(self.doc(d))))
+    }
+
+    /// Get a [`ReadOnlyDoc`].
+    ///
+    /// Returns None if the document cannot be found.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn open_read_only(&self, id: String) -> Result<Option<Arc<ReadOnlyDoc>>, IrohError> {
         let namespace_id = iroh_docs::NamespaceId::from_str(&id)?;
         let doc = self.client.open(namespace_id).await?;
 
-        Ok(doc.map(|d| Arc::new(Doc { inner: d })))
+        Ok(doc.map(|d| Arc::new(self.doc(d).read_only())))
     }
 
     /// Delete a document from the local node.
@@ -133,6 +287,25 @@ impl Docs {
     }
 }
 
+impl Docs {
+    fn doc(&self, inner: iroh_docs::rpc::client::docs::Doc<MemConnector>) -> Doc {
+        Doc::new(inner, self.engine.clone())
+    }
+
+    /// Import the document of `ticket` and start to sync it with the nodes of the ticket.
+    async fn import(&self, ticket: iroh_docs::DocTicket) -> Result<Doc, IrohError> {
+        let doc = self.client.import_namespace(ticket.capability).await?;
+        let doc = self.doc(doc);
+        let peers = ticket
+            .nodes
+            .into_iter()
+            .map(|addr| Arc::new(addr.into()))
+            .collect();
+        doc.start_sync(peers).await?;
+        Ok(doc)
+    }
+}
+
 /// The namespace id and CapabilityKind (read/write) of the doc
 #[derive(Debug, uniffi::Record)]
 pub struct NamespaceAndCapability {
@@ -142,10 +315,23 @@ pub struct NamespaceAndCapability {
     pub capability: CapabilityKind,
 }
 
+/// A document that is open, see `Docs.list_open`.
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct OpenDoc {
+    /// The namespace id of the doc
+    pub namespace: String,
+    pub state: OpenState,
+}
+
 /// A representation of a mutable, synchronizable key-value store.
 #[derive(Clone, uniffi::Object)]
 pub struct Doc {
     pub(crate) inner: iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    pub(crate) engine: DocsEngine,
+    /// The local state of the document, shared with the other handles to it.
+    pub(crate) state: Arc<NamespaceState>,
+    /// Set once this handle, or a clone of it, is closed.
+    closed: Arc<AtomicBool>,
 }
 
 #[uniffi::export]
@@ -157,11 +343,26 @@ impl Doc {
     }
 
     /// Close the document.
+    ///
+    /// All subscriptions created through this handle receive a final `LiveEventType::Closed`
+    /// event. Afterwards, all other methods of this handle return an error of kind
+    /// `IrohErrorKind::ObjectClosed`.
+    ///
+    /// Closing a handle that is already closed does nothing.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn close_me(&self) -> Result<(), IrohError> {
+        if self.closed.swap(true, Ordering::AcqRel) {
+            return Ok(());
+        }
         self.inner.close().await.map_err(IrohError::from)
     }
 
+    /// Whether this handle was closed with [`Self::close_me`].
+    #[uniffi::method]
+    pub fn is_closed(&self) -> bool {
+        self.closed.load(Ordering::Acquire)
+    }
+
     /// Set the content of a key to a byte array.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn set_bytes(
@@ -170,7 +371,13 @@ impl Doc {
         key: Vec<u8>,
         value: Vec<u8>,
     ) -> Result<Arc<Hash>, IrohError> {
-        let hash = self.inner.set_bytes(author_id.0, key, value).await?;
+        self.ensure_open()?;
+        let mut timer = CallTimer::start("doc.set_bytes");
+        timer.payload(key.len() + value.len());
+        let lock = self.write_lock().await;
+        let res = self.put_bytes(&lock, author_id.0, key, value).await;
+        let res = self.engine.events.check_write("doc.set_bytes", res);
+        let hash = timer.finish(res)?;
         Ok(Arc::new(Hash(hash)))
     }
 
@@ -183,11 +390,98 @@ impl Doc {
         hash: Arc<Hash>,
         size: u64,
     ) -> Result<(), IrohError> {
-        self.inner.set_hash(author_id.0, key, hash.0, size).await?;
-        Ok(())
+        self.ensure_open()?;
+        let mut timer = CallTimer::start("doc.set_hash");
+        timer.payload(key.len());
+        let lock = self.write_lock().await;
+        timer
+            .finish(self.put_hash(&lock, author_id.0, key, hash.0, size).await)
+            .map_err(IrohError::from)
+    }
+
+    /// Copy the latest entry at `src_key` to `dst_key`, written by `author_id`.
+    ///
+    /// Only the hash and size are copied, the content itself is not read or rehashed. The
+    /// compression and meta of the entry are copied along.
+    ///
+    /// Returns the hash of the copied content.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn copy_entry(
+        &self,
+        author_id: &AuthorId,
+        src_key: Vec<u8>,
+        dst_key: Vec<u8>,
+    ) -> Result<Arc<Hash>, IrohError> {
+        self.ensure_open()?;
+        let lock = self.write_lock().await;
+        let entry = self.latest_entry(&src_key).await?;
+        sidecar::copy(self, &entry, self, &lock, author_id, &dst_key).await?;
+        self.put_hash(
+            &lock,
+            author_id.0,
+            dst_key,
+            entry.content_hash(),
+            entry.content_len(),
+        )
+        .await?;
+        Ok(Arc::new(Hash(entry.content_hash())))
+    }
+
+    /// Move the latest entry at `src_key` to `dst_key`, written by `author_id`.
+    ///
+    /// The entry is copied like in [`Doc::copy_entry`], then the entry of `author_id` at `src_key`
+    /// is deleted. Entries of other authors at `src_key` are not affected.
+    ///
+    /// Since deletions apply to a whole key prefix, this fails if `author_id` has other entries
+    /// whose keys start with `src_key`.
+    ///
+    /// Returns the hash of the moved content.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn move_entry(
+        &self,
+        author_id: &AuthorId,
+        src_key: Vec<u8>,
+        dst_key: Vec<u8>,
+    ) -> Result<Arc<Hash>, IrohError> {
+        self.ensure_open()?;
+        if dst_key.starts_with(&src_key) {
+            return Err(anyhow::anyhow!("destination key is below the source key").into());
+        }
+        let lock = self.write_lock().await;
+
+        let query = iroh_docs::store::Query::author(author_id.0)
+            .key_prefix(src_key.clone())
+            .build();
+        let mut entries = self.inner.get_many(query).await?;
+        while let Some(entry) = entries.try_next().await? {
+            if entry.key() != src_key.as_slice() {
+                return Err(anyhow::anyhow!(
+                    "deleting the source key would also delete {:?}",
+                    String::from_utf8_lossy(entry.key())
+                )
+                .into());
+            }
+        }
+
+        let entry = self.latest_entry(&src_key).await?;
+        sidecar::copy(self, &entry, self, &lock, author_id, &dst_key).await?;
+        self.put_hash(
+            &lock,
+            author_id.0,
+            dst_key,
+            entry.content_hash(),
+            entry.content_len(),
+        )
+        .await?;
+        self.del_prefix(&lock, author_id.0, src_key.clone()).await?;
+        sidecar::clear_all(self, &lock, author_id, &src_key).await?;
+        Ok(Arc::new(Hash(entry.content_hash())))
     }
 
     /// Add an entry from an absolute file path
+    ///
+    /// The file is added to the blob store first, only setting the entry waits for the other
+    /// local reads and writes of the document.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn import_file(
         &self,
@@ -197,17 +491,73 @@ impl Doc {
         in_place: bool,
         cb: Option<Arc<dyn DocImportFileCallback>>,
     ) -> Result<(), IrohError> {
-        let mut stream = self
-            .inner
-            .import_file(author.0, Bytes::from(key), PathBuf::from(path), in_place)
-            .await?;
+        self.ensure_open()?;
+        let res = self
+            .engine
+            .blobs
+            .add_from_path(
+                PathBuf::from(path),
+                in_place,
+                iroh_blobs::util::SetTagOption::Auto,
+                iroh_blobs::rpc::client::blobs::WrapOption::NoWrap,
+            )
+            .await;
+        let mut stream = self.engine.events.check_write("doc.import_file", res)?;
 
+        let mut size = 0;
+        let mut added = None;
         while let Some(progress) = stream.next().await {
-            let progress = progress?;
+            let progress = self
+                .engine
+                .events
+                .check_write("doc.import_file", progress)?;
+            let progress = match progress {
+                iroh_blobs::provider::AddProgress::Found {
+                    id,
+                    name,
+                    size: len,
+                } => {
+                    size = len;
+                    DocImportProgress::Found(DocImportProgressFound { id, name, size })
+                }
+                iroh_blobs::provider::AddProgress::Progress { id, offset } => {
+                    DocImportProgress::Progress(DocImportProgressProgress { id, offset })
+                }
+                iroh_blobs::provider::AddProgress::Done { id, hash } => {
+                    DocImportProgress::IngestDone(DocImportProgressIngestDone {
+                        id,
+                        hash: Arc::new(hash.into()),
+                    })
+                }
+                iroh_blobs::provider::AddProgress::AllDone { hash, tag, .. } => {
+                    added = Some((hash, tag));
+                    continue;
+                }
+                iroh_blobs::provider::AddProgress::Abort(err) => {
+                    DocImportProgress::Abort(DocImportProgressAbort {
+                        error: err.to_string(),
+                    })
+                }
+            };
             if let Some(ref cb) = cb {
-                cb.progress(Arc::new(progress.into())).await?;
+                cb.progress(Arc::new(progress)).await?;
             }
         }
+        let (hash, tag) =
+            added.ok_or_else(|| anyhow::anyhow!("import of the file did not complete"))?;
+
+        let lock = self.write_lock().await;
+        let res = self
+            .put_hash(&lock, author.0, key.clone(), hash, size)
+            .await;
+        drop(lock);
+        // the entry protects the content from garbage collection once it is inserted
+        self.engine.blobs.tags().delete(tag).await?;
+        self.engine.events.check_write("doc.import_file", res)?;
+        if let Some(ref cb) = cb {
+            let done = DocImportProgress::AllDone(DocImportProgressAllDone { key });
+            cb.progress(Arc::new(done)).await?;
+        }
         Ok(())
     }
 
@@ -219,14 +569,25 @@ impl Doc {
         path: String,
         cb: Option<Arc<dyn DocExportFileCallback>>,
     ) -> Result<(), IrohError> {
+        self.export_file_with_mode(entry, path, BlobExportMode::Copy, cb)
+            .await
+    }
+
+    /// Export an entry as a file to a given absolute path, see [`BlobExportMode`] for the
+    /// modes.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_file_with_mode(
+        &self,
+        entry: Arc<Entry>,
+        path: String,
+        mode: BlobExportMode,
+        cb: Option<Arc<dyn DocExportFileCallback>>,
+    ) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        let path = PathBuf::from(path);
         let mut stream = self
             .inner
-            .export_file(
-                entry.0.clone(),
-                std::path::PathBuf::from(path),
-                // TODO(b5) - plumb up the export mode, currently it's always copy
-                iroh_blobs::store::ExportMode::Copy,
-            )
+            .export_file(entry.0.clone(), path, mode.into())
             .await?;
         while let Some(progress) = stream.next().await {
             let progress = progress?;
@@ -249,7 +610,11 @@ impl Doc {
         author_id: Arc<AuthorId>,
         prefix: Vec<u8>,
     ) -> Result<u64, IrohError> {
-        let num_del = self.inner.del(author_id.0, prefix).await?;
+        self.ensure_open()?;
+        let mut timer = CallTimer::start("doc.delete");
+        timer.payload(prefix.len());
+        let lock = self.write_lock().await;
+        let num_del = timer.finish(self.del_prefix(&lock, author_id.0, prefix).await)?;
 
         u64::try_from(num_del).map_err(|e| anyhow::Error::from(e).into())
     }
@@ -262,11 +627,12 @@ impl Doc {
         key: Vec<u8>,
         include_empty: bool,
     ) -> Result<Option<Arc<Entry>>, IrohError> {
-        self.inner
-            .get_exact(author.0, key, include_empty)
-            .await
-            .map(|e| e.map(|e| Arc::new(e.into())))
-            .map_err(IrohError::from)
+        self.ensure_open()?;
+        let timer = CallTimer::start("doc.get_exact");
+        let _guard = self.state.lock.read().await;
+        let res = self.inner.get_exact(author.0, key, include_empty).await;
+        let entry = timer.finish(res)?;
+        Ok(entry.map(|e| Arc::new(e.into())))
     }
 
     /// Get entries.
@@ -275,25 +641,151 @@ impl Doc {
     /// Please file an [issue](https://github.com/n0-computer/iroh-ffi/issues/new) if you run into this issue
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn get_many(&self, query: Arc<Query>) -> Result<Vec<Arc<Entry>>, IrohError> {
-        let entries = self
-            .inner
-            .get_many(query.0.clone())
+        self.ensure_open()?;
+        let timer = CallTimer::start("doc.get_many");
+        let _guard = self.state.lock.read().await;
+        let res = self.query_entries(&query.0, query.1).await;
+        let entries = timer.finish(res)?;
+        Ok(entries.into_iter().map(|e| Arc::new(Entry(e))).collect())
+    }
+
+    /// The entries matching `query` with `page` applied, without sidecar entries.
+    pub(crate) async fn query_entries(
+        &self,
+        query: &iroh_docs::store::Query,
+        page: Page,
+    ) -> anyhow::Result<Vec<iroh_docs::rpc::client::docs::Entry>> {
+        let offset = usize::try_from(page.offset).unwrap_or(usize::MAX);
+        let limit = page.limit.map_or(usize::MAX, |limit| {
+            usize::try_from(limit).unwrap_or(usize::MAX)
+        });
+        self.inner
+            .get_many(query.clone())
             .await?
-            .map_ok(|e| Arc::new(Entry(e)))
-            .try_collect::<Vec<_>>()
-            .await?;
-        Ok(entries)
+            .try_filter(|e| futures::future::ready(!sidecar::is_sidecar(e.key())))
+            .skip(offset)
+            .take(limit)
+            .try_collect()
+            .await
+    }
+
+    /// Get entries, together with whether their content is available locally.
+    ///
+    /// This saves checking the blob store for every entry, e.g. to show which entries can be
+    /// opened right away.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_many_with_status(
+        &self,
+        query: Arc<Query>,
+    ) -> Result<Vec<EntryWithStatus>, IrohError> {
+        self.ensure_open()?;
+        let entries = self.get_many(query).await?;
+        let mut statuses = HashMap::new();
+        let mut res = Vec::with_capacity(entries.len());
+        for entry in entries {
+            let hash = entry.0.content_hash();
+            let content_status = if entry.0.content_len() == 0 {
+                ContentStatus::Complete
+            } else if let Some(status) = statuses.get(&hash) {
+                *status
+            } else {
+                let status = match self.engine.blobs.status(hash).await? {
+                    iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. } => {
+                        ContentStatus::Complete
+                    }
+                    iroh_blobs::rpc::client::blobs::BlobStatus::Partial { .. } => {
+                        ContentStatus::Incomplete
+                    }
+                    iroh_blobs::rpc::client::blobs::BlobStatus::NotFound => ContentStatus::Missing,
+                };
+                statuses.insert(hash, status);
+                status
+            };
+            res.push(EntryWithStatus {
+                entry,
+                content_status,
+            });
+        }
+        Ok(res)
+    }
+
+    /// Get entries together with their content, in one call and one buffer.
+    ///
+    /// Saves a `read_content` call per entry when rendering documents of small values. The
+    /// contents are decompressed like with `read_content`. Entries are added in query order
+    /// until the next content would grow the buffer beyond `max_total_bytes`, then
+    /// `truncated` is set; continue with a query whose offset skips the returned entries.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_many_contents(
+        &self,
+        query: Arc<Query>,
+        max_total_bytes: u64,
+    ) -> Result<EntryContents, IrohError> {
+        self.ensure_open()?;
+        let entries = self.get_many(query).await?;
+        let mut res = EntryContents {
+            entries: Vec::with_capacity(entries.len()),
+            data: Vec::new(),
+            truncated: false,
+        };
+        for entry in entries {
+            let offset = res.data.len() as u64;
+            let hash = entry.0.content_hash();
+            let complete = entry.0.content_len() == 0
+                || matches!(
+                    self.engine.blobs.status(hash).await?,
+                    iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. }
+                );
+            let content = if complete && entry.0.content_len() <= max_total_bytes {
+                let stored = self
+                    .engine
+                    .content_cache
+                    .read(&self.engine.blobs, hash)
+                    .await?;
+                Some(
+                    crate::compression::decode_entry(self, &entry.0, &stored)
+                        .await?
+                        .data,
+                )
+            } else {
+                None
+            };
+            let len = content.as_ref().map_or(0, |data| data.len() as u64);
+            // an entry too large on its own is returned without content, to make progress
+            if offset + len > max_total_bytes && !res.entries.is_empty() {
+                res.truncated = true;
+                break;
+            }
+            let available = match content {
+                Some(data) if offset + len <= max_total_bytes => {
+                    res.data.extend_from_slice(&data);
+                    true
+                }
+                _ => false,
+            };
+            res.entries.push(EntryContentSlice {
+                entry,
+                available,
+                offset,
+                len: if available { len } else { 0 },
+            });
+        }
+        Ok(res)
     }
 
     /// Get the latest entry for a key and author.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn get_one(&self, query: Arc<Query>) -> Result<Option<Arc<Entry>>, IrohError> {
-        let res = self
-            .inner
-            .get_one((*query).clone().0)
-            .await
-            .map(|e| e.map(|e| Arc::new(e.into())))?;
-        Ok(res)
+        self.ensure_open()?;
+        let timer = CallTimer::start("doc.get_one");
+        let _guard = self.state.lock.read().await;
+        let page = Page {
+            limit: Some(1),
+            ..query.1
+        };
+        let res = self.query_entries(&query.0, page).await;
+        let entry = timer.finish(res)?.into_iter().next();
+        Ok(entry.map(|e| Arc::new(e.into())))
     }
 
     /// Share this document with peers over a ticket.
@@ -303,6 +795,7 @@ impl Doc {
         mode: ShareMode,
         addr_options: AddrInfoOptions,
     ) -> Result<Arc<DocTicket>, IrohError> {
+        self.ensure_open()?;
         let res = self
             .inner
             .share(mode.into(), addr_options.into())
@@ -311,53 +804,142 @@ impl Doc {
         Ok(res)
     }
 
+    /// Share this document with an invitation that expires or can only be used a limited
+    /// number of times.
+    ///
+    /// The invitation does not contain the capability for the document, this node hands it
+    /// out when the invitation is redeemed with `Docs.redeem_invite` and enforces the limits.
+    /// Once redeemed, the access to the document can not be revoked.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn share_with_options(
+        &self,
+        mode: ShareMode,
+        addr_options: AddrInfoOptions,
+        options: ShareOptions,
+    ) -> Result<Arc<DocInvite>, IrohError> {
+        self.ensure_open()?;
+        let mode = iroh_docs::rpc::client::docs::ShareMode::from(mode);
+        // sharing also makes sure the document is synced with peers that join
+        let ticket = self.inner.share(mode.clone(), addr_options.into()).await?;
+        let issuer = ticket
+            .nodes
+            .into_iter()
+            .next()
+            .unwrap_or_else(|| iroh::NodeAddr::new(self.engine.node_id));
+        let invite = self
+            .engine
+            .invites
+            .issue(issuer, self.inner.id(), mode, &options)?;
+        Ok(Arc::new(invite))
+    }
+
     /// Start to sync this document with a list of peers.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn start_sync(&self, peers: Vec<Arc<NodeAddr>>) -> Result<(), IrohError> {
-        self.inner
-            .start_sync(
-                peers
-                    .into_iter()
-                    .map(|p| (*p).clone().try_into())
-                    .collect::<Result<Vec<_>, IrohError>>()?,
-            )
-            .await?;
+        self.ensure_open()?;
+        let peers = peers
+            .into_iter()
+            .map(|p| {
+                let addr = (*p).clone().try_into()?;
+                Ok(self.engine.peer_errors.dialable(addr))
+            })
+            .collect::<Result<Vec<_>, IrohError>>()?;
+        self.engine.peer_errors.watch_sync(&self.inner).await?;
+        if self
+            .engine
+            .sync_limits
+            .start_sync(&self.inner.id(), peers.clone())
+        {
+            // join the swarm only, the peers are synced with within the limits
+            self.inner.start_sync(Vec::new()).await?;
+        } else {
+            self.inner.start_sync(peers).await?;
+        }
         Ok(())
     }
 
     /// Stop the live sync for this document.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn leave(&self) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        self.inner.leave().await?;
+        Ok(())
+    }
+
+    /// Pause the live sync for this document, until [`Self::start_sync`] is called again.
+    ///
+    /// Unlike closing the document, it stays usable for local reads and writes. Sync requests
+    /// from peers are refused while the sync is paused, and syncs queued because of
+    /// `Doc.set_sync_parallelism` are dropped.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stop_all_sync(&self) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        self.engine.sync_limits.stop_sync(&self.inner.id(), None);
         self.inner.leave().await?;
         Ok(())
     }
 
+    /// Stop syncing this document with `peer`, while keeping the live sync with other peers.
+    ///
+    /// The live sync of a document can only be stopped as a whole, so it is restarted with the
+    /// other peers that were synced with before. The peer is not blocked: if it is still
+    /// connected to other peers of the document, it can be found again through them and sync
+    /// with this node. Use [`Self::stop_all_sync`] to stop syncing with every peer. Does
+    /// nothing if the document is not syncing.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stop_sync(&self, peer: &PublicKey) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        let peer: iroh::NodeId = peer.into();
+        self.engine
+            .sync_limits
+            .stop_sync(&self.inner.id(), Some(peer));
+        if !self.inner.status().await?.sync {
+            return Ok(());
+        }
+        let others: Vec<_> = self
+            .inner
+            .get_sync_peers()
+            .await?
+            .unwrap_or_default()
+            .into_iter()
+            .filter_map(|bytes| iroh::NodeId::from_bytes(&bytes).ok())
+            .filter(|node_id| *node_id != peer)
+            .map(|node_id| Arc::new(iroh::NodeAddr::new(node_id).into()))
+            .collect();
+        self.inner.leave().await?;
+        self.start_sync(others).await
+    }
+
     /// Subscribe to events for this document.
+    ///
+    /// The subscription stays active until the document is closed, either through
+    /// [`Self::close_me`] or by the node shutting down. When that happens a final
+    /// `LiveEventType::Closed` event is delivered, after which the callback is not called again.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn subscribe(&self, cb: Arc<dyn SubscribeCallback>) -> Result<(), IrohError> {
-        let client = self.inner.clone();
-        tokio::task::spawn(async move {
-            let mut sub = client.subscribe().await.unwrap();
-            while let Some(event) = sub.next().await {
-                match event {
-                    Ok(event) => {
-                        if let Err(err) = cb.event(Arc::new(event.into())).await {
-                            warn!("cb error: {:?}", err);
-                        }
-                    }
-                    Err(err) => {
-                        warn!("rpc error: {:?}", err);
-                    }
-                }
-            }
-        });
+        self.ensure_open()?;
+        let batches = self.state.subscribe_batches();
+        let sub = self.live_events().await?;
+        tokio::task::spawn(forward_live_events(sub, batches, cb));
 
         Ok(())
     }
 
+    /// Get the sync activity of this document, such as the rate at which remote entries are
+    /// applied.
+    ///
+    /// Tracking starts with the first call, so the first result is always empty.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn metrics(&self) -> Result<DocMetrics, IrohError> {
+        self.ensure_open()?;
+        let metrics = self.engine.metrics.metrics(self).await?;
+        Ok(metrics)
+    }
+
     /// Get status info for this document
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn status(&self) -> Result<OpenState, IrohError> {
+        self.ensure_open()?;
         let res = self.inner.status().await.map(|o| o.into())?;
         Ok(res)
     }
@@ -365,15 +947,26 @@ impl Doc {
     /// Set the download policy for this document
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn set_download_policy(&self, policy: Arc<DownloadPolicy>) -> Result<(), IrohError> {
-        self.inner
-            .set_download_policy((*policy).clone().into())
-            .await?;
+        self.ensure_open()?;
+        let policy: iroh_docs::store::DownloadPolicy = (*policy).clone().into();
+        // with sync limits, contents are fetched following the policy kept by the limits
+        let limited = self
+            .engine
+            .sync_limits
+            .set_download_policy(&self.inner.id(), policy.clone())?;
+        if !limited {
+            self.inner.set_download_policy(policy).await?;
+        }
         Ok(())
     }
 
     /// Get the download policy for this document
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn get_download_policy(&self) -> Result<Arc<DownloadPolicy>, IrohError> {
+        self.ensure_open()?;
+        if let Some(policy) = self.engine.sync_limits.download_policy(&self.inner.id()) {
+            return Ok(Arc::new(policy.into()));
+        }
         let res = self
             .inner
             .get_download_policy()
@@ -385,1447 +978,3839 @@ impl Doc {
     /// Get sync peers for this document
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn get_sync_peers(&self) -> Result<Option<Vec<Vec<u8>>>, IrohError> {
+        self.ensure_open()?;
         let list = self.inner.get_sync_peers().await?;
         let list = list.map(|l| l.into_iter().map(|p| p.to_vec()).collect());
         Ok(list)
     }
-}
-
-/// Download policy to decide which content blobs shall be downloaded.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
-pub enum DownloadPolicy {
-    /// Do not download any key unless it matches one of the filters.
-    NothingExcept(Vec<Arc<FilterKind>>),
-    /// Download every key unless it matches one of the filters.
-    EverythingExcept(Vec<Arc<FilterKind>>),
-}
 
-#[uniffi::export]
-impl DownloadPolicy {
-    /// Download everything
-    #[uniffi::constructor]
-    pub fn everything() -> Self {
-        DownloadPolicy::EverythingExcept(Vec::default())
-    }
+    /// List the direct children of `prefix`, treating `separator` as a directory delimiter.
+    ///
+    /// Keys of the form `prefix + name + separator + ...` are collapsed into a single
+    /// `prefix + name + separator` entry in `prefixes`, while the latest entry for every key
+    /// without a further separator is returned in `entries`. Only the latest entry per key is
+    /// considered.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_prefixes(
+        &self,
+        separator: u8,
+        prefix: Vec<u8>,
+    ) -> Result<PrefixListing, IrohError> {
+        self.ensure_open()?;
+        let query = iroh_docs::store::Query::single_latest_per_key()
+            .key_prefix(prefix.clone())
+            .build();
+        let mut stream = self.inner.get_many(query).await?;
+
+        let mut prefixes = std::collections::BTreeSet::new();
+        let mut entries = Vec::new();
+        while let Some(entry) = stream.next().await {
+            let entry = entry?;
+            if sidecar::is_sidecar(entry.key()) {
+                continue;
+            }
+            match child_prefix(entry.id().key(), &prefix, separator) {
+                Some(child) => {
+                    prefixes.insert(child.to_vec());
+                }
+                None => entries.push(Arc::new(Entry(entry))),
+            }
+        }
 
-    /// Download nothing
-    #[uniffi::constructor]
-    pub fn nothing() -> Self {
-        DownloadPolicy::NothingExcept(Vec::default())
+        Ok(PrefixListing {
+            prefixes: prefixes.into_iter().collect(),
+            entries,
+        })
     }
 
-    /// Download nothing except keys that match the given filters
+    /// Count the entries under a key prefix and sum up their content sizes.
+    ///
+    /// Only the latest entry per key is counted, deleted entries are skipped.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn prefix_stats(&self, prefix: Vec<u8>) -> Result<PrefixStats, IrohError> {
+        self.ensure_open()?;
+        let query = iroh_docs::store::Query::single_latest_per_key()
+            .key_prefix(prefix)
+            .build();
+        let mut stream = self.inner.get_many(query).await?;
 
-    #[uniffi::constructor]
-    pub fn nothing_except(filters: Vec<Arc<FilterKind>>) -> Self {
-        DownloadPolicy::NothingExcept(filters)
+        let mut stats = PrefixStats {
+            entries: 0,
+            total_size: 0,
+        };
+        while let Some(entry) = stream.next().await {
+            let entry = entry?;
+            if sidecar::is_sidecar(entry.key()) {
+                continue;
+            }
+            stats.entries += 1;
+            stats.total_size += entry.content_len();
+        }
+        Ok(stats)
     }
 
-    /// Download everything except keys that match the given filters
-    #[uniffi::constructor]
-    pub fn everything_except(filters: Vec<Arc<FilterKind>>) -> Self {
-        DownloadPolicy::EverythingExcept(filters)
-    }
-}
-
-impl From<iroh_docs::store::DownloadPolicy> for DownloadPolicy {
-    fn from(value: iroh_docs::store::DownloadPolicy) -> Self {
-        match value {
-            iroh_docs::store::DownloadPolicy::NothingExcept(filters) => {
-                DownloadPolicy::NothingExcept(
-                    filters.into_iter().map(|f| Arc::new(f.into())).collect(),
-                )
-            }
-            iroh_docs::store::DownloadPolicy::EverythingExcept(filters) => {
-                DownloadPolicy::EverythingExcept(
-                    filters.into_iter().map(|f| Arc::new(f.into())).collect(),
-                )
-            }
-        }
+    /// Export all entries of this document, including deletions, in their signed form.
+    ///
+    /// The result can be shipped over any transport and merged into a replica of the same
+    /// document with [`Doc::import_replica_state`]. Content is not included and has to be
+    /// transferred separately, e.g. with blob tickets.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_replica_state(&self) -> Result<Vec<u8>, IrohError> {
+        self.ensure_open()?;
+        let query = iroh_docs::store::Query::all().include_empty().build();
+        let entries = self
+            .inner
+            .get_many(query)
+            .await?
+            .map_ok(iroh_docs::SignedEntry::from)
+            .try_collect::<Vec<_>>()
+            .await?;
+        let state = ReplicaState {
+            namespace: self.inner.id(),
+            entries,
+        };
+        let bytes = postcard::to_stdvec(&state).map_err(anyhow::Error::from)?;
+        ResponseClass::ReplicaState.check(bytes.len() as u64)?;
+        Ok(bytes)
     }
-}
 
-impl From<DownloadPolicy> for iroh_docs::store::DownloadPolicy {
-    fn from(value: DownloadPolicy) -> Self {
-        match value {
-            DownloadPolicy::NothingExcept(filters) => {
-                iroh_docs::store::DownloadPolicy::NothingExcept(
-                    filters.into_iter().map(|f| f.0.clone()).collect(),
-                )
-            }
-            DownloadPolicy::EverythingExcept(filters) => {
-                iroh_docs::store::DownloadPolicy::EverythingExcept(
-                    filters.into_iter().map(|f| f.0.clone()).collect(),
-                )
-            }
+    /// Merge entries exported with [`Doc::export_replica_state`] into this document.
+    ///
+    /// Entries are verified before they are inserted, entries that are older than the local
+    /// state are skipped. Fails if the state was exported from a different document, or if an
+    /// entry is invalid or can not be inserted; entries before it stay inserted.
+    ///
+    /// Returns the number of entries that were inserted.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn import_replica_state(&self, state: Vec<u8>) -> Result<u64, IrohError> {
+        self.ensure_open()?;
+        let state: ReplicaState = postcard::from_bytes(&state).map_err(anyhow::Error::from)?;
+        let namespace = self.inner.id();
+        if state.namespace != namespace {
+            return Err(anyhow::anyhow!(
+                "replica state is for document {}, not {}",
+                state.namespace,
+                namespace
+            )
+            .into());
         }
-    }
-}
-
-/// Filter strategy used in download policies.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
-pub struct FilterKind(pub(crate) iroh_docs::store::FilterKind);
-
-#[uniffi::export]
-impl FilterKind {
-    /// Verifies whether this filter matches a given key
-    pub fn matches(&self, key: Vec<u8>) -> bool {
-        self.0.matches(key)
-    }
 
-    /// Returns a FilterKind that matches if the contained bytes are a prefix of the key.
-    #[uniffi::constructor]
-    pub fn prefix(prefix: Vec<u8>) -> FilterKind {
-        FilterKind(iroh_docs::store::FilterKind::Prefix(Bytes::from(prefix)))
+        let inserted = self.engine.insert_signed(namespace, state.entries).await?;
+        Ok(inserted)
     }
 
-    /// Returns a FilterKind that matches if the contained bytes and the key are the same.
-    #[uniffi::constructor]
-    pub fn exact(key: Vec<u8>) -> FilterKind {
-        FilterKind(iroh_docs::store::FilterKind::Exact(Bytes::from(key)))
+    /// Get the current state of the document, the latest entry for every key, together with a
+    /// cursor to pass to [`Doc::changes_since`] later.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn snapshot(&self) -> Result<DocSnapshot, IrohError> {
+        self.ensure_open()?;
+        let _guard = self.state.lock.read().await;
+        // taken before reading the entries, an entry arriving through sync in between is
+        // returned by the next call of `changes_since` as well
+        let cursor = self.change_index().await?.lock().expect("poisoned").last();
+        let query = iroh_docs::store::Query::single_latest_per_key()
+            .include_empty()
+            .build();
+        let mut entries = self
+            .inner
+            .get_many(query)
+            .await?
+            .try_filter(|entry| {
+                futures::future::ready(entry.content_len() > 0 && !sidecar::is_sidecar(entry.key()))
+            })
+            .map_ok(|entry| Arc::new(Entry(entry)))
+            .try_collect::<Vec<_>>()
+            .await?;
+        entries.sort_by(|a, b| a.0.key().cmp(b.0.key()));
+        Ok(DocSnapshot { entries, cursor })
     }
-}
 
-impl From<iroh_docs::store::FilterKind> for FilterKind {
-    fn from(value: iroh_docs::store::FilterKind) -> Self {
-        FilterKind(value)
+    /// Get all entries after `cursor`, in cursor order, and a new cursor.
+    ///
+    /// Empty entries are deletion markers: deleting a key prefix removes the entries of that
+    /// author below it and leaves a single empty entry at the prefix.
+    ///
+    /// Entries are ordered by timestamp, author and key, see [`DocCursor`]. Entries are
+    /// timestamped by the node that wrote them, so an entry that arrives through sync with a
+    /// timestamp before the cursor, e.g. from a peer with a lagging clock or one that was
+    /// offline, is not returned by a later call. [`Doc::start_indexer`] also delivers those.
+    ///
+    /// The first call, or [`Doc::snapshot`], indexes the positions of all entries of the
+    /// document. The index is kept up to date while the document is open, so later calls only
+    /// read the entries after `cursor`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn changes_since(&self, cursor: DocCursor) -> Result<DocChanges, IrohError> {
+        self.ensure_open()?;
+        let _guard = self.state.lock.read().await;
+        let index = self.change_index().await?;
+        let positions = index.lock().expect("poisoned").after(&cursor);
+        let mut entries = Vec::new();
+        let mut next = cursor;
+        for (position, author) in positions {
+            let entry = self
+                .inner
+                .get_exact(author, position.key.clone(), true)
+                .await?;
+            match entry {
+                Some(entry) if DocCursor::at(&entry) == position => {
+                    entries.push(Arc::new(Entry(entry)))
+                }
+                // replaced, or removed by deleting a prefix
+                _ => index.lock().expect("poisoned").remove(&position),
+            }
+            next = position;
+        }
+        Ok(DocChanges {
+            entries,
+            cursor: next,
+        })
     }
-}
-
-/// The state for an open replica.
-#[derive(Debug, Clone, Copy, Serialize, Deserialize, uniffi::Record)]
-pub struct OpenState {
-    /// Whether to accept sync requests for this replica.
-    pub sync: bool,
-    /// How many event subscriptions are open
-    pub subscribers: u64,
-    /// By how many handles the replica is currently held open
-    pub handles: u64,
-}
 
-impl From<iroh_docs::actor::OpenState> for OpenState {
-    fn from(value: iroh_docs::actor::OpenState) -> Self {
-        OpenState {
-            sync: value.sync,
-            subscribers: value.subscribers as u64,
-            handles: value.handles as u64,
+    /// The [`ChangeIndex`] of the document, built by reading all entries if there is none.
+    async fn change_index(&self) -> anyhow::Result<Arc<Mutex<ChangeIndex>>> {
+        if let Some(index) = self.state.change_index() {
+            return Ok(index);
+        }
+        // subscribe first, so no entry inserted while reading is missed
+        let events = self.live_events().await?;
+        let cancel = CancellationToken::new();
+        let mut index = ChangeIndex {
+            positions: Default::default(),
+            timestamps: Default::default(),
+            stale: false,
+            _tracking: cancel.clone().drop_guard(),
+        };
+        let query = iroh_docs::store::Query::all().include_empty().build();
+        let mut entries = self.inner.get_many(query).await?;
+        while let Some(entry) = entries.try_next().await? {
+            index.insert(&entry);
         }
+        let index = Arc::new(Mutex::new(index));
+        tokio::spawn(track_changes(events, Arc::downgrade(&index), cancel));
+        *self.state.changes.lock().expect("poisoned") = Some(index.clone());
+        Ok(index)
     }
-}
-
-/// A peer and it's addressing information.
-#[derive(Debug, Clone, PartialEq, Eq, uniffi::Object)]
-pub struct NodeAddr {
-    node_id: Arc<PublicKey>,
-    relay_url: Option<String>,
-    addresses: Vec<String>,
-}
 
-#[uniffi::export]
-impl NodeAddr {
-    /// Create a new [`NodeAddr`] with empty [`AddrInfo`].
-    #[uniffi::constructor]
-    pub fn new(node_id: &PublicKey, derp_url: Option<String>, addresses: Vec<String>) -> Self {
-        Self {
-            node_id: Arc::new(node_id.clone()),
-            relay_url: derp_url,
-            addresses,
+    /// Add the entry just written by `author` at `key` to the [`ChangeIndex`], if there is
+    /// one, so the next call of [`Doc::changes_since`] does not depend on its event.
+    pub(crate) async fn index_write(
+        &self,
+        author: iroh_docs::AuthorId,
+        key: &[u8],
+    ) -> anyhow::Result<()> {
+        let Some(index) = self.state.change_index() else {
+            return Ok(());
+        };
+        if let Some(entry) = self.inner.get_exact(author, key.to_vec(), true).await? {
+            index.lock().expect("poisoned").insert(&entry);
         }
+        Ok(())
     }
 
-    /// Get the direct addresses of this peer.
-    pub fn direct_addresses(&self) -> Vec<String> {
-        self.addresses.clone()
+    /// Get the entries written by `author` after `since`, ordered by timestamp.
+    ///
+    /// Includes all entries the document still stores for the author, also empty entries
+    /// that mark deletions. Entries overwritten later, by the author or by deleting a
+    /// prefix, are no longer stored and not returned.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn entries_by_author_since(
+        &self,
+        author: Arc<AuthorId>,
+        since: u64,
+    ) -> Result<Vec<Arc<Entry>>, IrohError> {
+        self.ensure_open()?;
+        let _guard = self.state.lock.read().await;
+        let query = iroh_docs::store::Query::author(author.0)
+            .include_empty()
+            .build();
+        let mut entries = self
+            .inner
+            .get_many(query)
+            .await?
+            .try_filter(|entry| {
+                futures::future::ready(
+                    entry.timestamp() > since && !sidecar::is_sidecar(entry.key()),
+                )
+            })
+            .map_ok(|entry| Arc::new(Entry(entry)))
+            .try_collect::<Vec<_>>()
+            .await?;
+        entries.sort_by_key(|entry| entry.0.timestamp());
+        Ok(entries)
     }
 
-    /// Get the home relay URL for this peer
-    pub fn relay_url(&self) -> Option<String> {
-        self.relay_url.clone()
+    /// Feed every entry applied to this document into `cb`, e.g. to maintain a search index.
+    ///
+    /// Starts with the entries after `cursor` in cursor order, pass the default cursor to index
+    /// the whole document or the value of [`DocIndexer::cursor`] to resume. Afterwards every
+    /// entry is delivered as it is inserted, locally or through sync, also entries with a
+    /// timestamp before the cursor. Content of up to `max_content_len` bytes is passed along if
+    /// it is available locally, larger or missing content has to be fetched by the callback.
+    ///
+    /// Delivery is at least once: if the callback returns an error, the entry is delivered
+    /// again after a short delay, and entries may be delivered twice around the start. Entries
+    /// with a timestamp before the cursor that arrive through sync while no indexer runs are
+    /// not delivered, start the indexer before syncing the document to see all of them.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn start_indexer(
+        &self,
+        cursor: DocCursor,
+        max_content_len: u64,
+        cb: Arc<dyn DocIndexCallback>,
+    ) -> Result<Arc<DocIndexer>, IrohError> {
+        self.ensure_open()?;
+        let events = self.live_events().await?;
+        let indexer = Arc::new(DocIndexer {
+            cursor: Arc::new(std::sync::Mutex::new(cursor)),
+            cancel: CancellationToken::new(),
+        });
+        tokio::task::spawn(run_indexer(
+            self.clone(),
+            events,
+            indexer.cursor.clone(),
+            indexer.cancel.clone(),
+            max_content_len,
+            cb,
+        ));
+        Ok(indexer)
     }
 
-    /// Returns true if both NodeAddr's have the same values
-    pub fn equal(&self, other: &NodeAddr) -> bool {
-        self == other
+    /// Get a handle to this document that only allows reading.
+    pub fn read_only(&self) -> ReadOnlyDoc {
+        ReadOnlyDoc { doc: self.clone() }
     }
-}
-
-impl TryFrom<NodeAddr> for iroh::NodeAddr {
-    type Error = IrohError;
-    fn try_from(value: NodeAddr) -> Result<Self, Self::Error> {
-        let mut node_addr = iroh::NodeAddr::new((&*value.node_id).into());
-        let addresses = value
-            .direct_addresses()
-            .into_iter()
-            .map(|addr| {
-                std::net::SocketAddr::from_str(&addr).map_err(|e| anyhow::Error::from(e).into())
-            })
-            .collect::<Result<Vec<_>, IrohError>>()?;
 
-        if let Some(derp_url) = value.relay_url() {
-            let url = url::Url::parse(&derp_url).map_err(anyhow::Error::from)?;
-
-            node_addr = node_addr.with_relay_url(url.into());
+    /// Start a [`WriteBatch`] to apply multiple writes to this document at once.
+    pub fn begin_write_batch(&self) -> WriteBatch {
+        WriteBatch {
+            doc: self.clone(),
+            ops: Mutex::new(Some(Vec::new())),
         }
-        node_addr = node_addr.with_direct_addresses(addresses);
-        Ok(node_addr)
     }
 }
 
-impl From<iroh::NodeAddr> for NodeAddr {
-    fn from(value: iroh::NodeAddr) -> Self {
-        NodeAddr {
-            node_id: Arc::new(value.node_id.into()),
-            relay_url: value.relay_url.map(|url| url.to_string()),
-            addresses: value
-                .direct_addresses
-                .into_iter()
-                .map(|d| d.to_string())
-                .collect(),
+impl Doc {
+    pub(crate) fn new(
+        inner: iroh_docs::rpc::client::docs::Doc<MemConnector>,
+        engine: DocsEngine,
+    ) -> Self {
+        Doc {
+            state: engine.namespaces.get(inner.id()),
+            inner,
+            engine,
+            closed: Default::default(),
         }
     }
-}
 
-/// Intended capability for document share tickets
-#[derive(Debug, uniffi::Enum)]
-pub enum ShareMode {
-    /// Read-only access
-    Read,
-    /// Write access
-    Write,
-}
+    /// Wait for the write lock of the document, which every local write holds.
+    pub(crate) async fn write_lock(&self) -> WriteGuard<'_> {
+        self.state.lock.write().await
+    }
 
-impl From<ShareMode> for iroh_docs::rpc::client::docs::ShareMode {
-    fn from(mode: ShareMode) -> Self {
-        match mode {
-            ShareMode::Read => iroh_docs::rpc::client::docs::ShareMode::Read,
-            ShareMode::Write => iroh_docs::rpc::client::docs::ShareMode::Write,
+    pub(crate) fn ensure_open(&self) -> Result<(), ObjectClosed> {
+        if self.closed.load(Ordering::Acquire) {
+            return Err(ObjectClosed("document"));
+        }
+        Ok(())
+    }
+
+    /// The latest non empty entry at exactly `key`, across all authors.
+    async fn latest_entry(
+        &self,
+        key: &[u8],
+    ) -> anyhow::Result<iroh_docs::rpc::client::docs::Entry> {
+        let query = iroh_docs::store::Query::single_latest_per_key()
+            .key_exact(key)
+            .build();
+        match self.inner.get_one(query).await? {
+            Some(entry) if entry.content_len() > 0 => Ok(entry),
+            _ => Err(anyhow::anyhow!(
+                "no entry at key {:?}",
+                String::from_utf8_lossy(key)
+            )),
         }
     }
 }
 
-/// A single entry in a [`Doc`]
+/// A document that can only be read.
 ///
-/// An entry is identified by a key, its [`AuthorId`], and the [`Doc`]'s
-/// namespace id. Its value is the 32-byte BLAKE3 [`hash`]
-/// of the entry's content data, the size of this content data, and a timestamp.
-#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Object)]
-pub struct Entry(pub(crate) iroh_docs::rpc::client::docs::Entry);
-
-impl From<iroh_docs::rpc::client::docs::Entry> for Entry {
-    fn from(e: iroh_docs::rpc::client::docs::Entry) -> Self {
-        Entry(e)
-    }
+/// Offers the methods of [`Doc`] that do not write entries, so that writes to documents joined
+/// with a read ticket are caught when compiling the application instead of failing at runtime.
+#[derive(Clone, uniffi::Object)]
+pub struct ReadOnlyDoc {
+    pub(crate) doc: Doc,
 }
 
 #[uniffi::export]
-impl Entry {
-    /// Get the [`AuthorId`] of this entry.
-    #[uniffi::method]
-    pub fn author(&self) -> Arc<AuthorId> {
-        Arc::new(AuthorId(self.0.id().author()))
+impl ReadOnlyDoc {
+    /// Get the document id of this doc.
+    pub fn id(&self) -> String {
+        self.doc.id()
     }
 
-    /// Get the content_hash of this entry.
-    #[uniffi::method]
-    pub fn content_hash(&self) -> Arc<Hash> {
-        Arc::new(Hash(self.0.content_hash()))
+    /// Close the document, see [`Doc::close_me`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn close_me(&self) -> Result<(), IrohError> {
+        self.doc.close_me().await
     }
 
-    /// Get the content_length of this entry.
-    #[uniffi::method]
-    pub fn content_len(&self) -> u64 {
-        self.0.content_len()
+    /// Whether this handle was closed.
+    pub fn is_closed(&self) -> bool {
+        self.doc.is_closed()
     }
 
-    /// Get the key of this entry.
-    #[uniffi::method]
-    pub fn key(&self) -> Vec<u8> {
-        self.0.id().key().to_vec()
+    /// Export an entry as a file to a given absolute path
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_file(
+        &self,
+        entry: Arc<Entry>,
+        path: String,
+        cb: Option<Arc<dyn DocExportFileCallback>>,
+    ) -> Result<(), IrohError> {
+        self.doc.export_file(entry, path, cb).await
     }
 
-    /// Get the namespace id of this entry.
-    #[uniffi::method]
-    pub fn namespace(&self) -> String {
-        self.0.id().namespace().to_string()
+    /// Export an entry as a file to a given absolute path, see [`BlobExportMode`] for the
+    /// modes.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_file_with_mode(
+        &self,
+        entry: Arc<Entry>,
+        path: String,
+        mode: BlobExportMode,
+        cb: Option<Arc<dyn DocExportFileCallback>>,
+    ) -> Result<(), IrohError> {
+        self.doc.export_file_with_mode(entry, path, mode, cb).await
     }
 
-    /// Get the timestamp when this entry was written.
-    #[uniffi::method]
-    pub fn timestamp(&self) -> u64 {
-        self.0.timestamp()
-    }
-}
+    /// Get an entry for a key and author.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_exact(
+        &self,
+        author: Arc<AuthorId>,
+        key: Vec<u8>,
+        include_empty: bool,
+    ) -> Result<Option<Arc<Entry>>, IrohError> {
+        self.doc.get_exact(author, key, include_empty).await
+    }
 
-///d Fields by which the query can be sorted
-#[derive(Clone, Debug, Default, Serialize, Deserialize, uniffi::Enum)]
-pub enum SortBy {
-    /// Sort by key, then author.
-    KeyAuthor,
-    /// Sort by author, then key.
-    #[default]
-    AuthorKey,
-}
+    /// Get entries.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_many(&self, query: Arc<Query>) -> Result<Vec<Arc<Entry>>, IrohError> {
+        self.doc.get_many(query).await
+    }
 
-impl From<iroh_docs::store::SortBy> for SortBy {
-    fn from(value: iroh_docs::store::SortBy) -> Self {
-        match value {
-            iroh_docs::store::SortBy::AuthorKey => SortBy::AuthorKey,
-            iroh_docs::store::SortBy::KeyAuthor => SortBy::KeyAuthor,
-        }
+    /// Get entries, together with whether their content is available locally.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_many_with_status(
+        &self,
+        query: Arc<Query>,
+    ) -> Result<Vec<EntryWithStatus>, IrohError> {
+        self.doc.get_many_with_status(query).await
     }
-}
 
-impl From<SortBy> for iroh_docs::store::SortBy {
-    fn from(value: SortBy) -> Self {
-        match value {
-            SortBy::AuthorKey => iroh_docs::store::SortBy::AuthorKey,
-            SortBy::KeyAuthor => iroh_docs::store::SortBy::KeyAuthor,
-        }
+    /// Get entries together with their content, see `Doc.get_many_contents`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_many_contents(
+        &self,
+        query: Arc<Query>,
+        max_total_bytes: u64,
+    ) -> Result<EntryContents, IrohError> {
+        self.doc.get_many_contents(query, max_total_bytes).await
     }
-}
 
-/// Sort direction
-#[derive(Clone, Debug, Default, Serialize, Deserialize, uniffi::Enum)]
-pub enum SortDirection {
-    /// Sort ascending
-    #[default]
-    Asc,
-    /// Sort descending
-    Desc,
-}
+    /// Get the latest entry for a key and author.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_one(&self, query: Arc<Query>) -> Result<Option<Arc<Entry>>, IrohError> {
+        self.doc.get_one(query).await
+    }
 
-impl From<iroh_docs::store::SortDirection> for SortDirection {
-    fn from(value: iroh_docs::store::SortDirection) -> Self {
-        match value {
-            iroh_docs::store::SortDirection::Asc => SortDirection::Asc,
-            iroh_docs::store::SortDirection::Desc => SortDirection::Desc,
-        }
+    /// Share this document with peers over a read ticket.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn share(&self, addr_options: AddrInfoOptions) -> Result<Arc<DocTicket>, IrohError> {
+        self.doc.share(ShareMode::Read, addr_options).await
     }
-}
 
-impl From<SortDirection> for iroh_docs::store::SortDirection {
-    fn from(value: SortDirection) -> Self {
-        match value {
-            SortDirection::Asc => iroh_docs::store::SortDirection::Asc,
-            SortDirection::Desc => iroh_docs::store::SortDirection::Desc,
-        }
+    /// Start to sync this document with a list of peers.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn start_sync(&self, peers: Vec<Arc<NodeAddr>>) -> Result<(), IrohError> {
+        self.doc.start_sync(peers).await
     }
-}
 
-/// Build a Query to search for an entry or entries in a doc.
-///
-/// Use this with `QueryOptions` to determine sorting, grouping, and pagination.
-#[derive(Clone, Debug, uniffi::Object)]
-pub struct Query(pub(crate) iroh_docs::store::Query);
+    /// Stop the live sync for this document.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn leave(&self) -> Result<(), IrohError> {
+        self.doc.leave().await
+    }
 
-/// Options for sorting and pagination for using [`Query`]s.
-#[derive(Clone, Debug, Default, uniffi::Record)]
-pub struct QueryOptions {
-    /// Sort by author or key first.
-    ///
-    /// Default is [`SortBy::AuthorKey`], so sorting first by author and then by key.
-    pub sort_by: SortBy,
-    /// Direction by which to sort the entries
-    ///
-    /// Default is [`SortDirection::Asc`]
-    pub direction: SortDirection,
-    /// Offset
-    pub offset: u64,
-    /// Limit to limit the pagination.
-    ///
-    /// When the limit is 0, the limit does not exist.
-    pub limit: u64,
-}
+    /// Pause the live sync for this document, see [`Doc::stop_all_sync`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stop_all_sync(&self) -> Result<(), IrohError> {
+        self.doc.stop_all_sync().await
+    }
 
-#[uniffi::export]
-impl Query {
-    /// Query all records.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     sort_by: SortBy::AuthorKey
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn all(opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::all();
+    /// Stop syncing this document with a peer, see [`Doc::stop_sync`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stop_sync(&self, peer: &PublicKey) -> Result<(), IrohError> {
+        self.doc.stop_sync(peer).await
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
-            }
-            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
-        }
-        Query(builder.build())
+    /// Subscribe to events for this document.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe(&self, cb: Arc<dyn SubscribeCallback>) -> Result<(), IrohError> {
+        self.doc.subscribe(cb).await
     }
 
-    /// Query only the latest entry for each key, omitting older entries if the entry was written
-    /// to by multiple authors.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn single_latest_per_key(opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::single_latest_per_key();
+    /// Get the sync activity of this document.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn metrics(&self) -> Result<DocMetrics, IrohError> {
+        self.doc.metrics().await
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
-            }
-            builder = builder.sort_direction(opts.direction.into());
-        }
-        Query(builder.build())
+    /// Get status info for this document
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn status(&self) -> Result<OpenState, IrohError> {
+        self.doc.status().await
     }
 
-    /// Query exactly the key, but only the latest entry for it, omitting older entries if the entry was written
-    /// to by multiple authors.
-    #[uniffi::constructor]
-    pub fn single_latest_per_key_exact(key: Vec<u8>) -> Self {
-        let builder = iroh_docs::store::Query::single_latest_per_key()
-            .key_exact(key)
-            .build();
-        Query(builder)
+    /// Set the download policy for this document
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn set_download_policy(&self, policy: Arc<DownloadPolicy>) -> Result<(), IrohError> {
+        self.doc.set_download_policy(policy).await
     }
 
-    /// Query only the latest entry for each key, with this prefix, omitting older entries if the entry was written
-    /// to by multiple authors.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn single_latest_per_key_prefix(prefix: Vec<u8>, opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::single_latest_per_key().key_prefix(prefix);
+    /// Get the download policy for this document
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_download_policy(&self) -> Result<Arc<DownloadPolicy>, IrohError> {
+        self.doc.get_download_policy().await
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
-            }
-        }
-        Query(builder.build())
+    /// Get sync peers for this document
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn get_sync_peers(&self) -> Result<Option<Vec<Vec<u8>>>, IrohError> {
+        self.doc.get_sync_peers().await
     }
 
-    /// Query all entries for by a single author.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     sort_by: SortBy::AuthorKey
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn author(author: &AuthorId, opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::author(author.0);
+    /// List the direct children of a key prefix, see [`Doc::list_prefixes`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_prefixes(
+        &self,
+        separator: u8,
+        prefix: Vec<u8>,
+    ) -> Result<PrefixListing, IrohError> {
+        self.doc.list_prefixes(separator, prefix).await
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
-            }
-            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
-        }
-        Query(builder.build())
+    /// Count the entries under a key prefix and sum up their content sizes.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn prefix_stats(&self, prefix: Vec<u8>) -> Result<PrefixStats, IrohError> {
+        self.doc.prefix_stats(prefix).await
     }
 
-    /// Query all entries that have an exact key.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     sort_by: SortBy::AuthorKey
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn key_exact(key: Vec<u8>, opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::key_exact(key);
+    /// Export all entries of this document, see [`Doc::export_replica_state`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_replica_state(&self) -> Result<Vec<u8>, IrohError> {
+        self.doc.export_replica_state().await
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
+    /// Get the current state of the document, see [`Doc::snapshot`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn snapshot(&self) -> Result<DocSnapshot, IrohError> {
+        self.doc.snapshot().await
+    }
+
+    /// Get all entries after `cursor`, see [`Doc::changes_since`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn changes_since(&self, cursor: DocCursor) -> Result<DocChanges, IrohError> {
+        self.doc.changes_since(cursor).await
+    }
+
+    /// Get the entries written by `author` after `since`, see [`Doc::entries_by_author_since`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn entries_by_author_since(
+        &self,
+        author: Arc<AuthorId>,
+        since: u64,
+    ) -> Result<Vec<Arc<Entry>>, IrohError> {
+        self.doc.entries_by_author_since(author, since).await
+    }
+
+    /// Feed every entry applied to this document into `cb`, see [`Doc::start_indexer`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn start_indexer(
+        &self,
+        cursor: DocCursor,
+        max_content_len: u64,
+        cb: Arc<dyn DocIndexCallback>,
+    ) -> Result<Arc<DocIndexer>, IrohError> {
+        self.doc.start_indexer(cursor, max_content_len, cb).await
+    }
+}
+
+/// How long the indexer waits before delivering entries again after a callback error.
+const INDEX_RETRY_DELAY: Duration = Duration::from_secs(1);
+
+/// Index the entries of `doc` until `cancel` is triggered, see [`Doc::start_indexer`].
+///
+/// Catches up by reading the entries after `cursor` from the store once, afterwards the
+/// entries of the live events are delivered. If the subscription fails, the indexer catches up
+/// from the cursor again.
+async fn run_indexer(
+    doc: Doc,
+    mut events: impl futures::Stream<Item = anyhow::Result<iroh_docs::rpc::client::docs::LiveEvent>>
+        + Unpin,
+    cursor: Arc<std::sync::Mutex<DocCursor>>,
+    cancel: CancellationToken,
+    max_content_len: u64,
+    cb: Arc<dyn DocIndexCallback>,
+) {
+    let mut caught_up = false;
+    let mut pending = VecDeque::new();
+    loop {
+        if doc.ensure_open().is_err() {
+            break;
+        }
+        let res = if caught_up {
+            index_pending(&doc, &mut pending, &cursor, max_content_len, &cb).await
+        } else {
+            index_changes(&doc, &cursor, max_content_len, &cb).await
+        };
+        let delay = match res {
+            Ok(()) => {
+                caught_up = true;
+                None
             }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
+            Err(err) => {
+                warn!("indexer error: {err:#}");
+                Some(INDEX_RETRY_DELAY)
             }
-            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        };
+        tokio::select! {
+            biased;
+
+            _ = cancel.cancelled() => break,
+            _ = tokio::time::sleep(delay.unwrap_or_default()), if delay.is_some() => {}
+            event = events.next(), if delay.is_none() => match event {
+                Some(Ok(iroh_docs::rpc::client::docs::LiveEvent::InsertLocal { entry })) => {
+                    pending.push_back(entry)
+                }
+                // delivered even if it is older than the cursor, e.g. when it was written
+                // by a node with a lagging clock or one that was offline
+                Some(Ok(iroh_docs::rpc::client::docs::LiveEvent::InsertRemote {
+                    entry, ..
+                })) => pending.push_back(entry),
+                Some(Ok(_)) => {}
+                Some(Err(err)) => {
+                    warn!("indexer subscription error: {err:#}");
+                    caught_up = false;
+                    pending.clear();
+                }
+                None => break,
+            },
         }
-        Query(builder.build())
     }
+}
 
-    /// Create a Query for a single key and author.
-    #[uniffi::constructor]
-    pub fn author_key_exact(author: &AuthorId, key: Vec<u8>) -> Self {
-        let builder = iroh_docs::store::Query::author(author.0).key_exact(key);
-        Query(builder.build())
+/// Deliver all entries after `cursor` to `cb`, advancing `cursor` past each of them.
+async fn index_changes(
+    doc: &Doc,
+    cursor: &std::sync::Mutex<DocCursor>,
+    max_content_len: u64,
+    cb: &Arc<dyn DocIndexCallback>,
+) -> anyhow::Result<()> {
+    let start = cursor.lock().expect("poisoned").clone();
+    let changes = doc.changes_since(start).await?;
+    for entry in changes.entries {
+        let position = DocCursor::at(&entry.0);
+        index_entry(doc, entry, position.clone(), max_content_len, cb).await?;
+        *cursor.lock().expect("poisoned") = position;
     }
+    Ok(())
+}
 
-    /// Create a query for all entries with a given key prefix.
-    ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     sort_by: SortBy::AuthorKey
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn key_prefix(prefix: Vec<u8>, opts: Option<QueryOptions>) -> Self {
-        let mut builder = iroh_docs::store::Query::key_prefix(prefix);
+/// Deliver the entries of live events to `cb`, advancing `cursor` past each of them unless
+/// it is already further. An entry stays pending until it was indexed.
+async fn index_pending(
+    doc: &Doc,
+    pending: &mut VecDeque<iroh_docs::rpc::client::docs::Entry>,
+    cursor: &std::sync::Mutex<DocCursor>,
+    max_content_len: u64,
+    cb: &Arc<dyn DocIndexCallback>,
+) -> anyhow::Result<()> {
+    while let Some(entry) = pending.front() {
+        let position = cursor
+            .lock()
+            .expect("poisoned")
+            .clone()
+            .max(DocCursor::at(entry));
+        index_entry(
+            doc,
+            Arc::new(Entry(entry.clone())),
+            position.clone(),
+            max_content_len,
+            cb,
+        )
+        .await?;
+        pending.pop_front();
+        *cursor.lock().expect("poisoned") = position;
+    }
+    Ok(())
+}
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
+/// Pass `entry` to `cb`, with its content if it is at most `max_content_len` bytes and
+/// available locally. The content is decoded like by [`Doc::read_content`], sidecars are
+/// skipped.
+async fn index_entry(
+    doc: &Doc,
+    entry: Arc<Entry>,
+    cursor: DocCursor,
+    max_content_len: u64,
+    cb: &Arc<dyn DocIndexCallback>,
+) -> anyhow::Result<()> {
+    if sidecar::is_sidecar(entry.0.key()) {
+        return Ok(());
+    }
+    let len = entry.0.content_len();
+    let content = if len > 0 && len <= max_content_len {
+        let hash = entry.0.content_hash();
+        match doc.engine.blobs.status(hash).await? {
+            iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. } => {
+                let stored = doc
+                    .engine
+                    .content_cache
+                    .read(&doc.engine.blobs, hash)
+                    .await?;
+                let content = crate::compression::decode_entry(doc, &entry.0, &stored).await?;
+                Some(content.data).filter(|data| data.len() as u64 <= max_content_len)
             }
-            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+            _ => None,
         }
-        Query(builder.build())
-    }
+    } else {
+        None
+    };
+    cb.index(IndexedEntry {
+        key: entry.key(),
+        content_hash: entry.content_hash(),
+        content,
+        entry,
+        cursor,
+    })
+    .await?;
+    Ok(())
+}
 
-    /// Create a query for all entries of a single author with a given key prefix.
+/// Receives the entries of a document, see [`Doc::start_indexer`].
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait DocIndexCallback: Send + Sync + 'static {
+    /// Index a single entry. Returning an error delivers the entry again later.
+    async fn index(&self, entry: IndexedEntry) -> Result<(), CallbackError>;
+}
+
+/// An entry passed to a [`DocIndexCallback`].
+#[derive(Debug, uniffi::Record)]
+pub struct IndexedEntry {
+    /// The key of the entry.
+    pub key: Vec<u8>,
+    /// The hash of the content, the content of deleted entries is empty.
+    pub content_hash: Arc<Hash>,
+    /// The content, if it is small enough and available locally, decompressed like by
+    /// `Doc.read_content`.
+    pub content: Option<Vec<u8>>,
+    /// The full entry.
+    pub entry: Arc<Entry>,
+    /// The cursor the indexer resumes from once this entry is indexed.
+    pub cursor: DocCursor,
+}
+
+/// A running indexer, see [`Doc::start_indexer`].
+///
+/// The indexer stops when this handle is dropped.
+#[derive(Debug, uniffi::Object)]
+pub struct DocIndexer {
+    cursor: Arc<std::sync::Mutex<DocCursor>>,
+    cancel: CancellationToken,
+}
+
+#[uniffi::export]
+impl DocIndexer {
+    /// The cursor to resume indexing from, all entries up to it were indexed.
     ///
-    /// If `opts` is `None`, the default values will be used:
-    ///     direction: SortDirection::Asc
-    ///     offset: None
-    ///     limit: None
-    #[uniffi::constructor]
-    pub fn author_key_prefix(
-        author: &AuthorId,
-        prefix: Vec<u8>,
-        opts: Option<QueryOptions>,
-    ) -> Self {
-        let mut builder = iroh_docs::store::Query::author(author.0).key_prefix(prefix);
+    /// Persist it together with the index and pass it to [`Doc::start_indexer`] on restart.
+    pub fn cursor(&self) -> DocCursor {
+        self.cursor.lock().expect("poisoned").clone()
+    }
 
-        if let Some(opts) = opts {
-            if opts.offset != 0 {
-                builder = builder.offset(opts.offset);
-            }
-            if opts.limit != 0 {
-                builder = builder.limit(opts.limit);
-            }
-            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
-        }
-        Query(builder.build())
+    /// Stop delivering entries.
+    pub fn stop(&self) {
+        self.cancel.cancel();
     }
+}
 
-    /// Get the limit for this query (max. number of entries to emit).
-    pub fn limit(&self) -> Option<u64> {
-        self.0.limit()
+impl Drop for DocIndexer {
+    fn drop(&mut self) {
+        self.cancel.cancel();
     }
+}
 
-    /// Get the offset for this query (number of entries to skip at the beginning).
-    pub fn offset(&self) -> u64 {
-        self.0.offset()
+/// The serialized form of [`Doc::export_replica_state`].
+#[derive(Debug, Serialize, Deserialize)]
+struct ReplicaState {
+    namespace: iroh_docs::NamespaceId,
+    entries: Vec<iroh_docs::SignedEntry>,
+}
+
+/// A position in the entries of a document, see [`Doc::changes_since`].
+///
+/// Entries are ordered by timestamp, then by author and key, so entries written at the same
+/// time are neither skipped nor returned twice. A cursor is after the entry it was taken from,
+/// the default cursor is before all entries.
+#[derive(
+    Debug, Clone, Default, PartialEq, Eq, PartialOrd, Ord, Serialize, Deserialize, uniffi::Record,
+)]
+pub struct DocCursor {
+    pub timestamp: u64,
+    pub author: Vec<u8>,
+    pub key: Vec<u8>,
+}
+
+impl DocCursor {
+    /// The position of `entry`.
+    fn at(entry: &iroh_docs::rpc::client::docs::Entry) -> Self {
+        DocCursor {
+            timestamp: entry.timestamp(),
+            author: entry.author().as_bytes().to_vec(),
+            key: entry.key().to_vec(),
+        }
     }
 }
 
-/// The `progress` method will be called for each `SubscribeProgress` event that is
-/// emitted during a `node.doc_subscribe`. Use the `SubscribeProgress.type()`
-/// method to check the `LiveEvent`
-#[uniffi::export(with_foreign)]
-#[async_trait::async_trait]
-pub trait SubscribeCallback: Send + Sync + 'static {
-    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError>;
+/// The latest state of a document, see [`Doc::snapshot`].
+#[derive(Debug, uniffi::Record)]
+pub struct DocSnapshot {
+    /// The latest entry for every key that is not deleted, sorted by key.
+    pub entries: Vec<Arc<Entry>>,
+    /// Pass this to [`Doc::changes_since`] to get the changes after this snapshot.
+    pub cursor: DocCursor,
 }
 
-/// Events informing about actions of the live sync progress
-#[derive(Debug, Serialize, Deserialize, uniffi::Object)]
-#[allow(clippy::large_enum_variant)]
-pub enum LiveEvent {
-    /// A local insertion.
-    InsertLocal {
-        /// The inserted entry.
-        entry: Entry,
-    },
-    /// Received a remote insert.
-    InsertRemote {
-        /// The peer that sent us the entry.
-        from: PublicKey,
-        /// The inserted entry.
-        entry: Entry,
-        /// If the content is available at the local node
-        content_status: ContentStatus,
-    },
-    /// The content of an entry was downloaded and is now available at the local node
-    ContentReady {
-        /// The content hash of the newly available entry content
-        hash: Hash,
+/// Entries after a cursor, see [`Doc::changes_since`].
+#[derive(Debug, uniffi::Record)]
+pub struct DocChanges {
+    /// The new and deleted entries, in cursor order.
+    pub entries: Vec<Arc<Entry>>,
+    /// Pass this to the next call of [`Doc::changes_since`].
+    pub cursor: DocCursor,
+}
+
+/// Size of the entries under a key prefix, see [`Doc::prefix_stats`].
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct PrefixStats {
+    /// Number of keys under the prefix.
+    pub entries: u64,
+    /// Total content size of all entries in bytes.
+    pub total_size: u64,
+}
+
+/// The direct children of a key prefix, see [`Doc::list_prefixes`].
+#[derive(Debug, uniffi::Record)]
+pub struct PrefixListing {
+    /// The distinct child prefixes, each ending with the separator, in ascending order.
+    pub prefixes: Vec<Vec<u8>>,
+    /// The entries located directly under the prefix.
+    pub entries: Vec<Arc<Entry>>,
+}
+
+/// Returns the part of `key` up to and including the first `separator` after `prefix`, or
+/// `None` if `key` has no separator after `prefix`.
+fn child_prefix<'a>(key: &'a [u8], prefix: &[u8], separator: u8) -> Option<&'a [u8]> {
+    let rest = key.strip_prefix(prefix)?;
+    let pos = rest.iter().position(|b| *b == separator)?;
+    Some(&key[..prefix.len() + pos + 1])
+}
+
+/// Local state shared by all handles of a node to the same document.
+#[derive(Debug)]
+pub(crate) struct NamespaceState {
+    /// Held for writing by every local write, so the writes of a [`WriteBatch`] or a rebuild
+    /// of the document are not interleaved with others, and for reading by local reads.
+    pub(crate) lock: tokio::sync::RwLock<()>,
+    /// Held while appending to the [`crate::Log`] stored in the document.
+    pub(crate) appends: tokio::sync::Mutex<()>,
+    /// Informs subscribers about batches being committed.
+    pub(crate) batches: broadcast::Sender<BatchNotice>,
+    /// The positions of the entries for [`Doc::changes_since`], once it was called.
+    pub(crate) changes: Mutex<Option<Arc<Mutex<ChangeIndex>>>>,
+}
+
+/// The write lock of a document held by its caller, see [`NamespaceState::lock`].
+pub(crate) type WriteGuard<'a> = tokio::sync::RwLockWriteGuard<'a, ()>;
+
+type AuthorKey = (iroh_docs::AuthorId, Vec<u8>);
+
+#[derive(Debug, Clone)]
+pub(crate) enum BatchNotice {
+    /// A batch writing these author and key pairs is about to be committed.
+    Started(Arc<Vec<AuthorKey>>),
+    /// The batch was committed. Only the first `applied` writes were applied if one failed,
+    /// resulting in these entries.
+    Committed {
+        applied: usize,
+        entries: Arc<Vec<Entry>>,
     },
-    /// We have a new neighbor in the swarm.
-    NeighborUp(PublicKey),
-    /// We lost a neighbor in the swarm.
-    NeighborDown(PublicKey),
-    /// A set-reconciliation sync finished.
-    SyncFinished(SyncEvent),
-    /// All pending content is now ready.
-    ///
-    /// This event signals that all queued content downloads from the last sync run have either
-    /// completed or failed.
-    ///
-    /// It will only be emitted after a [`Self::SyncFinished`] event, never before.
-    ///
-    /// Receiving this event does not guarantee that all content in the document is available. If
-    /// blobs failed to download, this event will still be emitted after all operations completed.
-    PendingContentReady,
 }
 
-/// The type of events that can be emitted during the live sync progress
-#[derive(Debug, uniffi::Enum)]
-pub enum LiveEventType {
-    /// A local insertion.
-    InsertLocal,
-    /// Received a remote insert.
-    InsertRemote,
-    /// The content of an entry was downloaded and is now available at the local node
-    ContentReady,
-    /// We have a new neighbor in the swarm.
-    NeighborUp,
-    /// We lost a neighbor in the swarm.
-    NeighborDown,
-    /// A set-reconciliation sync finished.
-    SyncFinished,
-    /// All pending content is now ready.
-    ///
-    /// This event signals that all queued content downloads from the last sync run have either
-    /// completed or failed.
-    ///
-    /// It will only be emitted after a [`Self::SyncFinished`] event, never before.
-    ///
-    /// Receiving this event does not guarantee that all content in the document is available. If
-    /// blobs failed to download, this event will still be emitted after all operations completed.
-    PendingContentReady,
+/// A batch seen by a subscription, whose event is delivered once the local inserts of all
+/// its applied writes arrived, so they are never delivered after the batch event.
+#[derive(Debug, Default)]
+struct PendingBatch {
+    /// The writes whose local insert did not arrive yet.
+    keys: Vec<AuthorKey>,
+    /// The resulting entries, once the batch was committed.
+    entries: Option<Arc<Vec<Entry>>>,
 }
 
-#[uniffi::export]
-impl LiveEvent {
-    /// The type LiveEvent
-    pub fn r#type(&self) -> LiveEventType {
-        match self {
-            Self::InsertLocal { .. } => LiveEventType::InsertLocal,
-            Self::InsertRemote { .. } => LiveEventType::InsertRemote,
-            Self::ContentReady { .. } => LiveEventType::ContentReady,
-            Self::NeighborUp(_) => LiveEventType::NeighborUp,
-            Self::NeighborDown(_) => LiveEventType::NeighborDown,
-            Self::SyncFinished(_) => LiveEventType::SyncFinished,
-            Self::PendingContentReady => LiveEventType::PendingContentReady,
-        }
+impl NamespaceState {
+    /// The change index, unless there is none or it missed entries.
+    fn change_index(&self) -> Option<Arc<Mutex<ChangeIndex>>> {
+        let changes = self.changes.lock().expect("poisoned");
+        changes
+            .as_ref()
+            .filter(|index| !index.lock().expect("poisoned").stale)
+            .cloned()
     }
 
-    /// For `LiveEventType::InsertLocal`, returns an Entry
-    pub fn as_insert_local(&self) -> Arc<Entry> {
-        if let Self::InsertLocal { entry } = self {
-            Arc::new(entry.clone())
-        } else {
-            panic!("not an insert local event");
+    /// Subscribe to the batches committed to the document.
+    pub(crate) fn subscribe_batches(self: &Arc<Self>) -> BatchReceiver {
+        BatchReceiver {
+            notices: self.batches.subscribe(),
+            _state: self.clone(),
         }
     }
+}
 
-    /// For `LiveEventType::InsertRemote`, returns an InsertRemoteEvent
-    pub fn as_insert_remote(&self) -> InsertRemoteEvent {
-        if let Self::InsertRemote {
-            from,
-            entry,
-            content_status,
-        } = self
-        {
-            InsertRemoteEvent {
-                from: Arc::new(from.clone()),
-                entry: Arc::new(entry.clone()),
-                content_status: content_status.clone(),
+/// Receives the [`BatchNotice`]s of a document, keeping its [`NamespaceState`] alive so the
+/// notices do not stop while the subscription lasts.
+pub(crate) struct BatchReceiver {
+    notices: broadcast::Receiver<BatchNotice>,
+    _state: Arc<NamespaceState>,
+}
+
+/// The entries of a document ordered by their [`DocCursor`], so [`Doc::changes_since`] reads
+/// only the entries after its cursor.
+///
+/// Updated from the events of the document, sidecars are left out. Entries removed by
+/// deleting a prefix are dropped once they are found missing.
+#[derive(Debug)]
+pub(crate) struct ChangeIndex {
+    positions: BTreeMap<DocCursor, iroh_docs::AuthorId>,
+    /// The timestamp of the latest entry seen for each author and key.
+    timestamps: HashMap<AuthorKey, u64>,
+    /// Set once the events stopped, so entries may be missing.
+    stale: bool,
+    /// Stops [`track_changes`] when the index is dropped.
+    _tracking: DropGuard,
+}
+
+impl ChangeIndex {
+    fn insert(&mut self, entry: &iroh_docs::rpc::client::docs::Entry) {
+        if sidecar::is_sidecar(entry.key()) {
+            return;
+        }
+        let id = (entry.author(), entry.key().to_vec());
+        if let Some(&timestamp) = self.timestamps.get(&id) {
+            if timestamp >= entry.timestamp() {
+                return;
             }
-        } else {
-            panic!("not an insert remote event");
+            self.positions.remove(&DocCursor {
+                timestamp,
+                author: id.0.as_bytes().to_vec(),
+                key: id.1.clone(),
+            });
         }
+        self.timestamps.insert(id, entry.timestamp());
+        self.positions.insert(DocCursor::at(entry), entry.author());
     }
 
-    /// For `LiveEventType::ContentReady`, returns a Hash
-    pub fn as_content_ready(&self) -> Arc<Hash> {
-        if let Self::ContentReady { hash } = self {
-            Arc::new(hash.clone())
-        } else {
-            panic!("not an content ready event");
-        }
+    /// Drop the position of an entry that is gone. Its timestamp is kept, so a late event of
+    /// the entry does not add it again.
+    fn remove(&mut self, position: &DocCursor) {
+        self.positions.remove(position);
     }
 
-    /// For `LiveEventType::NeighborUp`, returns a PublicKey
-    pub fn as_neighbor_up(&self) -> Arc<PublicKey> {
-        if let Self::NeighborUp(key) = self {
-            Arc::new(key.clone())
-        } else {
-            panic!("not an neighbor up event");
-        }
+    /// The positions after `cursor`, in order, with their authors.
+    fn after(&self, cursor: &DocCursor) -> Vec<(DocCursor, iroh_docs::AuthorId)> {
+        self.positions
+            .range((Bound::Excluded(cursor), Bound::Unbounded))
+            .map(|(position, author)| (position.clone(), *author))
+            .collect()
     }
 
-    /// For `LiveEventType::NeighborDown`, returns a PublicKey
-    pub fn as_neighbor_down(&self) -> Arc<PublicKey> {
-        if let Self::NeighborDown(key) = self {
-            Arc::new(key.clone())
-        } else {
-            panic!("not an neighbor down event");
+    /// The position of the last entry.
+    fn last(&self) -> DocCursor {
+        self.positions
+            .last_key_value()
+            .map(|(position, _)| position.clone())
+            .unwrap_or_default()
+    }
+}
+
+/// Add the entries inserted into a document to `index` until it is dropped, marking it stale
+/// if the events stop.
+async fn track_changes(
+    mut events: impl futures::Stream<Item = anyhow::Result<iroh_docs::rpc::client::docs::LiveEvent>>
+        + Unpin,
+    index: Weak<Mutex<ChangeIndex>>,
+    cancel: CancellationToken,
+) {
+    loop {
+        let event = tokio::select! {
+            _ = cancel.cancelled() => break,
+            event = events.next() => event,
+        };
+        let Some(index) = index.upgrade() else {
+            break;
+        };
+        let mut index = index.lock().expect("poisoned");
+        match event {
+            Some(Ok(iroh_docs::rpc::client::docs::LiveEvent::InsertLocal { entry }))
+            | Some(Ok(iroh_docs::rpc::client::docs::LiveEvent::InsertRemote { entry, .. })) => {
+                index.insert(&entry)
+            }
+            Some(Ok(_)) => {}
+            Some(Err(err)) => {
+                warn!("change index subscription error: {err:#}");
+                index.stale = true;
+                break;
+            }
+            None => {
+                index.stale = true;
+                break;
+            }
         }
     }
+}
 
-    /// For `LiveEventType::SyncFinished`, returns a SyncEvent
-    pub fn as_sync_finished(&self) -> SyncEvent {
-        if let Self::SyncFinished(event) = self {
-            event.clone()
-        } else {
-            panic!("not an sync event event");
+/// The [`NamespaceState`]s of the documents of a node.
+///
+/// A state lives as long as a [`Doc`] handle or a subscription of its document, once the
+/// document is closed and they are dropped the next handle starts with a new one.
+#[derive(Debug, Default)]
+pub(crate) struct Namespaces(Mutex<HashMap<iroh_docs::NamespaceId, Weak<NamespaceState>>>);
+
+impl Namespaces {
+    /// The state of the document `id`, shared with the other handles to it.
+    pub(crate) fn get(&self, id: iroh_docs::NamespaceId) -> Arc<NamespaceState> {
+        let mut namespaces = self.0.lock().expect("poisoned");
+        if let Some(state) = namespaces.get(&id).and_then(Weak::upgrade) {
+            return state;
         }
+        namespaces.retain(|_, state| state.strong_count() > 0);
+        let (batches, _) = broadcast::channel(64);
+        let state = Arc::new(NamespaceState {
+            lock: tokio::sync::RwLock::new(()),
+            appends: Default::default(),
+            batches,
+            changes: Default::default(),
+        });
+        namespaces.insert(id, Arc::downgrade(&state));
+        state
     }
 }
 
-impl From<iroh_docs::rpc::client::docs::LiveEvent> for LiveEvent {
-    fn from(value: iroh_docs::rpc::client::docs::LiveEvent) -> Self {
-        match value {
-            iroh_docs::rpc::client::docs::LiveEvent::InsertLocal { entry } => {
-                LiveEvent::InsertLocal {
-                    entry: entry.into(),
+/// Forward all events of a doc subscription to the callback.
+///
+/// Local inserts made by a [`WriteBatch`] are folded into a single
+/// [`LiveEvent::InsertLocalBatch`], delivered after the inserts arrived. Once the stream ends,
+/// which happens when the doc is closed, a final [`LiveEvent::Closed`] is delivered so
+/// subscribers do not wait for events that will never come.
+pub(crate) async fn forward_live_events(
+    mut stream: impl futures::Stream<Item = anyhow::Result<iroh_docs::rpc::client::docs::LiveEvent>>
+        + Unpin,
+    mut batches: BatchReceiver,
+    cb: Arc<dyn SubscribeCallback>,
+) {
+    let mut pending: VecDeque<PendingBatch> = VecDeque::new();
+    loop {
+        tokio::select! {
+            biased;
+
+            notice = batches.notices.recv() => match notice {
+                Ok(BatchNotice::Started(keys)) => pending.push_back(PendingBatch {
+                    keys: keys.to_vec(),
+                    entries: None,
+                }),
+                Ok(BatchNotice::Committed { applied, entries }) => {
+                    if let Some(batch) = pending.iter_mut().find(|batch| batch.entries.is_none()) {
+                        // the writes that were not applied will never arrive
+                        batch.keys.truncate(applied);
+                        batch.entries = Some(entries);
+                    }
+                }
+                Err(err) => {
+                    warn!("batch notice error: {:?}", err);
+                    // notices were lost, stop waiting for the inserts and commits of the
+                    // batches seen so far
+                    pending.retain_mut(|batch| {
+                        batch.keys.clear();
+                        batch.entries.is_some()
+                    });
                 }
-            }
-            iroh_docs::rpc::client::docs::LiveEvent::InsertRemote {
-                from,
-                entry,
-                content_status,
-            } => LiveEvent::InsertRemote {
-                from: from.into(),
-                entry: entry.into(),
-                content_status: content_status.into(),
             },
-            iroh_docs::rpc::client::docs::LiveEvent::ContentReady { hash } => {
-                LiveEvent::ContentReady { hash: hash.into() }
-            }
-            iroh_docs::rpc::client::docs::LiveEvent::NeighborUp(key) => {
-                LiveEvent::NeighborUp(key.into())
-            }
-            iroh_docs::rpc::client::docs::LiveEvent::NeighborDown(key) => {
-                LiveEvent::NeighborDown(key.into())
-            }
-            iroh_docs::rpc::client::docs::LiveEvent::SyncFinished(e) => {
-                LiveEvent::SyncFinished(e.into())
-            }
-            iroh_docs::rpc::client::docs::LiveEvent::PendingContentReady => {
-                LiveEvent::PendingContentReady
-            }
+            event = stream.next() => match event {
+                Some(Ok(iroh_docs::rpc::client::docs::LiveEvent::InsertLocal { entry }))
+                    if take_batched(&mut pending, &entry) => {}
+                Some(Ok(event)) => deliver(&cb, event.into()).await,
+                Some(Err(err)) => warn!("rpc error: {:?}", err),
+                None => break,
+            },
+        }
+        while pending
+            .front()
+            .is_some_and(|batch| batch.entries.is_some() && batch.keys.is_empty())
+        {
+            let batch = pending.pop_front().expect("checked");
+            let entries = batch.entries.expect("checked").to_vec();
+            deliver(&cb, LiveEvent::InsertLocalBatch { entries }).await;
         }
     }
+    deliver(&cb, LiveEvent::Closed).await;
 }
 
-/// Outcome of a sync operation
-#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Record)]
-pub struct SyncEvent {
-    /// Peer we synced with
-    pub peer: Arc<PublicKey>,
-    /// Origin of the sync exchange
-    pub origin: Origin,
-    /// Timestamp when the sync finished
-    pub finished: SystemTime,
-    /// Timestamp when the sync started
-    pub started: SystemTime,
-    /// Result of the sync operation. `None` if successfull.
-    pub result: Option<String>,
+/// Remove the write that inserted `entry` from the pending batches, false if no batch made it.
+fn take_batched(
+    pending: &mut VecDeque<PendingBatch>,
+    entry: &iroh_docs::rpc::client::docs::Entry,
+) -> bool {
+    let id = entry.id();
+    for batch in pending.iter_mut() {
+        let pos = batch
+            .keys
+            .iter()
+            .position(|(author, key)| *author == id.author() && key.as_slice() == id.key());
+        if let Some(pos) = pos {
+            batch.keys.remove(pos);
+            return true;
+        }
+    }
+    false
 }
 
-impl From<iroh_docs::rpc::client::docs::SyncEvent> for SyncEvent {
-    fn from(value: iroh_docs::rpc::client::docs::SyncEvent) -> Self {
-        SyncEvent {
-            peer: Arc::new(value.peer.into()),
-            origin: value.origin.into(),
-            finished: value.finished,
-            started: value.started,
-            result: match value.result {
-                Ok(_) => None,
-                Err(err) => Some(err),
-            },
-        }
+async fn deliver(cb: &Arc<dyn SubscribeCallback>, event: LiveEvent) {
+    if let Err(err) = cb.event(Arc::new(event)).await {
+        warn!("cb error: {:?}", err);
     }
 }
 
-/// Why we started a sync request
-#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq, Copy, uniffi::Enum)]
-pub enum SyncReason {
-    /// Direct join request via API
-    DirectJoin,
-    /// Peer showed up as new neighbor in the gossip swarm
-    NewNeighbor,
-    /// We synced after receiving a sync report that indicated news for us
-    SyncReport,
-    /// We received a sync report while a sync was running, so run again afterwars
-    Resync,
+#[derive(Debug)]
+enum BatchOp {
+    SetBytes {
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        value: Vec<u8>,
+    },
+    SetHash {
+        author: iroh_docs::AuthorId,
+        key: Vec<u8>,
+        hash: iroh_blobs::Hash,
+        size: u64,
+    },
+    Delete {
+        author: iroh_docs::AuthorId,
+        prefix: Vec<u8>,
+    },
 }
 
-impl From<iroh_docs::rpc::client::docs::SyncReason> for SyncReason {
-    fn from(value: iroh_docs::rpc::client::docs::SyncReason) -> Self {
-        match value {
-            iroh_docs::rpc::client::docs::SyncReason::DirectJoin => Self::DirectJoin,
-            iroh_docs::rpc::client::docs::SyncReason::NewNeighbor => Self::NewNeighbor,
-            iroh_docs::rpc::client::docs::SyncReason::SyncReport => Self::SyncReport,
-            iroh_docs::rpc::client::docs::SyncReason::Resync => Self::Resync,
+impl BatchOp {
+    fn author_key(&self) -> AuthorKey {
+        match self {
+            BatchOp::SetBytes { author, key, .. } => (*author, key.clone()),
+            BatchOp::SetHash { author, key, .. } => (*author, key.clone()),
+            BatchOp::Delete { author, prefix } => (*author, prefix.clone()),
         }
     }
 }
 
-/// Why we performed a sync exchange
-#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Enum)]
-pub enum Origin {
-    /// public, use a unit variant
-    Connect { reason: SyncReason },
-    /// A peer connected to us and we accepted the exchange
-    Accept,
+/// A set of writes to a [`Doc`] that are committed together.
+///
+/// Create one with [`Doc::begin_write_batch`]. While a batch is committed, local reads and
+/// writes through any [`Doc`] handle of the same document wait until all writes are applied,
+/// so they never see part of the batch, and subscribers receive a single
+/// `LiveEventType::InsertLocalBatch` event instead of one event per write.
+///
+/// If a write fails, the writes before it remain applied and the batch event only contains
+/// their entries. Remote peers receive the entries one by one.
+#[derive(uniffi::Object)]
+pub struct WriteBatch {
+    doc: Doc,
+    ops: Mutex<Option<Vec<BatchOp>>>,
 }
 
-impl From<iroh_docs::rpc::client::docs::Origin> for Origin {
-    fn from(value: iroh_docs::rpc::client::docs::Origin) -> Self {
-        match value {
-            iroh_docs::rpc::client::docs::Origin::Connect(reason) => Self::Connect {
-                reason: reason.into(),
-            },
-            iroh_docs::rpc::client::docs::Origin::Accept => Self::Accept,
-        }
+impl WriteBatch {
+    fn push(&self, op: BatchOp) -> Result<(), IrohError> {
+        let mut ops = self.ops.lock().expect("poisoned");
+        let ops = ops
+            .as_mut()
+            .ok_or_else(|| anyhow::anyhow!("write batch already committed"))?;
+        ops.push(op);
+        Ok(())
     }
 }
 
-/// Outcome of an InsertRemove event.
-#[derive(Debug, Serialize, Deserialize, uniffi::Record)]
-pub struct InsertRemoteEvent {
-    /// The peer that sent us the entry.
-    pub from: Arc<PublicKey>,
-    /// The inserted entry.
-    pub entry: Arc<Entry>,
-    /// If the content is available at the local node
-    pub content_status: ContentStatus,
-}
+#[uniffi::export]
+impl WriteBatch {
+    /// Stage setting the content of a key to a byte array.
+    pub fn set_bytes(
+        &self,
+        author_id: &AuthorId,
+        key: Vec<u8>,
+        value: Vec<u8>,
+    ) -> Result<(), IrohError> {
+        self.push(BatchOp::SetBytes {
+            author: author_id.0,
+            key,
+            value,
+        })
+    }
 
-/// Whether the content status is available on a node.
-#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Enum)]
-pub enum ContentStatus {
-    /// The content is completely available.
-    Complete,
-    /// The content is partially available.
-    Incomplete,
-    /// The content is missing.
-    Missing,
-}
+    /// Stage setting an entry via its key, hash, and size.
+    pub fn set_hash(
+        &self,
+        author_id: &AuthorId,
+        key: Vec<u8>,
+        hash: &Hash,
+        size: u64,
+    ) -> Result<(), IrohError> {
+        self.push(BatchOp::SetHash {
+            author: author_id.0,
+            key,
+            hash: hash.0,
+            size,
+        })
+    }
 
-impl From<iroh_docs::ContentStatus> for ContentStatus {
-    fn from(value: iroh_docs::ContentStatus) -> Self {
-        match value {
-            iroh_docs::ContentStatus::Complete => Self::Complete,
-            iroh_docs::ContentStatus::Incomplete => Self::Incomplete,
-            iroh_docs::ContentStatus::Missing => Self::Missing,
-        }
+    /// Stage deleting all entries of `author` whose key starts with `prefix`.
+    pub fn delete(&self, author_id: &AuthorId, prefix: Vec<u8>) -> Result<(), IrohError> {
+        self.push(BatchOp::Delete {
+            author: author_id.0,
+            prefix,
+        })
     }
-}
 
-/// The `progress` method will be called for each `DocImportProgress` event that is
-/// emitted during a `doc.import_file()` call. Use the `DocImportProgress.type()`
-/// method to check the `DocImportProgressType`
-#[uniffi::export(with_foreign)]
-#[async_trait::async_trait]
-pub trait DocImportFileCallback: Send + Sync + 'static {
-    async fn progress(&self, progress: Arc<DocImportProgress>) -> Result<(), CallbackError>;
-}
+    /// The number of staged writes.
+    pub fn len(&self) -> u64 {
+        let ops = self.ops.lock().expect("poisoned");
+        ops.as_ref().map(|ops| ops.len() as u64).unwrap_or_default()
+    }
 
-/// The type of `DocImportProgress` event
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
-pub enum DocImportProgressType {
-    /// An item was found with name `name`, from now on referred to via `id`
-    Found,
-    /// We got progress ingesting item `id`.
-    Progress,
-    /// We are done ingesting `id`, and the hash is `hash`.
-    IngestDone,
-    /// We are done with the whole operation.
-    AllDone,
-    /// We got an error and need to abort.
+    /// Returns true if no writes are staged.
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Drop all staged writes without applying them.
+    pub fn discard(&self) {
+        self.ops.lock().expect("poisoned").take();
+    }
+
+    /// Apply all staged writes, returning the resulting entries.
     ///
-    /// This will be the last message in the stream.
-    Abort,
-}
+    /// A batch can only be committed once.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn commit(&self) -> Result<Vec<Arc<Entry>>, IrohError> {
+        self.doc.ensure_open()?;
+        let ops = self
+            .ops
+            .lock()
+            .expect("poisoned")
+            .take()
+            .ok_or_else(|| anyhow::anyhow!("write batch already committed"))?;
+
+        let doc = &self.doc;
+        let state = &doc.state;
+        let lock = doc.write_lock().await;
+
+        let keys = Arc::new(ops.iter().map(BatchOp::author_key).collect::<Vec<_>>());
+        state.batches.send(BatchNotice::Started(keys.clone())).ok();
+
+        let mut applied = 0;
+        let res: anyhow::Result<()> = async {
+            for op in ops {
+                match op {
+                    BatchOp::SetBytes { author, key, value } => {
+                        doc.put_bytes(&lock, author, key, value).await?;
+                    }
+                    BatchOp::SetHash {
+                        author,
+                        key,
+                        hash,
+                        size,
+                    } => {
+                        doc.put_hash(&lock, author, key, hash, size).await?;
+                    }
+                    BatchOp::Delete { author, prefix } => {
+                        doc.del_prefix(&lock, author, prefix).await?;
+                    }
+                }
+                applied += 1;
+            }
+            Ok(())
+        }
+        .await;
 
-/// A DocImportProgress event indicating a file was found with name `name`, from now on referred to via `id`
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocImportProgressFound {
-    /// A new unique id for this entry.
-    pub id: u64,
-    /// The name of the entry.
-    pub name: String,
-    /// The size of the entry in bytes.
-    pub size: u64,
-}
+        let mut entries = Vec::with_capacity(applied);
+        for (author, key) in keys[..applied].iter() {
+            if let Some(entry) = doc.inner.get_exact(*author, key.clone(), true).await? {
+                entries.push(Entry(entry));
+            }
+        }
+        state
+            .batches
+            .send(BatchNotice::Committed {
+                applied,
+                entries: Arc::new(entries.clone()),
+            })
+            .ok();
+        res?;
 
-/// A DocImportProgress event indicating we've made progress ingesting item `id`.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocImportProgressProgress {
-    /// The unique id of the entry.
-    pub id: u64,
-    /// The offset of the progress, in bytes.
-    pub offset: u64,
+        Ok(entries.into_iter().map(Arc::new).collect())
+    }
 }
 
-/// A DocImportProgress event indicating we are finished adding `id` to the data store and the hash is `hash`.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocImportProgressIngestDone {
-    /// The unique id of the entry.
-    pub id: u64,
-    /// The hash of the entry.
-    pub hash: Arc<Hash>,
+/// Download policy to decide which content blobs shall be downloaded.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+pub enum DownloadPolicy {
+    /// Do not download any key unless it matches one of the filters.
+    NothingExcept(Vec<Arc<FilterKind>>),
+    /// Download every key unless it matches one of the filters.
+    EverythingExcept(Vec<Arc<FilterKind>>),
 }
 
-/// A DocImportProgress event indicating we are done setting the entry to the doc
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocImportProgressAllDone {
-    /// The key of the entry
-    pub key: Vec<u8>,
-}
+#[uniffi::export]
+impl DownloadPolicy {
+    /// Download everything
+    #[uniffi::constructor]
+    pub fn everything() -> Self {
+        DownloadPolicy::EverythingExcept(Vec::default())
+    }
 
-/// A DocImportProgress event indicating we got an error and need to abort
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocImportProgressAbort {
-    /// The error message
-    pub error: String,
-}
+    /// Download nothing
+    #[uniffi::constructor]
+    pub fn nothing() -> Self {
+        DownloadPolicy::NothingExcept(Vec::default())
+    }
 
-/// Progress updates for the doc import file operation.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
-pub enum DocImportProgress {
-    /// An item was found with name `name`, from now on referred to via `id`
-    Found(DocImportProgressFound),
-    /// We got progress ingesting item `id`.
-    Progress(DocImportProgressProgress),
-    /// We are done ingesting `id`, and the hash is `hash`.
-    IngestDone(DocImportProgressIngestDone),
-    /// We are done with the whole operation.
-    AllDone(DocImportProgressAllDone),
-    /// We got an error and need to abort.
-    ///
-    /// This will be the last message in the stream.
-    Abort(DocImportProgressAbort),
+    /// Download nothing except keys that match the given filters
+
+    #[uniffi::constructor]
+    pub fn nothing_except(filters: Vec<Arc<FilterKind>>) -> Self {
+        DownloadPolicy::NothingExcept(filters)
+    }
+
+    /// Download everything except keys that match the given filters
+    #[uniffi::constructor]
+    pub fn everything_except(filters: Vec<Arc<FilterKind>>) -> Self {
+        DownloadPolicy::EverythingExcept(filters)
+    }
 }
 
-impl From<iroh_docs::rpc::client::docs::ImportProgress> for DocImportProgress {
-    fn from(value: iroh_docs::rpc::client::docs::ImportProgress) -> Self {
+impl From<iroh_docs::store::DownloadPolicy> for DownloadPolicy {
+    fn from(value: iroh_docs::store::DownloadPolicy) -> Self {
         match value {
-            iroh_docs::rpc::client::docs::ImportProgress::Found { id, name, size } => {
-                DocImportProgress::Found(DocImportProgressFound { id, name, size })
-            }
-            iroh_docs::rpc::client::docs::ImportProgress::Progress { id, offset } => {
-                DocImportProgress::Progress(DocImportProgressProgress { id, offset })
-            }
-            iroh_docs::rpc::client::docs::ImportProgress::IngestDone { id, hash } => {
-                DocImportProgress::IngestDone(DocImportProgressIngestDone {
-                    id,
-                    hash: Arc::new(hash.into()),
-                })
-            }
-            iroh_docs::rpc::client::docs::ImportProgress::AllDone { key } => {
-                DocImportProgress::AllDone(DocImportProgressAllDone { key: key.into() })
+            iroh_docs::store::DownloadPolicy::NothingExcept(filters) => {
+                DownloadPolicy::NothingExcept(
+                    filters.into_iter().map(|f| Arc::new(f.into())).collect(),
+                )
             }
-            iroh_docs::rpc::client::docs::ImportProgress::Abort(err) => {
-                DocImportProgress::Abort(DocImportProgressAbort {
-                    error: err.to_string(),
-                })
+            iroh_docs::store::DownloadPolicy::EverythingExcept(filters) => {
+                DownloadPolicy::EverythingExcept(
+                    filters.into_iter().map(|f| Arc::new(f.into())).collect(),
+                )
             }
         }
     }
 }
 
-#[uniffi::export]
-impl DocImportProgress {
-    /// Get the type of event
-    pub fn r#type(&self) -> DocImportProgressType {
-        match self {
-            DocImportProgress::Found(_) => DocImportProgressType::Found,
-            DocImportProgress::Progress(_) => DocImportProgressType::Progress,
-            DocImportProgress::IngestDone(_) => DocImportProgressType::IngestDone,
-            DocImportProgress::AllDone(_) => DocImportProgressType::AllDone,
-            DocImportProgress::Abort(_) => DocImportProgressType::Abort,
-        }
-    }
-
-    /// Return the `DocImportProgressFound` event
-    pub fn as_found(&self) -> DocImportProgressFound {
-        match self {
-            DocImportProgress::Found(f) => f.clone(),
-            _ => panic!("DocImportProgress type is not 'Found'"),
+impl From<DownloadPolicy> for iroh_docs::store::DownloadPolicy {
+    fn from(value: DownloadPolicy) -> Self {
+        match value {
+            DownloadPolicy::NothingExcept(filters) => {
+                iroh_docs::store::DownloadPolicy::NothingExcept(
+                    filters.into_iter().map(|f| f.0.clone()).collect(),
+                )
+            }
+            DownloadPolicy::EverythingExcept(filters) => {
+                iroh_docs::store::DownloadPolicy::EverythingExcept(
+                    filters.into_iter().map(|f| f.0.clone()).collect(),
+                )
+            }
         }
     }
+}
 
-    /// Return the `DocImportProgressProgress` event
-    pub fn as_progress(&self) -> DocImportProgressProgress {
-        match self {
-            DocImportProgress::Progress(p) => p.clone(),
-            _ => panic!("DocImportProgress type is not 'Progress'"),
-        }
-    }
+/// Filter strategy used in download policies.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+pub struct FilterKind(pub(crate) iroh_docs::store::FilterKind);
 
-    /// Return the `DocImportProgressDone` event
-    pub fn as_ingest_done(&self) -> DocImportProgressIngestDone {
-        match self {
-            DocImportProgress::IngestDone(d) => d.clone(),
-            _ => panic!("DocImportProgress type is not 'IngestDone'"),
-        }
+#[uniffi::export]
+impl FilterKind {
+    /// Verifies whether this filter matches a given key
+    pub fn matches(&self, key: Vec<u8>) -> bool {
+        self.0.matches(key)
     }
 
-    /// Return the `DocImportProgressAllDone`
-    pub fn as_all_done(&self) -> DocImportProgressAllDone {
-        match self {
-            DocImportProgress::AllDone(a) => a.clone(),
-            _ => panic!("DocImportProgress type is not 'AllDone'"),
-        }
+    /// Returns a FilterKind that matches if the contained bytes are a prefix of the key.
+    #[uniffi::constructor]
+    pub fn prefix(prefix: Vec<u8>) -> FilterKind {
+        FilterKind(iroh_docs::store::FilterKind::Prefix(Bytes::from(prefix)))
     }
 
-    /// Return the `DocImportProgressAbort`
-    pub fn as_abort(&self) -> DocImportProgressAbort {
-        match self {
-            DocImportProgress::Abort(a) => a.clone(),
-            _ => panic!("DocImportProgress type is not 'Abort'"),
-        }
+    /// Returns a FilterKind that matches if the contained bytes and the key are the same.
+    #[uniffi::constructor]
+    pub fn exact(key: Vec<u8>) -> FilterKind {
+        FilterKind(iroh_docs::store::FilterKind::Exact(Bytes::from(key)))
     }
 }
 
-/// The `progress` method will be called for each `DocExportProgress` event that is
-/// emitted during a `doc.export_file()` call. Use the `DocExportProgress.type()`
-/// method to check the `DocExportProgressType`
-#[uniffi::export(with_foreign)]
-#[async_trait::async_trait]
-pub trait DocExportFileCallback: Send + Sync + 'static {
-    async fn progress(&self, progress: Arc<DocExportProgress>) -> Result<(), CallbackError>;
+impl From<iroh_docs::store::FilterKind> for FilterKind {
+    fn from(value: iroh_docs::store::FilterKind) -> Self {
+        FilterKind(value)
+    }
 }
 
-/// The type of `DocExportProgress` event
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
-pub enum DocExportProgressType {
-    /// An item was found with name `name`, from now on referred to via `id`
-    Found,
-    /// We got progress exporting item `id`.
-    Progress,
-    /// We finished exporting a blob with `id`
-    Done,
-    /// We are done writing the entry to the filesystem
-    AllDone,
-    /// We got an error and need to abort.
-    ///
-    /// This will be the last message in the stream.
-    Abort,
+/// The state for an open replica.
+#[derive(Debug, Clone, Copy, Serialize, Deserialize, uniffi::Record)]
+pub struct OpenState {
+    /// Whether to accept sync requests for this replica.
+    pub sync: bool,
+    /// How many event subscriptions are open
+    pub subscribers: u64,
+    /// By how many handles the replica is currently held open
+    pub handles: u64,
 }
 
-/// A DocExportProgress event indicating a file was found with name `name`, from now on referred to via `id`
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocExportProgressFound {
-    /// A new unique id for this entry.
-    pub id: u64,
-    /// The hash of the entry.
-    pub hash: Arc<Hash>,
-    /// The size of the entry in bytes.
-    pub size: u64,
-    /// The path where we are writing the entry
-    pub outpath: String,
+/// Serialize an [`OpenState`] to JSON.
+#[uniffi::export]
+pub fn open_state_to_json(state: OpenState) -> Result<String, IrohError> {
+    crate::to_json(&state)
 }
 
-/// A DocExportProgress event indicating we've made progress exporting item `id`.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocExportProgressProgress {
-    /// The unique id of the entry.
-    pub id: u64,
-    /// The offset of the progress, in bytes.
-    pub offset: u64,
+/// Parse an [`OpenState`] from JSON produced by [`open_state_to_json`].
+#[uniffi::export]
+pub fn open_state_from_json(json: String) -> Result<OpenState, IrohError> {
+    crate::from_json(&json)
 }
 
-/// A DocExportProgress event indicating a single blob wit `id` is done
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocExportProgressDone {
-    /// The unique id of the entry.
-    pub id: u64,
+impl From<iroh_docs::actor::OpenState> for OpenState {
+    fn from(value: iroh_docs::actor::OpenState) -> Self {
+        OpenState {
+            sync: value.sync,
+            subscribers: value.subscribers as u64,
+            handles: value.handles as u64,
+        }
+    }
 }
 
-/// A DocExportProgress event indicating we got an error and need to abort
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
-pub struct DocExportProgressAbort {
-    /// The error message
-    pub error: String,
+/// The fields of a [`NodeAddr`], see [`NodeAddr::from_params`].
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct NodeAddrParams {
+    pub node_id: Arc<PublicKey>,
+    /// The home relay URL of the peer.
+    #[uniffi(default = None)]
+    pub relay_url: Option<String>,
+    /// The direct addresses of the peer, as `ip:port`.
+    #[uniffi(default = [])]
+    pub direct_addresses: Vec<String>,
 }
 
-/// Progress updates for the doc import file operation.
-#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
-pub enum DocExportProgress {
-    /// An item was found with name `name`, from now on referred to via `id`
-    Found(DocExportProgressFound),
-    /// We got progress ingesting item `id`.
-    Progress(DocExportProgressProgress),
-    /// We finished exporting a blob
-    Done(DocExportProgressDone),
-    /// We are done with the whole operation.
-    AllDone,
-    /// We got an error and need to abort.
-    ///
-    /// This will be the last message in the stream.
-    Abort(DocExportProgressAbort),
+/// A peer and it's addressing information.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Object)]
+pub struct NodeAddr {
+    node_id: Arc<PublicKey>,
+    relay_url: Option<String>,
+    addresses: Vec<String>,
 }
 
-impl From<iroh_blobs::export::ExportProgress> for DocExportProgress {
-    fn from(value: iroh_blobs::export::ExportProgress) -> Self {
-        match value {
-            iroh_blobs::export::ExportProgress::Found {
-                id,
-                hash,
-                size,
-                outpath,
-                // TODO (b5) - currently ignoring meta field. meta is probably the key of the entry that's being exported
-                ..
-            } => DocExportProgress::Found(DocExportProgressFound {
-                id,
-                hash: Arc::new(hash.into()),
-                // TODO(b5) - this is ignoring verification status of file size!
-                size: size.value(),
-                outpath: outpath.to_string_lossy().to_string(),
-            }),
-            iroh_blobs::export::ExportProgress::Progress { id, offset } => {
-                DocExportProgress::Progress(DocExportProgressProgress { id, offset })
-            }
-            iroh_blobs::export::ExportProgress::Done { id } => {
-                DocExportProgress::Done(DocExportProgressDone { id })
-            }
-            iroh_blobs::export::ExportProgress::AllDone => DocExportProgress::AllDone,
-            iroh_blobs::export::ExportProgress::Abort(err) => {
-                DocExportProgress::Abort(DocExportProgressAbort {
-                    error: err.to_string(),
-                })
-            }
+#[uniffi::export]
+impl NodeAddr {
+    /// Create a new [`NodeAddr`] with empty [`AddrInfo`].
+    #[uniffi::constructor]
+    pub fn new(node_id: &PublicKey, derp_url: Option<String>, addresses: Vec<String>) -> Self {
+        Self {
+            node_id: Arc::new(node_id.clone()),
+            relay_url: derp_url,
+            addresses,
         }
     }
-}
 
-#[uniffi::export]
-impl DocExportProgress {
-    /// Get the type of event
-    pub fn r#type(&self) -> DocExportProgressType {
-        match self {
-            DocExportProgress::Found(_) => DocExportProgressType::Found,
-            DocExportProgress::Progress(_) => DocExportProgressType::Progress,
-            DocExportProgress::Done(_) => DocExportProgressType::Done,
-            DocExportProgress::AllDone => DocExportProgressType::AllDone,
-            DocExportProgress::Abort(_) => DocExportProgressType::Abort,
+    /// Create a new [`NodeAddr`] from named fields.
+    #[uniffi::constructor]
+    pub fn from_params(params: NodeAddrParams) -> Self {
+        Self {
+            node_id: params.node_id,
+            relay_url: params.relay_url,
+            addresses: params.direct_addresses,
         }
     }
-    /// Return the `DocExportProgressFound` event
-    pub fn as_found(&self) -> DocExportProgressFound {
-        match self {
-            DocExportProgress::Found(f) => f.clone(),
-            _ => panic!("DocExportProgress type is not 'Found'"),
-        }
+
+    /// Get the direct addresses of this peer.
+    pub fn direct_addresses(&self) -> Vec<String> {
+        self.addresses.clone()
     }
-    /// Return the `DocExportProgressProgress` event
-    pub fn as_progress(&self) -> DocExportProgressProgress {
-        match self {
-            DocExportProgress::Progress(p) => p.clone(),
-            _ => panic!("DocExportProgress type is not 'Progress'"),
-        }
+
+    /// Get the home relay URL for this peer
+    pub fn relay_url(&self) -> Option<String> {
+        self.relay_url.clone()
     }
-    /// Return the `DocExportProgressAbort`
-    pub fn as_abort(&self) -> DocExportProgressAbort {
-        match self {
-            DocExportProgress::Abort(a) => a.clone(),
-            _ => panic!("DocExportProgress type is not 'Abort'"),
-        }
+
+    /// Returns true if both NodeAddr's have the same values
+    pub fn equal(&self, other: &NodeAddr) -> bool {
+        self == other
     }
 }
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use crate::{setup_logging, PublicKey};
-    use rand::RngCore;
-    use tokio::{io::AsyncWriteExt, sync::mpsc};
-
-    #[tokio::test]
-    async fn test_doc_create() {
-        let path = tempfile::tempdir().unwrap();
-        let options = crate::NodeOptions {
-            enable_docs: true,
+impl TryFrom<NodeAddr> for iroh::NodeAddr {
+    type Error = IrohError;
+    fn try_from(value: NodeAddr) -> Result<Self, Self::Error> {
+        let mut node_addr = iroh::NodeAddr::new((&*value.node_id).into());
+        let addresses = value
+            .direct_addresses()
+            .into_iter()
+            .map(|addr| {
+                std::net::SocketAddr::from_str(&addr).map_err(|e| anyhow::Error::from(e).into())
+            })
+            .collect::<Result<Vec<_>, IrohError>>()?;
+
+        if let Some(derp_url) = value.relay_url() {
+            let url = url::Url::parse(&derp_url).map_err(anyhow::Error::from)?;
+
+            node_addr = node_addr.with_relay_url(url.into());
+        }
+        node_addr = node_addr.with_direct_addresses(addresses);
+        Ok(node_addr)
+    }
+}
+
+impl From<iroh::NodeAddr> for NodeAddr {
+    fn from(value: iroh::NodeAddr) -> Self {
+        NodeAddr {
+            node_id: Arc::new(value.node_id.into()),
+            relay_url: value.relay_url.map(|url| url.to_string()),
+            addresses: value
+                .direct_addresses
+                .into_iter()
+                .map(|d| d.to_string())
+                .collect(),
+        }
+    }
+}
+
+/// Intended capability for document share tickets
+#[derive(Debug, Serialize, Deserialize, uniffi::Enum)]
+pub enum ShareMode {
+    /// Read-only access
+    Read,
+    /// Write access
+    Write,
+}
+
+crate::display_via_debug!(ShareMode);
+
+impl From<ShareMode> for iroh_docs::rpc::client::docs::ShareMode {
+    fn from(mode: ShareMode) -> Self {
+        match mode {
+            ShareMode::Read => iroh_docs::rpc::client::docs::ShareMode::Read,
+            ShareMode::Write => iroh_docs::rpc::client::docs::ShareMode::Write,
+        }
+    }
+}
+
+/// A single entry in a [`Doc`]
+///
+/// An entry is identified by a key, its [`AuthorId`], and the [`Doc`]'s
+/// namespace id. Its value is the 32-byte BLAKE3 [`hash`]
+/// of the entry's content data, the size of this content data, and a timestamp.
+#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Object)]
+pub struct Entry(pub(crate) iroh_docs::rpc::client::docs::Entry);
+
+impl From<iroh_docs::rpc::client::docs::Entry> for Entry {
+    fn from(e: iroh_docs::rpc::client::docs::Entry) -> Self {
+        Entry(e)
+    }
+}
+
+#[uniffi::export]
+impl Entry {
+    /// Get the [`AuthorId`] of this entry.
+    #[uniffi::method]
+    pub fn author(&self) -> Arc<AuthorId> {
+        Arc::new(AuthorId(self.0.id().author()))
+    }
+
+    /// Get the content_hash of this entry.
+    #[uniffi::method]
+    pub fn content_hash(&self) -> Arc<Hash> {
+        Arc::new(Hash(self.0.content_hash()))
+    }
+
+    /// Get the content_length of this entry.
+    #[uniffi::method]
+    pub fn content_len(&self) -> u64 {
+        self.0.content_len()
+    }
+
+    /// Get the key of this entry.
+    #[uniffi::method]
+    pub fn key(&self) -> Vec<u8> {
+        self.0.id().key().to_vec()
+    }
+
+    /// Get the namespace id of this entry.
+    #[uniffi::method]
+    pub fn namespace(&self) -> String {
+        self.0.id().namespace().to_string()
+    }
+
+    /// Get the timestamp when this entry was written.
+    #[uniffi::method]
+    pub fn timestamp(&self) -> u64 {
+        self.0.timestamp()
+    }
+
+    /// The timestamp of this entry as wall clock time.
+    ///
+    /// Timestamps are microseconds since the unix epoch as read from the clock of the writing
+    /// node, they are neither synchronized between nodes nor guaranteed to increase. Entries
+    /// carry no separate counter: nodes writing with a logical `NodeOptions.clock` store the
+    /// counter as the timestamp, which then does not translate to wall clock time.
+    #[uniffi::method]
+    pub fn written_at(&self) -> SystemTime {
+        SystemTime::UNIX_EPOCH + Duration::from_micros(self.0.timestamp())
+    }
+
+    /// How this entry is ordered relative to `other` by document sync.
+    ///
+    /// Only entries of the same author for the same key are ordered: of these, every replica
+    /// keeps the one with the newer timestamp, or the larger content hash if the timestamps
+    /// are equal. Entries of different authors for the same key are concurrent, queries for
+    /// the latest entry per key pick the newer timestamp among them.
+    #[uniffi::method]
+    pub fn order(&self, other: &Entry) -> EntryOrder {
+        let (id, other_id) = (self.0.id(), other.0.id());
+        if id.namespace() != other_id.namespace() || id.key() != other_id.key() {
+            return EntryOrder::Unrelated;
+        }
+        if id.author() != other_id.author() {
+            return EntryOrder::Concurrent;
+        }
+        let rank = |entry: &Entry| (entry.0.timestamp(), entry.0.content_hash());
+        match rank(self).cmp(&rank(other)) {
+            std::cmp::Ordering::Greater => EntryOrder::Supersedes,
+            std::cmp::Ordering::Less => EntryOrder::SupersededBy,
+            std::cmp::Ordering::Equal => EntryOrder::Equal,
+        }
+    }
+}
+
+/// How two entries are ordered by document sync, see [`Entry::order`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum EntryOrder {
+    /// The entry replaces the other one.
+    Supersedes,
+    /// The entry is replaced by the other one.
+    SupersededBy,
+    /// Both are the same entry.
+    Equal,
+    /// The entries are for the same key but by different authors, both are kept.
+    Concurrent,
+    /// The entries are for different keys or documents.
+    Unrelated,
+}
+
+///d Fields by which the query can be sorted
+#[derive(Clone, Debug, Default, Serialize, Deserialize, uniffi::Enum)]
+pub enum SortBy {
+    /// Sort by key, then author.
+    KeyAuthor,
+    /// Sort by author, then key.
+    #[default]
+    AuthorKey,
+}
+
+crate::display_via_debug!(SortBy);
+
+impl From<iroh_docs::store::SortBy> for SortBy {
+    fn from(value: iroh_docs::store::SortBy) -> Self {
+        match value {
+            iroh_docs::store::SortBy::AuthorKey => SortBy::AuthorKey,
+            iroh_docs::store::SortBy::KeyAuthor => SortBy::KeyAuthor,
+        }
+    }
+}
+
+impl From<SortBy> for iroh_docs::store::SortBy {
+    fn from(value: SortBy) -> Self {
+        match value {
+            SortBy::AuthorKey => iroh_docs::store::SortBy::AuthorKey,
+            SortBy::KeyAuthor => iroh_docs::store::SortBy::KeyAuthor,
+        }
+    }
+}
+
+/// Sort direction
+#[derive(Clone, Debug, Default, Serialize, Deserialize, uniffi::Enum)]
+pub enum SortDirection {
+    /// Sort ascending
+    #[default]
+    Asc,
+    /// Sort descending
+    Desc,
+}
+
+crate::display_via_debug!(SortDirection);
+
+impl From<iroh_docs::store::SortDirection> for SortDirection {
+    fn from(value: iroh_docs::store::SortDirection) -> Self {
+        match value {
+            iroh_docs::store::SortDirection::Asc => SortDirection::Asc,
+            iroh_docs::store::SortDirection::Desc => SortDirection::Desc,
+        }
+    }
+}
+
+impl From<SortDirection> for iroh_docs::store::SortDirection {
+    fn from(value: SortDirection) -> Self {
+        match value {
+            SortDirection::Asc => iroh_docs::store::SortDirection::Asc,
+            SortDirection::Desc => iroh_docs::store::SortDirection::Desc,
+        }
+    }
+}
+
+/// Build a Query to search for an entry or entries in a doc.
+///
+/// Use this with `QueryOptions` to determine sorting, grouping, and pagination.
+#[derive(Clone, Debug, uniffi::Object)]
+pub struct Query(pub(crate) iroh_docs::store::Query, pub(crate) Page);
+
+/// The offset and limit of a [`Query`].
+///
+/// They are applied once the sidecar entries are filtered out of the results, so the store
+/// query itself is not paginated, see [`Doc::query_entries`].
+#[derive(Clone, Copy, Debug, Default)]
+pub(crate) struct Page {
+    pub(crate) offset: u64,
+    pub(crate) limit: Option<u64>,
+}
+
+impl Page {
+    fn new(opts: &QueryOptions) -> Self {
+        Page {
+            offset: opts.offset,
+            limit: (opts.limit != 0).then_some(opts.limit),
+        }
+    }
+}
+
+/// Options for sorting and pagination for using [`Query`]s.
+#[derive(Clone, Debug, Default, uniffi::Record)]
+pub struct QueryOptions {
+    /// Sort by author or key first.
+    ///
+    /// Default is [`SortBy::AuthorKey`], so sorting first by author and then by key.
+    pub sort_by: SortBy,
+    /// Direction by which to sort the entries
+    ///
+    /// Default is [`SortDirection::Asc`]
+    pub direction: SortDirection,
+    /// Offset
+    pub offset: u64,
+    /// Limit to limit the pagination.
+    ///
+    /// When the limit is 0, the limit does not exist.
+    pub limit: u64,
+}
+
+/// Which entries a [`Query`] selects, see [`Query::from_params`].
+///
+/// Without any filter all entries are selected.
+#[derive(Clone, Debug, Default, uniffi::Record)]
+pub struct QueryParams {
+    /// Only entries by this author.
+    #[uniffi(default = None)]
+    pub author: Option<Arc<AuthorId>>,
+    /// Only entries with exactly this key.
+    #[uniffi(default = None)]
+    pub key_exact: Option<Vec<u8>>,
+    /// Only entries with keys starting with this prefix.
+    #[uniffi(default = None)]
+    pub key_prefix: Option<Vec<u8>>,
+    /// Only the latest entry for each key, omitting older entries if the entry was written to
+    /// by multiple authors. `QueryOptions.sort_by` does not apply.
+    #[uniffi(default = false)]
+    pub latest_per_key: bool,
+    /// Sorting and pagination, the defaults if not set.
+    #[uniffi(default = None)]
+    pub options: Option<QueryOptions>,
+}
+
+#[uniffi::export]
+impl Query {
+    /// Create a query from named fields.
+    ///
+    /// Fails if both `key_exact` and `key_prefix` are set, or if `author` is set together with
+    /// `latest_per_key`.
+    #[uniffi::constructor]
+    pub fn from_params(params: QueryParams) -> Result<Self, IrohError> {
+        if params.key_exact.is_some() && params.key_prefix.is_some() {
+            return Err(anyhow::anyhow!("key_exact and key_prefix can not both be set").into());
+        }
+        let opts = params.options.unwrap_or_default();
+        let page = Page::new(&opts);
+        let query = if params.latest_per_key {
+            if params.author.is_some() {
+                return Err(
+                    anyhow::anyhow!("author can not be set for latest_per_key queries").into(),
+                );
+            }
+            let mut builder = iroh_docs::store::Query::single_latest_per_key();
+            if let Some(key) = params.key_exact {
+                builder = builder.key_exact(key);
+            }
+            if let Some(prefix) = params.key_prefix {
+                builder = builder.key_prefix(prefix);
+            }
+            builder.sort_direction(opts.direction.into()).build()
+        } else {
+            let mut builder = match params.author {
+                Some(author) => iroh_docs::store::Query::author(author.0),
+                None => iroh_docs::store::Query::all(),
+            };
+            if let Some(key) = params.key_exact {
+                builder = builder.key_exact(key);
+            }
+            if let Some(prefix) = params.key_prefix {
+                builder = builder.key_prefix(prefix);
+            }
+            builder
+                .sort_by(opts.sort_by.into(), opts.direction.into())
+                .build()
+        };
+        Ok(Query(query, page))
+    }
+
+    /// Query all records.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     sort_by: SortBy::AuthorKey
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn all(opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::all();
+
+        if let Some(opts) = opts {
+            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Query only the latest entry for each key, omitting older entries if the entry was written
+    /// to by multiple authors.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn single_latest_per_key(opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::single_latest_per_key();
+
+        if let Some(opts) = opts {
+            builder = builder.sort_direction(opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Query exactly the key, but only the latest entry for it, omitting older entries if the entry was written
+    /// to by multiple authors.
+    #[uniffi::constructor]
+    pub fn single_latest_per_key_exact(key: Vec<u8>) -> Self {
+        let builder = iroh_docs::store::Query::single_latest_per_key()
+            .key_exact(key)
+            .build();
+        Query(builder, Page::default())
+    }
+
+    /// Query only the latest entry for each key, with this prefix, omitting older entries if the entry was written
+    /// to by multiple authors.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn single_latest_per_key_prefix(prefix: Vec<u8>, opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let builder = iroh_docs::store::Query::single_latest_per_key().key_prefix(prefix);
+        Query(builder.build(), page)
+    }
+
+    /// Query all entries for by a single author.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     sort_by: SortBy::AuthorKey
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn author(author: &AuthorId, opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::author(author.0);
+
+        if let Some(opts) = opts {
+            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Query all entries that have an exact key.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     sort_by: SortBy::AuthorKey
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn key_exact(key: Vec<u8>, opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::key_exact(key);
+
+        if let Some(opts) = opts {
+            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Create a Query for a single key and author.
+    #[uniffi::constructor]
+    pub fn author_key_exact(author: &AuthorId, key: Vec<u8>) -> Self {
+        let builder = iroh_docs::store::Query::author(author.0).key_exact(key);
+        Query(builder.build(), Page::default())
+    }
+
+    /// Create a query for all entries with a given key prefix.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     sort_by: SortBy::AuthorKey
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn key_prefix(prefix: Vec<u8>, opts: Option<QueryOptions>) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::key_prefix(prefix);
+
+        if let Some(opts) = opts {
+            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Create a query for all entries of a single author with a given key prefix.
+    ///
+    /// If `opts` is `None`, the default values will be used:
+    ///     direction: SortDirection::Asc
+    ///     offset: None
+    ///     limit: None
+    #[uniffi::constructor]
+    pub fn author_key_prefix(
+        author: &AuthorId,
+        prefix: Vec<u8>,
+        opts: Option<QueryOptions>,
+    ) -> Self {
+        let page = opts.as_ref().map(Page::new).unwrap_or_default();
+        let mut builder = iroh_docs::store::Query::author(author.0).key_prefix(prefix);
+
+        if let Some(opts) = opts {
+            builder = builder.sort_by(opts.sort_by.into(), opts.direction.into());
+        }
+        Query(builder.build(), page)
+    }
+
+    /// Get the limit for this query (max. number of entries to emit).
+    pub fn limit(&self) -> Option<u64> {
+        self.1.limit
+    }
+
+    /// Get the offset for this query (number of entries to skip at the beginning).
+    pub fn offset(&self) -> u64 {
+        self.1.offset
+    }
+}
+
+/// The `progress` method will be called for each `SubscribeProgress` event that is
+/// emitted during a `node.doc_subscribe`. Use the `SubscribeProgress.type()`
+/// method to check the `LiveEvent`
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait SubscribeCallback: Send + Sync + 'static {
+    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError>;
+}
+
+/// Events informing about actions of the live sync progress
+#[derive(Debug, Serialize, Deserialize, uniffi::Object)]
+#[uniffi::export(Display)]
+#[allow(clippy::large_enum_variant)]
+pub enum LiveEvent {
+    /// A local insertion.
+    InsertLocal {
+        /// The inserted entry.
+        entry: Entry,
+    },
+    /// Received a remote insert.
+    InsertRemote {
+        /// The peer that sent us the entry.
+        from: PublicKey,
+        /// The inserted entry.
+        entry: Entry,
+        /// If the content is available at the local node
+        content_status: ContentStatus,
+    },
+    /// The content of an entry was downloaded and is now available at the local node
+    ContentReady {
+        /// The content hash of the newly available entry content
+        hash: Hash,
+    },
+    /// We have a new neighbor in the swarm.
+    NeighborUp(PublicKey),
+    /// We lost a neighbor in the swarm.
+    NeighborDown(PublicKey),
+    /// A set-reconciliation sync finished.
+    SyncFinished(SyncEvent),
+    /// All pending content is now ready.
+    ///
+    /// This event signals that all queued content downloads from the last sync run have either
+    /// completed or failed.
+    ///
+    /// It will only be emitted after a [`Self::SyncFinished`] event, never before.
+    ///
+    /// Receiving this event does not guarantee that all content in the document is available. If
+    /// blobs failed to download, this event will still be emitted after all operations completed.
+    PendingContentReady,
+    /// Multiple local insertions, committed together through a [`WriteBatch`].
+    InsertLocalBatch {
+        /// The inserted entries.
+        entries: Vec<Entry>,
+    },
+    /// The subscription ended because the document was closed.
+    ///
+    /// This is always the last event delivered to a subscriber.
+    Closed,
+}
+
+crate::display_via_debug!(LiveEvent);
+
+/// The type of events that can be emitted during the live sync progress
+#[derive(Debug, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+pub enum LiveEventType {
+    /// A local insertion.
+    InsertLocal,
+    /// Received a remote insert.
+    InsertRemote,
+    /// The content of an entry was downloaded and is now available at the local node
+    ContentReady,
+    /// We have a new neighbor in the swarm.
+    NeighborUp,
+    /// We lost a neighbor in the swarm.
+    NeighborDown,
+    /// A set-reconciliation sync finished.
+    SyncFinished,
+    /// All pending content is now ready.
+    ///
+    /// This event signals that all queued content downloads from the last sync run have either
+    /// completed or failed.
+    ///
+    /// It will only be emitted after a [`Self::SyncFinished`] event, never before.
+    ///
+    /// Receiving this event does not guarantee that all content in the document is available. If
+    /// blobs failed to download, this event will still be emitted after all operations completed.
+    PendingContentReady,
+    /// Multiple local insertions, committed together through a [`WriteBatch`].
+    InsertLocalBatch,
+    /// The subscription ended because the document was closed.
+    ///
+    /// This is always the last event delivered to a subscriber.
+    Closed,
+}
+
+crate::display_via_debug!(LiveEventType);
+
+#[uniffi::export]
+impl LiveEvent {
+    /// The type LiveEvent
+    pub fn r#type(&self) -> LiveEventType {
+        match self {
+            Self::InsertLocal { .. } => LiveEventType::InsertLocal,
+            Self::InsertRemote { .. } => LiveEventType::InsertRemote,
+            Self::ContentReady { .. } => LiveEventType::ContentReady,
+            Self::NeighborUp(_) => LiveEventType::NeighborUp,
+            Self::NeighborDown(_) => LiveEventType::NeighborDown,
+            Self::SyncFinished(_) => LiveEventType::SyncFinished,
+            Self::PendingContentReady => LiveEventType::PendingContentReady,
+            Self::InsertLocalBatch { .. } => LiveEventType::InsertLocalBatch,
+            Self::Closed => LiveEventType::Closed,
+        }
+    }
+
+    /// For `LiveEventType::InsertLocal`, returns an Entry
+    pub fn as_insert_local(&self) -> Arc<Entry> {
+        if let Self::InsertLocal { entry } = self {
+            Arc::new(entry.clone())
+        } else {
+            panic!("not an insert local event");
+        }
+    }
+
+    /// For `LiveEventType::InsertLocalBatch`, returns the inserted entries
+    pub fn as_insert_local_batch(&self) -> Option<Vec<Arc<Entry>>> {
+        if let Self::InsertLocalBatch { entries } = self {
+            Some(entries.iter().cloned().map(Arc::new).collect())
+        } else {
+            None
+        }
+    }
+
+    /// For `LiveEventType::InsertRemote`, returns an InsertRemoteEvent
+    pub fn as_insert_remote(&self) -> InsertRemoteEvent {
+        if let Self::InsertRemote {
+            from,
+            entry,
+            content_status,
+        } = self
+        {
+            InsertRemoteEvent {
+                from: Arc::new(from.clone()),
+                entry: Arc::new(entry.clone()),
+                content_status: content_status.clone(),
+            }
+        } else {
+            panic!("not an insert remote event");
+        }
+    }
+
+    /// For `LiveEventType::ContentReady`, returns a Hash
+    pub fn as_content_ready(&self) -> Arc<Hash> {
+        if let Self::ContentReady { hash } = self {
+            Arc::new(hash.clone())
+        } else {
+            panic!("not an content ready event");
+        }
+    }
+
+    /// For `LiveEventType::NeighborUp`, returns a PublicKey
+    pub fn as_neighbor_up(&self) -> Arc<PublicKey> {
+        if let Self::NeighborUp(key) = self {
+            Arc::new(key.clone())
+        } else {
+            panic!("not an neighbor up event");
+        }
+    }
+
+    /// For `LiveEventType::NeighborDown`, returns a PublicKey
+    pub fn as_neighbor_down(&self) -> Arc<PublicKey> {
+        if let Self::NeighborDown(key) = self {
+            Arc::new(key.clone())
+        } else {
+            panic!("not an neighbor down event");
+        }
+    }
+
+    /// For `LiveEventType::SyncFinished`, returns a SyncEvent
+    pub fn as_sync_finished(&self) -> SyncEvent {
+        if let Self::SyncFinished(event) = self {
+            event.clone()
+        } else {
+            panic!("not an sync event event");
+        }
+    }
+}
+
+impl From<iroh_docs::rpc::client::docs::LiveEvent> for LiveEvent {
+    fn from(value: iroh_docs::rpc::client::docs::LiveEvent) -> Self {
+        match value {
+            iroh_docs::rpc::client::docs::LiveEvent::InsertLocal { entry } => {
+                LiveEvent::InsertLocal {
+                    entry: entry.into(),
+                }
+            }
+            iroh_docs::rpc::client::docs::LiveEvent::InsertRemote {
+                from,
+                entry,
+                content_status,
+            } => LiveEvent::InsertRemote {
+                from: from.into(),
+                entry: entry.into(),
+                content_status: content_status.into(),
+            },
+            iroh_docs::rpc::client::docs::LiveEvent::ContentReady { hash } => {
+                LiveEvent::ContentReady { hash: hash.into() }
+            }
+            iroh_docs::rpc::client::docs::LiveEvent::NeighborUp(key) => {
+                LiveEvent::NeighborUp(key.into())
+            }
+            iroh_docs::rpc::client::docs::LiveEvent::NeighborDown(key) => {
+                LiveEvent::NeighborDown(key.into())
+            }
+            iroh_docs::rpc::client::docs::LiveEvent::SyncFinished(e) => {
+                LiveEvent::SyncFinished(e.into())
+            }
+            iroh_docs::rpc::client::docs::LiveEvent::PendingContentReady => {
+                LiveEvent::PendingContentReady
+            }
+        }
+    }
+}
+
+/// Outcome of a sync operation
+#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Record)]
+pub struct SyncEvent {
+    /// Peer we synced with
+    pub peer: Arc<PublicKey>,
+    /// Origin of the sync exchange
+    pub origin: Origin,
+    /// Timestamp when the sync finished
+    pub finished: SystemTime,
+    /// Timestamp when the sync started
+    pub started: SystemTime,
+    /// Result of the sync operation. `None` if successfull.
+    pub result: Option<String>,
+}
+
+/// Serialize a [`SyncEvent`] to JSON.
+///
+/// The peer is encoded as its string representation.
+#[uniffi::export]
+pub fn sync_event_to_json(event: &SyncEvent) -> Result<String, IrohError> {
+    crate::to_json(event)
+}
+
+/// Parse a [`SyncEvent`] from JSON produced by [`sync_event_to_json`].
+#[uniffi::export]
+pub fn sync_event_from_json(json: String) -> Result<SyncEvent, IrohError> {
+    crate::from_json(&json)
+}
+
+impl From<iroh_docs::rpc::client::docs::SyncEvent> for SyncEvent {
+    fn from(value: iroh_docs::rpc::client::docs::SyncEvent) -> Self {
+        SyncEvent {
+            peer: Arc::new(value.peer.into()),
+            origin: value.origin.into(),
+            finished: value.finished,
+            started: value.started,
+            result: match value.result {
+                Ok(_) => None,
+                Err(err) => Some(err),
+            },
+        }
+    }
+}
+
+/// Why we started a sync request
+#[derive(Debug, Clone, Serialize, Deserialize, Eq, PartialEq, Copy, uniffi::Enum)]
+pub enum SyncReason {
+    /// Direct join request via API
+    DirectJoin,
+    /// Peer showed up as new neighbor in the gossip swarm
+    NewNeighbor,
+    /// We synced after receiving a sync report that indicated news for us
+    SyncReport,
+    /// We received a sync report while a sync was running, so run again afterwars
+    Resync,
+}
+
+crate::display_via_debug!(SyncReason);
+
+impl From<iroh_docs::rpc::client::docs::SyncReason> for SyncReason {
+    fn from(value: iroh_docs::rpc::client::docs::SyncReason) -> Self {
+        match value {
+            iroh_docs::rpc::client::docs::SyncReason::DirectJoin => Self::DirectJoin,
+            iroh_docs::rpc::client::docs::SyncReason::NewNeighbor => Self::NewNeighbor,
+            iroh_docs::rpc::client::docs::SyncReason::SyncReport => Self::SyncReport,
+            iroh_docs::rpc::client::docs::SyncReason::Resync => Self::Resync,
+        }
+    }
+}
+
+/// Why we performed a sync exchange
+#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Enum)]
+pub enum Origin {
+    /// public, use a unit variant
+    Connect { reason: SyncReason },
+    /// A peer connected to us and we accepted the exchange
+    Accept,
+}
+
+impl From<iroh_docs::rpc::client::docs::Origin> for Origin {
+    fn from(value: iroh_docs::rpc::client::docs::Origin) -> Self {
+        match value {
+            iroh_docs::rpc::client::docs::Origin::Connect(reason) => Self::Connect {
+                reason: reason.into(),
+            },
+            iroh_docs::rpc::client::docs::Origin::Accept => Self::Accept,
+        }
+    }
+}
+
+/// Outcome of an InsertRemove event.
+#[derive(Debug, Serialize, Deserialize, uniffi::Record)]
+pub struct InsertRemoteEvent {
+    /// The peer that sent us the entry.
+    pub from: Arc<PublicKey>,
+    /// The inserted entry.
+    pub entry: Arc<Entry>,
+    /// If the content is available at the local node
+    pub content_status: ContentStatus,
+}
+
+/// An entry and whether its content is available locally, see [`Doc::get_many_with_status`].
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct EntryWithStatus {
+    /// The entry.
+    pub entry: Arc<Entry>,
+    /// Whether the content of the entry is stored on this node.
+    pub content_status: ContentStatus,
+}
+
+/// Entries and their contents, see [`Doc::get_many_contents`].
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct EntryContents {
+    /// The entries, in query order.
+    pub entries: Vec<EntryContentSlice>,
+    /// The contents of the entries, back to back.
+    pub data: Vec<u8>,
+    /// Whether entries matching the query were left out to stay within the size limit.
+    pub truncated: bool,
+}
+
+/// An entry and where its content is in [`EntryContents::data`].
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct EntryContentSlice {
+    pub entry: Arc<Entry>,
+    /// Whether the content is in the buffer. False if the content is not stored on this node
+    /// or larger than the size limit on its own.
+    pub available: bool,
+    /// Start of the content in the buffer.
+    pub offset: u64,
+    /// Length of the content in the buffer.
+    pub len: u64,
+}
+
+/// Whether the content status is available on a node.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+pub enum ContentStatus {
+    /// The content is completely available.
+    Complete,
+    /// The content is partially available.
+    Incomplete,
+    /// The content is missing.
+    Missing,
+}
+
+crate::display_via_debug!(ContentStatus);
+
+impl From<iroh_docs::ContentStatus> for ContentStatus {
+    fn from(value: iroh_docs::ContentStatus) -> Self {
+        match value {
+            iroh_docs::ContentStatus::Complete => Self::Complete,
+            iroh_docs::ContentStatus::Incomplete => Self::Incomplete,
+            iroh_docs::ContentStatus::Missing => Self::Missing,
+        }
+    }
+}
+
+/// The `progress` method will be called for each `DocImportProgress` event that is
+/// emitted during a `doc.import_file()` call. Use the `DocImportProgress.type()`
+/// method to check the `DocImportProgressType`
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait DocImportFileCallback: Send + Sync + 'static {
+    async fn progress(&self, progress: Arc<DocImportProgress>) -> Result<(), CallbackError>;
+}
+
+/// The type of `DocImportProgress` event
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+pub enum DocImportProgressType {
+    /// An item was found with name `name`, from now on referred to via `id`
+    Found,
+    /// We got progress ingesting item `id`.
+    Progress,
+    /// We are done ingesting `id`, and the hash is `hash`.
+    IngestDone,
+    /// We are done with the whole operation.
+    AllDone,
+    /// We got an error and need to abort.
+    ///
+    /// This will be the last message in the stream.
+    Abort,
+}
+
+crate::display_via_debug!(DocImportProgressType);
+
+/// A DocImportProgress event indicating a file was found with name `name`, from now on referred to via `id`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocImportProgressFound {
+    /// A new unique id for this entry.
+    pub id: u64,
+    /// The name of the entry.
+    pub name: String,
+    /// The size of the entry in bytes.
+    pub size: u64,
+}
+
+/// A DocImportProgress event indicating we've made progress ingesting item `id`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocImportProgressProgress {
+    /// The unique id of the entry.
+    pub id: u64,
+    /// The offset of the progress, in bytes.
+    pub offset: u64,
+}
+
+/// A DocImportProgress event indicating we are finished adding `id` to the data store and the hash is `hash`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocImportProgressIngestDone {
+    /// The unique id of the entry.
+    pub id: u64,
+    /// The hash of the entry.
+    pub hash: Arc<Hash>,
+}
+
+/// A DocImportProgress event indicating we are done setting the entry to the doc
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocImportProgressAllDone {
+    /// The key of the entry
+    pub key: Vec<u8>,
+}
+
+/// A DocImportProgress event indicating we got an error and need to abort
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocImportProgressAbort {
+    /// The error message
+    pub error: String,
+}
+
+/// Progress updates for the doc import file operation.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+#[uniffi::export(Display)]
+pub enum DocImportProgress {
+    /// An item was found with name `name`, from now on referred to via `id`
+    Found(DocImportProgressFound),
+    /// We got progress ingesting item `id`.
+    Progress(DocImportProgressProgress),
+    /// We are done ingesting `id`, and the hash is `hash`.
+    IngestDone(DocImportProgressIngestDone),
+    /// We are done with the whole operation.
+    AllDone(DocImportProgressAllDone),
+    /// We got an error and need to abort.
+    ///
+    /// This will be the last message in the stream.
+    Abort(DocImportProgressAbort),
+}
+
+crate::display_via_debug!(DocImportProgress);
+
+impl From<iroh_docs::rpc::client::docs::ImportProgress> for DocImportProgress {
+    fn from(value: iroh_docs::rpc::client::docs::ImportProgress) -> Self {
+        match value {
+            iroh_docs::rpc::client::docs::ImportProgress::Found { id, name, size } => {
+                DocImportProgress::Found(DocImportProgressFound { id, name, size })
+            }
+            iroh_docs::rpc::client::docs::ImportProgress::Progress { id, offset } => {
+                DocImportProgress::Progress(DocImportProgressProgress { id, offset })
+            }
+            iroh_docs::rpc::client::docs::ImportProgress::IngestDone { id, hash } => {
+                DocImportProgress::IngestDone(DocImportProgressIngestDone {
+                    id,
+                    hash: Arc::new(hash.into()),
+                })
+            }
+            iroh_docs::rpc::client::docs::ImportProgress::AllDone { key } => {
+                DocImportProgress::AllDone(DocImportProgressAllDone { key: key.into() })
+            }
+            iroh_docs::rpc::client::docs::ImportProgress::Abort(err) => {
+                DocImportProgress::Abort(DocImportProgressAbort {
+                    error: err.to_string(),
+                })
+            }
+        }
+    }
+}
+
+#[uniffi::export]
+impl DocImportProgress {
+    /// Get the type of event
+    pub fn r#type(&self) -> DocImportProgressType {
+        match self {
+            DocImportProgress::Found(_) => DocImportProgressType::Found,
+            DocImportProgress::Progress(_) => DocImportProgressType::Progress,
+            DocImportProgress::IngestDone(_) => DocImportProgressType::IngestDone,
+            DocImportProgress::AllDone(_) => DocImportProgressType::AllDone,
+            DocImportProgress::Abort(_) => DocImportProgressType::Abort,
+        }
+    }
+
+    /// Returns true if this is the `AllDone` event, signaling a successful end of the stream.
+    pub fn is_all_done(&self) -> bool {
+        matches!(self, DocImportProgress::AllDone(_))
+    }
+
+    /// Returns true if this is the `Abort` event, signaling the operation failed.
+    pub fn is_abort(&self) -> bool {
+        matches!(self, DocImportProgress::Abort(_))
+    }
+
+    /// Return the `DocImportProgressFound` event
+    pub fn as_found(&self) -> DocImportProgressFound {
+        match self {
+            DocImportProgress::Found(f) => f.clone(),
+            _ => panic!("DocImportProgress type is not 'Found'"),
+        }
+    }
+
+    /// Return the `DocImportProgressProgress` event
+    pub fn as_progress(&self) -> DocImportProgressProgress {
+        match self {
+            DocImportProgress::Progress(p) => p.clone(),
+            _ => panic!("DocImportProgress type is not 'Progress'"),
+        }
+    }
+
+    /// Return the `DocImportProgressDone` event
+    pub fn as_ingest_done(&self) -> DocImportProgressIngestDone {
+        match self {
+            DocImportProgress::IngestDone(d) => d.clone(),
+            _ => panic!("DocImportProgress type is not 'IngestDone'"),
+        }
+    }
+
+    /// Return the `DocImportProgressAllDone`
+    pub fn as_all_done(&self) -> DocImportProgressAllDone {
+        match self {
+            DocImportProgress::AllDone(a) => a.clone(),
+            _ => panic!("DocImportProgress type is not 'AllDone'"),
+        }
+    }
+
+    /// Return the `DocImportProgressAbort`
+    pub fn as_abort(&self) -> DocImportProgressAbort {
+        match self {
+            DocImportProgress::Abort(a) => a.clone(),
+            _ => panic!("DocImportProgress type is not 'Abort'"),
+        }
+    }
+}
+
+/// The `progress` method will be called for each `DocExportProgress` event that is
+/// emitted during a `doc.export_file()` call. Use the `DocExportProgress.type()`
+/// method to check the `DocExportProgressType`
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait DocExportFileCallback: Send + Sync + 'static {
+    async fn progress(&self, progress: Arc<DocExportProgress>) -> Result<(), CallbackError>;
+}
+
+/// The type of `DocExportProgress` event
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+pub enum DocExportProgressType {
+    /// An item was found with name `name`, from now on referred to via `id`
+    Found,
+    /// We got progress exporting item `id`.
+    Progress,
+    /// We finished exporting a blob with `id`
+    Done,
+    /// We are done writing the entry to the filesystem
+    AllDone,
+    /// We got an error and need to abort.
+    ///
+    /// This will be the last message in the stream.
+    Abort,
+}
+
+crate::display_via_debug!(DocExportProgressType);
+
+/// A DocExportProgress event indicating a file was found with name `name`, from now on referred to via `id`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocExportProgressFound {
+    /// A new unique id for this entry.
+    pub id: u64,
+    /// The hash of the entry.
+    pub hash: Arc<Hash>,
+    /// The size of the entry in bytes.
+    pub size: u64,
+    /// The path where we are writing the entry
+    pub outpath: String,
+}
+
+/// A DocExportProgress event indicating we've made progress exporting item `id`.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocExportProgressProgress {
+    /// The unique id of the entry.
+    pub id: u64,
+    /// The offset of the progress, in bytes.
+    pub offset: u64,
+}
+
+/// A DocExportProgress event indicating a single blob wit `id` is done
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocExportProgressDone {
+    /// The unique id of the entry.
+    pub id: u64,
+}
+
+/// A DocExportProgress event indicating we got an error and need to abort
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct DocExportProgressAbort {
+    /// The error message
+    pub error: String,
+}
+
+/// Progress updates for the doc import file operation.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+#[uniffi::export(Display)]
+pub enum DocExportProgress {
+    /// An item was found with name `name`, from now on referred to via `id`
+    Found(DocExportProgressFound),
+    /// We got progress ingesting item `id`.
+    Progress(DocExportProgressProgress),
+    /// We finished exporting a blob
+    Done(DocExportProgressDone),
+    /// We are done with the whole operation.
+    AllDone,
+    /// We got an error and need to abort.
+    ///
+    /// This will be the last message in the stream.
+    Abort(DocExportProgressAbort),
+}
+
+crate::display_via_debug!(DocExportProgress);
+
+impl From<iroh_blobs::export::ExportProgress> for DocExportProgress {
+    fn from(value: iroh_blobs::export::ExportProgress) -> Self {
+        match value {
+            iroh_blobs::export::ExportProgress::Found {
+                id,
+                hash,
+                size,
+                outpath,
+                // TODO (b5) - currently ignoring meta field. meta is probably the key of the entry that's being exported
+                ..
+            } => DocExportProgress::Found(DocExportProgressFound {
+                id,
+                hash: Arc::new(hash.into()),
+                // TODO(b5) - this is ignoring verification status of file size!
+                size: size.value(),
+                outpath: outpath.to_string_lossy().to_string(),
+            }),
+            iroh_blobs::export::ExportProgress::Progress { id, offset } => {
+                DocExportProgress::Progress(DocExportProgressProgress { id, offset })
+            }
+            iroh_blobs::export::ExportProgress::Done { id } => {
+                DocExportProgress::Done(DocExportProgressDone { id })
+            }
+            iroh_blobs::export::ExportProgress::AllDone => DocExportProgress::AllDone,
+            iroh_blobs::export::ExportProgress::Abort(err) => {
+                DocExportProgress::Abort(DocExportProgressAbort {
+                    error: err.to_string(),
+                })
+            }
+        }
+    }
+}
+
+#[uniffi::export]
+impl DocExportProgress {
+    /// Get the type of event
+    pub fn r#type(&self) -> DocExportProgressType {
+        match self {
+            DocExportProgress::Found(_) => DocExportProgressType::Found,
+            DocExportProgress::Progress(_) => DocExportProgressType::Progress,
+            DocExportProgress::Done(_) => DocExportProgressType::Done,
+            DocExportProgress::AllDone => DocExportProgressType::AllDone,
+            DocExportProgress::Abort(_) => DocExportProgressType::Abort,
+        }
+    }
+    /// Returns true if this is the `AllDone` event, signaling a successful end of the stream.
+    pub fn is_all_done(&self) -> bool {
+        matches!(self, DocExportProgress::AllDone)
+    }
+
+    /// Returns true if this is the `Abort` event, signaling the operation failed.
+    pub fn is_abort(&self) -> bool {
+        matches!(self, DocExportProgress::Abort(_))
+    }
+
+    /// Return the `DocExportProgressFound` event
+    pub fn as_found(&self) -> DocExportProgressFound {
+        match self {
+            DocExportProgress::Found(f) => f.clone(),
+            _ => panic!("DocExportProgress type is not 'Found'"),
+        }
+    }
+    /// Return the `DocExportProgressProgress` event
+    pub fn as_progress(&self) -> DocExportProgressProgress {
+        match self {
+            DocExportProgress::Progress(p) => p.clone(),
+            _ => panic!("DocExportProgress type is not 'Progress'"),
+        }
+    }
+    /// Return the `DocExportProgressAbort`
+    pub fn as_abort(&self) -> DocExportProgressAbort {
+        match self {
+            DocExportProgress::Abort(a) => a.clone(),
+            _ => panic!("DocExportProgress type is not 'Abort'"),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_node, local_options, persistent_node, temp_docs_node};
+    use crate::{setup_logging, PublicKey};
+    use rand::RngCore;
+    use tokio::{io::AsyncWriteExt, sync::mpsc};
+
+    #[tokio::test]
+    async fn test_doc_create() {
+        let path = tempfile::tempdir().unwrap();
+        let options = crate::NodeOptions {
+            enable_docs: true,
+            ..Default::default()
+        };
+        let node = Iroh::persistent_with_options(
+            path.path()
+                .join("doc-create")
+                .to_string_lossy()
+                .into_owned(),
+            options,
+        )
+        .await
+        .unwrap();
+        let node_id = node.net().node_id().await.unwrap();
+        println!("id: {}", node_id);
+        let doc = node.docs().create().await.unwrap();
+        let doc_id = doc.id();
+        println!("doc_id: {}", doc_id);
+
+        let doc_ticket = doc
+            .share(crate::doc::ShareMode::Write, AddrInfoOptions::Id)
+            .await
+            .unwrap();
+        println!("doc_ticket: {}", doc_ticket);
+        node.docs().join(&doc_ticket).await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_docs_list_open() {
+        let node = local_node().await;
+        let handles = |open: &[OpenDoc], id: &str| {
+            open.iter()
+                .find(|doc| doc.namespace == id)
+                .map_or(0, |doc| doc.state.handles)
+        };
+        let doc = node.docs().create().await.unwrap();
+        let doc_id = doc.id();
+        let open = node.docs().list_open().await.unwrap();
+        let first = handles(&open, &doc_id);
+        assert!(first >= 1);
+
+        let again = node.docs().open(doc_id.clone()).await.unwrap().unwrap();
+        let open = node.docs().list_open().await.unwrap();
+        assert_eq!(handles(&open, &doc_id), first + 1);
+
+        again.close_me().await.unwrap();
+        doc.close_me().await.unwrap();
+        let open = node.docs().list_open().await.unwrap();
+        assert_eq!(handles(&open, &doc_id), first - 1);
+    }
+
+    #[tokio::test]
+    async fn test_doc_open_after_restart() {
+        let dir = tempfile::tempdir().unwrap();
+        let node = persistent_node(dir.path(), local_options()).await;
+        let author = node.authors().create().await.unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let doc_id = doc.id();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        drop(doc);
+        node.shutdown().await.unwrap();
+        drop(node);
+
+        let node = persistent_node(dir.path(), local_options()).await;
+        let doc = node.docs().open(doc_id.clone()).await.unwrap().unwrap();
+        assert_eq!(doc.id(), doc_id);
+        let entry = doc
+            .get_exact(author, b"key".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = node
+            .blobs()
+            .read_to_bytes(entry.content_hash())
+            .await
+            .unwrap();
+        assert_eq!(content, b"value");
+
+        let unknown = iroh_docs::NamespaceSecret::new(&mut rand::thread_rng()).id();
+        assert!(node
+            .docs()
+            .open(unknown.to_string())
+            .await
+            .unwrap()
+            .is_none());
+        assert!(node.docs().open("not an id".to_string()).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_basic_sync() {
+        setup_logging();
+
+        // create node_0
+        let iroh_dir = tempfile::tempdir().unwrap();
+        let options = crate::NodeOptions {
+            enable_docs: true,
+            ..Default::default()
+        };
+        let node_0 = Iroh::persistent_with_options(
+            iroh_dir
+                .path()
+                .join("basic-sync-0")
+                .to_string_lossy()
+                .into_owned(),
+            options,
+        )
+        .await
+        .unwrap();
+
+        tracing::warn!("first node started");
+
+        // create node_1
+        let options = crate::NodeOptions {
+            enable_docs: true,
+            ..Default::default()
+        };
+
+        let node_1 = Iroh::persistent_with_options(
+            iroh_dir
+                .path()
+                .join("basic-sync-1")
+                .to_string_lossy()
+                .into_owned(),
+            options,
+        )
+        .await
+        .unwrap();
+
+        tracing::warn!("second ndoe  started");
+
+        // create doc on node_0
+        let doc_0 = node_0.docs().create().await.unwrap();
+        tracing::warn!("doc created");
+        let ticket = doc_0
+            .share(ShareMode::Write, AddrInfoOptions::RelayAndAddresses)
+            .await
+            .unwrap();
+
+        tracing::warn!("ticket created");
+
+        // subscribe to sync events
+        let (found_s, mut found_r) = mpsc::channel(8);
+        struct Callback {
+            found_s: mpsc::Sender<Arc<LiveEvent>>,
+        }
+        #[async_trait::async_trait]
+        impl SubscribeCallback for Callback {
+            async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+                println!("event {:?}", event);
+                self.found_s.send(event).await.unwrap();
+                Ok(())
+            }
+        }
+        let cb_0 = Callback { found_s };
+        doc_0.subscribe(Arc::new(cb_0)).await.unwrap();
+
+        // join the same doc from node_1
+        let (found_s_1, mut found_r_1) = mpsc::channel(8);
+        let cb_1 = Callback { found_s: found_s_1 };
+        let doc_1 = node_1
+            .docs()
+            .join_and_subscribe(&ticket, Arc::new(cb_1))
+            .await
+            .unwrap();
+
+        tracing::warn!("joined");
+
+        // wait for initial sync to be one
+        while let Some(event) = found_r_1.recv().await {
+            if let LiveEvent::SyncFinished(_) = *event {
+                break;
+            }
+        }
+
+        // create author on node_1
+        let author = node_1.authors().create().await.unwrap();
+        doc_1
+            .set_bytes(&author, b"hello".to_vec(), b"world".to_vec())
+            .await
+            .unwrap();
+        while let Some(event) = found_r.recv().await {
+            if let LiveEvent::ContentReady { ref hash } = *event {
+                let val = node_1
+                    .blobs()
+                    .read_to_bytes(hash.clone().into())
+                    .await
+                    .unwrap();
+                assert_eq!(b"world".to_vec(), val);
+                break;
+            }
+        }
+    }
+
+    #[test]
+    fn test_node_addr() {
+        //
+        // create a node_id
+        let key_str = "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254";
+        let node_id = PublicKey::from_string(key_str.into()).unwrap();
+        //
+        // create socketaddrs
+        let port = 3000;
+        let ipv4 = format!("127.0.0.1:{port}");
+        let ipv6 = format!("::1:{port}");
+        //
+        // derp region
+        let derp_url = String::from("https://derp.url");
+        //
+        // create a NodeAddr
+        let addrs = vec![ipv4, ipv6];
+        let expect_addrs = addrs.clone();
+        let node_addr = NodeAddr::new(&node_id, Some(derp_url.clone()), addrs);
+        //
+        // test we have returned the expected addresses
+        let got_addrs = node_addr.direct_addresses();
+        let addrs = expect_addrs.iter().zip(got_addrs.iter());
+        for (expect, got) in addrs {
+            assert_eq!(got, expect);
+        }
+
+        let got_derp_url = node_addr.relay_url().unwrap();
+        assert_eq!(derp_url, got_derp_url);
+
+        let from_params = NodeAddr::from_params(NodeAddrParams {
+            node_id: Arc::new(node_id),
+            relay_url: Some(derp_url),
+            direct_addresses: expect_addrs,
+        });
+        assert!(from_params.equal(&node_addr));
+    }
+    #[test]
+    fn test_author_id() {
+        //
+        // create id from string
+        let author_str = "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254";
+        let author = AuthorId::from_string(author_str.into()).unwrap();
+        //
+        // call to_string, ensure equal
+        assert_eq!(author_str, author.to_string());
+        //
+        // create another id, same string
+        let author_0 = AuthorId::from_string(author_str.into()).unwrap();
+        //
+        assert!(author.equal(&author_0));
+        assert!(author_0.equal(&author));
+    }
+
+    #[test]
+    fn test_query() {
+        let opts = QueryOptions {
+            offset: 10,
+            limit: 10,
+            ..QueryOptions::default()
+        };
+        // all
+        let all = Query::all(Some(opts));
+        assert_eq!(10, all.offset());
+        assert_eq!(Some(10), all.limit());
+
+        let opts = QueryOptions {
+            direction: SortDirection::Desc,
+            ..QueryOptions::default()
+        };
+        let single_latest_per_key = Query::single_latest_per_key(Some(opts));
+        assert_eq!(0, single_latest_per_key.offset());
+        assert_eq!(None, single_latest_per_key.limit());
+
+        let opts = QueryOptions {
+            offset: 100,
+            ..QueryOptions::default()
+        };
+        let author = Query::author(
+            &AuthorId::from_string(
+                "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254".to_string(),
+            )
+            .unwrap(),
+            Some(opts),
+        );
+        assert_eq!(100, author.offset());
+        assert_eq!(None, author.limit());
+
+        let opts = QueryOptions {
+            limit: 100,
+            ..QueryOptions::default()
+        };
+        let key_exact = Query::key_exact(b"key".to_vec(), Some(opts));
+        assert_eq!(0, key_exact.offset());
+        assert_eq!(Some(100), key_exact.limit());
+
+        let opts = QueryOptions {
+            sort_by: SortBy::KeyAuthor,
+            direction: SortDirection::Desc,
+            offset: 0,
+            limit: 100,
+        };
+        let key_prefix = Query::key_prefix(b"prefix".to_vec(), Some(opts));
+        assert_eq!(0, key_prefix.offset());
+        assert_eq!(Some(100), key_prefix.limit());
+
+        let author = AuthorId::from_string(
+            "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254".to_string(),
+        )
+        .unwrap();
+        let params = QueryParams {
+            author: Some(Arc::new(author)),
+            key_prefix: Some(b"prefix".to_vec()),
+            options: Some(QueryOptions {
+                offset: 5,
+                limit: 20,
+                ..QueryOptions::default()
+            }),
+            ..QueryParams::default()
+        };
+        let query = Query::from_params(params.clone()).unwrap();
+        assert_eq!(5, query.offset());
+        assert_eq!(Some(20), query.limit());
+        assert!(Query::from_params(QueryParams {
+            key_exact: Some(b"key".to_vec()),
+            ..params.clone()
+        })
+        .is_err());
+        assert!(Query::from_params(QueryParams {
+            latest_per_key: true,
+            ..params
+        })
+        .is_err());
+        let latest = Query::from_params(QueryParams {
+            latest_per_key: true,
+            ..QueryParams::default()
+        })
+        .unwrap();
+        assert_eq!(None, latest.limit());
+    }
+
+    #[tokio::test]
+    async fn test_doc_entry_basics() {
+        let path = tempfile::tempdir().unwrap();
+        let options = crate::NodeOptions {
+            enable_docs: true,
             ..Default::default()
         };
-        let node = Iroh::persistent_with_options(
+        let node = crate::Iroh::persistent_with_options(
             path.path()
-                .join("doc-create")
+                .join("doc-entry-basics")
                 .to_string_lossy()
                 .into_owned(),
             options,
         )
         .await
         .unwrap();
-        let node_id = node.net().node_id().await.unwrap();
-        println!("id: {}", node_id);
+
+        // create doc  and author
         let doc = node.docs().create().await.unwrap();
-        let doc_id = doc.id();
-        println!("doc_id: {}", doc_id);
+        let author = node.authors().create().await.unwrap();
+
+        // add entry
+        let val = b"hello world!".to_vec();
+        let key = b"foo".to_vec();
+        let hash = doc
+            .set_bytes(&author, key.clone(), val.clone())
+            .await
+            .unwrap();
+
+        // get entry
+        let query = Query::author_key_exact(&author, key.clone());
+        let entry = doc.get_one(query.into()).await.unwrap().unwrap();
+
+        assert!(hash.equal(&entry.content_hash()));
+
+        let got_val = node
+            .blobs()
+            .read_to_bytes(entry.content_hash())
+            .await
+            .unwrap();
+        assert_eq!(val, got_val);
+        assert_eq!(val.len() as u64, entry.content_len());
+    }
+
+    #[tokio::test]
+    async fn test_entry_order() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let alice = node.authors().create().await.unwrap();
+        let bob = node.authors().create().await.unwrap();
+        let get = |author: &Arc<AuthorId>, key: &[u8]| {
+            let doc = doc.clone();
+            let author = author.clone();
+            let key = key.to_vec();
+            async move { doc.get_exact(author, key, false).await.unwrap().unwrap() }
+        };
+
+        doc.set_bytes(&alice, b"k".to_vec(), b"first".to_vec())
+            .await
+            .unwrap();
+        let first = get(&alice, b"k").await;
+        doc.set_bytes(&alice, b"k".to_vec(), b"second".to_vec())
+            .await
+            .unwrap();
+        let second = get(&alice, b"k").await;
+        assert!(second.written_at() >= first.written_at());
+        assert_eq!(
+            second.written_at(),
+            SystemTime::UNIX_EPOCH + Duration::from_micros(second.timestamp())
+        );
+        assert_eq!(second.order(&first), EntryOrder::Supersedes);
+        assert_eq!(first.order(&second), EntryOrder::SupersededBy);
+        assert_eq!(first.order(&first), EntryOrder::Equal);
+
+        doc.set_bytes(&bob, b"k".to_vec(), b"bob".to_vec())
+            .await
+            .unwrap();
+        let concurrent = get(&bob, b"k").await;
+        assert_eq!(concurrent.order(&second), EntryOrder::Concurrent);
+
+        doc.set_bytes(&alice, b"other".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        let other = get(&alice, b"other").await;
+        assert_eq!(other.order(&second), EntryOrder::Unrelated);
+    }
+
+    #[test]
+    fn test_child_prefix() {
+        assert_eq!(child_prefix(b"a/b/c", b"", b'/'), Some(&b"a/"[..]));
+        assert_eq!(child_prefix(b"a/b/c", b"a/", b'/'), Some(&b"a/b/"[..]));
+        assert_eq!(child_prefix(b"a/b/c", b"a/b/", b'/'), None);
+        assert_eq!(child_prefix(b"a/b", b"c/", b'/'), None);
+        assert_eq!(child_prefix(b"a//b", b"a/", b'/'), Some(&b"a//"[..]));
+    }
+
+    #[tokio::test]
+    async fn test_doc_copy_move_entry() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let hash = doc
+            .set_bytes(&author, b"a".to_vec(), b"content".to_vec())
+            .await
+            .unwrap();
+
+        let copied = doc
+            .copy_entry(&author, b"a".to_vec(), b"b".to_vec())
+            .await
+            .unwrap();
+        assert_eq!(copied, hash);
+        let entry = doc
+            .get_exact(author.clone(), b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.content_hash(), hash);
+
+        doc.move_entry(&author, b"b".to_vec(), b"c".to_vec())
+            .await
+            .unwrap();
+        assert!(doc
+            .get_exact(author.clone(), b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .is_none());
+        assert!(doc
+            .get_exact(author.clone(), b"c".to_vec(), false)
+            .await
+            .unwrap()
+            .is_some());
+
+        // moving "a" would delete "ab" as well
+        doc.set_bytes(&author, b"ab".to_vec(), b"other".to_vec())
+            .await
+            .unwrap();
+        assert!(doc
+            .move_entry(&author, b"a".to_vec(), b"d".to_vec())
+            .await
+            .is_err());
+        assert!(doc
+            .copy_entry(&author, b"missing".to_vec(), b"d".to_vec())
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_doc_replica_state() {
+        let dir = tempfile::tempdir().unwrap();
+        let node_0 = persistent_node(&dir.path().join("replica-0"), local_options()).await;
+        let node_1 = persistent_node(&dir.path().join("replica-1"), local_options()).await;
+
+        let doc_0 = node_0.docs().create().await.unwrap();
+        let author = node_0.authors().create().await.unwrap();
+        doc_0
+            .set_bytes(&author, b"a".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+        doc_0
+            .set_bytes(&author, b"b".to_vec(), b"2".to_vec())
+            .await
+            .unwrap();
+        let state = doc_0.export_replica_state().await.unwrap();
+
+        // a document on a different node, without syncing it
+        let ticket = doc_0
+            .share(ShareMode::Write, AddrInfoOptions::Id)
+            .await
+            .unwrap();
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        let doc_1 = node_1
+            .docs()
+            .client
+            .import_namespace(ticket.capability)
+            .await
+            .unwrap();
+        let doc_1 = node_1.docs().doc(doc_1);
+        assert_eq!(doc_1.import_replica_state(state.clone()).await.unwrap(), 2);
+        let entry = doc_1
+            .get_exact(author.clone(), b"a".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.content_len(), 1);
+
+        // importing again changes nothing
+        assert_eq!(doc_1.import_replica_state(state.clone()).await.unwrap(), 0);
+
+        // state of another document is rejected
+        let other = node_1.docs().create().await.unwrap();
+        assert!(other.import_replica_state(state).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_doc_get_many_with_status() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"local".to_vec(), b"content".to_vec())
+            .await
+            .unwrap();
+        // content we never stored
+        let missing = Hash::new(b"somewhere else".to_vec());
+        doc.set_hash(author.clone(), b"remote".to_vec(), Arc::new(missing), 14)
+            .await
+            .unwrap();
+
+        let entries = doc
+            .get_many_with_status(Arc::new(Query::all(None)))
+            .await
+            .unwrap();
+        let statuses: HashMap<_, _> = entries
+            .iter()
+            .map(|e| (e.entry.key(), e.content_status))
+            .collect();
+        assert_eq!(statuses[&b"local".to_vec()], ContentStatus::Complete);
+        assert_eq!(statuses[&b"remote".to_vec()], ContentStatus::Missing);
+    }
+
+    #[tokio::test]
+    async fn test_doc_get_many_contents() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        for (key, value) in [("a", "one"), ("b", "two"), ("c", "three")] {
+            doc.set_bytes(&author, key.into(), value.into())
+                .await
+                .unwrap();
+        }
+        let missing = Hash::new(b"somewhere else".to_vec());
+        doc.set_hash(author.clone(), b"d".to_vec(), Arc::new(missing), 14)
+            .await
+            .unwrap();
+
+        let query = |offset| {
+            Arc::new(Query::key_prefix(
+                vec![],
+                Some(QueryOptions {
+                    sort_by: SortBy::KeyAuthor,
+                    direction: SortDirection::Asc,
+                    offset,
+                    limit: 0,
+                }),
+            ))
+        };
+        let contents = doc.get_many_contents(query(0), 1024).await.unwrap();
+        assert!(!contents.truncated);
+        assert_eq!(contents.data, b"onetwothree");
+        let values: Vec<_> = contents
+            .entries
+            .iter()
+            .map(|slice| {
+                let range = slice.offset as usize..(slice.offset + slice.len) as usize;
+                (slice.available, &contents.data[range])
+            })
+            .collect();
+        assert_eq!(
+            values,
+            vec![
+                (true, &b"one"[..]),
+                (true, b"two"),
+                (true, b"three"),
+                (false, b""),
+            ]
+        );
+
+        // stops before the content that does not fit
+        let contents = doc.get_many_contents(query(0), 7).await.unwrap();
+        assert!(contents.truncated);
+        assert_eq!(contents.entries.len(), 2);
+        assert_eq!(contents.data, b"onetwo");
+        // content larger than the limit on its own is left out
+        let contents = doc.get_many_contents(query(2), 4).await.unwrap();
+        assert!(!contents.truncated);
+        assert_eq!(contents.entries.len(), 2);
+        assert!(!contents.entries[0].available);
+        assert!(contents.data.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_doc_snapshot_changes() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author_0 = node.authors().create().await.unwrap();
+        let author_1 = node.authors().create().await.unwrap();
+        doc.set_bytes(&author_0, b"a".to_vec(), b"old".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author_1, b"a".to_vec(), b"new".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author_0, b"b".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+
+        let snapshot = doc.snapshot().await.unwrap();
+        let keys: Vec<_> = snapshot.entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"a".to_vec(), b"b".to_vec()]);
+        assert_eq!(snapshot.entries[0].author(), author_1);
+        assert!(snapshot.cursor > DocCursor::default());
+
+        let changes = doc.changes_since(snapshot.cursor.clone()).await.unwrap();
+        assert!(changes.entries.is_empty());
+        assert_eq!(changes.cursor, snapshot.cursor);
+
+        doc.set_bytes(&author_0, b"c".to_vec(), b"2".to_vec())
+            .await
+            .unwrap();
+        doc.delete(author_0.clone(), b"b".to_vec()).await.unwrap();
+        let changes = doc.changes_since(snapshot.cursor.clone()).await.unwrap();
+        let keys: Vec<_> = changes.entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"c".to_vec(), b"b".to_vec()]);
+        assert_eq!(changes.entries[1].content_len(), 0);
+        assert!(changes.cursor > snapshot.cursor);
+
+        // deleted keys are not part of the snapshot
+        let snapshot = doc.snapshot().await.unwrap();
+        let keys: Vec<_> = snapshot.entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"a".to_vec(), b"c".to_vec()]);
+    }
+
+    #[tokio::test]
+    async fn test_doc_change_index() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"a".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+        assert!(doc.state.change_index().is_none());
+        let changes = doc.changes_since(DocCursor::default()).await.unwrap();
+        assert_eq!(changes.entries.len(), 1);
+        assert!(doc.state.change_index().is_some());
+
+        // replaced entries and entries below a deleted prefix are not returned
+        doc.set_bytes(&author, b"a".to_vec(), b"2".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author, b"d/x".to_vec(), b"3".to_vec())
+            .await
+            .unwrap();
+        doc.delete(author.clone(), b"d/".to_vec()).await.unwrap();
+        let changes = doc.changes_since(changes.cursor).await.unwrap();
+        let keys: Vec<_> = changes.entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"a".to_vec(), b"d/".to_vec()]);
+        let index = doc.change_index().await.unwrap();
+        assert!(index.lock().unwrap().after(&changes.cursor).is_empty());
+
+        // entries inserted through sync are added from the events
+        let other = local_node().await;
+        let ticket = doc
+            .share(ShareMode::Write, AddrInfoOptions::Id)
+            .await
+            .unwrap();
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        let other_doc = other
+            .docs()
+            .client
+            .import_namespace(ticket.capability)
+            .await
+            .unwrap();
+        let other_doc = other.docs().doc(other_doc);
+        let other_author = other.authors().create().await.unwrap();
+        other_doc
+            .set_bytes(&other_author, b"remote".to_vec(), b"4".to_vec())
+            .await
+            .unwrap();
+        let state = other_doc.export_replica_state().await.unwrap();
+        doc.import_replica_state(state).await.unwrap();
+        let changes = tokio::time::timeout(Duration::from_secs(5), async {
+            loop {
+                let next = doc.changes_since(changes.cursor.clone()).await.unwrap();
+                if !next.entries.is_empty() {
+                    break next;
+                }
+                tokio::time::sleep(Duration::from_millis(10)).await;
+            }
+        })
+        .await
+        .unwrap();
+        let keys: Vec<_> = changes.entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"remote".to_vec()]);
+    }
+
+    #[tokio::test]
+    async fn test_doc_indexer() {
+        let (_dir, node) = temp_docs_node().await;
+
+        struct Collector {
+            fail_once: std::sync::atomic::AtomicBool,
+            sender: tokio::sync::mpsc::Sender<IndexedEntry>,
+        }
+
+        #[async_trait::async_trait]
+        impl DocIndexCallback for Collector {
+            async fn index(&self, entry: IndexedEntry) -> Result<(), CallbackError> {
+                if self.fail_once.swap(false, Ordering::SeqCst) {
+                    return Err(CallbackError::Error);
+                }
+                self.sender.send(entry).await.unwrap();
+                Ok(())
+            }
+        }
+
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"small".to_vec(), b"hi".to_vec())
+            .await
+            .unwrap();
+
+        let (sender, mut receiver) = tokio::sync::mpsc::channel(16);
+        let cb = Collector {
+            fail_once: true.into(),
+            sender,
+        };
+        let indexer = doc
+            .start_indexer(DocCursor::default(), 4, Arc::new(cb))
+            .await
+            .unwrap();
+
+        // the first delivery fails and is retried
+        let entry = receiver.recv().await.unwrap();
+        assert_eq!(entry.key, b"small".to_vec());
+        assert_eq!(entry.content, Some(b"hi".to_vec()));
+
+        // an entry written on another node before the next local one
+        let other = local_node().await;
+        let ticket = doc
+            .share(ShareMode::Write, AddrInfoOptions::Id)
+            .await
+            .unwrap();
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        let other_doc = other
+            .docs()
+            .client
+            .import_namespace(ticket.capability)
+            .await
+            .unwrap();
+        let other_doc = other.docs().doc(other_doc);
+        let other_author = other.authors().create().await.unwrap();
+        other_doc
+            .set_bytes(&other_author, b"late".to_vec(), b"old".to_vec())
+            .await
+            .unwrap();
+
+        doc.set_bytes(&author, b"large".to_vec(), b"too large".to_vec())
+            .await
+            .unwrap();
+        let entry = receiver.recv().await.unwrap();
+        assert_eq!(entry.key, b"large".to_vec());
+        assert_eq!(entry.content, None);
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert_eq!(indexer.cursor(), entry.cursor);
+
+        // it is delivered when it arrives, although the cursor is past it
+        let state = other_doc.export_replica_state().await.unwrap();
+        doc.import_replica_state(state).await.unwrap();
+        let late = receiver.recv().await.unwrap();
+        assert_eq!(late.key, b"late".to_vec());
+        assert!(late.entry.timestamp() < entry.entry.timestamp());
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert_eq!(indexer.cursor(), entry.cursor);
+        indexer.stop();
+
+        // resuming from the cursor skips everything already indexed
+        let changes = doc.changes_since(indexer.cursor()).await.unwrap();
+        assert!(changes.entries.is_empty());
+
+        // compressed content is passed decompressed, without its sidecar
+        let text = "lorem ipsum dolor sit amet ".repeat(200).into_bytes();
+        let options = crate::SetBytesOptions {
+            compress: true,
+            meta: None,
+        };
+        doc.set_bytes_with_options(&author, b"text".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        let (sender, mut receiver) = tokio::sync::mpsc::channel(16);
+        let cb = Collector {
+            fail_once: false.into(),
+            sender,
+        };
+        let _indexer = doc
+            .start_indexer(indexer.cursor(), text.len() as u64, Arc::new(cb))
+            .await
+            .unwrap();
+        let entry = receiver.recv().await.unwrap();
+        assert_eq!(entry.key, b"text".to_vec());
+        assert_eq!(entry.content, Some(text));
+        assert!(
+            tokio::time::timeout(Duration::from_millis(100), receiver.recv())
+                .await
+                .is_err()
+        );
+    }
+
+    #[tokio::test]
+    async fn test_read_only_doc() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+
+        let read_only = node.docs().open_read_only(doc.id()).await.unwrap().unwrap();
+        assert_eq!(read_only.id(), doc.id());
+        let entry = read_only
+            .get_one(Query::key_exact(b"key".to_vec(), None).into())
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.author(), author);
+
+        let ticket = read_only.share(AddrInfoOptions::Relay).await.unwrap();
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        assert!(matches!(ticket.capability, iroh_docs::Capability::Read(_)));
+    }
+
+    #[tokio::test]
+    async fn test_doc_entries_by_author_since() {
+        let (_dir, node) = temp_docs_node().await;
+
+        let doc = node.docs().create().await.unwrap();
+        let author_0 = node.authors().create().await.unwrap();
+        let author_1 = node.authors().create().await.unwrap();
+        doc.set_bytes(&author_0, b"a".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+        let first = doc
+            .entries_by_author_since(author_0.clone(), 0)
+            .await
+            .unwrap();
+        assert_eq!(first.len(), 1);
+
+        doc.set_bytes(&author_1, b"b".to_vec(), b"2".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author_0, b"c".to_vec(), b"3".to_vec())
+            .await
+            .unwrap();
+        doc.delete(author_0.clone(), b"a".to_vec()).await.unwrap();
+
+        let entries = doc
+            .entries_by_author_since(author_0.clone(), first[0].timestamp())
+            .await
+            .unwrap();
+        let keys: Vec<_> = entries.iter().map(|e| e.key()).collect();
+        assert_eq!(keys, [b"c".to_vec(), b"a".to_vec()]);
+        assert_eq!(entries[1].content_len(), 0);
+        assert!(entries.iter().all(|e| e.author() == author_0));
+    }
+
+    #[tokio::test]
+    async fn test_doc_metrics() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+
+        let metrics = doc.metrics().await.unwrap();
+        assert_eq!(metrics.entries_applied, 0);
+        assert_eq!(metrics.sync_rounds, 0);
+
+        // local inserts are not sync activity
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        let again = doc.read_only().metrics().await.unwrap();
+        assert_eq!(again.entries_applied, 0);
+        assert_eq!(again.tracking_since, metrics.tracking_since);
+    }
+
+    #[tokio::test]
+    async fn test_doc_closed() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let read_only = doc.read_only();
+        let batch = doc.begin_write_batch();
+        batch
+            .set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .unwrap();
+        assert!(!doc.is_closed());
+        doc.close_me().await.unwrap();
+        assert!(doc.is_closed() && read_only.is_closed());
+        // closing again is fine
+        doc.close_me().await.unwrap();
+        read_only.close_me().await.unwrap();
+
+        let err = doc
+            .set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap_err();
+        assert_eq!(err.kind(), crate::IrohErrorKind::ObjectClosed);
+        let err = read_only.status().await.unwrap_err();
+        assert_eq!(err.kind(), crate::IrohErrorKind::ObjectClosed);
+        let err = batch.commit().await.unwrap_err();
+        assert_eq!(err.kind(), crate::IrohErrorKind::ObjectClosed);
+
+        // other handles to the same document stay usable
+        let doc = node.docs().open(doc.id()).await.unwrap().unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+    }
 
-        let doc_ticket = doc
-            .share(crate::doc::ShareMode::Write, AddrInfoOptions::Id)
+    #[tokio::test]
+    async fn test_doc_invite() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+
+        let doc = node_0.docs().create().await.unwrap();
+        let share_options = ShareOptions {
+            expires_at: None,
+            max_uses: Some(1),
+        };
+        let invite = doc
+            .share_with_options(ShareMode::Read, AddrInfoOptions::Addresses, share_options)
             .await
             .unwrap();
-        println!("doc_ticket: {}", doc_ticket);
-        node.docs().join(&doc_ticket).await.unwrap();
+        let invite = DocInvite::new(invite.to_string()).unwrap();
+        assert_eq!(invite.doc_id(), doc.id());
+
+        let joined = node_1.docs().redeem_invite(&invite).await.unwrap();
+        assert_eq!(joined.id(), doc.id());
+        // the invitation is used up
+        assert!(node_1.docs().redeem_invite(&invite).await.is_err());
     }
 
     #[tokio::test]
-    async fn test_basic_sync() {
-        setup_logging();
+    async fn test_stop_sync() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let peer = PublicKey::from(iroh::SecretKey::from_bytes(&rand::random()).public());
 
-        // create node_0
-        let iroh_dir = tempfile::tempdir().unwrap();
-        let options = crate::NodeOptions {
-            enable_docs: true,
-            ..Default::default()
-        };
-        let node_0 = Iroh::persistent_with_options(
-            iroh_dir
-                .path()
-                .join("basic-sync-0")
-                .to_string_lossy()
-                .into_owned(),
-            options,
-        )
-        .await
-        .unwrap();
+        doc.start_sync(vec![]).await.unwrap();
+        assert!(doc.status().await.unwrap().sync);
+        doc.stop_sync(&peer).await.unwrap();
+        assert!(doc.status().await.unwrap().sync);
 
-        tracing::warn!("first node started");
+        doc.stop_all_sync().await.unwrap();
+        assert!(!doc.status().await.unwrap().sync);
+        // still usable locally
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        // stopping a peer does not resume the sync
+        doc.stop_sync(&peer).await.unwrap();
+        assert!(!doc.status().await.unwrap().sync);
+    }
 
-        // create node_1
-        let options = crate::NodeOptions {
-            enable_docs: true,
-            ..Default::default()
-        };
+    #[tokio::test]
+    async fn test_doc_prefix_stats() {
+        let (_dir, node) = temp_docs_node().await;
 
-        let node_1 = Iroh::persistent_with_options(
-            iroh_dir
-                .path()
-                .join("basic-sync-1")
-                .to_string_lossy()
-                .into_owned(),
-            options,
-        )
-        .await
-        .unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        for (key, value) in [
+            (&b"dir/a"[..], &b"12345"[..]),
+            (b"dir/b", b"123"),
+            (b"dir/sub/c", b"1"),
+            (b"other", b"123456789"),
+        ] {
+            doc.set_bytes(&author, key.to_vec(), value.to_vec())
+                .await
+                .unwrap();
+        }
+        // overwriting counts the latest value only
+        doc.set_bytes(&author, b"dir/b".to_vec(), b"12".to_vec())
+            .await
+            .unwrap();
 
-        tracing::warn!("second ndoe  started");
+        let stats = doc.prefix_stats(b"dir/".to_vec()).await.unwrap();
+        assert_eq!(
+            stats,
+            PrefixStats {
+                entries: 3,
+                total_size: 8
+            }
+        );
 
-        // create doc on node_0
-        let doc_0 = node_0.docs().create().await.unwrap();
-        tracing::warn!("doc created");
-        let ticket = doc_0
-            .share(ShareMode::Write, AddrInfoOptions::RelayAndAddresses)
+        doc.delete(author.clone(), b"dir/sub/".to_vec())
             .await
             .unwrap();
+        let stats = doc.prefix_stats(b"dir/".to_vec()).await.unwrap();
+        assert_eq!(stats.entries, 2);
+        assert_eq!(stats.total_size, 7);
+    }
 
-        tracing::warn!("ticket created");
+    #[tokio::test]
+    async fn test_doc_write_batch() {
+        let (_dir, node) = temp_docs_node().await;
 
-        // subscribe to sync events
-        let (found_s, mut found_r) = mpsc::channel(8);
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+
+        let (events_s, mut events_r) = mpsc::channel(8);
         struct Callback {
-            found_s: mpsc::Sender<Arc<LiveEvent>>,
+            events_s: mpsc::Sender<Arc<LiveEvent>>,
         }
         #[async_trait::async_trait]
         impl SubscribeCallback for Callback {
             async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
-                println!("event {:?}", event);
-                self.found_s.send(event).await.unwrap();
+                self.events_s.send(event).await.unwrap();
                 Ok(())
             }
         }
-        let cb_0 = Callback { found_s };
-        doc_0.subscribe(Arc::new(cb_0)).await.unwrap();
-
-        // join the same doc from node_1
-        let (found_s_1, mut found_r_1) = mpsc::channel(8);
-        let cb_1 = Callback { found_s: found_s_1 };
-        let doc_1 = node_1
-            .docs()
-            .join_and_subscribe(&ticket, Arc::new(cb_1))
+        doc.subscribe(Arc::new(Callback { events_s }))
             .await
             .unwrap();
 
-        tracing::warn!("joined");
-
-        // wait for initial sync to be one
-        while let Some(event) = found_r_1.recv().await {
-            if let LiveEvent::SyncFinished(_) = *event {
-                break;
-            }
-        }
-
-        // create author on node_1
-        let author = node_1.authors().create().await.unwrap();
-        doc_1
-            .set_bytes(&author, b"hello".to_vec(), b"world".to_vec())
-            .await
+        let batch = doc.begin_write_batch();
+        batch
+            .set_bytes(&author, b"a".to_vec(), b"1".to_vec())
             .unwrap();
-        while let Some(event) = found_r.recv().await {
-            if let LiveEvent::ContentReady { ref hash } = *event {
-                let val = node_1
-                    .blobs()
-                    .read_to_bytes(hash.clone().into())
-                    .await
-                    .unwrap();
-                assert_eq!(b"world".to_vec(), val);
-                break;
-            }
-        }
-    }
-
-    #[test]
-    fn test_node_addr() {
-        //
-        // create a node_id
-        let key_str = "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254";
-        let node_id = PublicKey::from_string(key_str.into()).unwrap();
-        //
-        // create socketaddrs
-        let port = 3000;
-        let ipv4 = format!("127.0.0.1:{port}");
-        let ipv6 = format!("::1:{port}");
-        //
-        // derp region
-        let derp_url = String::from("https://derp.url");
-        //
-        // create a NodeAddr
-        let addrs = vec![ipv4, ipv6];
-        let expect_addrs = addrs.clone();
-        let node_addr = NodeAddr::new(&node_id, Some(derp_url.clone()), addrs);
-        //
-        // test we have returned the expected addresses
-        let got_addrs = node_addr.direct_addresses();
-        let addrs = expect_addrs.iter().zip(got_addrs.iter());
-        for (expect, got) in addrs {
-            assert_eq!(got, expect);
-        }
-
-        let got_derp_url = node_addr.relay_url().unwrap();
-        assert_eq!(derp_url, got_derp_url);
-    }
-    #[test]
-    fn test_author_id() {
-        //
-        // create id from string
-        let author_str = "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254";
-        let author = AuthorId::from_string(author_str.into()).unwrap();
-        //
-        // call to_string, ensure equal
-        assert_eq!(author_str, author.to_string());
-        //
-        // create another id, same string
-        let author_0 = AuthorId::from_string(author_str.into()).unwrap();
-        //
-        assert!(author.equal(&author_0));
-        assert!(author_0.equal(&author));
-    }
-
-    #[test]
-    fn test_query() {
-        let opts = QueryOptions {
-            offset: 10,
-            limit: 10,
-            ..QueryOptions::default()
-        };
-        // all
-        let all = Query::all(Some(opts));
-        assert_eq!(10, all.offset());
-        assert_eq!(Some(10), all.limit());
+        batch
+            .set_bytes(&author, b"b".to_vec(), b"2".to_vec())
+            .unwrap();
+        assert_eq!(batch.len(), 2);
 
-        let opts = QueryOptions {
-            direction: SortDirection::Desc,
-            ..QueryOptions::default()
-        };
-        let single_latest_per_key = Query::single_latest_per_key(Some(opts));
-        assert_eq!(0, single_latest_per_key.offset());
-        assert_eq!(None, single_latest_per_key.limit());
+        let entries = batch.commit().await.unwrap();
+        assert_eq!(entries.len(), 2);
+        assert!(batch.commit().await.is_err());
 
-        let opts = QueryOptions {
-            offset: 100,
-            ..QueryOptions::default()
-        };
-        let author = Query::author(
-            &AuthorId::from_string(
-                "7db06b57aac9b3640961d281239c8f23487ac7f7265da21607c5612d3527a254".to_string(),
-            )
-            .unwrap(),
-            Some(opts),
-        );
-        assert_eq!(100, author.offset());
-        assert_eq!(None, author.limit());
+        let event = events_r.recv().await.unwrap();
+        assert_eq!(event.r#type(), LiveEventType::InsertLocalBatch);
+        assert_eq!(event.as_insert_local_batch().unwrap().len(), 2);
 
-        let opts = QueryOptions {
-            limit: 100,
-            ..QueryOptions::default()
-        };
-        let key_exact = Query::key_exact(b"key".to_vec(), Some(opts));
-        assert_eq!(0, key_exact.offset());
-        assert_eq!(Some(100), key_exact.limit());
+        let entry = doc
+            .get_one(Query::author_key_exact(&author, b"b".to_vec()).into())
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.content_len(), 1);
 
-        let opts = QueryOptions {
-            sort_by: SortBy::KeyAuthor,
-            direction: SortDirection::Desc,
-            offset: 0,
-            limit: 100,
-        };
-        let key_prefix = Query::key_prefix(b"prefix".to_vec(), Some(opts));
-        assert_eq!(0, key_prefix.offset());
-        assert_eq!(Some(100), key_prefix.limit());
+        // writes after the batch are delivered one by one again
+        doc.set_bytes(&author, b"a".to_vec(), b"3".to_vec())
+            .await
+            .unwrap();
+        let event = events_r.recv().await.unwrap();
+        assert_eq!(event.r#type(), LiveEventType::InsertLocal);
+
+        // single writes wait for a commit in progress
+        let lock = doc.write_lock().await;
+        let write = tokio::spawn({
+            let doc = doc.clone();
+            let author = author.clone();
+            async move { doc.set_bytes(&author, b"c".to_vec(), b"4".to_vec()).await }
+        });
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert!(!write.is_finished());
+        drop(lock);
+        write.await.unwrap().unwrap();
     }
 
     #[tokio::test]
-    async fn test_doc_entry_basics() {
-        let path = tempfile::tempdir().unwrap();
-        let options = crate::NodeOptions {
-            enable_docs: true,
-            ..Default::default()
-        };
-        let node = crate::Iroh::persistent_with_options(
-            path.path()
-                .join("doc-entry-basics")
-                .to_string_lossy()
-                .into_owned(),
-            options,
-        )
-        .await
-        .unwrap();
-
-        // create doc  and author
-        let doc = node.docs().create().await.unwrap();
-        let author = node.authors().create().await.unwrap();
-
-        // add entry
-        let val = b"hello world!".to_vec();
-        let key = b"foo".to_vec();
-        let hash = doc
-            .set_bytes(&author, key.clone(), val.clone())
+    async fn test_namespace_state() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let doc = node_0.docs().create().await.unwrap();
+        let reopened = node_0.docs().open(doc.id()).await.unwrap().unwrap();
+        assert!(Arc::ptr_eq(&doc.state, &reopened.state));
+
+        // another node with the same document does not share the locks and batches
+        let ticket = doc
+            .share(ShareMode::Write, AddrInfoOptions::Id)
             .await
             .unwrap();
-
-        // get entry
-        let query = Query::author_key_exact(&author, key.clone());
-        let entry = doc.get_one(query.into()).await.unwrap().unwrap();
-
-        assert!(hash.equal(&entry.content_hash()));
-
-        let got_val = node
-            .blobs()
-            .read_to_bytes(entry.content_hash())
+        let ticket: iroh_docs::DocTicket = (*ticket).clone().into();
+        let other = node_1
+            .docs()
+            .client
+            .import_namespace(ticket.capability)
             .await
             .unwrap();
-        assert_eq!(val, got_val);
-        assert_eq!(val.len() as u64, entry.content_len());
+        let other = node_1.docs().doc(other);
+        assert!(!Arc::ptr_eq(&doc.state, &other.state));
+
+        // the state goes away with the last handle
+        let state = Arc::downgrade(&doc.state);
+        drop((doc, reopened));
+        assert!(state.upgrade().is_none());
     }
 
     #[tokio::test]
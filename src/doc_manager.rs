@@ -0,0 +1,349 @@
+use std::{collections::BTreeMap, sync::Arc};
+
+use anyhow::Context;
+use futures::TryStreamExt;
+use serde::{Deserialize, Serialize};
+use tokio::sync::Mutex;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::warn;
+
+use crate::{
+    doc::forward_live_events, BlobsClient, CallbackError, Doc, DocTicket, Docs, DocsClient, Iroh,
+    IrohError, LiveEvent, SubscribeCallback,
+};
+
+/// Prefix of the tags referencing the list of documents managed by a [`DocManager`], followed
+/// by the name of the manager.
+const MANAGED_DOCS_TAG_PREFIX: &str = "iroh-ffi/managed-docs/";
+
+/// Receives the events of all documents of a [`DocManager`].
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait DocManagerCallback: Send + Sync + 'static {
+    async fn event(&self, doc_id: String, event: Arc<LiveEvent>) -> Result<(), CallbackError>;
+}
+
+/// Keeps documents open, subscribed and syncing across restarts of a node.
+///
+/// The documents joined or added through a manager are recorded in the node, in the blob
+/// store, under the name of the manager. Creating a manager of the same name for the node
+/// again, e.g. after a restart, re-opens them, subscribes to them and restarts their sync, so
+/// the callback gets the events of the same documents as before.
+///
+/// Managers of different names keep separate records. Only one manager of a name should exist
+/// on a node at a time, the record is written by whichever changed it last.
+#[derive(uniffi::Object)]
+pub struct DocManager {
+    /// The tag of the record of the managed documents.
+    tag: iroh_blobs::Tag,
+    docs: Docs,
+    docs_client: DocsClient,
+    blobs: BlobsClient,
+    cb: Arc<dyn DocManagerCallback>,
+    managed: Mutex<BTreeMap<String, Managed>>,
+}
+
+#[uniffi::export]
+impl DocManager {
+    /// Create the manager `name` for the documents it recorded in `node`, passing their events
+    /// to `cb`.
+    ///
+    /// Documents that no longer exist are dropped from the record. Fails if the node was
+    /// created without docs.
+    #[uniffi::constructor(async_runtime = "tokio")]
+    pub async fn new(
+        node: Arc<Iroh>,
+        name: String,
+        cb: Arc<dyn DocManagerCallback>,
+    ) -> Result<Self, IrohError> {
+        let docs_client = node
+            .docs_client
+            .clone()
+            .context("docs are not enabled on this node")?;
+        let manager = DocManager {
+            tag: iroh_blobs::Tag::from(format!("{MANAGED_DOCS_TAG_PREFIX}{name}")),
+            docs: node.docs(),
+            docs_client,
+            blobs: node.blobs_client.clone(),
+            cb,
+            managed: Mutex::new(BTreeMap::new()),
+        };
+
+        let stored = manager.load().await?;
+        let mut managed = manager.managed.lock().await;
+        for (id, stored) in stored.docs.iter() {
+            let Some(doc) = manager.docs.open(id.clone()).await? else {
+                warn!("managed document {id} no longer exists");
+                continue;
+            };
+            let entry = manager.start(doc, stored.clone()).await?;
+            managed.insert(id.clone(), entry);
+        }
+        if managed.len() < stored.docs.len() {
+            manager.store(&managed).await?;
+        }
+        drop(managed);
+        Ok(manager)
+    }
+
+    /// Join a document, see `Docs.join`, and manage it.
+    ///
+    /// The nodes of the ticket are recorded, to sync with them again after a restart.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn join(&self, ticket: &DocTicket) -> Result<Arc<Doc>, IrohError> {
+        let ticket: iroh_docs::DocTicket = ticket.clone().into();
+        let namespace = self.docs_client.import_namespace(ticket.capability).await?;
+        let id = namespace.id().to_string();
+        let doc = self
+            .docs
+            .open(id.clone())
+            .await?
+            .context("imported document not found")?;
+        let stored = StoredDoc {
+            sync: true,
+            peers: ticket.nodes,
+        };
+        self.manage_stored(id, doc.clone(), stored).await?;
+        Ok(doc)
+    }
+
+    /// Manage a document that was created or opened before, subscribing to it.
+    ///
+    /// With `sync` its live sync is started, now and after each restart. Does nothing if the
+    /// document is managed already.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn add(&self, doc: Arc<Doc>, sync: bool) -> Result<(), IrohError> {
+        let stored = StoredDoc {
+            sync,
+            peers: Vec::new(),
+        };
+        self.manage_stored(doc.id(), doc, stored).await
+    }
+
+    /// Stop managing the document `doc_id`, returning `false` if it was not managed.
+    ///
+    /// Its subscription ends, so its events are no longer passed to the callback. The document
+    /// itself stays open and keeps syncing until the node is restarted, use `Doc.leave` to stop
+    /// the sync right away.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn forget(&self, doc_id: String) -> Result<bool, IrohError> {
+        let mut managed = self.managed.lock().await;
+        if managed.remove(&doc_id).is_none() {
+            return Ok(false);
+        }
+        self.store(&managed).await?;
+        Ok(true)
+    }
+
+    /// The ids of the managed documents.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn doc_ids(&self) -> Vec<String> {
+        self.managed.lock().await.keys().cloned().collect()
+    }
+
+    /// The managed document `doc_id`, if it is managed.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn doc(&self, doc_id: String) -> Option<Arc<Doc>> {
+        let managed = self.managed.lock().await;
+        managed.get(&doc_id).map(|entry| entry.doc.clone())
+    }
+}
+
+/// A document of a [`DocManager`].
+struct Managed {
+    doc: Arc<Doc>,
+    stored: StoredDoc,
+    /// The subscription passing the events of the document to the callback of the manager,
+    /// ended when the document is forgotten.
+    _subscription: AbortOnDropHandle<()>,
+}
+
+/// How a managed document is restored.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct StoredDoc {
+    /// Whether the live sync is started.
+    sync: bool,
+    /// Nodes to sync with, in addition to the sync peers the document remembers.
+    peers: Vec<iroh::NodeAddr>,
+}
+
+/// The record of the managed documents, by id.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct StoredDocs {
+    docs: BTreeMap<String, StoredDoc>,
+}
+
+impl DocManager {
+    async fn manage_stored(
+        &self,
+        id: String,
+        doc: Arc<Doc>,
+        stored: StoredDoc,
+    ) -> Result<(), IrohError> {
+        let mut managed = self.managed.lock().await;
+        if managed.contains_key(&id) {
+            return Ok(());
+        }
+        let entry = self.start(doc, stored).await?;
+        managed.insert(id, entry);
+        self.store(&managed).await?;
+        Ok(())
+    }
+
+    /// Subscribe to `doc`, then start its sync if `stored` asks for it.
+    async fn start(&self, doc: Arc<Doc>, stored: StoredDoc) -> Result<Managed, IrohError> {
+        let forward = Forward {
+            doc_id: doc.id(),
+            cb: self.cb.clone(),
+        };
+        let batches = doc.state.subscribe_batches();
+        let sub = doc.live_events().await?;
+        let subscription = tokio::task::spawn(forward_live_events(sub, batches, Arc::new(forward)));
+        if stored.sync {
+            let mut peers = stored.peers.clone();
+            let known = doc.inner.get_sync_peers().await?.unwrap_or_default();
+            for node_id in known {
+                let Ok(node_id) = iroh::NodeId::from_bytes(&node_id) else {
+                    continue;
+                };
+                if !peers.iter().any(|addr| addr.node_id == node_id) {
+                    peers.push(iroh::NodeAddr::new(node_id));
+                }
+            }
+            let peers = peers
+                .into_iter()
+                .map(|addr| Arc::new(addr.into()))
+                .collect();
+            doc.start_sync(peers).await?;
+        }
+        Ok(Managed {
+            doc,
+            stored,
+            _subscription: AbortOnDropHandle::new(subscription),
+        })
+    }
+
+    async fn load(&self) -> anyhow::Result<StoredDocs> {
+        let mut tags = self.blobs.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            if tag.name == self.tag {
+                let json = self.blobs.read_to_bytes(tag.hash).await?;
+                return Ok(serde_json::from_slice(&json)?);
+            }
+        }
+        Ok(StoredDocs::default())
+    }
+
+    async fn store(&self, managed: &BTreeMap<String, Managed>) -> anyhow::Result<()> {
+        let stored = StoredDocs {
+            docs: managed
+                .iter()
+                .map(|(id, entry)| (id.clone(), entry.stored.clone()))
+                .collect(),
+        };
+        let json = serde_json::to_vec(&stored)?;
+        // the previous record is no longer tagged and removed by the garbage collection
+        self.blobs.add_bytes_named(json, self.tag.clone()).await?;
+        Ok(())
+    }
+}
+
+/// Passes the events of a managed document to the callback of its manager.
+struct Forward {
+    doc_id: String,
+    cb: Arc<dyn DocManagerCallback>,
+}
+
+#[async_trait::async_trait]
+impl SubscribeCallback for Forward {
+    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+        self.cb.event(self.doc_id.clone(), event).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::{
+        test_utils::{local_options, persistent_node, Collect},
+        LiveEventType,
+    };
+
+    type Events = Collect<(String, Arc<LiveEvent>)>;
+
+    /// The ids of the documents with local inserts in `events`.
+    fn inserted(events: &Events) -> Vec<String> {
+        events
+            .items()
+            .into_iter()
+            .filter(|(_, event)| event.r#type() == LiveEventType::InsertLocal)
+            .map(|(doc_id, _)| doc_id)
+            .collect()
+    }
+
+    async fn wait_insert(events: &Events, doc_id: &str) {
+        for _ in 0..50 {
+            if inserted(events).iter().any(|id| id == doc_id) {
+                return;
+            }
+            tokio::time::sleep(Duration::from_millis(20)).await;
+        }
+        panic!("no insert event for {doc_id}");
+    }
+
+    #[tokio::test]
+    async fn test_doc_manager_restore() {
+        let dir = tempfile::tempdir().unwrap();
+        let node = Arc::new(persistent_node(dir.path(), local_options()).await);
+        let author = node.authors().create().await.unwrap();
+        let cb = Arc::new(Events::default());
+        let manager = DocManager::new(node.clone(), "app".to_string(), cb.clone())
+            .await
+            .unwrap();
+        let other_cb = Arc::new(Events::default());
+        let other_manager = DocManager::new(node.clone(), "other".to_string(), other_cb.clone())
+            .await
+            .unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let other = node.docs().create().await.unwrap();
+        manager.add(doc.clone(), false).await.unwrap();
+        manager.add(other.clone(), false).await.unwrap();
+        assert!(manager.forget(other.id()).await.unwrap());
+        assert!(!manager.forget(other.id()).await.unwrap());
+        other_manager.add(other.clone(), false).await.unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"before".to_vec())
+            .await
+            .unwrap();
+        other
+            .set_bytes(&author, b"key".to_vec(), b"before".to_vec())
+            .await
+            .unwrap();
+        wait_insert(&cb, &doc.id()).await;
+        wait_insert(&other_cb, &other.id()).await;
+        // the subscription of the forgotten document ended
+        assert!(!inserted(&cb).contains(&other.id()));
+        let (doc_id, other_id) = (doc.id(), other.id());
+        drop((manager, other_manager, doc, other));
+        node.node().shutdown().await.unwrap();
+        drop(node);
+
+        let node = Arc::new(persistent_node(dir.path(), local_options()).await);
+        let cb = Arc::new(Events::default());
+        let manager = DocManager::new(node.clone(), "app".to_string(), cb.clone())
+            .await
+            .unwrap();
+        assert_eq!(manager.doc_ids().await, vec![doc_id.clone()]);
+        let other_manager = DocManager::new(node.clone(), "other".to_string(), cb.clone())
+            .await
+            .unwrap();
+        assert_eq!(other_manager.doc_ids().await, vec![other_id]);
+        let doc = manager.doc(doc_id.clone()).await.unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"after".to_vec())
+            .await
+            .unwrap();
+        wait_insert(&cb, &doc_id).await;
+        node.node().shutdown().await.unwrap();
+    }
+}
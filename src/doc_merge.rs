@@ -0,0 +1,138 @@
+use std::sync::Arc;
+
+use anyhow::Context;
+use futures::TryStreamExt;
+
+use crate::{sidecar, AuthorId, Docs, IrohError};
+
+/// The number of entries handled by `Docs.merge`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct MergeOutcome {
+    /// Entries written to the destination document.
+    pub copied: u64,
+    /// Entries skipped because the destination already had the same content at their key.
+    pub unchanged: u64,
+}
+
+#[uniffi::export]
+impl Docs {
+    /// Copy the latest entry of every key of the document `src` into the document `dst`,
+    /// written by `author`.
+    ///
+    /// Merges documents on this node, e.g. to consolidate them, without reading the entries
+    /// into the application. Only hashes and sizes are copied, the content is shared by both
+    /// documents; the compression and meta of an entry are copied along. Keys where the latest
+    /// entry of `dst` has the same content are skipped, so a repeated merge copies nothing.
+    /// Deleted keys of `src` are not deleted in `dst`. Both documents must be on this node and
+    /// `dst` must be writable.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn merge(
+        &self,
+        src: String,
+        dst: String,
+        author: Arc<AuthorId>,
+    ) -> Result<MergeOutcome, IrohError> {
+        if src == dst {
+            return Err(anyhow::anyhow!("cannot merge document {src} into itself").into());
+        }
+        let src_doc = self
+            .open(src.clone())
+            .await?
+            .with_context(|| format!("document {src} not found"))?;
+        let dst_doc = self
+            .open(dst.clone())
+            .await?
+            .with_context(|| format!("document {dst} not found"))?;
+
+        let mut outcome = MergeOutcome::default();
+        let query = iroh_docs::store::Query::single_latest_per_key().build();
+        let mut entries = src_doc.inner.get_many(query).await?;
+        while let Some(entry) = entries.try_next().await? {
+            // carried along with the entries they belong to
+            if sidecar::is_sidecar(entry.key()) {
+                continue;
+            }
+            let query = iroh_docs::store::Query::single_latest_per_key()
+                .key_exact(entry.key())
+                .build();
+            let existing = dst_doc.inner.get_one(query).await?;
+            if existing.is_some_and(|existing| existing.content_hash() == entry.content_hash()) {
+                outcome.unchanged += 1;
+                continue;
+            }
+            let lock = dst_doc.write_lock().await;
+            sidecar::copy(&src_doc, &entry, &dst_doc, &lock, &author, entry.key()).await?;
+            dst_doc
+                .put_hash(
+                    &lock,
+                    author.0,
+                    entry.key().to_vec(),
+                    entry.content_hash(),
+                    entry.content_len(),
+                )
+                .await?;
+            outcome.copied += 1;
+        }
+        Ok(outcome)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_merge() {
+        let node = local_node().await;
+        let docs = node.docs();
+        let src = docs.create().await.unwrap();
+        let dst = docs.create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let merger = node.authors().create().await.unwrap();
+
+        src.set_bytes(&author, b"a".to_vec(), b"only in src".to_vec())
+            .await
+            .unwrap();
+        src.set_bytes(&author, b"b".to_vec(), b"in both".to_vec())
+            .await
+            .unwrap();
+        src.set_bytes(&author, b"gone".to_vec(), b"deleted".to_vec())
+            .await
+            .unwrap();
+        src.delete(author.clone(), b"gone".to_vec()).await.unwrap();
+        dst.set_bytes(&author, b"b".to_vec(), b"in both".to_vec())
+            .await
+            .unwrap();
+
+        let outcome = docs
+            .merge(src.id(), dst.id(), merger.clone())
+            .await
+            .unwrap();
+        assert_eq!(
+            outcome,
+            MergeOutcome {
+                copied: 1,
+                unchanged: 1,
+            }
+        );
+        let entry = dst
+            .get_exact(merger.clone(), b"a".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.content_len(), b"only in src".len() as u64);
+        assert!(dst
+            .get_exact(merger.clone(), b"gone".to_vec(), true)
+            .await
+            .unwrap()
+            .is_none());
+
+        let again = docs
+            .merge(src.id(), dst.id(), merger.clone())
+            .await
+            .unwrap();
+        assert_eq!(again.copied, 0);
+        assert!(docs.merge(src.id(), src.id(), merger).await.is_err());
+    }
+}
@@ -0,0 +1,271 @@
+use std::{
+    collections::{HashMap, VecDeque},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant, SystemTime},
+};
+
+use futures::StreamExt;
+use tracing::warn;
+
+use crate::Doc;
+
+/// The window over which [`DocMetrics`] rates are computed.
+const METRICS_WINDOW: Duration = Duration::from_secs(60);
+/// Maximum number of remote entries waiting for their content that are tracked per document.
+const MAX_PENDING_CONTENT: usize = 16 * 1024;
+
+/// Sync activity of a single document, returned by `Doc.metrics`.
+///
+/// Tracking starts with the first call to `Doc.metrics` for the document, totals count from
+/// then on. Rates are averaged over the last minute, or over the time since tracking started
+/// if that is shorter.
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct DocMetrics {
+    /// Number of entries received from other peers and applied to the document.
+    pub entries_applied: u64,
+    /// Number of content bytes downloaded for entries received from other peers.
+    pub content_bytes_downloaded: u64,
+    /// Number of completed sync rounds with other peers, including failed ones.
+    pub sync_rounds: u64,
+    /// Number of sync rounds that ended with an error.
+    pub sync_failures: u64,
+    /// Entries applied per second.
+    pub entries_per_sec: f64,
+    /// Content bytes downloaded per second.
+    pub bytes_per_sec: f64,
+    /// Sync rounds completed per minute.
+    pub sync_rounds_per_min: f64,
+    /// When tracking started.
+    pub tracking_since: SystemTime,
+}
+
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+struct Counts {
+    entries: u64,
+    bytes: u64,
+    sync_rounds: u64,
+    sync_failures: u64,
+}
+
+impl Counts {
+    fn add(&mut self, other: &Counts) {
+        self.entries += other.entries;
+        self.bytes += other.bytes;
+        self.sync_rounds += other.sync_rounds;
+        self.sync_failures += other.sync_failures;
+    }
+}
+
+/// Totals since tracking started, and per second counts for the last [`METRICS_WINDOW`].
+#[derive(Debug)]
+struct RollingCounts {
+    started: Instant,
+    started_at: SystemTime,
+    total: Counts,
+    /// Counts per second, keyed by seconds since `started`, oldest first.
+    buckets: VecDeque<(u64, Counts)>,
+}
+
+impl RollingCounts {
+    fn new(now: Instant) -> Self {
+        RollingCounts {
+            started: now,
+            started_at: SystemTime::now(),
+            total: Counts::default(),
+            buckets: VecDeque::new(),
+        }
+    }
+
+    fn record(&mut self, now: Instant, counts: Counts) {
+        let second = now.saturating_duration_since(self.started).as_secs();
+        self.total.add(&counts);
+        match self.buckets.back_mut() {
+            Some((s, bucket)) if *s == second => bucket.add(&counts),
+            _ => self.buckets.push_back((second, counts)),
+        }
+        self.expire(second);
+    }
+
+    /// Drop the buckets that fell out of the window at `second`.
+    fn expire(&mut self, second: u64) {
+        let oldest = second.saturating_sub(METRICS_WINDOW.as_secs() - 1);
+        while self.buckets.front().is_some_and(|(s, _)| *s < oldest) {
+            self.buckets.pop_front();
+        }
+    }
+
+    fn metrics(&mut self, now: Instant) -> DocMetrics {
+        let elapsed = now.saturating_duration_since(self.started);
+        self.expire(elapsed.as_secs());
+        let mut window = Counts::default();
+        for (_, counts) in &self.buckets {
+            window.add(counts);
+        }
+        let secs = elapsed.min(METRICS_WINDOW).as_secs_f64().max(1.0);
+        DocMetrics {
+            entries_applied: self.total.entries,
+            content_bytes_downloaded: self.total.bytes,
+            sync_rounds: self.total.sync_rounds,
+            sync_failures: self.total.sync_failures,
+            entries_per_sec: window.entries as f64 / secs,
+            bytes_per_sec: window.bytes as f64 / secs,
+            sync_rounds_per_min: window.sync_rounds as f64 * 60.0 / secs,
+            tracking_since: self.started_at,
+        }
+    }
+}
+
+/// Collects the metrics of one document from its event stream.
+#[derive(Debug)]
+struct DocMetricsTracker {
+    counts: Mutex<RollingCounts>,
+    /// Content length of remote entries whose content is still being downloaded.
+    pending: Mutex<HashMap<iroh_blobs::Hash, u64>>,
+}
+
+impl DocMetricsTracker {
+    fn new() -> Self {
+        DocMetricsTracker {
+            counts: Mutex::new(RollingCounts::new(Instant::now())),
+            pending: Default::default(),
+        }
+    }
+
+    fn on_event(&self, event: iroh_docs::rpc::client::docs::LiveEvent) {
+        use iroh_docs::rpc::client::docs::LiveEvent;
+
+        let counts = match event {
+            LiveEvent::InsertRemote {
+                entry,
+                content_status,
+                ..
+            } => {
+                if !matches!(content_status, iroh_docs::ContentStatus::Complete) {
+                    let mut pending = self.pending.lock().expect("poisoned");
+                    if pending.len() < MAX_PENDING_CONTENT {
+                        pending.insert(entry.content_hash(), entry.content_len());
+                    }
+                }
+                Counts {
+                    entries: 1,
+                    ..Default::default()
+                }
+            }
+            LiveEvent::ContentReady { hash } => {
+                let Some(len) = self.pending.lock().expect("poisoned").remove(&hash) else {
+                    return;
+                };
+                Counts {
+                    bytes: len,
+                    ..Default::default()
+                }
+            }
+            LiveEvent::SyncFinished(event) => Counts {
+                sync_rounds: 1,
+                sync_failures: u64::from(event.result.is_err()),
+                ..Default::default()
+            },
+            _ => return,
+        };
+        self.counts
+            .lock()
+            .expect("poisoned")
+            .record(Instant::now(), counts);
+    }
+
+    fn metrics(&self) -> DocMetrics {
+        self.counts
+            .lock()
+            .expect("poisoned")
+            .metrics(Instant::now())
+    }
+}
+
+/// The documents of a node whose metrics are tracked.
+#[derive(Debug, Default)]
+pub(crate) struct DocMetricsRegistry {
+    docs: Mutex<HashMap<iroh_docs::NamespaceId, Arc<DocMetricsTracker>>>,
+}
+
+impl DocMetricsRegistry {
+    /// Get the metrics of `doc`, starting to track them if they are not tracked yet.
+    pub(crate) async fn metrics(self: &Arc<Self>, doc: &Doc) -> anyhow::Result<DocMetrics> {
+        let id = doc.inner.id();
+        if let Some(tracker) = self.docs.lock().expect("poisoned").get(&id) {
+            return Ok(tracker.metrics());
+        }
+
+        let mut events = doc.live_events().await?;
+        let tracker = {
+            let mut docs = self.docs.lock().expect("poisoned");
+            if let Some(tracker) = docs.get(&id) {
+                // Another call started tracking while we subscribed.
+                return Ok(tracker.metrics());
+            }
+            let tracker = Arc::new(DocMetricsTracker::new());
+            docs.insert(id, tracker.clone());
+            tracker
+        };
+
+        let this = self.clone();
+        let t = tracker.clone();
+        tokio::task::spawn(async move {
+            while let Some(event) = events.next().await {
+                match event {
+                    Ok(event) => t.on_event(event),
+                    Err(err) => {
+                        warn!("doc metrics subscription for {id} failed: {err:#}");
+                        break;
+                    }
+                }
+            }
+            // The document was closed, tracking restarts with the next call.
+            this.docs.lock().expect("poisoned").remove(&id);
+        });
+
+        Ok(tracker.metrics())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rolling_counts() {
+        let start = Instant::now();
+        let mut counts = RollingCounts::new(start);
+        let entry = Counts {
+            entries: 1,
+            bytes: 100,
+            ..Default::default()
+        };
+        for i in 0..10 {
+            counts.record(start + Duration::from_millis(i * 500), entry);
+        }
+        counts.record(
+            start + Duration::from_secs(4),
+            Counts {
+                sync_rounds: 1,
+                sync_failures: 1,
+                ..Default::default()
+            },
+        );
+
+        let metrics = counts.metrics(start + Duration::from_secs(10));
+        assert_eq!(metrics.entries_applied, 10);
+        assert_eq!(metrics.content_bytes_downloaded, 1000);
+        assert_eq!(metrics.sync_rounds, 1);
+        assert_eq!(metrics.sync_failures, 1);
+        assert_eq!(metrics.entries_per_sec, 1.0);
+        assert_eq!(metrics.bytes_per_sec, 100.0);
+        assert_eq!(metrics.sync_rounds_per_min, 6.0);
+
+        // everything fell out of the window, but the totals remain
+        let metrics = counts.metrics(start + Duration::from_secs(120));
+        assert_eq!(metrics.entries_applied, 10);
+        assert_eq!(metrics.entries_per_sec, 0.0);
+        assert_eq!(metrics.sync_rounds_per_min, 0.0);
+        assert!(counts.buckets.is_empty());
+    }
+}
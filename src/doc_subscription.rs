@@ -0,0 +1,109 @@
+use std::sync::{Arc, Mutex};
+
+use tokio::sync::mpsc;
+use tokio_util::task::AbortOnDropHandle;
+
+use crate::{
+    doc::forward_live_events, CallbackError, Doc, IrohError, LiveEvent, ReadOnlyDoc,
+    SubscribeCallback,
+};
+
+/// Events of a document, received by polling instead of through a callback, see
+/// `Doc.subscribe_events`.
+#[derive(uniffi::Object)]
+pub struct DocSubscription {
+    receiver: tokio::sync::Mutex<mpsc::Receiver<Arc<LiveEvent>>>,
+    task: Mutex<Option<AbortOnDropHandle<()>>>,
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Subscribe to events for this document, receiving them with [`DocSubscription::next`].
+    ///
+    /// Suits bindings where callbacks are awkward, e.g. to feed a Go channel. Up to `buffer`
+    /// events are buffered, while the buffer is full the subscription waits for them to be
+    /// received. The subscription ends when the document is closed, after a final
+    /// `LiveEventType::Closed` event, or when it is cancelled.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_events(&self, buffer: u32) -> Result<Arc<DocSubscription>, IrohError> {
+        self.ensure_open()?;
+        let batches = self.state.subscribe_batches();
+        let sub = self.live_events().await?;
+        let (sender, receiver) = mpsc::channel(buffer.max(1) as usize);
+        let cb = Arc::new(ChannelCallback(sender));
+        let task = tokio::task::spawn(forward_live_events(sub, batches, cb));
+        Ok(Arc::new(DocSubscription {
+            receiver: tokio::sync::Mutex::new(receiver),
+            task: Mutex::new(Some(AbortOnDropHandle::new(task))),
+        }))
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// Subscribe to events for this document, see [`Doc::subscribe_events`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_events(&self, buffer: u32) -> Result<Arc<DocSubscription>, IrohError> {
+        self.doc.subscribe_events(buffer).await
+    }
+}
+
+#[uniffi::export]
+impl DocSubscription {
+    /// Wait for the next event, `None` once the subscription ended.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn next(&self) -> Option<Arc<LiveEvent>> {
+        self.receiver.lock().await.recv().await
+    }
+
+    /// End the subscription, e.g. when a Go context is done.
+    ///
+    /// Events that were buffered already are still returned by [`Self::next`], then it
+    /// returns `None`.
+    pub fn cancel(&self) {
+        self.task.lock().expect("poisoned").take();
+    }
+}
+
+/// Passes the events of a subscription to a [`DocSubscription`].
+struct ChannelCallback(mpsc::Sender<Arc<LiveEvent>>);
+
+#[async_trait::async_trait]
+impl SubscribeCallback for ChannelCallback {
+    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+        self.0.send(event).await.map_err(|_| CallbackError::Error)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+    use crate::LiveEventType;
+
+    #[tokio::test]
+    async fn test_subscribe_events() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+
+        let sub = doc.subscribe_events(4).await.unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        let event = sub.next().await.unwrap();
+        assert_eq!(event.r#type(), LiveEventType::InsertLocal);
+
+        doc.close_me().await.unwrap();
+        let mut last = None;
+        while let Some(event) = sub.next().await {
+            last = Some(event.r#type());
+        }
+        assert_eq!(last, Some(LiveEventType::Closed));
+
+        let doc = node.docs().create().await.unwrap();
+        let sub = doc.subscribe_events(4).await.unwrap();
+        sub.cancel();
+        assert!(sub.next().await.is_none());
+    }
+}
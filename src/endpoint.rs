@@ -1,16 +1,48 @@
-use std::sync::Arc;
+use std::{sync::Arc, time::Duration};
 
 use iroh::endpoint;
 use tokio::sync::Mutex;
 
-use crate::{IrohError, NodeAddr, PublicKey};
+use crate::{
+    error::ResponseTooLarge, instrument::CallTimer, peer_diagnostics::PeerErrors,
+    response_limit::ResponseClass, IrohError, NodeAddr, PublicKey,
+};
+
+/// QUIC transport settings, used for all connections of a node or for a single connection.
+#[derive(Debug, Clone, Default, uniffi::Record)]
+pub struct TransportOptions {
+    /// Close connections that had no activity for this long.
+    ///
+    /// The effective timeout is the minimum of the value of both peers. Defaults to 30 seconds.
+    #[uniffi(default = None)]
+    pub idle_timeout: Option<Duration>,
+    /// Send keep-alive packets at this interval to prevent idle connections from timing out.
+    ///
+    /// Keep-alives are only needed by one side of a connection. Disabled by default.
+    #[uniffi(default = None)]
+    pub keep_alive_interval: Option<Duration>,
+}
+
+impl TransportOptions {
+    /// Build the QUIC transport config, keeping defaults for all unset values.
+    pub(crate) fn transport_config(&self) -> anyhow::Result<endpoint::TransportConfig> {
+        let mut config = endpoint::TransportConfig::default();
+        if let Some(timeout) = self.idle_timeout {
+            config.max_idle_timeout(Some(timeout.try_into()?));
+        }
+        if let Some(interval) = self.keep_alive_interval {
+            config.keep_alive_interval(Some(interval));
+        }
+        Ok(config)
+    }
+}
 
 #[derive(Clone, uniffi::Object)]
-pub struct Endpoint(endpoint::Endpoint);
+pub struct Endpoint(endpoint::Endpoint, Arc<PeerErrors>);
 
 impl Endpoint {
-    pub fn new(ep: endpoint::Endpoint) -> Self {
-        Endpoint(ep)
+    pub(crate) fn new(ep: endpoint::Endpoint, peer_errors: Arc<PeerErrors>) -> Self {
+        Endpoint(ep, peer_errors)
     }
 }
 
@@ -30,8 +62,25 @@ impl Endpoint {
         alpn: &[u8],
     ) -> Result<Connection, IrohError> {
         let node_addr: iroh::NodeAddr = node_addr.clone().try_into()?;
-        let conn = self.0.connect(node_addr, alpn).await?;
-        Ok(Connection(conn))
+        let conn = self.1.connect(&self.0, node_addr, alpn, None).await?;
+        Ok(conn.into())
+    }
+
+    /// Connect to a node, overriding the node wide transport options for this connection.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn connect_with_options(
+        &self,
+        node_addr: &NodeAddr,
+        alpn: &[u8],
+        options: TransportOptions,
+    ) -> Result<Connection, IrohError> {
+        let node_addr: iroh::NodeAddr = node_addr.clone().try_into()?;
+        let config = options.transport_config()?;
+        let conn = self
+            .1
+            .connect(&self.0, node_addr, alpn, Some(Arc::new(config)))
+            .await?;
+        Ok(conn.into())
     }
 }
 
@@ -51,7 +100,7 @@ impl Connecting {
         match self.0.lock().await.take() {
             Some(conn) => {
                 let conn = conn.await.map_err(anyhow::Error::from)?;
-                Ok(Connection(conn))
+                Ok(conn.into())
             }
             None => Err(anyhow::anyhow!("already used").into()),
         }
@@ -92,31 +141,44 @@ impl Connecting {
 }
 
 #[derive(uniffi::Object)]
-pub struct Connection(endpoint::Connection);
+pub struct Connection {
+    inner: endpoint::Connection,
+    /// The counters at the last [`Connection::stats_reset`].
+    stats_baseline: std::sync::Mutex<ConnectionStats>,
+}
+
+impl From<endpoint::Connection> for Connection {
+    fn from(inner: endpoint::Connection) -> Self {
+        Connection {
+            inner,
+            stats_baseline: Default::default(),
+        }
+    }
+}
 
 #[uniffi::export]
 impl Connection {
     #[uniffi::method]
     pub fn get_remote_node_id(&self) -> Result<PublicKey, IrohError> {
-        let id = endpoint::get_remote_node_id(&self.0)?;
+        let id = endpoint::get_remote_node_id(&self.inner)?;
         Ok(id.into())
     }
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn open_uni(&self) -> Result<SendStream, IrohError> {
-        let s = self.0.open_uni().await.map_err(anyhow::Error::from)?;
+        let s = self.inner.open_uni().await.map_err(anyhow::Error::from)?;
         Ok(SendStream::new(s))
     }
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn accept_uni(&self) -> Result<RecvStream, IrohError> {
-        let r = self.0.accept_uni().await.map_err(anyhow::Error::from)?;
+        let r = self.inner.accept_uni().await.map_err(anyhow::Error::from)?;
         Ok(RecvStream::new(r))
     }
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn open_bi(&self) -> Result<BiStream, IrohError> {
-        let (s, r) = self.0.open_bi().await.map_err(anyhow::Error::from)?;
+        let (s, r) = self.inner.open_bi().await.map_err(anyhow::Error::from)?;
         Ok(BiStream {
             send: SendStream::new(s),
             recv: RecvStream::new(r),
@@ -125,7 +187,7 @@ impl Connection {
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn accept_bi(&self) -> Result<BiStream, IrohError> {
-        let (s, r) = self.0.accept_bi().await.map_err(anyhow::Error::from)?;
+        let (s, r) = self.inner.accept_bi().await.map_err(anyhow::Error::from)?;
         Ok(BiStream {
             send: SendStream::new(s),
             recv: RecvStream::new(r),
@@ -134,32 +196,36 @@ impl Connection {
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn read_datagram(&self) -> Result<Vec<u8>, IrohError> {
-        let res = self.0.read_datagram().await.map_err(anyhow::Error::from)?;
+        let res = self
+            .inner
+            .read_datagram()
+            .await
+            .map_err(anyhow::Error::from)?;
         Ok(res.to_vec())
     }
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn closed(&self) -> String {
-        let err = self.0.closed().await;
+        let err = self.inner.closed().await;
         err.to_string()
     }
 
     #[uniffi::method]
     pub fn close_reason(&self) -> Option<String> {
-        let err = self.0.close_reason();
+        let err = self.inner.close_reason();
         err.map(|s| s.to_string())
     }
 
     #[uniffi::method]
     pub fn close(&self, error_code: u64, reason: &[u8]) -> Result<(), IrohError> {
         let code = endpoint::VarInt::from_u64(error_code).map_err(anyhow::Error::from)?;
-        self.0.close(code, reason);
+        self.inner.close(code, reason);
         Ok(())
     }
 
     #[uniffi::method]
     pub fn send_datagram(&self, data: Vec<u8>) -> Result<(), IrohError> {
-        self.0
+        self.inner
             .send_datagram(data.into())
             .map_err(anyhow::Error::from)?;
         Ok(())
@@ -167,7 +233,7 @@ impl Connection {
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn send_datagram_wait(&self, data: Vec<u8>) -> Result<(), IrohError> {
-        self.0
+        self.inner
             .send_datagram_wait(data.into())
             .await
             .map_err(anyhow::Error::from)?;
@@ -176,56 +242,120 @@ impl Connection {
 
     #[uniffi::method]
     pub fn max_datagram_size(&self) -> Option<u64> {
-        self.0.max_datagram_size().map(|s| s as _)
+        self.inner.max_datagram_size().map(|s| s as _)
     }
 
     #[uniffi::method]
     pub fn datagram_send_buffer_space(&self) -> u64 {
-        self.0.datagram_send_buffer_space() as _
+        self.inner.datagram_send_buffer_space() as _
     }
 
     #[uniffi::method]
     pub fn remote_address(&self) -> String {
-        self.0.remote_address().to_string()
+        self.inner.remote_address().to_string()
     }
 
     #[uniffi::method]
     pub fn local_ip(&self) -> Option<String> {
-        self.0.local_ip().map(|s| s.to_string())
+        self.inner.local_ip().map(|s| s.to_string())
     }
 
     #[uniffi::method]
     pub fn rtt(&self) -> u64 {
-        self.0.rtt().as_millis() as _
+        self.inner.rtt().as_millis() as _
+    }
+
+    /// Get the counters of this connection.
+    ///
+    /// Counters start at zero again after [`Self::stats_reset`].
+    #[uniffi::method]
+    pub fn stats(&self) -> ConnectionStats {
+        let baseline = self.stats_baseline.lock().expect("poisoned");
+        ConnectionStats::of(&self.inner).since(&baseline)
+    }
+
+    /// Reset the counters returned by [`Self::stats`] to zero, e.g. to measure a single
+    /// scenario in a benchmark.
+    #[uniffi::method]
+    pub fn stats_reset(&self) {
+        *self.stats_baseline.lock().expect("poisoned") = ConnectionStats::of(&self.inner);
     }
 
     #[uniffi::method]
     pub fn stable_id(&self) -> u64 {
-        self.0.stable_id() as _
+        self.inner.stable_id() as _
     }
 
     #[uniffi::method]
     pub fn set_max_concurrent_uni_stream(&self, count: u64) -> Result<(), IrohError> {
         let n = endpoint::VarInt::from_u64(count).map_err(anyhow::Error::from)?;
-        self.0.set_max_concurrent_uni_streams(n);
+        self.inner.set_max_concurrent_uni_streams(n);
         Ok(())
     }
 
     #[uniffi::method]
     pub fn set_receive_window(&self, count: u64) -> Result<(), IrohError> {
         let n = endpoint::VarInt::from_u64(count).map_err(anyhow::Error::from)?;
-        self.0.set_receive_window(n);
+        self.inner.set_receive_window(n);
         Ok(())
     }
 
     #[uniffi::method]
     pub fn set_max_concurrent_bii_stream(&self, count: u64) -> Result<(), IrohError> {
         let n = endpoint::VarInt::from_u64(count).map_err(anyhow::Error::from)?;
-        self.0.set_max_concurrent_bi_streams(n);
+        self.inner.set_max_concurrent_bi_streams(n);
         Ok(())
     }
 }
 
+/// Counters of a single connection, see [`Connection::stats`].
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct ConnectionStats {
+    /// Bytes sent in UDP datagrams.
+    pub bytes_sent: u64,
+    /// Bytes received in UDP datagrams.
+    pub bytes_received: u64,
+    pub datagrams_sent: u64,
+    pub datagrams_received: u64,
+    /// Packets that were declared lost.
+    pub lost_packets: u64,
+    pub lost_bytes: u64,
+    pub congestion_events: u64,
+}
+
+impl ConnectionStats {
+    /// The current counters of `conn`.
+    fn of(conn: &endpoint::Connection) -> Self {
+        let stats = conn.stats();
+        ConnectionStats {
+            bytes_sent: stats.udp_tx.bytes,
+            bytes_received: stats.udp_rx.bytes,
+            datagrams_sent: stats.udp_tx.datagrams,
+            datagrams_received: stats.udp_rx.datagrams,
+            lost_packets: stats.path.lost_packets,
+            lost_bytes: stats.path.lost_bytes,
+            congestion_events: stats.path.congestion_events,
+        }
+    }
+
+    /// The counters since `baseline` was taken.
+    fn since(&self, baseline: &ConnectionStats) -> ConnectionStats {
+        ConnectionStats {
+            bytes_sent: self.bytes_sent.saturating_sub(baseline.bytes_sent),
+            bytes_received: self.bytes_received.saturating_sub(baseline.bytes_received),
+            datagrams_sent: self.datagrams_sent.saturating_sub(baseline.datagrams_sent),
+            datagrams_received: self
+                .datagrams_received
+                .saturating_sub(baseline.datagrams_received),
+            lost_packets: self.lost_packets.saturating_sub(baseline.lost_packets),
+            lost_bytes: self.lost_bytes.saturating_sub(baseline.lost_bytes),
+            congestion_events: self
+                .congestion_events
+                .saturating_sub(baseline.congestion_events),
+        }
+    }
+}
+
 #[derive(uniffi::Object)]
 pub struct BiStream {
     send: SendStream,
@@ -258,15 +388,23 @@ impl SendStream {
 impl SendStream {
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn write(&self, buf: &[u8]) -> Result<u64, IrohError> {
+        let mut timer = CallTimer::start("send_stream.write");
         let mut s = self.0.lock().await;
-        let written = s.write(buf).await.map_err(anyhow::Error::from)?;
+        let res = s.write(buf).await;
+        if let Ok(written) = res {
+            timer.payload(written);
+        }
+        let written = timer.finish(res).map_err(anyhow::Error::from)?;
         Ok(written as _)
     }
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn write_all(&self, buf: &[u8]) -> Result<(), IrohError> {
+        let mut timer = CallTimer::start("send_stream.write_all");
+        timer.payload(buf.len());
         let mut s = self.0.lock().await;
-        s.write_all(buf).await.map_err(anyhow::Error::from)?;
+        let res = s.write_all(buf).await;
+        timer.finish(res).map_err(anyhow::Error::from)?;
         Ok(())
     }
 
@@ -325,11 +463,21 @@ impl RecvStream {
 
 #[uniffi::export]
 impl RecvStream {
+    /// Read up to `size_limit` bytes, fewer if the stream read limit is lower, see
+    /// `set_response_limits`.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn read(&self, size_limit: u32) -> Result<Vec<u8>, IrohError> {
+        let size_limit = ResponseClass::StreamRead
+            .max()
+            .map_or(size_limit as u64, |max| max.min(size_limit as u64));
+        let mut timer = CallTimer::start("recv_stream.read");
         let mut buf = vec![0u8; size_limit as _];
         let mut r = self.0.lock().await;
-        let res = r.read(&mut buf).await.map_err(anyhow::Error::from)?;
+        let res = r.read(&mut buf).await;
+        if let Ok(Some(len)) = res {
+            timer.payload(len);
+        }
+        let res = timer.finish(res).map_err(anyhow::Error::from)?;
         let len = res.unwrap_or(0);
         buf.truncate(len);
         Ok(buf)
@@ -337,20 +485,39 @@ impl RecvStream {
 
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn read_exact(&self, size: u32) -> Result<Vec<u8>, IrohError> {
+        ResponseClass::StreamRead.check(size as u64)?;
+        let mut timer = CallTimer::start("recv_stream.read_exact");
         let mut buf = vec![0u8; size as _];
         let mut r = self.0.lock().await;
-        r.read_exact(&mut buf).await.map_err(anyhow::Error::from)?;
+        let res = r.read_exact(&mut buf).await;
+        if res.is_ok() {
+            timer.payload(buf.len());
+        }
+        timer.finish(res).map_err(anyhow::Error::from)?;
         Ok(buf)
     }
 
+    /// Read the rest of the stream, failing if it is longer than `size_limit`.
+    ///
+    /// If the stream read limit is lower, see `set_response_limits`, and the stream exceeds
+    /// it, the error is of kind `IrohErrorKind::ResponseTooLarge`.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn read_to_end(&self, size_limit: u32) -> Result<Vec<u8>, IrohError> {
+        let max = ResponseClass::StreamRead
+            .max()
+            .filter(|max| *max < size_limit as u64);
+        let limit = max.unwrap_or(size_limit as u64);
         let mut r = self.0.lock().await;
-        let res = r
-            .read_to_end(size_limit as _)
-            .await
-            .map_err(anyhow::Error::from)?;
-        Ok(res)
+        match r.read_to_end(limit as _).await {
+            Ok(res) => Ok(res),
+            Err(endpoint::ReadToEndError::TooLong) if max.is_some() => Err(ResponseTooLarge {
+                class: ResponseClass::StreamRead,
+                size: limit + 1,
+                max: limit,
+            }
+            .into()),
+            Err(err) => Err(anyhow::Error::from(err).into()),
+        }
     }
 
     #[uniffi::method(async_runtime = "tokio")]
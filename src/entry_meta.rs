@@ -0,0 +1,197 @@
+use std::sync::Arc;
+
+use crate::{doc::WriteGuard, sidecar, AuthorId, Doc, Entry, IrohError, ReadOnlyDoc};
+
+/// Kind of the sidecar holding the metadata set by `Doc.set_bytes_with_options`, see
+/// [`sidecar::write`]. Its payload is the metadata.
+pub(crate) const META_SIDECAR: &str = "meta";
+/// Maximum size of the metadata of an entry, see
+/// [`SetBytesOptions::meta`](crate::SetBytesOptions::meta).
+const MAX_META_LEN: usize = 256;
+
+#[uniffi::export]
+impl Doc {
+    /// The metadata stored with the content of an entry by `Doc.set_bytes_with_options`, if
+    /// any.
+    ///
+    /// The metadata is read from its sidecar entry, whose content has to be available on this
+    /// node. The content of the entry itself does not.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn entry_meta(&self, entry: Arc<Entry>) -> Result<Option<Vec<u8>>, IrohError> {
+        self.ensure_open()?;
+        let meta = read(self, &entry.0).await?;
+        Ok(meta)
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// The metadata stored with the content of an entry, see [`Doc::entry_meta`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn entry_meta(&self, entry: Arc<Entry>) -> Result<Option<Vec<u8>>, IrohError> {
+        self.doc.entry_meta(entry).await
+    }
+}
+
+/// Store `meta` for the entry of `author_id` at `key` with the content `content`, or remove
+/// the metadata stored for the entry before if `meta` is `None`.
+pub(crate) async fn write(
+    doc: &Doc,
+    lock: &WriteGuard<'_>,
+    author_id: &AuthorId,
+    key: &[u8],
+    content: iroh_blobs::Hash,
+    meta: Option<&[u8]>,
+) -> Result<(), IrohError> {
+    let Some(meta) = meta else {
+        return sidecar::clear(doc, lock, author_id, META_SIDECAR, key).await;
+    };
+    if meta.len() > MAX_META_LEN {
+        return Err(anyhow::anyhow!(
+            "entry metadata is {} bytes, at most {MAX_META_LEN} are allowed",
+            meta.len()
+        )
+        .into());
+    }
+    sidecar::write(doc, lock, author_id, META_SIDECAR, key, content, meta).await
+}
+
+/// The metadata stored for the current content of `entry`, if any.
+pub(crate) async fn read(
+    doc: &Doc,
+    entry: &iroh_docs::rpc::client::docs::Entry,
+) -> anyhow::Result<Option<Vec<u8>>> {
+    sidecar::read(doc, entry, META_SIDECAR).await
+}
+
+#[cfg(test)]
+mod tests {
+    use crate::test_utils::local_node;
+    use crate::{Query, SetBytesOptions};
+
+    #[tokio::test]
+    async fn test_set_bytes_meta() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let text = "lorem ipsum dolor sit amet ".repeat(200).into_bytes();
+        let get = |key: &'static [u8]| {
+            let doc = doc.clone();
+            let author = author.clone();
+            async move {
+                doc.get_exact(author, key.to_vec(), false)
+                    .await
+                    .unwrap()
+                    .unwrap()
+            }
+        };
+
+        let options = SetBytesOptions {
+            compress: true,
+            meta: Some(b"text/plain; charset=utf-8".to_vec()),
+        };
+        doc.set_bytes_with_options(&author, b"text".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        let entry = get(b"text").await;
+        let meta = doc.entry_meta(entry.clone()).await.unwrap();
+        assert_eq!(meta.as_deref(), Some(&b"text/plain; charset=utf-8"[..]));
+        let content = doc.read_content(entry).await.unwrap();
+        assert!(content.compressed);
+        assert_eq!(content.data, text);
+        assert_eq!(content.meta, meta);
+
+        // the metadata is not part of the content, which still dedupes with plain content
+        let options = SetBytesOptions {
+            compress: false,
+            meta: Some(b"text/plain".to_vec()),
+        };
+        let hash = doc
+            .set_bytes_with_options(&author, b"meta".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        let plain = doc
+            .set_bytes(&author, b"plain".to_vec(), text.clone())
+            .await
+            .unwrap();
+        assert_eq!(hash, plain);
+        assert_eq!(
+            node.blobs().read_to_bytes(hash.clone()).await.unwrap(),
+            text
+        );
+        assert!(doc.entry_meta(get(b"plain").await).await.unwrap().is_none());
+
+        // the same content set again without metadata drops it
+        let options = SetBytesOptions::default();
+        doc.set_bytes_with_options(&author, b"meta".to_vec(), text.clone(), options)
+            .await
+            .unwrap();
+        assert!(doc.entry_meta(get(b"meta").await).await.unwrap().is_none());
+
+        let options = SetBytesOptions {
+            compress: false,
+            meta: Some(vec![0u8; super::MAX_META_LEN + 1]),
+        };
+        assert!(doc
+            .set_bytes_with_options(&author, b"meta".to_vec(), text, options)
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_copy_meta() {
+        let node = local_node().await;
+        let docs = node.docs();
+        let doc = docs.create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let other = node.authors().create().await.unwrap();
+        let options = SetBytesOptions {
+            compress: false,
+            meta: Some(b"text/plain".to_vec()),
+        };
+        doc.set_bytes_with_options(&author, b"a".to_vec(), b"text".to_vec(), options)
+            .await
+            .unwrap();
+        let entries = doc.get_many(Query::all(None).into()).await.unwrap();
+        assert_eq!(entries.len(), 1);
+
+        // the copy of another author has the metadata
+        doc.copy_entry(&other, b"a".to_vec(), b"b".to_vec())
+            .await
+            .unwrap();
+        let entry = doc
+            .get_exact(other.clone(), b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let meta = doc.entry_meta(entry).await.unwrap();
+        assert_eq!(meta.as_deref(), Some(&b"text/plain"[..]));
+
+        // copying the same content without metadata drops it
+        doc.set_bytes(&author, b"c".to_vec(), b"text".to_vec())
+            .await
+            .unwrap();
+        doc.copy_entry(&other, b"c".to_vec(), b"b".to_vec())
+            .await
+            .unwrap();
+        let entry = doc
+            .get_exact(other.clone(), b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert!(doc.entry_meta(entry).await.unwrap().is_none());
+
+        // merging into another document carries it along
+        let dst = docs.create().await.unwrap();
+        docs.merge(doc.id(), dst.id(), other.clone()).await.unwrap();
+        let entry = dst
+            .get_exact(other, b"a".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let meta = dst.entry_meta(entry).await.unwrap();
+        assert_eq!(meta.as_deref(), Some(&b"text/plain"[..]));
+        let entries = dst.get_many(Query::all(None).into()).await.unwrap();
+        assert_eq!(entries.len(), 3);
+    }
+}
@@ -1,16 +1,182 @@
+use std::{
+    collections::VecDeque,
+    sync::{Mutex, Once},
+};
+
 /// An Error.
-#[derive(Debug, thiserror::Error, uniffi::Object)]
-#[error("{e:?}")]
+///
+/// Its message is redacted according to the redaction policy, see `set_redaction_policy`.
+#[derive(uniffi::Object)]
 #[uniffi::export(Debug)]
 pub struct IrohError {
     e: anyhow::Error,
 }
 
+impl std::fmt::Display for IrohError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&crate::redact::redact(&format!("{:?}", self.e)))
+    }
+}
+
+impl std::fmt::Debug for IrohError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "IrohError {{ e: {self} }}")
+    }
+}
+
+impl std::error::Error for IrohError {}
+
 #[uniffi::export]
 impl IrohError {
     pub fn message(&self) -> String {
         self.to_string()
     }
+
+    /// The kind of this error, to handle specific errors without matching on the message.
+    pub fn kind(&self) -> IrohErrorKind {
+        if self.e.downcast_ref::<VerificationFailed>().is_some() {
+            IrohErrorKind::VerificationFailed
+        } else if self.e.downcast_ref::<ObjectClosed>().is_some() {
+            IrohErrorKind::ObjectClosed
+        } else if is_storage_full(&self.e) {
+            IrohErrorKind::StorageFull
+        } else if self.e.downcast_ref::<DirectConnectionFailed>().is_some() {
+            IrohErrorKind::DirectConnectionFailed
+        } else if self.e.downcast_ref::<BlobInUse>().is_some() {
+            IrohErrorKind::InUse
+        } else if self.e.downcast_ref::<Cancelled>().is_some() {
+            IrohErrorKind::Cancelled
+        } else if self.e.downcast_ref::<ResponseTooLarge>().is_some() {
+            IrohErrorKind::ResponseTooLarge
+        } else {
+            IrohErrorKind::Other
+        }
+    }
+
+    /// What still references the blob, for errors of kind [`IrohErrorKind::InUse`].
+    pub fn in_use(&self) -> Option<crate::BlobReferences> {
+        self.e
+            .downcast_ref::<BlobInUse>()
+            .map(|in_use| in_use.references.clone())
+    }
+}
+
+/// The kinds of [`IrohError`] applications can tell apart.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum IrohErrorKind {
+    /// Any error without a kind of its own.
+    Other,
+    /// Content read from the blob store does not match its hash.
+    VerificationFailed,
+    /// The object was closed and can no longer be used.
+    ObjectClosed,
+    /// A write failed because the disk is full.
+    StorageFull,
+    /// A node in direct only mode could not connect to a peer directly, see
+    /// `NodeOptions.direct_only`.
+    DirectConnectionFailed,
+    /// A blob could not be deleted because it is still referenced, see `Blobs.delete_safe`
+    /// and [`IrohError::in_use`].
+    InUse,
+    /// The operation was cancelled with a `CancelToken`, or its timeout passed.
+    Cancelled,
+    /// A call would have returned more bytes than allowed, see `set_response_limits`.
+    ResponseTooLarge,
+}
+
+/// A blob is still referenced and was not deleted.
+#[derive(Debug, thiserror::Error)]
+#[error(
+    "blob {hash} is in use by {} documents and {} collections",
+    references.docs.len(),
+    references.tags.len()
+)]
+pub(crate) struct BlobInUse {
+    pub(crate) hash: iroh_blobs::Hash,
+    pub(crate) references: crate::BlobReferences,
+}
+
+/// An operation was stopped by a `CancelToken`.
+#[derive(Debug, thiserror::Error)]
+#[error("{}", if *timed_out { "operation deadline exceeded" } else { "operation cancelled" })]
+pub(crate) struct Cancelled {
+    pub(crate) timed_out: bool,
+}
+
+impl From<Cancelled> for IrohError {
+    fn from(e: Cancelled) -> Self {
+        IrohError { e: e.into() }
+    }
+}
+
+/// A response exceeds the limit of its class of calls.
+#[derive(Debug, thiserror::Error)]
+#[error("{class} response of at least {size} bytes exceeds the limit of {max} bytes")]
+pub(crate) struct ResponseTooLarge {
+    pub(crate) class: crate::response_limit::ResponseClass,
+    /// The size of the response, or a lower bound if it was not read to the end.
+    pub(crate) size: u64,
+    pub(crate) max: u64,
+}
+
+impl From<ResponseTooLarge> for IrohError {
+    fn from(e: ResponseTooLarge) -> Self {
+        IrohError { e: e.into() }
+    }
+}
+
+/// A method was called on an object that was closed before.
+#[derive(Debug, thiserror::Error)]
+#[error("{0} is closed")]
+pub(crate) struct ObjectClosed(pub(crate) &'static str);
+
+impl From<ObjectClosed> for IrohError {
+    fn from(e: ObjectClosed) -> Self {
+        IrohError { e: e.into() }
+    }
+}
+
+/// Content read from the blob store does not match its hash.
+#[derive(Debug, thiserror::Error)]
+#[error("verification failed: expected blob {expected}, content hashes to {actual}")]
+pub(crate) struct VerificationFailed {
+    pub(crate) expected: iroh_blobs::Hash,
+    pub(crate) actual: iroh_blobs::Hash,
+}
+
+/// A node in direct only mode could not connect to a peer directly.
+#[derive(Debug, thiserror::Error)]
+#[error("direct connection to {node_id} failed: {reason}")]
+pub(crate) struct DirectConnectionFailed {
+    pub(crate) node_id: iroh::NodeId,
+    pub(crate) reason: String,
+}
+
+/// Whether `err` was caused by a full disk.
+///
+/// Errors from the blob and docs stores cross an RPC boundary as messages, so the message is
+/// checked as well.
+pub(crate) fn is_storage_full(err: &anyhow::Error) -> bool {
+    // ERROR_HANDLE_DISK_FULL and ERROR_DISK_FULL
+    #[cfg(windows)]
+    const DISK_FULL: [i32; 2] = [39, 112];
+    #[cfg(not(windows))]
+    const DISK_FULL: [i32; 1] = [libc::ENOSPC];
+    const DISK_FULL_MESSAGES: [&str; 2] = [
+        "No space left on device",
+        "There is not enough space on the disk",
+    ];
+
+    err.chain().any(|cause| {
+        let io_full = cause
+            .downcast_ref::<std::io::Error>()
+            .and_then(|err| err.raw_os_error())
+            .is_some_and(|code| DISK_FULL.contains(&code));
+        io_full || {
+            let message = cause.to_string();
+            DISK_FULL_MESSAGES.iter().any(|m| message.contains(m))
+        }
+    })
 }
 
 impl From<anyhow::Error> for IrohError {
@@ -19,6 +185,81 @@ impl From<anyhow::Error> for IrohError {
     }
 }
 
+/// Details of a panic inside the library.
+///
+/// Panics reach the bindings as internal errors, often with little context. Enable panic
+/// reports with [`enable_panic_reports`] to retrieve where they happened.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct PanicReport {
+    /// The panic message.
+    pub message: String,
+    /// The source location of the panic, as `file:line:column`.
+    pub location: Option<String>,
+    /// The name of the thread that panicked.
+    pub thread: Option<String>,
+}
+
+/// The number of panics kept for [`recent_panics`].
+const RECENT_PANICS: usize = 16;
+
+static PANICS: Mutex<VecDeque<PanicReport>> = Mutex::new(VecDeque::new());
+static PANIC_HOOK: Once = Once::new();
+
+/// Record every panic inside the library, to be retrieved with [`last_panic`] and
+/// [`recent_panics`].
+///
+/// The previously installed panic hook is still called, so panics keep being printed.
+#[uniffi::export]
+pub fn enable_panic_reports() {
+    PANIC_HOOK.call_once(|| {
+        let previous = std::panic::take_hook();
+        std::panic::set_hook(Box::new(move |info| {
+            let report = panic_report(info);
+            if let Ok(mut panics) = PANICS.lock() {
+                if panics.len() == RECENT_PANICS {
+                    panics.pop_front();
+                }
+                panics.push_back(report);
+            }
+            previous(info);
+        }));
+    });
+}
+
+/// The most recent panic, if panic reports are enabled and a panic happened.
+#[uniffi::export]
+pub fn last_panic() -> Option<PanicReport> {
+    PANICS.lock().ok().and_then(|panics| panics.back().cloned())
+}
+
+/// The most recent panics, up to 16 of them, oldest first.
+///
+/// Panics on several threads close together all show up here, while [`last_panic`] only has
+/// the latest of them.
+#[uniffi::export]
+pub fn recent_panics() -> Vec<PanicReport> {
+    PANICS
+        .lock()
+        .map(|panics| panics.iter().cloned().collect())
+        .unwrap_or_default()
+}
+
+fn panic_report(info: &std::panic::PanicHookInfo<'_>) -> PanicReport {
+    let payload = info.payload();
+    let message = if let Some(s) = payload.downcast_ref::<&str>() {
+        s.to_string()
+    } else if let Some(s) = payload.downcast_ref::<String>() {
+        s.clone()
+    } else {
+        "unknown panic payload".to_string()
+    };
+    PanicReport {
+        message,
+        location: info.location().map(|l| l.to_string()),
+        thread: std::thread::current().name().map(ToString::to_string),
+    }
+}
+
 #[derive(Debug, thiserror::Error, PartialEq, Eq, uniffi::Error)]
 pub enum CallbackError {
     #[error("Callback failed")]
@@ -44,3 +285,46 @@ impl From<uniffi::UnexpectedUniFFICallbackError> for CallbackError {
         CallbackError::Error
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_panic_report() {
+        enable_panic_reports();
+        let res = std::thread::Builder::new()
+            .name("test_panic_report".to_string())
+            .spawn(|| panic!("expected panic in {}", "test_panic_report"))
+            .unwrap()
+            .join();
+        assert!(res.is_err());
+        assert!(last_panic().is_some());
+
+        // other tests may panic concurrently, look for this one
+        let report = recent_panics()
+            .into_iter()
+            .rev()
+            .find(|report| report.message == "expected panic in test_panic_report")
+            .unwrap();
+        assert_eq!(report.thread.as_deref(), Some("test_panic_report"));
+        assert!(report.location.unwrap().contains("error.rs"));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_storage_full() {
+        let full = std::io::Error::from_raw_os_error(libc::ENOSPC);
+        let err = anyhow::Error::from(full).context("failed to add blob");
+        assert!(is_storage_full(&err));
+        assert_eq!(IrohError::from(err).kind(), IrohErrorKind::StorageFull);
+
+        // as it arrives over RPC
+        let err = anyhow::anyhow!("rpc error: No space left on device (os error 28)");
+        assert!(is_storage_full(&err));
+
+        let err = anyhow::Error::from(std::io::Error::from(std::io::ErrorKind::NotFound));
+        assert!(!is_storage_full(&err));
+        assert_eq!(IrohError::from(err).kind(), IrohErrorKind::Other);
+    }
+}
@@ -0,0 +1,119 @@
+use std::{
+    sync::{
+        atomic::{AtomicBool, AtomicU64, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
+/// Error code used to close connections refused while a node is offline.
+const OFFLINE_CLOSE_CODE: u32 = 0x0ff1;
+
+/// Injects failures into a running node, to test how applications cope with them.
+///
+/// Faults only affect connections accepted by this node, outgoing connections are not
+/// touched. To partition two nodes from each other, set both of them offline.
+#[derive(Debug, Default, uniffi::Object)]
+pub struct FaultInjector {
+    offline: AtomicBool,
+    accept_delay_millis: AtomicU64,
+}
+
+#[uniffi::export]
+impl FaultInjector {
+    /// Refuse all incoming connections while `offline` is true.
+    ///
+    /// Connections that are already established are not affected.
+    pub fn set_offline(&self, offline: bool) {
+        self.offline.store(offline, Ordering::Relaxed);
+    }
+
+    /// Whether incoming connections are refused.
+    pub fn is_offline(&self) -> bool {
+        self.offline.load(Ordering::Relaxed)
+    }
+
+    /// Wait this long before handing incoming connections to the protocol handlers.
+    ///
+    /// This delays the start of every sync, blob transfer and gossip session another node
+    /// initiates with this node.
+    pub fn set_accept_delay(&self, delay: Duration) {
+        let millis = u64::try_from(delay.as_millis()).unwrap_or(u64::MAX);
+        self.accept_delay_millis.store(millis, Ordering::Relaxed);
+    }
+
+    /// The delay applied to incoming connections.
+    pub fn accept_delay(&self) -> Duration {
+        Duration::from_millis(self.accept_delay_millis.load(Ordering::Relaxed))
+    }
+
+    /// Remove all injected faults.
+    pub fn clear(&self) {
+        self.set_offline(false);
+        self.set_accept_delay(Duration::ZERO);
+    }
+}
+
+/// Wraps a protocol handler to apply the faults of a [`FaultInjector`].
+#[derive(Debug, Clone)]
+pub(crate) struct FaultyProtocol<P> {
+    inner: P,
+    faults: Arc<FaultInjector>,
+}
+
+impl<P> FaultyProtocol<P> {
+    pub(crate) fn new(inner: P, faults: Arc<FaultInjector>) -> Self {
+        FaultyProtocol { inner, faults }
+    }
+}
+
+impl<P: iroh::protocol::ProtocolHandler + Clone> iroh::protocol::ProtocolHandler
+    for FaultyProtocol<P>
+{
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let this = self.clone();
+        Box::pin(async move {
+            let delay = this.faults.accept_delay();
+            if !delay.is_zero() {
+                tokio::time::sleep(delay).await;
+            }
+            if this.faults.is_offline() {
+                let conn = conn.await?;
+                conn.close(OFFLINE_CLOSE_CODE.into(), b"offline");
+                return Ok(());
+            }
+            this.inner.accept(conn).await
+        })
+    }
+
+    fn shutdown(&self) -> futures_lite::future::Boxed<()> {
+        self.inner.shutdown()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_fault_injector() {
+        let faults = FaultInjector::default();
+        assert!(!faults.is_offline());
+        assert_eq!(faults.accept_delay(), Duration::ZERO);
+
+        faults.set_offline(true);
+        faults.set_accept_delay(Duration::from_millis(250));
+        assert!(faults.is_offline());
+        assert_eq!(faults.accept_delay(), Duration::from_millis(250));
+
+        faults.set_accept_delay(Duration::MAX);
+        assert_eq!(faults.accept_delay(), Duration::from_millis(u64::MAX));
+
+        faults.clear();
+        assert!(!faults.is_offline());
+        assert_eq!(faults.accept_delay(), Duration::ZERO);
+    }
+}
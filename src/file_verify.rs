@@ -0,0 +1,152 @@
+use std::{io::Read, path::PathBuf, sync::Arc};
+
+use tokio::sync::mpsc;
+
+use crate::{CallbackError, Hash, IrohError};
+
+/// Size of the reads from the file.
+const READ_SIZE: usize = 64 * 1024;
+/// Progress is reported each time this many bytes were read.
+const PROGRESS_INTERVAL: u64 = 4 * 1024 * 1024;
+
+/// How far `verify_file_against_hash` got.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct VerifyFileProgress {
+    /// Bytes of the file hashed so far.
+    pub bytes_read: u64,
+    /// Size of the file when the verification started.
+    pub total_bytes: u64,
+}
+
+/// The result of `verify_file_against_hash`.
+#[derive(Debug, Clone, uniffi::Record)]
+pub struct VerifyFileOutcome {
+    /// Whether the file matches the expected hash.
+    pub matches: bool,
+    /// The hash of the file.
+    pub hash: Arc<Hash>,
+    /// Size of the file in bytes.
+    pub size: u64,
+}
+
+/// The `progress` method is called while `verify_file_against_hash` reads the file, at least
+/// once at the start and once at the end.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait VerifyFileCallback: Send + Sync + 'static {
+    async fn progress(&self, progress: VerifyFileProgress) -> Result<(), CallbackError>;
+}
+
+/// Check whether the file at `path` has the content of the blob `hash`, without adding it to a
+/// blob store or reading it into the memory of the application.
+///
+/// Does not need a node. Returning an error from the callback stops the verification and is
+/// returned from this function.
+#[uniffi::export(async_runtime = "tokio")]
+pub async fn verify_file_against_hash(
+    path: String,
+    hash: &Hash,
+    cb: Arc<dyn VerifyFileCallback>,
+) -> Result<VerifyFileOutcome, IrohError> {
+    let (progress_tx, mut progress) = mpsc::channel(4);
+    let task = tokio::task::spawn_blocking(move || hash_file(PathBuf::from(path), progress_tx));
+    while let Some(event) = progress.recv().await {
+        // dropping the receiver on error stops the hashing
+        cb.progress(event).await?;
+    }
+    let (actual, size) = task.await.map_err(anyhow::Error::from)??;
+    Ok(VerifyFileOutcome {
+        matches: actual == hash.0,
+        hash: Arc::new(actual.into()),
+        size,
+    })
+}
+
+/// Hash the file at `path` the way the blob store does, returning the hash and the number of
+/// bytes read.
+fn hash_file(
+    path: PathBuf,
+    progress: mpsc::Sender<VerifyFileProgress>,
+) -> anyhow::Result<(iroh_blobs::Hash, u64)> {
+    let mut file = std::fs::File::open(&path)?;
+    let total_bytes = file.metadata()?.len();
+    let report = |bytes_read| {
+        progress
+            .blocking_send(VerifyFileProgress {
+                bytes_read,
+                total_bytes,
+            })
+            .map_err(|_| anyhow::anyhow!("verification cancelled"))
+    };
+    report(0)?;
+    let mut hasher = blake3::Hasher::new();
+    let mut buf = vec![0u8; READ_SIZE];
+    let mut bytes_read = 0;
+    let mut reported = 0;
+    loop {
+        let n = match file.read(&mut buf) {
+            Ok(0) => break,
+            Ok(n) => n,
+            Err(err) if err.kind() == std::io::ErrorKind::Interrupted => continue,
+            Err(err) => return Err(err.into()),
+        };
+        hasher.update(&buf[..n]);
+        bytes_read += n as u64;
+        if bytes_read - reported >= PROGRESS_INTERVAL {
+            report(bytes_read)?;
+            reported = bytes_read;
+        }
+    }
+    if bytes_read != reported {
+        report(bytes_read)?;
+    }
+    let hash = iroh_blobs::Hash::from_bytes(*hasher.finalize().as_bytes());
+    Ok((hash, bytes_read))
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Mutex;
+
+    use super::*;
+
+    #[derive(Default)]
+    struct Recorder(Mutex<Vec<VerifyFileProgress>>);
+
+    #[async_trait::async_trait]
+    impl VerifyFileCallback for Recorder {
+        async fn progress(&self, progress: VerifyFileProgress) -> Result<(), CallbackError> {
+            self.0.lock().unwrap().push(progress);
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_verify_file_against_hash() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("data");
+        let data: Vec<u8> = (0..10_000_000u32).map(|i| i as u8).collect();
+        std::fs::write(&path, &data).unwrap();
+        let path = path.to_string_lossy().into_owned();
+
+        let expected = Hash::new(data);
+        let recorder = Arc::new(Recorder::default());
+        let outcome = verify_file_against_hash(path.clone(), &expected, recorder.clone())
+            .await
+            .unwrap();
+        assert!(outcome.matches);
+        assert!(outcome.hash.equal(&expected));
+        assert_eq!(outcome.size, 10_000_000);
+        let events = recorder.0.lock().unwrap().clone();
+        let read: Vec<u64> = events.iter().map(|event| event.bytes_read).collect();
+        assert_eq!(read, vec![0, 4194304, 8388608, 10_000_000]);
+        assert!(events.iter().all(|event| event.total_bytes == 10_000_000));
+
+        let other = Hash::new(b"something else".to_vec());
+        let outcome = verify_file_against_hash(path, &other, Arc::new(Recorder::default()))
+            .await
+            .unwrap();
+        assert!(!outcome.matches);
+        assert!(outcome.hash.equal(&expected));
+    }
+}
@@ -10,10 +10,11 @@ use tokio_util::sync::CancellationToken;
 use tracing::warn;
 
 use crate::node::Iroh;
-use crate::{CallbackError, IrohError};
+use crate::{instrument::CallTimer, CallbackError, IrohError};
 
 /// Gossip message
 #[derive(Debug, uniffi::Object)]
+#[uniffi::export(Display)]
 pub enum Message {
     /// We have a new, direct neighbor in the swarm membership layer for this topic
     NeighborUp(String),
@@ -33,7 +34,9 @@ pub enum Message {
     Error(String),
 }
 
-#[derive(Debug, uniffi::Enum)]
+crate::display_via_debug!(Message);
+
+#[derive(Debug, serde::Serialize, serde::Deserialize, uniffi::Enum)]
 pub enum MessageType {
     NeighborUp,
     NeighborDown,
@@ -43,6 +46,8 @@ pub enum MessageType {
     Error,
 }
 
+crate::display_via_debug!(MessageType);
+
 #[uniffi::export]
 impl Message {
     pub fn r#type(&self) -> MessageType {
@@ -226,22 +231,30 @@ impl Sender {
     /// Broadcast a message to all nodes in the swarm
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn broadcast(&self, msg: Vec<u8>) -> Result<(), IrohError> {
-        self.sink
+        let mut timer = CallTimer::start("sender.broadcast");
+        timer.payload(msg.len());
+        let res = self
+            .sink
             .lock()
             .await
             .send(SubscribeUpdate::Broadcast(msg.into()))
-            .await?;
+            .await;
+        timer.finish(res)?;
         Ok(())
     }
 
     /// Broadcast a message to all direct neighbors.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn broadcast_neighbors(&self, msg: Vec<u8>) -> Result<(), IrohError> {
-        self.sink
+        let mut timer = CallTimer::start("sender.broadcast_neighbors");
+        timer.payload(msg.len());
+        let res = self
+            .sink
             .lock()
             .await
             .send(SubscribeUpdate::BroadcastNeighbors(msg.into()))
-            .await?;
+            .await;
+        timer.finish(res)?;
         Ok(())
     }
 
@@ -0,0 +1,510 @@
+use std::{
+    collections::{BTreeSet, HashMap},
+    ops::Bound,
+    sync::{Arc, Mutex},
+};
+
+use serde::{de::DeserializeOwned, Deserialize, Serialize};
+
+use crate::{
+    acl::{Acl, AclAction},
+    Hash, IrohError, Net, NodeAddr,
+};
+
+/// ALPN of the protocol used to diff hash sets, see `Net.hash_set_diff`.
+pub(crate) const HASH_DIFF_ALPN: &[u8] = b"/iroh-ffi/hash-diff/0";
+
+const DEFAULT_LEAF_SIZE: u32 = 32;
+const DEFAULT_SPLIT_FACTOR: u32 = 16;
+const MAX_LEAF_SIZE: u32 = 1024;
+const MAX_SPLIT_FACTOR: u32 = 256;
+/// Number of ranges queried per round, further ranges wait for the next round.
+const MAX_QUERIES_PER_ROUND: usize = 256;
+/// Maximum size of a single protocol message.
+const MAX_MESSAGE_LEN: usize = 16 * 1024 * 1024;
+
+/// Options for `Net.hash_set_diff`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct HashSetDiffOptions {
+    /// Ranges holding up to this many hashes on the remote side are exchanged as a list
+    /// instead of being split further. Defaults to 32, at most 1024.
+    #[uniffi(default = None)]
+    pub leaf_size: Option<u32>,
+    /// Into how many ranges a differing range is split. Defaults to 16, between 2 and 256.
+    #[uniffi(default = None)]
+    pub split_factor: Option<u32>,
+}
+
+/// The difference between a local hash set and a hash set published by a peer.
+#[derive(Debug, uniffi::Record)]
+pub struct HashSetDiff {
+    /// Hashes the peer has, but the local set does not.
+    pub missing_local: Vec<Arc<Hash>>,
+    /// Hashes the local set has, but the peer does not.
+    pub missing_remote: Vec<Arc<Hash>>,
+    /// Number of round trips the diff took.
+    pub rounds: u32,
+}
+
+#[uniffi::export]
+impl Net {
+    /// Publish a set of hashes under `name`, for peers to diff their own sets against with
+    /// [`Self::hash_set_diff`]. Replaces a set published earlier under the same name.
+    ///
+    /// The hashes do not need to refer to blobs, any 32 byte values of the application work.
+    /// Published sets are not persisted.
+    pub fn publish_hash_set(&self, name: String, hashes: Vec<Arc<Hash>>) {
+        let set = hashes.iter().map(|hash| hash.0).collect();
+        self.hash_sets.publish(name, set);
+    }
+
+    /// Stop publishing the hash set `name`. Returns false if no such set was published.
+    pub fn unpublish_hash_set(&self, name: String) -> bool {
+        self.hash_sets.unpublish(&name)
+    }
+
+    /// Find the differences between `local` and the hash set `name` published by `peer`.
+    ///
+    /// Uses range based set reconciliation: both sides compare fingerprints of ranges of their
+    /// sets and only split and exchange the ranges that differ, so the amount of data exchanged
+    /// depends on the size of the difference rather than the size of the sets.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn hash_set_diff(
+        &self,
+        name: String,
+        local: Vec<Arc<Hash>>,
+        peer: &NodeAddr,
+        options: Option<HashSetDiffOptions>,
+    ) -> Result<HashSetDiff, IrohError> {
+        let options = options.unwrap_or_default();
+        let leaf_size = options.leaf_size.unwrap_or(DEFAULT_LEAF_SIZE);
+        let split_factor = options.split_factor.unwrap_or(DEFAULT_SPLIT_FACTOR);
+        check_parameters(leaf_size, split_factor)?;
+        let addr: iroh::NodeAddr = peer.clone().try_into()?;
+        let local = local.iter().map(|hash| hash.0).collect();
+        let conn = self
+            .peer_errors
+            .connect(&self.endpoint, addr, HASH_DIFF_ALPN, None)
+            .await?;
+        let res = diff(&conn, name, &local, leaf_size, split_factor).await;
+        conn.close(0u32.into(), b"done");
+        let diff = res?;
+        Ok(diff)
+    }
+}
+
+fn check_parameters(leaf_size: u32, split_factor: u32) -> anyhow::Result<()> {
+    anyhow::ensure!(
+        (1..=MAX_LEAF_SIZE).contains(&leaf_size),
+        "leaf size must be between 1 and {MAX_LEAF_SIZE}"
+    );
+    anyhow::ensure!(
+        (2..=MAX_SPLIT_FACTOR).contains(&split_factor),
+        "split factor must be between 2 and {MAX_SPLIT_FACTOR}"
+    );
+    Ok(())
+}
+
+/// The hash sets published by this node, see `Net.publish_hash_set`.
+#[derive(Debug, Default)]
+pub(crate) struct HashSets {
+    sets: Mutex<HashMap<String, Arc<BTreeSet<iroh_blobs::Hash>>>>,
+}
+
+impl HashSets {
+    fn publish(&self, name: String, set: BTreeSet<iroh_blobs::Hash>) {
+        let mut sets = self.sets.lock().expect("poisoned");
+        sets.insert(name, Arc::new(set));
+    }
+
+    fn unpublish(&self, name: &str) -> bool {
+        let mut sets = self.sets.lock().expect("poisoned");
+        sets.remove(name).is_some()
+    }
+
+    fn get(&self, name: &str) -> Option<Arc<BTreeSet<iroh_blobs::Hash>>> {
+        let sets = self.sets.lock().expect("poisoned");
+        sets.get(name).cloned()
+    }
+}
+
+/// A range of hashes, from `lo` inclusive to `hi` exclusive, or to the end if `hi` is `None`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+struct HashRange {
+    lo: iroh_blobs::Hash,
+    hi: Option<iroh_blobs::Hash>,
+}
+
+impl HashRange {
+    fn all() -> Self {
+        HashRange {
+            lo: iroh_blobs::Hash::from_bytes([0u8; 32]),
+            hi: None,
+        }
+    }
+
+    fn items<'a>(
+        &self,
+        set: &'a BTreeSet<iroh_blobs::Hash>,
+    ) -> impl Iterator<Item = &'a iroh_blobs::Hash> {
+        let hi = match self.hi {
+            Some(hi) => Bound::Excluded(hi),
+            None => Bound::Unbounded,
+        };
+        set.range((Bound::Included(self.lo), hi))
+    }
+}
+
+/// Summary of the hashes in a range: their count and the XOR of the blake3 hashes of their
+/// bytes.
+///
+/// The values are chosen by the application, hashing them first keeps different sets from
+/// having the same XOR, as they easily do with the raw values.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+struct Fingerprint {
+    xor: [u8; 32],
+    count: u64,
+}
+
+impl Fingerprint {
+    fn of<'a>(hashes: impl IntoIterator<Item = &'a iroh_blobs::Hash>) -> Self {
+        let mut fingerprint = Fingerprint::default();
+        for hash in hashes {
+            let hashed = blake3::hash(hash.as_bytes());
+            for (acc, byte) in fingerprint.xor.iter_mut().zip(hashed.as_bytes()) {
+                *acc ^= byte;
+            }
+            fingerprint.count += 1;
+        }
+        fingerprint
+    }
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+enum Request {
+    Start {
+        name: String,
+        leaf_size: u32,
+        split_factor: u32,
+    },
+    Round(Vec<RangeQuery>),
+}
+
+/// The fingerprint of a range on the querying side.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+struct RangeQuery {
+    range: HashRange,
+    fingerprint: Fingerprint,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+enum Response {
+    Started,
+    Denied(String),
+    /// One reply per query of the round, in order.
+    Round(Vec<RangeReply>),
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+enum RangeReply {
+    /// The range holds the same hashes on both sides.
+    Equal,
+    /// All hashes of the range on the replying side.
+    Items(Vec<iroh_blobs::Hash>),
+    /// The range split into subranges, with their fingerprints on the replying side.
+    Split(Vec<RangeQuery>),
+}
+
+/// Answer a range query against `set`.
+fn reply(
+    set: &BTreeSet<iroh_blobs::Hash>,
+    query: &RangeQuery,
+    leaf_size: u32,
+    split_factor: u32,
+) -> RangeReply {
+    let items: Vec<_> = query.range.items(set).copied().collect();
+    if Fingerprint::of(&items) == query.fingerprint {
+        return RangeReply::Equal;
+    }
+    if items.len() <= leaf_size as usize {
+        return RangeReply::Items(items);
+    }
+    // split into ranges of about the same number of items, covering the whole queried range
+    let chunk = items.len().div_ceil(split_factor as usize);
+    let subranges = (0..items.len())
+        .step_by(chunk)
+        .map(|start| {
+            let end = (start + chunk).min(items.len());
+            let lo = if start == 0 {
+                query.range.lo
+            } else {
+                items[start]
+            };
+            let hi = if end == items.len() {
+                query.range.hi
+            } else {
+                Some(items[end])
+            };
+            RangeQuery {
+                range: HashRange { lo, hi },
+                fingerprint: Fingerprint::of(&items[start..end]),
+            }
+        })
+        .collect();
+    RangeReply::Split(subranges)
+}
+
+/// Run the diff of `local` against the set `name` of the peer on `conn`.
+async fn diff(
+    conn: &iroh::endpoint::Connection,
+    name: String,
+    local: &BTreeSet<iroh_blobs::Hash>,
+    leaf_size: u32,
+    split_factor: u32,
+) -> anyhow::Result<HashSetDiff> {
+    let (mut send, mut recv) = conn.open_bi().await?;
+    let start = Request::Start {
+        name,
+        leaf_size,
+        split_factor,
+    };
+    write_message(&mut send, &start).await?;
+    match read_message(&mut recv).await? {
+        Some(Response::Started) => {}
+        Some(Response::Denied(reason)) => anyhow::bail!("peer denied the diff: {reason}"),
+        _ => anyhow::bail!("unexpected response from peer"),
+    }
+
+    let mut missing_local = Vec::new();
+    let mut missing_remote = Vec::new();
+    let mut rounds = 0;
+    let mut pending = vec![RangeQuery {
+        range: HashRange::all(),
+        fingerprint: Fingerprint::of(local),
+    }];
+    while !pending.is_empty() {
+        let batch: Vec<_> = pending
+            .drain(..pending.len().min(MAX_QUERIES_PER_ROUND))
+            .collect();
+        write_message(&mut send, &Request::Round(batch.clone())).await?;
+        let Some(Response::Round(replies)) = read_message(&mut recv).await? else {
+            anyhow::bail!("unexpected response from peer");
+        };
+        anyhow::ensure!(replies.len() == batch.len(), "peer skipped ranges");
+        rounds += 1;
+        for (query, reply) in batch.iter().zip(replies) {
+            match reply {
+                RangeReply::Equal => {}
+                RangeReply::Items(remote) => {
+                    let remote: BTreeSet<_> = remote.into_iter().collect();
+                    let ours: BTreeSet<_> = query.range.items(local).copied().collect();
+                    missing_local.extend(remote.difference(&ours).copied());
+                    missing_remote.extend(ours.difference(&remote).copied());
+                }
+                RangeReply::Split(subranges) => {
+                    for subrange in subranges {
+                        let fingerprint = Fingerprint::of(subrange.range.items(local));
+                        if fingerprint != subrange.fingerprint {
+                            pending.push(RangeQuery {
+                                range: subrange.range,
+                                fingerprint,
+                            });
+                        }
+                    }
+                }
+            }
+        }
+    }
+    send.finish()?;
+
+    let wrap = |hashes: Vec<iroh_blobs::Hash>| {
+        hashes
+            .into_iter()
+            .map(|hash| Arc::new(Hash(hash)))
+            .collect()
+    };
+    Ok(HashSetDiff {
+        missing_local: wrap(missing_local),
+        missing_remote: wrap(missing_remote),
+        rounds,
+    })
+}
+
+/// Answers diff requests against the published hash sets, see `Net.hash_set_diff`.
+#[derive(Debug, Clone)]
+pub(crate) struct HashDiffProtocol {
+    sets: Arc<HashSets>,
+    acl: Arc<Acl>,
+}
+
+impl HashDiffProtocol {
+    pub(crate) fn new(sets: Arc<HashSets>, acl: Arc<Acl>) -> Self {
+        Self { sets, acl }
+    }
+}
+
+impl iroh::protocol::ProtocolHandler for HashDiffProtocol {
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let sets = self.sets.clone();
+        let acl = self.acl.clone();
+        Box::pin(async move {
+            let conn = conn.await?;
+            if !acl.admit(&conn, AclAction::Connect)? {
+                return Ok(());
+            }
+            let (mut send, mut recv) = conn.accept_bi().await?;
+            let Some(Request::Start {
+                name,
+                leaf_size,
+                split_factor,
+            }) = read_message(&mut recv).await?
+            else {
+                anyhow::bail!("expected a start request");
+            };
+            let set = match check_parameters(leaf_size, split_factor) {
+                Err(err) => Err(err.to_string()),
+                Ok(()) => sets
+                    .get(&name)
+                    .ok_or_else(|| format!("no hash set named {name:?}")),
+            };
+            let set = match set {
+                Ok(set) => set,
+                Err(reason) => {
+                    write_message(&mut send, &Response::Denied(reason)).await?;
+                    send.finish()?;
+                    conn.closed().await;
+                    return Ok(());
+                }
+            };
+            write_message(&mut send, &Response::Started).await?;
+            while let Some(request) = read_message(&mut recv).await? {
+                let Request::Round(queries) = request else {
+                    anyhow::bail!("unexpected request");
+                };
+                anyhow::ensure!(queries.len() <= MAX_QUERIES_PER_ROUND, "too many ranges");
+                let replies = queries
+                    .iter()
+                    .map(|query| reply(&set, query, leaf_size, split_factor))
+                    .collect();
+                write_message(&mut send, &Response::Round(replies)).await?;
+            }
+            send.finish()?;
+            conn.closed().await;
+            Ok(())
+        })
+    }
+}
+
+/// Write a length prefixed message.
+async fn write_message<T: Serialize>(
+    send: &mut iroh::endpoint::SendStream,
+    message: &T,
+) -> anyhow::Result<()> {
+    let bytes = postcard::to_stdvec(message)?;
+    anyhow::ensure!(bytes.len() <= MAX_MESSAGE_LEN, "message too large");
+    send.write_all(&(bytes.len() as u32).to_be_bytes()).await?;
+    send.write_all(&bytes).await?;
+    Ok(())
+}
+
+/// Read a length prefixed message, or `None` if the stream was finished.
+async fn read_message<T: DeserializeOwned>(
+    recv: &mut iroh::endpoint::RecvStream,
+) -> anyhow::Result<Option<T>> {
+    let mut len = [0u8; 4];
+    match recv.read_exact(&mut len).await {
+        Ok(()) => {}
+        Err(iroh::endpoint::ReadExactError::FinishedEarly(0)) => return Ok(None),
+        Err(err) => return Err(err.into()),
+    }
+    let len = u32::from_be_bytes(len) as usize;
+    anyhow::ensure!(len <= MAX_MESSAGE_LEN, "message too large");
+    let mut bytes = vec![0u8; len];
+    recv.read_exact(&mut bytes).await?;
+    let message = postcard::from_bytes(&bytes)?;
+    Ok(Some(message))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    fn hashes(range: std::ops::Range<u32>) -> Vec<Arc<Hash>> {
+        range
+            .map(|i| Arc::new(Hash(iroh_blobs::Hash::new(i.to_be_bytes()))))
+            .collect()
+    }
+
+    #[test]
+    fn test_fingerprint() {
+        let value = |i: u8| {
+            let mut bytes = [0u8; 32];
+            bytes[31] = i;
+            iroh_blobs::Hash::from_bytes(bytes)
+        };
+        // both XOR to 3 as raw values
+        let a = Fingerprint::of(&[value(1), value(2)]);
+        let b = Fingerprint::of(&[value(0), value(3)]);
+        assert_eq!(a.count, b.count);
+        assert_ne!(a, b);
+        assert_eq!(a, Fingerprint::of(&[value(2), value(1)]));
+    }
+
+    #[tokio::test]
+    async fn test_hash_set_diff() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let addr = node_1.net().node_addr().await.unwrap();
+
+        // the peer has 0..1000 and 2000..2005, we have 5..1000 and 1000..1010
+        let mut remote = hashes(0..1000);
+        remote.extend(hashes(2000..2005));
+        node_1.net().publish_hash_set("index".to_string(), remote);
+        let mut local = hashes(5..1000);
+        local.extend(hashes(1000..1010));
+
+        let options = HashSetDiffOptions {
+            leaf_size: Some(4),
+            split_factor: Some(4),
+        };
+        let diff = node_0
+            .net()
+            .hash_set_diff("index".to_string(), local.clone(), &addr, Some(options))
+            .await
+            .unwrap();
+        let sorted = |hashes: &[Arc<Hash>]| {
+            let mut hashes: Vec<_> = hashes.iter().map(|hash| hash.0).collect();
+            hashes.sort();
+            hashes
+        };
+        let mut expected_local = hashes(0..5);
+        expected_local.extend(hashes(2000..2005));
+        assert_eq!(sorted(&diff.missing_local), sorted(&expected_local));
+        assert_eq!(sorted(&diff.missing_remote), sorted(&hashes(1000..1010)));
+        assert!(diff.rounds > 1);
+
+        // equal sets are done after one round
+        node_1
+            .net()
+            .publish_hash_set("index".to_string(), local.clone());
+        let diff = node_0
+            .net()
+            .hash_set_diff("index".to_string(), local.clone(), &addr, None)
+            .await
+            .unwrap();
+        assert!(diff.missing_local.is_empty());
+        assert!(diff.missing_remote.is_empty());
+        assert_eq!(diff.rounds, 1);
+
+        assert!(node_1.net().unpublish_hash_set("index".to_string()));
+        let res = node_0
+            .net()
+            .hash_set_diff("index".to_string(), local, &addr, None)
+            .await;
+        assert!(res.is_err());
+    }
+}
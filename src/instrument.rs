@@ -0,0 +1,276 @@
+use std::{
+    collections::BTreeMap,
+    fmt::Write,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Mutex,
+    },
+    time::{Duration, Instant},
+};
+
+/// Upper bounds of the latency histogram buckets, in seconds.
+const LATENCY_BUCKETS: [f64; 12] = [
+    0.0001, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 5.0,
+];
+
+static ENABLED: AtomicBool = AtomicBool::new(false);
+static CALLS: CallRegistry = CallRegistry::new();
+
+/// The statistics of all instrumented methods, see [`call_metrics`].
+///
+/// The exported functions use a process wide registry, tests use their own so they do not
+/// see the calls of other tests running in parallel.
+struct CallRegistry(Mutex<BTreeMap<&'static str, CallRecord>>);
+
+#[derive(Debug, Default, Clone)]
+struct CallRecord {
+    count: u64,
+    errors: u64,
+    latency_sum: Duration,
+    buckets: [u64; LATENCY_BUCKETS.len()],
+    payload_bytes: u64,
+}
+
+impl CallRecord {
+    fn observe(&mut self, elapsed: Duration, payload: u64, is_err: bool) {
+        self.count += 1;
+        if is_err {
+            self.errors += 1;
+        }
+        self.latency_sum += elapsed;
+        self.payload_bytes += payload;
+        let secs = elapsed.as_secs_f64();
+        for (bucket, bound) in self.buckets.iter_mut().zip(LATENCY_BUCKETS.iter()) {
+            if secs <= *bound {
+                *bucket += 1;
+            }
+        }
+    }
+}
+
+/// Statistics collected for a single FFI method.
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct CallStats {
+    /// The name of the method, e.g. `blobs.add_bytes`.
+    pub method: String,
+    /// How often the method was called.
+    pub count: u64,
+    /// How many of the calls returned an error.
+    pub errors: u64,
+    /// The total time spent in the method.
+    pub latency_sum: Duration,
+    /// The total number of payload bytes passed in or returned.
+    pub payload_bytes: u64,
+}
+
+/// Enable or disable the recording of FFI call statistics.
+///
+/// Recording is disabled by default. Enabling it adds a small, constant overhead to every
+/// instrumented call. The instrumented calls are the ones moving data or doing I/O:
+///
+/// - blobs: `add_bytes`, `add_bytes_named`, `read_to_bytes`, `read_at_to_bytes`, `download`,
+///   `export`, `delete_blob` and `BlobWriter.write`
+/// - docs: `Docs.create`, `Docs.join`, `Docs.open`, `Doc.set_bytes`, `Doc.set_hash`,
+///   `Doc.delete`, `Doc.get_exact`, `Doc.get_one` and `Doc.get_many`
+/// - connections: `SendStream.write`, `SendStream.write_all`, `RecvStream.read` and
+///   `RecvStream.read_exact`
+/// - gossip: `Sender.broadcast` and `Sender.broadcast_neighbors`
+///
+/// The statistics are shared by all nodes of the process.
+#[uniffi::export]
+pub fn set_call_metrics_enabled(enabled: bool) {
+    ENABLED.store(enabled, Ordering::Relaxed);
+}
+
+/// Get the statistics recorded for every instrumented method that was called at least once.
+#[uniffi::export]
+pub fn call_metrics() -> Vec<CallStats> {
+    CALLS.stats()
+}
+
+/// Render the recorded call statistics in the Prometheus text exposition format.
+///
+/// Latencies are exported as the `iroh_ffi_call_duration_seconds` histogram, payload sizes as
+/// the `iroh_ffi_call_payload_bytes_total` counter, both labeled with the method name.
+#[uniffi::export]
+pub fn call_metrics_prometheus() -> String {
+    CALLS.prometheus()
+}
+
+/// Clear all recorded call statistics.
+#[uniffi::export]
+pub fn reset_call_metrics() {
+    CALLS.0.lock().expect("poisoned").clear();
+}
+
+impl CallRegistry {
+    const fn new() -> Self {
+        CallRegistry(Mutex::new(BTreeMap::new()))
+    }
+
+    fn observe(&self, method: &'static str, elapsed: Duration, payload: u64, is_err: bool) {
+        let mut calls = self.0.lock().expect("poisoned");
+        calls
+            .entry(method)
+            .or_default()
+            .observe(elapsed, payload, is_err);
+    }
+
+    fn stats(&self) -> Vec<CallStats> {
+        let calls = self.0.lock().expect("poisoned");
+        calls
+            .iter()
+            .map(|(method, record)| CallStats {
+                method: method.to_string(),
+                count: record.count,
+                errors: record.errors,
+                latency_sum: record.latency_sum,
+                payload_bytes: record.payload_bytes,
+            })
+            .collect()
+    }
+
+    fn prometheus(&self) -> String {
+        let calls = self.0.lock().expect("poisoned");
+        let mut out = String::new();
+
+        out.push_str("# HELP iroh_ffi_call_duration_seconds Latency of FFI calls.\n");
+        out.push_str("# TYPE iroh_ffi_call_duration_seconds histogram\n");
+        for (method, record) in calls.iter() {
+            for (bound, count) in LATENCY_BUCKETS.iter().zip(record.buckets.iter()) {
+                writeln!(
+                out,
+                "iroh_ffi_call_duration_seconds_bucket{{method=\"{method}\",le=\"{bound}\"}} {count}"
+            )
+            .ok();
+            }
+            writeln!(
+                out,
+                "iroh_ffi_call_duration_seconds_bucket{{method=\"{method}\",le=\"+Inf\"}} {}",
+                record.count
+            )
+            .ok();
+            writeln!(
+                out,
+                "iroh_ffi_call_duration_seconds_sum{{method=\"{method}\"}} {}",
+                record.latency_sum.as_secs_f64()
+            )
+            .ok();
+            writeln!(
+                out,
+                "iroh_ffi_call_duration_seconds_count{{method=\"{method}\"}} {}",
+                record.count
+            )
+            .ok();
+        }
+
+        out.push_str(
+            "# HELP iroh_ffi_call_errors_total Number of FFI calls that returned an error.\n",
+        );
+        out.push_str("# TYPE iroh_ffi_call_errors_total counter\n");
+        for (method, record) in calls.iter() {
+            writeln!(
+                out,
+                "iroh_ffi_call_errors_total{{method=\"{method}\"}} {}",
+                record.errors
+            )
+            .ok();
+        }
+
+        out.push_str(
+            "# HELP iroh_ffi_call_payload_bytes_total Payload bytes passed through FFI calls.\n",
+        );
+        out.push_str("# TYPE iroh_ffi_call_payload_bytes_total counter\n");
+        for (method, record) in calls.iter() {
+            writeln!(
+                out,
+                "iroh_ffi_call_payload_bytes_total{{method=\"{method}\"}} {}",
+                record.payload_bytes
+            )
+            .ok();
+        }
+
+        out
+    }
+}
+
+/// Measures a single call of an instrumented method.
+///
+/// Create it at the start of the method and call [`CallTimer::finish`] with the result.
+pub(crate) struct CallTimer {
+    method: &'static str,
+    start: Option<Instant>,
+    payload: u64,
+}
+
+impl CallTimer {
+    pub(crate) fn start(method: &'static str) -> Self {
+        let start = ENABLED.load(Ordering::Relaxed).then(Instant::now);
+        CallTimer {
+            method,
+            start,
+            payload: 0,
+        }
+    }
+
+    /// Add `len` bytes to the payload size of this call.
+    pub(crate) fn payload(&mut self, len: usize) {
+        self.payload += len as u64;
+    }
+
+    /// Run the call, recording it once `fut` is done.
+    pub(crate) async fn run<T, E>(
+        self,
+        fut: impl std::future::Future<Output = Result<T, E>>,
+    ) -> Result<T, E> {
+        let res = fut.await;
+        self.finish(res)
+    }
+
+    /// Record the call, passing through its result.
+    pub(crate) fn finish<T, E>(self, res: Result<T, E>) -> Result<T, E> {
+        if let Some(start) = self.start {
+            CALLS.observe(self.method, start.elapsed(), self.payload, res.is_err());
+        }
+        res
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_call_record_buckets() {
+        let mut record = CallRecord::default();
+        record.observe(Duration::from_millis(3), 10, false);
+        record.observe(Duration::from_secs(2), 5, true);
+
+        assert_eq!(record.count, 2);
+        assert_eq!(record.errors, 1);
+        assert_eq!(record.payload_bytes, 15);
+        // 3ms fits into every bucket from 5ms upwards
+        assert_eq!(record.buckets[2], 0);
+        assert_eq!(record.buckets[3], 1);
+        // 2s only fits into the largest bucket
+        assert_eq!(record.buckets[10], 1);
+        assert_eq!(record.buckets[11], 2);
+    }
+
+    #[test]
+    fn test_call_metrics_prometheus() {
+        // a registry of its own, the global one records the calls of all tests
+        let calls = CallRegistry::new();
+        calls.observe("test.prometheus", Duration::from_millis(1), 42, false);
+
+        let stats = calls.stats();
+        assert_eq!(stats.len(), 1);
+        assert_eq!(stats[0].method, "test.prometheus");
+        assert_eq!(stats[0].count, 1);
+        assert_eq!(stats[0].payload_bytes, 42);
+
+        let text = calls.prometheus();
+        assert!(text.contains("iroh_ffi_call_duration_seconds_count{method=\"test.prometheus\"} 1"));
+        assert!(text.contains("iroh_ffi_call_payload_bytes_total{method=\"test.prometheus\"} 42"));
+    }
+}
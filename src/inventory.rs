@@ -0,0 +1,215 @@
+use std::sync::Arc;
+
+use data_encoding::HEXLOWER;
+use futures::TryStreamExt;
+use serde::Serialize;
+
+use crate::{CallbackError, Iroh, IrohError};
+
+/// Receives the lines of `Iroh.export_inventory`.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait InventoryCallback: Send + Sync + 'static {
+    /// One JSON object, ending with a newline.
+    async fn write(&self, line: Vec<u8>) -> Result<(), CallbackError>;
+}
+
+/// The number of records written by `Iroh.export_inventory`, per type.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct InventorySummary {
+    pub blobs: u64,
+    pub tags: u64,
+    pub docs: u64,
+    pub entries: u64,
+}
+
+#[uniffi::export]
+impl Iroh {
+    /// Write a listing of everything stored on this node as newline delimited JSON.
+    ///
+    /// Each line is an object with a `type` field:
+    /// - `blob`: `hash`, `size` and `complete`, with `expected_size` for incomplete blobs
+    /// - `tag`: `name`, `hash` and `format`, either `raw` or `hash_seq`
+    /// - `doc`: `id` and `capability`, either `write` or `read`
+    /// - `entry`: `doc`, `author`, `key`, `hash`, `len` and `timestamp`, for the entries of
+    ///   each document right after its `doc` line, without deleted entries
+    ///
+    /// Tag names and entry keys are hex encoded, as they do not need to be text. The listing
+    /// is written while the stores are read, so it is never held in memory as a whole, and
+    /// changes made meanwhile may or may not show up. Returning an error from the callback
+    /// stops the export.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn export_inventory(
+        &self,
+        cb: Arc<dyn InventoryCallback>,
+    ) -> Result<InventorySummary, IrohError> {
+        let mut summary = InventorySummary::default();
+
+        let mut blobs = self.blobs_client.list().await?;
+        while let Some(blob) = blobs.try_next().await? {
+            write(
+                &cb,
+                &Record::Blob {
+                    hash: blob.hash.to_string(),
+                    size: blob.size,
+                    complete: true,
+                    expected_size: None,
+                },
+            )
+            .await?;
+            summary.blobs += 1;
+        }
+        let mut blobs = self.blobs_client.list_incomplete().await?;
+        while let Some(blob) = blobs.try_next().await? {
+            write(
+                &cb,
+                &Record::Blob {
+                    hash: blob.hash.to_string(),
+                    size: blob.size,
+                    complete: false,
+                    expected_size: Some(blob.expected_size),
+                },
+            )
+            .await?;
+            summary.blobs += 1;
+        }
+
+        let mut tags = self.blobs_client.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            let format = match tag.format {
+                iroh_blobs::BlobFormat::Raw => "raw",
+                iroh_blobs::BlobFormat::HashSeq => "hash_seq",
+            };
+            write(
+                &cb,
+                &Record::Tag {
+                    name: HEXLOWER.encode(&tag.name.0),
+                    hash: tag.hash.to_string(),
+                    format,
+                },
+            )
+            .await?;
+            summary.tags += 1;
+        }
+
+        let Some(docs) = &self.docs_client else {
+            return Ok(summary);
+        };
+        let namespaces: Vec<_> = docs.list().await?.try_collect().await?;
+        for (namespace, capability) in namespaces {
+            let capability = match capability {
+                iroh_docs::CapabilityKind::Write => "write",
+                iroh_docs::CapabilityKind::Read => "read",
+            };
+            let id = namespace.to_string();
+            write(
+                &cb,
+                &Record::Doc {
+                    id: id.clone(),
+                    capability,
+                },
+            )
+            .await?;
+            summary.docs += 1;
+
+            let Some(doc) = docs.open(namespace).await? else {
+                continue;
+            };
+            let mut entries = doc.get_many(iroh_docs::store::Query::all().build()).await?;
+            while let Some(entry) = entries.try_next().await? {
+                write(
+                    &cb,
+                    &Record::Entry {
+                        doc: id.clone(),
+                        author: entry.author().to_string(),
+                        key: HEXLOWER.encode(entry.key()),
+                        hash: entry.content_hash().to_string(),
+                        len: entry.content_len(),
+                        timestamp: entry.timestamp(),
+                    },
+                )
+                .await?;
+                summary.entries += 1;
+            }
+        }
+        Ok(summary)
+    }
+}
+
+/// A line of the inventory.
+#[derive(Debug, Serialize)]
+#[serde(tag = "type", rename_all = "snake_case")]
+enum Record {
+    Blob {
+        hash: String,
+        size: u64,
+        complete: bool,
+        #[serde(skip_serializing_if = "Option::is_none")]
+        expected_size: Option<u64>,
+    },
+    Tag {
+        name: String,
+        hash: String,
+        format: &'static str,
+    },
+    Doc {
+        id: String,
+        capability: &'static str,
+    },
+    Entry {
+        doc: String,
+        author: String,
+        key: String,
+        hash: String,
+        len: u64,
+        timestamp: u64,
+    },
+}
+
+async fn write(cb: &Arc<dyn InventoryCallback>, record: &Record) -> Result<(), IrohError> {
+    let mut line = serde_json::to_vec(record).map_err(anyhow::Error::from)?;
+    line.push(b'\n');
+    cb.write(line).await?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_node, Collect};
+
+    #[tokio::test]
+    async fn test_export_inventory() {
+        let node = local_node().await;
+        let blob = node.blobs().add_bytes(b"blob".to_vec()).await.unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+
+        let cb = Arc::new(Collect::<Vec<u8>>::default());
+        let summary = node.export_inventory(cb.clone()).await.unwrap();
+        assert_eq!(summary.docs, 1);
+        assert_eq!(summary.entries, 1);
+
+        let output = cb.items().concat();
+        let lines: Vec<serde_json::Value> = output
+            .split(|b| *b == b'\n')
+            .filter(|line| !line.is_empty())
+            .map(|line| serde_json::from_slice(line).unwrap())
+            .collect();
+        let total = summary.blobs + summary.tags + summary.docs + summary.entries;
+        assert_eq!(lines.len() as u64, total);
+        assert!(lines.iter().any(|line| line["type"] == "blob"
+            && line["hash"] == blob.hash.to_string()
+            && line["complete"] == true));
+        assert!(lines
+            .iter()
+            .any(|line| line["type"] == "tag" && line["name"] == HEXLOWER.encode(&blob.tag)));
+        let entry = lines.iter().find(|line| line["type"] == "entry").unwrap();
+        assert_eq!(entry["doc"], doc.id());
+        assert_eq!(entry["key"], HEXLOWER.encode(b"key"));
+        assert_eq!(entry["len"], 5);
+    }
+}
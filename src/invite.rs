@@ -0,0 +1,339 @@
+use std::{
+    collections::HashMap,
+    str::FromStr,
+    sync::{Arc, Mutex},
+    time::SystemTime,
+};
+
+use serde::{Deserialize, Serialize};
+
+use crate::{
+    acl::{Acl, AclAction},
+    DocsClient, IrohError,
+};
+
+/// ALPN of the protocol used to redeem a [`DocInvite`].
+pub(crate) const DOC_INVITE_ALPN: &[u8] = b"/iroh-ffi/doc-invite/0";
+
+/// Prefix of the string form of a [`DocInvite`].
+const DOC_INVITE_PREFIX: &str = "docinvite";
+
+/// Size of an invite token, which is also the size of a redeem request.
+const DOC_INVITE_TOKEN_LEN: usize = 32;
+/// Maximum size of a redeem response: a status byte, followed by a doc ticket or an error
+/// message.
+const DOC_INVITE_MAX_RESPONSE: usize = 64 * 1024;
+
+const DOC_INVITE_GRANTED: u8 = 0;
+const DOC_INVITE_DENIED: u8 = 1;
+
+/// Options for `Doc.share_with_options`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct ShareOptions {
+    /// The invitation can no longer be redeemed after this time. Never expires if not set.
+    #[uniffi(default = None)]
+    pub expires_at: Option<SystemTime>,
+    /// How often the invitation can be redeemed, at least once. Unlimited if not set.
+    #[uniffi(default = None)]
+    pub max_uses: Option<u32>,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+struct InviteData {
+    issuer: iroh::NodeAddr,
+    namespace: iroh_docs::NamespaceId,
+    token: [u8; DOC_INVITE_TOKEN_LEN],
+    expires_at: Option<SystemTime>,
+}
+
+/// An invitation to a document, created with `Doc.share_with_options`.
+///
+/// Unlike a [`crate::DocTicket`] it does not contain the capability for the document. The
+/// capability is handed out by the issuing node when the invitation is redeemed with
+/// `Docs.redeem_invite`, as long as the invitation has not expired or been used up. The issuer
+/// has to be online for that.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Object)]
+#[uniffi::export(Display)]
+pub struct DocInvite(InviteData);
+
+#[uniffi::export]
+impl DocInvite {
+    /// Parse an invitation from its string form.
+    #[uniffi::constructor]
+    pub fn new(str: String) -> Result<Self, IrohError> {
+        let data = str
+            .strip_prefix(DOC_INVITE_PREFIX)
+            .ok_or_else(|| anyhow::anyhow!("not a doc invite"))?;
+        let bytes = data_encoding::BASE32_NOPAD
+            .decode(data.to_ascii_uppercase().as_bytes())
+            .map_err(anyhow::Error::from)?;
+        let data = postcard::from_bytes(&bytes).map_err(anyhow::Error::from)?;
+        Ok(DocInvite(data))
+    }
+
+    /// The id of the document this invitation is for.
+    pub fn doc_id(&self) -> String {
+        self.0.namespace.to_string()
+    }
+
+    /// When the invitation expires, if it does.
+    pub fn expires_at(&self) -> Option<SystemTime> {
+        self.0.expires_at
+    }
+}
+
+impl std::fmt::Display for DocInvite {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        let bytes = postcard::to_stdvec(&self.0).expect("serializable");
+        let data = data_encoding::BASE32_NOPAD.encode(&bytes);
+        write!(f, "{DOC_INVITE_PREFIX}{}", data.to_ascii_lowercase())
+    }
+}
+
+/// An invitation issued by this node that was not used up yet.
+#[derive(Debug, Clone)]
+struct PendingInvite {
+    namespace: iroh_docs::NamespaceId,
+    mode: iroh_docs::rpc::client::docs::ShareMode,
+    expires_at: Option<SystemTime>,
+    /// Uses left, not counting the redemptions in progress.
+    remaining_uses: Option<u32>,
+    /// Redemptions that were admitted but did not produce a ticket yet.
+    redeeming: u32,
+}
+
+/// The invitations issued by a node.
+///
+/// Invitations are only kept in memory, they can no longer be redeemed once the issuing node
+/// restarts.
+#[derive(Debug, Default)]
+pub(crate) struct DocInvites {
+    pending: Mutex<HashMap<[u8; DOC_INVITE_TOKEN_LEN], PendingInvite>>,
+}
+
+impl DocInvites {
+    /// Issue an invitation to `namespace` from the node at `issuer`.
+    pub(crate) fn issue(
+        &self,
+        issuer: iroh::NodeAddr,
+        namespace: iroh_docs::NamespaceId,
+        mode: iroh_docs::rpc::client::docs::ShareMode,
+        options: &ShareOptions,
+    ) -> anyhow::Result<DocInvite> {
+        anyhow::ensure!(options.max_uses != Some(0), "max_uses must be at least 1");
+        let token: [u8; DOC_INVITE_TOKEN_LEN] = rand::random();
+        self.pending.lock().expect("poisoned").insert(
+            token,
+            PendingInvite {
+                namespace,
+                mode,
+                expires_at: options.expires_at,
+                remaining_uses: options.max_uses,
+                redeeming: 0,
+            },
+        );
+        Ok(DocInvite(InviteData {
+            issuer,
+            namespace,
+            token,
+            expires_at: options.expires_at,
+        }))
+    }
+
+    /// Start to redeem the invitation `token` at time `now`, reserving one of its uses.
+    ///
+    /// Every successful call has to be followed by [`DocInvites::finish`].
+    fn start_redeem(
+        &self,
+        token: &[u8; DOC_INVITE_TOKEN_LEN],
+        now: SystemTime,
+    ) -> anyhow::Result<(
+        iroh_docs::NamespaceId,
+        iroh_docs::rpc::client::docs::ShareMode,
+    )> {
+        let mut pending = self.pending.lock().expect("poisoned");
+        let invite = pending
+            .get_mut(token)
+            .filter(|invite| invite.remaining_uses != Some(0))
+            .ok_or_else(|| anyhow::anyhow!("unknown or used up invitation"))?;
+        if invite
+            .expires_at
+            .is_some_and(|expires_at| now >= expires_at)
+        {
+            pending.remove(token);
+            anyhow::bail!("invitation expired");
+        }
+        if let Some(remaining) = invite.remaining_uses.as_mut() {
+            *remaining -= 1;
+        }
+        invite.redeeming += 1;
+        Ok((invite.namespace, invite.mode.clone()))
+    }
+
+    /// Finish a redemption started with [`DocInvites::start_redeem`]. The reserved use is
+    /// only consumed if the redemption `succeeded`.
+    fn finish(&self, token: &[u8; DOC_INVITE_TOKEN_LEN], succeeded: bool) {
+        let mut pending = self.pending.lock().expect("poisoned");
+        let Some(invite) = pending.get_mut(token) else {
+            return;
+        };
+        invite.redeeming -= 1;
+        if !succeeded {
+            if let Some(remaining) = invite.remaining_uses.as_mut() {
+                *remaining += 1;
+            }
+        }
+        if invite.remaining_uses == Some(0) && invite.redeeming == 0 {
+            pending.remove(token);
+        }
+    }
+}
+
+/// Hands out doc tickets for invitations, see [`DocInvite`].
+#[derive(derive_more::Debug, Clone)]
+pub(crate) struct DocInviteProtocol {
+    invites: Arc<DocInvites>,
+    #[debug("DocsClient")]
+    docs: DocsClient,
+    acl: Arc<Acl>,
+}
+
+impl DocInviteProtocol {
+    pub(crate) fn new(invites: Arc<DocInvites>, docs: DocsClient, acl: Arc<Acl>) -> Self {
+        Self { invites, docs, acl }
+    }
+
+    /// Redeem the invitation in `request`, returning the ticket for the document.
+    async fn handle(&self, request: &[u8]) -> anyhow::Result<iroh_docs::DocTicket> {
+        let token: [u8; DOC_INVITE_TOKEN_LEN] = request
+            .try_into()
+            .map_err(|_| anyhow::anyhow!("invalid invite request length {}", request.len()))?;
+        let (namespace, mode) = self.invites.start_redeem(&token, SystemTime::now())?;
+        let res = async {
+            let doc = self
+                .docs
+                .open(namespace)
+                .await?
+                .ok_or_else(|| anyhow::anyhow!("document no longer exists"))?;
+            doc.share(mode, iroh_docs::rpc::AddrInfoOptions::RelayAndAddresses)
+                .await
+        }
+        .await;
+        self.invites.finish(&token, res.is_ok());
+        res
+    }
+}
+
+impl iroh::protocol::ProtocolHandler for DocInviteProtocol {
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let this = self.clone();
+        Box::pin(async move {
+            let conn = conn.await?;
+            if !this.acl.admit(&conn, AclAction::Sync)? {
+                return Ok(());
+            }
+            let (mut send, mut recv) = conn.accept_bi().await?;
+            let request = recv.read_to_end(DOC_INVITE_TOKEN_LEN).await?;
+            let response = match this.handle(&request).await {
+                Ok(ticket) => {
+                    let mut response = vec![DOC_INVITE_GRANTED];
+                    response.extend_from_slice(ticket.to_string().as_bytes());
+                    response
+                }
+                Err(err) => {
+                    let mut response = vec![DOC_INVITE_DENIED];
+                    response.extend_from_slice(err.to_string().as_bytes());
+                    response
+                }
+            };
+            send.write_all(&response).await?;
+            send.finish()?;
+            conn.closed().await;
+            Ok(())
+        })
+    }
+}
+
+/// Redeem `invite` with its issuer, getting the ticket for the document.
+pub(crate) async fn redeem(
+    endpoint: &iroh::Endpoint,
+    invite: &DocInvite,
+) -> anyhow::Result<iroh_docs::DocTicket> {
+    let conn = endpoint
+        .connect(invite.0.issuer.clone(), DOC_INVITE_ALPN)
+        .await?;
+    let (mut send, mut recv) = conn.open_bi().await?;
+    send.write_all(&invite.0.token).await?;
+    send.finish()?;
+    let response = recv.read_to_end(DOC_INVITE_MAX_RESPONSE).await?;
+    conn.close(0u32.into(), b"done");
+
+    match response.split_first() {
+        Some((&DOC_INVITE_GRANTED, ticket)) => {
+            let ticket = iroh_docs::DocTicket::from_str(std::str::from_utf8(ticket)?)?;
+            anyhow::ensure!(
+                ticket.capability.id() == invite.0.namespace,
+                "issuer granted access to a different document"
+            );
+            Ok(ticket)
+        }
+        Some((_, reason)) => {
+            anyhow::bail!("invitation denied: {}", String::from_utf8_lossy(reason))
+        }
+        None => anyhow::bail!("issuer closed the connection"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::*;
+
+    #[test]
+    fn test_invite_uses_and_expiry() {
+        let invites = DocInvites::default();
+        let issuer = iroh::NodeAddr::new(iroh::SecretKey::from_bytes(&[1u8; 32]).public());
+        let namespace = iroh_docs::NamespaceSecret::from_bytes(&[2u8; 32]).id();
+        let now = SystemTime::now();
+        let mode = iroh_docs::rpc::client::docs::ShareMode::Read;
+
+        let options = ShareOptions {
+            expires_at: Some(now + Duration::from_secs(60)),
+            max_uses: Some(2),
+        };
+        let invite = invites
+            .issue(issuer.clone(), namespace, mode.clone(), &options)
+            .unwrap();
+        assert_eq!(DocInvite::new(invite.to_string()).unwrap(), invite);
+        assert_eq!(invite.doc_id(), namespace.to_string());
+
+        let token = invite.0.token;
+        assert_eq!(invites.start_redeem(&token, now).unwrap().0, namespace);
+        invites.finish(&token, true);
+        // a failed redemption does not use up the invitation
+        assert!(invites.start_redeem(&token, now).is_ok());
+        invites.finish(&token, false);
+        // the last use is reserved while it is being redeemed
+        assert!(invites.start_redeem(&token, now).is_ok());
+        assert!(invites.start_redeem(&token, now).is_err());
+        invites.finish(&token, true);
+        assert!(invites.start_redeem(&token, now).is_err());
+
+        let invite = invites
+            .issue(issuer.clone(), namespace, mode.clone(), &options)
+            .unwrap();
+        let later = now + Duration::from_secs(61);
+        assert!(invites.start_redeem(&invite.0.token, later).is_err());
+        assert!(invites.start_redeem(&invite.0.token, now).is_err());
+
+        let options = ShareOptions {
+            expires_at: None,
+            max_uses: Some(0),
+        };
+        assert!(invites.issue(issuer, namespace, mode, &options).is_err());
+    }
+}
@@ -8,7 +8,7 @@ use crate::IrohError;
 ///
 /// The key itself is just a 32 byte array, but a key has associated crypto
 /// information that is cached for performance reasons.
-#[derive(Debug, Clone, Eq, Serialize, Deserialize, uniffi::Object)]
+#[derive(Debug, Clone, Eq, uniffi::Object)]
 #[uniffi::export(Display)]
 pub struct PublicKey {
     pub(crate) key: [u8; 32],
@@ -35,6 +35,9 @@ impl PublicKey {
     }
 
     /// Express the PublicKey as a byte array
+    ///
+    /// These are the 32 bytes of the ed25519 public key, as used by other ed25519
+    /// implementations, such as `ed25519.PublicKey` in Go.
     pub fn to_bytes(&self) -> Vec<u8> {
         self.key.to_vec()
     }
@@ -47,6 +50,8 @@ impl PublicKey {
     }
 
     /// Make a PublicKey from byte array
+    ///
+    /// Accepts the 32 bytes of any valid ed25519 public key, see [`Self::to_bytes`].
     #[uniffi::constructor]
     pub fn from_bytes(bytes: Vec<u8>) -> Result<Self, IrohError> {
         if bytes.len() != 32 {
@@ -62,6 +67,20 @@ impl PublicKey {
     pub fn fmt_short(&self) -> String {
         iroh::PublicKey::from(self).fmt_short()
     }
+
+    /// Verify an ed25519 `signature` of `message` made with the secret key of this key.
+    ///
+    /// Uses the same strict verification as iroh, which rejects some signatures that more lenient
+    /// implementations accept.
+    pub fn verify(&self, message: Vec<u8>, signature: Vec<u8>) -> Result<(), IrohError> {
+        let signature =
+            ed25519_dalek::Signature::from_slice(&signature).map_err(anyhow::Error::from)?;
+        let key =
+            ed25519_dalek::VerifyingKey::from_bytes(&self.key).map_err(anyhow::Error::from)?;
+        key.verify_strict(&message, &signature)
+            .map_err(anyhow::Error::from)?;
+        Ok(())
+    }
 }
 
 impl PartialEq for PublicKey {
@@ -70,6 +89,30 @@ impl PartialEq for PublicKey {
     }
 }
 
+/// Serialized as its string representation in human readable formats such as JSON.
+impl Serialize for PublicKey {
+    fn serialize<S: serde::Serializer>(&self, serializer: S) -> Result<S::Ok, S::Error> {
+        if serializer.is_human_readable() {
+            serializer.collect_str(self)
+        } else {
+            self.key.serialize(serializer)
+        }
+    }
+}
+
+impl<'de> Deserialize<'de> for PublicKey {
+    fn deserialize<D: serde::Deserializer<'de>>(deserializer: D) -> Result<Self, D::Error> {
+        if deserializer.is_human_readable() {
+            let s = String::deserialize(deserializer)?;
+            let key = iroh::PublicKey::from_str(&s).map_err(serde::de::Error::custom)?;
+            Ok(key.into())
+        } else {
+            let key = <[u8; 32]>::deserialize(deserializer)?;
+            Ok(PublicKey { key })
+        }
+    }
+}
+
 impl std::fmt::Display for PublicKey {
     fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
         iroh::PublicKey::from(self).fmt(f)
@@ -106,5 +149,27 @@ mod tests {
         // test that the eq function works
         assert!(key.equal(&key_0));
         assert!(key_0.equal(&key));
+        //
+        // test that json uses the string representation
+        let json = serde_json::to_string(&key).unwrap();
+        assert_eq!(format!("\"{key_str}\""), json);
+        let key_1: PublicKey = serde_json::from_str(&json).unwrap();
+        assert!(key.equal(&key_1));
+    }
+
+    #[test]
+    fn test_public_key_verify() {
+        use ed25519_dalek::Signer;
+
+        let signing = ed25519_dalek::SigningKey::from_bytes(&[7u8; 32]);
+        let key = PublicKey::from_bytes(signing.verifying_key().to_bytes().to_vec()).unwrap();
+        // the same key as iroh derives from the secret key
+        let iroh_key = iroh::SecretKey::from_bytes(&[7u8; 32]).public();
+        assert_eq!(key.to_bytes(), iroh_key.as_bytes().to_vec());
+
+        let signature = signing.sign(b"message").to_bytes().to_vec();
+        key.verify(b"message".to_vec(), signature.clone()).unwrap();
+        assert!(key.verify(b"other".to_vec(), signature).is_err());
+        assert!(key.verify(b"message".to_vec(), vec![0u8; 10]).is_err());
     }
 }
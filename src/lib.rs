@@ -1,26 +1,113 @@
+mod acl;
+mod attachment;
 mod author;
 mod blob;
+mod cancel;
+mod clock;
+mod compression;
+mod conn_history;
+mod content_cache;
+mod debounce;
 mod doc;
+mod doc_manager;
+mod doc_merge;
+mod doc_metrics;
+mod doc_subscription;
 mod endpoint;
+mod entry_meta;
 mod error;
+mod fault;
+mod file_verify;
 mod gossip;
+mod hash_diff;
+mod instrument;
+mod inventory;
+mod invite;
 mod key;
+mod log;
+mod maintenance;
 mod net;
 mod node;
+mod node_events;
+mod peer_diagnostics;
+mod presence;
+mod provide;
+mod redact;
+mod relay_latency;
+mod response_limit;
+mod runtime;
+mod safe_delete;
+mod self_test;
+mod serve_policy;
+mod sidecar;
+mod signed_record;
+mod snapshot;
+mod startup;
+mod stats_tracker;
+mod store_import;
+mod sync_parallelism;
+mod sync_tuning;
 mod tag;
+mod tag_index;
+mod tenant;
+#[cfg(test)]
+mod test_utils;
 mod ticket;
+mod tombstone;
+mod wait_entry;
 
+pub use self::acl::*;
+pub use self::attachment::*;
 pub use self::author::*;
 pub use self::blob::*;
+pub use self::cancel::*;
+pub use self::clock::*;
+pub use self::compression::*;
+pub use self::conn_history::*;
+pub use self::content_cache::*;
+pub use self::debounce::*;
 pub use self::doc::*;
+pub use self::doc_manager::*;
+pub use self::doc_merge::*;
+pub use self::doc_metrics::*;
+pub use self::doc_subscription::*;
 pub use self::endpoint::*;
+pub use self::entry_meta::*;
 pub use self::error::*;
+pub use self::fault::*;
+pub use self::file_verify::*;
 pub use self::gossip::*;
+pub use self::hash_diff::*;
+pub use self::instrument::*;
+pub use self::inventory::*;
+pub use self::invite::*;
 pub use self::key::*;
+pub use self::log::*;
 pub use self::net::*;
 pub use self::node::*;
+pub use self::node_events::*;
+pub use self::peer_diagnostics::*;
+pub use self::presence::*;
+pub use self::provide::*;
+pub use self::redact::*;
+pub use self::relay_latency::*;
+pub use self::response_limit::*;
+pub use self::runtime::*;
+pub use self::safe_delete::*;
+pub use self::self_test::*;
+pub use self::serve_policy::*;
+pub use self::signed_record::*;
+pub use self::snapshot::*;
+pub use self::startup::*;
+pub use self::stats_tracker::*;
+pub use self::store_import::*;
+pub use self::sync_parallelism::*;
+pub use self::sync_tuning::*;
 pub use self::tag::*;
+pub use self::tenant::*;
 pub use self::ticket::*;
+pub use self::tombstone::*;
+pub use self::wait_entry::*;
 
 use iroh_metrics::core::Metric;
 use tracing_subscriber::filter::LevelFilter;
@@ -28,8 +115,21 @@ use tracing_subscriber::filter::LevelFilter;
 // This macro includes the scaffolding for the Iroh FFI bindings.
 uniffi::setup_scaffolding!();
 
+/// Implement `Display` through `Debug`, for the types exported with `uniffi::export(Display)`
+/// whose debug output is all there is to show.
+macro_rules! display_via_debug {
+    ($ty:ty) => {
+        impl std::fmt::Display for $ty {
+            fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+                std::fmt::Debug::fmt(self, f)
+            }
+        }
+    };
+}
+pub(crate) use display_via_debug;
+
 /// The logging level. See the rust (log crate)[https://docs.rs/log] for more information.
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, serde::Serialize, serde::Deserialize, uniffi::Enum)]
 pub enum LogLevel {
     Trace,
     Debug,
@@ -39,6 +139,8 @@ pub enum LogLevel {
     Off,
 }
 
+display_via_debug!(LogLevel);
+
 impl From<LogLevel> for LevelFilter {
     fn from(level: LogLevel) -> LevelFilter {
         match level {
@@ -58,7 +160,8 @@ pub fn set_log_level(level: LogLevel) {
     use tracing_subscriber::{fmt, prelude::*, reload};
     let filter: LevelFilter = level.into();
     let (filter, _) = reload::Layer::new(filter);
-    let mut layer = fmt::Layer::default();
+    // logs are redacted according to the redaction policy, see `set_redaction_policy`
+    let mut layer = fmt::Layer::default().with_writer(|| redact::RedactingStdout);
     layer.set_ansi(false);
     tracing_subscriber::registry()
         .with(filter)
@@ -80,6 +183,86 @@ pub fn start_metrics_collection() -> Result<(), IrohError> {
     .map_err(|e| anyhow::Error::from(e).into())
 }
 
+/// Capabilities this build of the library provides, see [`library_features`].
+const FEATURES: &[&str] = &[
+    "blobs",
+    "blob-push",
+    "call-metrics",
+    "custom-protocols",
+    "direct-only",
+    "discovery",
+    "docs",
+    "fault-injection",
+    "gossip",
+    "relay",
+    "replica-state",
+    "tags",
+];
+
+/// The version of this library.
+#[uniffi::export]
+pub fn iroh_ffi_version() -> String {
+    env!("CARGO_PKG_VERSION").to_string()
+}
+
+/// Versions of this library and the crates it is built on, see [`version_info`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct VersionInfo {
+    /// The version of this library, as returned by [`iroh_ffi_version`].
+    pub iroh_ffi: String,
+    /// The version of iroh, which contains the networking that was iroh-net.
+    pub iroh: String,
+    /// The version of iroh-blobs, which was iroh-bytes.
+    pub iroh_blobs: String,
+    pub iroh_docs: String,
+    pub iroh_gossip: String,
+    /// The version of uniffi the library is built with.
+    pub uniffi: String,
+    /// The version of the interface between the library and the generated bindings, which
+    /// the bindings check when loading the library.
+    pub uniffi_contract: u32,
+    /// The git commit the library was built from, if it was built from a git checkout.
+    pub git_commit: Option<String>,
+}
+
+/// The versions of this library and the crates it is built on, e.g. for bug reports.
+///
+/// Crate versions are the requirements of the manifest, e.g. `0.30`, if the library was built
+/// without its lock file, as a dependency of another project.
+#[uniffi::export]
+pub fn version_info() -> VersionInfo {
+    let commit = env!("IROH_FFI_GIT_COMMIT");
+    VersionInfo {
+        iroh_ffi: iroh_ffi_version(),
+        iroh: env!("IROH_FFI_IROH_VERSION").to_string(),
+        iroh_blobs: env!("IROH_FFI_IROH_BLOBS_VERSION").to_string(),
+        iroh_docs: env!("IROH_FFI_IROH_DOCS_VERSION").to_string(),
+        iroh_gossip: env!("IROH_FFI_IROH_GOSSIP_VERSION").to_string(),
+        uniffi: env!("IROH_FFI_UNIFFI_VERSION").to_string(),
+        // generated by `setup_scaffolding`, the bindings call it when loading the library
+        uniffi_contract: ffi_iroh_ffi_uniffi_contract_version(),
+        git_commit: (!commit.is_empty()).then(|| commit.to_string()),
+    }
+}
+
+/// The capabilities this library provides.
+///
+/// Which of them are enabled on a node depends on its options, see `Node.supported_features`.
+#[uniffi::export]
+pub fn library_features() -> Vec<String> {
+    FEATURES.iter().map(|f| f.to_string()).collect()
+}
+
+/// Serialize `value` to a JSON string.
+pub(crate) fn to_json<T: serde::Serialize>(value: &T) -> Result<String, IrohError> {
+    serde_json::to_string(value).map_err(|e| anyhow::Error::from(e).into())
+}
+
+/// Parse a value from a JSON string.
+pub(crate) fn from_json<T: serde::de::DeserializeOwned>(json: &str) -> Result<T, IrohError> {
+    serde_json::from_str(json).map_err(|e| anyhow::Error::from(e).into())
+}
+
 /// Helper function that translates a key that was derived from the [`path_to_key`] function back
 /// into a path.
 ///
@@ -120,6 +303,29 @@ pub fn path_to_key(
 #[cfg(test)]
 mod tests {
     use super::*;
+
+    #[test]
+    fn test_version_and_features() {
+        assert_eq!(iroh_ffi_version(), env!("CARGO_PKG_VERSION"));
+        let features = library_features();
+        assert!(features.contains(&"docs".to_string()));
+        let mut sorted = features.clone();
+        sorted.sort();
+        sorted.dedup();
+        assert_eq!(features, sorted);
+    }
+
+    #[test]
+    fn test_version_info() {
+        let info = version_info();
+        assert_eq!(info.iroh_ffi, iroh_ffi_version());
+        // the requirements of the manifest, without a lock file
+        assert!(info.iroh.starts_with("0.30"));
+        assert!(info.iroh_blobs.starts_with("0.30"));
+        assert!(info.uniffi.starts_with("0.28"));
+        assert!(info.uniffi_contract > 0);
+    }
+
     #[test]
     fn test_path_to_key_roundtrip() {
         let path = std::path::PathBuf::from("/").join("foo").join("bar");
@@ -0,0 +1,390 @@
+use std::{
+    collections::HashMap,
+    str::FromStr,
+    sync::Arc,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+use futures::{StreamExt, TryStreamExt};
+use tracing::warn;
+
+use crate::{AuthorId, CallbackError, Doc, Docs, IrohError};
+
+/// Prefix of the keys holding the entries of a log.
+const LOG_ENTRY_PREFIX: &[u8] = b"log/";
+/// Key holding the name of a log.
+const LOG_NAME_KEY: &[u8] = b"log-name";
+
+/// An entry of a [`Log`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct LogEntry {
+    /// The sequence number of the entry.
+    pub seq: u64,
+    /// The author that appended the entry.
+    pub author: Arc<AuthorId>,
+    /// The appended data.
+    pub data: Vec<u8>,
+}
+
+/// Receives the entries of a [`Log`], see `Log.subscribe`.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait LogCallback: Send + Sync + 'static {
+    async fn entry(&self, entry: LogEntry) -> Result<(), CallbackError>;
+}
+
+/// An append-only log stored in a document.
+///
+/// Every entry gets a sequence number, which is the time of the append in microseconds since
+/// the Unix epoch, raised if needed to be larger than the last sequence number of the log. So
+/// entries are ordered by time, also when appended by different nodes, and the log syncs like
+/// any other document. Entries are stored under the keys `log/<seq>`, with the sequence number
+/// zero padded to 20 digits.
+#[derive(Clone, uniffi::Object)]
+pub struct Log {
+    doc: Doc,
+    name: String,
+}
+
+#[uniffi::export]
+impl Docs {
+    /// Create a new [`Log`] named `name`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn create_log(&self, name: String) -> Result<Arc<Log>, IrohError> {
+        let doc = self.create().await?;
+        let author = doc.engine.client.authors().default().await?;
+        doc.set_bytes(
+            &AuthorId(author),
+            LOG_NAME_KEY.to_vec(),
+            name.clone().into_bytes(),
+        )
+        .await?;
+        Ok(Arc::new(Log {
+            doc: (*doc).clone(),
+            name,
+        }))
+    }
+
+    /// Open the [`Log`] stored in the document with id `id`.
+    ///
+    /// Returns None if the document cannot be found.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn open_log(&self, id: String) -> Result<Option<Arc<Log>>, IrohError> {
+        let Some(doc) = self.open(id).await? else {
+            return Ok(None);
+        };
+        let log = Log::new((*doc).clone()).await?;
+        Ok(Some(Arc::new(log)))
+    }
+}
+
+#[uniffi::export]
+impl Log {
+    /// The id of the log, the id of the document it is stored in.
+    pub fn id(&self) -> String {
+        self.doc.id()
+    }
+
+    /// The name the log was created with. Empty if the name was not synced yet.
+    pub fn name(&self) -> String {
+        self.name.clone()
+    }
+
+    /// The document the log is stored in, to share and sync it.
+    pub fn doc(&self) -> Arc<Doc> {
+        Arc::new(self.doc.clone())
+    }
+
+    /// Append `data` to the log with the default author of this node.
+    ///
+    /// Returns the sequence number of the new entry.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn append(&self, data: Vec<u8>) -> Result<u64, IrohError> {
+        self.doc.ensure_open()?;
+        let author = self.doc.engine.client.authors().default().await?;
+        // appends of this node take turns, so they get increasing sequence numbers
+        let _guard = self.doc.state.appends.lock().await;
+        let last = self.last_seq().await?;
+        let now = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|t| u64::try_from(t.as_micros()).unwrap_or(u64::MAX))
+            .unwrap_or(0);
+        let seq = match last {
+            Some(last) => now.max(last.checked_add(1).ok_or_else(|| {
+                anyhow::anyhow!("log is full, the last sequence number is {last}")
+            })?),
+            None => now,
+        };
+        self.doc
+            .set_bytes(&AuthorId(author), entry_key(seq), data)
+            .await?;
+        Ok(seq)
+    }
+
+    /// The sequence number of the last entry of the log, if any.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn last_seq(&self) -> Result<Option<u64>, IrohError> {
+        self.doc.ensure_open()?;
+        let query = iroh_docs::store::Query::key_prefix(LOG_ENTRY_PREFIX)
+            .sort_by(
+                iroh_docs::store::SortBy::KeyAuthor,
+                iroh_docs::store::SortDirection::Desc,
+            )
+            .limit(1)
+            .build();
+        let entry = self.doc.inner.get_many(query).await?.try_next().await?;
+        Ok(entry.and_then(|entry| parse_entry_key(entry.key())))
+    }
+
+    /// Read the entries with sequence numbers from `from` up to, but not including, `to`.
+    ///
+    /// Entries whose data is not available on this node yet are left out.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read(&self, from: u64, to: u64) -> Result<Vec<LogEntry>, IrohError> {
+        self.doc.ensure_open()?;
+        let mut res = Vec::new();
+        let query = iroh_docs::store::Query::key_prefix(LOG_ENTRY_PREFIX)
+            .sort_by(
+                iroh_docs::store::SortBy::KeyAuthor,
+                iroh_docs::store::SortDirection::Asc,
+            )
+            .build();
+        let mut entries = self.doc.inner.get_many(query).await?;
+        while let Some(entry) = entries.try_next().await? {
+            let Some(seq) = parse_entry_key(entry.key()) else {
+                continue;
+            };
+            if seq < from {
+                continue;
+            }
+            if seq >= to {
+                break;
+            }
+            if let Some(entry) = self.load(seq, &entry).await? {
+                res.push(entry);
+            }
+        }
+        Ok(res)
+    }
+
+    /// Call `cb` for every entry from sequence number `from` on, first for the entries already
+    /// in the log, then for new ones as they are appended or synced.
+    ///
+    /// New entries are delivered in the order they arrive, entries synced from other nodes
+    /// once their data is available. An entry appended while the subscription starts can be
+    /// delivered twice, use the sequence number and author to tell. The subscription ends when
+    /// the document is closed or `cb` returns an error.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe(&self, from: u64, cb: Arc<dyn LogCallback>) -> Result<(), IrohError> {
+        self.doc.ensure_open()?;
+        let events = self.doc.live_events().await?;
+        let log = self.clone();
+        tokio::task::spawn(async move {
+            if let Err(err) = log.forward(from, events, cb).await {
+                warn!("log subscription of {} ended: {err:#}", log.id());
+            }
+        });
+        Ok(())
+    }
+}
+
+impl Log {
+    async fn new(doc: Doc) -> anyhow::Result<Self> {
+        let query = iroh_docs::store::Query::single_latest_per_key()
+            .key_exact(LOG_NAME_KEY)
+            .build();
+        let name = match doc.inner.get_one(query).await? {
+            Some(entry) => {
+                let name = doc
+                    .engine
+                    .content_cache
+                    .read(&doc.engine.blobs, entry.content_hash())
+                    .await?;
+                String::from_utf8_lossy(&name).into_owned()
+            }
+            None => String::new(),
+        };
+        Ok(Log { doc, name })
+    }
+
+    /// Read the data of the entry with sequence number `seq`, if it is available.
+    async fn load(
+        &self,
+        seq: u64,
+        entry: &iroh_docs::rpc::client::docs::Entry,
+    ) -> anyhow::Result<Option<LogEntry>> {
+        let hash = entry.content_hash();
+        match self.doc.engine.blobs.status(hash).await? {
+            iroh_blobs::rpc::client::blobs::BlobStatus::Complete { .. } => {}
+            _ => return Ok(None),
+        }
+        let data = self
+            .doc
+            .engine
+            .content_cache
+            .read(&self.doc.engine.blobs, hash)
+            .await?;
+        Ok(Some(LogEntry {
+            seq,
+            author: Arc::new(AuthorId(entry.author())),
+            data: data.to_vec(),
+        }))
+    }
+
+    async fn forward(
+        &self,
+        from: u64,
+        mut events: impl futures::Stream<Item = anyhow::Result<iroh_docs::rpc::client::docs::LiveEvent>>
+            + Unpin,
+        cb: Arc<dyn LogCallback>,
+    ) -> anyhow::Result<()> {
+        use iroh_docs::rpc::client::docs::LiveEvent;
+
+        // entries whose data is still being downloaded, by content hash
+        let mut pending: HashMap<
+            iroh_blobs::Hash,
+            Vec<(u64, iroh_docs::rpc::client::docs::Entry)>,
+        > = HashMap::new();
+
+        let query = iroh_docs::store::Query::key_prefix(LOG_ENTRY_PREFIX)
+            .sort_by(
+                iroh_docs::store::SortBy::KeyAuthor,
+                iroh_docs::store::SortDirection::Asc,
+            )
+            .build();
+        let backlog = self
+            .doc
+            .inner
+            .get_many(query)
+            .await?
+            .try_collect::<Vec<_>>()
+            .await?;
+        for entry in backlog {
+            let Some(seq) = parse_entry_key(entry.key()).filter(|seq| *seq >= from) else {
+                continue;
+            };
+            match self.load(seq, &entry).await? {
+                Some(entry) => cb.entry(entry).await?,
+                None => pending
+                    .entry(entry.content_hash())
+                    .or_default()
+                    .push((seq, entry)),
+            }
+        }
+
+        while let Some(event) = events.next().await {
+            let ready = match event? {
+                LiveEvent::InsertLocal { entry } => vec![entry],
+                LiveEvent::InsertRemote {
+                    entry,
+                    content_status,
+                    ..
+                } => {
+                    if matches!(content_status, iroh_docs::ContentStatus::Complete) {
+                        vec![entry]
+                    } else {
+                        if let Some(seq) = parse_entry_key(entry.key()).filter(|s| *s >= from) {
+                            pending
+                                .entry(entry.content_hash())
+                                .or_default()
+                                .push((seq, entry));
+                        }
+                        continue;
+                    }
+                }
+                LiveEvent::ContentReady { hash } => pending
+                    .remove(&hash)
+                    .unwrap_or_default()
+                    .into_iter()
+                    .map(|(_, entry)| entry)
+                    .collect(),
+                _ => continue,
+            };
+            for entry in ready {
+                let Some(seq) = parse_entry_key(entry.key()).filter(|seq| *seq >= from) else {
+                    continue;
+                };
+                if let Some(entry) = self.load(seq, &entry).await? {
+                    cb.entry(entry).await?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+fn entry_key(seq: u64) -> Vec<u8> {
+    let mut key = LOG_ENTRY_PREFIX.to_vec();
+    key.extend_from_slice(format!("{seq:020}").as_bytes());
+    key
+}
+
+fn parse_entry_key(key: &[u8]) -> Option<u64> {
+    let seq = key.strip_prefix(LOG_ENTRY_PREFIX)?;
+    if seq.len() != 20 {
+        return None;
+    }
+    u64::from_str(std::str::from_utf8(seq).ok()?).ok()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::test_utils::{local_node, Forward};
+
+    #[test]
+    fn test_entry_key() {
+        assert_eq!(entry_key(42), b"log/00000000000000000042");
+        assert_eq!(parse_entry_key(&entry_key(42)), Some(42));
+        assert_eq!(parse_entry_key(&entry_key(u64::MAX)), Some(u64::MAX));
+        // keys sort like their sequence numbers
+        assert!(entry_key(9) < entry_key(10));
+        assert_eq!(parse_entry_key(b"log/42"), None);
+        assert_eq!(parse_entry_key(b"log-name"), None);
+    }
+
+    #[tokio::test]
+    async fn test_log() {
+        let node = local_node().await;
+        let log = node.docs().create_log("events".to_string()).await.unwrap();
+        assert_eq!(log.name(), "events");
+        assert_eq!(log.last_seq().await.unwrap(), None);
+
+        let mut seqs = Vec::new();
+        for i in 0..5u8 {
+            seqs.push(log.append(vec![i]).await.unwrap());
+        }
+        assert!(seqs.windows(2).all(|w| w[0] < w[1]));
+        assert_eq!(log.last_seq().await.unwrap(), Some(seqs[4]));
+
+        let entries = log.read(seqs[1], seqs[4]).await.unwrap();
+        let data = entries.iter().map(|e| e.data.clone()).collect::<Vec<_>>();
+        assert_eq!(data, vec![vec![1], vec![2], vec![3]]);
+        assert_eq!(entries[0].seq, seqs[1]);
+
+        let reopened = node.docs().open_log(log.id()).await.unwrap().unwrap();
+        assert_eq!(reopened.name(), "events");
+        assert_eq!(reopened.read(0, u64::MAX).await.unwrap().len(), 5);
+
+        let (sender, mut received) = tokio::sync::mpsc::channel(16);
+        log.subscribe(seqs[3], Arc::new(Forward(sender)))
+            .await
+            .unwrap();
+        let seq = log.append(vec![5]).await.unwrap();
+        let mut data = Vec::new();
+        while data.len() < 3 {
+            let entry = tokio::time::timeout(Duration::from_secs(5), received.recv())
+                .await
+                .unwrap()
+                .unwrap();
+            assert!(entry.seq >= seqs[3]);
+            if !data.contains(&entry.data) {
+                data.push(entry.data);
+            }
+        }
+        assert_eq!(data, vec![vec![3], vec![4], vec![5]]);
+        assert!(seq > seqs[4]);
+    }
+}
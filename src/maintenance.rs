@@ -0,0 +1,206 @@
+use std::{future::Future, sync::Arc, time::Duration};
+
+use futures::TryStreamExt;
+use tokio::sync::watch;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::{debug, warn};
+
+use crate::{
+    doc::{DocsEngine, MemConnector},
+    Node,
+};
+
+#[uniffi::export]
+impl Node {
+    /// Pause background maintenance until [`Self::maintenance_resume`] is called.
+    ///
+    /// While paused, no garbage collection, tombstone purge, periodic document sync or
+    /// scheduled snapshot starts, so that latency critical work does not compete with them
+    /// for disk and network. Maintenance that is already running finishes first. Live sync of
+    /// documents and explicit calls are not affected.
+    ///
+    /// Returns `false` if maintenance was already paused.
+    pub fn maintenance_pause(&self) -> bool {
+        self.maintenance.set_paused(true)
+    }
+
+    /// Resume background maintenance paused with [`Self::maintenance_pause`].
+    ///
+    /// Maintenance that was due while paused runs right away. Returns `false` if maintenance
+    /// was not paused.
+    pub fn maintenance_resume(&self) -> bool {
+        self.maintenance.set_paused(false)
+    }
+
+    /// Whether background maintenance is paused, see [`Self::maintenance_pause`].
+    pub fn maintenance_paused(&self) -> bool {
+        *self.maintenance.paused.borrow()
+    }
+}
+
+/// Gate the background tasks of a node wait on before doing any work, see
+/// `Node.maintenance_pause`.
+#[derive(Debug)]
+pub(crate) struct Maintenance {
+    paused: watch::Sender<bool>,
+}
+
+impl Default for Maintenance {
+    fn default() -> Self {
+        Maintenance {
+            paused: watch::Sender::new(false),
+        }
+    }
+}
+
+impl Maintenance {
+    fn set_paused(&self, paused: bool) -> bool {
+        self.paused.send_if_modified(|current| {
+            let changed = *current != paused;
+            *current = paused;
+            changed
+        })
+    }
+
+    /// Wait until maintenance is not paused.
+    pub(crate) async fn resumed(&self) {
+        let mut paused = self.paused.subscribe();
+        // the sender lives as long as `self`, so this can not fail
+        paused.wait_for(|paused| !paused).await.ok();
+    }
+}
+
+/// A document handed to the task of [`spawn_doc_maintenance`].
+pub(crate) type MaintainedDoc = iroh_docs::rpc::client::docs::Doc<MemConnector>;
+
+/// Run `task` on every document of `engine` every `interval`, starting one interval from now.
+///
+/// Each round waits until maintenance is not paused. A document the task fails on is skipped
+/// until the next round, `name` describes the task in the logs.
+pub(crate) fn spawn_doc_maintenance<F, Fut>(
+    engine: DocsEngine,
+    interval: Duration,
+    maintenance: Arc<Maintenance>,
+    name: &'static str,
+    task: F,
+) -> AbortOnDropHandle<()>
+where
+    F: Fn(DocsEngine, MaintainedDoc) -> Fut + Send + Sync + 'static,
+    Fut: Future<Output = anyhow::Result<()>> + Send,
+{
+    let task = tokio::task::spawn(async move {
+        let mut interval = tokio::time::interval(interval.max(Duration::from_secs(1)));
+        interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        // the first tick completes immediately, don't run right on startup
+        interval.tick().await;
+        loop {
+            interval.tick().await;
+            maintenance.resumed().await;
+            if let Err(err) = for_each_doc(&engine, name, &task).await {
+                warn!("{name} failed: {err:#}");
+            }
+        }
+    });
+    AbortOnDropHandle::new(task)
+}
+
+/// Run `task` on every document of `engine` once, see [`spawn_doc_maintenance`].
+pub(crate) async fn for_each_doc<F, Fut>(
+    engine: &DocsEngine,
+    name: &str,
+    task: &F,
+) -> anyhow::Result<()>
+where
+    F: Fn(DocsEngine, MaintainedDoc) -> Fut,
+    Fut: Future<Output = anyhow::Result<()>>,
+{
+    let docs = engine
+        .client
+        .list()
+        .await?
+        .map_ok(|(id, _)| id)
+        .try_collect::<Vec<_>>()
+        .await?;
+    for id in docs {
+        let Some(doc) = engine.client.open(id).await? else {
+            continue;
+        };
+        if let Err(err) = task(engine.clone(), doc.clone()).await {
+            debug!("skipping {name} of {id}: {err:#}");
+        }
+        doc.close().await?;
+    }
+    Ok(())
+}
+
+/// Blob garbage collection asks all protection callbacks for live hashes before each run, so a
+/// callback that waits for the gate holds back the run.
+pub(crate) fn gc_gate(maintenance: Arc<Maintenance>) -> iroh_blobs::net_protocol::ProtectCb {
+    Box::new(move |_live| {
+        let maintenance = maintenance.clone();
+        Box::pin(async move { maintenance.resumed().await })
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_maintenance_gate() {
+        let maintenance = Arc::new(Maintenance::default());
+        // not paused, passes right away
+        maintenance.resumed().await;
+
+        assert!(maintenance.set_paused(true));
+        assert!(!maintenance.set_paused(true));
+        let task = tokio::task::spawn({
+            let maintenance = maintenance.clone();
+            async move { maintenance.resumed().await }
+        });
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(!task.is_finished());
+
+        assert!(maintenance.set_paused(false));
+        tokio::time::timeout(Duration::from_secs(5), task)
+            .await
+            .unwrap()
+            .unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_node_maintenance_pause() {
+        let node = crate::Iroh::memory_with_options(crate::NodeOptions {
+            gc_interval_millis: Some(100),
+            ..Default::default()
+        })
+        .await
+        .unwrap();
+        let blobs = node.blobs();
+        let has = |hashes: Vec<Arc<crate::Hash>>, hash: &crate::Hash| {
+            hashes.iter().any(|other| other.equal(hash))
+        };
+        let client = node.node();
+        assert!(!client.maintenance_paused());
+        assert!(client.maintenance_pause());
+        assert!(client.maintenance_paused());
+
+        // untagged blobs survive while garbage collection is paused
+        let outcome = blobs.add_bytes(b"garbage".to_vec()).await.unwrap();
+        node.tags().delete(outcome.tag).await.unwrap();
+        tokio::time::sleep(Duration::from_millis(500)).await;
+        assert!(has(blobs.list().await.unwrap(), &outcome.hash));
+
+        assert!(client.maintenance_resume());
+        assert!(!client.maintenance_resume());
+        let mut collected = false;
+        for _ in 0..50 {
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            if !has(blobs.list().await.unwrap(), &outcome.hash) {
+                collected = true;
+                break;
+            }
+        }
+        assert!(collected);
+    }
+}
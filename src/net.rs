@@ -1,11 +1,39 @@
+use std::{
+    collections::HashMap,
+    str::FromStr,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
 use futures::TryStreamExt;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::debug;
+
+use crate::{
+    conn_history::ConnHistory, hash_diff::HashSets, peer_diagnostics::PeerErrors,
+    relay_latency::RelayLatencies, Iroh, IrohError, NodeAddr, PeerErrorKind, PublicKey, RemoteInfo,
+    TransportOptions,
+};
 
-use crate::{Iroh, IrohError, NodeAddr, PublicKey, RemoteInfo};
+/// How long to wait before reconnecting to a warm peer after the connection was lost.
+const WARM_PEER_RECONNECT_DELAY: Duration = Duration::from_secs(5);
+/// How often connections to warm peers send keep-alives, well below the default idle timeout
+/// of 30 seconds.
+const WARM_PEER_KEEP_ALIVE: Duration = Duration::from_secs(10);
+/// How long `Net.probe_ticket` waits for a peer by default.
+const DEFAULT_PROBE_TIMEOUT: Duration = Duration::from_secs(10);
 
 /// Iroh net client.
 #[derive(uniffi::Object)]
 pub struct Net {
     client: NetClient,
+    pub(crate) relay_map: iroh::RelayMap,
+    pub(crate) endpoint: iroh::Endpoint,
+    warm_peers: Arc<WarmPeers>,
+    pub(crate) peer_errors: Arc<PeerErrors>,
+    pub(crate) conn_history: Arc<ConnHistory>,
+    pub(crate) relay_latencies: Arc<RelayLatencies>,
+    pub(crate) hash_sets: Arc<HashSets>,
 }
 
 #[uniffi::export]
@@ -15,12 +43,62 @@ impl Iroh {
         let client = self.client.clone().boxed();
         let client = iroh_node_util::rpc::client::net::Client::new(client);
 
-        Net { client }
+        Net {
+            client,
+            relay_map: self.relay_map.clone(),
+            endpoint: self.router.endpoint().clone(),
+            warm_peers: self.warm_peers.clone(),
+            peer_errors: self.peer_errors.clone(),
+            conn_history: self.conn_history.clone(),
+            relay_latencies: self.relay_latencies.clone(),
+            hash_sets: self.hash_sets.clone(),
+        }
     }
 }
 
 type NetClient = iroh_node_util::rpc::client::net::Client;
 
+/// How a peer was reached, see [`PeerProbe`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum ProbePath {
+    /// Over a direct UDP path.
+    Direct,
+    /// Through a relay server.
+    Relay,
+    /// Through a relay server, while a direct path is being established.
+    Mixed,
+    /// The connection closed before its path could be determined.
+    Unknown,
+}
+
+/// The outcome of probing one peer of a ticket, see `Net.probe_ticket`.
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct PeerProbe {
+    /// The peer that was probed.
+    pub node_id: Arc<PublicKey>,
+    /// Whether a connection to the peer could be established.
+    pub reachable: bool,
+    /// How the peer was reached, if it was.
+    pub path: Option<ProbePath>,
+    /// How long it took to establish the connection, if it was.
+    pub latency: Option<Duration>,
+    /// Why the peer could not be reached, if it was not.
+    pub error: Option<String>,
+}
+
+/// A relay server configured for this node.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct RelayNodeInfo {
+    /// The url of the relay server.
+    pub url: String,
+    /// Whether the server is only used for STUN, not for relaying.
+    pub stun_only: bool,
+    /// The port of the STUN server.
+    pub stun_port: u16,
+    /// Whether this is the home relay of the node, through which it is reachable.
+    pub is_home: bool,
+}
+
 #[uniffi::export]
 impl Net {
     /// The string representation of the PublicKey of this node.
@@ -37,7 +115,8 @@ impl Net {
 
     /// Add a known node address to the node.
     pub async fn add_node_addr(&self, addr: &NodeAddr) -> Result<(), IrohError> {
-        self.client.add_node_addr(addr.clone().try_into()?).await?;
+        let addr = self.peer_errors.dialable(addr.clone().try_into()?);
+        self.client.add_node_addr(addr).await?;
         Ok(())
     }
 
@@ -47,6 +126,61 @@ impl Net {
         Ok(relay.map(|u| u.to_string()))
     }
 
+    /// List the relay servers this node can use.
+    pub async fn relay_map(&self) -> Result<Vec<RelayNodeInfo>, IrohError> {
+        let home = self.client.home_relay().await?;
+        let relays = self
+            .relay_map
+            .nodes()
+            .map(|node| RelayNodeInfo {
+                url: node.url.to_string(),
+                stun_only: node.stun_only,
+                stun_port: node.stun_port,
+                is_home: home.as_ref() == Some(&node.url),
+            })
+            .collect();
+        Ok(relays)
+    }
+
+    /// Connect to a peer and keep the connection open, so that the next sync or download
+    /// from it does not have to establish a connection first.
+    ///
+    /// Returns once the first connection is established. If the connection is lost, it is
+    /// re-established in the background until [`Self::disconnect_peer`] is called.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn connect_peer(&self, addr: &NodeAddr) -> Result<(), IrohError> {
+        let addr: iroh::NodeAddr = addr.clone().try_into()?;
+        let node_id = addr.node_id;
+        let conn = self
+            .peer_errors
+            .connect(
+                &self.endpoint,
+                addr,
+                iroh_blobs::protocol::ALPN,
+                Some(self.warm_peers.transport.clone()),
+            )
+            .await?;
+        self.warm_peers
+            .keep(self.endpoint.clone(), node_id, Some(conn));
+        Ok(())
+    }
+
+    /// Stop keeping a connection to a peer open.
+    ///
+    /// Returns false if the peer was not kept warm.
+    pub fn disconnect_peer(&self, node_id: &PublicKey) -> bool {
+        self.warm_peers.remove(&node_id.into())
+    }
+
+    /// The peers connections are kept open to, see [`Self::connect_peer`].
+    pub fn warm_peers(&self) -> Vec<Arc<PublicKey>> {
+        self.warm_peers
+            .list()
+            .into_iter()
+            .map(|id| Arc::new(id.into()))
+            .collect()
+    }
+
     /// Return `ConnectionInfo`s for each connection we have to another iroh node.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn remote_info_list(&self) -> Result<Vec<RemoteInfo>, IrohError> {
@@ -70,4 +204,290 @@ impl Net {
             .map(|i| i.map(|i| i.into()))?;
         Ok(info)
     }
+
+    /// Check which peers of a blob, doc or node ticket, or an `iroh://` link, can be reached,
+    /// without downloading or joining anything.
+    ///
+    /// All peers are probed concurrently, each for at most `timeout`, 10 seconds by default.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn probe_ticket(
+        &self,
+        ticket: String,
+        timeout: Option<Duration>,
+    ) -> Result<Vec<PeerProbe>, IrohError> {
+        let target = crate::ticket::parse_uri_target(ticket.trim())?;
+        let peers = target.peers();
+        if peers.is_empty() {
+            return Err(anyhow::anyhow!("the ticket contains no peers").into());
+        }
+        let timeout = timeout.unwrap_or(DEFAULT_PROBE_TIMEOUT);
+        let probes = peers.into_iter().map(|addr| {
+            probe_peer(
+                &self.endpoint,
+                &self.peer_errors,
+                addr,
+                target.alpn(),
+                timeout,
+            )
+        });
+        Ok(futures::future::join_all(probes).await)
+    }
+}
+
+/// Connect to `addr` and report how it was reached.
+async fn probe_peer(
+    endpoint: &iroh::Endpoint,
+    peer_errors: &PeerErrors,
+    addr: iroh::NodeAddr,
+    alpn: &[u8],
+    timeout: Duration,
+) -> PeerProbe {
+    let node_id = addr.node_id;
+    let start = std::time::Instant::now();
+    let res = tokio::time::timeout(timeout, peer_errors.connect(endpoint, addr, alpn, None)).await;
+    let conn = match res {
+        Ok(Ok(conn)) => conn,
+        Ok(Err(err)) => return PeerProbe::unreachable(node_id, format!("{err:#}")),
+        Err(_) => {
+            let message = format!("timed out after {timeout:?}");
+            peer_errors.record(node_id, alpn, PeerErrorKind::TimedOut, message.clone());
+            return PeerProbe::unreachable(node_id, message);
+        }
+    };
+    let latency = start.elapsed();
+    let path = match endpoint.remote_info(node_id).map(|info| info.conn_type) {
+        Some(iroh::endpoint::ConnectionType::Direct(_)) => ProbePath::Direct,
+        Some(iroh::endpoint::ConnectionType::Relay(_)) => ProbePath::Relay,
+        Some(iroh::endpoint::ConnectionType::Mixed(..)) => ProbePath::Mixed,
+        Some(iroh::endpoint::ConnectionType::None) | None => ProbePath::Unknown,
+    };
+    conn.close(0u32.into(), b"probe");
+    PeerProbe {
+        node_id: Arc::new(node_id.into()),
+        reachable: true,
+        path: Some(path),
+        latency: Some(latency),
+        error: None,
+    }
+}
+
+impl PeerProbe {
+    fn unreachable(node_id: iroh::NodeId, error: String) -> Self {
+        PeerProbe {
+            node_id: Arc::new(node_id.into()),
+            reachable: false,
+            path: None,
+            latency: None,
+            error: Some(error),
+        }
+    }
+}
+
+/// The peers a node keeps connections open to, see [`Net::connect_peer`].
+#[derive(Debug)]
+pub(crate) struct WarmPeers {
+    peers: Mutex<HashMap<iroh::NodeId, AbortOnDropHandle<()>>>,
+    peer_errors: Arc<PeerErrors>,
+    /// The transport config of the connections, see [`warm_transport`].
+    transport: Arc<iroh::endpoint::TransportConfig>,
+}
+
+impl WarmPeers {
+    /// Warm peers of a node with the transport options `transport`.
+    pub(crate) fn new(
+        peer_errors: Arc<PeerErrors>,
+        transport: Option<&TransportOptions>,
+    ) -> anyhow::Result<Self> {
+        let transport = warm_transport(transport).transport_config()?;
+        Ok(WarmPeers {
+            peers: Default::default(),
+            peer_errors,
+            transport: Arc::new(transport),
+        })
+    }
+
+    /// Keep a connection to `node_id` open, starting with `conn` if there is one.
+    pub(crate) fn keep(
+        &self,
+        endpoint: iroh::Endpoint,
+        node_id: iroh::NodeId,
+        conn: Option<iroh::endpoint::Connection>,
+    ) {
+        let task = tokio::task::spawn(keep_warm(
+            endpoint,
+            self.peer_errors.clone(),
+            self.transport.clone(),
+            node_id,
+            conn,
+        ));
+        self.peers
+            .lock()
+            .expect("poisoned")
+            .insert(node_id, AbortOnDropHandle::new(task));
+    }
+
+    fn remove(&self, node_id: &iroh::NodeId) -> bool {
+        self.peers
+            .lock()
+            .expect("poisoned")
+            .remove(node_id)
+            .is_some()
+    }
+
+    fn list(&self) -> Vec<iroh::NodeId> {
+        self.peers
+            .lock()
+            .expect("poisoned")
+            .keys()
+            .copied()
+            .collect()
+    }
+}
+
+/// The node wide transport options `transport` with keep-alives at an interval below the
+/// idle timeout, so connections to warm peers are not closed for being idle.
+fn warm_transport(transport: Option<&TransportOptions>) -> TransportOptions {
+    let mut options = transport.cloned().unwrap_or_default();
+    let interval = options
+        .idle_timeout
+        .map_or(WARM_PEER_KEEP_ALIVE, |timeout| {
+            WARM_PEER_KEEP_ALIVE.min(timeout / 2)
+        });
+    options.keep_alive_interval = Some(
+        options
+            .keep_alive_interval
+            .map_or(interval, |configured| configured.min(interval)),
+    );
+    options
+}
+
+/// Parse the node ids of `NodeOptions.keep_alive_peers`.
+pub(crate) fn parse_node_ids(ids: &[String]) -> anyhow::Result<Vec<iroh::NodeId>> {
+    ids.iter()
+        .map(|id| {
+            iroh::NodeId::from_str(id).map_err(|err| anyhow::anyhow!("invalid node id {id}: {err}"))
+        })
+        .collect()
+}
+
+/// Reconnect to `node_id` whenever the connection is lost, until the endpoint is closed.
+///
+/// Connections use the blobs protocol, which every node serves, and send keep-alives so
+/// neither side closes them for being idle.
+async fn keep_warm(
+    endpoint: iroh::Endpoint,
+    peer_errors: Arc<PeerErrors>,
+    transport: Arc<iroh::endpoint::TransportConfig>,
+    node_id: iroh::NodeId,
+    mut conn: Option<iroh::endpoint::Connection>,
+) {
+    loop {
+        if let Some(conn) = conn.take() {
+            let reason = conn.closed().await;
+            debug!(
+                "connection to warm peer {} closed: {reason}",
+                node_id.fmt_short()
+            );
+            continue;
+        }
+        if endpoint.is_closed() {
+            break;
+        }
+        let res = peer_errors
+            .connect(
+                &endpoint,
+                node_id,
+                iroh_blobs::protocol::ALPN,
+                Some(transport.clone()),
+            )
+            .await;
+        match res {
+            Ok(c) => conn = Some(c),
+            Err(err) => {
+                debug!(
+                    "failed to connect to warm peer {}: {err:#}",
+                    node_id.fmt_short()
+                );
+                tokio::time::sleep(WARM_PEER_RECONNECT_DELAY).await;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_warm_peers() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let addr = node_1.net().node_addr().await.unwrap();
+        let node_id = node_1.net().node_id().await.unwrap();
+
+        let net = node_0.net();
+        net.connect_peer(&addr).await.unwrap();
+        let peers = net.warm_peers();
+        assert_eq!(peers.len(), 1);
+        assert_eq!(peers[0].to_string(), node_id);
+
+        assert!(net.disconnect_peer(&peers[0]));
+        assert!(!net.disconnect_peer(&peers[0]));
+        assert!(net.warm_peers().is_empty());
+
+        // keep-alives are sent before the connection idles out
+        let options = warm_transport(None);
+        assert_eq!(options.keep_alive_interval, Some(WARM_PEER_KEEP_ALIVE));
+        let options = warm_transport(Some(&TransportOptions {
+            idle_timeout: Some(Duration::from_secs(4)),
+            keep_alive_interval: None,
+        }));
+        assert_eq!(options.idle_timeout, Some(Duration::from_secs(4)));
+        assert_eq!(options.keep_alive_interval, Some(Duration::from_secs(2)));
+
+        assert!(parse_node_ids(&["not a node id".to_string()]).is_err());
+        assert_eq!(parse_node_ids(&[node_id]).unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_probe_ticket() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let outcome = node_1.blobs().add_bytes(b"hello".to_vec()).await.unwrap();
+        let ticket = node_1
+            .blobs()
+            .share(
+                outcome.hash,
+                crate::BlobFormat::Raw,
+                crate::AddrInfoOptions::RelayAndAddresses,
+            )
+            .await
+            .unwrap();
+
+        let probes = node_0
+            .net()
+            .probe_ticket(ticket.to_string(), None)
+            .await
+            .unwrap();
+        assert_eq!(probes.len(), 1);
+        assert!(probes[0].reachable, "{:?}", probes[0].error);
+        assert_eq!(probes[0].path, Some(ProbePath::Direct));
+
+        // a node that is gone
+        node_1.node().shutdown().await.unwrap();
+        let probes = node_0
+            .net()
+            .probe_ticket(ticket.to_string(), Some(Duration::from_secs(1)))
+            .await
+            .unwrap();
+        assert!(!probes[0].reachable);
+        assert!(probes[0].error.is_some());
+
+        assert!(node_0
+            .net()
+            .probe_ticket("not a ticket".to_string(), None)
+            .await
+            .is_err());
+    }
 }
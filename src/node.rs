@@ -1,17 +1,57 @@
-use std::{collections::HashMap, fmt::Debug, path::PathBuf, sync::Arc, time::Duration};
+use std::{
+    collections::HashMap,
+    fmt::Debug,
+    net::{Ipv4Addr, Ipv6Addr, SocketAddrV4, SocketAddrV6},
+    path::PathBuf,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc, OnceLock,
+    },
+    time::Duration,
+};
 
 use iroh_blobs::{
-    downloader::Downloader, net_protocol::Blobs, provider::EventSender, store::GcConfig,
-    util::local_pool::LocalPool,
+    downloader::Downloader,
+    net_protocol::Blobs,
+    provider::EventSender,
+    store::GcConfig,
+    util::local_pool::{self, LocalPool},
 };
 use iroh_docs::protocol::Docs;
 use iroh_gossip::net::Gossip;
 use iroh_node_util::rpc::server::AbstractNode;
 use quic_rpc::{transport::flume::FlumeConnector, RpcClient, RpcServer};
+use serde::{Deserialize, Serialize};
 use tokio_util::task::AbortOnDropHandle;
 
 use crate::{
-    BlobProvideEventCallback, CallbackError, Connecting, Endpoint, IrohError, NodeAddr, PublicKey,
+    acl::{Acl, AclGossip, ACL_FILE},
+    blob::{BlobPushProtocol, DownloadLimiter, IncompleteBlobs, BLOB_PUSH_ALPN},
+    clock::EntryClock,
+    conn_history::{spawn_conn_history, ConnHistory},
+    content_cache::ContentCache,
+    doc::DocsEngine,
+    fault::FaultyProtocol,
+    hash_diff::{HashDiffProtocol, HashSets, HASH_DIFF_ALPN},
+    invite::{DocInviteProtocol, DocInvites, DOC_INVITE_ALPN},
+    maintenance::{gc_gate, Maintenance},
+    net::{parse_node_ids, WarmPeers},
+    node_events::{spawn_storage_monitor, NodeEvents},
+    peer_diagnostics::PeerErrors,
+    presence::PresenceStore,
+    provide::{ProvideEventSender, ProvideEvents, ProvideProtocol},
+    relay_latency::{spawn_relay_probes, RelayLatencies},
+    serve_policy::ServeFilter,
+    snapshot::DocSnapshots,
+    startup::{Startup, StartupPhase},
+    sync_parallelism::{DocSyncLimits, SYNC_PARALLELISM_FILE},
+    sync_tuning::spawn_periodic_sync,
+    tag_index::TagIndexes,
+    tombstone::{resume_rebuilds, spawn_tombstone_purge},
+    AcceptPushCallback, BlobProvideEventCallback, CallbackError, ClockCallback, Connecting,
+    ContentCacheOptions, DownloadLimits, Endpoint, FaultInjector, IrohError, NodeAddr,
+    NodeEventCallback, PublicKey, StoragePressureOptions, SyncTuning, TombstonePurgePolicy,
+    TransportOptions,
 };
 
 /// Stats counter
@@ -24,7 +64,7 @@ pub struct CounterStats {
 }
 
 /// Information about a direct address.
-#[derive(Debug, Clone, uniffi::Object)]
+#[derive(Debug, Clone, Serialize, Deserialize, uniffi::Object)]
 pub struct DirectAddrInfo(pub(crate) iroh::endpoint::DirectAddrInfo);
 
 #[uniffi::export]
@@ -56,7 +96,7 @@ impl DirectAddrInfo {
 }
 
 /// The latency and type of the control message
-#[derive(Debug, uniffi::Record)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Record)]
 pub struct LatencyAndControlMsg {
     /// The latency of the control message
     pub latency: Duration,
@@ -70,7 +110,7 @@ pub struct LatencyAndControlMsg {
 // pub use iroh::magicsock::ControlMsg;
 
 /// Information about a remote node
-#[derive(Debug, uniffi::Record)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Record)]
 pub struct RemoteInfo {
     /// The node identifier of the endpoint. Also a public key.
     pub node_id: Arc<PublicKey>,
@@ -87,6 +127,18 @@ pub struct RemoteInfo {
     pub last_used: Option<Duration>,
 }
 
+/// Serialize a [`RemoteInfo`] to JSON.
+#[uniffi::export]
+pub fn remote_info_to_json(info: &RemoteInfo) -> Result<String, IrohError> {
+    crate::to_json(info)
+}
+
+/// Parse a [`RemoteInfo`] from JSON produced by [`remote_info_to_json`].
+#[uniffi::export]
+pub fn remote_info_from_json(json: String) -> Result<RemoteInfo, IrohError> {
+    crate::from_json(&json)
+}
+
 impl From<iroh::endpoint::RemoteInfo> for RemoteInfo {
     fn from(value: iroh::endpoint::RemoteInfo) -> Self {
         RemoteInfo {
@@ -105,7 +157,7 @@ impl From<iroh::endpoint::RemoteInfo> for RemoteInfo {
 }
 
 /// The type of the connection
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Enum)]
 pub enum ConnType {
     /// Indicates you have a UDP connection.
     Direct,
@@ -117,8 +169,26 @@ pub enum ConnType {
     None,
 }
 
+crate::display_via_debug!(ConnType);
+
+/// The transport carrying the packets of a connection, see `ConnectionType.transport`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, uniffi::Enum)]
+pub enum ConnTransport {
+    /// UDP, directly to the peer.
+    Udp,
+    /// TCP to the relay server of the peer, which is used when UDP is blocked. Goes through
+    /// the proxy of `NodeOptions.tcp_fallback` if one is configured.
+    RelayTcp,
+    /// Both, while UDP is not confirmed to work yet.
+    UdpAndRelayTcp,
+    /// No connection.
+    None,
+}
+
+crate::display_via_debug!(ConnTransport);
+
 /// The type of connection we have to the node
-#[derive(Debug, uniffi::Object)]
+#[derive(Debug, Serialize, Deserialize, uniffi::Object)]
 pub enum ConnectionType {
     /// Direct UDP connection
     Direct(String),
@@ -145,6 +215,16 @@ impl ConnectionType {
         }
     }
 
+    /// The transport in use: UDP for direct connections, TCP for relayed ones.
+    pub fn transport(&self) -> ConnTransport {
+        match self {
+            ConnectionType::Direct(_) => ConnTransport::Udp,
+            ConnectionType::Relay(_) => ConnTransport::RelayTcp,
+            ConnectionType::Mixed(..) => ConnTransport::UdpAndRelayTcp,
+            ConnectionType::None => ConnTransport::None,
+        }
+    }
+
     /// Return the socket address if this is a direct connection
     pub fn as_direct(&self) -> String {
         match self {
@@ -196,6 +276,104 @@ impl From<iroh::endpoint::ConnectionType> for ConnectionType {
         }
     }
 }
+/// How relay servers are reached over TCP, see `NodeOptions.tcp_fallback`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct TcpFallbackOptions {
+    /// An HTTP or HTTPS proxy to connect to relay servers through, e.g.
+    /// `http://proxy.example.com:3128`.
+    #[uniffi(default = None)]
+    pub proxy_url: Option<String>,
+    /// Use the proxy configured in the `HTTPS_PROXY` or `HTTP_PROXY` environment variables,
+    /// unless `proxy_url` is set.
+    #[uniffi(default = false)]
+    pub proxy_from_env: bool,
+}
+
+/// Options of direct only mode, see `NodeOptions.direct_only`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct DirectOnlyOptions {
+    /// How long connecting to a peer may take before it fails. Defaults to 10 seconds.
+    #[uniffi(default = None)]
+    pub connect_timeout: Option<Duration>,
+}
+
+/// The protocols a node accepts incoming connections for, see `NodeOptions.accept_protocols`.
+///
+/// Connections for other protocols are refused during the handshake. This only limits what
+/// peers can do on this node, the node itself can still download blobs, sync documents and
+/// connect to peers with any protocol.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Enum)]
+pub enum AcceptProtocols {
+    /// All protocols of the node.
+    All,
+    /// Document sync: docs, gossip and document invites, and blobs, as peers download the
+    /// content of entries as blobs. Requires `NodeOptions.enable_docs`.
+    DocsOnly,
+    /// Blob transfers: blobs, blob pushes and hash diffs.
+    BlobsOnly,
+    /// Only the protocols with these ALPNs, see [`builtin_protocols`] for the ALPNs of the
+    /// built-in protocols.
+    Custom { alpns: Vec<Vec<u8>> },
+}
+
+impl AcceptProtocols {
+    /// Whether incoming connections for `alpn` are accepted. The presets accept all protocols
+    /// in `NodeOptions.protocols`, as they were added on purpose.
+    fn allows(&self, alpn: &[u8]) -> bool {
+        let docs: [&[u8]; 4] = [
+            iroh_docs::ALPN,
+            iroh_gossip::ALPN,
+            DOC_INVITE_ALPN,
+            iroh_blobs::ALPN,
+        ];
+        let blobs: [&[u8]; 3] = [iroh_blobs::ALPN, BLOB_PUSH_ALPN, HASH_DIFF_ALPN];
+        let builtin = BUILTIN_PROTOCOLS
+            .iter()
+            .any(|(_, builtin)| *builtin == alpn);
+        match self {
+            AcceptProtocols::All => true,
+            AcceptProtocols::DocsOnly => !builtin || docs.contains(&alpn),
+            AcceptProtocols::BlobsOnly => !builtin || blobs.contains(&alpn),
+            AcceptProtocols::Custom { alpns } => alpns.iter().any(|allowed| allowed == alpn),
+        }
+    }
+}
+
+/// The protocols every node can serve, by name and ALPN.
+const BUILTIN_PROTOCOLS: [(&str, &[u8]); 6] = [
+    ("blobs", iroh_blobs::ALPN),
+    ("blob-push", BLOB_PUSH_ALPN),
+    ("doc-invite", DOC_INVITE_ALPN),
+    ("docs", iroh_docs::ALPN),
+    ("gossip", iroh_gossip::ALPN),
+    ("hash-diff", HASH_DIFF_ALPN),
+];
+
+/// A protocol built into the library, see [`builtin_protocols`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct BuiltinProtocol {
+    pub name: String,
+    pub alpn: Vec<u8>,
+}
+
+/// The protocols built into the library, to build an `AcceptProtocols::Custom` list from.
+///
+/// Blob pushes are only served with `NodeOptions.accept_push`, docs and document invites only
+/// with `NodeOptions.enable_docs`.
+#[uniffi::export]
+pub fn builtin_protocols() -> Vec<BuiltinProtocol> {
+    BUILTIN_PROTOCOLS
+        .iter()
+        .map(|(name, alpn)| BuiltinProtocol {
+            name: name.to_string(),
+            alpn: alpn.to_vec(),
+        })
+        .collect()
+}
+
+/// Connect timeout of nodes in direct only mode, unless configured.
+const DIRECT_CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+
 /// Options passed to [`IrohNode.new`]. Controls the behaviour of an iroh node.
 #[derive(derive_more::Debug, uniffi::Record)]
 pub struct NodeOptions {
@@ -216,6 +394,12 @@ pub struct NodeOptions {
     /// Overwrites the default IPv6 address to bind to
     #[uniffi(default = None)]
     pub ipv6_addr: Option<String>,
+    /// Bind to this UDP port on all IPv4 and IPv6 interfaces, e.g. to allow it in a firewall
+    /// or to run several nodes on one machine with known ports. A random port is used by
+    /// default. Can not be combined with `ipv4_addr` or `ipv6_addr`, which set the interface
+    /// as well.
+    #[uniffi(default = None)]
+    pub bind_port: Option<u16>,
     /// Configure the node discovery. Defaults to the default set of config
     #[uniffi(default = None)]
     pub node_discovery: Option<NodeDiscoveryConfig>,
@@ -225,6 +409,96 @@ pub struct NodeOptions {
 
     #[uniffi(default = None)]
     pub protocols: Option<HashMap<Vec<u8>, Arc<dyn ProtocolCreator>>>,
+    /// Accept blobs other nodes push to this node using `Blobs.send_blob`.
+    ///
+    /// If not set, pushes are refused.
+    #[debug("AcceptPushCallback")]
+    #[uniffi(default = None)]
+    pub accept_push: Option<Arc<dyn AcceptPushCallback>>,
+    /// Idle timeout and keep-alive settings for all connections of this node.
+    ///
+    /// Can be overridden for a single connection with `Endpoint.connect_with_options`.
+    #[uniffi(default = None)]
+    pub transport: Option<TransportOptions>,
+    /// Directory for the blob store of a persistent node. Defaults to `<path>/blobs`.
+    #[uniffi(default = None)]
+    pub blobs_path: Option<String>,
+    /// Directory for the docs database of a persistent node. Defaults to `<path>`.
+    #[uniffi(default = None)]
+    pub docs_path: Option<String>,
+    /// Directory for the default author key of a persistent node. Defaults to `<path>`.
+    #[uniffi(default = None)]
+    pub keys_path: Option<String>,
+    /// Use these relay servers instead of the default ones. An empty list disables relaying.
+    ///
+    /// The relay servers are fixed once the node is created, see `Net.relay_map` for the
+    /// servers in use.
+    #[uniffi(default = None)]
+    pub relay_urls: Option<Vec<String>>,
+    /// Limits for concurrent blob downloads, applied to the downloader of the node. The number
+    /// of concurrent `Blobs.download` calls can be lowered later with
+    /// `Blobs.set_max_concurrent_downloads`.
+    #[uniffi(default = None)]
+    pub download_limits: Option<DownloadLimits>,
+    /// Check the content read from the blob store against its hash, to detect disk
+    /// corruption. Can be overridden per read with `Blobs.read_to_bytes_with_options`.
+    #[uniffi(default = false)]
+    pub verify_on_read: bool,
+    /// Node ids of peers to connect to on startup and keep connections open to, see
+    /// `Net.connect_peer`.
+    #[uniffi(default = None)]
+    pub keep_alive_peers: Option<Vec<String>>,
+    /// Periodically remove old tombstones from all documents, see `Doc.purge_tombstones`.
+    /// Tombstones are kept forever if not set.
+    #[uniffi(default = None)]
+    pub tombstone_purge: Option<TombstonePurgePolicy>,
+    /// Tuning of the background traffic of gossip and document sync. Uses the defaults of
+    /// iroh if not set.
+    #[uniffi(default = None)]
+    pub sync_tuning: Option<SyncTuning>,
+    /// Emit node events when the disk holding the blob store of a persistent node runs low on
+    /// space, see `Node.subscribe_events`. Write failures due to a full disk are reported
+    /// regardless.
+    #[uniffi(default = None)]
+    pub storage_pressure: Option<StoragePressureOptions>,
+    /// Timestamp document entries written by this node with this clock instead of the system
+    /// time, e.g. an NTP disciplined or logical clock.
+    ///
+    /// Peers reject entries timestamped more than 10 minutes ahead of their own system time.
+    /// `Doc.import_file` always uses the system time.
+    #[debug("ClockCallback")]
+    #[uniffi(default = None)]
+    pub clock: Option<Arc<dyn ClockCallback>>,
+    /// Keep small contents of blobs and document entries in memory once read, to serve
+    /// repeated reads of hot keys without going to the blob store. Disabled if not set.
+    #[uniffi(default = None)]
+    pub content_cache: Option<ContentCacheOptions>,
+    /// Reach relay servers through an HTTP proxy.
+    ///
+    /// Connections always fall back to TCP through the relay servers when UDP is blocked, but
+    /// networks that block UDP often only allow TCP through a proxy. See
+    /// `ConnectionType.transport` for the transport a connection uses. Requires relay servers.
+    #[uniffi(default = None)]
+    pub tcp_fallback: Option<TcpFallbackOptions>,
+    /// Never route traffic through relay servers, for deployments that must not use third
+    /// party infrastructure.
+    ///
+    /// Relay servers are disabled and connections are only made to the direct addresses of
+    /// peers: the relay urls of addresses given to the node, e.g. in tickets, download options
+    /// and `Net.add_node_addr`, are ignored. Relay urls peers exchange through gossip can not
+    /// be filtered, so peers that are not in direct only mode should not join the same gossip
+    /// topics. Connections made by `Net`, `Endpoint.connect` and `Blobs.send_blob` fail after
+    /// the connect timeout with an error of kind `IrohErrorKind::DirectConnectionFailed`
+    /// instead of falling back to a relay, downloads and document sync fail with their usual
+    /// errors. Node discovery is off, as the default discovery publishes through third party
+    /// servers. Can not be combined with `relay_urls`, `tcp_fallback` or
+    /// `NodeDiscoveryConfig::Default`.
+    #[uniffi(default = None)]
+    pub direct_only: Option<DirectOnlyOptions>,
+    /// Restrict the protocols peers can connect to this node with, e.g. to run a pure blob
+    /// mirror. All protocols are accepted if not set.
+    #[uniffi(default = None)]
+    pub accept_protocols: Option<AcceptProtocols>,
 }
 
 #[uniffi::export(with_foreign)]
@@ -274,14 +548,32 @@ impl Default for NodeOptions {
             enable_docs: false,
             ipv4_addr: None,
             ipv6_addr: None,
+            bind_port: None,
             node_discovery: None,
             secret_key: None,
             protocols: None,
+            accept_push: None,
+            transport: None,
+            blobs_path: None,
+            docs_path: None,
+            keys_path: None,
+            relay_urls: None,
+            download_limits: None,
+            verify_on_read: false,
+            keep_alive_peers: None,
+            tombstone_purge: None,
+            sync_tuning: None,
+            storage_pressure: None,
+            clock: None,
+            content_cache: None,
+            tcp_fallback: None,
+            direct_only: None,
+            accept_protocols: None,
         }
     }
 }
 
-#[derive(Debug, Default, uniffi::Enum)]
+#[derive(Debug, Default, Serialize, Deserialize, uniffi::Enum)]
 pub enum NodeDiscoveryConfig {
     /// Use no node discovery mechanism.
     None,
@@ -308,10 +600,12 @@ pub enum NodeDiscoveryConfig {
     Default,
 }
 
+crate::display_via_debug!(NodeDiscoveryConfig);
+
 /// An Iroh node. Allows you to sync, store, and transfer data.
 #[derive(uniffi::Object, Debug, Clone)]
 pub struct Iroh {
-    router: iroh::protocol::Router,
+    pub(crate) router: iroh::protocol::Router,
     _local_pool: Arc<LocalPool>,
     /// RPC client for node and net to hand out
     pub(crate) client: RpcClient<
@@ -325,7 +619,70 @@ pub struct Iroh {
     pub(crate) net_client: NetClient,
     pub(crate) authors_client: Option<AuthorsClient>,
     pub(crate) docs_client: Option<DocsClient>,
+    pub(crate) docs_engine: Option<DocsEngine>,
     pub(crate) gossip: Gossip,
+    pub(crate) relay_map: iroh::RelayMap,
+    pub(crate) download_limiter: Arc<DownloadLimiter>,
+    pub(crate) incomplete_blobs: Arc<IncompleteBlobs>,
+    pub(crate) tag_indexes: Arc<TagIndexes>,
+    pub(crate) presence: PresenceStore,
+    pub(crate) verify_on_read: bool,
+    pub(crate) warm_peers: Arc<WarmPeers>,
+    /// Task purging old tombstones, see [`NodeOptions::tombstone_purge`].
+    _tombstone_purge: Option<Arc<AbortOnDropHandle<()>>>,
+    /// Task re-running document reconciliation, see [`SyncTuning::sync_interval`].
+    _periodic_sync: Option<Arc<AbortOnDropHandle<()>>>,
+    /// Task watching the disk space, see [`NodeOptions::storage_pressure`].
+    _storage_monitor: Option<Arc<AbortOnDropHandle<()>>>,
+    pub(crate) events: NodeEvents,
+    pub(crate) provides: Arc<ProvideEvents>,
+    pub(crate) peer_errors: Arc<PeerErrors>,
+    pub(crate) conn_history: Arc<ConnHistory>,
+    /// Task recording connection type changes, see `Net.peer_conn_history`.
+    _conn_history_task: Arc<AbortOnDropHandle<()>>,
+    pub(crate) relay_latencies: Arc<RelayLatencies>,
+    /// Task measuring the latency to the relay servers, see `Net.relay_latencies`.
+    _relay_probe_task: Arc<AbortOnDropHandle<()>>,
+    pub(crate) hash_sets: Arc<HashSets>,
+    pub(crate) acl: Arc<Acl>,
+    pub(crate) serve: Arc<ServeFilter>,
+    pub(crate) maintenance: Arc<Maintenance>,
+    pub(crate) content_cache: Arc<ContentCache>,
+    /// The snapshot schedules, see `Docs.configure_snapshot`.
+    pub(crate) snapshots: Arc<DocSnapshots>,
+    faults: Arc<FaultInjector>,
+    features: Vec<String>,
+    shutdown: Arc<ShutdownState>,
+    /// Counter values at the last `Node.stats_reset`.
+    stats_baseline: Arc<std::sync::Mutex<HashMap<String, u64>>>,
+    /// Where a persistent node stores its data.
+    data_paths: Option<DataPaths>,
+}
+
+/// The directories a persistent node stores its data in.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct DataPaths {
+    /// Directory of the blob store.
+    pub blobs: String,
+    /// Directory of the docs database.
+    pub docs: String,
+    /// Directory of the default author key.
+    pub keys: String,
+}
+
+impl DataPaths {
+    fn new(path: &std::path::Path, options: &NodeOptions) -> Self {
+        let dir = |custom: &Option<String>, default: PathBuf| {
+            custom
+                .clone()
+                .unwrap_or_else(|| default.to_string_lossy().into_owned())
+        };
+        DataPaths {
+            blobs: dir(&options.blobs_path, path.join("blobs")),
+            docs: dir(&options.docs_path, path.to_path_buf()),
+            keys: dir(&options.keys_path, path.to_path_buf()),
+        }
+    }
 }
 
 pub(crate) type NetClient = iroh_node_util::rpc::client::net::Client;
@@ -379,69 +736,113 @@ impl Iroh {
     pub async fn persistent_with_options(
         path: String,
         options: NodeOptions,
+    ) -> Result<Self, IrohError> {
+        crate::runtime::spawn(async move {
+            Self::spawn_persistent(path, options, &Startup::default()).await
+        })
+        .await
+    }
+
+    /// Create a new in memory iroh node with options.
+    #[uniffi::constructor(async_runtime = "tokio")]
+    pub async fn memory_with_options(options: NodeOptions) -> Result<Self, IrohError> {
+        crate::runtime::spawn(Self::spawn_memory(options)).await
+    }
+
+    /// Access to fault injection, to test how an application copes with failures.
+    pub fn faults(&self) -> Arc<FaultInjector> {
+        self.faults.clone()
+    }
+
+    /// Access to node specific funtionaliy.
+    pub fn node(&self) -> Node {
+        let router = self.router.clone();
+        let client = self.client.clone().boxed();
+        let client = iroh_node_util::rpc::client::node::Client::new(client);
+        Node {
+            router,
+            client,
+            data_paths: self.data_paths.clone(),
+            blobs_client: self.blobs_client.clone(),
+            net_client: self.net_client.clone(),
+            relay_map: self.relay_map.clone(),
+            features: self.features.clone(),
+            shutdown: self.shutdown.clone(),
+            stats_baseline: self.stats_baseline.clone(),
+            events: self.events.clone(),
+            acl: self.acl.clone(),
+            serve: self.serve.clone(),
+            maintenance: self.maintenance.clone(),
+            peer_errors: self.peer_errors.clone(),
+        }
+    }
+
+    /// Whether the node was shut down with `Node.shutdown`.
+    pub fn is_closed(&self) -> bool {
+        self.shutdown.is_closed()
+    }
+}
+
+/// The stores of a node and the state loaded alongside them, which differ between persistent
+/// and in memory nodes, see [`Iroh::spawn`].
+struct NodeStorage<S> {
+    blobs_store: S,
+    docs_store: Option<iroh_docs::store::Store>,
+    author_store: Option<iroh_docs::engine::DefaultAuthorStorage>,
+    acl: Acl,
+    sync_limits: DocSyncLimits,
+    /// Set for persistent nodes only.
+    data_paths: Option<DataPaths>,
+}
+
+impl Iroh {
+    pub(crate) async fn spawn_persistent(
+        path: String,
+        options: NodeOptions,
+        startup: &Startup,
     ) -> Result<Self, IrohError> {
         let path = PathBuf::from(path);
-        tokio::fs::create_dir_all(&path)
-            .await
-            .map_err(|err| anyhow::anyhow!(err))?;
+        let data_paths = DataPaths::new(&path, &options);
+        let dirs = [
+            path.clone(),
+            PathBuf::from(&data_paths.docs),
+            PathBuf::from(&data_paths.keys),
+        ];
+        for dir in dirs {
+            tokio::fs::create_dir_all(&dir)
+                .await
+                .map_err(|err| anyhow::anyhow!(err))?;
+        }
 
-        let builder = iroh::Endpoint::builder();
+        let acl = Acl::load(path.join(ACL_FILE))?;
+        let sync_limits = DocSyncLimits::new(Some(path.join(SYNC_PARALLELISM_FILE)));
         let (docs_store, author_store) = if options.enable_docs {
-            let docs_store = iroh_docs::store::Store::persistent(path.join("docs.redb"))?;
-            let author_store =
-                iroh_docs::engine::DefaultAuthorStorage::Persistent(path.join("default-author"));
+            startup.phase(StartupPhase::OpenDocsStore).await?;
+            let docs_path = PathBuf::from(&data_paths.docs).join("docs.redb");
+            let docs_store = iroh_docs::store::Store::persistent(docs_path)?;
+            let author_path = PathBuf::from(&data_paths.keys).join("default-author");
+            let author_store = iroh_docs::engine::DefaultAuthorStorage::Persistent(author_path);
 
             (Some(docs_store), Some(author_store))
         } else {
             (None, None)
         };
-        let blobs_store = iroh_blobs::store::fs::Store::load(path.join("blobs"))
+        startup.phase(StartupPhase::OpenBlobStore).await?;
+        let blobs_store = iroh_blobs::store::fs::Store::load(&data_paths.blobs)
             .await
             .map_err(|err| anyhow::anyhow!(err))?;
-        let local_pool = LocalPool::default();
-        let (builder, gossip, blobs, docs) = apply_options(
-            builder,
-            options,
+        let storage = NodeStorage {
             blobs_store,
             docs_store,
             author_store,
-            &local_pool,
-        )
-        .await?;
-        let router = builder.spawn().await?;
-
-        let (listener, connector) = quic_rpc::transport::flume::channel(1);
-        let listener = RpcServer::new(listener);
-        let client = RpcClient::new(connector);
-        let nn = Arc::new(NetNode(router.endpoint().clone()));
-        let handler = listener.spawn_accept_loop(move |req, chan| {
-            iroh_node_util::rpc::server::handle_rpc_request(nn.clone(), req, chan)
-        });
-
-        let blobs_client = blobs.client().clone();
-        let net_client = iroh_node_util::rpc::client::net::Client::new(client.clone().boxed());
-
-        let docs_client = docs.map(|d| d.client().clone());
-
-        Ok(Iroh {
-            router,
-            _local_pool: Arc::new(local_pool),
-            client,
-            _handler: Arc::new(handler),
-            tags_client: blobs_client.tags(),
-            blobs_client,
-            net_client,
-            authors_client: docs_client.as_ref().map(|d| d.authors()),
-            docs_client,
-            gossip,
-        })
+            acl,
+            sync_limits,
+            data_paths: Some(data_paths),
+        };
+        Self::spawn(options, storage, startup).await
     }
 
-    /// Create a new in memory iroh node with options.
-    #[uniffi::constructor(async_runtime = "tokio")]
-    pub async fn memory_with_options(options: NodeOptions) -> Result<Self, IrohError> {
-        let builder = iroh::Endpoint::builder();
-
+    async fn spawn_memory(options: NodeOptions) -> Result<Self, IrohError> {
         let (docs_store, author_store) = if options.enable_docs {
             let docs_store = iroh_docs::store::Store::memory();
             let author_store = iroh_docs::engine::DefaultAuthorStorage::Mem;
@@ -450,18 +851,89 @@ impl Iroh {
         } else {
             (None, None)
         };
-        let blobs_store = iroh_blobs::store::mem::Store::default();
-        let local_pool = LocalPool::default();
-        let (builder, gossip, blobs, docs) = apply_options(
+        let storage = NodeStorage {
+            blobs_store: iroh_blobs::store::mem::Store::default(),
+            docs_store,
+            author_store,
+            acl: Acl::default(),
+            sync_limits: DocSyncLimits::new(None),
+            data_paths: None,
+        };
+        Self::spawn(options, storage, &Startup::default()).await
+    }
+
+    /// Spawn a node on top of `storage`.
+    async fn spawn<S: iroh_blobs::store::Store>(
+        options: NodeOptions,
+        storage: NodeStorage<S>,
+        startup: &Startup,
+    ) -> Result<Self, IrohError> {
+        let NodeStorage {
+            blobs_store,
+            docs_store,
+            author_store,
+            acl,
+            sync_limits,
+            data_paths,
+        } = storage;
+        let relay_mode = relay_mode(&options)?;
+        let download_limits = options.download_limits.clone().unwrap_or_default();
+        let verify_on_read = options.verify_on_read;
+        let tombstone_purge = options.tombstone_purge.clone();
+        let sync_interval = options
+            .sync_tuning
+            .as_ref()
+            .and_then(|tuning| tuning.sync_interval);
+        let storage_pressure = options.storage_pressure.clone();
+        let events = NodeEvents::default();
+        let clock = options.clock.clone().map(EntryClock::new);
+        let content_cache = Arc::new(ContentCache::new(options.content_cache.clone()));
+        let keep_alive_peers =
+            parse_node_ids(options.keep_alive_peers.as_deref().unwrap_or_default())?;
+        let faults = Arc::new(FaultInjector::default());
+        let invites = Arc::new(DocInvites::default());
+        let provides = Arc::new(ProvideEvents::default());
+        let peer_errors = Arc::new(PeerErrors::new(direct_connect_timeout(&options)));
+        let warm_peers = Arc::new(WarmPeers::new(
+            peer_errors.clone(),
+            options.transport.as_ref(),
+        )?);
+        let hash_sets = Arc::new(HashSets::default());
+        let acl = Arc::new(acl);
+        let serve = Arc::new(ServeFilter::default());
+        let maintenance = Arc::new(Maintenance::default());
+        let sync_limits = Arc::new(sync_limits);
+        let features = node_features(&options);
+        let relay_map = relay_mode.relay_map();
+        let builder = iroh::Endpoint::builder().relay_mode(relay_mode);
+        let presence = PresenceStore::new(blobs_store.clone());
+        let local_pool = local_pool();
+        let (builder, gossip, blobs, docs, docs_sync) = apply_options(
             builder,
             options,
             blobs_store,
             docs_store,
             author_store,
             &local_pool,
+            &faults,
+            &invites,
+            &provides,
+            &peer_errors,
+            &hash_sets,
+            &acl,
+            &serve,
+            &maintenance,
+            startup,
         )
         .await?;
         let router = builder.spawn().await?;
+        for node_id in keep_alive_peers {
+            warm_peers.keep(router.endpoint().clone(), node_id, None);
+        }
+        let conn_history = Arc::new(ConnHistory::default());
+        let conn_history_task = spawn_conn_history(router.endpoint().clone(), conn_history.clone());
+        let relay_latencies = Arc::new(RelayLatencies::default());
+        let relay_probe_task = spawn_relay_probes(relay_map.clone(), relay_latencies.clone());
 
         let (listener, connector) = quic_rpc::transport::flume::channel(1);
         let listener = RpcServer::new(listener);
@@ -475,28 +947,182 @@ impl Iroh {
         let net_client = iroh_node_util::rpc::client::net::Client::new(client.clone().boxed());
 
         let docs_client = docs.map(|d| d.client().clone());
+        let docs_engine = docs_sync
+            .zip(docs_client.clone())
+            .map(|(sync, client)| DocsEngine {
+                sync,
+                client,
+                node_id: router.endpoint().node_id(),
+                blobs: blobs_client.clone(),
+                endpoint: router.endpoint().clone(),
+                invites: invites.clone(),
+                metrics: Default::default(),
+                events: events.clone(),
+                clock: clock.clone(),
+                content_cache: content_cache.clone(),
+                sync_limits: sync_limits.clone(),
+                peer_errors: peer_errors.clone(),
+                gossip: gossip.clone(),
+                namespaces: Default::default(),
+            });
+        if let Some(engine) = &docs_engine {
+            resume_rebuilds(engine).await?;
+            engine
+                .sync_limits
+                .resume(&engine.client, &engine.blobs)
+                .await?;
+        }
+
+        let tombstone_purge = docs_engine
+            .clone()
+            .zip(tombstone_purge)
+            .map(|(engine, policy)| {
+                Arc::new(spawn_tombstone_purge(engine, policy, maintenance.clone()))
+            });
+        let periodic_sync = docs_engine
+            .clone()
+            .zip(sync_interval)
+            .map(|(engine, interval)| {
+                Arc::new(spawn_periodic_sync(engine, interval, maintenance.clone()))
+            });
+        // in memory nodes have no disk to watch
+        let storage_monitor =
+            data_paths
+                .as_ref()
+                .zip(storage_pressure)
+                .map(|(data_paths, options)| {
+                    let dir = PathBuf::from(&data_paths.blobs);
+                    Arc::new(spawn_storage_monitor(events.clone(), dir, options))
+                });
 
         Ok(Iroh {
             router,
             _local_pool: Arc::new(local_pool),
             client,
             _handler: Arc::new(handler),
-            net_client,
             tags_client: blobs_client.tags(),
             blobs_client,
+            net_client,
             authors_client: docs_client.as_ref().map(|d| d.authors()),
             docs_client,
+            docs_engine,
             gossip,
+            relay_map,
+            download_limiter: Arc::new(DownloadLimiter::new(download_limits)),
+            incomplete_blobs: Default::default(),
+            tag_indexes: Default::default(),
+            presence,
+            verify_on_read,
+            warm_peers,
+            _tombstone_purge: tombstone_purge,
+            _periodic_sync: periodic_sync,
+            _storage_monitor: storage_monitor,
+            events,
+            provides,
+            peer_errors,
+            conn_history,
+            _conn_history_task: Arc::new(conn_history_task),
+            relay_latencies,
+            _relay_probe_task: Arc::new(relay_probe_task),
+            hash_sets,
+            acl,
+            serve,
+            content_cache,
+            snapshots: Arc::new(DocSnapshots::new(maintenance.clone())),
+            maintenance,
+            faults,
+            features,
+            shutdown: Default::default(),
+            stats_baseline: Default::default(),
+            data_paths,
         })
     }
+}
 
-    /// Access to node specific funtionaliy.
-    pub fn node(&self) -> Node {
-        let router = self.router.clone();
-        let client = self.client.clone().boxed();
-        let client = iroh_node_util::rpc::client::node::Client::new(client);
-        Node { router, client }
+/// The library features enabled by `options`, see `Node.supported_features`.
+fn node_features(options: &NodeOptions) -> Vec<String> {
+    let direct_only = options.direct_only.is_some();
+    let relay = !direct_only && !matches!(&options.relay_urls, Some(urls) if urls.is_empty());
+    let discovery = match options.node_discovery {
+        Some(NodeDiscoveryConfig::None) => false,
+        Some(NodeDiscoveryConfig::Default) => true,
+        None => !direct_only,
+    };
+    let enabled = [
+        ("blobs", true),
+        ("blob-push", options.accept_push.is_some()),
+        ("call-metrics", true),
+        ("custom-protocols", options.protocols.is_some()),
+        ("direct-only", direct_only),
+        ("discovery", discovery),
+        ("docs", options.enable_docs),
+        ("fault-injection", true),
+        ("gossip", true),
+        ("relay", relay),
+        ("replica-state", options.enable_docs),
+        ("tags", true),
+    ];
+    enabled
+        .into_iter()
+        .filter(|(_, enabled)| *enabled)
+        .map(|(feature, _)| feature.to_string())
+        .collect()
+}
+
+/// The connect timeout of a node in direct only mode, `None` if not in direct only mode.
+fn direct_connect_timeout(options: &NodeOptions) -> Option<Duration> {
+    let direct_only = options.direct_only.as_ref()?;
+    Some(
+        direct_only
+            .connect_timeout
+            .unwrap_or(DIRECT_CONNECT_TIMEOUT),
+    )
+}
+
+/// The STUN port of relay servers configured by url.
+const RELAY_STUN_PORT: u16 = 3478;
+
+/// The relay servers to use, as configured by `options.relay_urls`.
+fn relay_mode(options: &NodeOptions) -> anyhow::Result<iroh::RelayMode> {
+    if options.direct_only.is_some() {
+        anyhow::ensure!(
+            options.relay_urls.as_ref().map_or(true, Vec::is_empty),
+            "relay servers can not be used in direct only mode"
+        );
+        return Ok(iroh::RelayMode::Disabled);
+    }
+    let Some(urls) = &options.relay_urls else {
+        return Ok(iroh::RelayMode::Default);
+    };
+    if urls.is_empty() {
+        return Ok(iroh::RelayMode::Disabled);
     }
+    let nodes = urls
+        .iter()
+        .map(|url| {
+            Ok(iroh::RelayNode {
+                url: url.parse()?,
+                stun_only: false,
+                stun_port: RELAY_STUN_PORT,
+            })
+        })
+        .collect::<anyhow::Result<Vec<_>>>()?;
+    Ok(iroh::RelayMode::Custom(iroh::RelayMap::from_nodes(nodes)?))
+}
+
+/// Create the local pool used by the blobs protocol, configured according to the runtime
+/// options.
+fn local_pool() -> LocalPool {
+    static THREAD_NAME: OnceLock<String> = OnceLock::new();
+    let options = crate::runtime::options();
+    let mut config = local_pool::Config {
+        thread_name_prefix: THREAD_NAME.get_or_init(|| crate::runtime::thread_name("blobs")),
+        ..Default::default()
+    };
+    if let Some(threads) = options.blob_pool_threads {
+        config.threads = threads.max(1) as usize;
+    }
+    LocalPool::new(config)
 }
 
 async fn apply_options<S: iroh_blobs::store::Store>(
@@ -506,11 +1132,21 @@ async fn apply_options<S: iroh_blobs::store::Store>(
     docs_store: Option<iroh_docs::store::Store>,
     author_store: Option<iroh_docs::engine::DefaultAuthorStorage>,
     local_pool: &LocalPool,
+    faults: &Arc<FaultInjector>,
+    invites: &Arc<DocInvites>,
+    provides: &Arc<ProvideEvents>,
+    peer_errors: &Arc<PeerErrors>,
+    hash_sets: &Arc<HashSets>,
+    acl: &Arc<Acl>,
+    serve: &Arc<ServeFilter>,
+    maintenance: &Arc<Maintenance>,
+    startup: &Startup,
 ) -> anyhow::Result<(
     iroh::protocol::RouterBuilder,
     Gossip,
     Blobs<S>,
     Option<Docs<S>>,
+    Option<iroh_docs::actor::SyncHandle>,
 )> {
     let gc_period = if let Some(millis) = options.gc_interval_millis {
         match millis {
@@ -526,6 +1162,26 @@ async fn apply_options<S: iroh_blobs::store::Store>(
     } else {
         EventSender::default()
     };
+    let blob_events: EventSender = ProvideEventSender::new(provides.clone(), blob_events).into();
+
+    let accepted = options
+        .accept_protocols
+        .clone()
+        .unwrap_or(AcceptProtocols::All);
+    anyhow::ensure!(
+        accepted != AcceptProtocols::DocsOnly || options.enable_docs,
+        "accepting only docs requires docs to be enabled"
+    );
+
+    if let Some(port) = options.bind_port {
+        anyhow::ensure!(
+            options.ipv4_addr.is_none() && options.ipv6_addr.is_none(),
+            "bind_port can not be combined with ipv4_addr or ipv6_addr"
+        );
+        builder = builder
+            .bind_addr_v4(SocketAddrV4::new(Ipv4Addr::UNSPECIFIED, port))
+            .bind_addr_v6(SocketAddrV6::new(Ipv6Addr::UNSPECIFIED, port, 0, 0));
+    }
 
     if let Some(addr) = options.ipv4_addr {
         builder = builder.bind_addr_v4(addr.parse()?);
@@ -535,45 +1191,114 @@ async fn apply_options<S: iroh_blobs::store::Store>(
         builder = builder.bind_addr_v6(addr.parse()?);
     }
 
+    let direct_only = options.direct_only.is_some();
     builder = match options.node_discovery {
+        Some(NodeDiscoveryConfig::Default) if direct_only => {
+            anyhow::bail!("the default node discovery can not be used in direct only mode")
+        }
         Some(NodeDiscoveryConfig::None) => builder.clear_discovery(),
+        None if direct_only => builder.clear_discovery(),
         Some(NodeDiscoveryConfig::Default) | None => builder.discovery_n0(),
     };
 
+    if let Some(transport) = options.transport {
+        builder = builder.transport_config(transport.transport_config()?);
+    }
+
+    if let Some(fallback) = options.tcp_fallback {
+        anyhow::ensure!(
+            !direct_only,
+            "the tcp fallback can not be used in direct only mode"
+        );
+        anyhow::ensure!(
+            !matches!(&options.relay_urls, Some(urls) if urls.is_empty()),
+            "the tcp fallback requires relay servers"
+        );
+        if let Some(proxy) = fallback.proxy_url {
+            builder = builder.proxy_url(url::Url::parse(&proxy)?);
+        } else if fallback.proxy_from_env {
+            builder = builder.proxy_from_env();
+        }
+    }
+
     if let Some(secret_key) = options.secret_key {
         let key: [u8; 32] = AsRef::<[u8]>::as_ref(&secret_key).try_into()?;
         let key = iroh::SecretKey::from_bytes(&key);
         builder = builder.secret_key(key);
     }
 
+    startup.phase(StartupPhase::BindEndpoint).await?;
     let endpoint = builder.bind().await?;
+    startup.phase(StartupPhase::StartProtocols).await?;
     let mut builder = iroh::protocol::Router::builder(endpoint);
 
-    let endpoint = Arc::new(Endpoint::new(builder.endpoint().clone()));
+    let endpoint = Arc::new(Endpoint::new(
+        builder.endpoint().clone(),
+        peer_errors.clone(),
+    ));
+
+    let faulty = |handler| FaultyProtocol::new(handler, faults.clone());
 
     // Add default protocols for now
 
     // iroh gossip
-    let gossip = Gossip::builder().spawn(builder.endpoint().clone()).await?;
-    builder = builder.accept(iroh_gossip::ALPN, gossip.clone());
+    let mut gossip = Gossip::builder();
+    if let Some(tuning) = &options.sync_tuning {
+        gossip = gossip.membership_config(tuning.membership_config()?);
+    }
+    let gossip = gossip.spawn(builder.endpoint().clone()).await?;
+    if accepted.allows(iroh_gossip::ALPN) {
+        builder = builder.accept(
+            iroh_gossip::ALPN,
+            faulty(AclGossip::new(gossip.clone(), acl.clone())),
+        );
+    }
 
     // iroh blobs
-    let downloader = Downloader::new(
+    let download_limits = options.download_limits.clone().unwrap_or_default();
+    let downloader = Downloader::with_config(
         blob_store.clone(),
         builder.endpoint().clone(),
         local_pool.handle().clone(),
+        download_limits.concurrency_limits(),
+        Default::default(),
     );
     let blobs = Blobs::new(
         blob_store.clone(),
         local_pool.handle().clone(),
-        blob_events,
+        blob_events.clone(),
         downloader.clone(),
         builder.endpoint().clone(),
     );
 
-    builder = builder.accept(iroh_blobs::ALPN, blobs.clone());
+    // served by our own handler to know the peer of every request
+    let provide = ProvideProtocol::new(
+        blobs.clone(),
+        blob_store.clone(),
+        blob_events,
+        local_pool.handle().clone(),
+        provides.clone(),
+        acl.clone(),
+        blobs.client().clone(),
+        serve.clone(),
+    );
+    if accepted.allows(iroh_blobs::ALPN) {
+        builder = builder.accept(iroh_blobs::ALPN, faulty(provide));
+    }
 
-    let docs = if options.enable_docs {
+    if let Some(callback) = options.accept_push {
+        if accepted.allows(BLOB_PUSH_ALPN) {
+            let push = BlobPushProtocol::new(callback, blobs.client().clone(), acl.clone());
+            builder = builder.accept(BLOB_PUSH_ALPN, faulty(push));
+        }
+    }
+
+    if accepted.allows(HASH_DIFF_ALPN) {
+        let hash_diff = HashDiffProtocol::new(hash_sets.clone(), acl.clone());
+        builder = builder.accept(HASH_DIFF_ALPN, faulty(hash_diff));
+    }
+
+    let (docs, docs_sync) = if options.enable_docs {
         let engine = iroh_docs::engine::Engine::spawn(
             builder.endpoint().clone(),
             gossip.clone(),
@@ -584,15 +1309,26 @@ async fn apply_options<S: iroh_blobs::store::Store>(
             local_pool.handle().clone(),
         )
         .await?;
+        let sync = engine.sync.clone();
         let docs = Docs::new(engine);
-        builder = builder.accept(iroh_docs::ALPN, docs.clone());
+        // not covered by the access control list: the engine takes the connection before the
+        // peer is known and offers no hook to refuse it afterwards
+        if accepted.allows(iroh_docs::ALPN) {
+            builder = builder.accept(iroh_docs::ALPN, faulty(docs.clone()));
+        }
+        if accepted.allows(DOC_INVITE_ALPN) {
+            let invite =
+                DocInviteProtocol::new(invites.clone(), docs.client().clone(), acl.clone());
+            builder = builder.accept(DOC_INVITE_ALPN, faulty(invite));
+        }
         blobs.add_protected(docs.protect_cb())?;
 
-        Some(docs)
+        (Some(docs), Some(sync))
     } else {
-        None
+        (None, None)
     };
     if let Some(period) = gc_period {
+        blobs.add_protected(gc_gate(maintenance.clone()))?;
         blobs.start_gc(GcConfig {
             period,
             done_callback: None,
@@ -602,34 +1338,103 @@ async fn apply_options<S: iroh_blobs::store::Store>(
     // Add custom protocols
     if let Some(protocols) = options.protocols {
         for (alpn, protocol) in protocols {
+            if !accepted.allows(&alpn) {
+                continue;
+            }
             let handler = protocol.create(endpoint.clone());
-            builder = builder.accept(alpn, ProtocolWrapper { handler });
+            builder = builder.accept(alpn, faulty(ProtocolWrapper { handler }));
         }
     }
 
-    Ok((builder, gossip, blobs, docs))
+    Ok((builder, gossip, blobs, docs, docs_sync))
 }
 
 /// Iroh node client.
 #[derive(uniffi::Object)]
 pub struct Node {
     router: iroh::protocol::Router,
-    client: iroh_node_util::rpc::client::node::Client,
+    pub(crate) client: iroh_node_util::rpc::client::node::Client,
+    data_paths: Option<DataPaths>,
+    blobs_client: BlobsClient,
+    net_client: NetClient,
+    relay_map: iroh::RelayMap,
+    features: Vec<String>,
+    shutdown: Arc<ShutdownState>,
+    pub(crate) stats_baseline: Arc<std::sync::Mutex<HashMap<String, u64>>>,
+    events: NodeEvents,
+    pub(crate) acl: Arc<Acl>,
+    pub(crate) serve: Arc<ServeFilter>,
+    pub(crate) maintenance: Arc<Maintenance>,
+    peer_errors: Arc<PeerErrors>,
+}
+
+/// Tracks the shutdown of a node, shared by all its handles.
+#[derive(Debug, Default)]
+pub(crate) struct ShutdownState {
+    /// Set once the shutdown started.
+    closed: AtomicBool,
+    /// Set once the shutdown completed.
+    done: tokio::sync::OnceCell<()>,
+}
+
+impl ShutdownState {
+    fn is_closed(&self) -> bool {
+        self.closed.load(Ordering::Acquire)
+    }
+}
+
+/// How long a single health probe may take before it counts as failed.
+const PROBE_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// The result of [`Node::ready`] or [`Node::healthy`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct HealthStatus {
+    /// Whether all checks passed.
+    pub ok: bool,
+    /// Why checks failed, empty if `ok` is true.
+    pub reasons: Vec<String>,
+}
+
+impl HealthStatus {
+    fn from_reasons(reasons: Vec<String>) -> Self {
+        HealthStatus {
+            ok: reasons.is_empty(),
+            reasons,
+        }
+    }
+}
+
+/// Run a probe, turning errors and timeouts into a failure reason.
+async fn probe<T>(
+    name: &str,
+    fut: impl std::future::Future<Output = anyhow::Result<T>>,
+) -> Result<T, String> {
+    match tokio::time::timeout(PROBE_TIMEOUT, fut).await {
+        Ok(Ok(value)) => Ok(value),
+        Ok(Err(err)) => Err(format!("{name}: {err}")),
+        Err(_) => Err(format!("{name}: timed out")),
+    }
 }
 
 #[uniffi::export]
 impl Node {
     /// Get statistics of the running node.
+    ///
+    /// Counters start at zero again after [`Self::stats_reset`].
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn stats(&self) -> Result<HashMap<String, CounterStats>, IrohError> {
         let stats = self.client.stats().await?;
+        let baseline = self.stats_baseline.lock().expect("poisoned");
         let stats = stats
             .into_iter()
             .map(|(k, v)| {
+                let value = v
+                    .value
+                    .saturating_sub(baseline.get(&k).copied().unwrap_or_default());
                 (
                     k,
                     CounterStats {
-                        value: u32::try_from(v.value).expect("value too large"),
+                        value: u32::try_from(value).expect("value too large"),
                         description: v.description,
                     },
                 )
@@ -638,46 +1443,142 @@ impl Node {
         Ok(stats)
     }
 
+    /// Reset the counters returned by [`Self::stats`] to zero, e.g. to measure a single
+    /// scenario in a benchmark.
+    ///
+    /// The underlying metrics are shared by all nodes in the process and keep counting, the
+    /// reset only applies to the stats returned by this node. The counters of a single
+    /// connection are reset with `Connection.stats_reset`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stats_reset(&self) -> Result<(), IrohError> {
+        let stats = self.client.stats().await?;
+        let mut baseline = self.stats_baseline.lock().expect("poisoned");
+        *baseline = stats.into_iter().map(|(k, v)| (k, v.value)).collect();
+        Ok(())
+    }
+
+    /// Subscribe to events concerning the node as a whole, such as the disk running full.
+    ///
+    /// The callback is called for every event until it returns an error or the node is
+    /// dropped. Subscribing while the disk space is low delivers the last
+    /// `NodeEventType::LowDiskSpace` event right away.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_events(&self, cb: Arc<dyn NodeEventCallback>) {
+        self.events.subscribe(cb);
+    }
+
     /// Get status information about a node
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn status(&self) -> Result<Arc<NodeStatus>, IrohError> {
-        let res = self.client.status().await.map(|n| Arc::new(n.into()))?;
-        Ok(res)
+        let status = self.client.status().await?;
+        Ok(Arc::new(NodeStatus {
+            status,
+            data_paths: self.data_paths.clone(),
+        }))
+    }
+
+    /// The library features enabled on this node, a subset of `library_features`.
+    #[uniffi::method]
+    pub fn supported_features(&self) -> Vec<String> {
+        self.features.clone()
+    }
+
+    /// Check whether the node is alive, suitable for a liveness probe.
+    ///
+    /// Fails if the node was shut down or its blob store or RPC handlers stopped responding.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn healthy(&self) -> HealthStatus {
+        HealthStatus::from_reasons(self.liveness_failures().await)
+    }
+
+    /// Check whether the node can serve requests, suitable for a readiness probe.
+    ///
+    /// In addition to [`Node::healthy`], this requires the endpoint to have local addresses
+    /// and, unless relays are disabled, a connection to a home relay.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn ready(&self) -> HealthStatus {
+        let mut reasons = self.liveness_failures().await;
+        if !reasons.is_empty() {
+            return HealthStatus::from_reasons(reasons);
+        }
+
+        match probe("endpoint", self.net_client.node_addr()).await {
+            Ok(addr) if addr.direct_addresses.is_empty() => {
+                reasons.push("endpoint: no local addresses yet".to_string());
+            }
+            Ok(_) => {}
+            Err(reason) => reasons.push(reason),
+        }
+        if !self.relay_map.is_empty() {
+            match probe("relay", self.net_client.home_relay()).await {
+                Ok(Some(_)) => {}
+                Ok(None) => reasons.push("relay: not connected to a home relay".to_string()),
+                Err(reason) => reasons.push(reason),
+            }
+        }
+        HealthStatus::from_reasons(reasons)
     }
 
     /// Shutdown this iroh node.
+    ///
+    /// Can be called multiple times, also concurrently, every call returns once the node is
+    /// shut down.
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn shutdown(&self) -> Result<(), IrohError> {
-        self.router.shutdown().await?;
+        self.shutdown.closed.store(true, Ordering::Release);
+        self.shutdown
+            .done
+            .get_or_try_init(|| self.router.shutdown())
+            .await?;
         Ok(())
     }
 
+    /// Whether [`Self::shutdown`] was called.
+    #[uniffi::method]
+    pub fn is_closed(&self) -> bool {
+        self.shutdown.is_closed()
+    }
+
     #[uniffi::method]
     pub fn endpoint(&self) -> Endpoint {
-        Endpoint::new(self.router.endpoint().clone())
+        Endpoint::new(self.router.endpoint().clone(), self.peer_errors.clone())
+    }
+}
+
+impl Node {
+    async fn liveness_failures(&self) -> Vec<String> {
+        if self.router.endpoint().is_closed() {
+            return vec!["node is shut down".to_string()];
+        }
+        let mut reasons = Vec::new();
+        let store = self.blobs_client.status(iroh_blobs::Hash::EMPTY);
+        if let Err(reason) = probe("blob store", store).await {
+            reasons.push(reason);
+        }
+        if let Err(reason) = probe("rpc", self.client.status()).await {
+            reasons.push(reason);
+        }
+        reasons
     }
 }
 
 /// The response to a status request
 #[derive(Debug, uniffi::Object)]
-pub struct NodeStatus(iroh_node_util::rpc::client::net::NodeStatus);
-
-impl From<iroh_node_util::rpc::client::net::NodeStatus> for NodeStatus {
-    fn from(n: iroh_node_util::rpc::client::net::NodeStatus) -> Self {
-        NodeStatus(n)
-    }
+pub struct NodeStatus {
+    status: iroh_node_util::rpc::client::net::NodeStatus,
+    data_paths: Option<DataPaths>,
 }
 
 #[uniffi::export]
 impl NodeStatus {
     /// The node id and socket addresses of this node.
     pub fn node_addr(&self) -> Arc<NodeAddr> {
-        Arc::new(self.0.addr.clone().into())
+        Arc::new(self.status.addr.clone().into())
     }
 
     /// The bound listening addresses of the node
     pub fn listen_addrs(&self) -> Vec<String> {
-        self.0
+        self.status
             .listen_addrs
             .iter()
             .map(|addr| addr.to_string())
@@ -686,12 +1587,17 @@ impl NodeStatus {
 
     /// The version of the node
     pub fn version(&self) -> String {
-        self.0.version.clone()
+        self.status.version.clone()
     }
 
     /// The address of the RPC of the node
     pub fn rpc_addr(&self) -> Option<String> {
-        self.0.rpc_addr.map(|a| a.to_string())
+        self.status.rpc_addr.map(|a| a.to_string())
+    }
+
+    /// The directories the node stores its data in, `None` for in memory nodes.
+    pub fn data_paths(&self) -> Option<DataPaths> {
+        self.data_paths.clone()
     }
 }
 
@@ -731,6 +1637,7 @@ impl iroh_blobs::provider::CustomEventSender for BlobProvideEvents {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::test_utils::{local_node, local_options, NoProgress};
 
     #[tokio::test]
     async fn test_memory() {
@@ -738,4 +1645,433 @@ mod tests {
         let id = node.net().node_id().await.unwrap();
         println!("{id}");
     }
+
+    #[tokio::test]
+    async fn test_supported_features() {
+        let node = Iroh::memory().await.unwrap();
+        let features = node.node().supported_features();
+        assert!(features.contains(&"gossip".to_string()));
+        assert!(!features.contains(&"docs".to_string()));
+        for feature in &features {
+            assert!(crate::library_features().contains(feature));
+        }
+
+        let options = NodeOptions {
+            enable_docs: true,
+            relay_urls: Some(vec![]),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        let features = node.node().supported_features();
+        assert!(features.contains(&"docs".to_string()));
+        assert!(!features.contains(&"relay".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_shutdown_idempotent() {
+        let node = Iroh::memory().await.unwrap();
+        assert!(!node.is_closed());
+
+        let (a, b) = tokio::join!(node.node().shutdown(), node.node().shutdown());
+        a.unwrap();
+        b.unwrap();
+        node.node().shutdown().await.unwrap();
+        assert!(node.is_closed());
+        assert!(node.node().is_closed());
+    }
+
+    #[tokio::test]
+    async fn test_stats_reset() {
+        let node = Iroh::memory().await.unwrap();
+        let before = node.node().stats().await.unwrap();
+        node.node().stats_reset().await.unwrap();
+        let after = node.node().stats().await.unwrap();
+        assert_eq!(before.len(), after.len());
+        for (name, counter) in &after {
+            // Background tasks keep counting, but never faster than since process start.
+            assert!(counter.value <= before[name].value, "{name}");
+        }
+
+        // connections count on their own
+        let client = local_node().await;
+        let server = local_node().await;
+        let addr = server.net().node_addr().await.unwrap();
+        let conn = client
+            .node()
+            .endpoint()
+            .connect(&addr, iroh_blobs::ALPN)
+            .await
+            .unwrap();
+        let before = conn.stats();
+        // the client hello alone is padded to 1200 bytes
+        assert!(before.bytes_sent >= 1200);
+        assert!(before.datagrams_received > 0);
+        conn.stats_reset();
+        let after = conn.stats();
+        assert!(after.bytes_sent < before.bytes_sent);
+        assert!(after.datagrams_received < before.datagrams_received);
+        node.node().shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_health() {
+        let options = NodeOptions {
+            relay_urls: Some(vec![]),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        let status = node.node().healthy().await;
+        assert!(status.ok, "{:?}", status.reasons);
+        let status = node.node().ready().await;
+        assert!(status.ok, "{:?}", status.reasons);
+
+        node.node().shutdown().await.unwrap();
+        let status = node.node().healthy().await;
+        assert!(!status.ok);
+        assert_eq!(status.reasons, ["node is shut down"]);
+        assert!(!node.node().ready().await.ok);
+    }
+
+    #[tokio::test]
+    async fn test_fault_offline() {
+        let provider = Iroh::memory().await.unwrap();
+        let node = Iroh::memory().await.unwrap();
+        let outcome = provider.blobs().add_bytes(b"hello".to_vec()).await.unwrap();
+        let addr = provider.net().node_addr().await.unwrap();
+
+        provider.faults().set_offline(true);
+        let download_opts = crate::BlobDownloadOptions::new(
+            crate::BlobFormat::Raw,
+            vec![Arc::new(addr.clone())],
+            Arc::new(crate::SetTagOption::auto()),
+        )
+        .unwrap();
+        struct Ignore;
+        #[async_trait::async_trait]
+        impl crate::DownloadCallback for Ignore {
+            async fn progress(
+                &self,
+                _progress: Arc<crate::DownloadProgress>,
+            ) -> Result<(), CallbackError> {
+                Ok(())
+            }
+        }
+        let download_opts = Arc::new(download_opts);
+        node.blobs()
+            .download(
+                outcome.hash.clone(),
+                download_opts.clone(),
+                Arc::new(Ignore),
+            )
+            .await
+            .ok();
+        assert!(node
+            .blobs()
+            .read_to_bytes(outcome.hash.clone())
+            .await
+            .is_err());
+
+        provider.faults().clear();
+        node.blobs()
+            .download(outcome.hash.clone(), download_opts, Arc::new(Ignore))
+            .await
+            .unwrap();
+        let got = node.blobs().read_to_bytes(outcome.hash).await.unwrap();
+        assert_eq!(got, b"hello".to_vec());
+    }
+
+    #[tokio::test]
+    async fn test_transport_options() {
+        let transport = TransportOptions {
+            idle_timeout: Some(Duration::from_secs(5)),
+            keep_alive_interval: Some(Duration::from_secs(1)),
+        };
+        let options = NodeOptions {
+            transport: Some(transport.clone()),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        node.node().shutdown().await.unwrap();
+
+        // idle timeouts are limited to 2^62 milliseconds
+        let transport = TransportOptions {
+            idle_timeout: Some(Duration::MAX),
+            ..transport
+        };
+        assert!(transport.transport_config().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_relay_map() {
+        let relay_urls = vec![
+            "https://relay-a.example.com".to_string(),
+            "https://relay-b.example.com".to_string(),
+        ];
+        let options = NodeOptions {
+            relay_urls: Some(relay_urls.clone()),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        let relays = node.net().relay_map().await.unwrap();
+        let urls: Vec<_> = relays.iter().map(|r| r.url.clone()).collect();
+        let expected: Vec<_> = relay_urls
+            .iter()
+            .map(|url| url.parse::<iroh::RelayUrl>().unwrap().to_string())
+            .collect();
+        assert_eq!(urls, expected);
+        node.node().shutdown().await.unwrap();
+
+        let options = NodeOptions {
+            relay_urls: Some(vec![]),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        assert!(node.net().relay_map().await.unwrap().is_empty());
+
+        let options = NodeOptions {
+            relay_urls: Some(vec!["not a url".to_string()]),
+            ..Default::default()
+        };
+        assert!(Iroh::memory_with_options(options).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_tcp_fallback() {
+        let fallback = |proxy_url: &str| TcpFallbackOptions {
+            proxy_url: Some(proxy_url.to_string()),
+            proxy_from_env: false,
+        };
+        let options = NodeOptions {
+            tcp_fallback: Some(fallback("http://proxy.example.com:3128")),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        node.node().shutdown().await.unwrap();
+
+        let options = NodeOptions {
+            tcp_fallback: Some(fallback("not a url")),
+            ..Default::default()
+        };
+        assert!(Iroh::memory_with_options(options).await.is_err());
+
+        // there is nothing to fall back to without relay servers
+        let options = NodeOptions {
+            relay_urls: Some(vec![]),
+            tcp_fallback: Some(TcpFallbackOptions::default()),
+            ..Default::default()
+        };
+        assert!(Iroh::memory_with_options(options).await.is_err());
+
+        let relay = ConnectionType::Relay("https://relay.example.com".to_string());
+        assert_eq!(relay.transport(), ConnTransport::RelayTcp);
+        let direct = ConnectionType::Direct("127.0.0.1:1234".to_string());
+        assert_eq!(direct.transport(), ConnTransport::Udp);
+    }
+
+    #[tokio::test]
+    async fn test_direct_only() {
+        let direct_only = || {
+            Some(DirectOnlyOptions {
+                connect_timeout: Some(Duration::from_secs(2)),
+            })
+        };
+        for options in [
+            NodeOptions {
+                relay_urls: Some(vec!["https://relay.example.com".to_string()]),
+                direct_only: direct_only(),
+                ..Default::default()
+            },
+            NodeOptions {
+                tcp_fallback: Some(TcpFallbackOptions::default()),
+                direct_only: direct_only(),
+                ..Default::default()
+            },
+            NodeOptions {
+                node_discovery: Some(NodeDiscoveryConfig::Default),
+                direct_only: direct_only(),
+                ..Default::default()
+            },
+        ] {
+            assert!(Iroh::memory_with_options(options).await.is_err());
+        }
+
+        let options = || NodeOptions {
+            direct_only: direct_only(),
+            ..Default::default()
+        };
+        let node = Iroh::memory_with_options(options()).await.unwrap();
+        let peer = Iroh::memory_with_options(options()).await.unwrap();
+        let features = node.node().supported_features();
+        assert!(features.contains(&"direct-only".to_string()));
+        assert!(!features.contains(&"relay".to_string()));
+        assert!(!features.contains(&"discovery".to_string()));
+
+        let addr = peer.net().node_addr().await.unwrap();
+        assert!(addr.relay_url().is_none());
+        node.node()
+            .endpoint()
+            .connect(&addr, iroh_blobs::protocol::ALPN)
+            .await
+            .unwrap();
+
+        // a peer only reachable through a relay
+        let peer_id = PublicKey::from_string(peer.net().node_id().await.unwrap()).unwrap();
+        let other = Iroh::memory_with_options(options()).await.unwrap();
+        let relayed = NodeAddr::new(
+            &peer_id,
+            Some("https://relay.example.com".to_string()),
+            vec![],
+        );
+        let err = other
+            .node()
+            .endpoint()
+            .connect(&relayed, iroh_blobs::protocol::ALPN)
+            .await
+            .unwrap_err();
+        assert_eq!(err.kind(), crate::IrohErrorKind::DirectConnectionFailed);
+
+        // a ticket carrying a relay url is downloaded from directly
+        let outcome = peer.blobs().add_bytes(b"direct".to_vec()).await.unwrap();
+        let mut ticket_addr: iroh::NodeAddr = addr.try_into().unwrap();
+        ticket_addr = ticket_addr.with_relay_url("https://relay.example.com".parse().unwrap());
+        let ticket =
+            iroh_blobs::ticket::BlobTicket::new(ticket_addr, outcome.hash.0, outcome.format.into())
+                .unwrap();
+        let ticket = crate::BlobTicket::new(ticket.to_string()).unwrap();
+        let downloader = Iroh::memory_with_options(options()).await.unwrap();
+        downloader
+            .blobs()
+            .download(
+                ticket.hash(),
+                ticket.as_download_options(),
+                Arc::new(NoProgress),
+            )
+            .await
+            .unwrap();
+        let data = downloader
+            .blobs()
+            .read_to_bytes(outcome.hash.clone())
+            .await
+            .unwrap();
+        assert_eq!(data, b"direct".to_vec());
+        let info = downloader
+            .net()
+            .remote_info(&peer_id)
+            .await
+            .unwrap()
+            .unwrap();
+        assert!(info.relay_url.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_bind_port() {
+        let port = std::net::UdpSocket::bind("127.0.0.1:0")
+            .unwrap()
+            .local_addr()
+            .unwrap()
+            .port();
+        let options = NodeOptions {
+            bind_port: Some(port),
+            ..local_options()
+        };
+        let node = Iroh::memory_with_options(options).await.unwrap();
+        let status = node.node().status().await.unwrap();
+        let suffix = format!(":{port}");
+        assert!(status
+            .listen_addrs()
+            .iter()
+            .any(|addr| addr.ends_with(&suffix)));
+
+        let res = Iroh::memory_with_options(NodeOptions {
+            bind_port: Some(port),
+            ipv4_addr: Some("127.0.0.1:0".to_string()),
+            ..Default::default()
+        })
+        .await;
+        assert!(res.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_accept_protocols() {
+        let options = |accept_protocols| NodeOptions {
+            accept_protocols,
+            ..local_options()
+        };
+        let err = Iroh::memory_with_options(NodeOptions {
+            accept_protocols: Some(AcceptProtocols::DocsOnly),
+            ..Default::default()
+        })
+        .await;
+        assert!(err.is_err());
+
+        let mirror = Iroh::memory_with_options(options(Some(AcceptProtocols::BlobsOnly)))
+            .await
+            .unwrap();
+        let node = Iroh::memory_with_options(options(None)).await.unwrap();
+        let addr = mirror.net().node_addr().await.unwrap();
+        node.node()
+            .endpoint()
+            .connect(&addr, iroh_blobs::ALPN)
+            .await
+            .unwrap();
+        assert!(node
+            .node()
+            .endpoint()
+            .connect(&addr, iroh_docs::ALPN)
+            .await
+            .is_err());
+        assert!(node
+            .node()
+            .endpoint()
+            .connect(&addr, iroh_gossip::ALPN)
+            .await
+            .is_err());
+
+        let custom = AcceptProtocols::Custom {
+            alpns: vec![iroh_gossip::ALPN.to_vec()],
+        };
+        let gossip_only = Iroh::memory_with_options(options(Some(custom)))
+            .await
+            .unwrap();
+        let addr = gossip_only.net().node_addr().await.unwrap();
+        node.node()
+            .endpoint()
+            .connect(&addr, iroh_gossip::ALPN)
+            .await
+            .unwrap();
+        assert!(node
+            .node()
+            .endpoint()
+            .connect(&addr, iroh_blobs::ALPN)
+            .await
+            .is_err());
+
+        let names: Vec<_> = builtin_protocols().into_iter().map(|p| p.name).collect();
+        assert!(names.contains(&"docs".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_data_paths() {
+        let dir = tempfile::tempdir().unwrap();
+        let blobs_dir = tempfile::tempdir().unwrap();
+        let blobs_path = blobs_dir.path().to_string_lossy().into_owned();
+        let options = NodeOptions {
+            enable_docs: true,
+            blobs_path: Some(blobs_path.clone()),
+            ..Default::default()
+        };
+        let node =
+            Iroh::persistent_with_options(dir.path().to_string_lossy().into_owned(), options)
+                .await
+                .unwrap();
+        let paths = node.node().status().await.unwrap().data_paths().unwrap();
+        assert_eq!(paths.blobs, blobs_path);
+        assert_eq!(paths.docs, dir.path().to_string_lossy());
+        assert!(dir.path().join("docs.redb").exists());
+        assert!(!dir.path().join("blobs").exists());
+        node.node().shutdown().await.unwrap();
+
+        let node = Iroh::memory().await.unwrap();
+        assert!(node.node().status().await.unwrap().data_paths().is_none());
+    }
 }
@@ -0,0 +1,389 @@
+use std::{
+    path::PathBuf,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use tokio::sync::broadcast;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::{debug, warn};
+
+use crate::{error::is_storage_full, CallbackError, SnapshotFailed, SnapshotWritten};
+
+/// Number of node events buffered per subscriber before the oldest are dropped.
+const NODE_EVENTS_CAPACITY: usize = 64;
+/// How often the free disk space is checked by default.
+const DEFAULT_STORAGE_CHECK_INTERVAL: Duration = Duration::from_secs(30);
+
+/// Thresholds for storage pressure events, see `NodeOptions.storage_pressure`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct StoragePressureOptions {
+    /// Emit `NodeEventType::LowDiskSpace` once less than this many bytes are available on the
+    /// disk holding the blob store.
+    pub low_disk_bytes: u64,
+    /// How often the available space is checked. Defaults to 30 seconds.
+    #[uniffi(default = None)]
+    pub check_interval: Option<Duration>,
+}
+
+/// The space on the disk holding the data of a node.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct DiskSpace {
+    /// The directory that was checked.
+    pub path: String,
+    /// Bytes available to the node.
+    pub available: u64,
+    /// Size of the disk in bytes.
+    pub total: u64,
+}
+
+/// A write failed because the disk is full.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct WriteFailed {
+    /// The method that failed, e.g. `blobs.add_bytes`.
+    pub operation: String,
+    /// The error message.
+    pub message: String,
+}
+
+/// Events concerning a node as a whole, see `Node.subscribe_events`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Object)]
+#[uniffi::export(Display)]
+pub enum NodeEvent {
+    /// The available disk space dropped below `StoragePressureOptions.low_disk_bytes`.
+    LowDiskSpace(DiskSpace),
+    /// The available disk space is above `StoragePressureOptions.low_disk_bytes` again.
+    DiskSpaceRecovered(DiskSpace),
+    /// A write failed because the disk is full.
+    WriteFailed(WriteFailed),
+    /// A scheduled document snapshot was written, see `Docs.configure_snapshot`.
+    SnapshotWritten(SnapshotWritten),
+    /// A scheduled document snapshot failed, see `Docs.configure_snapshot`.
+    SnapshotFailed(SnapshotFailed),
+}
+
+/// The type of a [`NodeEvent`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum NodeEventType {
+    /// The available disk space dropped below `StoragePressureOptions.low_disk_bytes`.
+    LowDiskSpace,
+    /// The available disk space is above `StoragePressureOptions.low_disk_bytes` again.
+    DiskSpaceRecovered,
+    /// A write failed because the disk is full.
+    WriteFailed,
+    /// A scheduled document snapshot was written, see `Docs.configure_snapshot`.
+    SnapshotWritten,
+    /// A scheduled document snapshot failed, see `Docs.configure_snapshot`.
+    SnapshotFailed,
+}
+
+crate::display_via_debug!(NodeEvent);
+
+crate::display_via_debug!(NodeEventType);
+
+#[uniffi::export]
+impl NodeEvent {
+    /// The type of this event.
+    pub fn r#type(&self) -> NodeEventType {
+        match self {
+            Self::LowDiskSpace(_) => NodeEventType::LowDiskSpace,
+            Self::DiskSpaceRecovered(_) => NodeEventType::DiskSpaceRecovered,
+            Self::WriteFailed(_) => NodeEventType::WriteFailed,
+            Self::SnapshotWritten(_) => NodeEventType::SnapshotWritten,
+            Self::SnapshotFailed(_) => NodeEventType::SnapshotFailed,
+        }
+    }
+
+    /// For `NodeEventType::LowDiskSpace`, returns the disk space
+    pub fn as_low_disk_space(&self) -> Option<DiskSpace> {
+        if let Self::LowDiskSpace(space) = self {
+            Some(space.clone())
+        } else {
+            None
+        }
+    }
+
+    /// For `NodeEventType::DiskSpaceRecovered`, returns the disk space
+    pub fn as_disk_space_recovered(&self) -> Option<DiskSpace> {
+        if let Self::DiskSpaceRecovered(space) = self {
+            Some(space.clone())
+        } else {
+            None
+        }
+    }
+
+    /// For `NodeEventType::WriteFailed`, returns the failed write
+    pub fn as_write_failed(&self) -> Option<WriteFailed> {
+        if let Self::WriteFailed(failed) = self {
+            Some(failed.clone())
+        } else {
+            None
+        }
+    }
+
+    /// For `NodeEventType::SnapshotWritten`, returns the written snapshot
+    pub fn as_snapshot_written(&self) -> Option<SnapshotWritten> {
+        if let Self::SnapshotWritten(written) = self {
+            Some(written.clone())
+        } else {
+            None
+        }
+    }
+
+    /// For `NodeEventType::SnapshotFailed`, returns the failure
+    pub fn as_snapshot_failed(&self) -> Option<SnapshotFailed> {
+        if let Self::SnapshotFailed(failed) = self {
+            Some(failed.clone())
+        } else {
+            None
+        }
+    }
+}
+
+/// The `event` method is called for every [`NodeEvent`] of the node it is subscribed to.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait NodeEventCallback: Send + Sync + 'static {
+    async fn event(&self, event: Arc<NodeEvent>) -> Result<(), CallbackError>;
+}
+
+/// Hands out the events of a node to its subscribers.
+#[derive(Debug, Clone)]
+pub(crate) struct NodeEvents {
+    sender: broadcast::Sender<NodeEvent>,
+    /// The last `NodeEvent::LowDiskSpace`, while the disk space did not recover.
+    low_disk: Arc<Mutex<Option<NodeEvent>>>,
+}
+
+impl Default for NodeEvents {
+    fn default() -> Self {
+        let (sender, _) = broadcast::channel(NODE_EVENTS_CAPACITY);
+        NodeEvents {
+            sender,
+            low_disk: Default::default(),
+        }
+    }
+}
+
+impl NodeEvents {
+    pub(crate) fn emit(&self, event: NodeEvent) {
+        match event {
+            NodeEvent::LowDiskSpace(_) => {
+                *self.low_disk.lock().expect("poisoned") = Some(event.clone())
+            }
+            NodeEvent::DiskSpaceRecovered(_) => *self.low_disk.lock().expect("poisoned") = None,
+            NodeEvent::WriteFailed(_)
+            | NodeEvent::SnapshotWritten(_)
+            | NodeEvent::SnapshotFailed(_) => {}
+        }
+        // no subscribers is fine
+        self.sender.send(event).ok();
+    }
+
+    /// Emit `NodeEvent::WriteFailed` if `res` failed because the disk is full.
+    pub(crate) fn check_write<T>(
+        &self,
+        operation: &str,
+        res: anyhow::Result<T>,
+    ) -> anyhow::Result<T> {
+        if let Err(err) = &res {
+            if is_storage_full(err) {
+                self.emit(NodeEvent::WriteFailed(WriteFailed {
+                    operation: operation.to_string(),
+                    message: format!("{err:#}"),
+                }));
+            }
+        }
+        res
+    }
+
+    /// Call `cb` for every event emitted from now on, until `cb` fails or the node is dropped.
+    ///
+    /// If the disk space is low, `cb` first gets the last `NodeEvent::LowDiskSpace`.
+    pub(crate) fn subscribe(&self, cb: Arc<dyn NodeEventCallback>) {
+        let mut events = self.sender.subscribe();
+        let low_disk = self.low_disk.lock().expect("poisoned").clone();
+        tokio::task::spawn(async move {
+            if let Some(event) = low_disk {
+                if cb.event(Arc::new(event)).await.is_err() {
+                    return;
+                }
+            }
+            loop {
+                let event = match events.recv().await {
+                    Ok(event) => event,
+                    Err(broadcast::error::RecvError::Lagged(n)) => {
+                        warn!("node event subscriber lagged, dropped {n} events");
+                        continue;
+                    }
+                    Err(broadcast::error::RecvError::Closed) => break,
+                };
+                if let Err(err) = cb.event(Arc::new(event)).await {
+                    debug!("node event callback failed, ending subscription: {err}");
+                    break;
+                }
+            }
+        });
+    }
+}
+
+/// Watch the space available in `dir`, emitting storage pressure events according to
+/// `options`.
+pub(crate) fn spawn_storage_monitor(
+    events: NodeEvents,
+    dir: PathBuf,
+    options: StoragePressureOptions,
+) -> AbortOnDropHandle<()> {
+    let period = options
+        .check_interval
+        .unwrap_or(DEFAULT_STORAGE_CHECK_INTERVAL)
+        .max(Duration::from_secs(1));
+    let task = tokio::task::spawn(async move {
+        let mut interval = tokio::time::interval(period);
+        interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        let mut low = false;
+        loop {
+            interval.tick().await;
+            let space = match disk_space(&dir) {
+                Ok(space) => space,
+                Err(err) => {
+                    warn!("failed to check disk space of {}: {err:#}", dir.display());
+                    continue;
+                }
+            };
+            if let Some(event) = pressure_change(&mut low, space, options.low_disk_bytes) {
+                events.emit(event);
+            }
+        }
+    });
+    AbortOnDropHandle::new(task)
+}
+
+/// The event to emit for `space`, if the storage pressure changed since the last check.
+fn pressure_change(low: &mut bool, space: DiskSpace, threshold: u64) -> Option<NodeEvent> {
+    let now_low = space.available < threshold;
+    if now_low == *low {
+        return None;
+    }
+    *low = now_low;
+    if now_low {
+        Some(NodeEvent::LowDiskSpace(space))
+    } else {
+        Some(NodeEvent::DiskSpaceRecovered(space))
+    }
+}
+
+/// Get the space of the disk holding `dir`.
+#[cfg(unix)]
+pub(crate) fn disk_space(dir: &std::path::Path) -> anyhow::Result<DiskSpace> {
+    use std::os::unix::ffi::OsStrExt;
+
+    let path = std::ffi::CString::new(dir.as_os_str().as_bytes())?;
+    let mut stat: libc::statvfs = unsafe { std::mem::zeroed() };
+    // SAFETY: `path` is a valid C string and `stat` is a valid, writable statvfs struct.
+    let res = unsafe { libc::statvfs(path.as_ptr(), &mut stat) };
+    if res != 0 {
+        return Err(std::io::Error::last_os_error().into());
+    }
+    let block_size = stat.f_frsize as u64;
+    Ok(DiskSpace {
+        path: dir.to_string_lossy().into_owned(),
+        available: stat.f_bavail as u64 * block_size,
+        total: stat.f_blocks as u64 * block_size,
+    })
+}
+
+/// Get the space of the disk holding `dir`.
+#[cfg(not(unix))]
+pub(crate) fn disk_space(_dir: &std::path::Path) -> anyhow::Result<DiskSpace> {
+    anyhow::bail!("checking disk space is not supported on this platform")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{persistent_node, Forward};
+
+    #[test]
+    fn test_pressure_change() {
+        let space = |available| DiskSpace {
+            path: "/data".to_string(),
+            available,
+            total: 1000,
+        };
+        let mut low = false;
+        assert_eq!(pressure_change(&mut low, space(500), 100), None);
+        assert_eq!(
+            pressure_change(&mut low, space(50), 100),
+            Some(NodeEvent::LowDiskSpace(space(50)))
+        );
+        // only reported once
+        assert_eq!(pressure_change(&mut low, space(40), 100), None);
+        assert_eq!(
+            pressure_change(&mut low, space(100), 100),
+            Some(NodeEvent::DiskSpaceRecovered(space(100)))
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_disk_space() {
+        let dir = tempfile::tempdir().unwrap();
+        let space = disk_space(dir.path()).unwrap();
+        assert!(space.total > 0);
+        assert!(space.available <= space.total);
+        assert!(disk_space(&dir.path().join("missing")).is_err());
+    }
+
+    async fn next(events: &mut tokio::sync::mpsc::Receiver<Arc<NodeEvent>>) -> Arc<NodeEvent> {
+        tokio::time::timeout(Duration::from_secs(5), events.recv())
+            .await
+            .unwrap()
+            .unwrap()
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_storage_events() {
+        let dir = tempfile::tempdir().unwrap();
+        let options = crate::NodeOptions {
+            // every disk has less space than this
+            storage_pressure: Some(StoragePressureOptions {
+                low_disk_bytes: u64::MAX,
+                check_interval: Some(Duration::from_secs(1)),
+            }),
+            ..Default::default()
+        };
+        let node = persistent_node(dir.path(), options).await;
+        // give the monitor time for its first check, the subscriber still gets the event
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        let (sender, mut events) = tokio::sync::mpsc::channel(8);
+        node.node()
+            .subscribe_events(Arc::new(Forward(sender)))
+            .await;
+        let event = next(&mut events).await;
+        assert_eq!(event.r#type(), NodeEventType::LowDiskSpace);
+        assert!(event.as_low_disk_space().unwrap().total > 0);
+
+        let full = std::io::Error::from_raw_os_error(libc::ENOSPC);
+        let res = node
+            .events
+            .check_write("blobs.add_bytes", Err::<(), _>(full.into()));
+        assert_eq!(
+            crate::IrohError::from(res.unwrap_err()).kind(),
+            crate::IrohErrorKind::StorageFull
+        );
+        let event = next(&mut events).await;
+        assert_eq!(
+            event.as_write_failed().unwrap().operation,
+            "blobs.add_bytes"
+        );
+
+        // other errors are not reported
+        let res = node
+            .events
+            .check_write("blobs.add_bytes", Err::<(), _>(anyhow::anyhow!("failed")));
+        assert!(res.is_err());
+        assert!(events.try_recv().is_err());
+    }
+}
@@ -0,0 +1,395 @@
+use std::{
+    collections::{HashMap, HashSet, VecDeque},
+    sync::{Arc, Mutex},
+    time::{Duration, SystemTime},
+};
+
+use futures::StreamExt;
+use tracing::debug;
+
+use crate::{
+    doc::MemConnector, error::DirectConnectionFailed, IrohError, Net, PublicKey, RemoteInfo,
+};
+
+/// Number of connection errors kept per peer.
+const ERRORS_PER_PEER: usize = 8;
+/// Number of peers connection errors are kept for, the peers with the oldest errors are
+/// forgotten first.
+const MAX_PEERS: usize = 256;
+
+/// Why a connection to a peer failed, see [`PeerConnectionError`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum PeerErrorKind {
+    /// No address or relay url is known for the peer.
+    NoAddress,
+    /// The peer could not be reached in time on any of its addresses.
+    TimedOut,
+    /// The relay server of the peer could not be reached.
+    RelayUnreachable,
+    /// The peer was reached, but the QUIC or TLS handshake failed, for example because the
+    /// peer does not support the requested protocol.
+    HandshakeFailed,
+    /// The connection was closed or reset by the peer while connecting.
+    Closed,
+    /// Any other failure, see the error message.
+    Other,
+}
+
+/// A failed attempt to connect to a peer.
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct PeerConnectionError {
+    pub kind: PeerErrorKind,
+    /// The error as reported by the connection attempt.
+    pub message: String,
+    /// The protocol that was requested, lossily decoded as UTF-8.
+    pub alpn: String,
+    /// When the attempt failed.
+    pub at: SystemTime,
+}
+
+/// What this node knows about its connectivity to a peer, see `Net.peer_diagnostics`.
+#[derive(Debug, uniffi::Record)]
+pub struct PeerDiagnostics {
+    pub node_id: Arc<PublicKey>,
+    /// The current connection state, if the peer is known to the endpoint.
+    pub remote_info: Option<RemoteInfo>,
+    /// When this node last established a connection to the peer.
+    pub last_connected: Option<SystemTime>,
+    /// The last connection errors, newest first.
+    pub last_errors: Vec<PeerConnectionError>,
+}
+
+#[uniffi::export]
+impl Net {
+    /// Diagnose connectivity to a peer: its current connection state and the last errors of
+    /// connections this node made to it.
+    ///
+    /// Errors are recorded for connections made through `Net`, `Endpoint.connect` and
+    /// `Blobs.send_blob`, for blob downloads and for sync rounds of documents with live sync
+    /// started on this node. A failed download is recorded for every node it was started
+    /// with, since it does not tell which of them failed.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn peer_diagnostics(
+        &self,
+        node_id: &PublicKey,
+    ) -> Result<PeerDiagnostics, IrohError> {
+        let remote_info = self.remote_info(node_id).await?;
+        let history = self.peer_errors.get(&node_id.into());
+        Ok(PeerDiagnostics {
+            node_id: Arc::new(node_id.clone()),
+            remote_info,
+            last_connected: history.last_connected,
+            last_errors: history.errors.into_iter().rev().collect(),
+        })
+    }
+}
+
+/// Connection history of a peer.
+#[derive(Debug, Clone, Default)]
+struct PeerHistory {
+    last_connected: Option<SystemTime>,
+    /// Oldest first.
+    errors: VecDeque<PeerConnectionError>,
+}
+
+/// The recent connection errors of every peer, see `Net.peer_diagnostics`.
+#[derive(Debug, Default)]
+pub(crate) struct PeerErrors {
+    peers: Mutex<HashMap<iroh::NodeId, PeerHistory>>,
+    /// The connect timeout of a node in direct only mode, see `NodeOptions.direct_only`.
+    direct_only: Option<Duration>,
+    /// The documents whose sync rounds are recorded, see [`Self::watch_sync`].
+    synced_docs: Mutex<HashSet<iroh_docs::NamespaceId>>,
+}
+
+impl PeerErrors {
+    pub(crate) fn new(direct_only: Option<Duration>) -> Self {
+        PeerErrors {
+            peers: Default::default(),
+            direct_only,
+            synced_docs: Default::default(),
+        }
+    }
+
+    /// Record the outcome of the sync rounds of `doc` with its peers, until it is closed.
+    ///
+    /// Call this before starting live sync, so the first rounds are not missed.
+    pub(crate) async fn watch_sync(
+        self: &Arc<Self>,
+        doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    ) -> anyhow::Result<()> {
+        use iroh_docs::rpc::client::docs::LiveEvent;
+
+        let id = doc.id();
+        if !self.synced_docs.lock().expect("poisoned").insert(id) {
+            return Ok(());
+        }
+        let mut events = match doc.subscribe().await {
+            Ok(events) => events,
+            Err(err) => {
+                self.synced_docs.lock().expect("poisoned").remove(&id);
+                return Err(err);
+            }
+        };
+        let this = self.clone();
+        tokio::task::spawn(async move {
+            while let Some(event) = events.next().await {
+                match event {
+                    Ok(LiveEvent::SyncFinished(event)) => match event.result {
+                        Ok(()) => this.connected(event.peer),
+                        Err(message) => this.record(
+                            event.peer,
+                            iroh_docs::ALPN,
+                            classify_message(&message),
+                            message,
+                        ),
+                    },
+                    Ok(_) => {}
+                    Err(err) => {
+                        debug!("sync events of {id} failed: {err:#}");
+                        break;
+                    }
+                }
+            }
+            // The document was closed, starting sync again watches it again.
+            this.synced_docs.lock().expect("poisoned").remove(&id);
+        });
+        Ok(())
+    }
+
+    /// Connect to `addr`, recording the outcome.
+    ///
+    /// In direct only mode the relay url of `addr` is ignored, and failures are
+    /// [`DirectConnectionFailed`] errors.
+    pub(crate) async fn connect(
+        &self,
+        endpoint: &iroh::Endpoint,
+        addr: impl Into<iroh::NodeAddr>,
+        alpn: &[u8],
+        transport: Option<Arc<iroh::endpoint::TransportConfig>>,
+    ) -> anyhow::Result<iroh::endpoint::Connection> {
+        let addr = self.dialable(addr.into());
+        let node_id = addr.node_id;
+        let attempt = async {
+            match transport {
+                Some(config) => endpoint.connect_with(addr, alpn, config).await,
+                None => endpoint.connect(addr, alpn).await,
+            }
+        };
+        let res = match self.direct_only {
+            Some(timeout) => tokio::time::timeout(timeout, attempt)
+                .await
+                .unwrap_or_else(|_| Err(anyhow::anyhow!("timed out after {timeout:?}"))),
+            None => attempt.await,
+        };
+        match &res {
+            Ok(_) => self.connected(node_id),
+            Err(err) => self.record(node_id, alpn, classify(err), format!("{err:#}")),
+        }
+        match self.direct_only {
+            Some(_) => res.map_err(|err| {
+                DirectConnectionFailed {
+                    node_id,
+                    reason: format!("{err:#}"),
+                }
+                .into()
+            }),
+            None => res,
+        }
+    }
+
+    /// `addr` as this node may use it: without its relay url in direct only mode.
+    ///
+    /// The endpoint connects to any relay url it is given, even with relays disabled, so every
+    /// address handed to it has to go through this.
+    pub(crate) fn dialable(&self, mut addr: iroh::NodeAddr) -> iroh::NodeAddr {
+        if self.direct_only.is_some() {
+            addr.relay_url = None;
+        }
+        addr
+    }
+
+    /// Record that a connection to `node_id` was established.
+    pub(crate) fn connected(&self, node_id: iroh::NodeId) {
+        let mut peers = self.peers.lock().expect("poisoned");
+        peers.entry(node_id).or_default().last_connected = Some(SystemTime::now());
+    }
+
+    /// Record a failed connection attempt to `node_id`.
+    pub(crate) fn record(
+        &self,
+        node_id: iroh::NodeId,
+        alpn: &[u8],
+        kind: PeerErrorKind,
+        message: String,
+    ) {
+        let mut peers = self.peers.lock().expect("poisoned");
+        if !peers.contains_key(&node_id) && peers.len() >= MAX_PEERS {
+            let oldest = peers
+                .iter()
+                .min_by_key(|(_, history)| history.errors.back().map(|err| err.at))
+                .map(|(id, _)| *id);
+            if let Some(oldest) = oldest {
+                peers.remove(&oldest);
+            }
+        }
+        let errors = &mut peers.entry(node_id).or_default().errors;
+        if errors.len() == ERRORS_PER_PEER {
+            errors.pop_front();
+        }
+        errors.push_back(PeerConnectionError {
+            kind,
+            message,
+            alpn: String::from_utf8_lossy(alpn).into_owned(),
+            at: SystemTime::now(),
+        });
+    }
+
+    fn get(&self, node_id: &iroh::NodeId) -> PeerHistory {
+        let peers = self.peers.lock().expect("poisoned");
+        peers.get(node_id).cloned().unwrap_or_default()
+    }
+}
+
+/// Tell why a connection attempt failed.
+pub(crate) fn classify(err: &anyhow::Error) -> PeerErrorKind {
+    use iroh::endpoint::ConnectionError;
+
+    if let Some(err) = err.downcast_ref::<ConnectionError>() {
+        return match err {
+            ConnectionError::TimedOut => PeerErrorKind::TimedOut,
+            ConnectionError::TransportError(_) | ConnectionError::VersionMismatch => {
+                PeerErrorKind::HandshakeFailed
+            }
+            // TLS alerts, like a missing common ALPN, use the crypto error code range
+            ConnectionError::ConnectionClosed(close)
+                if (0x100..0x200).contains(&u64::from(close.error_code)) =>
+            {
+                PeerErrorKind::HandshakeFailed
+            }
+            ConnectionError::ConnectionClosed(_)
+            | ConnectionError::ApplicationClosed(_)
+            | ConnectionError::Reset => PeerErrorKind::Closed,
+            _ => PeerErrorKind::Other,
+        };
+    }
+    classify_message(&format!("{err:#}"))
+}
+
+/// Tell why a connection attempt failed from its error message.
+fn classify_message(message: &str) -> PeerErrorKind {
+    let message = message.to_lowercase();
+    if message.contains("no addressing information") || message.contains("no addresses") {
+        PeerErrorKind::NoAddress
+    } else if message.contains("relay") {
+        PeerErrorKind::RelayUnreachable
+    } else if message.contains("timed out") || message.contains("timeout") {
+        PeerErrorKind::TimedOut
+    } else if message.contains("handshake")
+        || message.contains("alpn")
+        || message.contains("known protocol")
+    {
+        PeerErrorKind::HandshakeFailed
+    } else {
+        PeerErrorKind::Other
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::test_utils::{local_node, NoProgress};
+
+    fn random_node_id() -> iroh::NodeId {
+        iroh::SecretKey::from_bytes(&rand::random()).public()
+    }
+
+    #[test]
+    fn test_record_errors() {
+        let errors = PeerErrors::default();
+        let node_id = random_node_id();
+        for i in 0..ERRORS_PER_PEER + 2 {
+            errors.record(node_id, b"alpn", PeerErrorKind::Other, i.to_string());
+        }
+        let history = errors.get(&node_id);
+        assert_eq!(history.errors.len(), ERRORS_PER_PEER);
+        assert_eq!(history.errors.front().unwrap().message, "2");
+        assert_eq!(history.errors[0].alpn, "alpn");
+        assert!(history.last_connected.is_none());
+
+        for _ in 0..MAX_PEERS {
+            let other = random_node_id();
+            errors.record(other, b"alpn", PeerErrorKind::Other, String::new());
+        }
+        assert_eq!(errors.peers.lock().unwrap().len(), MAX_PEERS);
+    }
+
+    #[test]
+    fn test_classify() {
+        let err = anyhow::Error::from(iroh::endpoint::ConnectionError::TimedOut);
+        assert_eq!(classify(&err), PeerErrorKind::TimedOut);
+        let err = anyhow::anyhow!("no addressing information available");
+        assert_eq!(classify(&err), PeerErrorKind::NoAddress);
+        let err = anyhow::anyhow!("failed to connect to relay server");
+        assert_eq!(classify(&err), PeerErrorKind::RelayUnreachable);
+        let err = anyhow::anyhow!("something else");
+        assert_eq!(classify(&err), PeerErrorKind::Other);
+    }
+
+    #[tokio::test]
+    async fn test_peer_diagnostics() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let addr = node_1.net().node_addr().await.unwrap();
+        let node_id = PublicKey::from_string(node_1.net().node_id().await.unwrap()).unwrap();
+
+        let endpoint = node_0.node().endpoint();
+        endpoint.connect(&addr, b"unsupported").await.unwrap_err();
+        node_0.net().connect_peer(&addr).await.unwrap();
+
+        let diagnostics = node_0.net().peer_diagnostics(&node_id).await.unwrap();
+        assert!(diagnostics.remote_info.is_some());
+        assert!(diagnostics.last_connected.is_some());
+        assert_eq!(diagnostics.last_errors.len(), 1);
+        let error = &diagnostics.last_errors[0];
+        assert_eq!(error.alpn, "unsupported");
+        assert!(error.at <= SystemTime::now());
+        assert!(error.at + Duration::from_secs(60) > SystemTime::now());
+
+        // a peer that was never contacted
+        let unknown = PublicKey::from_string(random_node_id().to_string()).unwrap();
+        let diagnostics = node_0.net().peer_diagnostics(&unknown).await.unwrap();
+        assert!(diagnostics.remote_info.is_none());
+        assert!(diagnostics.last_errors.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_download_errors() {
+        let node_0 = local_node().await;
+        let node_1 = local_node().await;
+        let addr = node_1.net().node_addr().await.unwrap();
+        let node_id = PublicKey::from_string(node_1.net().node_id().await.unwrap()).unwrap();
+
+        // node_1 does not have the blob
+        let hash = Arc::new(crate::Hash::new(b"missing".to_vec()));
+        let opts = crate::BlobDownloadOptions::new(
+            crate::BlobFormat::Raw,
+            vec![Arc::new(addr)],
+            Arc::new(crate::SetTagOption::auto()),
+        )
+        .unwrap();
+        node_0
+            .blobs()
+            .download(hash, Arc::new(opts), Arc::new(NoProgress))
+            .await
+            .ok();
+
+        let diagnostics = node_0.net().peer_diagnostics(&node_id).await.unwrap();
+        assert!(diagnostics
+            .last_errors
+            .iter()
+            .any(|error| error.alpn == String::from_utf8_lossy(iroh_blobs::ALPN)));
+    }
+}
@@ -0,0 +1,167 @@
+use std::sync::Arc;
+
+use iroh_blobs::store::{MapEntry, MapMut};
+use range_collections::range_set::RangeSetRange;
+
+use crate::{Blobs, Hash, IrohError};
+
+/// Size of the chunks blobs are verified in.
+const CHUNK_SIZE: u64 = 1024;
+
+/// A range of bytes of a blob, `start` inclusive and `end` exclusive.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct ByteRange {
+    pub start: u64,
+    pub end: u64,
+}
+
+/// Which parts of a blob are on this node, see `Blobs.presence`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct BlobPresence {
+    /// The size of the blob in bytes.
+    pub size: u64,
+    /// Whether `size` was verified. The size of a partial blob is the size announced by the
+    /// peer it is downloaded from until its last chunk is received.
+    pub size_verified: bool,
+    /// Whether the whole blob is on this node.
+    pub complete: bool,
+    /// The verified byte ranges on this node, sorted and not overlapping.
+    pub ranges: Vec<ByteRange>,
+    /// Total length of `ranges` in bytes.
+    pub present_bytes: u64,
+}
+
+#[uniffi::export]
+impl Blobs {
+    /// Which byte ranges of a blob are on this node and verified against its hash.
+    ///
+    /// Returns `None` if no part of the blob is on this node. Downloads of a partial blob
+    /// only request the ranges that are missing, so `present_bytes` out of `size` is where
+    /// a download resumes from.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn presence(&self, hash: &Hash) -> Result<Option<BlobPresence>, IrohError> {
+        let presence = self.presence.get(hash.0).await?;
+        Ok(presence)
+    }
+}
+
+/// Reads the verified ranges of blobs from the blob store of a node, whatever its type.
+#[derive(Clone, derive_more::Debug)]
+pub(crate) struct PresenceStore {
+    #[debug("Store")]
+    store: Arc<dyn RangesSource>,
+}
+
+impl PresenceStore {
+    pub(crate) fn new<S: iroh_blobs::store::Store>(store: S) -> Self {
+        PresenceStore {
+            store: Arc::new(store),
+        }
+    }
+
+    async fn get(&self, hash: iroh_blobs::Hash) -> anyhow::Result<Option<BlobPresence>> {
+        self.store.presence(hash).await
+    }
+}
+
+trait RangesSource: Send + Sync + 'static {
+    fn presence(
+        &self,
+        hash: iroh_blobs::Hash,
+    ) -> futures_lite::future::Boxed<anyhow::Result<Option<BlobPresence>>>;
+}
+
+impl<S: iroh_blobs::store::Store> RangesSource for S {
+    fn presence(
+        &self,
+        hash: iroh_blobs::Hash,
+    ) -> futures_lite::future::Boxed<anyhow::Result<Option<BlobPresence>>> {
+        let store = self.clone();
+        Box::pin(async move {
+            let Some(entry) = store.get_mut(&hash).await? else {
+                return Ok(None);
+            };
+            let size = entry.size();
+            let complete = entry.is_complete();
+            let chunks = if complete {
+                vec![(0, None)]
+            } else {
+                iroh_blobs::get::db::valid_ranges::<S>(&entry)
+                    .await?
+                    .iter()
+                    .map(|range| match range {
+                        RangeSetRange::Range(range) => (range.start.0, Some(range.end.0)),
+                        RangeSetRange::RangeFrom(range) => (range.start.0, None),
+                    })
+                    .collect()
+            };
+            let ranges = byte_ranges(chunks, size.value());
+            Ok(Some(BlobPresence {
+                size: size.value(),
+                size_verified: matches!(size, iroh_blobs::store::BaoBlobSize::Verified(_)),
+                complete,
+                present_bytes: ranges.iter().map(|range| range.end - range.start).sum(),
+                ranges,
+            }))
+        })
+    }
+}
+
+/// Convert ranges of chunk numbers, with an open end for the rest of the blob, to byte
+/// ranges clamped to `size`.
+fn byte_ranges(chunks: Vec<(u64, Option<u64>)>, size: u64) -> Vec<ByteRange> {
+    chunks
+        .into_iter()
+        .filter_map(|(start, end)| {
+            let start = start.saturating_mul(CHUNK_SIZE).min(size);
+            let end = end.map_or(size, |end| end.saturating_mul(CHUNK_SIZE).min(size));
+            (start < end).then_some(ByteRange { start, end })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_byte_ranges() {
+        let ranges = byte_ranges(vec![(0, Some(2)), (5, Some(6)), (9, None)], 10000);
+        let expected =
+            [(0, 2048), (5120, 6144), (9216, 10000)].map(|(start, end)| ByteRange { start, end });
+        assert_eq!(ranges, expected);
+        // ranges past the end of the blob are dropped
+        assert!(byte_ranges(vec![(12, None)], 10000).is_empty());
+        // the last chunk of a blob is shorter than a full chunk
+        assert_eq!(
+            byte_ranges(vec![(8, Some(9))], 8500),
+            vec![ByteRange {
+                start: 8192,
+                end: 8500
+            }]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_presence() {
+        let node = crate::Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let data = vec![7u8; 3000];
+        let outcome = blobs.add_bytes(data).await.unwrap();
+        let presence = blobs.presence(&outcome.hash).await.unwrap().unwrap();
+        assert!(presence.complete);
+        assert!(presence.size_verified);
+        assert_eq!(presence.size, 3000);
+        assert_eq!(presence.present_bytes, 3000);
+        assert_eq!(
+            presence.ranges,
+            vec![ByteRange {
+                start: 0,
+                end: 3000
+            }]
+        );
+
+        let missing = Hash::new(b"not on this node".to_vec());
+        assert!(blobs.presence(&missing).await.unwrap().is_none());
+    }
+}
@@ -0,0 +1,386 @@
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+};
+
+use iroh_blobs::{provider::EventSender, util::local_pool::LocalPoolHandle};
+use tokio::sync::broadcast;
+use tracing::{debug, warn};
+
+use crate::{
+    acl::{Acl, AclAction},
+    serve_policy::{AllowedStore, ServeFilter},
+    Blobs, BlobsClient, CallbackError, Hash, PublicKey,
+};
+
+/// Number of provide events buffered per subscriber before the oldest are dropped.
+const PROVIDE_EVENTS_CAPACITY: usize = 256;
+
+/// The kinds of [`ProvideEvent`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum ProvideEventKind {
+    /// A peer requested a blob or collection.
+    RequestReceived,
+    /// Data was sent to the peer. Not every chunk is reported.
+    Progress,
+    /// The request was served completely.
+    Completed,
+    /// The peer disconnected before the request was served.
+    Aborted,
+}
+
+/// Data this node serves to another peer, see `Blobs.subscribe_provide_events`.
+///
+/// Content of documents is served as blobs as well, so syncing peers show up here too.
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct ProvideEvent {
+    pub kind: ProvideEventKind,
+    /// The peer the data is served to, if known.
+    pub peer: Option<Arc<PublicKey>>,
+    /// The requested blob or collection.
+    pub hash: Arc<Hash>,
+    /// Identifies the connection to the peer.
+    pub connection_id: u64,
+    /// Identifies the request within the connection.
+    pub request_id: u64,
+    /// Bytes of blob content sent for this request so far.
+    pub bytes_served: u64,
+}
+
+/// The `event` method is called for every [`ProvideEvent`] of the node it is subscribed to.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait ProvideEventCallback: Send + Sync + 'static {
+    async fn event(&self, event: ProvideEvent) -> Result<(), CallbackError>;
+}
+
+#[uniffi::export]
+impl Blobs {
+    /// Subscribe to the requests other peers make to this node and the data served to them.
+    ///
+    /// The callback is called for every event until it returns an error or the node is
+    /// dropped.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn subscribe_provide_events(&self, cb: Arc<dyn ProvideEventCallback>) {
+        let mut events = self.provides.sender.subscribe();
+        tokio::task::spawn(async move {
+            loop {
+                let event = match events.recv().await {
+                    Ok(event) => event,
+                    Err(broadcast::error::RecvError::Lagged(n)) => {
+                        warn!("provide event subscriber lagged, dropped {n} events");
+                        continue;
+                    }
+                    Err(broadcast::error::RecvError::Closed) => break,
+                };
+                if let Err(err) = cb.event(event).await {
+                    debug!("provide event callback failed, ending subscription: {err}");
+                    break;
+                }
+            }
+        });
+    }
+}
+
+/// A request being served.
+#[derive(Debug, Clone, Copy)]
+struct ServedRequest {
+    hash: iroh_blobs::Hash,
+    peer: Option<iroh::NodeId>,
+    /// Bytes of the blobs that were sent completely.
+    completed: u64,
+}
+
+/// Turns the events of the blobs provider into [`ProvideEvent`]s.
+#[derive(Debug)]
+pub(crate) struct ProvideEvents {
+    sender: broadcast::Sender<ProvideEvent>,
+    /// The peer of every connection being served, by connection id.
+    peers: Mutex<HashMap<u64, iroh::NodeId>>,
+    requests: Mutex<HashMap<(u64, u64), ServedRequest>>,
+}
+
+impl Default for ProvideEvents {
+    fn default() -> Self {
+        let (sender, _) = broadcast::channel(PROVIDE_EVENTS_CAPACITY);
+        ProvideEvents {
+            sender,
+            peers: Default::default(),
+            requests: Default::default(),
+        }
+    }
+}
+
+impl ProvideEvents {
+    fn on_event(&self, event: &iroh_blobs::provider::Event) {
+        use iroh_blobs::provider::Event;
+
+        let mut requests = self.requests.lock().expect("poisoned");
+        let (kind, key, bytes_served) = match *event {
+            Event::GetRequestReceived {
+                connection_id,
+                request_id,
+                hash,
+            } => {
+                let peer = self
+                    .peers
+                    .lock()
+                    .expect("poisoned")
+                    .get(&connection_id)
+                    .copied();
+                let request = ServedRequest {
+                    hash,
+                    peer,
+                    completed: 0,
+                };
+                requests.insert((connection_id, request_id), request);
+                (
+                    ProvideEventKind::RequestReceived,
+                    (connection_id, request_id),
+                    0,
+                )
+            }
+            Event::TransferProgress {
+                connection_id,
+                request_id,
+                end_offset,
+                ..
+            } => {
+                let key = (connection_id, request_id);
+                let Some(request) = requests.get(&key) else {
+                    return;
+                };
+                (
+                    ProvideEventKind::Progress,
+                    key,
+                    request.completed + end_offset,
+                )
+            }
+            Event::TransferBlobCompleted {
+                connection_id,
+                request_id,
+                size,
+                ..
+            } => {
+                let key = (connection_id, request_id);
+                let Some(request) = requests.get_mut(&key) else {
+                    return;
+                };
+                request.completed += size;
+                (ProvideEventKind::Progress, key, request.completed)
+            }
+            Event::TransferCompleted {
+                connection_id,
+                request_id,
+                ..
+            } => {
+                let key = (connection_id, request_id);
+                let Some(request) = requests.get(&key) else {
+                    return;
+                };
+                (ProvideEventKind::Completed, key, request.completed)
+            }
+            Event::TransferAborted {
+                connection_id,
+                request_id,
+                ..
+            } => {
+                let key = (connection_id, request_id);
+                let Some(request) = requests.get(&key) else {
+                    return;
+                };
+                (ProvideEventKind::Aborted, key, request.completed)
+            }
+            _ => return,
+        };
+        let request = match kind {
+            ProvideEventKind::Completed | ProvideEventKind::Aborted => {
+                requests.remove(&key).expect("checked above")
+            }
+            _ => requests[&key],
+        };
+        // no subscribers is fine
+        self.sender
+            .send(ProvideEvent {
+                kind,
+                peer: request.peer.map(|peer| Arc::new(peer.into())),
+                hash: Arc::new(request.hash.into()),
+                connection_id: key.0,
+                request_id: key.1,
+                bytes_served,
+            })
+            .ok();
+    }
+}
+
+/// Feeds the provider events to [`ProvideEvents`] and to the callback of
+/// `NodeOptions.blob_events`, if any.
+#[derive(Debug, Clone)]
+pub(crate) struct ProvideEventSender {
+    provides: Arc<ProvideEvents>,
+    callback: EventSender,
+}
+
+impl ProvideEventSender {
+    pub(crate) fn new(provides: Arc<ProvideEvents>, callback: EventSender) -> Self {
+        ProvideEventSender { provides, callback }
+    }
+}
+
+impl iroh_blobs::provider::CustomEventSender for ProvideEventSender {
+    fn send(&self, event: iroh_blobs::provider::Event) -> futures_lite::future::Boxed<()> {
+        self.provides.on_event(&event);
+        let callback = self.callback.clone();
+        Box::pin(async move { callback.send(event).await })
+    }
+
+    fn try_send(&self, event: iroh_blobs::provider::Event) {
+        self.provides.on_event(&event);
+        self.callback.try_send(event);
+    }
+}
+
+/// Serves blobs like the iroh blobs protocol, remembering the peer of every connection for
+/// [`ProvideEvents`].
+///
+/// Takes the place of `blobs` in the router, so it also shuts it down.
+#[derive(Debug, Clone)]
+pub(crate) struct ProvideProtocol<S> {
+    blobs: iroh_blobs::net_protocol::Blobs<S>,
+    store: S,
+    events: EventSender,
+    rt: LocalPoolHandle,
+    provides: Arc<ProvideEvents>,
+    acl: Arc<Acl>,
+    client: BlobsClient,
+    serve: Arc<ServeFilter>,
+}
+
+impl<S> ProvideProtocol<S> {
+    #[allow(clippy::too_many_arguments)]
+    pub(crate) fn new(
+        blobs: iroh_blobs::net_protocol::Blobs<S>,
+        store: S,
+        events: EventSender,
+        rt: LocalPoolHandle,
+        provides: Arc<ProvideEvents>,
+        acl: Arc<Acl>,
+        client: BlobsClient,
+        serve: Arc<ServeFilter>,
+    ) -> Self {
+        ProvideProtocol {
+            blobs,
+            store,
+            events,
+            rt,
+            provides,
+            acl,
+            client,
+            serve,
+        }
+    }
+}
+
+impl<S: iroh_blobs::store::Store> iroh::protocol::ProtocolHandler for ProvideProtocol<S> {
+    fn accept(
+        &self,
+        conn: iroh::endpoint::Connecting,
+    ) -> futures_lite::future::Boxed<anyhow::Result<()>> {
+        let this = self.clone();
+        Box::pin(async move {
+            let conn = conn.await?;
+            if !this.acl.admit(&conn, AclAction::Fetch)? {
+                return Ok(());
+            }
+            // the provider identifies connections by their stable id
+            let connection_id = conn.stable_id() as u64;
+            if let Ok(peer) = iroh::endpoint::get_remote_node_id(&conn) {
+                this.provides
+                    .peers
+                    .lock()
+                    .expect("poisoned")
+                    .insert(connection_id, peer);
+            }
+            match this.serve.allowed(&this.client).await {
+                Ok(None) => {
+                    iroh_blobs::provider::handle_connection(conn, this.store, this.events, this.rt)
+                        .await
+                }
+                Ok(Some(allowed)) => {
+                    let store = AllowedStore::new(this.store, allowed);
+                    iroh_blobs::provider::handle_connection(conn, store, this.events, this.rt).await
+                }
+                Err(err) => {
+                    warn!("failed to apply the serve policy: {err:#}");
+                    conn.close(0u32.into(), b"internal error");
+                }
+            }
+            this.provides
+                .peers
+                .lock()
+                .expect("poisoned")
+                .remove(&connection_id);
+            Ok(())
+        })
+    }
+
+    fn shutdown(&self) -> futures_lite::future::Boxed<()> {
+        iroh::protocol::ProtocolHandler::shutdown(&self.blobs)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use super::*;
+    use crate::test_utils::{local_node, Forward};
+
+    #[tokio::test]
+    async fn test_provide_events() {
+        let provider = local_node().await;
+        let getter = local_node().await;
+        let (sender, mut events) = tokio::sync::mpsc::channel(64);
+        provider
+            .blobs()
+            .subscribe_provide_events(Arc::new(Forward(sender)))
+            .await;
+
+        let content = vec![7u8; 100_000];
+        let hash = provider
+            .blobs()
+            .add_bytes(content.clone())
+            .await
+            .unwrap()
+            .hash;
+        let addr = provider.router.endpoint().node_addr().await.unwrap();
+        getter
+            .blobs_client
+            .download(hash.0, addr)
+            .await
+            .unwrap()
+            .finish()
+            .await
+            .unwrap();
+
+        let getter_id = getter.net().node_id().await.unwrap();
+        let mut kinds = Vec::new();
+        loop {
+            let event = tokio::time::timeout(Duration::from_secs(5), events.recv())
+                .await
+                .unwrap()
+                .unwrap();
+            assert_eq!(event.hash, hash);
+            assert_eq!(
+                event.peer.as_ref().map(|peer| peer.to_string()),
+                Some(getter_id.clone())
+            );
+            kinds.push(event.kind);
+            if event.kind == ProvideEventKind::Completed {
+                assert_eq!(event.bytes_served, content.len() as u64);
+                break;
+            }
+        }
+        assert_eq!(kinds[0], ProvideEventKind::RequestReceived);
+    }
+}
@@ -0,0 +1,147 @@
+use std::{io::Write, sync::RwLock};
+
+/// Replaces tickets in redacted text.
+const TICKET_PLACEHOLDER: &str = "[ticket]";
+/// Replaces keys in redacted text.
+const KEY_PLACEHOLDER: &str = "[key]";
+/// Prefixes of the tickets of iroh, docs and blobs.
+const TICKET_PREFIXES: [&str; 3] = ["doc", "blob", "node"];
+/// Length of 32 bytes in lowercase base32 without padding, as keys are usually displayed.
+const KEY_BASE32_LEN: usize = 52;
+/// Length of 32 bytes in hex.
+const KEY_HEX_LEN: usize = 64;
+
+static POLICY: RwLock<RedactionPolicy> = RwLock::new(RedactionPolicy {
+    tickets: false,
+    keys: false,
+});
+
+/// What to remove from error messages and logs, see [`set_redaction_policy`].
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, uniffi::Record)]
+pub struct RedactionPolicy {
+    /// Replace doc, blob and node tickets with `[ticket]`. Doc tickets contain the secret key
+    /// of their document if they allow writing.
+    pub tickets: bool,
+    /// Replace 32 byte keys, written in base32 or hex, with `[key]`.
+    ///
+    /// Secret keys look the same as public keys, node ids and hashes, so all of them are
+    /// replaced.
+    pub keys: bool,
+}
+
+/// Remove tickets and keys from the messages of `IrohError`s and from the logs enabled with
+/// `set_log_level`.
+///
+/// Applies to all nodes of the process, from the next message on. Nothing is removed by
+/// default.
+#[uniffi::export]
+pub fn set_redaction_policy(policy: RedactionPolicy) {
+    *POLICY.write().expect("poisoned") = policy;
+}
+
+/// The current redaction policy, see [`set_redaction_policy`].
+#[uniffi::export]
+pub fn redaction_policy() -> RedactionPolicy {
+    *POLICY.read().expect("poisoned")
+}
+
+/// `text` with what the redaction policy asks for removed.
+pub(crate) fn redact(text: &str) -> String {
+    redact_with(&redaction_policy(), text)
+}
+
+fn redact_with(policy: &RedactionPolicy, text: &str) -> String {
+    if !policy.tickets && !policy.keys {
+        return text.to_string();
+    }
+    let mut res = String::with_capacity(text.len());
+    let mut rest = text;
+    while !rest.is_empty() {
+        let end = rest
+            .find(|c: char| !c.is_ascii_alphanumeric())
+            .unwrap_or(rest.len());
+        let (word, after) = rest.split_at(end);
+        res.push_str(redact_word(policy, word));
+        let sep = after.chars().next().map_or(0, char::len_utf8);
+        res.push_str(&after[..sep]);
+        rest = &after[sep..];
+    }
+    res
+}
+
+fn redact_word<'a>(policy: &RedactionPolicy, word: &'a str) -> &'a str {
+    let base32 = |s: &str| {
+        s.bytes()
+            .all(|b| b.is_ascii_lowercase() || (b'2'..=b'7').contains(&b))
+    };
+    if policy.tickets {
+        let is_ticket = TICKET_PREFIXES.iter().any(|prefix| {
+            word.strip_prefix(prefix)
+                .is_some_and(|data| data.len() > KEY_BASE32_LEN && base32(data))
+        });
+        if is_ticket {
+            return TICKET_PLACEHOLDER;
+        }
+    }
+    if policy.keys {
+        let is_key = match word.len() {
+            KEY_BASE32_LEN => base32(word),
+            KEY_HEX_LEN => word.bytes().all(|b| b.is_ascii_hexdigit()),
+            _ => false,
+        };
+        if is_key {
+            return KEY_PLACEHOLDER;
+        }
+    }
+    word
+}
+
+/// Writes log lines to stdout, redacted, see [`set_redaction_policy`].
+pub(crate) struct RedactingStdout;
+
+impl Write for RedactingStdout {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        // the formatter writes each event in one go, so tokens are never split
+        let text = String::from_utf8_lossy(buf);
+        std::io::stdout().write_all(redact(&text).as_bytes())?;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        std::io::stdout().flush()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_redact() {
+        let key = iroh::SecretKey::from_bytes(&[7u8; 32]);
+        let node_id = key.public().to_string();
+        let hex = data_encoding::HEXLOWER.encode(&[7u8; 32]);
+        let addr = iroh::NodeAddr::new(key.public());
+        let ticket = iroh_base::ticket::NodeTicket::new(addr).to_string();
+        let text = format!("failed to join {ticket}: secret {hex}, node {node_id}.");
+
+        // the global policy is left alone, it applies to the other tests as well
+        assert_eq!(redact_with(&RedactionPolicy::default(), &text), text);
+        let tickets = RedactionPolicy {
+            tickets: true,
+            keys: false,
+        };
+        assert_eq!(
+            redact_with(&tickets, &text),
+            format!("failed to join [ticket]: secret {hex}, node {node_id}.")
+        );
+        let all = RedactionPolicy {
+            tickets: true,
+            keys: true,
+        };
+        assert_eq!(
+            redact_with(&all, &text),
+            "failed to join [ticket]: secret [key], node [key]."
+        );
+    }
+}
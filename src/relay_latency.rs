@@ -0,0 +1,204 @@
+use std::{
+    collections::{HashMap, VecDeque},
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use anyhow::Context;
+use tokio_util::task::AbortOnDropHandle;
+
+use crate::Net;
+
+/// How often the latency to each relay server is measured.
+const RELAY_PROBE_INTERVAL: Duration = Duration::from_secs(30);
+/// Probes taking longer count as failed.
+const RELAY_PROBE_TIMEOUT: Duration = Duration::from_secs(5);
+/// Number of probes kept per relay server, half an hour worth.
+const PROBES_PER_RELAY: usize = 60;
+/// Upper bounds of the latency histogram buckets, in milliseconds.
+const RELAY_LATENCY_BUCKETS: [u64; 9] = [10, 25, 50, 100, 150, 250, 500, 1000, 5000];
+
+/// A bucket of a latency histogram.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct LatencyBucket {
+    pub upper_bound: Duration,
+    /// Number of measurements of at most `upper_bound`.
+    pub count: u64,
+}
+
+/// The recent latencies to a relay server, see `Net.relay_latencies`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct RelayLatency {
+    /// The url of the relay server.
+    pub url: String,
+    /// Whether this is the home relay of the node.
+    pub is_home: bool,
+    /// Number of successful measurements.
+    pub samples: u64,
+    /// Number of measurements that failed or timed out.
+    pub failures: u64,
+    pub min: Option<Duration>,
+    pub median: Option<Duration>,
+    pub p90: Option<Duration>,
+    pub max: Option<Duration>,
+    /// Cumulative histogram of the successful measurements.
+    pub buckets: Vec<LatencyBucket>,
+}
+
+#[uniffi::export]
+impl Net {
+    /// The latency distribution of each relay server this node can use, over the last half
+    /// hour.
+    ///
+    /// The latency is measured every 30 seconds from the start of the node, as the time to
+    /// open a TCP connection to the relay server, which is one round trip. Measurements taking
+    /// longer than 5 seconds count as failures. Empty without relay servers.
+    pub fn relay_latencies(&self) -> Vec<RelayLatency> {
+        let home = self.endpoint.home_relay();
+        self.relay_map
+            .nodes()
+            .map(|node| {
+                let probes = self.relay_latencies.probes(&node.url);
+                summarize(
+                    node.url.to_string(),
+                    home.as_ref() == Some(&node.url),
+                    &probes,
+                )
+            })
+            .collect()
+    }
+}
+
+/// The recent probes of every relay server, `None` for failed probes.
+#[derive(Debug, Default)]
+pub(crate) struct RelayLatencies {
+    relays: Mutex<HashMap<iroh::RelayUrl, VecDeque<Option<Duration>>>>,
+}
+
+impl RelayLatencies {
+    fn record(&self, url: iroh::RelayUrl, probe: Option<Duration>) {
+        let mut relays = self.relays.lock().expect("poisoned");
+        let probes = relays.entry(url).or_default();
+        if probes.len() == PROBES_PER_RELAY {
+            probes.pop_front();
+        }
+        probes.push_back(probe);
+    }
+
+    fn probes(&self, url: &iroh::RelayUrl) -> Vec<Option<Duration>> {
+        let relays = self.relays.lock().expect("poisoned");
+        relays
+            .get(url)
+            .map(|probes| probes.iter().copied().collect())
+            .unwrap_or_default()
+    }
+}
+
+fn summarize(url: String, is_home: bool, probes: &[Option<Duration>]) -> RelayLatency {
+    let mut latencies: Vec<Duration> = probes.iter().flatten().copied().collect();
+    latencies.sort();
+    let percentile = |p: usize| {
+        let last = latencies.len().checked_sub(1)?;
+        latencies.get(last * p / 100).copied()
+    };
+    let buckets = RELAY_LATENCY_BUCKETS
+        .iter()
+        .map(|bound| {
+            let upper_bound = Duration::from_millis(*bound);
+            LatencyBucket {
+                upper_bound,
+                count: latencies.iter().filter(|l| **l <= upper_bound).count() as u64,
+            }
+        })
+        .collect();
+    RelayLatency {
+        url,
+        is_home,
+        samples: latencies.len() as u64,
+        failures: (probes.len() - latencies.len()) as u64,
+        min: latencies.first().copied(),
+        median: percentile(50),
+        p90: percentile(90),
+        max: latencies.last().copied(),
+        buckets,
+    }
+}
+
+/// Measure the latency to each relay server of `relay_map` periodically, recording it in
+/// `latencies`.
+pub(crate) fn spawn_relay_probes(
+    relay_map: iroh::RelayMap,
+    latencies: Arc<RelayLatencies>,
+) -> AbortOnDropHandle<()> {
+    let task = tokio::task::spawn(async move {
+        if relay_map.is_empty() {
+            return;
+        }
+        let mut interval = tokio::time::interval(RELAY_PROBE_INTERVAL);
+        interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+        loop {
+            interval.tick().await;
+            let probes = relay_map.nodes().map(|node| async move {
+                let res = tokio::time::timeout(RELAY_PROBE_TIMEOUT, probe(&node.url)).await;
+                (node.url.clone(), res.ok().and_then(Result::ok))
+            });
+            for (url, latency) in futures::future::join_all(probes).await {
+                latencies.record(url, latency);
+            }
+        }
+    });
+    AbortOnDropHandle::new(task)
+}
+
+/// The time to open a TCP connection to the relay server at `url`, without name resolution.
+async fn probe(url: &iroh::RelayUrl) -> anyhow::Result<Duration> {
+    let host = url.host_str().context("relay url without host")?;
+    let port = url.port_or_known_default().unwrap_or(443);
+    let addr = tokio::net::lookup_host((host, port))
+        .await?
+        .next()
+        .context("relay host without address")?;
+    let start = Instant::now();
+    tokio::net::TcpStream::connect(addr).await?;
+    Ok(start.elapsed())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_summarize() {
+        let url: iroh::RelayUrl = "https://relay.example.com".parse().unwrap();
+        let latencies = RelayLatencies::default();
+        for ms in 1..=PROBES_PER_RELAY as u64 + 10 {
+            latencies.record(url.clone(), Some(Duration::from_millis(ms)));
+        }
+        latencies.record(url.clone(), None);
+
+        let probes = latencies.probes(&url);
+        assert_eq!(probes.len(), PROBES_PER_RELAY);
+        let summary = summarize(url.to_string(), true, &probes);
+        // the oldest probes were dropped
+        assert_eq!(summary.samples, PROBES_PER_RELAY as u64 - 1);
+        assert_eq!(summary.failures, 1);
+        assert_eq!(summary.min, Some(Duration::from_millis(12)));
+        assert_eq!(summary.max, Some(Duration::from_millis(70)));
+        assert_eq!(summary.median, Some(Duration::from_millis(41)));
+        let bucket = |ms| {
+            summary
+                .buckets
+                .iter()
+                .find(|b| b.upper_bound == Duration::from_millis(ms))
+                .unwrap()
+                .count
+        };
+        assert_eq!(bucket(10), 0);
+        assert_eq!(bucket(25), 14);
+        assert_eq!(bucket(5000), 59);
+
+        let empty = summarize(url.to_string(), false, &[]);
+        assert_eq!(empty.samples, 0);
+        assert_eq!(empty.median, None);
+    }
+}
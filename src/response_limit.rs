@@ -0,0 +1,126 @@
+use std::sync::RwLock;
+
+use crate::{error::ResponseTooLarge, ReadAtLen};
+
+static LIMITS: RwLock<ResponseLimits> = RwLock::new(ResponseLimits {
+    blob_read: None,
+    stream_read: None,
+    replica_state: None,
+});
+
+/// Maximum sizes of the byte arrays returned by classes of calls, see
+/// [`set_response_limits`]. `None` means unlimited.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, uniffi::Record)]
+pub struct ResponseLimits {
+    /// Reading blobs into memory, with `Blobs.read_to_bytes`, `Blobs.read_at_to_bytes` and
+    /// their variants.
+    #[uniffi(default = None)]
+    pub blob_read: Option<u64>,
+    /// Reading from a `RecvStream` of a connection.
+    #[uniffi(default = None)]
+    pub stream_read: Option<u64>,
+    /// Exporting a document with `Doc.export_replica_state`.
+    #[uniffi(default = None)]
+    pub replica_state: Option<u64>,
+}
+
+/// Limit the size of the byte arrays returned to the application.
+///
+/// Every returned byte array is copied into memory of the application, so a huge blob or a
+/// peer sending a huge response can exhaust it. Calls that would return more bytes than the
+/// limit of their class fail with an error of kind `IrohErrorKind::ResponseTooLarge` instead,
+/// in most cases before the bytes are read. Applies to all nodes of the process. Unlimited by
+/// default.
+#[uniffi::export]
+pub fn set_response_limits(limits: ResponseLimits) {
+    *LIMITS.write().expect("poisoned") = limits;
+}
+
+/// The current response limits, see [`set_response_limits`].
+#[uniffi::export]
+pub fn response_limits() -> ResponseLimits {
+    *LIMITS.read().expect("poisoned")
+}
+
+/// A class of calls sharing a response limit.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(crate) enum ResponseClass {
+    BlobRead,
+    StreamRead,
+    ReplicaState,
+}
+
+impl ResponseClass {
+    /// The current maximum response size of this class, if limited.
+    pub(crate) fn max(self) -> Option<u64> {
+        response_limits().max(self)
+    }
+
+    /// Fail if a response of `size` bytes exceeds the current limit of this class.
+    pub(crate) fn check(self, size: u64) -> Result<(), ResponseTooLarge> {
+        response_limits().check(self, size)
+    }
+}
+
+impl ResponseLimits {
+    fn max(&self, class: ResponseClass) -> Option<u64> {
+        match class {
+            ResponseClass::BlobRead => self.blob_read,
+            ResponseClass::StreamRead => self.stream_read,
+            ResponseClass::ReplicaState => self.replica_state,
+        }
+    }
+
+    fn check(&self, class: ResponseClass, size: u64) -> Result<(), ResponseTooLarge> {
+        match self.max(class) {
+            Some(max) if size > max => Err(ResponseTooLarge { class, size, max }),
+            _ => Ok(()),
+        }
+    }
+}
+
+impl std::fmt::Display for ResponseClass {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            ResponseClass::BlobRead => "blob read",
+            ResponseClass::StreamRead => "stream read",
+            ResponseClass::ReplicaState => "replica state",
+        };
+        f.write_str(name)
+    }
+}
+
+/// The number of bytes a read of `len` at `offset` of a blob of `size` bytes returns.
+pub(crate) fn read_at_len(size: u64, offset: u64, len: ReadAtLen) -> u64 {
+    let available = size.saturating_sub(offset);
+    match len {
+        ReadAtLen::All => available,
+        ReadAtLen::Exact(len) => len,
+        ReadAtLen::AtMost(len) => len.min(available),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_response_limits() {
+        // the global limits are left alone, they apply to the other tests as well
+        let limits = ResponseLimits {
+            blob_read: Some(64),
+            ..Default::default()
+        };
+        assert!(limits.check(ResponseClass::BlobRead, 64).is_ok());
+        let err = limits.check(ResponseClass::BlobRead, 100).unwrap_err();
+        assert_eq!((err.size, err.max), (100, 64));
+        assert!(limits.check(ResponseClass::StreamRead, u64::MAX).is_ok());
+        let err = crate::IrohError::from(err);
+        assert_eq!(err.kind(), crate::IrohErrorKind::ResponseTooLarge);
+
+        assert_eq!(read_at_len(100, 50, ReadAtLen::All), 50);
+        assert_eq!(read_at_len(100, 150, ReadAtLen::All), 0);
+        assert_eq!(read_at_len(100, 50, ReadAtLen::AtMost(80)), 50);
+        assert_eq!(read_at_len(100, 0, ReadAtLen::Exact(80)), 80);
+    }
+}
@@ -0,0 +1,199 @@
+use std::sync::OnceLock;
+
+use crate::IrohError;
+
+/// Default prefix of the names of the threads started by this library.
+const DEFAULT_THREAD_NAME_PREFIX: &str = "iroh-ffi";
+/// Highest nice value, i.e. lowest priority, on unix.
+const MAX_NICENESS: u8 = 19;
+
+static RUNTIME: OnceLock<NodeRuntime> = OnceLock::new();
+
+/// The runtime all node tasks are spawned on, with the options it was built with.
+struct NodeRuntime {
+    runtime: tokio::runtime::Runtime,
+    options: RuntimeOptions,
+}
+
+/// Options for the runtime that drives all iroh nodes in this process.
+#[derive(Debug, Clone, Default, uniffi::Record)]
+pub struct RuntimeOptions {
+    /// Number of tokio worker threads. Defaults to the number of CPUs.
+    #[uniffi(default = None)]
+    pub worker_threads: Option<u32>,
+    /// Maximum number of threads in the blocking pool. Defaults to 512.
+    ///
+    /// Blocking threads are only spawned on demand, e.g. for file system access.
+    #[uniffi(default = None)]
+    pub max_blocking_threads: Option<u32>,
+    /// Number of threads used by each node to import and export blobs. Defaults to the number
+    /// of CPUs.
+    #[uniffi(default = None)]
+    pub blob_pool_threads: Option<u32>,
+    /// Prefix for the names of the threads started by this library, so profilers can
+    /// attribute their CPU usage. Defaults to `iroh-ffi`.
+    ///
+    /// Runtime threads, including the blocking pool, are named `<prefix>-worker`, blob pool
+    /// threads `<prefix>-blobs`. The threads of the executor of the language bindings keep
+    /// their names.
+    #[uniffi(default = None)]
+    pub thread_name_prefix: Option<String>,
+    /// Nice value between 1 and 19 for the runtime threads, to run them at a lower priority
+    /// than the rest of the process.
+    ///
+    /// Applies to the worker and blocking threads of the runtime. The blob pool threads and
+    /// the executor of the language bindings keep the priority of the process, since they
+    /// are started without a hook to change it. Only supported on Linux and Android, ignored
+    /// on other platforms.
+    #[uniffi(default = None)]
+    pub thread_niceness: Option<u8>,
+}
+
+/// Configure the runtime used by all iroh nodes.
+///
+/// Must be called before any node is created, fails if the runtime was started already. The
+/// options apply to the runtime the node tasks run on. The language bindings drive the async
+/// calls on an executor of their own, which only waits for the results of the node runtime
+/// and is not configured by these options.
+#[uniffi::export]
+pub fn configure_runtime(options: RuntimeOptions) -> Result<(), IrohError> {
+    if RUNTIME.get().is_some() {
+        return Err(anyhow::anyhow!("runtime already started").into());
+    }
+    if options.worker_threads == Some(0) {
+        return Err(anyhow::anyhow!("worker_threads must be larger than 0").into());
+    }
+    if let Some(niceness) = options.thread_niceness {
+        if niceness == 0 || niceness > MAX_NICENESS {
+            return Err(
+                anyhow::anyhow!("thread_niceness must be between 1 and {MAX_NICENESS}").into(),
+            );
+        }
+    }
+    let runtime = NodeRuntime::build(options).map_err(anyhow::Error::from)?;
+    RUNTIME
+        .set(runtime)
+        .map_err(|_| anyhow::anyhow!("runtime already started"))?;
+    Ok(())
+}
+
+/// The options the runtime was configured with.
+pub(crate) fn options() -> &'static RuntimeOptions {
+    &node_runtime().options
+}
+
+/// The name of the threads of kind `kind`, e.g. `iroh-ffi-worker`.
+pub(crate) fn thread_name(kind: &str) -> String {
+    thread_name_with(options(), kind)
+}
+
+fn thread_name_with(options: &RuntimeOptions, kind: &str) -> String {
+    let prefix = options
+        .thread_name_prefix
+        .as_deref()
+        .unwrap_or(DEFAULT_THREAD_NAME_PREFIX);
+    format!("{prefix}-{kind}")
+}
+
+/// Lower the scheduling priority of the calling thread to `niceness`.
+#[cfg(any(target_os = "linux", target_os = "android"))]
+fn set_thread_niceness(niceness: u8) -> std::io::Result<()> {
+    // On Linux the nice value is per thread, `setpriority` with a thread id only affects
+    // that thread.
+    let res = unsafe {
+        let tid = libc::gettid();
+        libc::setpriority(
+            libc::PRIO_PROCESS,
+            tid as libc::id_t,
+            libc::c_int::from(niceness),
+        )
+    };
+    if res == -1 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+#[cfg(not(any(target_os = "linux", target_os = "android")))]
+fn set_thread_niceness(_niceness: u8) -> std::io::Result<()> {
+    Ok(())
+}
+
+/// The runtime all node tasks are spawned on, started with the default options on first use
+/// unless [`configure_runtime`] started it.
+pub(crate) fn runtime() -> &'static tokio::runtime::Runtime {
+    &node_runtime().runtime
+}
+
+fn node_runtime() -> &'static NodeRuntime {
+    RUNTIME.get_or_init(|| {
+        NodeRuntime::build(RuntimeOptions::default()).expect("failed to start runtime")
+    })
+}
+
+impl NodeRuntime {
+    fn build(options: RuntimeOptions) -> std::io::Result<Self> {
+        let mut builder = tokio::runtime::Builder::new_multi_thread();
+        builder
+            .enable_all()
+            .thread_name(thread_name_with(&options, "worker"));
+        if let Some(niceness) = options.thread_niceness {
+            builder.on_thread_start(move || {
+                if let Err(err) = set_thread_niceness(niceness) {
+                    tracing::warn!("failed to lower thread priority: {err}");
+                }
+            });
+        }
+        if let Some(threads) = options.worker_threads {
+            builder.worker_threads(threads as usize);
+        }
+        if let Some(threads) = options.max_blocking_threads {
+            builder.max_blocking_threads(threads.max(1) as usize);
+        }
+        let runtime = builder.build()?;
+        Ok(NodeRuntime { runtime, options })
+    }
+}
+
+/// Run `fut` to completion on the node runtime.
+pub(crate) async fn spawn<F, T>(fut: F) -> Result<T, IrohError>
+where
+    F: std::future::Future<Output = Result<T, IrohError>> + Send + 'static,
+    T: Send + 'static,
+{
+    runtime()
+        .spawn(fut)
+        .await
+        .map_err(|e| IrohError::from(anyhow::Error::from(e)))?
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_configure_started_runtime() {
+        runtime();
+        let custom = RuntimeOptions {
+            worker_threads: Some(1),
+            ..Default::default()
+        };
+        assert!(configure_runtime(custom).is_err());
+        assert_eq!(options().worker_threads, None);
+    }
+
+    #[cfg(any(target_os = "linux", target_os = "android"))]
+    #[test]
+    fn test_set_thread_niceness() {
+        let niceness = std::thread::spawn(|| {
+            set_thread_niceness(MAX_NICENESS).unwrap();
+            unsafe { libc::getpriority(libc::PRIO_PROCESS, libc::gettid() as libc::id_t) }
+        })
+        .join()
+        .unwrap();
+        assert_eq!(niceness, libc::c_int::from(MAX_NICENESS));
+        // other threads are not affected
+        let own = unsafe { libc::getpriority(libc::PRIO_PROCESS, 0) };
+        assert!(own < libc::c_int::from(MAX_NICENESS));
+    }
+}
@@ -0,0 +1,167 @@
+use std::sync::Arc;
+
+use futures::TryStreamExt;
+
+use crate::{error::BlobInUse, Blobs, Hash, IrohError};
+
+/// The documents and tags that reference a blob, see `Blobs.delete_safe`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct BlobReferences {
+    /// The documents with entries that have the blob as their content.
+    pub docs: Vec<String>,
+    /// The tags of collections that contain the blob.
+    pub tags: Vec<Vec<u8>>,
+}
+
+impl BlobReferences {
+    fn is_empty(&self) -> bool {
+        self.docs.is_empty() && self.tags.is_empty()
+    }
+}
+
+#[uniffi::export]
+impl Blobs {
+    /// Delete a blob, unless documents or collections still reference it.
+    ///
+    /// Unlike [`Blobs::delete_blob`], this first looks for document entries with the blob as
+    /// their content and for tagged collections that contain it. If there are any, the blob is
+    /// kept and the error, of kind `IrohErrorKind::InUse`, lists them, see `IrohError.in_use`.
+    /// Tags of the blob itself are no references, they are deleted with it. With `force` the
+    /// blob is deleted in any case, leaving the references without content.
+    ///
+    /// Looking for references reads every entry of every document. Entries added while this
+    /// runs are not seen.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn delete_safe(&self, hash: Arc<Hash>, force: bool) -> Result<(), IrohError> {
+        let hash = hash.0;
+        let (own_tags, collections) = self.tags_referencing(hash).await?;
+        if !force {
+            let references = BlobReferences {
+                docs: self.docs_referencing(hash).await?,
+                tags: collections,
+            };
+            if !references.is_empty() {
+                return Err(anyhow::Error::from(BlobInUse { hash, references }).into());
+            }
+        }
+
+        self.content_cache.remove(&hash);
+        // an untagged blob is removed by the garbage collection, if this is cancelled halfway
+        for tag in own_tags {
+            self.client.tags().delete(tag.clone()).await?;
+            self.tag_indexes.forget(&tag).await;
+        }
+        self.serve.tags_changed();
+        self.client.delete_blob(hash).await?;
+        Ok(())
+    }
+}
+
+impl Blobs {
+    /// The tags of `hash` itself, and the names of the tags of collections containing it.
+    async fn tags_referencing(
+        &self,
+        hash: iroh_blobs::Hash,
+    ) -> anyhow::Result<(Vec<iroh_blobs::Tag>, Vec<Vec<u8>>)> {
+        let mut own = Vec::new();
+        let mut collections = Vec::new();
+        let mut tags = self.client.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            if tag.hash == hash {
+                own.push(tag.name);
+                continue;
+            }
+            if !tag.format.is_hash_seq() {
+                continue;
+            }
+            // the children of an incomplete collection are unknown
+            let Ok(bytes) = self.client.read_to_bytes(tag.hash).await else {
+                continue;
+            };
+            let children = iroh_blobs::hashseq::HashSeq::try_from(bytes)?;
+            if children.iter().any(|child| child == hash) {
+                collections.push(tag.name.0.to_vec());
+            }
+        }
+        Ok((own, collections))
+    }
+
+    /// The ids of the documents with an entry that has `hash` as its content.
+    async fn docs_referencing(&self, hash: iroh_blobs::Hash) -> anyhow::Result<Vec<String>> {
+        let Some(docs) = &self.docs_client else {
+            return Ok(Vec::new());
+        };
+        let namespaces: Vec<_> = docs
+            .list()
+            .await?
+            .map_ok(|(namespace, _)| namespace)
+            .try_collect()
+            .await?;
+        let mut referencing = Vec::new();
+        for namespace in namespaces {
+            let Some(doc) = docs.open(namespace).await? else {
+                continue;
+            };
+            let mut entries = doc.get_many(iroh_docs::store::Query::all().build()).await?;
+            while let Some(entry) = entries.try_next().await? {
+                if entry.content_hash() == hash {
+                    referencing.push(namespace.to_string());
+                    break;
+                }
+            }
+        }
+        Ok(referencing)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+    use crate::{Collection, IrohErrorKind, SetTagOption};
+
+    #[tokio::test]
+    async fn test_delete_safe() {
+        let node = local_node().await;
+        let blobs = node.blobs();
+
+        // referenced by a document
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let hash = doc
+            .set_bytes(&author, b"key".to_vec(), b"in a doc".to_vec())
+            .await
+            .unwrap();
+        let err = blobs.delete_safe(hash.clone(), false).await.unwrap_err();
+        assert_eq!(err.kind(), IrohErrorKind::InUse);
+        let references = err.in_use().unwrap();
+        assert_eq!(references.docs, vec![doc.id()]);
+        assert!(references.tags.is_empty());
+        assert!(blobs.size(&hash).await.is_ok());
+        blobs.delete_safe(hash.clone(), true).await.unwrap();
+        assert!(!blobs.list().await.unwrap().iter().any(|h| h.equal(&hash)));
+
+        // referenced by a collection
+        let child = blobs.add_bytes(b"in a collection".to_vec()).await.unwrap();
+        let collection = Collection::new();
+        collection.push("child".to_string(), &child.hash).unwrap();
+        let tag = SetTagOption::named(b"collection".to_vec());
+        blobs
+            .create_collection(Arc::new(collection), Arc::new(tag), vec![])
+            .await
+            .unwrap();
+        let err = blobs
+            .delete_safe(child.hash.clone(), false)
+            .await
+            .unwrap_err();
+        let references = err.in_use().unwrap();
+        assert!(references.docs.is_empty());
+        assert_eq!(references.tags, vec![b"collection".to_vec()]);
+
+        // only tagged by itself
+        let single = blobs.add_bytes(b"alone".to_vec()).await.unwrap();
+        blobs.delete_safe(single.hash.clone(), false).await.unwrap();
+        let tags = node.tags().list().await.unwrap();
+        assert!(!tags.iter().any(|tag| tag.name == single.tag));
+    }
+}
@@ -0,0 +1,223 @@
+use std::{
+    fmt::Debug,
+    sync::Arc,
+    time::{Duration, SystemTime},
+};
+
+use crate::{error::ObjectClosed, CallbackError, IrohError};
+
+/// The foreign side of [`self_test`], handing every value it receives straight back.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait SelfTestPeer: Send + Sync + 'static {
+    async fn echo_string(&self, value: String) -> Result<String, CallbackError>;
+    async fn echo_bytes(&self, value: Vec<u8>) -> Result<Vec<u8>, CallbackError>;
+    async fn echo_duration(&self, value: Duration) -> Result<Duration, CallbackError>;
+    async fn echo_timestamp(&self, value: SystemTime) -> Result<SystemTime, CallbackError>;
+    async fn echo_object(
+        &self,
+        value: Arc<SelfTestObject>,
+    ) -> Result<Arc<SelfTestObject>, CallbackError>;
+    async fn echo_error(&self, value: Arc<IrohError>) -> Result<Arc<IrohError>, CallbackError>;
+    /// Must return an error.
+    async fn fail(&self) -> Result<(), CallbackError>;
+}
+
+/// An object passed through a [`SelfTestPeer`].
+#[derive(Debug, uniffi::Object)]
+pub struct SelfTestObject {
+    id: u64,
+}
+
+#[uniffi::export]
+impl SelfTestObject {
+    #[uniffi::constructor]
+    pub fn new(id: u64) -> Self {
+        SelfTestObject { id }
+    }
+
+    pub fn id(&self) -> u64 {
+        self.id
+    }
+}
+
+/// The outcome of [`self_test`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct SelfTestReport {
+    /// The version of the loaded library, see `iroh_ffi_version`.
+    pub library_version: String,
+    /// Number of checks that passed.
+    pub passed: u32,
+    /// A description of every check that failed. Empty if the bindings match the library.
+    pub failures: Vec<String>,
+}
+
+impl SelfTestReport {
+    fn check<T: PartialEq + Debug>(
+        &mut self,
+        name: &str,
+        expected: T,
+        actual: Result<T, CallbackError>,
+    ) {
+        match actual {
+            Ok(actual) if actual == expected => self.passed += 1,
+            Ok(actual) => self
+                .failures
+                .push(format!("{name}: expected {expected:?}, got {actual:?}")),
+            Err(err) => self
+                .failures
+                .push(format!("{name}: callback failed: {err}")),
+        }
+    }
+}
+
+/// Check that values of every kind survive the trip through the language bindings.
+///
+/// Strings, byte arrays, durations, timestamps, objects and errors are handed to `peer` and
+/// compared with what it returns. Meant to run in the CI of applications, to verify the library
+/// they load matches their bindings without starting a node.
+#[uniffi::export(async_runtime = "tokio")]
+pub async fn self_test(peer: Arc<dyn SelfTestPeer>) -> SelfTestReport {
+    let mut report = SelfTestReport {
+        library_version: crate::iroh_ffi_version(),
+        passed: 0,
+        failures: Vec::new(),
+    };
+
+    for value in ["", "hello", "héllo wörld 🦀", "nul\0byte"] {
+        let res = peer.echo_string(value.to_string()).await;
+        report.check("echo_string", value.to_string(), res);
+    }
+
+    let all_bytes = (0..=255u8).collect::<Vec<_>>();
+    for value in [Vec::new(), all_bytes, vec![0u8; 1024 * 1024]] {
+        // compare length and hash, to keep failure messages short
+        let expected = (value.len(), iroh_blobs::Hash::new(&value));
+        let res = peer
+            .echo_bytes(value)
+            .await
+            .map(|value| (value.len(), iroh_blobs::Hash::new(&value)));
+        report.check("echo_bytes", expected, res);
+    }
+
+    for value in [
+        Duration::ZERO,
+        Duration::from_nanos(1),
+        Duration::from_millis(1500),
+        Duration::from_secs(365 * 24 * 60 * 60),
+    ] {
+        let res = peer.echo_duration(value).await;
+        report.check("echo_duration", value, res);
+    }
+
+    for value in [
+        SystemTime::UNIX_EPOCH,
+        SystemTime::UNIX_EPOCH + Duration::new(1_700_000_000, 123_456_789),
+    ] {
+        let res = peer.echo_timestamp(value).await;
+        report.check("echo_timestamp", value, res);
+    }
+
+    let res = peer
+        .echo_object(Arc::new(SelfTestObject::new(u64::MAX)))
+        .await
+        .map(|object| object.id());
+    report.check("echo_object", u64::MAX, res);
+
+    let err = IrohError::from(ObjectClosed("self test object"));
+    let expected = (err.kind(), err.message());
+    let res = peer
+        .echo_error(Arc::new(err))
+        .await
+        .map(|err| (err.kind(), err.message()));
+    report.check("echo_error", expected, res);
+
+    match peer.fail().await {
+        Ok(()) => report
+            .failures
+            .push("fail: expected an error, got success".to_string()),
+        Err(_) => report.passed += 1,
+    }
+
+    report
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct Echo;
+
+    #[async_trait::async_trait]
+    impl SelfTestPeer for Echo {
+        async fn echo_string(&self, value: String) -> Result<String, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_bytes(&self, value: Vec<u8>) -> Result<Vec<u8>, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_duration(&self, value: Duration) -> Result<Duration, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_timestamp(&self, value: SystemTime) -> Result<SystemTime, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_object(
+            &self,
+            value: Arc<SelfTestObject>,
+        ) -> Result<Arc<SelfTestObject>, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_error(&self, value: Arc<IrohError>) -> Result<Arc<IrohError>, CallbackError> {
+            Ok(value)
+        }
+        async fn fail(&self) -> Result<(), CallbackError> {
+            Err(CallbackError::Error)
+        }
+    }
+
+    /// Truncates byte arrays and succeeds where it should fail.
+    struct Broken;
+
+    #[async_trait::async_trait]
+    impl SelfTestPeer for Broken {
+        async fn echo_string(&self, value: String) -> Result<String, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_bytes(&self, mut value: Vec<u8>) -> Result<Vec<u8>, CallbackError> {
+            value.truncate(16);
+            Ok(value)
+        }
+        async fn echo_duration(&self, value: Duration) -> Result<Duration, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_timestamp(&self, _value: SystemTime) -> Result<SystemTime, CallbackError> {
+            Err(CallbackError::Error)
+        }
+        async fn echo_object(
+            &self,
+            value: Arc<SelfTestObject>,
+        ) -> Result<Arc<SelfTestObject>, CallbackError> {
+            Ok(value)
+        }
+        async fn echo_error(&self, value: Arc<IrohError>) -> Result<Arc<IrohError>, CallbackError> {
+            Ok(value)
+        }
+        async fn fail(&self) -> Result<(), CallbackError> {
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_self_test() {
+        let report = self_test(Arc::new(Echo)).await;
+        assert!(report.failures.is_empty(), "{:?}", report.failures);
+        assert_eq!(report.passed, 16);
+        assert_eq!(report.library_version, env!("CARGO_PKG_VERSION"));
+
+        let report = self_test(Arc::new(Broken)).await;
+        // the 256 byte and 1 MiB arrays, both timestamps and fail
+        assert_eq!(report.failures.len(), 5, "{:?}", report.failures);
+        assert_eq!(report.passed, 11);
+    }
+}
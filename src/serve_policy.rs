@@ -0,0 +1,208 @@
+use std::{
+    collections::HashSet,
+    sync::{
+        atomic::{AtomicU64, Ordering},
+        Arc, RwLock,
+    },
+};
+
+use futures::TryStreamExt;
+
+use crate::{BlobsClient, Hash, Node};
+
+/// Which blobs a node serves to peers, see `Node.set_serve_policy`.
+#[derive(Debug, Clone, Default, uniffi::Record)]
+pub struct ServePolicy {
+    /// Serve these blobs.
+    #[uniffi(default = [])]
+    pub allow_hashes: Vec<Arc<Hash>>,
+    /// Serve the blobs of tags starting with one of these prefixes. The children of tagged
+    /// collections and other hash sequences are served as well.
+    #[uniffi(default = [])]
+    pub allow_tag_prefixes: Vec<String>,
+}
+
+#[uniffi::export]
+impl Node {
+    /// Only serve the blobs allowed by `policy` to peers, or every blob in the store if `None`,
+    /// the default.
+    ///
+    /// Requests for other blobs are answered as if this node did not have them. The allowed
+    /// blobs are determined when a peer connects and kept until the policy or the tags change,
+    /// tags changed later apply to the next connection. Only tags set and deleted through
+    /// `Blobs` and `Tags` are noticed. The policy is not stored, it has to be set again after
+    /// a restart.
+    pub fn set_serve_policy(&self, policy: Option<ServePolicy>) {
+        *self.serve.policy.write().expect("poisoned") = policy;
+        self.serve.tags_changed();
+    }
+
+    /// The policy set with [`Self::set_serve_policy`].
+    pub fn serve_policy(&self) -> Option<ServePolicy> {
+        self.serve.policy.read().expect("poisoned").clone()
+    }
+}
+
+/// The serve policy of a node, see `Node.set_serve_policy`.
+#[derive(Debug, Default)]
+pub(crate) struct ServeFilter {
+    policy: RwLock<Option<ServePolicy>>,
+    /// Counts the changes of the policy and the tags, see [`Self::tags_changed`].
+    generation: AtomicU64,
+    /// The allowed blobs, with the generation they were computed at.
+    allowed: tokio::sync::Mutex<Option<(u64, Arc<HashSet<iroh_blobs::Hash>>)>>,
+}
+
+impl ServeFilter {
+    /// Record that tags were set or deleted, so the allowed blobs are computed again.
+    pub(crate) fn tags_changed(&self) {
+        self.generation.fetch_add(1, Ordering::AcqRel);
+    }
+
+    /// The blobs served under the current policy, `None` if all are.
+    ///
+    /// Computed once per change of the policy or the tags, connections in between share it.
+    pub(crate) async fn allowed(
+        &self,
+        client: &BlobsClient,
+    ) -> anyhow::Result<Option<Arc<HashSet<iroh_blobs::Hash>>>> {
+        let mut cached = self.allowed.lock().await;
+        // read before computing, so changes made meanwhile cause another computation
+        let generation = self.generation.load(Ordering::Acquire);
+        let Some(policy) = self.policy.read().expect("poisoned").clone() else {
+            return Ok(None);
+        };
+        if let Some((computed, allowed)) = cached.as_ref() {
+            if *computed == generation {
+                return Ok(Some(allowed.clone()));
+            }
+        }
+        let allowed = Arc::new(Self::compute(&policy, client).await?);
+        *cached = Some((generation, allowed.clone()));
+        Ok(Some(allowed))
+    }
+
+    async fn compute(
+        policy: &ServePolicy,
+        client: &BlobsClient,
+    ) -> anyhow::Result<HashSet<iroh_blobs::Hash>> {
+        let mut allowed: HashSet<_> = policy.allow_hashes.iter().map(|hash| hash.0).collect();
+        if policy.allow_tag_prefixes.is_empty() {
+            return Ok(allowed);
+        }
+        let mut tags = client.tags().list().await?;
+        while let Some(tag) = tags.try_next().await? {
+            let name: &[u8] = tag.name.0.as_ref();
+            let matches = policy
+                .allow_tag_prefixes
+                .iter()
+                .any(|prefix| name.starts_with(prefix.as_bytes()));
+            if !matches {
+                continue;
+            }
+            allowed.insert(tag.hash);
+            if tag.format.is_hash_seq() {
+                // an incomplete hash sequence has no children to serve yet
+                let Ok(bytes) = client.read_to_bytes(tag.hash).await else {
+                    continue;
+                };
+                let children = iroh_blobs::hashseq::HashSeq::try_from(bytes)?;
+                allowed.extend(children.iter());
+            }
+        }
+        Ok(allowed)
+    }
+}
+
+/// A blob store that only contains the allowed blobs, for serving them to a peer.
+#[derive(Debug, Clone)]
+pub(crate) struct AllowedStore<S> {
+    store: S,
+    allowed: Arc<HashSet<iroh_blobs::Hash>>,
+}
+
+impl<S> AllowedStore<S> {
+    pub(crate) fn new(store: S, allowed: Arc<HashSet<iroh_blobs::Hash>>) -> Self {
+        AllowedStore { store, allowed }
+    }
+}
+
+impl<S: iroh_blobs::store::Map> iroh_blobs::store::Map for AllowedStore<S> {
+    type Entry = S::Entry;
+
+    async fn get(&self, hash: &iroh_blobs::Hash) -> std::io::Result<Option<Self::Entry>> {
+        if !self.allowed.contains(hash) {
+            return Ok(None);
+        }
+        self.store.get(hash).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_node, NoProgress};
+
+    #[tokio::test]
+    async fn test_serve_policy() {
+        let provider = local_node().await;
+        let getter = local_node().await;
+        let blobs = provider.blobs();
+        let listed = blobs.add_bytes(b"listed".to_vec()).await.unwrap();
+        let tagged = blobs
+            .add_bytes_named(b"tagged".to_vec(), "public/tagged".to_string())
+            .await
+            .unwrap();
+        let private = blobs.add_bytes(b"private".to_vec()).await.unwrap();
+
+        let policy = ServePolicy {
+            allow_hashes: vec![listed.hash.clone()],
+            allow_tag_prefixes: vec!["public/".to_string()],
+        };
+        provider.node().set_serve_policy(Some(policy));
+        assert!(provider.node().serve_policy().is_some());
+
+        let addr = Arc::new(provider.net().node_addr().await.unwrap());
+        let download = |hash: Arc<Hash>| {
+            let opts = crate::BlobDownloadOptions::new(
+                crate::BlobFormat::Raw,
+                vec![addr.clone()],
+                Arc::new(crate::SetTagOption::auto()),
+            )
+            .unwrap();
+            let blobs = getter.blobs();
+            async move {
+                blobs
+                    .download(hash, Arc::new(opts), Arc::new(NoProgress))
+                    .await
+            }
+        };
+        download(listed.hash).await.unwrap();
+        download(tagged.hash).await.unwrap();
+        assert!(download(private.hash.clone()).await.is_err());
+
+        // the allowed blobs are cached until the tags change
+        let first = provider
+            .serve
+            .allowed(&provider.blobs_client)
+            .await
+            .unwrap();
+        let again = provider
+            .serve
+            .allowed(&provider.blobs_client)
+            .await
+            .unwrap();
+        assert!(Arc::ptr_eq(
+            first.as_ref().unwrap(),
+            again.as_ref().unwrap()
+        ));
+        let later = blobs
+            .add_bytes_named(b"later".to_vec(), "public/later".to_string())
+            .await
+            .unwrap();
+        download(later.hash).await.unwrap();
+
+        provider.node().set_serve_policy(None);
+        download(private.hash).await.unwrap();
+    }
+}
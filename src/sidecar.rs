@@ -0,0 +1,194 @@
+use crate::{
+    compression::COMPRESSED_SIDECAR, doc::WriteGuard, entry_meta::META_SIDECAR, AuthorId, Doc,
+    IrohError,
+};
+
+/// Prefix of the keys of sidecar entries, followed by the kind of the sidecar, a slash and
+/// the key of the entry the sidecar belongs to.
+///
+/// Starts with a byte that is invalid in UTF-8, so sidecars sort after all text keys.
+pub(crate) const SIDECAR_PREFIX: &[u8] = b"\xffiroh-ffi/";
+
+/// The kinds of sidecars an entry can have.
+const KINDS: [&str; 2] = [COMPRESSED_SIDECAR, META_SIDECAR];
+
+/// Whether `key` is the key of a sidecar. Sidecars are never returned to users as entries.
+pub(crate) fn is_sidecar(key: &[u8]) -> bool {
+    key.starts_with(SIDECAR_PREFIX)
+}
+
+/// The key of the sidecar of `kind` for the entry at `key`.
+pub(crate) fn sidecar_key(kind: &str, key: &[u8]) -> Vec<u8> {
+    let mut sidecar = Vec::with_capacity(SIDECAR_PREFIX.len() + kind.len() + 1 + key.len());
+    sidecar.extend_from_slice(SIDECAR_PREFIX);
+    sidecar.extend_from_slice(kind.as_bytes());
+    sidecar.push(b'/');
+    sidecar.extend_from_slice(key);
+    sidecar
+}
+
+/// Write the sidecar of `kind` for the entry of `author_id` at `key` with the content
+/// `content`.
+///
+/// A sidecar records information about the content of an entry out of band, in an entry of
+/// its own that is synced like any other. Its content is the hash of the content it belongs
+/// to followed by `payload`, so a sidecar left behind by content that was since replaced is
+/// ignored. Write it before the entry, so the entry is never seen without it on this node.
+pub(crate) async fn write(
+    doc: &Doc,
+    lock: &WriteGuard<'_>,
+    author_id: &AuthorId,
+    kind: &str,
+    key: &[u8],
+    content: iroh_blobs::Hash,
+    payload: &[u8],
+) -> Result<(), IrohError> {
+    let mut value = Vec::with_capacity(32 + payload.len());
+    value.extend_from_slice(content.as_bytes());
+    value.extend_from_slice(payload);
+    doc.put_bytes(lock, author_id.0, sidecar_key(kind, key), value)
+        .await?;
+    Ok(())
+}
+
+/// Remove the sidecar of `kind` for the entry of `author_id` at `key`, if it has one.
+///
+/// A sidecar is only ignored once the content of the entry changes, so it has to be removed
+/// when the entry is set to the same content without it. Its content is replaced by a hash no
+/// content has, deleting it would delete all keys it is a prefix of and empty entries can not
+/// be set.
+pub(crate) async fn clear(
+    doc: &Doc,
+    lock: &WriteGuard<'_>,
+    author_id: &AuthorId,
+    kind: &str,
+    key: &[u8],
+) -> Result<(), IrohError> {
+    let key = sidecar_key(kind, key);
+    if doc
+        .inner
+        .get_exact(author_id.0, key.clone(), false)
+        .await?
+        .is_some()
+    {
+        doc.put_bytes(lock, author_id.0, key, vec![0u8; 32]).await?;
+    }
+    Ok(())
+}
+
+/// The payload of the sidecar of `kind` for `entry`, if it has one for its current content.
+///
+/// The content of the sidecar has to be available on this node.
+pub(crate) async fn read(
+    doc: &Doc,
+    entry: &iroh_docs::rpc::client::docs::Entry,
+    kind: &str,
+) -> anyhow::Result<Option<Vec<u8>>> {
+    let key = sidecar_key(kind, entry.key());
+    let Some(sidecar) = doc.inner.get_exact(entry.author(), key, false).await? else {
+        return Ok(None);
+    };
+    let value = doc
+        .engine
+        .content_cache
+        .read(&doc.engine.blobs, sidecar.content_hash())
+        .await?;
+    Ok(value
+        .strip_prefix(entry.content_hash().as_bytes().as_slice())
+        .map(|payload| payload.to_vec()))
+}
+
+/// Give the entry of `author_id` at `key` in `dst` the sidecars `entry` of `src` has for its
+/// content, and clear the ones it does not have. Call it before writing the content of
+/// `entry` to `key`.
+pub(crate) async fn copy(
+    src: &Doc,
+    entry: &iroh_docs::rpc::client::docs::Entry,
+    dst: &Doc,
+    lock: &WriteGuard<'_>,
+    author_id: &AuthorId,
+    key: &[u8],
+) -> Result<(), IrohError> {
+    for kind in KINDS {
+        match read(src, entry, kind).await? {
+            Some(payload) => {
+                write(
+                    dst,
+                    lock,
+                    author_id,
+                    kind,
+                    key,
+                    entry.content_hash(),
+                    &payload,
+                )
+                .await?
+            }
+            None => clear(dst, lock, author_id, kind, key).await?,
+        }
+    }
+    Ok(())
+}
+
+/// Remove all sidecars of the entry of `author_id` at `key`, see [`clear`].
+pub(crate) async fn clear_all(
+    doc: &Doc,
+    lock: &WriteGuard<'_>,
+    author_id: &AuthorId,
+    key: &[u8],
+) -> Result<(), IrohError> {
+    for kind in KINDS {
+        clear(doc, lock, author_id, kind, key).await?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_sidecar() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        let get = |key: &'static [u8]| {
+            let doc = doc.clone();
+            let author = author.clone();
+            async move {
+                doc.get_exact(author, key.to_vec(), false)
+                    .await
+                    .unwrap()
+                    .unwrap()
+            }
+        };
+
+        let lock = doc.write_lock().await;
+        write(
+            &doc,
+            &lock,
+            &author,
+            "test",
+            b"key",
+            iroh_blobs::Hash::new(b"value"),
+            b"payload",
+        )
+        .await
+        .unwrap();
+        drop(lock);
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        let entry = get(b"key").await;
+        let payload = read(&doc, &entry.0, "test").await.unwrap();
+        assert_eq!(payload.as_deref(), Some(&b"payload"[..]));
+        assert!(read(&doc, &entry.0, "other").await.unwrap().is_none());
+
+        // replaced content does not inherit the sidecar
+        doc.set_bytes(&author, b"key".to_vec(), b"replaced".to_vec())
+            .await
+            .unwrap();
+        let entry = get(b"key").await;
+        assert!(read(&doc, &entry.0, "test").await.unwrap().is_none());
+    }
+}
@@ -0,0 +1,257 @@
+use std::{str::FromStr, sync::Arc};
+
+use ed25519_dalek::Signature;
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+use serde::{Deserialize, Serialize};
+use tracing::debug;
+
+use crate::{Author, AuthorId, Doc, Hash, IrohError};
+
+/// A document entry signed by its author, but not yet inserted into a document.
+///
+/// Created with `Author.sign_entry`, possibly in another process or on another machine than
+/// the one holding the document, and inserted with `Doc.insert_signed_record`. The node
+/// inserting the record adds the signature of the document, so the author does not need write
+/// access to the document itself.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize, uniffi::Object)]
+pub struct SignedRecord {
+    entry: iroh_docs::Entry,
+    author_signature: Signature,
+}
+
+#[uniffi::export]
+impl SignedRecord {
+    /// Parse a record serialized with [`Self::to_bytes`], verifying its signature.
+    #[uniffi::constructor]
+    pub fn from_bytes(bytes: Vec<u8>) -> Result<Self, IrohError> {
+        let record: SignedRecord = postcard::from_bytes(&bytes).map_err(anyhow::Error::from)?;
+        record.verify()?;
+        Ok(record)
+    }
+
+    /// Serialize the record, to hand it to the process holding the document.
+    pub fn to_bytes(&self) -> Vec<u8> {
+        postcard::to_stdvec(self).expect("serializable")
+    }
+
+    /// The id of the document the record is for.
+    pub fn doc_id(&self) -> String {
+        self.entry.namespace().to_string()
+    }
+
+    /// The author that signed the record.
+    pub fn author(&self) -> Arc<AuthorId> {
+        Arc::new(AuthorId(self.entry.author()))
+    }
+
+    pub fn key(&self) -> Vec<u8> {
+        self.entry.key().to_vec()
+    }
+
+    pub fn content_hash(&self) -> Arc<Hash> {
+        Arc::new(Hash(self.entry.content_hash()))
+    }
+
+    pub fn content_len(&self) -> u64 {
+        self.entry.content_len()
+    }
+
+    /// The timestamp of the record, in microseconds since the unix epoch.
+    pub fn timestamp(&self) -> u64 {
+        self.entry.timestamp()
+    }
+}
+
+impl SignedRecord {
+    fn verify(&self) -> anyhow::Result<()> {
+        let author = self.entry.author().public_key()?;
+        author
+            .verify(&self.entry.to_vec(), &self.author_signature)
+            .map_err(|_| anyhow::anyhow!("invalid author signature"))?;
+        Ok(())
+    }
+}
+
+#[uniffi::export]
+impl Author {
+    /// Sign an entry for the document `doc_id` without inserting it, see [`SignedRecord`].
+    ///
+    /// `timestamp` is in microseconds since the unix epoch. Nodes reject entries timestamped
+    /// more than 10 minutes ahead of their system time.
+    pub fn sign_entry(
+        &self,
+        doc_id: String,
+        key: Vec<u8>,
+        content_hash: &Hash,
+        size: u64,
+        timestamp: u64,
+    ) -> Result<SignedRecord, IrohError> {
+        let namespace = iroh_docs::NamespaceId::from_str(&doc_id)?;
+        Ok(SignedRecord::sign(
+            &self.0,
+            namespace,
+            key,
+            content_hash.0,
+            size,
+            timestamp,
+        ))
+    }
+}
+
+impl SignedRecord {
+    pub(crate) fn sign(
+        author: &iroh_docs::Author,
+        namespace: iroh_docs::NamespaceId,
+        key: Vec<u8>,
+        hash: iroh_blobs::Hash,
+        len: u64,
+        timestamp: u64,
+    ) -> Self {
+        let id = iroh_docs::RecordIdentifier::new(namespace, author.id(), key);
+        let record = iroh_docs::Record::new(hash, len, timestamp);
+        let entry = iroh_docs::Entry::new(id, record);
+        let author_signature = author.sign(&entry.to_vec());
+        SignedRecord {
+            entry,
+            author_signature,
+        }
+    }
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Insert a record created with `Author.sign_entry`.
+    ///
+    /// The record has to be for this document and this node needs write access to it. Like any
+    /// other write, the record is rejected if the author already has a newer entry for the key.
+    /// The content does not need to be available yet.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn insert_signed_record(&self, record: &SignedRecord) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        record.verify()?;
+        let _lock = self.write_lock().await;
+        self.insert_record(record.clone()).await?;
+        self.index_write(record.entry.author(), record.entry.key())
+            .await?;
+        Ok(())
+    }
+}
+
+impl Doc {
+    /// Add the signature of the document to `record` and insert it.
+    ///
+    /// The docs engine always timestamps local writes with the system time, so the entry is
+    /// inserted the way entries received from peers are, as received from this node, and
+    /// announced to the peers the document is live synced with like a local write. See
+    /// [`Doc::live_events`] for how subscribers see it.
+    pub(crate) async fn insert_record(&self, record: SignedRecord) -> anyhow::Result<()> {
+        let engine = &self.engine;
+        let namespace = self.inner.id();
+        anyhow::ensure!(
+            record.entry.namespace() == namespace,
+            "record is for document {}, not {}",
+            record.entry.namespace(),
+            namespace
+        );
+        let secret = engine.sync.export_secret_key(namespace).await?;
+        let namespace_signature = secret.sign(&record.entry.to_vec());
+        let signature = iroh_docs::EntrySignature::from_parts(
+            &namespace_signature.to_bytes(),
+            &record.author_signature.to_bytes(),
+        );
+        let entry = iroh_docs::SignedEntry::new(signature, record.entry);
+        let hash = entry.content_hash();
+        let status = if entry.content_len() == 0 {
+            iroh_docs::ContentStatus::Complete
+        } else {
+            match engine.blobs.status(hash).await? {
+                BlobStatus::Complete { .. } => iroh_docs::ContentStatus::Complete,
+                BlobStatus::Partial { .. } => iroh_docs::ContentStatus::Incomplete,
+                BlobStatus::NotFound => iroh_docs::ContentStatus::Missing,
+            }
+        };
+        engine
+            .sync
+            .insert_remote(namespace, entry.clone(), *engine.node_id.as_bytes(), status)
+            .await?;
+        if let Err(err) = self.announce(entry).await {
+            debug!("failed to announce inserted record of {namespace}: {err:#}");
+        }
+        Ok(())
+    }
+
+    /// Broadcast `entry` in the gossip swarm of the document, the way the docs engine
+    /// announces local writes, if the document is live synced.
+    async fn announce(&self, entry: iroh_docs::SignedEntry) -> anyhow::Result<()> {
+        if !self.inner.status().await?.sync {
+            return Ok(());
+        }
+        let message = postcard::to_stdvec(&GossipOp::Put(entry))?;
+        let topic = iroh_gossip::proto::TopicId::from_bytes(*self.inner.id().as_bytes());
+        // joins the swarm the docs engine is already part of
+        let mut topic = self.engine.gossip.subscribe(topic, vec![])?;
+        topic.broadcast(message.into()).await?;
+        Ok(())
+    }
+}
+
+/// The gossip message announcing an entry, as sent by the live sync of the docs engine.
+///
+/// Only the variant announcing an entry is needed, it is the first one of the engine's.
+#[derive(Debug, Serialize)]
+enum GossipOp {
+    Put(iroh_docs::SignedEntry),
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_sign_and_insert_record() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author_id = node.authors().create().await.unwrap();
+        let author = node.authors().export(author_id.clone()).await.unwrap();
+        let outcome = node.blobs().add_bytes(b"offline".to_vec()).await.unwrap();
+
+        let timestamp = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)
+            .unwrap()
+            .as_micros() as u64;
+        let record = author
+            .sign_entry(
+                doc.id(),
+                b"key".to_vec(),
+                &outcome.hash,
+                outcome.size,
+                timestamp,
+            )
+            .unwrap();
+        assert_eq!(record.doc_id(), doc.id());
+        assert!(record.author().equal(&author_id));
+
+        // as if handed over from another process
+        let bytes = record.to_bytes();
+        let record = SignedRecord::from_bytes(bytes.clone()).unwrap();
+        doc.insert_signed_record(&record).await.unwrap();
+        let entry = doc
+            .get_exact(author_id, b"key".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(entry.timestamp(), timestamp);
+        assert_eq!(entry.content_hash(), outcome.hash);
+
+        // tampered records do not verify
+        let mut tampered = bytes;
+        let last = tampered.len() - 1;
+        tampered[last] ^= 1;
+        assert!(SignedRecord::from_bytes(tampered).is_err());
+
+        // records for another document are refused
+        let other = node.docs().create().await.unwrap();
+        assert!(other.insert_signed_record(&record).await.is_err());
+    }
+}
@@ -0,0 +1,435 @@
+use std::{
+    collections::{HashMap, HashSet},
+    path::{Path, PathBuf},
+    str::FromStr,
+    sync::{Arc, Mutex},
+    time::{Duration, SystemTime},
+};
+
+use futures::TryStreamExt;
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::warn;
+
+use crate::{
+    doc::DocsEngine, maintenance::Maintenance, node_events::NodeEvent, Doc, Docs, IrohError,
+};
+
+/// Name of the file holding the entries in a snapshot directory.
+const ENTRIES_FILE: &str = "entries.bin";
+/// Name of the directory holding the content in a snapshot directory, one file per hash.
+const CONTENT_DIR: &str = "content";
+
+/// A snapshot written by `Doc.write_snapshot` or a schedule set with `Docs.configure_snapshot`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct SnapshotWritten {
+    pub doc_id: String,
+    /// The directory the snapshot was written to.
+    pub path: String,
+    /// Number of entries in the snapshot, including deletions.
+    pub entries: u64,
+    /// Total size of the content in the snapshot.
+    pub content_bytes: u64,
+    /// Number of contents that were not complete on this node and are missing from the
+    /// snapshot.
+    pub missing_content: u64,
+}
+
+/// A scheduled snapshot failed.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct SnapshotFailed {
+    pub doc_id: String,
+    /// The error message.
+    pub message: String,
+}
+
+#[uniffi::export]
+impl Docs {
+    /// Periodically write a snapshot of a document to `dest_dir`, see `Doc.write_snapshot`.
+    ///
+    /// Snapshots are written every `interval`, the first one after one interval. Only the
+    /// newest `keep` snapshots of the document are kept in `dest_dir`, older ones are removed.
+    /// Every snapshot emits `NodeEventType::SnapshotWritten` or `NodeEventType::SnapshotFailed`,
+    /// see `Node.subscribe_events`.
+    ///
+    /// Replaces the schedule of the document if it already has one. Schedules are not
+    /// persisted and end when the node shuts down.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn configure_snapshot(
+        &self,
+        doc_id: String,
+        interval: Duration,
+        dest_dir: String,
+        keep: u32,
+    ) -> Result<(), IrohError> {
+        let namespace = iroh_docs::NamespaceId::from_str(&doc_id)?;
+        if keep == 0 {
+            return Err(anyhow::anyhow!("keep must be at least 1").into());
+        }
+        if interval < Duration::from_secs(1) {
+            return Err(anyhow::anyhow!("interval must be at least one second").into());
+        }
+        self.snapshots.schedule(
+            self.engine.clone(),
+            namespace,
+            interval,
+            PathBuf::from(dest_dir),
+            keep as usize,
+        );
+        Ok(())
+    }
+
+    /// Stop the snapshot schedule of a document. Returns false if it had none.
+    pub fn remove_snapshot(&self, doc_id: String) -> Result<bool, IrohError> {
+        let namespace = iroh_docs::NamespaceId::from_str(&doc_id)?;
+        Ok(self.snapshots.remove(&namespace))
+    }
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Write a snapshot of this document, its entries and their content, to a new directory
+    /// below `dest_dir/<doc id>`.
+    ///
+    /// The snapshot can be restored into a replica of the same document with
+    /// [`Doc::restore_snapshot`]. Content that is not complete on this node is left out.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn write_snapshot(&self, dest_dir: String) -> Result<SnapshotWritten, IrohError> {
+        self.ensure_open()?;
+        let written = write_snapshot(self, Path::new(&dest_dir)).await?;
+        Ok(written)
+    }
+
+    /// Restore a snapshot written with [`Doc::write_snapshot`], given the snapshot directory.
+    ///
+    /// The content is added to the blob store and the entries are merged like with
+    /// [`Doc::import_replica_state`]. Returns the number of entries that were inserted.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn restore_snapshot(&self, path: String) -> Result<u64, IrohError> {
+        self.ensure_open()?;
+        let path = PathBuf::from(path);
+        let state = tokio::fs::read(path.join(ENTRIES_FILE))
+            .await
+            .map_err(anyhow::Error::from)?;
+
+        // tag the content until the entries reference it
+        let mut tags = Vec::new();
+        let mut dir = tokio::fs::read_dir(path.join(CONTENT_DIR))
+            .await
+            .map_err(anyhow::Error::from)?;
+        let res = async {
+            while let Some(file) = dir.next_entry().await? {
+                let outcome = self
+                    .engine
+                    .blobs
+                    .add_from_path(
+                        file.path(),
+                        false,
+                        iroh_blobs::util::SetTagOption::Auto,
+                        iroh_blobs::rpc::client::blobs::WrapOption::NoWrap,
+                    )
+                    .await?
+                    .finish()
+                    .await?;
+                tags.push(outcome.tag);
+                if outcome.hash.to_string() != file.file_name().to_string_lossy() {
+                    warn!("snapshot content {} is corrupt", file.path().display());
+                }
+            }
+            anyhow::Ok(())
+        }
+        .await;
+        let inserted = match res {
+            Ok(()) => self.import_replica_state(state).await,
+            Err(err) => Err(err.into()),
+        };
+        for tag in tags {
+            self.engine.blobs.tags().delete(tag).await?;
+        }
+        inserted
+    }
+}
+
+/// The snapshot schedules of a node, see `Docs.configure_snapshot`.
+#[derive(Debug)]
+pub(crate) struct DocSnapshots {
+    tasks: Mutex<HashMap<iroh_docs::NamespaceId, AbortOnDropHandle<()>>>,
+    maintenance: Arc<Maintenance>,
+}
+
+impl DocSnapshots {
+    pub(crate) fn new(maintenance: Arc<Maintenance>) -> Self {
+        DocSnapshots {
+            tasks: Default::default(),
+            maintenance,
+        }
+    }
+
+    fn schedule(
+        &self,
+        engine: DocsEngine,
+        namespace: iroh_docs::NamespaceId,
+        interval: Duration,
+        dest_dir: PathBuf,
+        keep: usize,
+    ) {
+        let maintenance = self.maintenance.clone();
+        let task = tokio::task::spawn(async move {
+            let mut interval = tokio::time::interval(interval);
+            interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+            // the first tick completes immediately
+            interval.tick().await;
+            loop {
+                interval.tick().await;
+                maintenance.resumed().await;
+                let event = match scheduled_snapshot(&engine, namespace, &dest_dir, keep).await {
+                    Ok(written) => NodeEvent::SnapshotWritten(written),
+                    Err(err) => {
+                        warn!("snapshot of {namespace} failed: {err:#}");
+                        NodeEvent::SnapshotFailed(SnapshotFailed {
+                            doc_id: namespace.to_string(),
+                            message: format!("{err:#}"),
+                        })
+                    }
+                };
+                engine.events.emit(event);
+            }
+        });
+        self.tasks
+            .lock()
+            .expect("poisoned")
+            .insert(namespace, AbortOnDropHandle::new(task));
+    }
+
+    fn remove(&self, namespace: &iroh_docs::NamespaceId) -> bool {
+        self.tasks
+            .lock()
+            .expect("poisoned")
+            .remove(namespace)
+            .is_some()
+    }
+}
+
+async fn scheduled_snapshot(
+    engine: &DocsEngine,
+    namespace: iroh_docs::NamespaceId,
+    dest_dir: &Path,
+    keep: usize,
+) -> anyhow::Result<SnapshotWritten> {
+    let inner = engine
+        .client
+        .open(namespace)
+        .await?
+        .ok_or_else(|| anyhow::anyhow!("document {namespace} not found"))?;
+    let doc = Doc::new(inner, engine.clone());
+    let res = write_snapshot(&doc, dest_dir).await;
+    doc.inner.close().await?;
+    let written = res?;
+    prune_snapshots(&dest_dir.join(namespace.to_string()), keep).await?;
+    Ok(written)
+}
+
+/// Write a snapshot of `doc` to a new directory below `dest_dir/<doc id>`.
+///
+/// The snapshot is written to a temporary directory first, so that a snapshot directory is
+/// always complete.
+async fn write_snapshot(doc: &Doc, dest_dir: &Path) -> anyhow::Result<SnapshotWritten> {
+    let namespace = doc.inner.id();
+    let millis = SystemTime::now()
+        .duration_since(SystemTime::UNIX_EPOCH)?
+        .as_millis();
+    // zero padded, so that snapshots sort by name
+    let name = format!("{millis:020}");
+    let doc_dir = dest_dir.join(namespace.to_string());
+    let tmp = doc_dir.join(format!(".tmp-{name}"));
+    let content_dir = tmp.join(CONTENT_DIR);
+    tokio::fs::create_dir_all(&content_dir).await?;
+
+    let res = async {
+        let state = doc.export_replica_state().await?;
+        tokio::fs::write(tmp.join(ENTRIES_FILE), state).await?;
+
+        let query = iroh_docs::store::Query::all().include_empty().build();
+        let entries = doc
+            .inner
+            .get_many(query)
+            .await?
+            .try_collect::<Vec<_>>()
+            .await?;
+        let hashes: HashSet<_> = entries
+            .iter()
+            .filter(|entry| entry.content_len() > 0)
+            .map(|entry| entry.content_hash())
+            .collect();
+        let mut content_bytes = 0;
+        let mut missing_content = 0;
+        for hash in hashes {
+            let size = match doc.engine.blobs.status(hash).await? {
+                BlobStatus::Complete { size } => size,
+                _ => {
+                    missing_content += 1;
+                    continue;
+                }
+            };
+            doc.engine
+                .blobs
+                .export(
+                    hash,
+                    content_dir.join(hash.to_string()),
+                    iroh_blobs::store::ExportFormat::Blob,
+                    iroh_blobs::store::ExportMode::Copy,
+                )
+                .await?
+                .finish()
+                .await?;
+            content_bytes += size;
+        }
+        anyhow::Ok((entries.len() as u64, content_bytes, missing_content))
+    }
+    .await;
+    let (entries, content_bytes, missing_content) = match res {
+        Ok(counts) => counts,
+        Err(err) => {
+            tokio::fs::remove_dir_all(&tmp).await.ok();
+            return Err(err);
+        }
+    };
+
+    let path = doc_dir.join(&name);
+    tokio::fs::rename(&tmp, &path).await?;
+    Ok(SnapshotWritten {
+        doc_id: namespace.to_string(),
+        path: path.display().to_string(),
+        entries,
+        content_bytes,
+        missing_content,
+    })
+}
+
+/// Remove all but the newest `keep` snapshots in `doc_dir`.
+async fn prune_snapshots(doc_dir: &Path, keep: usize) -> anyhow::Result<()> {
+    let mut snapshots = Vec::new();
+    let mut dir = tokio::fs::read_dir(doc_dir).await?;
+    while let Some(entry) = dir.next_entry().await? {
+        let name = entry.file_name().to_string_lossy().into_owned();
+        // leftovers of interrupted snapshots are pruned as well
+        if entry.file_type().await?.is_dir() {
+            snapshots.push((name, entry.path()));
+        }
+    }
+    // temporary directories sort first, as '.' sorts before digits
+    snapshots.sort();
+    let remove = snapshots.len().saturating_sub(keep);
+    for (_, path) in snapshots.into_iter().take(remove) {
+        tokio::fs::remove_dir_all(&path).await?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use super::*;
+    use crate::test_utils::{local_node, Forward};
+    use crate::NodeEventType;
+
+    #[tokio::test]
+    async fn test_write_and_restore_snapshot() {
+        let node = local_node().await;
+        let dir = tempfile::tempdir().unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"a".to_vec(), b"hello".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author, b"b".to_vec(), b"world!".to_vec())
+            .await
+            .unwrap();
+
+        let written = doc
+            .write_snapshot(dir.path().display().to_string())
+            .await
+            .unwrap();
+        assert_eq!(written.doc_id, doc.id());
+        assert_eq!(written.entries, 2);
+        assert_eq!(written.content_bytes, 11);
+        assert_eq!(written.missing_content, 0);
+
+        // restore into a fresh replica of the same document on another node
+        let ticket = doc
+            .share(crate::ShareMode::Write, crate::AddrInfoOptions::Id)
+            .await
+            .unwrap();
+        let other = local_node().await;
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        let engine = other.docs().engine;
+        let copy = engine
+            .client
+            .import_namespace(ticket.capability)
+            .await
+            .unwrap();
+        let copy = Doc::new(copy, engine);
+        let inserted = copy.restore_snapshot(written.path).await.unwrap();
+        assert_eq!(inserted, 2);
+        let entry = copy
+            .get_exact(author, b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = copy.read_content(entry).await.unwrap();
+        assert_eq!(content.data, b"world!");
+    }
+
+    #[tokio::test]
+    async fn test_scheduled_snapshots() {
+        let node = local_node().await;
+        let (sender, mut events) = tokio::sync::mpsc::channel(16);
+        node.node()
+            .subscribe_events(Arc::new(Forward(sender)))
+            .await;
+        let dir = tempfile::tempdir().unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let docs = node.docs();
+        docs.configure_snapshot(
+            doc.id(),
+            Duration::from_secs(1),
+            dir.path().display().to_string(),
+            2,
+        )
+        .await
+        .unwrap();
+
+        for _ in 0..3 {
+            let event = tokio::time::timeout(Duration::from_secs(5), events.recv())
+                .await
+                .unwrap()
+                .unwrap();
+            assert_eq!(event.r#type(), NodeEventType::SnapshotWritten);
+            assert_eq!(event.as_snapshot_written().unwrap().doc_id, doc.id());
+        }
+        assert!(docs.remove_snapshot(doc.id()).unwrap());
+        assert!(!docs.remove_snapshot(doc.id()).unwrap());
+
+        let snapshots = std::fs::read_dir(dir.path().join(doc.id()))
+            .unwrap()
+            .count();
+        assert_eq!(snapshots, 2);
+
+        // unknown documents fail
+        let unknown = iroh_docs::NamespaceSecret::new(&mut rand::thread_rng()).id();
+        docs.configure_snapshot(
+            unknown.to_string(),
+            Duration::from_secs(1),
+            dir.path().display().to_string(),
+            1,
+        )
+        .await
+        .unwrap();
+        let event = tokio::time::timeout(Duration::from_secs(5), events.recv())
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(event.r#type(), NodeEventType::SnapshotFailed);
+    }
+}
@@ -0,0 +1,155 @@
+use std::{
+    sync::Arc,
+    time::{Duration, Instant},
+};
+
+use futures::StreamExt;
+
+use crate::{CallbackError, Iroh, IrohError, NodeOptions};
+
+/// How long `Iroh.persistent_with_progress` waits for the connection to the home relay.
+const RELAY_CONNECT_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// A phase of starting a node, see `Iroh.persistent_with_progress`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, uniffi::Enum)]
+pub enum StartupPhase {
+    /// Opening the docs database.
+    OpenDocsStore,
+    /// Opening the blob store, including migrating it from an older version and cleaning up
+    /// after an unclean shutdown. Takes longer the more blobs there are.
+    OpenBlobStore,
+    /// Binding the sockets of the endpoint.
+    BindEndpoint,
+    /// Starting gossip, blob transfers and the docs engine.
+    StartProtocols,
+    /// Waiting for the connection to the home relay server, for up to 5 seconds.
+    ConnectRelay,
+    /// The node is started.
+    Ready,
+}
+
+/// The start of a phase of starting a node.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct StartupProgress {
+    pub phase: StartupPhase,
+    /// Time since the start of the node.
+    pub elapsed: Duration,
+}
+
+/// The `progress` method is called at the start of each phase of starting a node, see
+/// `Iroh.persistent_with_progress`.
+#[uniffi::export(with_foreign)]
+#[async_trait::async_trait]
+pub trait StartupCallback: Send + Sync + 'static {
+    async fn progress(&self, progress: StartupProgress) -> Result<(), CallbackError>;
+}
+
+#[uniffi::export]
+impl Iroh {
+    /// Create a new iroh node, reporting the phases of the start to `cb`.
+    ///
+    /// Opening a large blob store can take a while, the phases tell which part is slow.
+    /// Unlike the other constructors, this also waits a moment for the connection to the home
+    /// relay, so the node can be reached by other nodes right away once it is ready. Returning
+    /// an error from the callback aborts the start.
+    #[uniffi::constructor(async_runtime = "tokio")]
+    pub async fn persistent_with_progress(
+        path: String,
+        options: NodeOptions,
+        cb: Arc<dyn StartupCallback>,
+    ) -> Result<Self, IrohError> {
+        crate::runtime::spawn(async move {
+            let startup = Startup::new(Some(cb));
+            let node = Self::spawn_persistent(path, options, &startup).await?;
+            if !node.relay_map.is_empty() {
+                startup.phase(StartupPhase::ConnectRelay).await?;
+                let relays = node.router.endpoint().watch_home_relay();
+                tokio::pin!(relays);
+                // offline nodes start without a relay connection
+                tokio::time::timeout(RELAY_CONNECT_TIMEOUT, relays.next())
+                    .await
+                    .ok();
+            }
+            startup.phase(StartupPhase::Ready).await?;
+            Ok(node)
+        })
+        .await
+    }
+}
+
+/// Reports the phases of starting a node to a [`StartupCallback`], if there is one.
+#[derive(Default)]
+pub(crate) struct Startup {
+    cb: Option<Arc<dyn StartupCallback>>,
+    start: Option<Instant>,
+}
+
+impl Startup {
+    fn new(cb: Option<Arc<dyn StartupCallback>>) -> Self {
+        Startup {
+            cb,
+            start: Some(Instant::now()),
+        }
+    }
+
+    pub(crate) async fn phase(&self, phase: StartupPhase) -> anyhow::Result<()> {
+        let Some(cb) = &self.cb else {
+            return Ok(());
+        };
+        let progress = StartupProgress {
+            phase,
+            elapsed: self.start.map(|start| start.elapsed()).unwrap_or_default(),
+        };
+        cb.progress(progress).await?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_options, Collect};
+
+    #[tokio::test]
+    async fn test_persistent_with_progress() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().to_string_lossy().into_owned();
+        let cb = Arc::new(Collect::<StartupProgress>::default());
+        let node = Iroh::persistent_with_progress(path, local_options(), cb.clone())
+            .await
+            .unwrap();
+        let progress = cb.items();
+        let phases: Vec<_> = progress.iter().map(|p| p.phase).collect();
+        // without relays there is no relay to wait for
+        assert_eq!(
+            phases,
+            vec![
+                StartupPhase::OpenDocsStore,
+                StartupPhase::OpenBlobStore,
+                StartupPhase::BindEndpoint,
+                StartupPhase::StartProtocols,
+                StartupPhase::Ready,
+            ]
+        );
+        assert!(progress.windows(2).all(|w| w[0].elapsed <= w[1].elapsed));
+        node.node().shutdown().await.unwrap();
+    }
+
+    struct Abort;
+
+    #[async_trait::async_trait]
+    impl StartupCallback for Abort {
+        async fn progress(&self, _progress: StartupProgress) -> Result<(), CallbackError> {
+            Err(CallbackError::Error)
+        }
+    }
+
+    #[tokio::test]
+    async fn test_persistent_with_progress_abort() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().to_string_lossy().into_owned();
+        let res =
+            Iroh::persistent_with_progress(path, NodeOptions::default(), Arc::new(Abort)).await;
+        assert!(res.is_err());
+    }
+}
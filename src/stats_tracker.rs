@@ -0,0 +1,221 @@
+use std::{
+    collections::HashMap,
+    fmt::Write,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use tokio_util::task::AbortOnDropHandle;
+use tracing::warn;
+
+use crate::{IrohError, Node};
+
+/// The change of a counter between two snapshots, see [`StatsTracker`].
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct CounterDelta {
+    pub name: String,
+    pub description: String,
+    /// The value at the newer snapshot.
+    pub value: u64,
+    /// The increase since the older snapshot.
+    pub delta: u64,
+    /// The increase per second.
+    pub rate: f64,
+}
+
+/// The changes of all counters between two snapshots, see [`StatsTracker`].
+#[derive(Debug, Clone, PartialEq, uniffi::Record)]
+pub struct StatsDelta {
+    /// The counters, sorted by name.
+    pub counters: Vec<CounterDelta>,
+    /// The time between the snapshots, zero for the first snapshot.
+    pub elapsed: Duration,
+}
+
+/// Takes snapshots of `Node.stats` and computes how the counters changed between them.
+///
+/// Safe to use from several threads. Create it with [`Node::stats_tracker`].
+#[derive(uniffi::Object)]
+pub struct StatsTracker {
+    inner: Arc<TrackerInner>,
+    _task: Option<AbortOnDropHandle<()>>,
+}
+
+#[uniffi::export]
+impl Node {
+    /// Track the changes of the counters of [`Node::stats`].
+    ///
+    /// With an `interval`, a snapshot is taken at that interval in the background, and
+    /// [`StatsTracker::latest`] returns the changes over the last interval, e.g. to publish them
+    /// as metrics. Without one, snapshots are only taken by [`StatsTracker::snapshot`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn stats_tracker(&self, interval: Option<Duration>) -> Arc<StatsTracker> {
+        let inner = Arc::new(TrackerInner {
+            client: self.client.clone(),
+            baseline: self.stats_baseline.clone(),
+            state: Mutex::new(TrackerState::default()),
+        });
+        let task = interval.map(|interval| {
+            let inner = inner.clone();
+            let task = tokio::task::spawn(async move {
+                let mut interval = tokio::time::interval(interval);
+                interval.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+                loop {
+                    interval.tick().await;
+                    if let Err(err) = inner.snapshot().await {
+                        warn!("stats snapshot failed: {err:#}");
+                    }
+                }
+            });
+            AbortOnDropHandle::new(task)
+        });
+        Arc::new(StatsTracker { inner, _task: task })
+    }
+}
+
+#[uniffi::export]
+impl StatsTracker {
+    /// Take a snapshot now, returning the changes since the previous one.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn snapshot(&self) -> Result<StatsDelta, IrohError> {
+        let delta = self.inner.snapshot().await?;
+        Ok(delta)
+    }
+
+    /// The changes between the last two snapshots, `None` before the first snapshot.
+    pub fn latest(&self) -> Option<StatsDelta> {
+        let state = self.inner.state.lock().expect("poisoned");
+        state.latest.clone()
+    }
+
+    /// The last snapshot in the Prometheus text format, for a metrics endpoint.
+    ///
+    /// Each counter is written as `iroh_<name>_total`, with the characters Prometheus does not
+    /// allow in names replaced by `_`. Empty before the first snapshot.
+    pub fn prometheus(&self) -> String {
+        let mut out = String::new();
+        let Some(latest) = self.latest() else {
+            return out;
+        };
+        for counter in latest.counters {
+            let name = prometheus_name(&counter.name);
+            let help = counter
+                .description
+                .replace('\\', "\\\\")
+                .replace('\n', "\\n");
+            writeln!(out, "# HELP {name} {help}").ok();
+            writeln!(out, "# TYPE {name} counter").ok();
+            writeln!(out, "{name} {}", counter.value).ok();
+        }
+        out
+    }
+}
+
+struct TrackerInner {
+    client: iroh_node_util::rpc::client::node::Client,
+    baseline: Arc<Mutex<HashMap<String, u64>>>,
+    state: Mutex<TrackerState>,
+}
+
+#[derive(Default)]
+struct TrackerState {
+    previous: Option<(Instant, HashMap<String, u64>)>,
+    latest: Option<StatsDelta>,
+}
+
+impl TrackerInner {
+    async fn snapshot(&self) -> anyhow::Result<StatsDelta> {
+        let stats = self.client.stats().await?;
+        let now = Instant::now();
+        let baseline = self.baseline.lock().expect("poisoned").clone();
+        let values: HashMap<_, _> = stats
+            .iter()
+            .map(|(name, counter)| {
+                let base = baseline.get(name).copied().unwrap_or_default();
+                (name.clone(), counter.value.saturating_sub(base))
+            })
+            .collect();
+
+        let mut state = self.state.lock().expect("poisoned");
+        let (elapsed, previous) = match &state.previous {
+            Some((at, previous)) => (now.duration_since(*at), Some(previous)),
+            None => (Duration::ZERO, None),
+        };
+        let mut counters: Vec<_> = stats
+            .into_iter()
+            .map(|(name, counter)| {
+                let value = values[&name];
+                let delta = match previous.and_then(|previous| previous.get(&name)) {
+                    // the counter was reset, see `Node.stats_reset`
+                    Some(before) if *before > value => value,
+                    Some(before) => value - before,
+                    None => 0,
+                };
+                let rate = if elapsed.is_zero() {
+                    0.0
+                } else {
+                    delta as f64 / elapsed.as_secs_f64()
+                };
+                CounterDelta {
+                    name,
+                    description: counter.description,
+                    value,
+                    delta,
+                    rate,
+                }
+            })
+            .collect();
+        counters.sort_by(|a, b| a.name.cmp(&b.name));
+        let delta = StatsDelta { counters, elapsed };
+        state.previous = Some((now, values));
+        state.latest = Some(delta.clone());
+        Ok(delta)
+    }
+}
+
+/// `name` as a Prometheus counter name.
+fn prometheus_name(name: &str) -> String {
+    let name: String = name
+        .chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c } else { '_' })
+        .collect();
+    format!("iroh_{name}_total")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::Iroh;
+
+    #[tokio::test]
+    async fn test_stats_tracker() {
+        let node = Iroh::memory().await.unwrap();
+        let tracker = node.node().stats_tracker(None).await;
+        assert!(tracker.latest().is_none());
+        assert!(tracker.prometheus().is_empty());
+
+        let first = tracker.snapshot().await.unwrap();
+        assert_eq!(first.elapsed, Duration::ZERO);
+        assert!(first.counters.iter().all(|c| c.delta == 0));
+        assert!(first.counters.windows(2).all(|w| w[0].name < w[1].name));
+
+        node.blobs().add_bytes(b"counted".to_vec()).await.unwrap();
+        let second = tracker.snapshot().await.unwrap();
+        assert!(second.elapsed > Duration::ZERO);
+        for counter in &second.counters {
+            let before = first.counters.iter().find(|c| c.name == counter.name);
+            if let Some(before) = before {
+                if counter.value >= before.value {
+                    assert_eq!(counter.delta, counter.value - before.value);
+                }
+            }
+        }
+        assert_eq!(tracker.latest(), Some(second));
+        if let Some(counter) = tracker.latest().unwrap().counters.first() {
+            let name = prometheus_name(&counter.name);
+            assert!(tracker
+                .prometheus()
+                .contains(&format!("# TYPE {name} counter")));
+        }
+    }
+}
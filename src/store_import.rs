@@ -0,0 +1,251 @@
+use std::path::{Path, PathBuf};
+
+use anyhow::Context;
+use iroh_blobs::{
+    rpc::client::blobs::{AddFileOpts, BlobStatus},
+    store::{ExportMode, ImportMode, ReadableStore, Store as _},
+    BlobFormat,
+};
+use tracing::debug;
+
+use crate::{BlobsClient, Iroh, IrohError};
+
+/// Directory inside the imported data directory that blobs are exported to before they are
+/// imported, removed once the import is done or failed.
+const STAGING_DIR: &str = ".iroh-ffi-import";
+
+/// What was imported by `Iroh.import_store`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct StoreImportOutcome {
+    /// Complete blobs this node did not have yet.
+    pub blobs: u64,
+    pub tags: u64,
+    pub docs: u64,
+    /// Document entries that were newer than the entries this node had.
+    pub entries: u64,
+    pub authors: u64,
+}
+
+#[uniffi::export]
+impl Iroh {
+    /// Import the blobs, tags, documents and authors of another iroh data directory, e.g. one
+    /// created by the iroh command line tool.
+    ///
+    /// Lets an application adopt existing data without adding it again. The directory has to
+    /// contain the blob store in `blobs` and the docs database in `docs.redb`, like the data
+    /// directory of a persistent node, and no node may be running on it. Documents and authors
+    /// are only imported if docs are enabled on this node. Partial blobs are not imported, tags
+    /// replace tags of the same name on this node. The content of the blobs is verified while
+    /// it is imported.
+    ///
+    /// With `move_data`, the blobs and tags are removed from the other directory once they are
+    /// imported. The content of the blobs is copied into the store of this node either way, so
+    /// moving needs as much free space as copying. Documents and authors are always copied.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn import_store(
+        &self,
+        other_data_dir: String,
+        move_data: bool,
+    ) -> Result<StoreImportOutcome, IrohError> {
+        let dir = tokio::fs::canonicalize(&other_data_dir)
+            .await
+            .with_context(|| format!("data directory {other_data_dir} not found"))?;
+        let mut outcome = StoreImportOutcome::default();
+
+        // documents first, they keep the content of their entries from being garbage collected
+        let docs_path = dir.join("docs.redb");
+        if let Some(engine) = self.docs_engine.as_ref().filter(|_| docs_path.exists()) {
+            let (docs, authors) = tokio::task::spawn_blocking(move || read_docs(docs_path))
+                .await
+                .context("reading documents failed")??;
+            for author in authors {
+                engine.client.authors().import(author).await?;
+                outcome.authors += 1;
+            }
+            for (capability, entries) in docs {
+                let doc = engine.client.import_namespace(capability).await?;
+                let inserted = engine.insert_signed(doc.id(), entries).await;
+                doc.close().await?;
+                outcome.entries += inserted?;
+                outcome.docs += 1;
+            }
+        }
+
+        let blobs_path = dir.join("blobs");
+        if blobs_path.exists() {
+            let store = iroh_blobs::store::fs::Store::load(&blobs_path)
+                .await
+                .map_err(|err| anyhow::anyhow!(err))?;
+            let staging = dir.join(STAGING_DIR);
+            let res = import_blobs(
+                &self.blobs_client,
+                &store,
+                &staging,
+                move_data,
+                &mut outcome,
+            )
+            .await;
+            store.shutdown().await;
+            self.serve.tags_changed();
+            tokio::fs::remove_dir_all(&staging).await.ok();
+            res?;
+        }
+        Ok(outcome)
+    }
+}
+
+/// The documents, with all their entries, and the authors of the docs database at `path`.
+#[allow(clippy::type_complexity)]
+fn read_docs(
+    path: PathBuf,
+) -> anyhow::Result<(
+    Vec<(iroh_docs::Capability, Vec<iroh_docs::SignedEntry>)>,
+    Vec<iroh_docs::Author>,
+)> {
+    let mut store = iroh_docs::store::Store::persistent(path)?;
+    let authors = store.list_authors()?.collect::<anyhow::Result<Vec<_>>>()?;
+    let namespaces = store
+        .list_namespaces()?
+        .collect::<anyhow::Result<Vec<_>>>()?;
+    let mut docs = Vec::with_capacity(namespaces.len());
+    for (namespace, _) in namespaces {
+        let capability = store.open_replica(&namespace)?.capability().clone();
+        let query = iroh_docs::store::Query::all().include_empty().build();
+        let entries = store
+            .get_many(namespace, query)?
+            .collect::<anyhow::Result<Vec<_>>>()?;
+        docs.push((capability, entries));
+    }
+    Ok((docs, authors))
+}
+
+/// Import the complete blobs and the tags of `store` through files in `staging`.
+async fn import_blobs(
+    client: &BlobsClient,
+    store: &iroh_blobs::store::fs::Store,
+    staging: &Path,
+    move_data: bool,
+    outcome: &mut StoreImportOutcome,
+) -> anyhow::Result<()> {
+    tokio::fs::create_dir_all(staging).await?;
+    let hashes = store.blobs().await?.collect::<std::io::Result<Vec<_>>>()?;
+    let tags = store.tags().await?.collect::<std::io::Result<Vec<_>>>()?;
+    // the blobs are protected by temp tags of the batch until they are tagged
+    let batch = client.batch().await?;
+    let mut imported = Vec::with_capacity(hashes.len());
+
+    for &hash in &hashes {
+        if matches!(client.status(hash).await?, BlobStatus::Complete { .. }) {
+            continue;
+        }
+        let target = staging.join(hash.to_hex());
+        // a copy, the other store must not refer to the file when the staging dir is removed
+        store
+            .export(hash, target.clone(), ExportMode::Copy, Box::new(|_| Ok(())))
+            .await?;
+        let opts = AddFileOpts {
+            import_mode: ImportMode::Copy,
+            format: BlobFormat::Raw,
+        };
+        let (temp_tag, _) = batch.add_file_with_opts(target.clone(), opts).await?;
+        anyhow::ensure!(
+            *temp_tag.hash() == hash,
+            "content of blob {hash} is corrupt"
+        );
+        tokio::fs::remove_file(&target).await?;
+        imported.push(temp_tag);
+        outcome.blobs += 1;
+    }
+
+    for (name, content) in &tags {
+        if !matches!(
+            client.status(content.hash).await?,
+            BlobStatus::Complete { .. }
+        ) {
+            debug!("skipping tag {name} of missing blob {}", content.hash);
+            continue;
+        }
+        let temp_tag = batch.temp_tag(*content).await?;
+        batch.persist_to(temp_tag, name.clone()).await?;
+        outcome.tags += 1;
+    }
+
+    if move_data {
+        for (name, _) in tags {
+            store.set_tag(name, None).await?;
+        }
+        store.delete(hashes).await?;
+    }
+    drop(imported);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::{local_node, local_options, persistent_node};
+
+    #[tokio::test]
+    async fn test_import_store() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().to_string_lossy().into_owned();
+        let node = persistent_node(dir.path(), local_options()).await;
+        let blob = node
+            .blobs()
+            .add_bytes_named(b"tagged".to_vec(), "kept".to_string())
+            .await
+            .unwrap();
+        let author = node.authors().create().await.unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let doc_id = doc.id();
+        doc.set_bytes(&author, b"key".to_vec(), b"value".to_vec())
+            .await
+            .unwrap();
+        drop(doc);
+        node.node().shutdown().await.unwrap();
+        drop(node);
+
+        let node = local_node().await;
+        let outcome = node.import_store(path.clone(), false).await.unwrap();
+        assert_eq!(outcome.docs, 1);
+        assert_eq!(outcome.entries, 1);
+        assert_eq!(outcome.tags, 1);
+        assert!(outcome.blobs >= 2);
+        assert!(outcome.authors >= 1);
+        assert!(!dir.path().join(STAGING_DIR).exists());
+        assert_eq!(
+            node.blobs().read_to_bytes(blob.hash.clone()).await.unwrap(),
+            b"tagged".to_vec()
+        );
+        assert!(node
+            .tags()
+            .list()
+            .await
+            .unwrap()
+            .iter()
+            .any(|tag| tag.name == b"kept".to_vec()));
+        assert!(node.authors().list().await.unwrap().contains(&author));
+        let doc = node.docs().open(doc_id).await.unwrap().unwrap();
+        let entry = doc
+            .get_exact(author.clone(), b"key".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(
+            node.blobs()
+                .read_to_bytes(entry.content_hash())
+                .await
+                .unwrap(),
+            b"value".to_vec()
+        );
+
+        // moving leaves the blobs and tags of the other directory behind
+        let node = local_node().await;
+        let moved = node.import_store(path.clone(), true).await.unwrap();
+        assert_eq!(moved.blobs, outcome.blobs);
+        assert_eq!(moved.tags, 1);
+        let node = local_node().await;
+        let again = node.import_store(path, false).await.unwrap();
+        assert_eq!((again.blobs, again.tags, again.docs), (0, 0, 1));
+    }
+}
@@ -0,0 +1,660 @@
+use std::{
+    collections::{BTreeMap, HashMap, HashSet, VecDeque},
+    path::PathBuf,
+    str::FromStr,
+    sync::Mutex,
+    time::{Duration, Instant},
+};
+
+use anyhow::Context;
+use futures::{StreamExt, TryStreamExt};
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+use iroh_docs::{rpc::client::docs::LiveEvent, store::DownloadPolicy};
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+use tokio_util::task::AbortOnDropHandle;
+use tracing::{debug, warn};
+
+use crate::{
+    doc::{DocsEngine, MemConnector},
+    BlobsClient, Doc, DocsClient, IrohError,
+};
+
+/// Name of the file the limits of the documents of a persistent node are stored in, in its
+/// data directory.
+pub(crate) const SYNC_PARALLELISM_FILE: &str = "sync-parallelism.json";
+/// A peer that did not report the end of its sync in this time no longer counts as syncing.
+const PEER_SYNC_TIMEOUT: Duration = Duration::from_secs(60);
+/// Prefix of the tags protecting contents while they are fetched, followed by their hash.
+const FETCH_TAG_PREFIX: &str = "iroh-ffi/sync-fetch/";
+/// Delay before a failed fetch is tried again, doubled with every failure.
+const FETCH_RETRY_DELAY: Duration = Duration::from_secs(5);
+/// Longest delay between two tries to fetch a content.
+const MAX_FETCH_RETRY_DELAY: Duration = Duration::from_secs(5 * 60);
+
+/// Limits on the concurrent work of syncing a document, see `Doc.set_sync_parallelism`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, uniffi::Record)]
+pub struct SyncParallelism {
+    /// Peers passed to `Doc.start_sync` that are synced with at the same time.
+    pub max_concurrent_peers: u32,
+    /// Entry contents fetched from peers at the same time.
+    pub max_concurrent_blob_fetches: u32,
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Limit how many peers this document syncs with at the same time, and how many entry
+    /// contents it fetches at the same time.
+    ///
+    /// Peers passed to [`Doc::start_sync`] beyond `max_concurrent_peers` wait until the syncs
+    /// running with other peers finished. Syncs the engine starts with neighbors found through
+    /// gossip count toward the limit, but start right away. Syncs started by peers are not
+    /// limited, the sync engine accepts them before this library learns about them.
+    ///
+    /// Contents are fetched by this library instead of the sync engine, through the downloader
+    /// of the node, following the download policy of the document: from the peer that sent the
+    /// entry or any other peer the document synced with. Failed fetches are tried again with
+    /// growing delays until the content arrives, and contents still missing when the limits are
+    /// set, when the node starts or when the policy changes are fetched as well. No
+    /// `LiveEventType::ContentReady` events are emitted for these contents. Both limits must be
+    /// at least 1.
+    ///
+    /// The limits of a persistent node are stored in its data directory and apply again after
+    /// a restart.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn set_sync_parallelism(
+        &self,
+        max_concurrent_peers: u32,
+        max_concurrent_blob_fetches: u32,
+    ) -> Result<(), IrohError> {
+        self.ensure_open()?;
+        if max_concurrent_peers == 0 || max_concurrent_blob_fetches == 0 {
+            return Err(anyhow::anyhow!("sync parallelism limits must be at least 1").into());
+        }
+        let limits = SyncParallelism {
+            max_concurrent_peers,
+            max_concurrent_blob_fetches,
+        };
+        self.engine
+            .sync_limits
+            .set(&self.engine, &self.inner, limits)
+            .await?;
+        Ok(())
+    }
+
+    /// Remove the limits set with [`Self::set_sync_parallelism`], handing content fetching
+    /// back to the sync engine.
+    ///
+    /// Returns `false` if there were no limits.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn clear_sync_parallelism(&self) -> Result<bool, IrohError> {
+        self.ensure_open()?;
+        let cleared = self.engine.sync_limits.clear(&self.inner).await?;
+        Ok(cleared)
+    }
+
+    /// The limits set with [`Self::set_sync_parallelism`], if any.
+    pub fn sync_parallelism(&self) -> Option<SyncParallelism> {
+        let docs = self.engine.sync_limits.docs.lock().expect("poisoned");
+        docs.get(&self.inner.id()).map(|limited| limited.limits)
+    }
+}
+
+/// The stored form of the limits.
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct StoredLimits {
+    docs: BTreeMap<String, StoredDoc>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+struct StoredDoc {
+    #[serde(flatten)]
+    limits: SyncParallelism,
+    /// The download policy of the document, which the sync engine does not know about.
+    policy: DownloadPolicy,
+}
+
+/// The documents of a node with limits on their sync, see `Doc.set_sync_parallelism`.
+#[derive(Debug, Default)]
+pub(crate) struct DocSyncLimits {
+    docs: Mutex<HashMap<iroh_docs::NamespaceId, LimitedDoc>>,
+    /// Held while limits are set or cleared.
+    changes: tokio::sync::Mutex<()>,
+    /// Where the limits are stored, for persistent nodes.
+    path: Option<PathBuf>,
+}
+
+#[derive(Debug)]
+struct LimitedDoc {
+    limits: SyncParallelism,
+    /// The download policy of the document, applied by the task instead of the sync engine.
+    policy: DownloadPolicy,
+    commands: mpsc::UnboundedSender<Command>,
+    _task: AbortOnDropHandle<()>,
+}
+
+#[derive(Debug)]
+enum Command {
+    Sync(Vec<iroh::NodeAddr>),
+    /// Drop the queued syncs with a peer, or with all peers.
+    Stop(Option<iroh::NodeId>),
+    Limits(SyncParallelism),
+    Policy(DownloadPolicy),
+}
+
+impl DocSyncLimits {
+    pub(crate) fn new(path: Option<PathBuf>) -> Self {
+        DocSyncLimits {
+            path,
+            ..Default::default()
+        }
+    }
+
+    /// Apply the stored limits again.
+    pub(crate) async fn resume(
+        &self,
+        client: &DocsClient,
+        blobs: &BlobsClient,
+    ) -> anyhow::Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let stored: StoredLimits = match std::fs::read(path) {
+            Ok(bytes) => serde_json::from_slice(&bytes)?,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+            Err(err) => return Err(err.into()),
+        };
+        for (id, stored) in stored.docs {
+            let namespace = iroh_docs::NamespaceId::from_str(&id)?;
+            // the document may have been deleted since
+            let Some(doc) = client.open(namespace).await? else {
+                continue;
+            };
+            let limited = spawn_limited(doc, blobs.clone(), stored.limits, stored.policy);
+            self.docs
+                .lock()
+                .expect("poisoned")
+                .insert(namespace, limited);
+        }
+        Ok(())
+    }
+
+    async fn set(
+        &self,
+        engine: &DocsEngine,
+        doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+        limits: SyncParallelism,
+    ) -> anyhow::Result<()> {
+        let _changes = self.changes.lock().await;
+        let namespace = doc.id();
+        let updated = {
+            let mut docs = self.docs.lock().expect("poisoned");
+            match docs.get_mut(&namespace) {
+                Some(limited) => {
+                    limited.limits = limits;
+                    limited.commands.send(Command::Limits(limits)).ok();
+                    true
+                }
+                None => false,
+            }
+        };
+        if !updated {
+            let policy = doc.get_download_policy().await?;
+            let task_doc = engine
+                .client
+                .open(namespace)
+                .await?
+                .context("document not found")?;
+            // contents are fetched by the task from now on
+            doc.set_download_policy(DownloadPolicy::NothingExcept(Vec::new()))
+                .await?;
+            let limited = spawn_limited(task_doc, engine.blobs.clone(), limits, policy);
+            self.docs
+                .lock()
+                .expect("poisoned")
+                .insert(namespace, limited);
+        }
+        self.store()
+    }
+
+    async fn clear(
+        &self,
+        doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    ) -> anyhow::Result<bool> {
+        let _changes = self.changes.lock().await;
+        let Some(limited) = self.docs.lock().expect("poisoned").remove(&doc.id()) else {
+            return Ok(false);
+        };
+        let policy = limited.policy.clone();
+        // stop fetching before the engine takes over again
+        drop(limited);
+        doc.set_download_policy(policy).await?;
+        self.store()?;
+        Ok(true)
+    }
+
+    /// Sync with `peers` once there is room, returns `false` if the document has no limits.
+    pub(crate) fn start_sync(
+        &self,
+        namespace: &iroh_docs::NamespaceId,
+        peers: Vec<iroh::NodeAddr>,
+    ) -> bool {
+        let docs = self.docs.lock().expect("poisoned");
+        let Some(limited) = docs.get(namespace) else {
+            return false;
+        };
+        limited.commands.send(Command::Sync(peers)).ok();
+        true
+    }
+
+    /// Drop the queued syncs of a document with `peer`, or with all peers if not set.
+    pub(crate) fn stop_sync(&self, namespace: &iroh_docs::NamespaceId, peer: Option<iroh::NodeId>) {
+        let docs = self.docs.lock().expect("poisoned");
+        if let Some(limited) = docs.get(namespace) {
+            limited.commands.send(Command::Stop(peer)).ok();
+        }
+    }
+
+    /// The download policy of a document with limits, `None` if it has none.
+    pub(crate) fn download_policy(
+        &self,
+        namespace: &iroh_docs::NamespaceId,
+    ) -> Option<DownloadPolicy> {
+        let docs = self.docs.lock().expect("poisoned");
+        docs.get(namespace).map(|limited| limited.policy.clone())
+    }
+
+    /// Set the download policy of a document with limits, returns `false` if it has none.
+    pub(crate) fn set_download_policy(
+        &self,
+        namespace: &iroh_docs::NamespaceId,
+        policy: DownloadPolicy,
+    ) -> anyhow::Result<bool> {
+        {
+            let mut docs = self.docs.lock().expect("poisoned");
+            let Some(limited) = docs.get_mut(namespace) else {
+                return Ok(false);
+            };
+            limited.policy = policy.clone();
+            limited.commands.send(Command::Policy(policy)).ok();
+        }
+        self.store()?;
+        Ok(true)
+    }
+
+    fn store(&self) -> anyhow::Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let stored = {
+            let docs = self.docs.lock().expect("poisoned");
+            StoredLimits {
+                docs: docs
+                    .iter()
+                    .map(|(namespace, limited)| {
+                        let doc = StoredDoc {
+                            limits: limited.limits,
+                            policy: limited.policy.clone(),
+                        };
+                        (namespace.to_string(), doc)
+                    })
+                    .collect(),
+            }
+        };
+        // write a temporary file first, so that a crash never leaves partial limits
+        let tmp = path.with_extension("json.tmp");
+        std::fs::write(&tmp, serde_json::to_vec_pretty(&stored)?)?;
+        std::fs::rename(&tmp, path)?;
+        Ok(())
+    }
+}
+
+fn spawn_limited(
+    doc: iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    blobs: BlobsClient,
+    limits: SyncParallelism,
+    policy: DownloadPolicy,
+) -> LimitedDoc {
+    let (commands, receiver) = mpsc::unbounded_channel();
+    let task = tokio::task::spawn(run_limited(doc, blobs, limits, policy.clone(), receiver));
+    LimitedDoc {
+        limits,
+        policy,
+        commands,
+        _task: AbortOnDropHandle::new(task),
+    }
+}
+
+/// A content to fetch.
+#[derive(Debug)]
+struct Wanted {
+    /// The peer that sent the entry, tried first.
+    from: Option<iroh::NodeId>,
+    /// Failed fetches so far.
+    attempts: u32,
+    /// When the content may be fetched again after a failure.
+    not_before: Instant,
+}
+
+impl Wanted {
+    fn new(from: Option<iroh::NodeId>) -> Self {
+        Wanted {
+            from,
+            attempts: 0,
+            not_before: Instant::now(),
+        }
+    }
+
+    fn failed(&mut self) {
+        self.attempts += 1;
+        let delay = FETCH_RETRY_DELAY.saturating_mul(2u32.saturating_pow(self.attempts - 1));
+        self.not_before = Instant::now() + delay.min(MAX_FETCH_RETRY_DELAY);
+    }
+}
+
+/// Start syncs with queued peers and fetch missing contents within the limits.
+async fn run_limited(
+    doc: iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    blobs: BlobsClient,
+    mut limits: SyncParallelism,
+    mut policy: DownloadPolicy,
+    mut commands: mpsc::UnboundedReceiver<Command>,
+) {
+    let namespace = doc.id();
+    let mut events = match doc.subscribe().await {
+        Ok(events) => events,
+        Err(err) => {
+            warn!("failed to subscribe to {namespace}, sync is not limited: {err:#}");
+            return;
+        }
+    };
+    let mut queue = VecDeque::<iroh::NodeAddr>::new();
+    let mut syncing = HashMap::<iroh::NodeId, Instant>::new();
+    // the peers contents can be fetched from
+    let mut peers = match sync_peers(&doc).await {
+        Ok(peers) => peers,
+        Err(err) => {
+            warn!("failed to get the sync peers of {namespace}: {err:#}");
+            HashSet::new()
+        }
+    };
+    let mut wanted = HashMap::<iroh_blobs::Hash, Wanted>::new();
+    let mut fetching = HashMap::<iroh_blobs::Hash, Wanted>::new();
+    let mut fetches = tokio::task::JoinSet::new();
+    // contents missing before the task started, e.g. across a restart
+    let mut scan = true;
+    let mut expire = tokio::time::interval(PEER_SYNC_TIMEOUT / 4);
+    expire.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+    let mut retry = tokio::time::interval(FETCH_RETRY_DELAY);
+    retry.set_missed_tick_behavior(tokio::time::MissedTickBehavior::Delay);
+
+    loop {
+        tokio::select! {
+            command = commands.recv() => match command {
+                Some(Command::Sync(peers)) => {
+                    for peer in peers {
+                        let known = syncing.contains_key(&peer.node_id)
+                            || queue.iter().any(|queued| queued.node_id == peer.node_id);
+                        if !known {
+                            queue.push_back(peer);
+                        }
+                    }
+                }
+                Some(Command::Stop(peer)) => {
+                    queue.retain(|queued| peer.is_some_and(|peer| queued.node_id != peer));
+                }
+                Some(Command::Limits(new_limits)) => limits = new_limits,
+                Some(Command::Policy(new_policy)) => {
+                    policy = new_policy;
+                    scan = true;
+                }
+                None => break,
+            },
+            event = events.next() => match event {
+                Some(Ok(LiveEvent::SyncFinished(event))) => {
+                    syncing.remove(&event.peer);
+                    peers.insert(event.peer);
+                }
+                // the engine syncs with new neighbors right away
+                Some(Ok(LiveEvent::NeighborUp(peer))) => {
+                    syncing.entry(peer).or_insert_with(Instant::now);
+                    peers.insert(peer);
+                }
+                Some(Ok(LiveEvent::InsertRemote {
+                    from,
+                    entry,
+                    content_status,
+                })) => {
+                    peers.insert(from);
+                    let hash = entry.content_hash();
+                    let missing = !matches!(content_status, iroh_docs::ContentStatus::Complete);
+                    if missing
+                        && policy_matches(&policy, entry.id().key())
+                        && !fetching.contains_key(&hash)
+                    {
+                        wanted.entry(hash).or_insert_with(|| Wanted::new(Some(from)));
+                    }
+                }
+                Some(Ok(_)) => {}
+                Some(Err(err)) => {
+                    warn!("sync events of {namespace} failed: {err:#}");
+                    break;
+                }
+                None => break,
+            },
+            Some(res) = fetches.join_next() => {
+                if let Ok((hash, res)) = res {
+                    let mut fetch = fetching.remove(&hash).expect("fetching");
+                    if let Err(err) = res {
+                        debug!("failed to fetch {hash}, attempt {}: {err:#}", fetch.attempts + 1);
+                        fetch.failed();
+                        wanted.insert(hash, fetch);
+                    }
+                }
+            }
+            _ = expire.tick() => {
+                syncing.retain(|_, started| started.elapsed() < PEER_SYNC_TIMEOUT);
+            }
+            _ = retry.tick() => {}
+        }
+
+        if std::mem::take(&mut scan) {
+            match missing_contents(&doc, &blobs, &policy).await {
+                Ok(missing) => {
+                    for hash in missing {
+                        if !fetching.contains_key(&hash) {
+                            wanted.entry(hash).or_insert_with(|| Wanted::new(None));
+                        }
+                    }
+                }
+                Err(err) => warn!("failed to find the missing contents of {namespace}: {err:#}"),
+            }
+        }
+
+        let now = Instant::now();
+        while fetches.len() < limits.max_concurrent_blob_fetches as usize {
+            let Some(hash) = wanted
+                .iter()
+                .filter(|(_, fetch)| fetch.not_before <= now)
+                .min_by_key(|(_, fetch)| fetch.attempts)
+                .map(|(hash, _)| *hash)
+            else {
+                break;
+            };
+            let fetch = wanted.remove(&hash).expect("wanted");
+            let mut nodes = Vec::from_iter(fetch.from);
+            nodes.extend(peers.iter().filter(|peer| Some(**peer) != fetch.from));
+            fetching.insert(hash, fetch);
+            let blobs = blobs.clone();
+            fetches.spawn(async move { (hash, fetch_content(&blobs, hash, nodes).await) });
+        }
+
+        while syncing.len() < limits.max_concurrent_peers as usize {
+            let Some(peer) = queue.pop_front() else {
+                break;
+            };
+            syncing.insert(peer.node_id, Instant::now());
+            if let Err(err) = doc.start_sync(vec![peer]).await {
+                warn!("failed to start the sync of {namespace}: {err:#}");
+            }
+        }
+    }
+}
+
+/// The peers `doc` synced with.
+async fn sync_peers(
+    doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+) -> anyhow::Result<HashSet<iroh::NodeId>> {
+    let peers = doc.get_sync_peers().await?.unwrap_or_default();
+    peers
+        .iter()
+        .map(|peer| iroh::NodeId::from_bytes(peer).map_err(anyhow::Error::from))
+        .collect()
+}
+
+/// The contents of the entries of `doc` the policy wants that are not complete in the store.
+async fn missing_contents(
+    doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    blobs: &BlobsClient,
+    policy: &DownloadPolicy,
+) -> anyhow::Result<HashSet<iroh_blobs::Hash>> {
+    let mut entries = doc.get_many(iroh_docs::store::Query::all().build()).await?;
+    let mut missing = HashSet::new();
+    while let Some(entry) = entries.try_next().await? {
+        let hash = entry.content_hash();
+        if entry.content_len() == 0
+            || missing.contains(&hash)
+            || !policy_matches(policy, entry.key())
+        {
+            continue;
+        }
+        if !matches!(blobs.status(hash).await?, BlobStatus::Complete { .. }) {
+            missing.insert(hash);
+        }
+    }
+    Ok(missing)
+}
+
+fn policy_matches(policy: &DownloadPolicy, key: &[u8]) -> bool {
+    match policy {
+        DownloadPolicy::NothingExcept(filters) => filters.iter().any(|f| f.matches(key)),
+        DownloadPolicy::EverythingExcept(filters) => !filters.iter().any(|f| f.matches(key)),
+    }
+}
+
+/// Download the content `hash` of an entry from `nodes`.
+async fn fetch_content(
+    blobs: &BlobsClient,
+    hash: iroh_blobs::Hash,
+    nodes: Vec<iroh::NodeId>,
+) -> anyhow::Result<()> {
+    anyhow::ensure!(!nodes.is_empty(), "no peer to fetch from");
+    let tag = iroh_blobs::Tag(format!("{FETCH_TAG_PREFIX}{hash}").into());
+    let opts = iroh_blobs::rpc::client::blobs::DownloadOptions {
+        format: iroh_blobs::BlobFormat::Raw,
+        nodes: nodes.into_iter().map(iroh::NodeAddr::new).collect(),
+        tag: iroh_blobs::util::SetTagOption::Named(tag.clone()),
+        mode: iroh_blobs::rpc::client::blobs::DownloadMode::Queued,
+    };
+    let res = async { blobs.download_with_opts(hash, opts).await?.finish().await }.await;
+    // once downloaded, the entry protects the content from garbage collection
+    blobs.tags().delete(tag).await?;
+    res?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Arc;
+
+    use super::*;
+    use crate::test_utils::{local_node, local_options, persistent_node};
+
+    #[test]
+    fn test_policy_matches() {
+        let prefix = |p: &[u8]| iroh_docs::store::FilterKind::Prefix(p.to_vec().into());
+        let policy = DownloadPolicy::EverythingExcept(vec![prefix(b"large/")]);
+        assert!(policy_matches(&policy, b"small/a"));
+        assert!(!policy_matches(&policy, b"large/a"));
+        let policy = DownloadPolicy::NothingExcept(vec![prefix(b"small/")]);
+        assert!(policy_matches(&policy, b"small/a"));
+        assert!(!policy_matches(&policy, b"large/a"));
+    }
+
+    #[tokio::test]
+    async fn test_sync_parallelism() {
+        let dir = tempfile::tempdir().unwrap();
+        let node = persistent_node(dir.path(), local_options()).await;
+        let doc = node.docs().create().await.unwrap();
+        assert!(doc.sync_parallelism().is_none());
+        assert!(doc.set_sync_parallelism(0, 1).await.is_err());
+
+        let policy = crate::DownloadPolicy::nothing_except(vec![Arc::new(
+            crate::FilterKind::prefix(b"small/".to_vec()),
+        )]);
+        doc.set_download_policy(Arc::new(policy)).await.unwrap();
+        doc.set_sync_parallelism(1, 2).await.unwrap();
+        let limits = SyncParallelism {
+            max_concurrent_peers: 1,
+            max_concurrent_blob_fetches: 2,
+        };
+        assert_eq!(doc.sync_parallelism(), Some(limits));
+        // the policy is kept by the limits, the engine fetches nothing
+        let policy = doc.get_download_policy().await.unwrap();
+        assert!(matches!(&*policy, crate::DownloadPolicy::NothingExcept(f) if f.len() == 1));
+        let engine_policy = doc.inner.get_download_policy().await.unwrap();
+        assert_eq!(engine_policy, DownloadPolicy::NothingExcept(Vec::new()));
+
+        // the limits apply again after a restart
+        let doc_id = doc.id();
+        node.node().shutdown().await.unwrap();
+        drop(doc);
+        drop(node);
+        let node = persistent_node(dir.path(), local_options()).await;
+        let doc = node.docs().open(doc_id).await.unwrap().unwrap();
+        assert_eq!(doc.sync_parallelism(), Some(limits));
+
+        assert!(doc.clear_sync_parallelism().await.unwrap());
+        assert!(!doc.clear_sync_parallelism().await.unwrap());
+        assert!(doc.sync_parallelism().is_none());
+        let engine_policy = doc.inner.get_download_policy().await.unwrap();
+        assert!(matches!(engine_policy, DownloadPolicy::NothingExcept(f) if f.len() == 1));
+    }
+
+    #[tokio::test]
+    async fn test_fetch_missing_contents() {
+        let provider = local_node().await;
+        let getter = local_node().await;
+        let doc = provider.docs().create().await.unwrap();
+        let author = provider.authors().create().await.unwrap();
+        let hash = doc
+            .set_bytes(&author, b"key".to_vec(), b"content".to_vec())
+            .await
+            .unwrap();
+        doc.start_sync(Vec::new()).await.unwrap();
+        let ticket = doc
+            .share(
+                crate::ShareMode::Read,
+                crate::AddrInfoOptions::RelayAndAddresses,
+            )
+            .await
+            .unwrap();
+        let joined = getter.docs().join(&ticket).await.unwrap();
+        let complete = || async {
+            for _ in 0..100 {
+                if getter.blobs().read_to_bytes(hash.clone()).await.is_ok() {
+                    return true;
+                }
+                tokio::time::sleep(Duration::from_millis(100)).await;
+            }
+            false
+        };
+        assert!(complete().await);
+
+        // content lost while nobody fetched it, found by the scan when the limits are set
+        getter.blobs_client.delete_blob(hash.0).await.unwrap();
+        assert!(getter.blobs().read_to_bytes(hash.clone()).await.is_err());
+        joined.set_sync_parallelism(1, 1).await.unwrap();
+        assert!(complete().await);
+    }
+}
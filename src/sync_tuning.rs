@@ -0,0 +1,176 @@
+use std::{sync::Arc, time::Duration};
+
+use tokio_util::task::AbortOnDropHandle;
+
+use crate::{
+    doc::DocsEngine,
+    maintenance::{spawn_doc_maintenance, MaintainedDoc, Maintenance},
+};
+
+/// Tuning of the background traffic of gossip and document sync, see `NodeOptions.sync_tuning`.
+///
+/// The defaults suit well connected nodes. On metered links the gossip fanout can be lowered
+/// and the shuffle interval raised to cut down on background chatter.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct SyncTuning {
+    /// How often documents with live sync enabled re-run reconciliation with their known peers.
+    ///
+    /// By default reconciliation only runs when a peer connects or announces new entries
+    /// through gossip, which is enough as long as no announcement is lost.
+    #[uniffi(default = None)]
+    pub sync_interval: Option<Duration>,
+    /// Number of peers kept in direct contact per gossip topic, every document is a topic.
+    /// Messages are forwarded to these peers only. Defaults to 5.
+    #[uniffi(default = None)]
+    pub gossip_fanout: Option<u32>,
+    /// How often a node exchanges the peers it knows of with a random peer, per gossip topic.
+    /// Defaults to 60 seconds.
+    #[uniffi(default = None)]
+    pub gossip_shuffle_interval: Option<Duration>,
+}
+
+impl SyncTuning {
+    /// The gossip membership config with the tuned values applied.
+    pub(crate) fn membership_config(&self) -> anyhow::Result<iroh_gossip::proto::HyparviewConfig> {
+        let mut config = iroh_gossip::proto::HyparviewConfig::default();
+        if let Some(fanout) = self.gossip_fanout {
+            anyhow::ensure!(fanout > 0, "gossip fanout must be at least 1");
+            config.active_view_capacity = fanout as usize;
+        }
+        if let Some(interval) = self.gossip_shuffle_interval {
+            anyhow::ensure!(
+                !interval.is_zero(),
+                "gossip shuffle interval must not be zero"
+            );
+            config.shuffle_interval = interval;
+        }
+        Ok(config)
+    }
+}
+
+/// Re-run reconciliation of all documents with live sync enabled every `interval`.
+pub(crate) fn spawn_periodic_sync(
+    engine: DocsEngine,
+    interval: Duration,
+    maintenance: Arc<Maintenance>,
+) -> AbortOnDropHandle<()> {
+    spawn_doc_maintenance(
+        engine,
+        interval,
+        maintenance,
+        "periodic sync",
+        |_, doc| async move { resync(&doc).await },
+    )
+}
+
+/// Reconcile `doc` with its known peers, if live sync is enabled for it.
+async fn resync(doc: &MaintainedDoc) -> anyhow::Result<()> {
+    if !doc.status().await?.sync {
+        return Ok(());
+    }
+    let peers = doc
+        .get_sync_peers()
+        .await?
+        .unwrap_or_default()
+        .into_iter()
+        .filter_map(|peer| iroh::NodeId::from_bytes(&peer).ok())
+        .map(iroh::NodeAddr::new)
+        .collect::<Vec<_>>();
+    if peers.is_empty() {
+        return Ok(());
+    }
+    doc.start_sync(peers).await?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use std::str::FromStr;
+
+    use super::*;
+    use crate::test_utils::local_options;
+
+    #[test]
+    fn test_membership_config() {
+        let default = iroh_gossip::proto::HyparviewConfig::default();
+        let config = SyncTuning::default().membership_config().unwrap();
+        assert_eq!(config.active_view_capacity, default.active_view_capacity);
+        assert_eq!(config.shuffle_interval, default.shuffle_interval);
+
+        let tuning = SyncTuning {
+            sync_interval: None,
+            gossip_fanout: Some(2),
+            gossip_shuffle_interval: Some(Duration::from_secs(600)),
+        };
+        let config = tuning.membership_config().unwrap();
+        assert_eq!(config.active_view_capacity, 2);
+        assert_eq!(config.shuffle_interval, Duration::from_secs(600));
+
+        let tuning = SyncTuning {
+            gossip_fanout: Some(0),
+            ..Default::default()
+        };
+        assert!(tuning.membership_config().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_periodic_sync() {
+        let options = |sync_interval| crate::NodeOptions {
+            sync_tuning: Some(SyncTuning {
+                sync_interval,
+                gossip_fanout: Some(2),
+                ..Default::default()
+            }),
+            ..local_options()
+        };
+        let alice = crate::Iroh::memory_with_options(options(Some(Duration::from_secs(1))))
+            .await
+            .unwrap();
+        let bob = crate::Iroh::memory_with_options(options(None))
+            .await
+            .unwrap();
+        let doc = alice.docs().create().await.unwrap();
+        doc.start_sync(Vec::new()).await.unwrap();
+        let ticket = doc
+            .share(
+                crate::ShareMode::Write,
+                crate::AddrInfoOptions::RelayAndAddresses,
+            )
+            .await
+            .unwrap();
+        let bob_doc = bob.docs().join(&ticket).await.unwrap();
+        let namespace = bob_doc.inner.id();
+
+        // An entry bob inserts as if it was synced is not announced through gossip, alice only
+        // gets it by reconciling with bob again.
+        let ticket = iroh_docs::DocTicket::from_str(&ticket.to_string()).unwrap();
+        let iroh_docs::Capability::Write(secret) = ticket.capability else {
+            panic!("write ticket without secret");
+        };
+        let author = iroh_docs::Author::from_bytes(&[7u8; 32]);
+        let content = b"unannounced";
+        let record =
+            iroh_docs::Record::new_current(iroh_blobs::Hash::new(content), content.len() as u64);
+        let entry = iroh_docs::SignedEntry::from_parts(&secret, &author, b"key", record);
+        let engine = bob.docs_engine.clone().unwrap();
+        assert_eq!(
+            engine.insert_signed(namespace, vec![entry]).await.unwrap(),
+            1
+        );
+
+        let author_id = Arc::new(crate::AuthorId(author.id()));
+        let mut synced = false;
+        for _ in 0..100 {
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            let entry = doc
+                .get_exact(author_id.clone(), b"key".to_vec(), false)
+                .await
+                .unwrap();
+            if entry.is_some() {
+                synced = true;
+                break;
+            }
+        }
+        assert!(synced);
+    }
+}
@@ -1,6 +1,8 @@
 use std::sync::Arc;
 
-use crate::{BlobFormat, Hash, Iroh, IrohError, TagsClient};
+use crate::{
+    serve_policy::ServeFilter, tag_index::TagIndexes, BlobFormat, Hash, Iroh, IrohError, TagsClient,
+};
 use bytes::Bytes;
 use futures::TryStreamExt;
 
@@ -29,6 +31,8 @@ impl From<iroh_blobs::rpc::client::tags::TagInfo> for TagInfo {
 #[derive(uniffi::Object)]
 pub struct Tags {
     client: TagsClient,
+    tag_indexes: Arc<TagIndexes>,
+    serve: Arc<ServeFilter>,
 }
 
 #[uniffi::export]
@@ -37,6 +41,8 @@ impl Iroh {
     pub fn tags(&self) -> Tags {
         Tags {
             client: self.tags_client.clone(),
+            tag_indexes: self.tag_indexes.clone(),
+            serve: self.serve.clone(),
         }
     }
 }
@@ -59,11 +65,96 @@ impl Tags {
         Ok(tags)
     }
 
+    /// List the tags whose name starts with `prefix`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_by_prefix(&self, prefix: Vec<u8>) -> Result<Vec<TagInfo>, IrohError> {
+        let tags = self
+            .client
+            .list()
+            .await?
+            .try_filter(|tag| futures::future::ready(tag.name.0.starts_with(&prefix)))
+            .map_ok(|l| l.into())
+            .try_collect::<Vec<_>>()
+            .await?;
+        Ok(tags)
+    }
+
+    /// Delete the tags whose name starts with `prefix`, returning how many were deleted.
+    ///
+    /// The blobs of the tags are removed by the next garbage collection, unless other tags or
+    /// documents still refer to them.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn delete_by_prefix(&self, prefix: Vec<u8>) -> Result<u64, IrohError> {
+        let tags = self.list_by_prefix(prefix).await?;
+        for tag in &tags {
+            let tag = iroh_blobs::Tag(Bytes::from(tag.name.clone()));
+            self.client.delete(tag.clone()).await?;
+            self.tag_indexes.forget(&tag).await;
+        }
+        self.serve.tags_changed();
+        Ok(tags.len() as u64)
+    }
+
     /// Delete a tag
     #[uniffi::method(async_runtime = "tokio")]
     pub async fn delete(&self, name: Vec<u8>) -> Result<(), IrohError> {
         let tag = iroh_blobs::Tag(Bytes::from(name));
-        self.client.delete(tag).await?;
+        self.client.delete(tag.clone()).await?;
+        self.tag_indexes.forget(&tag).await;
+        self.serve.tags_changed();
         Ok(())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::SetTagOption;
+
+    #[tokio::test]
+    async fn test_tags_by_prefix() {
+        let node = Iroh::memory().await.unwrap();
+        let blobs = node.blobs();
+        let named = |prefix: &[u8]| match SetTagOption::with_prefix(prefix.to_vec()) {
+            SetTagOption::Named(name) => name,
+            SetTagOption::Auto => unreachable!(),
+        };
+        let first = named(b"thumbnails/");
+        assert!(first.starts_with(b"thumbnails/"));
+        assert_ne!(first, named(b"thumbnails/"));
+
+        for (data, prefix) in [
+            ("a", "thumbnails/"),
+            ("b", "thumbnails/"),
+            ("c", "backups/"),
+        ] {
+            let tag = String::from_utf8(named(prefix.as_bytes())).unwrap();
+            blobs.add_bytes_named(data.into(), tag).await.unwrap();
+        }
+        let tags = node.tags();
+        let thumbnails = tags.list_by_prefix(b"thumbnails/".to_vec()).await.unwrap();
+        assert_eq!(thumbnails.len(), 2);
+        assert!(thumbnails
+            .iter()
+            .all(|tag| tag.name.starts_with(b"thumbnails/")));
+
+        assert_eq!(
+            tags.delete_by_prefix(b"thumbnails/".to_vec())
+                .await
+                .unwrap(),
+            2
+        );
+        assert!(tags
+            .list_by_prefix(b"thumbnails/".to_vec())
+            .await
+            .unwrap()
+            .is_empty());
+        assert_eq!(
+            tags.list_by_prefix(b"backups/".to_vec())
+                .await
+                .unwrap()
+                .len(),
+            1
+        );
+    }
+}
@@ -0,0 +1,121 @@
+use std::collections::HashMap;
+
+use futures::TryStreamExt;
+
+use crate::TagsClient;
+
+/// Prefix of the tags of blob metadata, see [`Blobs::set_metadata`](crate::Blobs::set_metadata).
+pub(crate) const METADATA_TAG_PREFIX: &str = "iroh-ffi/meta/";
+
+/// Prefix of the tags recording which docs and blobs belong to a tenant, see
+/// [`ScopedClient`](crate::ScopedClient).
+pub(crate) const TENANT_TAG_PREFIX: &str = "iroh-ffi/tenant/";
+
+/// The tags of a node below a prefix, by name, mapped to the hash they refer to.
+///
+/// The tag client can only list all tags, so they are listed once when the index is first
+/// used. Afterwards the calls that set or delete tags below the prefix keep it up to date.
+#[derive(Debug)]
+pub(crate) struct TagIndex {
+    prefix: &'static str,
+    tags: tokio::sync::Mutex<Option<HashMap<iroh_blobs::Tag, iroh_blobs::Hash>>>,
+}
+
+impl TagIndex {
+    fn new(prefix: &'static str) -> Self {
+        TagIndex {
+            prefix,
+            tags: Default::default(),
+        }
+    }
+
+    /// The hash the tag `name` refers to, if it exists.
+    pub(crate) async fn get(
+        &self,
+        client: &TagsClient,
+        name: &iroh_blobs::Tag,
+    ) -> anyhow::Result<Option<iroh_blobs::Hash>> {
+        let mut tags = self.tags.lock().await;
+        let tags = self.load(&mut tags, client).await?;
+        Ok(tags.get(name).copied())
+    }
+
+    /// All tags whose name starts with `prefix`, which has to start with the prefix of the
+    /// index.
+    pub(crate) async fn list(
+        &self,
+        client: &TagsClient,
+        prefix: &str,
+    ) -> anyhow::Result<Vec<(iroh_blobs::Tag, iroh_blobs::Hash)>> {
+        debug_assert!(prefix.starts_with(self.prefix));
+        let mut tags = self.tags.lock().await;
+        let tags = self.load(&mut tags, client).await?;
+        Ok(tags
+            .iter()
+            .filter(|(name, _)| name.0.starts_with(prefix.as_bytes()))
+            .map(|(name, hash)| (name.clone(), *hash))
+            .collect())
+    }
+
+    /// Record that the tag `name` was set to `hash`.
+    pub(crate) async fn set(&self, name: iroh_blobs::Tag, hash: iroh_blobs::Hash) {
+        if let Some(tags) = self.tags.lock().await.as_mut() {
+            tags.insert(name, hash);
+        }
+    }
+
+    /// Record that the tag `name` was deleted.
+    pub(crate) async fn forget(&self, name: &iroh_blobs::Tag) {
+        if let Some(tags) = self.tags.lock().await.as_mut() {
+            tags.remove(name);
+        }
+    }
+
+    async fn load<'a>(
+        &self,
+        tags: &'a mut Option<HashMap<iroh_blobs::Tag, iroh_blobs::Hash>>,
+        client: &TagsClient,
+    ) -> anyhow::Result<&'a HashMap<iroh_blobs::Tag, iroh_blobs::Hash>> {
+        if tags.is_none() {
+            let prefix = self.prefix.as_bytes();
+            let loaded = client
+                .list()
+                .await?
+                .try_filter(|tag| futures::future::ready(tag.name.0.starts_with(prefix)))
+                .map_ok(|tag| (tag.name, tag.hash))
+                .try_collect()
+                .await?;
+            *tags = Some(loaded);
+        }
+        Ok(tags.as_ref().expect("just loaded"))
+    }
+}
+
+/// The tag indexes of a node.
+#[derive(Debug)]
+pub(crate) struct TagIndexes {
+    /// The tags of blob metadata.
+    pub(crate) metadata: TagIndex,
+    /// The tags recording the docs and blobs of tenants.
+    pub(crate) tenants: TagIndex,
+}
+
+impl Default for TagIndexes {
+    fn default() -> Self {
+        TagIndexes {
+            metadata: TagIndex::new(METADATA_TAG_PREFIX),
+            tenants: TagIndex::new(TENANT_TAG_PREFIX),
+        }
+    }
+}
+
+impl TagIndexes {
+    /// Record that the tag `name` was deleted, in whichever index it belongs to.
+    pub(crate) async fn forget(&self, name: &iroh_blobs::Tag) {
+        for index in [&self.metadata, &self.tenants] {
+            if name.0.starts_with(index.prefix.as_bytes()) {
+                index.forget(name).await;
+            }
+        }
+    }
+}
@@ -0,0 +1,355 @@
+use std::{
+    collections::HashMap,
+    str::FromStr,
+    sync::{Arc, Mutex, OnceLock},
+};
+
+use crate::{
+    tag_index::TENANT_TAG_PREFIX, BlobAddOutcome, Doc, DocTicket, Hash, Iroh, IrohError,
+    NamespaceAndCapability,
+};
+
+static TENANT_LOCKS: OnceLock<Mutex<HashMap<String, Arc<tokio::sync::Mutex<()>>>>> =
+    OnceLock::new();
+
+/// Serializes the quota checked operations of a tenant, across all its clients.
+fn tenant_lock(tenant_id: &str) -> Arc<tokio::sync::Mutex<()>> {
+    let mut locks = TENANT_LOCKS
+        .get_or_init(Default::default)
+        .lock()
+        .expect("poisoned");
+    locks.entry(tenant_id.to_string()).or_default().clone()
+}
+
+/// Limits for the data a single tenant can store on a node.
+///
+/// There is no limit for the size of the data: the documents of a tenant are handed out as
+/// regular [`Doc`]s, so their content can not be accounted to the tenant.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct TenantQuota {
+    /// Maximum number of documents. Unlimited if not set.
+    #[uniffi(default = None)]
+    pub max_docs: Option<u64>,
+}
+
+/// The data a tenant currently stores, see [`ScopedClient::usage`].
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct TenantUsage {
+    /// Number of documents.
+    pub docs: u64,
+    /// Number of blobs.
+    pub blobs: u64,
+    /// Total size of the blobs in bytes.
+    pub blob_bytes: u64,
+}
+
+/// A view of a node restricted to the docs and blobs of a single tenant.
+///
+/// Membership is recorded in tags named `iroh-ffi/tenant/<tenant id>/...`, so it survives
+/// restarts of persistent nodes. The tenant blob tags also protect the blobs from garbage
+/// collection. Every method only acts on the docs and blobs of the tenant, but the returned
+/// [`Doc`]s are not restricted, and the unscoped clients of the node still see all data.
+#[derive(uniffi::Object)]
+pub struct ScopedClient {
+    node: Iroh,
+    tenant_id: String,
+    quota: TenantQuota,
+}
+
+#[uniffi::export]
+impl Iroh {
+    /// Get a client for the docs and blobs of the tenant `tenant_id`, enforcing `quota`.
+    ///
+    /// Tenant ids must not be empty and must not contain `/`.
+    pub fn scoped_client(
+        &self,
+        tenant_id: String,
+        quota: TenantQuota,
+    ) -> Result<Arc<ScopedClient>, IrohError> {
+        if tenant_id.is_empty() || tenant_id.contains('/') {
+            return Err(anyhow::anyhow!("invalid tenant id {tenant_id:?}").into());
+        }
+        Ok(Arc::new(ScopedClient {
+            node: self.clone(),
+            tenant_id,
+            quota,
+        }))
+    }
+}
+
+#[uniffi::export]
+impl ScopedClient {
+    /// The id of the tenant.
+    pub fn tenant_id(&self) -> String {
+        self.tenant_id.clone()
+    }
+
+    /// The quota enforced for the tenant.
+    pub fn quota(&self) -> TenantQuota {
+        self.quota.clone()
+    }
+
+    /// Get the amount of data the tenant stores.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn usage(&self) -> Result<TenantUsage, IrohError> {
+        let members = self.members().await?;
+        Ok(TenantUsage {
+            docs: members.docs.len() as u64,
+            blobs: members.blobs.len() as u64,
+            blob_bytes: self.blob_bytes(&members).await?,
+        })
+    }
+
+    /// Create a new doc owned by the tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn create_doc(&self) -> Result<Arc<Doc>, IrohError> {
+        let lock = tenant_lock(&self.tenant_id);
+        let _guard = lock.lock().await;
+        self.check_doc_quota().await?;
+        let doc = self.node.docs().create().await?;
+        self.add_doc(doc.inner.id()).await?;
+        Ok(doc)
+    }
+
+    /// Join an existing document and add it to the docs of the tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn join_doc(&self, ticket: &DocTicket) -> Result<Arc<Doc>, IrohError> {
+        let lock = tenant_lock(&self.tenant_id);
+        let _guard = lock.lock().await;
+        let namespace = iroh_docs::DocTicket::from(ticket.clone()).capability.id();
+        if !self.members().await?.docs.contains(&namespace) {
+            self.check_doc_quota().await?;
+        }
+        let doc = self.node.docs().join(ticket).await?;
+        self.add_doc(namespace).await?;
+        Ok(doc)
+    }
+
+    /// List the docs of the tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_docs(&self) -> Result<Vec<NamespaceAndCapability>, IrohError> {
+        let members = self.members().await?;
+        let docs = self
+            .node
+            .docs()
+            .list()
+            .await?
+            .into_iter()
+            .filter(|doc| {
+                iroh_docs::NamespaceId::from_str(&doc.namespace)
+                    .is_ok_and(|id| members.docs.contains(&id))
+            })
+            .collect();
+        Ok(docs)
+    }
+
+    /// Get a doc of the tenant.
+    ///
+    /// Returns None if the document does not exist or belongs to another tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn open_doc(&self, id: String) -> Result<Option<Arc<Doc>>, IrohError> {
+        let namespace = iroh_docs::NamespaceId::from_str(&id)?;
+        if !self.members().await?.docs.contains(&namespace) {
+            return Ok(None);
+        }
+        self.node.docs().open(id).await
+    }
+
+    /// Delete a doc of the tenant from the node.
+    ///
+    /// Fails if the document belongs to another tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn drop_doc(&self, id: String) -> Result<(), IrohError> {
+        let namespace = iroh_docs::NamespaceId::from_str(&id)?;
+        if !self.members().await?.docs.contains(&namespace) {
+            return Err(anyhow::anyhow!("document {id} does not belong to this tenant").into());
+        }
+        self.node.docs().drop_doc(id).await?;
+        self.delete_tag(self.doc_tag(&namespace)).await?;
+        Ok(())
+    }
+
+    /// Add a blob for the tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn add_bytes(&self, bytes: Vec<u8>) -> Result<BlobAddOutcome, IrohError> {
+        let name = self.blob_tag(&iroh_blobs::Hash::new(&bytes));
+        let res = self
+            .node
+            .blobs_client
+            .add_bytes_named(bytes, name.clone())
+            .await?;
+        self.index().set(name, res.hash).await;
+        Ok(res.into())
+    }
+
+    /// Read a blob of the tenant.
+    ///
+    /// Fails if the blob was not added by this tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn read_to_bytes(&self, hash: Arc<Hash>) -> Result<Vec<u8>, IrohError> {
+        if !self.members().await?.blobs.contains(&hash.0) {
+            return Err(anyhow::anyhow!("blob {} does not belong to this tenant", hash.0).into());
+        }
+        self.node.blobs().read_to_bytes(hash).await
+    }
+
+    /// List the blobs of the tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn list_blobs(&self) -> Result<Vec<Arc<Hash>>, IrohError> {
+        let members = self.members().await?;
+        Ok(members
+            .blobs
+            .into_iter()
+            .map(|hash| Arc::new(Hash(hash)))
+            .collect())
+    }
+
+    /// Remove a blob from the tenant.
+    ///
+    /// The content is deleted by garbage collection once nothing else references it. Fails if
+    /// the blob was not added by this tenant.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn delete_blob(&self, hash: Arc<Hash>) -> Result<(), IrohError> {
+        if !self.members().await?.blobs.contains(&hash.0) {
+            return Err(anyhow::anyhow!("blob {} does not belong to this tenant", hash.0).into());
+        }
+        self.delete_tag(self.blob_tag(&hash.0)).await?;
+        Ok(())
+    }
+}
+
+/// The docs and blobs recorded for a tenant.
+#[derive(Debug, Default)]
+struct Members {
+    docs: Vec<iroh_docs::NamespaceId>,
+    blobs: Vec<iroh_blobs::Hash>,
+}
+
+impl ScopedClient {
+    fn prefix(&self) -> String {
+        format!("{TENANT_TAG_PREFIX}{}/", self.tenant_id)
+    }
+
+    fn doc_tag(&self, namespace: &iroh_docs::NamespaceId) -> iroh_blobs::Tag {
+        iroh_blobs::Tag(format!("{}doc/{namespace}", self.prefix()).into())
+    }
+
+    fn blob_tag(&self, hash: &iroh_blobs::Hash) -> iroh_blobs::Tag {
+        iroh_blobs::Tag(format!("{}blob/{hash}", self.prefix()).into())
+    }
+
+    fn index(&self) -> &crate::tag_index::TagIndex {
+        &self.node.tag_indexes.tenants
+    }
+
+    async fn members(&self) -> anyhow::Result<Members> {
+        let prefix = self.prefix();
+        let mut members = Members::default();
+        for (name, hash) in self.index().list(&self.node.tags_client, &prefix).await? {
+            let Some(name) = std::str::from_utf8(&name.0)
+                .ok()
+                .and_then(|name| name.strip_prefix(&prefix))
+            else {
+                continue;
+            };
+            if let Some(id) = name.strip_prefix("doc/") {
+                members.docs.push(iroh_docs::NamespaceId::from_str(id)?);
+            } else if name.starts_with("blob/") {
+                members.blobs.push(hash);
+            }
+        }
+        Ok(members)
+    }
+
+    async fn delete_tag(&self, name: iroh_blobs::Tag) -> anyhow::Result<()> {
+        self.node.tags_client.delete(name.clone()).await?;
+        self.index().forget(&name).await;
+        Ok(())
+    }
+
+    async fn blob_bytes(&self, members: &Members) -> anyhow::Result<u64> {
+        let mut total = 0;
+        for hash in &members.blobs {
+            total += self.node.blobs_client.read(*hash).await?.size();
+        }
+        Ok(total)
+    }
+
+    async fn check_doc_quota(&self) -> anyhow::Result<()> {
+        if let Some(max) = self.quota.max_docs {
+            if self.members().await?.docs.len() as u64 >= max {
+                anyhow::bail!("doc quota of {max} exceeded for tenant {}", self.tenant_id);
+            }
+        }
+        Ok(())
+    }
+
+    /// Record `namespace` as a doc of the tenant.
+    ///
+    /// The tag refers to a hash made of the namespace id, no blob is stored for it.
+    async fn add_doc(&self, namespace: iroh_docs::NamespaceId) -> anyhow::Result<()> {
+        let hash = iroh_blobs::Hash::from_bytes(*namespace.as_bytes());
+        let name = self.doc_tag(&namespace);
+        let batch = self.node.blobs_client.batch().await?;
+        let temp_tag = batch.temp_tag(iroh_blobs::HashAndFormat::raw(hash)).await?;
+        batch.persist_to(temp_tag, name.clone()).await?;
+        self.index().set(name, hash).await;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::temp_docs_node;
+
+    #[tokio::test]
+    async fn test_scoped_client() {
+        let (_dir, node) = temp_docs_node().await;
+
+        assert!(node
+            .scoped_client("a/b".to_string(), Default::default())
+            .is_err());
+        let quota = TenantQuota { max_docs: Some(1) };
+        let alice = node.scoped_client("alice".to_string(), quota).unwrap();
+        let bob = node
+            .scoped_client("bob".to_string(), Default::default())
+            .unwrap();
+
+        let doc = alice.create_doc().await.unwrap();
+        assert!(alice.create_doc().await.is_err());
+        let bob_doc = bob.create_doc().await.unwrap();
+
+        let docs = alice.list_docs().await.unwrap();
+        assert_eq!(docs.len(), 1);
+        assert_eq!(docs[0].namespace, doc.id());
+        assert!(alice.open_doc(bob_doc.id()).await.unwrap().is_none());
+        assert!(alice.drop_doc(bob_doc.id()).await.is_err());
+
+        let outcome = alice.add_bytes(b"hello".to_vec()).await.unwrap();
+        // adding the same content again does not add another blob
+        alice.add_bytes(b"hello".to_vec()).await.unwrap();
+        assert!(bob.read_to_bytes(outcome.hash.clone()).await.is_err());
+        assert!(bob.delete_blob(outcome.hash.clone()).await.is_err());
+        assert_eq!(
+            alice.read_to_bytes(outcome.hash.clone()).await.unwrap(),
+            b"hello".to_vec()
+        );
+
+        let usage = alice.usage().await.unwrap();
+        assert_eq!(
+            usage,
+            TenantUsage {
+                docs: 1,
+                blobs: 1,
+                blob_bytes: 5,
+            }
+        );
+
+        alice.delete_blob(outcome.hash).await.unwrap();
+        alice.drop_doc(doc.id()).await.unwrap();
+        assert_eq!(alice.usage().await.unwrap().docs, 0);
+        assert!(alice.list_blobs().await.unwrap().is_empty());
+        assert_eq!(bob.list_docs().await.unwrap().len(), 1);
+    }
+}
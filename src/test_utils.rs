@@ -0,0 +1,145 @@
+//! Setup and callbacks shared by the tests of the crate.
+
+use std::{path::Path, sync::Arc};
+
+use tokio::sync::mpsc;
+
+use crate::{
+    AddCallback, AddProgress, CallbackError, DocManagerCallback, DownloadCallback,
+    DownloadProgress, InventoryCallback, Iroh, LiveEvent, LogCallback, LogEntry,
+    NodeDiscoveryConfig, NodeEvent, NodeEventCallback, NodeOptions, ProvideEvent,
+    ProvideEventCallback, StartupCallback, StartupProgress, SubscribeCallback,
+};
+
+/// Options of a node with docs that only dials the addresses it is given, without relays or
+/// discovery, so tests with several nodes do not depend on the network.
+pub(crate) fn local_options() -> NodeOptions {
+    NodeOptions {
+        enable_docs: true,
+        relay_urls: Some(vec![]),
+        node_discovery: Some(NodeDiscoveryConfig::None),
+        ..Default::default()
+    }
+}
+
+/// An in memory node with docs and [`local_options`].
+pub(crate) async fn local_node() -> Iroh {
+    Iroh::memory_with_options(local_options()).await.unwrap()
+}
+
+/// A node with `options` persisted at `path`, which can be started again on the same path.
+pub(crate) async fn persistent_node(path: &Path, options: NodeOptions) -> Iroh {
+    let path = path.to_string_lossy().into_owned();
+    Iroh::persistent_with_options(path, options).await.unwrap()
+}
+
+/// A node with docs persisted in a new temporary directory, which is removed once the
+/// returned handle is dropped.
+pub(crate) async fn temp_docs_node() -> (tempfile::TempDir, Iroh) {
+    let dir = tempfile::tempdir().unwrap();
+    let node = persistent_node(dir.path(), local_options()).await;
+    (dir, node)
+}
+
+/// Ignores the progress of a download.
+pub(crate) struct NoProgress;
+
+#[async_trait::async_trait]
+impl DownloadCallback for NoProgress {
+    async fn progress(&self, _progress: Arc<DownloadProgress>) -> Result<(), CallbackError> {
+        Ok(())
+    }
+}
+
+/// Collects what a callback is called with.
+pub(crate) struct Collect<T>(pub(crate) std::sync::Mutex<Vec<T>>);
+
+impl<T> Default for Collect<T> {
+    fn default() -> Self {
+        Collect(Default::default())
+    }
+}
+
+impl<T: Clone> Collect<T> {
+    /// Everything collected so far.
+    pub(crate) fn items(&self) -> Vec<T> {
+        self.0.lock().unwrap().clone()
+    }
+
+    fn push(&self, item: T) -> Result<(), CallbackError> {
+        self.0.lock().unwrap().push(item);
+        Ok(())
+    }
+}
+
+#[async_trait::async_trait]
+impl DownloadCallback for Collect<Arc<DownloadProgress>> {
+    async fn progress(&self, progress: Arc<DownloadProgress>) -> Result<(), CallbackError> {
+        self.push(progress)
+    }
+}
+
+#[async_trait::async_trait]
+impl AddCallback for Collect<Arc<AddProgress>> {
+    async fn progress(&self, progress: Arc<AddProgress>) -> Result<(), CallbackError> {
+        self.push(progress)
+    }
+}
+
+#[async_trait::async_trait]
+impl SubscribeCallback for Collect<Arc<LiveEvent>> {
+    async fn event(&self, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+        self.push(event)
+    }
+}
+
+#[async_trait::async_trait]
+impl DocManagerCallback for Collect<(String, Arc<LiveEvent>)> {
+    async fn event(&self, doc_id: String, event: Arc<LiveEvent>) -> Result<(), CallbackError> {
+        self.push((doc_id, event))
+    }
+}
+
+#[async_trait::async_trait]
+impl StartupCallback for Collect<StartupProgress> {
+    async fn progress(&self, progress: StartupProgress) -> Result<(), CallbackError> {
+        self.push(progress)
+    }
+}
+
+#[async_trait::async_trait]
+impl InventoryCallback for Collect<Vec<u8>> {
+    async fn write(&self, line: Vec<u8>) -> Result<(), CallbackError> {
+        self.push(line)
+    }
+}
+
+/// Sends what a callback is called with to a channel, to wait for it.
+pub(crate) struct Forward<T>(pub(crate) mpsc::Sender<T>);
+
+impl<T> Forward<T> {
+    async fn send(&self, item: T) -> Result<(), CallbackError> {
+        self.0.send(item).await.map_err(|_| CallbackError::Error)
+    }
+}
+
+#[async_trait::async_trait]
+impl LogCallback for Forward<LogEntry> {
+    async fn entry(&self, entry: LogEntry) -> Result<(), CallbackError> {
+        self.send(entry).await
+    }
+}
+
+#[async_trait::async_trait]
+impl NodeEventCallback for Forward<Arc<NodeEvent>> {
+    async fn event(&self, event: Arc<NodeEvent>) -> Result<(), CallbackError> {
+        self.send(event).await
+    }
+}
+
+#[async_trait::async_trait]
+impl ProvideEventCallback for Forward<ProvideEvent> {
+    async fn event(&self, event: ProvideEvent) -> Result<(), CallbackError> {
+        self.send(event).await
+    }
+}
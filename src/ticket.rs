@@ -4,6 +4,7 @@ use std::sync::Arc;
 use crate::blob::{BlobDownloadOptions, BlobFormat, Hash};
 use crate::doc::NodeAddr;
 use crate::error::IrohError;
+use crate::key::PublicKey;
 
 /// A token containing information for establishing a connection to a node.
 ///
@@ -115,7 +116,7 @@ impl BlobTicket {
 }
 
 /// Options when creating a ticket
-#[derive(Debug, uniffi::Enum)]
+#[derive(Debug, serde::Serialize, serde::Deserialize, uniffi::Enum)]
 pub enum AddrInfoOptions {
     /// Only the Node ID is added.
     ///
@@ -129,6 +130,8 @@ pub enum AddrInfoOptions {
     Addresses,
 }
 
+crate::display_via_debug!(AddrInfoOptions);
+
 impl From<AddrInfoOptions> for iroh_docs::rpc::AddrInfoOptions {
     fn from(options: AddrInfoOptions) -> iroh_docs::rpc::AddrInfoOptions {
         match options {
@@ -173,3 +176,356 @@ impl std::fmt::Display for DocTicket {
         write!(f, "{}", self.0)
     }
 }
+
+/// The scheme of iroh links.
+const IROH_URI_SCHEME: &str = "iroh://";
+
+/// What an [`IrohUri`] links to.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, serde::Serialize, serde::Deserialize, uniffi::Enum)]
+pub enum IrohUriType {
+    /// A blob or collection, see `IrohUri.hash`.
+    Blob,
+    /// A document, see `IrohUri.doc_ticket`.
+    Doc,
+    /// A node, see `IrohUri.node_id`.
+    Node,
+}
+
+crate::display_via_debug!(IrohUriType);
+
+#[derive(Debug, Clone)]
+pub(crate) enum UriTarget {
+    Blob {
+        hash: iroh_blobs::Hash,
+        format: iroh_blobs::BlobFormat,
+        ticket: Option<iroh_blobs::ticket::BlobTicket>,
+    },
+    Doc(iroh_docs::DocTicket),
+    Node {
+        node_id: iroh::NodeId,
+        ticket: Option<iroh_base::ticket::NodeTicket>,
+    },
+}
+
+/// An `iroh://` link to a blob, document or node.
+///
+/// Links have the form `iroh://blob/<hash or blob ticket>`, `iroh://doc/<doc ticket>` or
+/// `iroh://node/<node id or node ticket>`. A blob hash can be followed by `?format=hashseq` for
+/// collections. The string form of a link is built with `to_string`.
+#[derive(Debug, Clone, uniffi::Object)]
+#[uniffi::export(Display)]
+pub struct IrohUri(UriTarget);
+
+#[uniffi::export]
+impl IrohUri {
+    /// Parse a link, see [`parse_iroh_uri`].
+    #[uniffi::constructor]
+    pub fn parse(uri: String) -> Result<Self, IrohError> {
+        let target = parse_uri_target(uri.trim())?;
+        Ok(IrohUri(target))
+    }
+
+    /// Link to a blob by its hash, leaving it up to the application where to get it from.
+    #[uniffi::constructor]
+    pub fn from_hash(hash: &Hash, format: BlobFormat) -> Self {
+        IrohUri(UriTarget::Blob {
+            hash: hash.0,
+            format: format.into(),
+            ticket: None,
+        })
+    }
+
+    /// Link to a blob and the node providing it.
+    #[uniffi::constructor]
+    pub fn from_blob_ticket(ticket: &BlobTicket) -> Self {
+        IrohUri(UriTarget::Blob {
+            hash: ticket.0.hash(),
+            format: ticket.0.format(),
+            ticket: Some(ticket.0.clone()),
+        })
+    }
+
+    /// Link to a document.
+    #[uniffi::constructor]
+    pub fn from_doc_ticket(ticket: &DocTicket) -> Self {
+        IrohUri(UriTarget::Doc(ticket.0.clone()))
+    }
+
+    /// Link to a node by its id, to be found through discovery.
+    #[uniffi::constructor]
+    pub fn from_node_id(node_id: &PublicKey) -> Self {
+        IrohUri(UriTarget::Node {
+            node_id: node_id.into(),
+            ticket: None,
+        })
+    }
+
+    /// Link to a node and its addresses.
+    #[uniffi::constructor]
+    pub fn from_node_ticket(ticket: &NodeTicket) -> Self {
+        IrohUri(UriTarget::Node {
+            node_id: ticket.0.node_addr().node_id,
+            ticket: Some(ticket.0.clone()),
+        })
+    }
+
+    /// What this link points to.
+    pub fn r#type(&self) -> IrohUriType {
+        match self.0 {
+            UriTarget::Blob { .. } => IrohUriType::Blob,
+            UriTarget::Doc(_) => IrohUriType::Doc,
+            UriTarget::Node { .. } => IrohUriType::Node,
+        }
+    }
+
+    /// The hash of a blob link.
+    pub fn hash(&self) -> Option<Arc<Hash>> {
+        match &self.0 {
+            UriTarget::Blob { hash, .. } => Some(Arc::new((*hash).into())),
+            _ => None,
+        }
+    }
+
+    /// The format of a blob link.
+    pub fn blob_format(&self) -> Option<BlobFormat> {
+        match &self.0 {
+            UriTarget::Blob { format, .. } => Some((*format).into()),
+            _ => None,
+        }
+    }
+
+    /// The ticket of a blob link, if it names the node providing the blob.
+    pub fn blob_ticket(&self) -> Option<Arc<BlobTicket>> {
+        match &self.0 {
+            UriTarget::Blob { ticket, .. } => ticket.clone().map(|t| Arc::new(t.into())),
+            _ => None,
+        }
+    }
+
+    /// The ticket of a doc link.
+    pub fn doc_ticket(&self) -> Option<Arc<DocTicket>> {
+        match &self.0 {
+            UriTarget::Doc(ticket) => Some(Arc::new(ticket.clone().into())),
+            _ => None,
+        }
+    }
+
+    /// The id of a node link.
+    pub fn node_id(&self) -> Option<Arc<PublicKey>> {
+        match &self.0 {
+            UriTarget::Node { node_id, .. } => Some(Arc::new((*node_id).into())),
+            _ => None,
+        }
+    }
+
+    /// The ticket of a node link, if it includes the addresses of the node.
+    pub fn node_ticket(&self) -> Option<Arc<NodeTicket>> {
+        match &self.0 {
+            UriTarget::Node { ticket, .. } => ticket.clone().map(|t| Arc::new(t.into())),
+            _ => None,
+        }
+    }
+}
+
+impl std::fmt::Display for IrohUri {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        match &self.0 {
+            UriTarget::Blob {
+                ticket: Some(ticket),
+                ..
+            } => write!(f, "{IROH_URI_SCHEME}blob/{ticket}"),
+            UriTarget::Blob { hash, format, .. } => {
+                write!(f, "{IROH_URI_SCHEME}blob/{hash}")?;
+                if format.is_hash_seq() {
+                    write!(f, "?format=hashseq")?;
+                }
+                Ok(())
+            }
+            UriTarget::Doc(ticket) => write!(f, "{IROH_URI_SCHEME}doc/{ticket}"),
+            UriTarget::Node {
+                ticket: Some(ticket),
+                ..
+            } => write!(f, "{IROH_URI_SCHEME}node/{ticket}"),
+            UriTarget::Node { node_id, .. } => write!(f, "{IROH_URI_SCHEME}node/{node_id}"),
+        }
+    }
+}
+
+/// Parse an `iroh://` link, or a bare blob, doc or node ticket.
+#[uniffi::export]
+pub fn parse_iroh_uri(uri: String) -> Result<Arc<IrohUri>, IrohError> {
+    IrohUri::parse(uri).map(Arc::new)
+}
+
+/// Build the `iroh://` link to a blob, document or node.
+#[uniffi::export]
+pub fn build_iroh_uri(uri: &IrohUri) -> String {
+    uri.to_string()
+}
+
+fn strip_prefix_ignore_case<'a>(s: &'a str, prefix: &str) -> Option<&'a str> {
+    let head = s.get(..prefix.len())?;
+    head.eq_ignore_ascii_case(prefix)
+        .then(|| &s[prefix.len()..])
+}
+
+impl UriTarget {
+    /// The nodes the target can be fetched from.
+    pub(crate) fn peers(&self) -> Vec<iroh::NodeAddr> {
+        match self {
+            UriTarget::Blob { ticket, .. } => ticket
+                .iter()
+                .map(|ticket| ticket.node_addr().clone())
+                .collect(),
+            UriTarget::Doc(ticket) => ticket.nodes.clone(),
+            UriTarget::Node {
+                ticket: Some(ticket),
+                ..
+            } => vec![ticket.node_addr().clone()],
+            UriTarget::Node { node_id, .. } => vec![iroh::NodeAddr::new(*node_id)],
+        }
+    }
+
+    /// The ALPN of the protocol the target is fetched with.
+    pub(crate) fn alpn(&self) -> &'static [u8] {
+        match self {
+            UriTarget::Doc(_) => iroh_docs::ALPN,
+            UriTarget::Blob { .. } | UriTarget::Node { .. } => iroh_blobs::protocol::ALPN,
+        }
+    }
+}
+
+pub(crate) fn parse_uri_target(uri: &str) -> anyhow::Result<UriTarget> {
+    let Some(rest) = strip_prefix_ignore_case(uri, IROH_URI_SCHEME) else {
+        // bare tickets are accepted as well, as that is what users paste most often
+        return parse_bare_ticket(uri);
+    };
+    let (kind, rest) = rest
+        .split_once('/')
+        .ok_or_else(|| anyhow::anyhow!("missing target in iroh link"))?;
+    let (value, query) = match rest.split_once('?') {
+        Some((value, query)) => (value, Some(query)),
+        None => (rest.trim_end_matches('/'), None),
+    };
+    match kind.to_ascii_lowercase().as_str() {
+        "blob" => parse_blob_target(value, query),
+        "doc" => {
+            anyhow::ensure!(query.is_none(), "doc links take no options");
+            Ok(UriTarget::Doc(iroh_docs::DocTicket::from_str(value)?))
+        }
+        "node" => {
+            anyhow::ensure!(query.is_none(), "node links take no options");
+            match iroh_base::ticket::NodeTicket::from_str(value) {
+                Ok(ticket) => Ok(UriTarget::Node {
+                    node_id: ticket.node_addr().node_id,
+                    ticket: Some(ticket),
+                }),
+                Err(_) => Ok(UriTarget::Node {
+                    node_id: iroh::NodeId::from_str(value)?,
+                    ticket: None,
+                }),
+            }
+        }
+        kind => anyhow::bail!("unknown iroh link type {kind:?}"),
+    }
+}
+
+fn parse_blob_target(value: &str, query: Option<&str>) -> anyhow::Result<UriTarget> {
+    let mut format = None;
+    for pair in query.into_iter().flat_map(|q| q.split('&')) {
+        match pair.split_once('=') {
+            Some(("format", "raw")) => format = Some(iroh_blobs::BlobFormat::Raw),
+            Some(("format", "hashseq")) => format = Some(iroh_blobs::BlobFormat::HashSeq),
+            _ => anyhow::bail!("unknown blob link option {pair:?}"),
+        }
+    }
+    if let Ok(ticket) = iroh_blobs::ticket::BlobTicket::from_str(value) {
+        anyhow::ensure!(
+            format.is_none() || format == Some(ticket.format()),
+            "blob link format does not match its ticket"
+        );
+        return Ok(UriTarget::Blob {
+            hash: ticket.hash(),
+            format: ticket.format(),
+            ticket: Some(ticket),
+        });
+    }
+    Ok(UriTarget::Blob {
+        hash: iroh_blobs::Hash::from_str(value)?,
+        format: format.unwrap_or(iroh_blobs::BlobFormat::Raw),
+        ticket: None,
+    })
+}
+
+fn parse_bare_ticket(s: &str) -> anyhow::Result<UriTarget> {
+    if let Ok(ticket) = iroh_blobs::ticket::BlobTicket::from_str(s) {
+        return Ok(UriTarget::Blob {
+            hash: ticket.hash(),
+            format: ticket.format(),
+            ticket: Some(ticket),
+        });
+    }
+    if let Ok(ticket) = iroh_docs::DocTicket::from_str(s) {
+        return Ok(UriTarget::Doc(ticket));
+    }
+    if let Ok(ticket) = iroh_base::ticket::NodeTicket::from_str(s) {
+        return Ok(UriTarget::Node {
+            node_id: ticket.node_addr().node_id,
+            ticket: Some(ticket),
+        });
+    }
+    anyhow::bail!("not an iroh link or ticket")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_iroh_uri() {
+        let hash = Hash::new(b"hello".to_vec());
+        let uri = IrohUri::from_hash(&hash, BlobFormat::HashSeq);
+        let s = uri.to_string();
+        assert_eq!(s, format!("iroh://blob/{}?format=hashseq", hash.0));
+        // the scheme and link type are case insensitive
+        let parsed = parse_iroh_uri(s.replace("iroh://blob/", "IROH://Blob/")).unwrap();
+        assert_eq!(parsed.r#type(), IrohUriType::Blob);
+        assert_eq!(*parsed.hash().unwrap(), hash);
+        assert_eq!(parsed.blob_format(), Some(BlobFormat::HashSeq));
+        assert!(parsed.blob_ticket().is_none());
+
+        let node_id = iroh::SecretKey::from_bytes(&[1u8; 32]).public();
+        let addr = iroh::NodeAddr::new(node_id);
+        let ticket = BlobTicket(
+            iroh_blobs::ticket::BlobTicket::new(addr.clone(), hash.0, iroh_blobs::BlobFormat::Raw)
+                .unwrap(),
+        );
+        let uri = IrohUri::from_blob_ticket(&ticket);
+        let parsed = IrohUri::parse(uri.to_string()).unwrap();
+        assert_eq!(
+            parsed.blob_ticket().unwrap().to_string(),
+            ticket.to_string()
+        );
+        // bare tickets are links too
+        let parsed = IrohUri::parse(ticket.to_string()).unwrap();
+        assert_eq!(parsed.to_string(), uri.to_string());
+
+        let uri = IrohUri::from_node_id(&node_id.into());
+        assert_eq!(uri.to_string(), format!("iroh://node/{node_id}"));
+        let parsed = IrohUri::parse(format!("{uri}/")).unwrap();
+        assert_eq!(parsed.r#type(), IrohUriType::Node);
+        assert_eq!(*parsed.node_id().unwrap(), PublicKey::from(node_id));
+        assert!(parsed.node_ticket().is_none());
+
+        let ticket = NodeTicket(iroh_base::ticket::NodeTicket::new(addr));
+        let parsed = IrohUri::parse(IrohUri::from_node_ticket(&ticket).to_string()).unwrap();
+        assert_eq!(
+            parsed.node_ticket().unwrap().to_string(),
+            ticket.to_string()
+        );
+
+        assert!(IrohUri::parse("iroh://tag/foo".to_string()).is_err());
+        assert!(IrohUri::parse(format!("iroh://blob/{}?format=zip", hash.0)).is_err());
+        assert!(IrohUri::parse("https://iroh.computer".to_string()).is_err());
+    }
+}
@@ -0,0 +1,483 @@
+use std::{
+    collections::{HashMap, HashSet},
+    sync::Arc,
+    time::{Duration, SystemTime},
+};
+
+use futures::TryStreamExt;
+use iroh_blobs::rpc::client::blobs::BlobStatus;
+use serde::{Deserialize, Serialize};
+use tokio_util::task::AbortOnDropHandle;
+use tracing::{debug, warn};
+
+use crate::{
+    doc::{DocsEngine, MemConnector},
+    maintenance::{spawn_doc_maintenance, Maintenance},
+    Doc, IrohError,
+};
+
+/// Prefix of the tags of the journals of documents that are rebuilt, which also protect the
+/// content of the documents from garbage collection.
+const PURGE_TAG_PREFIX: &str = "iroh-ffi/purge/";
+
+/// Automatic removal of old deletion markers, see `Doc.purge_tombstones`.
+#[derive(Debug, Clone, PartialEq, Eq, uniffi::Record)]
+pub struct TombstonePurgePolicy {
+    /// Only tombstones older than this are removed.
+    ///
+    /// Must be longer than the time any peer may stay offline, see `Doc.purge_tombstones`.
+    pub older_than: Duration,
+    /// How often all documents are checked.
+    pub interval: Duration,
+}
+
+/// The outcome of purging the tombstones of a document.
+#[derive(Debug, Clone, Default, PartialEq, Eq, uniffi::Record)]
+pub struct TombstonePurgeReport {
+    /// Number of entries in the document, including tombstones.
+    pub entries: u64,
+    /// Number of tombstones in the document.
+    pub tombstones: u64,
+    /// Number of tombstones that were removed.
+    pub purged: u64,
+}
+
+#[uniffi::export]
+impl Doc {
+    /// Remove the tombstones older than `older_than` from this document.
+    ///
+    /// Deleting a key or prefix leaves an empty entry, a tombstone, that tells peers the
+    /// entries are gone. Tombstones are kept forever, so keys that are written and deleted
+    /// over and over use up more and more space. Once a tombstone is removed, peers that have
+    /// not seen it yet can sync the deleted entries back, so `older_than` must be longer than
+    /// the time any peer may stay offline.
+    ///
+    /// The document is rebuilt without the tombstones, which requires this to be the only
+    /// open handle to it. Live sync is stopped while it is rebuilt and restarted with the same
+    /// peers afterwards, event subscriptions end as if the document was closed. If the node
+    /// stops during the rebuild, the rebuild is finished when it starts again.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn purge_tombstones(
+        &self,
+        older_than: Duration,
+    ) -> Result<TombstonePurgeReport, IrohError> {
+        self.ensure_open()?;
+        let report = purge_tombstones(&self.engine, &self.inner, older_than).await?;
+        Ok(report)
+    }
+}
+
+/// Rebuild the document behind `doc` without the tombstones older than `older_than`.
+pub(crate) async fn purge_tombstones(
+    engine: &DocsEngine,
+    doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    older_than: Duration,
+) -> anyhow::Result<TombstonePurgeReport> {
+    let namespace = doc.id();
+    let cutoff = SystemTime::now()
+        .checked_sub(older_than)
+        .and_then(|t| t.duration_since(SystemTime::UNIX_EPOCH).ok())
+        .map(|t| u64::try_from(t.as_micros()).unwrap_or(u64::MAX))
+        .unwrap_or(0);
+
+    // keep local writes out while the document is rebuilt
+    let state = engine.namespaces.get(namespace);
+    let _guard = state.lock.write().await;
+
+    let (report, _) = partition(doc, cutoff).await?;
+    if report.purged == 0 {
+        return Ok(report);
+    }
+
+    let status = doc.status().await?;
+    anyhow::ensure!(
+        status.handles <= 1,
+        "document is open {} times, close the other handles before purging",
+        status.handles
+    );
+    let capability = match doc
+        .share(
+            iroh_docs::rpc::client::docs::ShareMode::Write,
+            iroh_docs::rpc::AddrInfoOptions::Id,
+        )
+        .await
+    {
+        Ok(ticket) => ticket.capability,
+        Err(_) => {
+            doc.share(
+                iroh_docs::rpc::client::docs::ShareMode::Read,
+                iroh_docs::rpc::AddrInfoOptions::Id,
+            )
+            .await?
+            .capability
+        }
+    };
+    let peers = doc.get_sync_peers().await?.unwrap_or_default();
+    let policy = doc.get_download_policy().await?;
+
+    // Stop sync first, so no entries arrive after they are read. Reading them again picks up
+    // the ones that arrived in the meantime.
+    if status.sync {
+        doc.leave().await?;
+    }
+    let prepared = async {
+        let (report, keep) = partition(doc, cutoff).await?;
+        let mut statuses = HashMap::new();
+        for entry in &keep {
+            let hash = entry.content_hash();
+            if !statuses.contains_key(&hash) {
+                let status = match engine.blobs.status(hash).await? {
+                    BlobStatus::Complete { .. } => iroh_docs::ContentStatus::Complete,
+                    BlobStatus::Partial { .. } => iroh_docs::ContentStatus::Incomplete,
+                    BlobStatus::NotFound => iroh_docs::ContentStatus::Missing,
+                };
+                statuses.insert(hash, status);
+            }
+        }
+        let entries = keep
+            .into_iter()
+            .map(|entry| {
+                let status = statuses[&entry.content_hash()];
+                (entry, status)
+            })
+            .collect();
+        let journal = RebuildJournal {
+            capability,
+            entries,
+            sync: status.sync,
+            peers: peers.clone(),
+            policy,
+        };
+        // The journal is stored before the replica is dropped, so a rebuild that is
+        // interrupted is finished by `resume_rebuilds` when the node starts again.
+        let tag = write_journal(engine, namespace, &journal).await?;
+        anyhow::Ok((report, journal, tag))
+    }
+    .await;
+    let (report, journal, tag) = match prepared {
+        Ok(prepared) => prepared,
+        Err(err) => {
+            if status.sync {
+                if let Err(err) = doc.start_sync(node_addrs(peers)).await {
+                    warn!("failed to restart sync of {namespace}: {err:#}");
+                }
+            }
+            return Err(err);
+        }
+    };
+    rebuild(engine, namespace, journal, true).await?;
+    if let Err(err) = engine.blobs.tags().delete(tag).await {
+        warn!("failed to delete purge tag of {namespace}: {err:#}");
+    }
+    Ok(report)
+}
+
+/// The entries of `doc`, without the tombstones older than `cutoff`.
+async fn partition(
+    doc: &iroh_docs::rpc::client::docs::Doc<MemConnector>,
+    cutoff: u64,
+) -> anyhow::Result<(TombstonePurgeReport, Vec<iroh_docs::SignedEntry>)> {
+    let query = iroh_docs::store::Query::all().include_empty().build();
+    let entries = doc
+        .get_many(query)
+        .await?
+        .map_ok(iroh_docs::SignedEntry::from)
+        .try_collect::<Vec<_>>()
+        .await?;
+    let mut report = TombstonePurgeReport {
+        entries: entries.len() as u64,
+        ..Default::default()
+    };
+    let mut keep = Vec::with_capacity(entries.len());
+    for entry in entries {
+        if entry.content_len() == 0 {
+            report.tombstones += 1;
+            if entry.timestamp() < cutoff {
+                report.purged += 1;
+                continue;
+            }
+        }
+        keep.push(entry);
+    }
+    Ok((report, keep))
+}
+
+/// Name of the journal in the collection tagged while a document is rebuilt.
+const JOURNAL_NAME: &str = "journal";
+
+/// Everything needed to rebuild a document, stored until the rebuild is done.
+#[derive(Debug, Serialize, Deserialize)]
+struct RebuildJournal {
+    capability: iroh_docs::Capability,
+    entries: Vec<(iroh_docs::SignedEntry, iroh_docs::ContentStatus)>,
+    /// Whether live sync was running.
+    sync: bool,
+    peers: Vec<iroh_docs::PeerIdBytes>,
+    policy: iroh_docs::store::DownloadPolicy,
+}
+
+/// Store `journal` in a collection with the content of its entries, tagged
+/// `iroh-ffi/purge/<namespace>`.
+///
+/// The content is not referenced by the document while it is rebuilt, the tag keeps garbage
+/// collection away.
+async fn write_journal(
+    engine: &DocsEngine,
+    namespace: iroh_docs::NamespaceId,
+    journal: &RebuildJournal,
+) -> anyhow::Result<iroh_blobs::Tag> {
+    let batch = engine.blobs.batch().await?;
+    let journal_tag = batch.add_bytes(postcard::to_stdvec(journal)?).await?;
+    let mut collection = iroh_blobs::format::collection::Collection::default();
+    collection.push(JOURNAL_NAME.to_string(), *journal_tag.hash());
+    let hashes: HashSet<_> = journal
+        .entries
+        .iter()
+        .map(|(entry, _)| entry.content_hash())
+        .collect();
+    for hash in hashes {
+        collection.push(hash.to_string(), hash);
+    }
+    let tag = iroh_blobs::Tag::from(format!("{PURGE_TAG_PREFIX}{namespace}"));
+    engine
+        .blobs
+        .create_collection(
+            collection,
+            iroh_blobs::util::SetTagOption::Named(tag.clone()),
+            Vec::new(),
+        )
+        .await?;
+    drop(journal_tag);
+    Ok(tag)
+}
+
+/// Finish the rebuilds of documents that were interrupted, e.g. because the node crashed
+/// while purging tombstones.
+pub(crate) async fn resume_rebuilds(engine: &DocsEngine) -> anyhow::Result<()> {
+    let tags = engine
+        .blobs
+        .tags()
+        .list()
+        .await?
+        .try_filter(|tag| {
+            futures::future::ready(tag.name.0.starts_with(PURGE_TAG_PREFIX.as_bytes()))
+        })
+        .try_collect::<Vec<_>>()
+        .await?;
+    for tag in tags {
+        let collection = engine.blobs.get_collection(tag.hash).await?;
+        let Some((_, hash)) = collection.iter().find(|(name, _)| name == JOURNAL_NAME) else {
+            warn!("purge tag {} has no journal", tag.name);
+            continue;
+        };
+        let bytes = engine.blobs.read_to_bytes(*hash).await?;
+        let journal: RebuildJournal = postcard::from_bytes(&bytes)?;
+        let namespace = journal.capability.id();
+        debug!("resuming rebuild of {namespace}");
+        rebuild(engine, namespace, journal, false).await?;
+        engine.blobs.tags().delete(tag.name).await?;
+    }
+    Ok(())
+}
+
+/// Replace the replica of `namespace` with one containing only the entries of `journal`.
+///
+/// Can be run again if it was interrupted. With `reopen`, the new replica is opened on behalf
+/// of the handle the purge was started from.
+async fn rebuild(
+    engine: &DocsEngine,
+    namespace: iroh_docs::NamespaceId,
+    journal: RebuildJournal,
+    reopen: bool,
+) -> anyhow::Result<()> {
+    let exists = engine
+        .client
+        .list()
+        .await?
+        .try_filter(|(id, _)| futures::future::ready(*id == namespace))
+        .try_next()
+        .await?
+        .is_some();
+    if exists {
+        engine.client.drop_doc(namespace).await?;
+    }
+    engine.sync.import_namespace(journal.capability).await?;
+    if reopen {
+        engine.sync.open(namespace, Default::default()).await?;
+    }
+    engine
+        .sync
+        .set_download_policy(namespace, journal.policy)
+        .await?;
+
+    for (entry, content_status) in journal.entries {
+        // keep going, an entry that fails to insert should not take the others with it
+        if let Err(err) = engine
+            .sync
+            .insert_remote(namespace, entry, *engine.node_id.as_bytes(), content_status)
+            .await
+        {
+            warn!("failed to restore entry of {namespace}: {err:#}");
+        }
+    }
+
+    if journal.sync {
+        let doc = engine
+            .client
+            .open(namespace)
+            .await?
+            .ok_or_else(|| anyhow::anyhow!("rebuilt document {namespace} not found"))?;
+        doc.start_sync(node_addrs(journal.peers)).await?;
+        doc.close().await?;
+    }
+    Ok(())
+}
+
+fn node_addrs(peers: Vec<iroh_docs::PeerIdBytes>) -> Vec<iroh::NodeAddr> {
+    peers
+        .into_iter()
+        .filter_map(|peer| iroh::NodeId::from_bytes(&peer).ok())
+        .map(iroh::NodeAddr::new)
+        .collect()
+}
+
+/// Purge the tombstones of all documents of a node according to `policy`.
+///
+/// Documents that are open elsewhere are skipped and tried again in the next round.
+pub(crate) fn spawn_tombstone_purge(
+    engine: DocsEngine,
+    policy: TombstonePurgePolicy,
+    maintenance: Arc<Maintenance>,
+) -> AbortOnDropHandle<()> {
+    let older_than = policy.older_than;
+    spawn_doc_maintenance(
+        engine,
+        policy.interval,
+        maintenance,
+        "tombstone purge",
+        move |engine, doc| async move {
+            let report = purge_tombstones(&engine, &doc, older_than).await?;
+            if report.purged > 0 {
+                debug!("purged {} tombstones from {}", report.purged, doc.id());
+            }
+            Ok(())
+        },
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_purge_tombstones() {
+        let node = local_node().await;
+        let doc = node.docs().create().await.unwrap();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"a".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+        doc.set_bytes(&author, b"b".to_vec(), b"2".to_vec())
+            .await
+            .unwrap();
+        doc.delete(author.clone(), b"a".to_vec()).await.unwrap();
+
+        // the tombstone is too young
+        let report = doc
+            .purge_tombstones(Duration::from_secs(3600))
+            .await
+            .unwrap();
+        assert_eq!(
+            report,
+            TombstonePurgeReport {
+                entries: 2,
+                tombstones: 1,
+                purged: 0,
+            }
+        );
+
+        let report = doc.purge_tombstones(Duration::ZERO).await.unwrap();
+        assert_eq!(report.purged, 1);
+        let tombstone = doc
+            .get_exact(author.clone(), b"a".to_vec(), true)
+            .await
+            .unwrap();
+        assert!(tombstone.is_none());
+        let entry = doc
+            .get_exact(author.clone(), b"b".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = node
+            .blobs()
+            .read_to_bytes(entry.content_hash())
+            .await
+            .unwrap();
+        assert_eq!(content, b"2");
+
+        // the handle stays usable
+        doc.set_bytes(&author, b"a".to_vec(), b"3".to_vec())
+            .await
+            .unwrap();
+        let report = doc.purge_tombstones(Duration::ZERO).await.unwrap();
+        assert_eq!(report.tombstones, 0);
+    }
+
+    #[tokio::test]
+    async fn test_resume_rebuild() {
+        let node = local_node().await;
+        let engine = node.docs_engine.clone().unwrap();
+        let doc = node.docs().create().await.unwrap();
+        let namespace = doc.inner.id();
+        let author = node.authors().create().await.unwrap();
+        doc.set_bytes(&author, b"a".to_vec(), b"1".to_vec())
+            .await
+            .unwrap();
+        let ticket = doc
+            .inner
+            .share(
+                iroh_docs::rpc::client::docs::ShareMode::Write,
+                iroh_docs::rpc::AddrInfoOptions::Id,
+            )
+            .await
+            .unwrap();
+        let (_, keep) = partition(&doc.inner, 0).await.unwrap();
+        let journal = RebuildJournal {
+            capability: ticket.capability,
+            entries: keep
+                .into_iter()
+                .map(|entry| (entry, iroh_docs::ContentStatus::Complete))
+                .collect(),
+            sync: false,
+            peers: Vec::new(),
+            policy: Default::default(),
+        };
+
+        // the node stopped right after dropping the replica
+        let tag = write_journal(&engine, namespace, &journal).await.unwrap();
+        doc.close_me().await.unwrap();
+        engine.client.drop_doc(namespace).await.unwrap();
+
+        resume_rebuilds(&engine).await.unwrap();
+        let doc = node
+            .docs()
+            .open(namespace.to_string())
+            .await
+            .unwrap()
+            .unwrap();
+        let entry = doc
+            .get_exact(author, b"a".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        let content = node
+            .blobs()
+            .read_to_bytes(entry.content_hash())
+            .await
+            .unwrap();
+        assert_eq!(content, b"1");
+        let tags = node.tags().list().await.unwrap();
+        assert!(!tags.iter().any(|t| t.name == tag.0.to_vec()));
+    }
+}
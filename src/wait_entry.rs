@@ -0,0 +1,146 @@
+use std::{sync::Arc, time::Duration};
+
+use futures::TryStreamExt;
+use iroh_docs::rpc::client::docs::LiveEvent;
+
+use crate::{AuthorId, Doc, Entry, IrohError, ReadOnlyDoc};
+
+#[uniffi::export]
+impl Doc {
+    /// Wait until the entry of `author` at `key` has a timestamp of at least `timestamp`.
+    ///
+    /// Lets a reader, e.g. in another process sharing the node, wait for a write it was told
+    /// about: pass the timestamp of the written entry. Returns the entry once it or a newer
+    /// one is stored, right away if it already is. Deletions count as writes, so the entry
+    /// can be empty. Fails if the entry is not written within `timeout`.
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn wait_for_entry(
+        &self,
+        author: Arc<AuthorId>,
+        key: Vec<u8>,
+        timestamp: u64,
+        timeout: Duration,
+    ) -> Result<Arc<Entry>, IrohError> {
+        self.ensure_open()?;
+        let wait = self.wait_written(&author, &key, timestamp);
+        match tokio::time::timeout(timeout, wait).await {
+            Ok(res) => res,
+            Err(_) => Err(anyhow::anyhow!("entry was not written within {timeout:?}").into()),
+        }
+    }
+}
+
+#[uniffi::export]
+impl ReadOnlyDoc {
+    /// Wait until an entry is written, see [`Doc::wait_for_entry`].
+    #[uniffi::method(async_runtime = "tokio")]
+    pub async fn wait_for_entry(
+        &self,
+        author: Arc<AuthorId>,
+        key: Vec<u8>,
+        timestamp: u64,
+        timeout: Duration,
+    ) -> Result<Arc<Entry>, IrohError> {
+        self.doc
+            .wait_for_entry(author, key, timestamp, timeout)
+            .await
+    }
+}
+
+impl Doc {
+    async fn wait_written(
+        &self,
+        author: &Arc<AuthorId>,
+        key: &[u8],
+        timestamp: u64,
+    ) -> Result<Arc<Entry>, IrohError> {
+        // subscribe first, so a write right after the first check is not missed
+        let mut events = self.live_events().await?;
+        if let Some(entry) = self.written(author, key, timestamp).await? {
+            return Ok(entry);
+        }
+        while let Some(event) = events.try_next().await? {
+            let matches = match &event {
+                LiveEvent::InsertLocal { entry } | LiveEvent::InsertRemote { entry, .. } => {
+                    entry.author() == author.0 && entry.key() == key
+                }
+                _ => false,
+            };
+            if !matches {
+                continue;
+            }
+            if let Some(entry) = self.written(author, key, timestamp).await? {
+                return Ok(entry);
+            }
+        }
+        Err(anyhow::anyhow!("the document was closed").into())
+    }
+
+    /// The entry of `author` at `key`, if it has a timestamp of at least `timestamp`.
+    async fn written(
+        &self,
+        author: &Arc<AuthorId>,
+        key: &[u8],
+        timestamp: u64,
+    ) -> Result<Option<Arc<Entry>>, IrohError> {
+        let entry = self.get_exact(author.clone(), key.to_vec(), true).await?;
+        Ok(entry.filter(|entry| entry.timestamp() >= timestamp))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_utils::local_node;
+
+    #[tokio::test]
+    async fn test_wait_for_entry() {
+        let node = local_node().await;
+        let writer = node.docs().create().await.unwrap();
+        let reader = node.docs().open(writer.id()).await.unwrap().unwrap();
+        let author = node.authors().create().await.unwrap();
+
+        writer
+            .set_bytes(&author, b"key".to_vec(), b"first".to_vec())
+            .await
+            .unwrap();
+        let first = writer
+            .get_exact(author.clone(), b"key".to_vec(), false)
+            .await
+            .unwrap()
+            .unwrap();
+        // already written
+        let entry = reader
+            .wait_for_entry(
+                author.clone(),
+                b"key".to_vec(),
+                first.timestamp(),
+                Duration::from_secs(1),
+            )
+            .await
+            .unwrap();
+        assert_eq!(entry.timestamp(), first.timestamp());
+
+        // not written yet
+        let wait = reader.wait_for_entry(
+            author.clone(),
+            b"key".to_vec(),
+            first.timestamp() + 1,
+            Duration::from_secs(5),
+        );
+        let write = async {
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            writer
+                .set_bytes(&author, b"key".to_vec(), b"second".to_vec())
+                .await
+                .unwrap();
+        };
+        let (entry, _) = tokio::join!(wait, write);
+        assert!(entry.unwrap().timestamp() > first.timestamp());
+
+        let res = reader
+            .wait_for_entry(author, b"other".to_vec(), 0, Duration::from_millis(100))
+            .await;
+        assert!(res.is_err());
+    }
+}